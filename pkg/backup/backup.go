@@ -209,7 +209,7 @@ func ToCsvLine2(s [][]string) (string, error) {
 	return ss.String(), nil
 }
 
-func saveTaeFilesList(ctx context.Context, Fs fileservice.FileService, taeFiles []*taeFile, backupTime, backupTS, typ string) error {
+func saveTaeFilesList(ctx context.Context, Fs fileservice.FileService, taeFiles []*taeFile, backupTime, backupTS, typ string, complete bool) error {
 	var err error
 	if Fs == nil {
 		return moerr.NewInternalError(ctx, "fileservice is nil")
@@ -230,7 +230,7 @@ func saveTaeFilesList(ctx context.Context, Fs fileservice.FileService, taeFiles
 	}
 
 	//save tae files size
-	lines = [][]string{taeBackupTimeAndSizeToCsv(backupTime, backupTS, typ, size)}
+	lines = [][]string{taeBackupTimeAndSizeToCsv(backupTime, backupTS, typ, size, complete)}
 	metas, err = ToCsvLine2(lines)
 	if err != nil {
 		return err
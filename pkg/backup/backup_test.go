@@ -16,28 +16,41 @@ package backup
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
 	"github.com/matrixorigin/matrixone/pkg/common/runtime"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
 	"github.com/matrixorigin/matrixone/pkg/defines"
 	"github.com/matrixorigin/matrixone/pkg/fileservice"
 	"github.com/matrixorigin/matrixone/pkg/logservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
 	pb "github.com/matrixorigin/matrixone/pkg/pb/logservice"
 	"github.com/matrixorigin/matrixone/pkg/sql/parsers/tree"
+	"github.com/matrixorigin/matrixone/pkg/sql/plan/function/ctl"
+	"github.com/matrixorigin/matrixone/pkg/util/executor"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/catalog"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/db/testutil"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/iface/handle"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/testutils"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/testutils/config"
 	"github.com/panjf2000/ants/v2"
 	"github.com/prashantv/gostub"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -124,8 +137,9 @@ func TestBackupData(t *testing.T) {
 	for _, location := range files {
 		locations = append(locations, location)
 	}
-	err = execBackup(ctx, "", db.Opts.Fs, service, locations, 1, types.TS{}, "full")
+	err = execBackup(ctx, "", db.Opts.Fs, service, locations, 1, types.TS{}, "full", nil, nil)
 	assert.Nil(t, err)
+	checkBackupFileService(t, ctx, service, locations[2:])
 	db.Opts.Fs = service
 	db.Restart(ctx)
 	txn, rel := testutil.GetDefaultRelation(t, db.DB, schema.Name)
@@ -133,6 +147,202 @@ func TestBackupData(t *testing.T) {
 	assert.NoError(t, txn.Commit(context.Background()))
 }
 
+func TestBackupDataQuota(t *testing.T) {
+	defer testutils.AfterTest(t)()
+	ctx := context.Background()
+
+	opts := config.WithLongScanAndCKPOptsAndQuickGC(nil)
+	db := testutil.NewTestEngine(ctx, ModuleName, t, opts)
+	defer db.Close()
+	defer opts.Fs.Close()
+
+	schema := catalog.MockSchemaAll(13, 3)
+	schema.BlockMaxRows = 10
+	schema.ObjectMaxBlocks = 2
+	db.BindSchema(schema)
+	testutil.CreateRelation(t, db.DB, "db", schema, true)
+	totalRows := uint64(schema.BlockMaxRows * 10)
+	bat := catalog.MockBatch(schema, int(totalRows))
+	defer bat.Close()
+	for _, data := range bat.Split(5) {
+		db.DoAppend(data)
+	}
+	db.ForceLongCheckpoint()
+	bats := bat.Split(10)
+	for _, data := range bats[:2] {
+		txn, rel := db.GetRelation()
+		v := testutil.GetSingleSortKeyValue(data, schema, 2)
+		assert.NoError(t, rel.DeleteByFilter(context.Background(), handle.NewEQFilter(v)))
+		assert.NoError(t, txn.Commit(context.Background()))
+	}
+
+	backupTime := time.Now().UTC()
+	currTs := types.BuildTS(backupTime.UnixNano(), 0)
+	locations := []string{backupTime.Format(time.DateTime)}
+	location, err := db.ForceCheckpointForBackup(ctx, currTs, 20*time.Second)
+	require.NoError(t, err)
+	db.BGCheckpointRunner.DisableCheckpoint()
+	locations = append(locations, location)
+	files := make(map[string]string)
+	for _, candidate := range db.BGCheckpointRunner.GetAllCheckpoints() {
+		files[candidate.GetLocation().Name().String()] = fmt.Sprintf("%s:%d",
+			candidate.GetLocation().String(), candidate.GetVersion())
+	}
+	for _, location := range files {
+		locations = append(locations, location)
+	}
+
+	service, err := fileservice.NewFileService(ctx, fileservice.Config{
+		Name:    defines.LocalFileServiceName,
+		Backend: "DISK",
+		DataDir: path.Join(db.Dir, "/local"),
+	}, nil)
+	require.NoError(t, err)
+	defer service.Close()
+	// Every run copies and writes one object at most, the runs resume
+	// from the journals of the ones before.
+	quota := &BackupQuota{MaxObjects: 1, Journal: "quota"}
+	runs := 0
+	for {
+		runs++
+		require.Less(t, runs, 100)
+		err = execBackup(ctx, "", db.Opts.Fs, service, locations, 1, types.TS{}, "full", nil, quota)
+		if !logtail.IsQuotaExceeded(err) {
+			break
+		}
+	}
+	require.NoError(t, err)
+	require.Greater(t, runs, 2)
+	checkBackupFileService(t, ctx, service, locations[2:])
+	db.Opts.Fs = service
+	db.Restart(ctx)
+	txn, rel := testutil.GetDefaultRelation(t, db.DB, schema.Name)
+	testutil.CheckAllColRowsByScan(t, rel, int(totalRows-2), true)
+	assert.NoError(t, txn.Commit(context.Background()))
+}
+
+// ctlExecutor answers the mo_ctl call of BackupData with result.
+type ctlExecutor struct {
+	result string
+}
+
+func (e *ctlExecutor) Exec(ctx context.Context, sql string, opts executor.Options) (executor.Result, error) {
+	buf, err := json.Marshal(ctl.Result{Method: "Backup", Data: []any{e.result}})
+	if err != nil {
+		return executor.Result{}, err
+	}
+	mp := mpool.MustNewZero()
+	vec := vector.NewVec(types.T_varchar.ToType())
+	if err = vector.AppendBytes(vec, buf, false, mp); err != nil {
+		return executor.Result{}, err
+	}
+	bat := batch.NewWithSize(1)
+	bat.Vecs[0] = vec
+	bat.SetRowCount(1)
+	return executor.Result{Batches: []*batch.Batch{bat}, Mp: mp}, nil
+}
+
+func (e *ctlExecutor) ExecTxn(context.Context, func(executor.TxnExecutor) error, executor.Options) error {
+	return moerr.NewNotSupportedNoCtx("ExecTxn")
+}
+
+func TestBackupDataResolvesTS(t *testing.T) {
+	defer testutils.AfterTest(t)()
+	ctx := context.Background()
+
+	opts := config.WithLongScanAndCKPOptsAndQuickGC(nil)
+	db := testutil.NewTestEngine(ctx, ModuleName, t, opts)
+	defer db.Close()
+	defer opts.Fs.Close()
+
+	schema := catalog.MockSchemaAll(13, 3)
+	schema.BlockMaxRows = 10
+	db.BindSchema(schema)
+	testutil.CreateRelation(t, db.DB, "db", schema, true)
+	bat := catalog.MockBatch(schema, 50)
+	defer bat.Close()
+	db.DoAppend(bat)
+	db.ForceLongCheckpoint()
+
+	// The answer of mo_ctl, as HandleBackup makes it.
+	backupTime := time.Now().UTC()
+	currTs := types.BuildTS(backupTime.UnixNano(), 0)
+	location, err := db.ForceCheckpointForBackup(ctx, currTs, 20*time.Second)
+	require.NoError(t, err)
+	db.BGCheckpointRunner.DisableCheckpoint()
+	result := backupTime.Format(time.DateTime) + ";" + location + ";"
+	for _, entry := range db.BGCheckpointRunner.GetAllCheckpoints() {
+		result += fmt.Sprintf("%s:%d;", entry.GetLocation().String(), entry.GetVersion())
+	}
+	runtime.RunTest("", func(rt runtime.Runtime) {
+		rt.SetGlobalVariables(runtime.InternalSQLExecutor, &ctlExecutor{result: result})
+	})
+
+	backupTS := func(exact bool) string {
+		dir := path.Join(db.Dir, fmt.Sprintf("backup-%t", exact))
+		service, err := fileservice.NewFileService(ctx, fileservice.Config{
+			Name:    defines.LocalFileServiceName,
+			Backend: "DISK",
+			DataDir: dir,
+		}, nil)
+		require.NoError(t, err)
+		defer service.Close()
+		cfg := &Config{Parallelism: 1, BackupType: "full", ExactBackupTS: exact}
+		require.NoError(t, BackupData(ctx, "", db.Opts.Fs, service, "", cfg))
+		data, err := readFileAndCheck(ctx, service, taeSum)
+		require.NoError(t, err)
+		lines, err := fromCsvBytes(data)
+		require.NoError(t, err)
+		return lines[0][2]
+	}
+
+	// The checkpoint taken for the backup starts right after currTs, the
+	// end of the chain before it.
+	require.Equal(t, currTs.ToString(), backupTS(false))
+	require.Equal(t, currTs.Next().ToString(), backupTS(true))
+}
+
+// checkBackupFileService loads the checkpoints of the backup in service
+// and the objects they reference through OpenBackupFileService.
+func checkBackupFileService(t *testing.T, ctx context.Context, service fileservice.FileService, checkpoints []string) {
+	data, err := readFile(ctx, service, taeList)
+	require.NoError(t, err)
+	manifest, err := ManifestFromTaeList(ctx, "backup", data)
+	require.NoError(t, err)
+	fs := OpenBackupFileService(service, &manifest)
+
+	var read int
+	for _, ckp := range checkpoints {
+		ckpStr := strings.Split(ckp, ":")
+		require.Len(t, ckpStr, 2)
+		key, err := blockio.EncodeLocationFromString(ckpStr[0])
+		require.NoError(t, err)
+		version, err := strconv.ParseUint(ckpStr[1], 10, 32)
+		require.NoError(t, err)
+		objects, ckpData, err := logtail.LoadCheckpointEntriesFromKey(ctx, "", fs, key, uint32(version), nil, &types.TS{})
+		require.NoError(t, err)
+		for _, object := range objects {
+			_, err = fs.StatFile(ctx, object.Location.Name().String())
+			require.NoError(t, err)
+			meta, err := objectio.FastLoadObjectMeta(ctx, &object.Location, false, fs)
+			require.NoError(t, err)
+			if _, ok := meta.DataMeta(); !ok {
+				continue
+			}
+			bat, err := blockio.LoadOneBlock(ctx, fs, object.Location, objectio.SchemaData)
+			require.NoError(t, err)
+			read += bat.RowCount()
+		}
+		ckpData.Close()
+	}
+	require.Positive(t, read)
+
+	_, err = fs.StatFile(ctx, taeList)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound))
+	err = fs.Write(ctx, fileservice.IOVector{FilePath: "new"})
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported))
+}
+
 func Test_saveTaeFilesList(t *testing.T) {
 	type args struct {
 		ctx        context.Context
@@ -182,6 +392,7 @@ func Test_saveTaeFilesList(t *testing.T) {
 				assert.NoError(t, err2)
 				assert.Equal(t, lines[0][0], ts)
 				assert.Equal(t, lines[0][1], "0")
+				assert.Equal(t, lines[0][4], "true")
 				return false
 			},
 		},
@@ -234,7 +445,7 @@ func Test_saveTaeFilesList(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.wantErr(t, saveTaeFilesList(tt.args.ctx, tt.args.Fs, tt.args.taeFiles, tt.args.backupTime, tt.args.backupTime, ""), fmt.Sprintf("saveTaeFilesList(%v, %v, %v, %v)", tt.args.ctx, tt.args.Fs, tt.args.taeFiles, tt.args.backupTime))
+			tt.wantErr(t, saveTaeFilesList(tt.args.ctx, tt.args.Fs, tt.args.taeFiles, tt.args.backupTime, tt.args.backupTime, "", true), fmt.Sprintf("saveTaeFilesList(%v, %v, %v, %v)", tt.args.ctx, tt.args.Fs, tt.args.taeFiles, tt.args.backupTime))
 		})
 	}
 }
@@ -638,3 +849,39 @@ func TestBackup(t *testing.T) {
 		})
 	}
 }
+
+func TestAppendRewriteFiles(t *testing.T) {
+	ctx := context.Background()
+	fs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	assert.NoError(t, err)
+	for _, name := range []string{"obj-a", "obj-a_01000", "ckp-1", "ckp-meta"} {
+		assert.NoError(t, writeFile(ctx, fs, name, []byte(name)))
+	}
+	start := types.BuildTS(10, 0)
+	copied := &taeFile{path: "obj-a", size: 100, checksum: []byte{1}, ts: types.BuildTS(1, 0)}
+	untouched := &taeFile{path: "obj-b", size: 7}
+	files := &logtail.RewriteFiles{
+		Rewritten:  []string{"obj-a"},
+		Converted:  []string{"obj-a_01000"},
+		Checkpoint: []string{"ckp-1", "ckp-meta"},
+	}
+	list, err := appendRewriteFiles(ctx, fs, []*taeFile{copied, untouched}, files, start)
+	assert.NoError(t, err)
+
+	paths := make([]string, 0, len(list))
+	for _, file := range list {
+		paths = append(paths, file.path)
+	}
+	// The rewritten object keeps its entry, the others are appended.
+	assert.Equal(t, []string{"obj-a", "obj-b", "obj-a_01000", "ckp-1", "ckp-meta"}, paths)
+	assert.Equal(t, int64(len("obj-a")), copied.size)
+	assert.Nil(t, copied.checksum)
+	assert.True(t, copied.exclusive)
+	assert.Equal(t, start, copied.ts)
+	assert.Equal(t, int64(7), untouched.size)
+	assert.False(t, untouched.exclusive)
+	for _, file := range list[2:] {
+		assert.True(t, file.exclusive)
+		assert.True(t, file.needCopy)
+	}
+}
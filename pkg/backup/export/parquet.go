@@ -0,0 +1,216 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export exports the data of the blocks a backup rewrites to
+// formats read without MatrixOne.
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
+	"github.com/parquet-go/parquet-go"
+)
+
+// ParquetFileName is the name of the Parquet file the block of table
+// tid converted to the object name is exported to.
+func ParquetFileName(tid uint64, name objectio.ObjectName) string {
+	return fmt.Sprintf("%d_%s.parquet", tid, name.String())
+}
+
+// parquetColumn maps a column of a block to a Parquet column, node is
+// its type and value the Parquet value of a row that is not null.
+type parquetColumn struct {
+	node  parquet.Node
+	value func(vec *vector.Vector, row int) parquet.Value
+}
+
+// parquetColumnOf returns the Parquet column of a column of type typ.
+//
+// Integers, floats, bools and strings keep their type, an unsigned
+// integer is written as the unsigned logical type of its width. A date
+// is a DATE, days since the unix epoch, a datetime and a timestamp are
+// a TIMESTAMP in microseconds since the unix epoch, the datetime read
+// as if it were UTC. A decimal and a uuid are written as their text.
+// The other types, json, time, enum and the vector types among them,
+// are not supported and fail the export.
+func parquetColumnOf(typ types.Type) (parquetColumn, error) {
+	switch typ.Oid {
+	case types.T_bool:
+		return parquetColumn{parquet.Leaf(parquet.BooleanType), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.BooleanValue(vector.GetFixedAt[bool](vec, row))
+		}}, nil
+	case types.T_int8:
+		return parquetColumn{parquet.Int(8), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(int32(vector.GetFixedAt[int8](vec, row)))
+		}}, nil
+	case types.T_int16:
+		return parquetColumn{parquet.Int(16), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(int32(vector.GetFixedAt[int16](vec, row)))
+		}}, nil
+	case types.T_int32:
+		return parquetColumn{parquet.Int(32), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(vector.GetFixedAt[int32](vec, row))
+		}}, nil
+	case types.T_int64:
+		return parquetColumn{parquet.Int(64), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int64Value(vector.GetFixedAt[int64](vec, row))
+		}}, nil
+	case types.T_uint8:
+		return parquetColumn{parquet.Uint(8), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(int32(vector.GetFixedAt[uint8](vec, row)))
+		}}, nil
+	case types.T_uint16:
+		return parquetColumn{parquet.Uint(16), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(int32(vector.GetFixedAt[uint16](vec, row)))
+		}}, nil
+	case types.T_uint32:
+		return parquetColumn{parquet.Uint(32), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(int32(vector.GetFixedAt[uint32](vec, row)))
+		}}, nil
+	case types.T_uint64:
+		return parquetColumn{parquet.Uint(64), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int64Value(int64(vector.GetFixedAt[uint64](vec, row)))
+		}}, nil
+	case types.T_float32:
+		return parquetColumn{parquet.Leaf(parquet.FloatType), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.FloatValue(vector.GetFixedAt[float32](vec, row))
+		}}, nil
+	case types.T_float64:
+		return parquetColumn{parquet.Leaf(parquet.DoubleType), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.DoubleValue(vector.GetFixedAt[float64](vec, row))
+		}}, nil
+	case types.T_char, types.T_varchar, types.T_text:
+		return parquetColumn{parquet.String(), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.ByteArrayValue(vec.GetBytesAt(row))
+		}}, nil
+	case types.T_binary, types.T_varbinary, types.T_blob:
+		return parquetColumn{parquet.Leaf(parquet.ByteArrayType), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.ByteArrayValue(vec.GetBytesAt(row))
+		}}, nil
+	case types.T_date:
+		return parquetColumn{parquet.Date(), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int32Value(vector.GetFixedAt[types.Date](vec, row).DaysSinceUnixEpoch())
+		}}, nil
+	case types.T_datetime:
+		return parquetColumn{parquet.Timestamp(parquet.Microsecond), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int64Value(int64(vector.GetFixedAt[types.Datetime](vec, row)) -
+				int64(types.UnixMicroToTimestamp(0)))
+		}}, nil
+	case types.T_timestamp:
+		return parquetColumn{parquet.Timestamp(parquet.Microsecond), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.Int64Value(int64(vector.GetFixedAt[types.Timestamp](vec, row)) -
+				int64(types.UnixMicroToTimestamp(0)))
+		}}, nil
+	case types.T_decimal64:
+		return parquetColumn{parquet.String(), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.ByteArrayValue([]byte(vector.GetFixedAt[types.Decimal64](vec, row).Format(typ.Scale)))
+		}}, nil
+	case types.T_decimal128:
+		return parquetColumn{parquet.String(), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.ByteArrayValue([]byte(vector.GetFixedAt[types.Decimal128](vec, row).Format(typ.Scale)))
+		}}, nil
+	case types.T_uuid:
+		return parquetColumn{parquet.String(), func(vec *vector.Vector, row int) parquet.Value {
+			return parquet.ByteArrayValue([]byte(vector.GetFixedAt[types.Uuid](vec, row).String()))
+		}}, nil
+	}
+	return parquetColumn{}, moerr.NewNotSupportedNoCtx("export of a %s column to parquet", typ.String())
+}
+
+// EncodeParquet encodes the rows of bat as a Parquet file. A column is
+// named after its attr, c<i> when bat has no attrs, and is optional so
+// that its nulls are kept.
+func EncodeParquet(bat *batch.Batch) ([]byte, error) {
+	names := make([]string, len(bat.Vecs))
+	group := make(parquet.Group, len(bat.Vecs))
+	columns := make([]parquetColumn, len(bat.Vecs))
+	for i, vec := range bat.Vecs {
+		names[i] = fmt.Sprintf("c%d", i)
+		if len(bat.Attrs) == len(bat.Vecs) && bat.Attrs[i] != "" {
+			names[i] = bat.Attrs[i]
+		}
+		if _, ok := group[names[i]]; ok {
+			return nil, moerr.NewInternalErrorNoCtx("column %s exported twice", names[i])
+		}
+		column, err := parquetColumnOf(*vec.GetType())
+		if err != nil {
+			return nil, err
+		}
+		columns[i] = column
+		group[names[i]] = parquet.Optional(column.node)
+	}
+	schema := parquet.NewSchema("block", group)
+	// The leaves of a group are ordered by name, not by column.
+	leaves := make([]int, len(bat.Vecs))
+	for i, name := range names {
+		leaf, _ := schema.Lookup(name)
+		leaves[i] = leaf.ColumnIndex
+	}
+
+	var buf bytes.Buffer
+	writer := parquet.NewWriter(&buf, schema)
+	rows := make([]parquet.Row, bat.RowCount())
+	for row := range rows {
+		rows[row] = make(parquet.Row, len(bat.Vecs))
+		for i, vec := range bat.Vecs {
+			value := parquet.NullValue().Level(0, 0, leaves[i])
+			if !vec.IsNull(uint64(row)) {
+				value = columns[i].value(vec, row).Level(0, 1, leaves[i])
+			}
+			rows[row][leaves[i]] = value
+		}
+	}
+	if _, err := writer.WriteRows(rows); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParquetExporter returns the logtail.BlockExporter that writes each
+// block to fs as a Parquet file named by ParquetFileName.
+func ParquetExporter(fs fileservice.FileService) logtail.BlockExporter {
+	return func(ctx context.Context, tid uint64, name objectio.ObjectName, bat *batch.Batch) (string, error) {
+		data, err := EncodeParquet(bat)
+		if err != nil {
+			return "", err
+		}
+		fileName := ParquetFileName(tid, name)
+		if err = fs.Delete(ctx, fileName); err != nil &&
+			!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return "", err
+		}
+		return fileName, fs.Write(ctx, fileservice.IOVector{
+			FilePath: fileName,
+			Entries: []fileservice.IOEntry{
+				{
+					Offset: 0,
+					Size:   int64(len(data)),
+					Data:   data,
+				},
+			},
+		})
+	}
+}
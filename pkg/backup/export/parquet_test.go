@@ -0,0 +1,106 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/defines"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParquetExporter(t *testing.T) {
+	mp := mpool.MustNewZero()
+	date, err := types.ParseDateCast("2024-03-01")
+	require.NoError(t, err)
+	ts, err := types.ParseTimestamp(time.UTC, "2024-03-01 10:20:30.000004", 6)
+	require.NoError(t, err)
+	dec, err := types.ParseDecimal64("12.34", 10, 2)
+	require.NoError(t, err)
+
+	bat := batch.NewWithSize(6)
+	bat.Attrs = []string{"id", "name", "day", "at", "big", "price"}
+	bat.Vecs[0] = vector.NewVec(types.T_int32.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[0], []int32{1, 2}, nil, mp))
+	bat.Vecs[1] = vector.NewVec(types.T_varchar.ToType())
+	require.NoError(t, vector.AppendBytes(bat.Vecs[1], []byte("a"), false, mp))
+	require.NoError(t, vector.AppendBytes(bat.Vecs[1], nil, true, mp))
+	bat.Vecs[2] = vector.NewVec(types.T_date.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[2], []types.Date{date, 0}, []bool{false, true}, mp))
+	bat.Vecs[3] = vector.NewVec(types.T_timestamp.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[3], []types.Timestamp{ts, ts}, nil, mp))
+	bat.Vecs[4] = vector.NewVec(types.T_uint64.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[4], []uint64{math.MaxUint64, 0}, nil, mp))
+	bat.Vecs[5] = vector.NewVec(types.New(types.T_decimal64, 10, 2))
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[5], []types.Decimal64{dec, dec}, nil, mp))
+	bat.SetRowCount(2)
+	defer bat.Clean(mp)
+
+	ctx := context.Background()
+	fs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	file, err := ParquetExporter(fs)(ctx, 1000, name, bat)
+	require.NoError(t, err)
+	require.Equal(t, ParquetFileName(1000, name), file)
+
+	iov := &fileservice.IOVector{
+		FilePath: file,
+		Entries:  []fileservice.IOEntry{{Size: -1}},
+	}
+	require.NoError(t, fs.Read(ctx, iov))
+	buf := iov.Entries[0].Data
+	pf, err := parquet.OpenFile(bytes.NewReader(buf), int64(len(buf)))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), pf.NumRows())
+	rows := make([]parquet.Row, 2)
+	reader := pf.RowGroups()[0].Rows()
+	n, _ := reader.ReadRows(rows)
+	require.Equal(t, 2, n)
+	require.NoError(t, reader.Close())
+	column := func(row int, name string) parquet.Value {
+		leaf, ok := pf.Schema().Lookup(name)
+		require.True(t, ok, name)
+		return rows[row][leaf.ColumnIndex]
+	}
+
+	require.Equal(t, int32(1), column(0, "id").Int32())
+	require.Equal(t, int32(2), column(1, "id").Int32())
+	require.Equal(t, "a", string(column(0, "name").ByteArray()))
+	require.True(t, column(1, "name").IsNull())
+	require.Equal(t, date.DaysSinceUnixEpoch(), column(0, "day").Int32())
+	require.True(t, column(1, "day").IsNull())
+	at := time.UnixMicro(column(0, "at").Int64()).UTC()
+	require.Equal(t, "2024-03-01 10:20:30.000004", at.Format("2006-01-02 15:04:05.000000"))
+	require.Equal(t, uint64(math.MaxUint64), column(0, "big").Uint64())
+	require.Equal(t, "12.34", string(column(1, "price").ByteArray()))
+
+	unsupported := batch.NewWithSize(1)
+	unsupported.Vecs[0] = vector.NewVec(types.T_json.ToType())
+	_, err = EncodeParquet(unsupported)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported))
+}
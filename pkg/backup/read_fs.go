@@ -0,0 +1,156 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"path"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// backupFS is a read only FileService over the files of one backup set.
+type backupFS struct {
+	upstream fileservice.FileService
+	files    map[string]struct{}
+}
+
+// OpenBackupFileService returns a read only FileService over the files
+// manifest lists in base, so that the checkpoint and object readers can
+// load a backup set as they load a cluster. The shared entries are
+// read from base too, where the earlier backup copied them. A file that
+// is not in manifest is reported as not found, even when base has it.
+func OpenBackupFileService(base fileservice.FileService, manifest *Manifest) fileservice.FileService {
+	files := make(map[string]struct{}, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		files[path.Clean(entry.Path)] = struct{}{}
+	}
+	return &backupFS{
+		upstream: base,
+		files:    files,
+	}
+}
+
+var _ fileservice.FileService = new(backupFS)
+
+func (b *backupFS) Name() string {
+	return b.upstream.Name()
+}
+
+// resolve returns the upstream path of the file p of the backup set.
+func (b *backupFS) resolve(p string) (string, error) {
+	parsed, err := fileservice.ParsePathAtService(p, b.upstream.Name())
+	if err != nil {
+		return "", err
+	}
+	if _, ok := b.files[path.Clean(parsed.File)]; !ok {
+		return "", moerr.NewFileNotFoundNoCtx(p)
+	}
+	return parsed.File, nil
+}
+
+func (b *backupFS) Close() {
+}
+
+func (b *backupFS) Write(_ context.Context, vector fileservice.IOVector) error {
+	return moerr.NewNotSupportedNoCtx("write %s to a backup set", vector.FilePath)
+}
+
+func (b *backupFS) Read(ctx context.Context, vector *fileservice.IOVector) error {
+	p, err := b.resolve(vector.FilePath)
+	if err != nil {
+		return err
+	}
+	upstream := *vector
+	upstream.FilePath = p
+	err = b.upstream.Read(ctx, &upstream)
+	vector.Entries = upstream.Entries
+	return err
+}
+
+func (b *backupFS) ReadCache(ctx context.Context, vector *fileservice.IOVector) error {
+	p, err := b.resolve(vector.FilePath)
+	if err != nil {
+		return err
+	}
+	upstream := *vector
+	upstream.FilePath = p
+	err = b.upstream.ReadCache(ctx, &upstream)
+	vector.Entries = upstream.Entries
+	return err
+}
+
+// List lists the entries of dirPath that belong to the backup set, and
+// the directories that contain some.
+func (b *backupFS) List(ctx context.Context, dirPath string) ([]fileservice.DirEntry, error) {
+	entries, err := b.upstream.List(ctx, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := fileservice.ParsePathAtService(dirPath, b.upstream.Name())
+	if err != nil {
+		return nil, err
+	}
+	listed := entries[:0]
+	for _, entry := range entries {
+		name := path.Join(parsed.File, entry.Name)
+		if entry.IsDir {
+			if b.hasDir(name) {
+				listed = append(listed, entry)
+			}
+			continue
+		}
+		if _, ok := b.files[name]; ok {
+			listed = append(listed, entry)
+		}
+	}
+	return listed, nil
+}
+
+func (b *backupFS) hasDir(dir string) bool {
+	for file := range b.files {
+		for d := path.Dir(file); d != "." && d != "/"; d = path.Dir(d) {
+			if d == dir {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *backupFS) Delete(_ context.Context, filePaths ...string) error {
+	return moerr.NewNotSupportedNoCtx("delete %v from a backup set", filePaths)
+}
+
+func (b *backupFS) StatFile(ctx context.Context, filePath string) (*fileservice.DirEntry, error) {
+	p, err := b.resolve(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return b.upstream.StatFile(ctx, p)
+}
+
+func (b *backupFS) PrefetchFile(ctx context.Context, filePath string) error {
+	p, err := b.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	return b.upstream.PrefetchFile(ctx, p)
+}
+
+func (b *backupFS) Cost() *fileservice.CostAttr {
+	return b.upstream.Cost()
+}
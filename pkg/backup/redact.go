@@ -0,0 +1,186 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"path"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// redactedPrefix starts the redacted name of a file.
+const redactedPrefix = "redacted-"
+
+// ManifestRedactor redacts the names of the files of a manifest, for a
+// backup shared for support without the table and segment ids the
+// object names carry. A name is encrypted with a nonce derived from
+// it, so that a file has the same redacted name wherever it is listed
+// and the manifests stay consistent with each other, e.g. for
+// ComputeBackupRetention. The directory of a file is kept. Only the
+// holder of the key can restore the names.
+type ManifestRedactor struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// NewManifestRedactor returns the redactor of key, which can be of any
+// length but not empty.
+func NewManifestRedactor(key []byte) (*ManifestRedactor, error) {
+	if len(key) == 0 {
+		return nil, moerr.NewInvalidInputNoCtx("empty manifest redaction key")
+	}
+	encKey := deriveRedactionKey(key, "encrypt")
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestRedactor{
+		aead: aead,
+		mac:  deriveRedactionKey(key, "nonce"),
+	}, nil
+}
+
+func deriveRedactionKey(key []byte, use string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("backup manifest redaction " + use))
+	return mac.Sum(nil)
+}
+
+func (r *ManifestRedactor) nonce(name string) []byte {
+	mac := hmac.New(sha256.New, r.mac)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:r.aead.NonceSize()]
+}
+
+// RedactPath returns the redacted path of the file p.
+func (r *ManifestRedactor) RedactPath(p string) string {
+	dir, name := path.Split(p)
+	nonce := r.nonce(name)
+	sealed := r.aead.Seal(nonce, nonce, []byte(name), nil)
+	return dir + redactedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// RestorePath returns the path RedactPath redacted to p, it fails if p
+// was not redacted with the key of r.
+func (r *ManifestRedactor) RestorePath(p string) (string, error) {
+	dir, name := path.Split(p)
+	if !strings.HasPrefix(name, redactedPrefix) {
+		return "", moerr.NewInvalidInputNoCtx("path %s is not redacted", p)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(name, redactedPrefix))
+	if err != nil || len(sealed) < r.aead.NonceSize() {
+		return "", moerr.NewInvalidInputNoCtx("path %s is not redacted", p)
+	}
+	nonce := sealed[:r.aead.NonceSize()]
+	plain, err := r.aead.Open(nil, nonce, sealed[r.aead.NonceSize():], nil)
+	if err != nil || !hmac.Equal(nonce, r.nonce(string(plain))) {
+		return "", moerr.NewInvalidInputNoCtx("path %s is not redacted with this key", p)
+	}
+	return dir + string(plain), nil
+}
+
+// RedactManifest returns manifest with the paths of its entries
+// redacted.
+func (r *ManifestRedactor) RedactManifest(manifest Manifest) Manifest {
+	redacted := Manifest{
+		Name:    manifest.Name,
+		Entries: make([]ManifestEntry, 0, len(manifest.Entries)),
+	}
+	for _, entry := range manifest.Entries {
+		entry.Path = r.RedactPath(entry.Path)
+		redacted.Entries = append(redacted.Entries, entry)
+	}
+	return redacted
+}
+
+// RestoreManifest returns the manifest RedactManifest redacted to
+// manifest.
+func (r *ManifestRedactor) RestoreManifest(manifest Manifest) (Manifest, error) {
+	restored := Manifest{
+		Name:    manifest.Name,
+		Entries: make([]ManifestEntry, 0, len(manifest.Entries)),
+	}
+	for _, entry := range manifest.Entries {
+		var err error
+		if entry.Path, err = r.RestorePath(entry.Path); err != nil {
+			return Manifest{}, err
+		}
+		restored.Entries = append(restored.Entries, entry)
+	}
+	return restored, nil
+}
+
+// RedactTaeList returns the tae_list data with the paths of its files
+// redacted, the other columns are kept.
+func (r *ManifestRedactor) RedactTaeList(data []byte) ([]byte, error) {
+	return mapTaeListPaths(data, func(p string) (string, error) {
+		return r.RedactPath(p), nil
+	})
+}
+
+// RestoreTaeList returns the tae_list RedactTaeList redacted to data.
+func (r *ManifestRedactor) RestoreTaeList(data []byte) ([]byte, error) {
+	return mapTaeListPaths(data, r.RestorePath)
+}
+
+func mapTaeListPaths(data []byte, fn func(string) (string, error)) ([]byte, error) {
+	lines, err := fromCsvBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if len(line) <= taeListPathPos {
+			return nil, moerr.NewInternalErrorNoCtx("invalid tae list line %v", line)
+		}
+		if line[taeListPathPos], err = fn(line[taeListPathPos]); err != nil {
+			return nil, err
+		}
+	}
+	mapped, err := ToCsvLine2(lines)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(mapped), nil
+}
+
+// saveRedactedTaeList writes the tae_list of the backup in fs redacted
+// with key next to it, as taeListRedacted.
+func saveRedactedTaeList(ctx context.Context, fs fileservice.FileService, key []byte) error {
+	redactor, err := NewManifestRedactor(key)
+	if err != nil {
+		return err
+	}
+	data, err := readFile(ctx, fs, taeList)
+	if err != nil {
+		return err
+	}
+	redacted, err := redactor.RedactTaeList(data)
+	if err != nil {
+		return err
+	}
+	return writeFile(ctx, fs, taeListRedacted, redacted)
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/matrixorigin/matrixone/pkg/defines"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestRedactor(t *testing.T) {
+	ctx := context.Background()
+	redactor, err := NewManifestRedactor([]byte("support key"))
+	require.NoError(t, err)
+	_, err = NewManifestRedactor(nil)
+	assert.Error(t, err)
+
+	names := []string{
+		"0190f6a2-1b4c-7c3e-9d4e-5f6a7b8c9d0e_00000",
+		"0190f6a2-1b4c-7c3e-9d4e-5f6a7b8c9d0f_00001",
+		"0190f6a2-1b4c-7c3e-9d4e-5f6a7b8c9d10_00000",
+	}
+	b1 := []*taeFile{
+		{path: names[0], size: 10, needCopy: true},
+		{path: names[1], size: 20, needCopy: true},
+		{path: "ckp/meta_0-0_1-0.ckp", size: 1, needCopy: true, exclusive: true},
+	}
+	b2 := []*taeFile{
+		{path: names[0], size: 10, needCopy: false},
+		{path: names[2], size: 30, needCopy: true, exclusive: true},
+	}
+	lines, _ := taeFileListToCsv(b1)
+	data, err := ToCsvLine2(lines)
+	require.NoError(t, err)
+
+	redacted, err := redactor.RedactTaeList([]byte(data))
+	require.NoError(t, err)
+	for _, name := range append(names, "meta_0-0_1-0.ckp") {
+		assert.NotContains(t, string(redacted), name)
+	}
+	// The directory is kept.
+	assert.Contains(t, string(redacted), "ckp/"+redactedPrefix)
+	restored, err := redactor.RestoreTaeList(redacted)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(restored))
+
+	// Another key cannot restore the names.
+	other, err := NewManifestRedactor([]byte("another key"))
+	require.NoError(t, err)
+	_, err = other.RestoreTaeList(redacted)
+	assert.Error(t, err)
+	_, err = redactor.RestorePath(names[0])
+	assert.Error(t, err)
+
+	// The redacted manifests are consistent with each other, the same
+	// file has the same redacted name in both.
+	manifests := []Manifest{
+		redactor.RedactManifest(manifestFromFiles(t, "b1", b1)),
+		redactor.RedactManifest(manifestFromFiles(t, "b2", b2)),
+	}
+	assert.Equal(t, manifests[0].Entries[0].Path, manifests[1].Entries[0].Path)
+	assert.True(t, manifests[1].Entries[0].Shared)
+	expected := ComputeBackupRetention([]Manifest{
+		manifestFromFiles(t, "b1", b1),
+		manifestFromFiles(t, "b2", b2),
+	}, []string{"b2"})
+	deletable := ComputeBackupRetention(manifests, []string{"b2"})
+	require.Equal(t, len(expected), len(deletable))
+	for name, paths := range deletable {
+		restoredPaths := make([]string, 0, len(paths))
+		for _, p := range paths {
+			restoredPath, err := redactor.RestorePath(p)
+			require.NoError(t, err)
+			restoredPaths = append(restoredPaths, restoredPath)
+		}
+		assert.ElementsMatch(t, expected[name], restoredPaths)
+	}
+	manifest, err := redactor.RestoreManifest(manifests[1])
+	require.NoError(t, err)
+	assert.Equal(t, manifestFromFiles(t, "b2", b2), manifest)
+
+	// The backup writes the redacted list next to its tae_list.
+	fs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+	require.NoError(t, writeFile(ctx, fs, taeList, []byte(data)))
+	require.NoError(t, saveRedactedTaeList(ctx, fs, []byte("support key")))
+	saved, err := readFileAndCheck(ctx, fs, taeListRedacted)
+	require.NoError(t, err)
+	assert.Equal(t, redacted, saved)
+	assert.False(t, strings.Contains(string(saved), names[1]))
+}
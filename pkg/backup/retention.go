@@ -0,0 +1,197 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+)
+
+// tae_list columns
+const (
+	taeListPathPos      = 0
+	taeListNeedCopyPos  = 3
+	taeListExclusivePos = 5
+)
+
+// Manifest is the tae file list of one backup.
+type Manifest struct {
+	Name    string
+	Entries []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Path string
+	// Shared entries were copied by an earlier backup, this one only
+	// references them.
+	Shared bool
+	// Exclusive entries are rewritten for this backup, the checkpoint
+	// and the converted blocks, no other backup references them.
+	Exclusive bool
+}
+
+// ManifestFromTaeList parses the tae_list file of the backup name.
+// Lists written before the exclusive column existed are accepted, none
+// of their entries is exclusive then.
+func ManifestFromTaeList(ctx context.Context, name string, data []byte) (Manifest, error) {
+	lines, err := fromCsvBytes(data)
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest := Manifest{
+		Name:    name,
+		Entries: make([]ManifestEntry, 0, len(lines)),
+	}
+	for _, line := range lines {
+		if len(line) <= taeListNeedCopyPos {
+			return Manifest{}, moerr.NewInternalError(ctx, "invalid tae list line %v", line)
+		}
+		needCopy, err := strconv.ParseBool(line[taeListNeedCopyPos])
+		if err != nil {
+			return Manifest{}, err
+		}
+		entry := ManifestEntry{
+			Path:   line[taeListPathPos],
+			Shared: !needCopy,
+		}
+		if len(line) > taeListExclusivePos {
+			if entry.Exclusive, err = strconv.ParseBool(line[taeListExclusivePos]); err != nil {
+				return Manifest{}, err
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	return manifest, nil
+}
+
+// ManifestSummary is the compact report of a manifest, see
+// Manifest.Summary. Tools parse its JSON, the field names are stable.
+type ManifestSummary struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	// Copied entries are those not Shared.
+	Copied    int `json:"copied"`
+	Shared    int `json:"shared"`
+	Exclusive int `json:"exclusive"`
+	// Dirs counts the entries by directory, sorted by directory. The
+	// objects are in ".", the root of the backup.
+	Dirs []ManifestDirCount `json:"dirs"`
+}
+
+type ManifestDirCount struct {
+	Dir     string `json:"dir"`
+	Entries int    `json:"entries"`
+}
+
+// Summary returns the compact report of m.
+func (m Manifest) Summary() ManifestSummary {
+	summary := ManifestSummary{
+		Name:    m.Name,
+		Entries: len(m.Entries),
+		Dirs:    []ManifestDirCount{},
+	}
+	dirs := make(map[string]int)
+	for _, entry := range m.Entries {
+		if entry.Shared {
+			summary.Shared++
+		} else {
+			summary.Copied++
+		}
+		if entry.Exclusive {
+			summary.Exclusive++
+		}
+		dirs[path.Dir(entry.Path)]++
+	}
+	for dir, entries := range dirs {
+		summary.Dirs = append(summary.Dirs, ManifestDirCount{Dir: dir, Entries: entries})
+	}
+	sort.Slice(summary.Dirs, func(i, j int) bool {
+		return summary.Dirs[i].Dir < summary.Dirs[j].Dir
+	})
+	return summary
+}
+
+// String returns the summary of m on one line, for the logs.
+func (m Manifest) String() string {
+	return m.Summary().String()
+}
+
+func (s ManifestSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backup %s: %d entries, copied=%d shared=%d exclusive=%d",
+		s.Name, s.Entries, s.Copied, s.Shared, s.Exclusive)
+	if len(s.Dirs) > 0 {
+		b.WriteString(", dirs")
+		for _, dir := range s.Dirs {
+			fmt.Fprintf(&b, " %s=%d", dir.Dir, dir.Entries)
+		}
+	}
+	return b.String()
+}
+
+// ComputeBackupRetention returns, per backup, the objects that can be
+// deleted when only the backups named in keep are kept.
+//
+// An object copied by a dropped backup stays as long as a kept backup
+// shares it. Exclusive objects are never shared, even if a kept backup
+// lists the same path, it has its own copy.
+func ComputeBackupRetention(manifests []Manifest, keep []string) map[string][]string {
+	kept := make(map[string]struct{}, len(keep))
+	for _, name := range keep {
+		kept[name] = struct{}{}
+	}
+	referenced := make(map[string]struct{})
+	for _, manifest := range manifests {
+		if _, ok := kept[manifest.Name]; !ok {
+			continue
+		}
+		for _, entry := range manifest.Entries {
+			if entry.Shared && !entry.Exclusive {
+				referenced[entry.Path] = struct{}{}
+			}
+		}
+	}
+
+	deletable := make(map[string][]string)
+	for _, manifest := range manifests {
+		if _, ok := kept[manifest.Name]; ok {
+			continue
+		}
+		paths := make([]string, 0)
+		for _, entry := range manifest.Entries {
+			if entry.Shared {
+				// Owned by the backup that copied it.
+				continue
+			}
+			if !entry.Exclusive {
+				if _, ok := referenced[entry.Path]; ok {
+					continue
+				}
+			}
+			paths = append(paths, entry.Path)
+		}
+		if len(paths) > 0 {
+			sort.Strings(paths)
+			deletable[manifest.Name] = paths
+		}
+	}
+	return deletable
+}
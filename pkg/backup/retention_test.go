@@ -0,0 +1,119 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func manifestFromFiles(t *testing.T, name string, files []*taeFile) Manifest {
+	lines, _ := taeFileListToCsv(files)
+	data, err := ToCsvLine2(lines)
+	assert.NoError(t, err)
+	manifest, err := ManifestFromTaeList(context.Background(), name, []byte(data))
+	assert.NoError(t, err)
+	return manifest
+}
+
+func TestComputeBackupRetention(t *testing.T) {
+	// b2 and b3 are incremental on top of b1, both rewrote the same
+	// aBlock into a converted object x.
+	manifests := []Manifest{
+		manifestFromFiles(t, "b1", []*taeFile{
+			{path: "a", needCopy: true},
+			{path: "b", needCopy: true},
+			{path: "c", needCopy: true},
+			{path: "ckp1", needCopy: true, exclusive: true},
+		}),
+		manifestFromFiles(t, "b2", []*taeFile{
+			{path: "a", needCopy: false},
+			{path: "d", needCopy: true},
+			{path: "x", needCopy: true, exclusive: true},
+			{path: "ckp2", needCopy: true, exclusive: true},
+		}),
+		manifestFromFiles(t, "b3", []*taeFile{
+			{path: "a", needCopy: false},
+			{path: "d", needCopy: false},
+			{path: "e", needCopy: true},
+			{path: "x", needCopy: true, exclusive: true},
+			{path: "ckp3", needCopy: true, exclusive: true},
+		}),
+	}
+	assert.True(t, manifests[1].Entries[0].Shared)
+	assert.True(t, manifests[1].Entries[2].Exclusive)
+
+	assert.Equal(t, map[string][]string{
+		"b1": {"b", "c", "ckp1"},
+		"b2": {"ckp2", "x"},
+	}, ComputeBackupRetention(manifests, []string{"b3"}))
+
+	assert.Equal(t, map[string][]string{
+		"b1": {"b", "c", "ckp1"},
+		"b3": {"ckp3", "e", "x"},
+	}, ComputeBackupRetention(manifests, []string{"b2"}))
+
+	assert.Equal(t, map[string][]string{
+		"b2": {"ckp2", "x"},
+	}, ComputeBackupRetention(manifests, []string{"b1", "b3"}))
+
+	assert.Empty(t, ComputeBackupRetention(manifests, []string{"b1", "b2", "b3"}))
+}
+
+func TestManifestFromOldTaeList(t *testing.T) {
+	manifest, err := ManifestFromTaeList(context.Background(), "old",
+		[]byte("a,1,01,true,0-0\nb,1,01,false,0-0\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []ManifestEntry{{Path: "a"}, {Path: "b", Shared: true}}, manifest.Entries)
+}
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files of the tests")
+
+// requireGolden compares got to the golden file testdata/name, which
+// -update-golden rewrites instead.
+func requireGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+}
+
+func TestManifestSummary(t *testing.T) {
+	manifest := manifestFromFiles(t, "b2", []*taeFile{
+		{path: "a", needCopy: false},
+		{path: "b", needCopy: true},
+		{path: "x", needCopy: true, exclusive: true},
+		{path: "ckp/meta_0-0_1-0.ckp", needCopy: true, exclusive: true},
+		{path: "ckp/meta_1-0_2-0.ckp", needCopy: true, exclusive: true},
+	})
+	requireGolden(t, "manifest_summary.golden", []byte(manifest.String()+"\n"))
+	data, err := json.MarshalIndent(manifest.Summary(), "", "  ")
+	require.NoError(t, err)
+	requireGolden(t, "manifest_summary.json.golden", append(data, '\n'))
+
+	data, err = json.Marshal(Manifest{Name: "empty"}.Summary())
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"empty","entries":0,"copied":0,"shared":0,"exclusive":0,"dirs":[]}`, string(data))
+}
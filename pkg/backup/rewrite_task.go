@@ -0,0 +1,227 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/logutil"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/pb/task"
+	"github.com/matrixorigin/matrixone/pkg/taskservice"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
+)
+
+const rewriteTaskIDPrefix = "checkpoint-rewrite-"
+
+// rewriteStatusInterval is how often the progress of a phase that goes
+// object by object is saved.
+const rewriteStatusInterval = time.Second
+
+// RewriteTask is the checkpoint rewrite a task runs, it is the context
+// of the task. It holds the options of the rewrite that can be saved.
+type RewriteTask struct {
+	SID        string
+	CNLocation objectio.Location
+	TNLocation objectio.Location
+	Version    uint32
+	TS         types.TS
+
+	VerifySort      bool
+	StrictBlockLoad bool
+	SkipExisting    bool
+	Projection      map[uint64][]uint16
+	MaxOpenWriters  int
+}
+
+func (t *RewriteTask) options() []logtail.BackupOption {
+	opts := make([]logtail.BackupOption, 0)
+	if t.VerifySort {
+		opts = append(opts, logtail.WithVerifySort())
+	}
+	if t.StrictBlockLoad {
+		opts = append(opts, logtail.WithStrictBlockLoad())
+	}
+	if t.SkipExisting {
+		opts = append(opts, logtail.WithSkipExisting())
+	}
+	if len(t.Projection) > 0 {
+		opts = append(opts, logtail.WithColumnProjection(t.Projection))
+	}
+	if t.MaxOpenWriters > 0 {
+		opts = append(opts, logtail.WithMaxOpenWriters(t.MaxOpenWriters))
+	}
+	return opts
+}
+
+// RewriteStatus is the progress of a rewrite task, and its outcome
+// once Finished.
+type RewriteStatus struct {
+	logtail.RewriteProgress
+	Finished bool
+	// Error is set when the rewrite failed or was canceled.
+	Error      string
+	CNLocation objectio.Location
+	TNLocation objectio.Location
+	Result     *logtail.RewriteResult
+}
+
+// SubmitCheckpointRewrite creates a task that runs the rewrite t and
+// returns its id right away. code is the executor the task runners
+// registered RewriteTaskExecutor for.
+func SubmitCheckpointRewrite(
+	ctx context.Context,
+	service taskservice.TaskService,
+	code task.TaskCode,
+	t RewriteTask,
+) (string, error) {
+	buf, err := json.Marshal(&t)
+	if err != nil {
+		return "", err
+	}
+	uid, err := uuid.NewV7()
+	if err != nil {
+		return "", err
+	}
+	id := rewriteTaskIDPrefix + uid.String()
+	if err = service.CreateAsyncTask(ctx, task.TaskMetadata{
+		ID:       id,
+		Executor: code,
+		Context:  buf,
+	}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RewriteTaskExecutor returns the executor of the tasks created by
+// SubmitCheckpointRewrite, it rewrites from srcFs to dstFs and saves
+// the status of the task in dstFs. The runner cancels a task through
+// its context, which the rewrite checks between objects. A task that
+// is run again, e.g. after its runner died, reuses the objects the
+// earlier run converted.
+func RewriteTaskExecutor(srcFs, dstFs fileservice.FileService) taskservice.TaskExecutor {
+	return func(ctx context.Context, t task.Task) error {
+		metadata := t.GetMetadata()
+		var rewrite RewriteTask
+		if err := json.Unmarshal(metadata.Context, &rewrite); err != nil {
+			return err
+		}
+		if async, ok := t.(*task.AsyncTask); ok && async.Epoch > 1 {
+			rewrite.SkipExisting = true
+		}
+		return runRewriteTask(ctx, srcFs, dstFs, metadata.ID, &rewrite)
+	}
+}
+
+func runRewriteTask(
+	ctx context.Context,
+	srcFs, dstFs fileservice.FileService,
+	id string,
+	rewrite *RewriteTask,
+) error {
+	status := &RewriteStatus{}
+	var saved time.Time
+	save := func(ctx context.Context) {
+		saved = time.Now()
+		if err := saveRewriteStatus(ctx, dstFs, id, status); err != nil {
+			logutil.Warn("backup", common.OperationField("save rewrite status"),
+				common.AnyField("task", id),
+				common.AnyField("error", err))
+		}
+	}
+	result := &logtail.RewriteResult{}
+	opts := append(rewrite.options(),
+		logtail.WithRewriteResult(result),
+		logtail.WithProgress(func(progress logtail.RewriteProgress) {
+			phaseChanged := progress.Phase != status.Phase
+			status.RewriteProgress = progress
+			if phaseChanged || time.Since(saved) >= rewriteStatusInterval {
+				save(ctx)
+			}
+		}))
+	cnLocation, tnLocation, _, err := logtail.ReWriteCheckpointAndBlockFromKey(ctx, rewrite.SID, srcFs, dstFs,
+		rewrite.CNLocation, rewrite.TNLocation, rewrite.Version, rewrite.TS, nil, opts...)
+	status.Finished = true
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.CNLocation = cnLocation
+		status.TNLocation = tnLocation
+		status.Result = result
+	}
+	// The status of a canceled task is saved all the same.
+	save(context.WithoutCancel(ctx))
+	return err
+}
+
+func rewriteStatusName(id string) string {
+	return logtail.BackupAuxName(logtail.BackupAuxRewriteTask, id)
+}
+
+func saveRewriteStatus(ctx context.Context, fs fileservice.FileService, id string, status *RewriteStatus) error {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	// The status is the state of the task, stamped when it is saved.
+	buf, err := logtail.EncodeBackupAux(logtail.BackupAuxRewriteTask, types.BuildTS(time.Now().UnixNano(), 0), payload)
+	if err != nil {
+		return err
+	}
+	name := rewriteStatusName(id)
+	if err = fs.Delete(ctx, name); err != nil && !moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return err
+	}
+	return fs.Write(ctx, fileservice.IOVector{
+		FilePath: name,
+		Entries: []fileservice.IOEntry{
+			{
+				Size: int64(len(buf)),
+				Data: buf,
+			},
+		},
+	})
+}
+
+// QueryRewriteStatus returns the status the rewrite task id saved in
+// fs, the destination of the rewrite. A task that did not start yet
+// has a zero status.
+func QueryRewriteStatus(ctx context.Context, fs fileservice.FileService, id string) (*RewriteStatus, error) {
+	name := rewriteStatusName(id)
+	buf, err := readFile(ctx, fs, name)
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return &RewriteStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, payload, err := logtail.DecodeBackupAux(name, logtail.BackupAuxRewriteTask, buf)
+	if err != nil {
+		return nil, err
+	}
+	status := &RewriteStatus{}
+	if err = json.Unmarshal(payload, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
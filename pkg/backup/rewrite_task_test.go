@@ -0,0 +1,124 @@
+// Copyright 2023 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/common/runtime"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/defines"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/pb/task"
+	"github.com/matrixorigin/matrixone/pkg/taskservice"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointRewriteTask(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	srcFs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+	dstFs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+
+	data := logtail.NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	cnLocation, tnLocation, _, err := data.WriteTo(srcFs, logtail.DefaultCheckpointBlockRows, logtail.DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	service := taskservice.NewTaskService(runtime.DefaultRuntime(), taskservice.NewMemTaskStorage())
+	defer service.Close()
+	rewrite := RewriteTask{
+		CNLocation:     cnLocation,
+		TNLocation:     tnLocation,
+		Version:        logtail.CheckpointCurrentVersion,
+		TS:             types.BuildTS(10, 1),
+		VerifySort:     true,
+		Projection:     map[uint64][]uint16{1: {0, 2}},
+		MaxOpenWriters: 2,
+	}
+	id, err := SubmitCheckpointRewrite(ctx, service, task.TaskCode_TestOnly, rewrite)
+	require.NoError(t, err)
+
+	tasks, err := service.QueryAsyncTask(ctx, taskservice.WithTaskMetadataId(taskservice.EQ, id))
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	var submitted RewriteTask
+	require.NoError(t, json.Unmarshal(tasks[0].Metadata.Context, &submitted))
+	require.Equal(t, rewrite, submitted)
+
+	status, err := QueryRewriteStatus(ctx, dstFs, id)
+	require.NoError(t, err)
+	require.Equal(t, &RewriteStatus{}, status)
+
+	// Standing in for the task runner.
+	executor := RewriteTaskExecutor(srcFs, dstFs)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = executor(canceled, &tasks[0])
+	require.ErrorIs(t, err, context.Canceled)
+	status, err = QueryRewriteStatus(ctx, dstFs, id)
+	require.NoError(t, err)
+	require.True(t, status.Finished)
+	require.NotEmpty(t, status.Error)
+	require.Nil(t, status.Result)
+
+	tasks[0].Epoch = 2
+	require.NoError(t, executor(ctx, &tasks[0]))
+	status, err = QueryRewriteStatus(ctx, dstFs, id)
+	require.NoError(t, err)
+	require.True(t, status.Finished)
+	require.Empty(t, status.Error)
+	// Nothing to trim, the rewrite stops after the trim phase.
+	require.Equal(t, 3, status.Phase)
+	require.Equal(t, cnLocation, status.CNLocation)
+	require.Equal(t, tnLocation, status.TNLocation)
+	require.NotNil(t, status.Result)
+}
+
+func TestRewriteStatusHeader(t *testing.T) {
+	ctx := context.Background()
+	fs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+
+	saved := &RewriteStatus{Finished: true, Error: "canceled"}
+	require.NoError(t, saveRewriteStatus(ctx, fs, "task", saved))
+	buf, err := readFile(ctx, fs, rewriteStatusName("task"))
+	require.NoError(t, err)
+	header, _, err := logtail.DecodeBackupAux("task", logtail.BackupAuxRewriteTask, buf)
+	require.NoError(t, err)
+	require.Equal(t, logtail.BackupAuxRewriteTask, header.Kind)
+	status, err := QueryRewriteStatus(ctx, fs, "task")
+	require.NoError(t, err)
+	require.Equal(t, saved, status)
+
+	// The status is not a journal, and a journal is not a status.
+	_, _, err = logtail.DecodeBackupAux("task", logtail.BackupAuxJournal, buf)
+	require.True(t, logtail.IsBackupAuxKindError(err), err)
+	journal, err := logtail.EncodeBackupAux(logtail.BackupAuxJournal, types.BuildTS(1, 0), []byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, fs.Write(ctx, fileservice.IOVector{
+		FilePath: rewriteStatusName("journal"),
+		Entries:  []fileservice.IOEntry{{Size: int64(len(journal)), Data: journal}},
+	}))
+	_, err = QueryRewriteStatus(ctx, fs, "journal")
+	require.True(t, logtail.IsBackupAuxKindError(err), err)
+}
@@ -97,14 +97,62 @@ func BackupData(
 		retByts = append(retByts, executor.GetBytesRows(cols[0]))
 		return true
 	})
-	res.Close()
-
+	// The rows point into the result, it is closed once they are parsed.
 	fileName, err := getFileNames(ctx, retByts)
+	res.Close()
 	if err != nil {
 		return err
 	}
 	count := config.Parallelism
-	return execBackup(ctx, sid, srcFs, dstFs, fileName, int(count), config.BackupTs, config.BackupType)
+	backupOpts := append(projectionOptions(config), samplingOptions(config)...)
+	if config.ExactBackupTS {
+		backupOpts = append(backupOpts, logtail.WithExactBackupTS())
+	}
+	err = execBackup(ctx, sid, srcFs, dstFs, fileName, int(count), config.BackupTs, config.BackupType,
+		config.BestEffort, config.Quota, backupOpts...)
+	if err != nil {
+		return err
+	}
+	if config.BestEffort != nil && config.BestEffort.Partial() && config.metasMustBeSet() {
+		config.Metas.AppendPartial(config.BestEffort.Skipped())
+	}
+	if len(config.RedactionKey) > 0 {
+		return saveRedactedTaeList(ctx, dstFs, config.RedactionKey)
+	}
+	return nil
+}
+
+// projectionOptions turns config.Projection into rewrite options and
+// tags the backup meta, a projected backup must not pass for a full one.
+func projectionOptions(config *Config) []logtail.BackupOption {
+	if len(config.Projection) == 0 {
+		return nil
+	}
+	if config.Metas != nil {
+		tids := make([]uint64, 0, len(config.Projection))
+		for tid := range config.Projection {
+			tids = append(tids, tid)
+		}
+		sort.Slice(tids, func(i, j int) bool {
+			return tids[i] < tids[j]
+		})
+		for _, tid := range tids {
+			config.Metas.AppendProjection(tid, config.Projection[tid])
+		}
+	}
+	return []logtail.BackupOption{logtail.WithColumnProjection(config.Projection)}
+}
+
+// samplingOptions turns config.Sampling into rewrite options and tags
+// the backup meta, a sampled backup must not pass for a full one.
+func samplingOptions(config *Config) []logtail.BackupOption {
+	if config.Sampling == nil {
+		return nil
+	}
+	if config.Metas != nil {
+		config.Metas.AppendSampling(*config.Sampling)
+	}
+	return []logtail.BackupOption{logtail.WithSampling(*config.Sampling)}
 }
 
 func getParallelCount(count int) int {
@@ -124,14 +172,21 @@ func getParallelCount(count int) int {
 	return 512
 }
 
-// parallelCopyData copy data from srcFs to dstFs in parallel
+// parallelCopyData copy data from srcFs to dstFs, or to the staging
+// FileService of session if it has one, in parallel. Once the
+// quota of session is used up, no new copy is started, the copies in
+// flight are finished and recorded in the journal of session, and the
+// QuotaExceededError is returned.
 func parallelCopyData(srcFs, dstFs fileservice.FileService,
 	files map[string]*objectio.BackupObject,
 	parallelCount int,
 	gcFileMap map[string]string,
+	session *logtail.BackupSession,
 ) ([]*taeFile, error) {
 	var copyCount, skipCount, copySize int64
 	var printMutex, fileMutex sync.Mutex
+	// stopped is the QuotaExceededError of the first copy refused.
+	var stopped error
 	stopPrint := false
 	defer func() {
 		printMutex.Lock()
@@ -188,9 +243,24 @@ func parallelCopyData(srcFs, dstFs fileservice.FileService,
 						Res: nil,
 					}
 				}
-				checksum, err := CopyFileWithRetry(context.Background(), srcFs, dstFs, backupObject.Location.Name().String(), "")
+				var checksum []byte
+				err := session.Copy(context.Background(), name, int64(size), func(ctx context.Context) (err error) {
+					checksum, err = CopyFileWithRetry(ctx, srcFs, session.CopyFS(dstFs), name, "")
+					return
+				})
+				if logtail.IsQuotaExceeded(err) {
+					fileMutex.Lock()
+					if stopped == nil {
+						stopped = err
+					}
+					fileMutex.Unlock()
+					return &tasks.JobResult{
+						Res: nil,
+					}
+				}
 				if err != nil {
-					if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+					// A best effort session lists the objects it skips.
+					if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) || logtail.IsObjectSkipped(err) {
 						// TODO: handle file not found, maybe GC
 						fileMutex.Lock()
 						skipCount++
@@ -230,12 +300,20 @@ func parallelCopyData(srcFs, dstFs fileservice.FileService,
 		idx++
 	}
 
+	scheduled := 0
 	for n := range backupJobs {
+		fileMutex.Lock()
+		quotaExceeded := stopped != nil
+		fileMutex.Unlock()
+		if quotaExceeded {
+			break
+		}
 		err := jobScheduler.Schedule(backupJobs[n])
 		if err != nil {
 			logutil.Infof("schedule job failed %v", err.Error())
 			return nil, err
 		}
+		scheduled++
 		select {
 		case err = <-errC:
 			logutil.Infof("copy file failed %v", err.Error())
@@ -244,13 +322,24 @@ func parallelCopyData(srcFs, dstFs fileservice.FileService,
 		}
 	}
 
-	for n := range backupJobs {
+	for n := range backupJobs[:scheduled] {
 		ret := backupJobs[n].WaitDone()
 		if ret.Err != nil {
 			logutil.Infof("wait job done failed %v", ret.Err.Error())
 			return nil, ret.Err
 		}
 	}
+	if stopped != nil {
+		// The copies finished after the session stopped are recorded
+		// too, the next run does not copy them again.
+		if err := session.Flush(context.Background()); err != nil {
+			return nil, err
+		}
+		logutil.Info("backup", common.OperationField("copy file stopped by quota"),
+			common.AnyField("copy file num", copyCount),
+			common.AnyField("total file num", len(files)))
+		return nil, stopped
+	}
 
 	logutil.Info("backup", common.OperationField("copy file"),
 		common.AnyField("copy file size", copySize),
@@ -268,16 +357,20 @@ func execBackup(
 	count int,
 	ts types.TS,
 	typ string,
+	bestEffort *logtail.BestEffort,
+	quota *BackupQuota,
+	opts ...logtail.BackupOption,
 ) error {
 	backupTime := names[0]
 	trimInfo := names[1]
 	names = names[1:]
 	files := make(map[string]*objectio.BackupObject, 0)
 	gcFileMap := make(map[string]string)
-	softDeletes := make(map[string]bool)
+	softDeletes := logtail.NewSoftDeletes()
 	var loadDuration, copyDuration, reWriteDuration time.Duration
 	var oNames []*objectio.BackupObject
 	parallelNum := getParallelCount(count)
+	stats := logtail.NewBackupStats()
 	logutil.Info("backup", common.OperationField("start backup"),
 		common.AnyField("backup time", backupTime),
 		common.AnyField("checkpoint num", len(names)),
@@ -287,9 +380,18 @@ func execBackup(
 			common.AnyField("load checkpoint cost", loadDuration),
 			common.AnyField("copy file cost", copyDuration),
 			common.AnyField("rewrite checkpoint cost", reWriteDuration))
+		snapshot := stats.Snapshot()
+		logutil.Info("backup stats", snapshot.Fields()...)
+		snapshot.Export()
 	}()
 	now := time.Now()
 	baseTS := ts
+	// Only the entries of the checkpoints are needed, the session scans
+	// the chain without loading their data.
+	scanner, err := logtail.NewBackupSession(ctx, dstFs)
+	if err != nil {
+		return err
+	}
 	for i, name := range names {
 		if len(name) == 0 {
 			continue
@@ -308,24 +410,20 @@ func execBackup(
 			return err
 		}
 		var oneNames []*objectio.BackupObject
-		var data *logtail.CheckpointData
 		if i == 0 {
-			oneNames, data, err = logtail.LoadCheckpointEntriesFromKey(ctx, sid, srcFs, key, uint32(version), nil, &baseTS)
+			oneNames, err = scanner.ScanCheckpointEntries(ctx, sid, srcFs, key, uint32(version), nil, &baseTS)
 		} else {
-			oneNames, data, err = logtail.LoadCheckpointEntriesFromKey(ctx, sid, srcFs, key, uint32(version), &softDeletes, &baseTS)
+			oneNames, err = scanner.ScanCheckpointEntries(ctx, sid, srcFs, key, uint32(version), softDeletes, &baseTS)
 		}
 		if err != nil {
 			return err
 		}
-		defer data.Close()
 		oNames = append(oNames, oneNames...)
 	}
 	loadDuration += time.Since(now)
 	now = time.Now()
-	for _, oName := range oNames {
-		if files[oName.Location.Name().String()] == nil {
-			files[oName.Location.Name().String()] = oName
-		}
+	for _, oName := range logtail.NormalizeLocations(oNames) {
+		files[oName.Location.Name().String()] = oName
 	}
 
 	// trim checkpoint and block
@@ -350,11 +448,62 @@ func execBackup(
 		}
 	}
 
+	// A best effort backup skips the objects it cannot copy or rewrite
+	// in time, and a backup with a quota stops once it is used up. The
+	// copy and the rewrite each have their session.
+	copySession, err := backupSession(ctx, dstFs, bestEffort, quota, "copy")
+	if err != nil {
+		return err
+	}
+
 	// copy data
-	taeFileList, err := parallelCopyData(srcFs, dstFs, files, parallelNum, gcFileMap)
+	taeFileList, err := parallelCopyData(srcFs, dstFs, files, parallelNum, gcFileMap, copySession)
 	if err != nil {
 		return err
 	}
+	copyDuration += time.Since(now)
+	now = time.Now()
+
+	// The checkpoint is rewritten before the checkpoint and gc meta are
+	// copied, a run the quota stops in the rewrite has not copied them
+	// yet when it is resumed.
+	backupTS := start
+	var cnLocation, tnLocation objectio.Location
+	var result *logtail.RewriteResult
+	if trimInfo != "" {
+		cnLocation, err = blockio.EncodeLocationFromString(cnLoc)
+		if err != nil {
+			return err
+		}
+		tnLocation, err = blockio.EncodeLocationFromString(tnLoc)
+		if err != nil {
+			return err
+		}
+		// The backup is as of the latest ts the checkpoint chain holds a
+		// consistent snapshot of, unless opts ask for the exact ts.
+		chain, err := checkpointChain(ctx, sid, srcFs, start, end)
+		if err != nil {
+			return err
+		}
+		result = &logtail.RewriteResult{}
+		opts = append([]logtail.BackupOption{logtail.WithCheckpointChain(chain)}, opts...)
+		opts = append(opts, logtail.WithRewriteResult(result), logtail.WithBackupStats(stats))
+		rewriteSession, err := backupSession(ctx, dstFs, bestEffort, quota, "rewrite")
+		if err != nil {
+			return err
+		}
+		if rewriteSession != nil {
+			opts = append(opts, logtail.WithBackupSession(rewriteSession))
+		}
+		cnLocation, tnLocation, _, err = logtail.ReWriteCheckpointAndBlockFromKey(ctx, sid, srcFs, dstFs,
+			cnLocation, tnLocation, uint32(version), start, softDeletes, opts...)
+		if err != nil {
+			return err
+		}
+		backupTS = result.EffectiveTS
+	}
+	reWriteDuration += time.Since(now)
+	now = time.Now()
 
 	// copy checkpoint and gc meta
 	sizeList, minTs, err := CopyCheckpointDir(ctx, srcFs, dstFs, "ckp", start)
@@ -370,29 +519,7 @@ func execBackup(
 	taeFileList = append(taeFileList, sizeList...)
 	now = time.Now()
 	if trimInfo != "" {
-		cnLocation, err := blockio.EncodeLocationFromString(cnLoc)
-		if err != nil {
-			return err
-		}
-		tnLocation, err := blockio.EncodeLocationFromString(tnLoc)
-		if err != nil {
-			return err
-		}
-		var checkpointFiles []string
-		cnLocation, tnLocation, checkpointFiles, err = logtail.ReWriteCheckpointAndBlockFromKey(ctx, sid, srcFs, dstFs,
-			cnLocation, tnLocation, uint32(version), start, softDeletes)
-		for _, name := range checkpointFiles {
-			dentry, err := dstFs.StatFile(ctx, name)
-			if err != nil {
-				return err
-			}
-			taeFileList = append(taeFileList, &taeFile{
-				path:     dentry.Name,
-				size:     dentry.Size,
-				needCopy: true,
-				ts:       start,
-			})
-		}
+		taeFileList, err = appendRewriteFiles(ctx, dstFs, taeFileList, &result.Files, start)
 		if err != nil {
 			return err
 		}
@@ -405,21 +532,126 @@ func execBackup(
 			return err
 		}
 		taeFileList = append(taeFileList, &taeFile{
-			path:     "ckp/" + dentry.Name,
-			size:     dentry.Size,
-			needCopy: true,
-			ts:       start,
+			path:      "ckp/" + dentry.Name,
+			size:      dentry.Size,
+			needCopy:  true,
+			ts:        start,
+			exclusive: true,
 		})
 	}
 	reWriteDuration += time.Since(now)
-	//save tae files size
-	err = saveTaeFilesList(ctx, dstFs, taeFileList, backupTime, start.ToString(), typ)
+	//save tae files size, a partial backup is not restore complete
+	complete := bestEffort == nil || !bestEffort.Partial()
+	err = saveTaeFilesList(ctx, dstFs, taeFileList, backupTime, backupTS.ToString(), typ, complete)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// backupSession returns the session of part of the backup, the copy or
+// the rewrite, for bestEffort and quota, nil if neither is set. The
+// journal of each part is named after quota.Journal.
+func backupSession(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	bestEffort *logtail.BestEffort,
+	quota *BackupQuota,
+	part string,
+) (*logtail.BackupSession, error) {
+	var opts []logtail.SessionOption
+	if bestEffort != nil {
+		opts = append(opts, logtail.WithBestEffort(bestEffort))
+	}
+	if quota != nil {
+		opts = append(opts,
+			logtail.WithQuota(quota.MaxBytes, quota.MaxObjects),
+			logtail.WithJournal(quota.Journal+"-"+part))
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	return logtail.NewBackupSession(ctx, dstFs, opts...)
+}
+
+// checkpointChain returns the spans of the checkpoints listed by the
+// latest checkpoint meta file of fs, and of the checkpoint taken for the
+// backup from start to end.
+func checkpointChain(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	start, end types.TS,
+) ([]logtail.CheckpointSpan, error) {
+	latest := func(_ types.TS, files []*checkpoint.MetaFile) ([]*checkpoint.MetaFile, int, error) {
+		return files, len(files) - 1, nil
+	}
+	files, idx, err := checkpoint.ListSnapshotMeta(ctx, fs, types.TS{}, latest)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*checkpoint.CheckpointEntry
+	if len(files) > 0 {
+		entries, err = checkpoint.ListSnapshotCheckpointWithMeta(ctx, sid, fs, files, idx, types.TS{}, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	chain := make([]logtail.CheckpointSpan, 0, len(entries)+1)
+	for _, entry := range entries {
+		chain = append(chain, logtail.CheckpointSpan{Start: entry.GetStart(), End: entry.GetEnd()})
+	}
+	return append(chain, logtail.CheckpointSpan{Start: start, End: end}), nil
+}
+
+// appendRewriteFiles records the objects written by the checkpoint
+// rewrite in taeFileList. The rewritten objects were already copied and
+// only have their entry updated, the others are new.
+func appendRewriteFiles(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	taeFileList []*taeFile,
+	files *logtail.RewriteFiles,
+	start types.TS,
+) ([]*taeFile, error) {
+	copied := make(map[string]*taeFile, len(taeFileList))
+	for _, file := range taeFileList {
+		copied[file.path] = file
+	}
+	for _, name := range files.Rewritten {
+		dentry, err := dstFs.StatFile(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		file, ok := copied[dentry.Name]
+		if !ok {
+			file = &taeFile{path: dentry.Name}
+			taeFileList = append(taeFileList, file)
+		}
+		file.size = dentry.Size
+		file.checksum = nil
+		file.needCopy = true
+		file.ts = start
+		file.exclusive = true
+	}
+	for _, group := range [][]string{files.Converted, files.Checkpoint} {
+		for _, name := range group {
+			dentry, err := dstFs.StatFile(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			taeFileList = append(taeFileList, &taeFile{
+				path:      dentry.Name,
+				size:      dentry.Size,
+				needCopy:  true,
+				ts:        start,
+				exclusive: true,
+			})
+		}
+	}
+	return taeFileList, nil
+}
+
 // CopyCheckpointDir copy checkpoint dir from srcFs to dstFs
 // return taeFile list
 // copy: if copy is true,it means not to check the suffix name and copy all files.
@@ -17,11 +17,13 @@ package backup
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 	"github.com/matrixorigin/matrixone/pkg/fileservice"
 	"github.com/matrixorigin/matrixone/pkg/logservice"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
 )
 
 const (
@@ -38,6 +40,10 @@ const (
 	HakeeperFile = "hk_data"
 )
 
+// taeListRedacted is the tae_list with the names of its files redacted,
+// see Config.RedactionKey.
+const taeListRedacted = "tae_list_redacted"
+
 // Format :type,subtype,filename or dirname
 const (
 	TypePos              = 0
@@ -54,12 +60,18 @@ const (
 	    Version   | Version
 	    Buildinfo | Buildinfo
 	              | Launchconfig
+	              | Projection
+	              | Sampling
+	              | Partial
 	              | Tae
 	              | Hakeeper
 	*/
 	TypeVersion MetaType = iota
 	TypeBuildinfo
 	TypeLaunchconfig
+	TypeProjection
+	TypeSampling
+	TypePartial
 )
 
 func (t MetaType) String() string {
@@ -70,6 +82,12 @@ func (t MetaType) String() string {
 		return "buildinfo"
 	case TypeLaunchconfig:
 		return "launchconfig"
+	case TypeProjection:
+		return "projection"
+	case TypeSampling:
+		return "sampling"
+	case TypePartial:
+		return "partial"
 	default:
 		return fmt.Sprintf("invalid type %d", t)
 	}
@@ -89,6 +107,18 @@ type Meta struct {
 
 	//launch config
 	LaunchConfigFile string
+
+	//projection, the table and its kept data columns
+	ProjectionTable   uint64
+	ProjectionColumns []uint16
+
+	//sampling, the fraction or every nth row kept
+	SamplingFraction float64
+	SamplingEveryNth int
+
+	//partial, an object the best effort backup skipped and why
+	SkippedObject string
+	SkipReason    string
 }
 
 func (m *Meta) String() string {
@@ -106,6 +136,19 @@ func (m *Meta) CsvString() []string {
 		format[SubTypePos] = m.Buildinfo
 	case TypeLaunchconfig:
 		format[FileNameOrDirNamePos] = m.LaunchConfigFile
+	case TypeProjection:
+		cols := make([]string, 0, len(m.ProjectionColumns))
+		for _, col := range m.ProjectionColumns {
+			cols = append(cols, strconv.Itoa(int(col)))
+		}
+		format[SubTypePos] = strconv.FormatUint(m.ProjectionTable, 10)
+		format[FileNameOrDirNamePos] = strings.Join(cols, " ")
+	case TypeSampling:
+		format[SubTypePos] = strconv.FormatFloat(m.SamplingFraction, 'g', -1, 64)
+		format[FileNameOrDirNamePos] = strconv.Itoa(m.SamplingEveryNth)
+	case TypePartial:
+		format[SubTypePos] = m.SkippedObject
+		format[FileNameOrDirNamePos] = m.SkipReason
 	}
 	return format
 }
@@ -147,6 +190,38 @@ func (m *Metas) AppendLaunchconfig(subTyp, file string) {
 	})
 }
 
+// AppendProjection tags the backup as projected: only cols of table tid
+// were kept, so it cannot be restored with full fidelity.
+func (m *Metas) AppendProjection(tid uint64, cols []uint16) {
+	m.Append(&Meta{
+		Typ:               TypeProjection,
+		ProjectionTable:   tid,
+		ProjectionColumns: cols,
+	})
+}
+
+// AppendSampling tags the backup as sampled: only a sample of the rows
+// was kept, so it cannot be restored with full fidelity.
+func (m *Metas) AppendSampling(sampling logtail.Sampling) {
+	m.Append(&Meta{
+		Typ:              TypeSampling,
+		SamplingFraction: sampling.Fraction,
+		SamplingEveryNth: sampling.EveryNth,
+	})
+}
+
+// AppendPartial tags the backup as partial: the best effort backup
+// skipped the objects in skipped, so it cannot be restored.
+func (m *Metas) AppendPartial(skipped []logtail.SkippedObject) {
+	for _, object := range skipped {
+		m.Append(&Meta{
+			Typ:           TypePartial,
+			SkippedObject: object.Name,
+			SkipReason:    object.Reason,
+		})
+	}
+}
+
 func (m *Metas) orderTypes() []int {
 	idx := make([]int, 0, len(m.metas))
 	for i := range m.metas {
@@ -227,6 +302,43 @@ type Config struct {
 
 	BackupType string
 	BackupTs   types.TS
+
+	// Projection keeps only the listed data columns of each table, see
+	// logtail.WithColumnProjection. It makes a slimmer backup for
+	// analytics that is not restore compatible.
+	Projection map[uint64][]uint16
+
+	// Sampling keeps only a sample of the rows, see
+	// logtail.WithSampling. It makes a small backup for tests that is not
+	// restore compatible.
+	Sampling *logtail.Sampling
+	// BestEffort makes a backup that skips the objects it cannot copy
+	// or rewrite in time instead of failing, see logtail.BestEffort. A
+	// backup that skipped objects is partial and not restore complete.
+	BestEffort *logtail.BestEffort
+	// Quota bounds what one run of the backup copies and writes, see
+	// BackupQuota. A run that uses it up returns a
+	// logtail.QuotaExceededError, running the backup again with the
+	// same Quota continues from where it stopped.
+	Quota *BackupQuota
+	// ExactBackupTS takes the backup as of the start of the checkpoint
+	// taken for it rather than the ts the checkpoint chain resolves it
+	// to, see logtail.WithExactBackupTS.
+	ExactBackupTS bool
+	// RedactionKey, when set, has the backup write its tae_list again
+	// with the names of its files redacted, to be shared for support,
+	// see ManifestRedactor.
+	RedactionKey []byte
+}
+
+// BackupQuota limits the bytes and the objects the copy of the data
+// objects and the rewrite of the checkpoint each write in one run, zero
+// means unlimited, see logtail.WithQuota. What they wrote is recorded
+// in the journals named after Journal, see logtail.WithJournal.
+type BackupQuota struct {
+	MaxBytes   int64
+	MaxObjects int64
+	Journal    string
 }
 
 // metasGeneralFsMustBeSet denotes metas and generalFs must be ready
@@ -273,6 +385,9 @@ type taeFile struct {
 	checksum []byte
 	needCopy bool
 	ts       types.TS
+	// exclusive files are written for this backup only, e.g. the
+	// rewritten checkpoint, and never referenced by another backup.
+	exclusive bool
 }
 
 func (tfs *taeFile) String() string {
@@ -283,7 +398,7 @@ func (tfs *taeFile) String() string {
 func (tfs *taeFile) CsvString() []string {
 	return []string{tfs.path, fmt.Sprintf("%d", tfs.size),
 		fmt.Sprintf("%x", tfs.checksum), fmt.Sprintf("%t", tfs.needCopy),
-		tfs.ts.ToString()}
+		tfs.ts.ToString(), fmt.Sprintf("%t", tfs.exclusive)}
 }
 
 func taeFileListToCsv(files []*taeFile) ([][]string, int64) {
@@ -296,6 +411,8 @@ func taeFileListToCsv(files []*taeFile) ([][]string, int64) {
 	return lines, ret
 }
 
-func taeBackupTimeAndSizeToCsv(backupTime, backupTS, typ string, size int64) []string {
-	return []string{backupTime, fmt.Sprintf("%d", size), backupTS, typ}
+// taeBackupTimeAndSizeToCsv returns the tae_sum line, its last column
+// tells whether the backup is restore complete.
+func taeBackupTimeAndSizeToCsv(backupTime, backupTS, typ string, size int64, complete bool) []string {
+	return []string{backupTime, fmt.Sprintf("%d", size), backupTS, typ, fmt.Sprintf("%t", complete)}
 }
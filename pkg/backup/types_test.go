@@ -15,6 +15,7 @@
 package backup
 
 import (
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/logtail"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -68,3 +69,32 @@ func TestMetas_AppendLaunchconfig(t *testing.T) {
 		})
 	}
 }
+
+func TestMetas_AppendProjection(t *testing.T) {
+	m := NewMetas()
+	m.AppendVersion(Version)
+	m.AppendProjection(272515, []uint16{0, 3})
+	lines := m.CsvString()
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, []string{"projection", "272515", "0 3"}, lines[1])
+}
+
+func TestMetas_AppendSampling(t *testing.T) {
+	m := NewMetas()
+	m.AppendVersion(Version)
+	m.AppendSampling(logtail.Sampling{Fraction: 0.1})
+	m.AppendSampling(logtail.Sampling{EveryNth: 8})
+	lines := m.CsvString()
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, []string{"sampling", "0.1", "0"}, lines[1])
+	assert.Equal(t, []string{"sampling", "0", "8"}, lines[2])
+}
+
+func TestMetas_AppendPartial(t *testing.T) {
+	m := NewMetas()
+	m.AppendVersion(Version)
+	m.AppendPartial([]logtail.SkippedObject{{Name: "obj", Reason: "context deadline exceeded"}})
+	lines := m.CsvString()
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, []string{"partial", "obj", "context deadline exceeded"}, lines[1])
+}
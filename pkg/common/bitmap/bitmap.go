@@ -21,6 +21,7 @@ import (
 	"math/bits"
 	"unsafe"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 )
 
@@ -430,6 +431,24 @@ func (n *Bitmap) Unmarshal(data []byte) {
 	}
 }
 
+// CheckMarshaled returns an error if data, e.g. read from a corrupt
+// file, is not as long as the bitmap Marshal wrote it from claims.
+// Unmarshal and UnmarshalNoCopy do not check.
+func CheckMarshaled(data []byte) error {
+	if len(data) < 20 {
+		return moerr.NewInternalErrorNoCtx("bitmap of %d bytes", len(data))
+	}
+	length := types.DecodeUint64(data[4:12])
+	size := types.DecodeUint64(data[12:20])
+	if size%8 != 0 || size > uint64(len(data)-20) {
+		return moerr.NewInternalErrorNoCtx("bitmap data of %d bytes in %d bytes", size, len(data)-20)
+	}
+	if length > size/8*64 {
+		return moerr.NewInternalErrorNoCtx("bitmap of %d bits in %d bytes", length, size)
+	}
+	return nil
+}
+
 func (n *Bitmap) UnmarshalNoCopy(data []byte) {
 	n.emptyFlag.Store(types.DecodeInt32(data[:4]))
 	data = data[4:]
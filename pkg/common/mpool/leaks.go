@@ -0,0 +1,109 @@
+// Copyright 2021 - 2022 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mpool
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Leak is an allocation of a MPool that was not freed.
+type Leak struct {
+	Size int
+	// Stack is where it was allocated, empty unless the leak tracking
+	// records stacks.
+	Stack string
+}
+
+// mpoolLeaks are the outstanding allocations of a MPool, by address.
+type mpoolLeaks struct {
+	mu          sync.Mutex
+	withStacks  bool
+	outstanding map[uintptr]Leak
+}
+
+// EnableLeakTracking makes mp record each allocation until it is freed,
+// with the stack that made it when withStacks, which is slow and only
+// meant for debugging and tests. Allocations made before it are not
+// tracked.
+func (mp *MPool) EnableLeakTracking(withStacks bool) {
+	mp.leaks.CompareAndSwap(nil, &mpoolLeaks{
+		withStacks:  withStacks,
+		outstanding: make(map[uintptr]Leak),
+	})
+}
+
+func (mp *MPool) DisableLeakTracking() {
+	mp.leaks.Store(nil)
+}
+
+// Leaks returns the tracked allocations of mp not freed yet, the
+// largest first, none when leak tracking is disabled.
+func (mp *MPool) Leaks() []Leak {
+	leaks := mp.leaks.Load()
+	if leaks == nil {
+		return nil
+	}
+	return leaks.list()
+}
+
+// ReportLeaks writes the tracked allocations of mp not freed yet to w.
+// It reports whether there are any.
+func (mp *MPool) ReportLeaks(w io.Writer) bool {
+	leaks := mp.Leaks()
+	for _, leak := range leaks {
+		fmt.Fprintf(w, "mpool %s: %d bytes not freed\n", mp.tag, leak.Size)
+		if leak.Stack != "" {
+			fmt.Fprintf(w, "%s\n", leak.Stack)
+		}
+	}
+	return len(leaks) > 0
+}
+
+func (l *mpoolLeaks) recordAlloc(bs []byte) {
+	leak := Leak{Size: cap(bs)}
+	if l.withStacks {
+		leak.Stack = string(debug.Stack())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.outstanding[uintptr(unsafe.Pointer(&bs[0]))] = leak
+}
+
+func (l *mpoolLeaks) recordFree(bs []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.outstanding, uintptr(unsafe.Pointer(&bs[0])))
+}
+
+func (l *mpoolLeaks) list() []Leak {
+	l.mu.Lock()
+	leaks := make([]Leak, 0, len(l.outstanding))
+	for _, leak := range l.outstanding {
+		leaks = append(leaks, leak)
+	}
+	l.mu.Unlock()
+	sort.SliceStable(leaks, func(i, j int) bool {
+		if leaks[i].Size != leaks[j].Size {
+			return leaks[i].Size > leaks[j].Size
+		}
+		return leaks[i].Stack < leaks[j].Stack
+	})
+	return leaks
+}
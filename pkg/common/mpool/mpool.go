@@ -330,6 +330,9 @@ type MPool struct {
 	inUseCount int32 // number of in use call
 	pools      [NumFixedPool]fixedPool
 	details    *mpoolDetails
+	// leaks is loaded once by each Alloc and Free, it can be enabled
+	// and disabled while they run.
+	leaks atomic.Pointer[mpoolLeaks]
 
 	// To remove: this thing is highly unlikely to be of any good use.
 	sels *sync.Pool
@@ -586,16 +589,21 @@ func (mp *MPool) Alloc(sz int) ([]byte, error) {
 		return nil, moerr.NewInternalErrorNoCtx("mpool out of space, alloc %d bytes, cap %d", sz, mp.cap)
 	}
 
+	var bs []byte
 	// from fixed pool
 	if idx < NumFixedPool {
-		bs := mp.pools[idx].alloc(int32(requiredSpaceWithoutHeader))
+		hdr := mp.pools[idx].alloc(int32(requiredSpaceWithoutHeader))
 		if mp.details != nil {
-			mp.details.recordAlloc(int64(bs.allocSz))
+			mp.details.recordAlloc(int64(hdr.allocSz))
 		}
-		return bs.ToSlice(sz, int(mp.pools[idx].eleSz)), nil
+		bs = hdr.ToSlice(sz, int(mp.pools[idx].eleSz))
+	} else {
+		bs = alloc(sz, requiredSpaceWithoutHeader, mp)
 	}
-
-	return alloc(sz, requiredSpaceWithoutHeader, mp), nil
+	if leaks := mp.leaks.Load(); leaks != nil {
+		leaks.recordAlloc(bs)
+	}
+	return bs, nil
 }
 
 func (mp *MPool) Free(bs []byte) {
@@ -637,6 +645,9 @@ func (mp *MPool) Free(bs []byte) {
 	if mp.details != nil {
 		mp.details.recordFree(int64(pHdr.allocSz))
 	}
+	if leaks := mp.leaks.Load(); leaks != nil {
+		leaks.recordFree(bs)
+	}
 
 	// free from fixed pool
 	if pHdr.fixedPoolIdx < NumFixedPool {
@@ -15,6 +15,7 @@
 package mpool
 
 import (
+	"strings"
 	"sync"
 	"testing"
 
@@ -150,3 +151,57 @@ func TestMpoolReAllocate(t *testing.T) {
 	m.Free(d4)
 	require.Equal(t, int64(0), m.CurrNB())
 }
+
+func TestMPoolLeakTracking(t *testing.T) {
+	m := MustNewZeroNoFixed()
+	untracked, err := m.Alloc(10)
+	require.NoError(t, err)
+	m.EnableLeakTracking(true)
+	m.Free(untracked)
+
+	freed, err := m.Alloc(100)
+	require.NoError(t, err)
+	leaked, err := m.Alloc(1000)
+	require.NoError(t, err)
+	m.Free(freed)
+
+	leaks := m.Leaks()
+	require.Equal(t, 1, len(leaks))
+	require.Equal(t, cap(leaked), leaks[0].Size)
+	require.Contains(t, leaks[0].Stack, "TestMPoolLeakTracking")
+	var report strings.Builder
+	require.True(t, m.ReportLeaks(&report))
+	require.Contains(t, report.String(), "TestMPoolLeakTracking")
+
+	m.Free(leaked)
+	require.Empty(t, m.Leaks())
+	require.False(t, m.ReportLeaks(&report))
+	m.DisableLeakTracking()
+	require.Nil(t, m.Leaks())
+}
+
+func TestMPoolLeakTrackingToggled(t *testing.T) {
+	// Tracking is enabled and disabled while the pool is in use, run
+	// with -race.
+	m := MustNewZeroNoFixed()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				bs, err := m.Alloc(64)
+				require.NoError(t, err)
+				m.Free(bs)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		m.EnableLeakTracking(false)
+		_ = m.Leaks()
+		m.DisableLeakTracking()
+	}
+	wg.Wait()
+	m.EnableLeakTracking(false)
+	require.Empty(t, m.Leaks())
+}
@@ -15,6 +15,7 @@
 package compress
 
 import (
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/pierrec/lz4/v4"
 )
 
@@ -25,6 +26,9 @@ var Algorithms map[string]int = map[string]int{
 
 func Compress(src, dst []byte, typ int) ([]byte, error) {
 	switch typ {
+	case None:
+		n := copy(dst, src)
+		return dst[:n], nil
 	case Lz4:
 		n, err := lz4.CompressBlock(src, dst, nil)
 		if err != nil {
@@ -32,11 +36,38 @@ func Compress(src, dst []byte, typ int) ([]byte, error) {
 		}
 		return dst[:n], nil
 	}
-	return nil, nil
+	return nil, moerr.NewNotSupportedNoCtx(T(typ).String())
+}
+
+// CompressLevel is Compress at level, 0 is the level of Compress. Lz4
+// takes levels 1 to 9 and compresses with its high compression variant,
+// slower but smaller, in the block format Decompress reads. None has no
+// levels.
+func CompressLevel(src, dst []byte, typ, level int) ([]byte, error) {
+	if level == 0 {
+		return Compress(src, dst, typ)
+	}
+	if level < 0 || level > MaxLevel {
+		return nil, moerr.NewInvalidInputNoCtx("compression level %d", level)
+	}
+	switch typ {
+	case None:
+		return Compress(src, dst, typ)
+	case Lz4:
+		n, err := lz4.CompressBlockHC(src, dst, lz4.CompressionLevel(1<<(8+level)), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return dst[:n], nil
+	}
+	return nil, moerr.NewNotSupportedNoCtx(T(typ).String())
 }
 
 func Decompress(src, dst []byte, typ int) ([]byte, error) {
 	switch typ {
+	case None:
+		n := copy(dst, src)
+		return dst[:n], nil
 	case Lz4:
 		n, err := lz4.UncompressBlock(src, dst)
 		if err != nil {
@@ -44,5 +75,5 @@ func Decompress(src, dst []byte, typ int) ([]byte, error) {
 		}
 		return dst[:n], nil
 	}
-	return nil, nil
+	return nil, moerr.NewNotSupportedNoCtx(T(typ).String())
 }
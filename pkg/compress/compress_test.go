@@ -41,3 +41,52 @@ func TestLz4(t *testing.T) {
 	}
 	fmt.Printf("dat: %v\n", data)
 }
+
+func TestNone(t *testing.T) {
+	raw := types.EncodeSlice([]int64{1, 2, 3})
+	buf, err := Compress(raw, make([]byte, len(raw)), None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Decompress(buf, make([]byte, len(raw)), None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(raw) {
+		t.Fatalf("unexpected data: %v", data)
+	}
+	if _, err = Decompress(buf, raw, 7); err == nil {
+		t.Fatal("expected unsupported codec error")
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	xs := make([]int64, 4096)
+	for i := range xs {
+		xs[i] = int64(i % 97)
+	}
+	raw := types.EncodeSlice(xs)
+	fast, err := Compress(raw, make([]byte, lz4.CompressBlockBound(len(raw))), Lz4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level := 1; level <= MaxLevel; level++ {
+		buf, err := CompressLevel(raw, make([]byte, lz4.CompressBlockBound(len(raw))), Lz4, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) > len(fast) {
+			t.Fatalf("level %d: %d bytes, %d at the default level", level, len(buf), len(fast))
+		}
+		data, err := Decompress(buf, make([]byte, len(raw)), Lz4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(raw) {
+			t.Fatalf("level %d: unexpected data", level)
+		}
+	}
+	if _, err = CompressLevel(raw, make([]byte, len(raw)), Lz4, MaxLevel+1); err == nil {
+		t.Fatal("expected invalid level error")
+	}
+}
@@ -21,6 +21,9 @@ const (
 	Lz4
 )
 
+// MaxLevel is the highest level of CompressLevel.
+const MaxLevel = 9
+
 type T uint8
 
 func (t T) String() string {
@@ -325,6 +325,9 @@ func (nsp *Nulls) ReadNoCopy(data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
+	if err := bitmap.CheckMarshaled(data); err != nil {
+		return err
+	}
 	nsp.np.UnmarshalNoCopy(data)
 	return nil
 }
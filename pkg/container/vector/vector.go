@@ -540,7 +540,18 @@ func (v *Vector) MarshalBinaryWithBuffer(buf *bytes.Buffer) error {
 }
 
 func (v *Vector) UnmarshalBinary(data []byte) error {
+	// the lengths are read from data, which may be corrupt
+	short := func(what string, n uint64) error {
+		if uint64(len(data)) < n {
+			return moerr.NewInternalErrorNoCtx("vector %s: %d bytes left, need %d", what, len(data), n)
+		}
+		return nil
+	}
+
 	// read class
+	if err := short("class", uint64(1+types.TSize+4+4)); err != nil {
+		return err
+	}
 	v.class = int(data[0])
 	data = data[1:]
 
@@ -555,6 +566,9 @@ func (v *Vector) UnmarshalBinary(data []byte) error {
 	// read data
 	dataLen := types.DecodeUint32(data[:4])
 	data = data[4:]
+	if err := short("data", uint64(dataLen)+4); err != nil {
+		return err
+	}
 	if dataLen > 0 {
 		v.data = data[:dataLen]
 		v.setupFromData()
@@ -564,6 +578,9 @@ func (v *Vector) UnmarshalBinary(data []byte) error {
 	// read area
 	areaLen := types.DecodeUint32(data[:4])
 	data = data[4:]
+	if err := short("area", uint64(areaLen)+4); err != nil {
+		return err
+	}
 	if areaLen > 0 {
 		v.area = data[:areaLen]
 		data = data[areaLen:]
@@ -572,6 +589,9 @@ func (v *Vector) UnmarshalBinary(data []byte) error {
 	// read nsp
 	nspLen := types.DecodeUint32(data[:4])
 	data = data[4:]
+	if err := short("nulls", uint64(nspLen)+1); err != nil {
+		return err
+	}
 	if nspLen > 0 {
 		if err := v.nsp.ReadNoCopy(data[:nspLen]); err != nil {
 			return err
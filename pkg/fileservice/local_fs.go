@@ -27,6 +27,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/matrixorigin/matrixone/pkg/common/moerr"
@@ -1054,6 +1055,21 @@ func (l *LocalFS) SetAsyncUpdate(b bool) {
 	l.asyncUpdate = b
 }
 
+// AvailableSpace returns the bytes that can still be written under the
+// root path, those of the file system it is on available to an
+// unprivileged user.
+func (l *LocalFS) AvailableSpace(ctx context.Context) (int64, error) {
+	path := l.rootPath
+	if path == "" {
+		path = "."
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
 func (l *LocalFS) Cost() *CostAttr {
 	return &CostAttr{
 		List: CostLow,
@@ -19,6 +19,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"syscall"
 	"testing"
 
 	"github.com/matrixorigin/matrixone/pkg/fileservice/fscache"
@@ -239,3 +240,20 @@ func TestLocalFSEmptyRootPath(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, fs)
 }
+
+func TestLocalFSAvailableSpace(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs, err := NewLocalFS(ctx, "local", dir, DisabledCacheConfig, nil)
+	assert.Nil(t, err)
+
+	var stat syscall.Statfs_t
+	assert.Nil(t, syscall.Statfs(dir, &stat))
+	available, err := fs.AvailableSpace(ctx)
+	assert.Nil(t, err)
+	assert.Positive(t, available)
+	// Within a few blocks of what the file system reports, the other
+	// tests write to it too.
+	expected := int64(stat.Bavail) * int64(stat.Bsize)
+	assert.InDelta(t, expected, available, float64(1<<20))
+}
@@ -116,12 +116,19 @@ func (l *LRU[K, V]) hash(k K) uint64 {
 func (l *LRU[K, V]) EnsureNBytes(n int) {
 	want := int64(n * 2)
 	for {
+		evicted := false
 		for i := 0; i < len(l.shards); i++ {
 			if l.Available() > want {
 				return
 			}
 			shard := &l.shards[i]
-			shard.evictOne()
+			if _, ok := shard.evictOne(); ok {
+				evicted = true
+			}
+		}
+		// n is more than the whole capacity, nothing is left to evict
+		if !evicted {
+			return
 		}
 	}
 }
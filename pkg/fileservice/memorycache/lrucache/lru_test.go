@@ -37,6 +37,17 @@ func TestLRU(t *testing.T) {
 	assert.Equal(t, Bytes([]byte{43}), val)
 }
 
+func TestLRUEnsureNBytesOverCapacity(t *testing.T) {
+	l := New[int, Bytes](fscache.ConstCapacity(1024), nil, nil, nil)
+	ctx := context.Background()
+
+	l.Set(ctx, 1, []byte{42})
+	// More than the capacity evicts everything and returns.
+	l.EnsureNBytes(4096)
+	_, ok := l.Get(ctx, 1)
+	assert.False(t, ok)
+}
+
 func TestLRUCallbacks(t *testing.T) {
 	ctx := context.Background()
 
@@ -17,6 +17,7 @@ package objectio
 import (
 	"io"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/compress"
 	"github.com/matrixorigin/matrixone/pkg/fileservice"
 	"github.com/matrixorigin/matrixone/pkg/fileservice/fscache"
@@ -42,10 +43,10 @@ func constructorFactory(size int64, algo uint8) CacheConstructor {
 			return cacheData, nil
 		}
 
-		// lz4 compress
 		decompressed := allocator.Alloc(int(size))
-		bs, err := compress.Decompress(data, decompressed.Bytes(), compress.Lz4)
+		bs, err := compress.Decompress(data, decompressed.Bytes(), int(algo))
 		if err != nil {
+			decompressed.Release()
 			return
 		}
 		decompressed = decompressed.Slice(len(bs))
@@ -54,8 +55,15 @@ func constructorFactory(size int64, algo uint8) CacheConstructor {
 }
 
 func Decode(buf []byte) (any, error) {
+	// a corrupt entry must fail with an error, not panic
+	if len(buf) < IOEntryHeaderSize {
+		return nil, moerr.NewInternalErrorNoCtx("bad io entry: %d bytes", len(buf))
+	}
 	header := DecodeIOEntryHeader(buf)
-	codec := GetIOEntryCodec(*header)
+	codec, ok := ioEntryCodecs[*header]
+	if !ok {
+		return nil, moerr.NewInternalErrorNoCtx("no codec found for: %s", header.String())
+	}
 	if codec.NoUnmarshal() {
 		return buf[IOEntryHeaderSize:], nil
 	}
@@ -25,6 +25,7 @@ import (
 	"github.com/matrixorigin/matrixone/pkg/container/batch"
 	"github.com/matrixorigin/matrixone/pkg/container/vector"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/common/mpool"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 	"github.com/matrixorigin/matrixone/pkg/fileservice"
@@ -121,6 +122,36 @@ func ReadObjectMeta(
 	return
 }
 
+// ReadObjectMetaWithVersion is ReadObjectMeta that also returns the
+// version of the IOEntry the meta is written in, which tells the layout
+// of the blocks of the object.
+func ReadObjectMetaWithVersion(
+	ctx context.Context,
+	name string,
+	extent *Extent,
+	policy fileservice.Policy,
+	fs fileservice.FileService,
+) (meta ObjectMeta, version uint16, err error) {
+	var v []byte
+	if v, err = ReadExtent(ctx, name, extent, policy, fs, constructorFactory); err != nil {
+		return
+	}
+	if len(v) < IOEntryHeaderSize {
+		err = moerr.NewInternalErrorNoCtx("object meta of %s is %d bytes", name, len(v))
+		return
+	}
+	version = DecodeIOEntryHeader(v).Version
+
+	var obj any
+	obj, err = Decode(v)
+	if err != nil {
+		return
+	}
+
+	meta = obj.(ObjectMeta)
+	return
+}
+
 func ReadOneBlock(
 	ctx context.Context,
 	meta *ObjectDataMeta,
@@ -201,6 +232,9 @@ func ReadOneBlockWithMeta(
 	if len(ioVec.Entries) > 0 {
 		err = fs.Read(ctx, ioVec)
 		if err != nil {
+			// the entries read before the failure are cached already
+			ioVec.Release()
+			ioVec = nil
 			return
 		}
 		//TODO when to call ioVec.Release?
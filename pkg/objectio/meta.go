@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"unsafe"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 )
 
@@ -73,6 +74,41 @@ func (o objectDataMetaV1) GetColumnMeta(blk uint32, seqnum uint16) ColumnMeta {
 	return o.GetBlockMeta(blk).MustGetColumn(seqnum)
 }
 
+// check returns an error if o, as read from a file, has counts or
+// offsets that point past its end, the accessors slice o unchecked.
+func (o objectDataMetaV1) check() error {
+	size := uint64(len(o))
+	if size < headerLen {
+		return moerr.NewInternalErrorNoCtx("bad object meta: %d bytes", size)
+	}
+	header := o.BlockHeader()
+	columns := uint64(headerLen) + uint64(header.MetaColumnCount())*colMetaLen
+	if columns+blockCountLen > size || header.MetaColumnCount() > 0 &&
+		uint64(headerLen)+(uint64(header.MaxSeqnum())+1)*colMetaLen > size {
+		return moerr.NewInternalErrorNoCtx("bad object meta: %d columns, max seqnum %d in %d bytes",
+			header.MetaColumnCount(), header.MaxSeqnum(), size)
+	}
+	index := BlockIndex(o[columns:])
+	count := index.BlockCount()
+	if columns+uint64(index.Length()) > size || uint32(header.Sequence()) > count {
+		return moerr.NewInternalErrorNoCtx("bad object meta: %d blocks, %d indexed in %d bytes",
+			header.Sequence(), count, size)
+	}
+	for i := uint32(0); i < count; i++ {
+		offset, length := index.BlockMetaPos(i)
+		if uint64(offset)+uint64(length) > size || length < headerLen {
+			return moerr.NewInternalErrorNoCtx("bad object meta: block %d at %d of %d bytes in %d bytes",
+				i, offset, length, size)
+		}
+		block := BlockObject(o[offset : offset+length])
+		if uint64(headerLen)+uint64(block.BlockHeader().MetaColumnCount())*colMetaLen > uint64(length) {
+			return moerr.NewInternalErrorNoCtx("bad object meta: block %d of %d columns in %d bytes",
+				i, block.BlockHeader().MetaColumnCount(), length)
+		}
+	}
+	return nil
+}
+
 func (o objectDataMetaV1) IsEmpty() bool {
 	return len(o) == 0
 }
@@ -15,8 +15,13 @@
 package objectio
 
 import (
-	"github.com/stretchr/testify/assert"
 	"testing"
+
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildMetaData(t *testing.T) {
@@ -27,3 +32,28 @@ func TestBuildMetaData(t *testing.T) {
 		assert.Equal(t, uint16(30), blkMeta.BlockHeader().ColumnCount())
 	}
 }
+
+func TestDecodeCorrupt(t *testing.T) {
+	meta := BuildMetaData(20, 30)
+	require.NoError(t, meta.check())
+	for _, n := range []int{0, headerLen - 1, headerLen + 10, len(meta) / 2, len(meta) - 1} {
+		_, err := DecodeObjectMetaV1(meta[:n])
+		require.Error(t, err, n)
+	}
+
+	vec := vector.NewVec(types.T_int32.ToType())
+	mp := mpool.MustNewZero()
+	require.NoError(t, vector.AppendFixedList(vec, []int32{1, 2, 3}, nil, mp))
+	vec.GetNulls().Add(1)
+	data, err := EncodeColumnDataV1(vec)
+	require.NoError(t, err)
+	buf := append(EncodeIOEntryHeader(&IOEntryHeader{IOET_ColData, IOET_ColumnData_V1}), data...)
+	_, err = Decode(buf)
+	require.NoError(t, err)
+	for n := 0; n < len(buf); n++ {
+		_, err = Decode(buf[:n])
+		require.Error(t, err, n)
+	}
+	_, err = Decode(EncodeIOEntryHeader(&IOEntryHeader{IOET_ColData, 100}))
+	require.Error(t, err)
+}
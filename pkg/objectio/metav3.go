@@ -15,6 +15,7 @@
 package objectio
 
 import (
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 )
 
@@ -25,6 +26,43 @@ func buildObjectMetaV3() objectMetaV3 {
 	return buf[:]
 }
 
+// checkObjectMeta returns an error if buf, an objectMetaV2 or V3 read
+// from a file, has offsets or counts that point past its end.
+func checkObjectMeta(buf []byte) error {
+	size := uint64(len(buf))
+	if size < metaHeaderLen+schemaCountLen {
+		return moerr.NewInternalErrorNoCtx("bad object meta: %d bytes", size)
+	}
+	checkAt := func(offset uint32) error {
+		if uint64(offset) >= size {
+			return moerr.NewInternalErrorNoCtx("bad object meta: sub meta at %d in %d bytes", offset, size)
+		}
+		return objectDataMetaV1(buf[offset:]).check()
+	}
+	mh := objectMetaV3(buf)
+	if mh.DataMetaCount() > 0 {
+		if err := checkAt(types.DecodeUint32(mh[dataMetaCount:tombstoneMetaCountOff])); err != nil {
+			return err
+		}
+	}
+	if mh.TombstoneMetaCount() > 0 {
+		if err := checkAt(types.DecodeUint32(mh[tombstoneMetaCountOff+tombstoneMetaCount : metaDummyOff])); err != nil {
+			return err
+		}
+	}
+	count := mh.SubMetaCount()
+	if metaHeaderLen+schemaCountLen+uint64(count)*typePosLen > size {
+		return moerr.NewInternalErrorNoCtx("bad object meta: %d sub metas in %d bytes", count, size)
+	}
+	for pos := uint16(0); pos < count; pos++ {
+		offStart := schemaCountLen + uint32(pos)*typePosLen + schemaType + schemaBlockCount + metaHeaderLen
+		if err := checkAt(types.DecodeUint32(mh[offStart : offStart+schemaMetaOffset])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (mh objectMetaV3) MustGetMeta(metaType DataMetaType) objectDataMetaV1 {
 	if metaType == SchemaData {
 		return mh.MustDataMeta()
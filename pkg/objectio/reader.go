@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/index"
 
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/common/mpool"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 
@@ -179,12 +180,21 @@ func (r *objectReaderV1) ReadSubBlock(
 	if metaHeader, err = r.ReadMeta(ctx, m); err != nil {
 		return
 	}
+	if _, ok := metaHeader.(objectMetaV1); !ok && blk >= metaHeader.SubMetaCount() {
+		err = moerr.NewInternalErrorNoCtx("object %s has %d sub metas, no %d",
+			r.name, metaHeader.SubMetaCount(), blk)
+		return
+	}
 	meta, _ := metaHeader.SubMeta(blk)
 	ioVecs = make([]*fileservice.IOVector, 0)
 	for i := uint32(0); i < meta.BlockCount(); i++ {
 		var ioVec *fileservice.IOVector
 		ioVec, err = ReadOneBlockWithMeta(ctx, &meta, r.name, meta.BlockHeader().StartID()+uint16(i), idxs, typs, m, r.fs, constructorFactory, fileservice.Policy(0))
 		if err != nil {
+			for _, read := range ioVecs {
+				ReleaseIOVector(read)
+			}
+			ioVecs = nil
 			return
 		}
 		ioVecs = append(ioVecs, ioVec)
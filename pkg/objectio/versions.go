@@ -71,13 +71,22 @@ func DecodeColumnDataV1(buf []byte) (ioe any, err error) {
 }
 
 func DecodeObjectMetaV1(buf []byte) (ioe any, err error) {
+	if err = objectDataMetaV1(buf).check(); err != nil {
+		return
+	}
 	return objectMetaV1(buf), nil
 }
 
 func DecodeObjectMetaV2(buf []byte) (ioe any, err error) {
+	if err = checkObjectMeta(buf); err != nil {
+		return
+	}
 	return objectMetaV2(buf), nil
 }
 
 func DecodeObjectMetaV3(buf []byte) (ioe any, err error) {
+	if err = checkObjectMeta(buf); err != nil {
+		return
+	}
 	return objectMetaV3(buf), nil
 }
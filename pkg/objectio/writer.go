@@ -47,12 +47,16 @@ type objectWriterV1 struct {
 	lastId            uint32
 	name              ObjectName
 	compressBuf       []byte
+	compressAlgo      uint8
+	compressLevel     int
 	bloomFilter       []byte
 	objStats          []ObjectStats
 	sortKeySeqnum     uint16
 	appendable        bool
 	originSize        uint32
 	size              uint32
+	// aborted is set by Abort, the writer cannot be used after it.
+	aborted bool
 }
 
 type blockData struct {
@@ -101,6 +105,7 @@ func newObjectWriterSpecialV1(wt WriterType, fileName string, fs fileservice.Fil
 		blocks:        make([][]blockData, 2),
 		lastId:        0,
 		sortKeySeqnum: math.MaxUint16,
+		compressAlgo:  compress.Lz4,
 	}
 	writer.blocks[SchemaData] = make([]blockData, 0)
 	writer.blocks[SchemaTombstone] = make([]blockData, 0)
@@ -120,6 +125,7 @@ func newObjectWriterV1(name ObjectName, fs fileservice.FileService, schemaVersio
 		blocks:        make([][]blockData, 2),
 		lastId:        0,
 		sortKeySeqnum: math.MaxUint16,
+		compressAlgo:  compress.Lz4,
 	}
 	writer.blocks[SchemaData] = make([]blockData, 0)
 	writer.blocks[SchemaTombstone] = make([]blockData, 0)
@@ -185,7 +191,9 @@ func (w *objectWriterV1) Write(batch *batch.Batch) (BlockObject, error) {
 		panic(fmt.Sprintf("Unmatched Write Batch, expect %d, get %d, %v", col, len(batch.Vecs), batch.Attrs))
 	}
 	block := NewBlock(w.seqnums)
-	w.AddBlock(block, batch, w.seqnums)
+	if _, err := w.AddBlock(block, batch, w.seqnums); err != nil {
+		return nil, err
+	}
 	return block, nil
 }
 
@@ -193,7 +201,9 @@ func (w *objectWriterV1) WriteTombstone(batch *batch.Batch) (BlockObject, error)
 	denseSeqnums := NewSeqnums(nil)
 	denseSeqnums.InitWithColCnt(len(batch.Vecs))
 	block := NewBlock(denseSeqnums)
-	w.AddTombstone(block, batch, denseSeqnums)
+	if _, err := w.AddTombstone(block, batch, denseSeqnums); err != nil {
+		return nil, err
+	}
 	return block, nil
 }
 
@@ -231,6 +241,20 @@ func (w *objectWriterV1) SetSortKeySeqnum(seqnum uint16) {
 	w.sortKeySeqnum = seqnum
 }
 
+// SetCompression sets the codec of the extents written after it, Lz4 by
+// default. The codec is recorded in every extent, readers do not need
+// to know it in advance.
+func (w *objectWriterV1) SetCompression(algo uint8) {
+	w.compressAlgo = algo
+}
+
+// SetCompressionLevel sets the level of the codec, see
+// compress.CompressLevel. The level is not recorded, the extents of
+// every level of a codec are read the same.
+func (w *objectWriterV1) SetCompressionLevel(level int) {
+	w.compressLevel = level
+}
+
 func (w *objectWriterV1) WriteObjectMetaBF(buf []byte) (err error) {
 	w.bloomFilter = buf
 	return
@@ -422,6 +446,9 @@ func (w *objectWriterV1) WriteEnd(ctx context.Context, items ...WriteOptions) ([
 	var err error
 	w.RLock()
 	defer w.RUnlock()
+	if w.aborted {
+		return nil, w.abortedError()
+	}
 
 	objectHeader := BuildHeader()
 	objectHeader.SetSchemaVersion(w.schemaVer)
@@ -562,6 +589,9 @@ func (w *objectWriterV1) WriteEnd(ctx context.Context, items ...WriteOptions) ([
 
 func (w *objectWriterV1) Sync(ctx context.Context, items ...WriteOptions) error {
 	var err error
+	if w.aborted {
+		return w.abortedError()
+	}
 	w.buffer.SetDataOptions(items...)
 	defer func() {
 		if err != nil {
@@ -614,16 +644,35 @@ func (w *objectWriterV1) WriteWithCompress(offset uint32, buf []byte) (data []by
 	if len(w.compressBuf) < compressBlockBound {
 		w.compressBuf = make([]byte, compressBlockBound)
 	}
-	if tmpData, err = compress.Compress(buf, w.compressBuf[:compressBlockBound], compress.Lz4); err != nil {
+	if tmpData, err = compress.CompressLevel(buf, w.compressBuf[:compressBlockBound], int(w.compressAlgo), w.compressLevel); err != nil {
 		return
 	}
 	length := uint32(len(tmpData))
 	data = make([]byte, length)
 	copy(data, tmpData[:length])
-	extent = NewExtent(compress.Lz4, offset, length, uint32(dataLen))
+	extent = NewExtent(w.compressAlgo, offset, length, uint32(dataLen))
 	return
 }
 
+// Abort drops the blocks, bloom filters and buffers the writer holds
+// without writing them, e.g. when the object is given up on an error.
+// The writer cannot be used after it.
+func (w *objectWriterV1) Abort() {
+	w.Lock()
+	defer w.Unlock()
+	w.aborted = true
+	w.blocks = nil
+	w.buffer = nil
+	w.compressBuf = nil
+	w.bloomFilter = nil
+	w.colmeta = nil
+	w.tombstonesColmeta = nil
+}
+
+func (w *objectWriterV1) abortedError() error {
+	return moerr.NewInternalErrorNoCtx("object writer of %s is aborted", w.fileName)
+}
+
 func (w *objectWriterV1) addBlock(blocks *[]blockData, blockMeta BlockObject, bat *batch.Batch, seqnums *Seqnums) (int, error) {
 	// CHANGE ME
 	// block.BlockHeader()return w.WriteWithCompress(offset, buf.Bytes()).SetBlockID(w.lastId)
@@ -674,6 +723,9 @@ func (w *objectWriterV1) addBlock(blocks *[]blockData, blockMeta BlockObject, ba
 func (w *objectWriterV1) AddBlock(blockMeta BlockObject, bat *batch.Batch, seqnums *Seqnums) (int, error) {
 	w.Lock()
 	defer w.Unlock()
+	if w.aborted {
+		return 0, w.abortedError()
+	}
 
 	return w.addBlock(&w.blocks[SchemaData], blockMeta, bat, seqnums)
 }
@@ -681,6 +733,9 @@ func (w *objectWriterV1) AddBlock(blockMeta BlockObject, bat *batch.Batch, seqnu
 func (w *objectWriterV1) AddTombstone(blockMeta BlockObject, bat *batch.Batch, seqnums *Seqnums) (int, error) {
 	w.Lock()
 	defer w.Unlock()
+	if w.aborted {
+		return 0, w.abortedError()
+	}
 	if w.tombstonesColmeta == nil {
 		w.tombstonesColmeta = make([]ColumnMeta, len(bat.Vecs))
 	}
@@ -693,6 +748,9 @@ func (w *objectWriterV1) AddTombstone(blockMeta BlockObject, bat *batch.Batch, s
 func (w *objectWriterV1) AddSubBlock(blockMeta BlockObject, bat *batch.Batch, seqnums *Seqnums, dataType DataMetaType) (int, error) {
 	w.Lock()
 	defer w.Unlock()
+	if w.aborted {
+		return 0, w.abortedError()
+	}
 	if dataType < CkpMetaStart {
 		panic("invalid data type")
 	}
@@ -93,6 +93,14 @@ func (w *BlockWriter) SetAppendable() {
 	w.writer.SetAppendable()
 }
 
+func (w *BlockWriter) SetCompression(algo uint8) {
+	w.writer.SetCompression(algo)
+}
+
+func (w *BlockWriter) SetCompressionLevel(level int) {
+	w.writer.SetCompressionLevel(level)
+}
+
 func (w *BlockWriter) GetObjectStats() []objectio.ObjectStats {
 	return w.objectStats
 }
@@ -218,6 +226,15 @@ func (w *BlockWriter) Sync(ctx context.Context) ([]objectio.BlockObject, objecti
 		common.OperandField(w.writer.GetMaxSeqnum()))
 	return blocks, blocks[0].BlockHeader().MetaLocation(), err
 }
+
+// Abort drops what the writer holds without writing the object, for a
+// writer given up before Sync, e.g. on an error. The writer cannot be
+// used after it.
+func (w *BlockWriter) Abort() {
+	w.writer.Abort()
+	w.objMetaBuilder = nil
+}
+
 func (w *BlockWriter) Stats() objectio.ObjectStats {
 	return w.writer.GetDataStats()
 }
@@ -339,3 +339,38 @@ func TestWriter_WriteBlockAndBF(t *testing.T) {
 		},
 	)
 }
+
+func TestWriter_Abort(t *testing.T) {
+	defer testutils.AfterTest(t)()
+	ctx := context.Background()
+
+	dir := testutils.InitTestEnv(ModuleName, t)
+	dir = path.Join(dir, "/local")
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	c := fileservice.Config{
+		Name:    defines.LocalFileServiceName,
+		Backend: "DISK",
+		DataDir: dir,
+	}
+	service, err := fileservice.NewFileService(ctx, c, nil)
+	require.NoError(t, err)
+	writer, err := NewBlockWriterNew(service, name, 0, nil)
+	require.NoError(t, err)
+
+	schema := catalog.MockSchemaAll(13, 2)
+	bats := catalog.MockBatch(schema, 100).Split(2)
+	_, err = writer.WriteBatch(containers.ToCNBatch(bats[0]))
+	require.NoError(t, err)
+
+	// An aborted writer drops its blocks, writes nothing and fails the
+	// calls after it.
+	writer.Abort()
+	_, err = writer.WriteBatch(containers.ToCNBatch(bats[1]))
+	require.Error(t, err)
+	_, err = writer.WriteTombstoneBatch(containers.ToCNBatch(bats[1]))
+	require.Error(t, err)
+	_, _, err = writer.Sync(ctx)
+	require.Error(t, err)
+	_, err = service.StatFile(ctx, name.String())
+	require.Error(t, err)
+}
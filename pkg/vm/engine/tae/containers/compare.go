@@ -0,0 +1,206 @@
+// Copyright 2022 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package containers
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+const defaultMaxMismatches = 10
+
+type CompareOptions struct {
+	// MaxMismatches is the number of mismatches a Diff describes, the
+	// others are only counted. 10 when not set.
+	MaxMismatches int
+	// IgnoreAttrs are the columns left out of the comparison.
+	IgnoreAttrs []string
+}
+
+// Diff is the outcome of CompareBatches, the two batches are the same
+// when it is empty.
+type Diff struct {
+	// Count is the number of mismatches found.
+	Count int
+	// Mismatches describes the first mismatches found.
+	Mismatches []string
+	max        int
+}
+
+func newDiff(max int) Diff {
+	if max <= 0 {
+		max = defaultMaxMismatches
+	}
+	return Diff{max: max}
+}
+
+func (d *Diff) Empty() bool {
+	return d.Count == 0
+}
+
+func (d *Diff) add(format string, args ...any) {
+	d.Count++
+	if len(d.Mismatches) < d.max {
+		d.Mismatches = append(d.Mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// Merge adds the mismatches of other to d, prefixed by prefix.
+func (d *Diff) Merge(prefix string, other Diff) {
+	if d.max == 0 {
+		d.max = defaultMaxMismatches
+	}
+	d.Count += other.Count
+	for _, m := range other.Mismatches {
+		if len(d.Mismatches) == d.max {
+			break
+		}
+		d.Mismatches = append(d.Mismatches, prefix+m)
+	}
+}
+
+func (d *Diff) String() string {
+	if d.Empty() {
+		return "no mismatch"
+	}
+	var w strings.Builder
+	fmt.Fprintf(&w, "%d mismatches", d.Count)
+	for _, m := range d.Mismatches {
+		w.WriteString("\n  ")
+		w.WriteString(m)
+	}
+	if d.Count > len(d.Mismatches) {
+		w.WriteString("\n  ...")
+	}
+	return w.String()
+}
+
+// CompareBatches compares the attrs, the deletes and the columns of a
+// and b row by row, nulls included, and describes how they differ.
+func CompareBatches(a, b *Batch, opts CompareOptions) Diff {
+	diff := newDiff(opts.MaxMismatches)
+	ignored := make(map[string]struct{}, len(opts.IgnoreAttrs))
+	for _, attr := range opts.IgnoreAttrs {
+		ignored[attr] = struct{}{}
+	}
+	if a == nil || b == nil {
+		if a != b {
+			diff.add("batch: %v vs %v", a != nil, b != nil)
+		}
+		return diff
+	}
+	if a.Length() != b.Length() {
+		diff.add("length: %d vs %d", a.Length(), b.Length())
+	}
+	if !common.BitmapEqual(a.Deletes, b.Deletes) {
+		diff.add("deletes: %d vs %d rows", a.DeleteCnt(), b.DeleteCnt())
+	}
+	attrs := func(bat *Batch) []string {
+		kept := make([]string, 0, len(bat.Attrs))
+		for _, attr := range bat.Attrs {
+			if _, ok := ignored[attr]; !ok {
+				kept = append(kept, attr)
+			}
+		}
+		return kept
+	}
+	aAttrs, bAttrs := attrs(a), attrs(b)
+	if len(aAttrs) != len(bAttrs) {
+		diff.add("attrs: %v vs %v", aAttrs, bAttrs)
+	}
+	for i := 0; i < len(aAttrs) && i < len(bAttrs); i++ {
+		if aAttrs[i] != bAttrs[i] {
+			diff.add("attr %d: %s vs %s", i, aAttrs[i], bAttrs[i])
+			continue
+		}
+		compareVectors(&diff, aAttrs[i], a.GetVectorByName(aAttrs[i]), b.GetVectorByName(bAttrs[i]))
+	}
+	return diff
+}
+
+func compareVectors(diff *Diff, attr string, a, b Vector) {
+	if *a.GetType() != *b.GetType() {
+		diff.add("%s: type %s vs %s", attr, a.GetType().String(), b.GetType().String())
+		return
+	}
+	rows := a.Length()
+	if b.Length() < rows {
+		rows = b.Length()
+	}
+	for i := 0; i < rows; i++ {
+		aNull, bNull := a.IsNull(i), b.IsNull(i)
+		if aNull || bNull {
+			if aNull != bNull {
+				diff.add("%s[%d]: %s vs %s", attr, i, formatValue(a, i), formatValue(b, i))
+			}
+			continue
+		}
+		if !valueEqual(a.Get(i), b.Get(i)) {
+			diff.add("%s[%d]: %s vs %s", attr, i, formatValue(a, i), formatValue(b, i))
+		}
+	}
+	if a.Length() != b.Length() {
+		diff.add("%s: length %d vs %d", attr, a.Length(), b.Length())
+	}
+}
+
+func valueEqual(a, b any) bool {
+	switch av := a.(type) {
+	case []byte:
+		return bytes.Equal(av, b.([]byte))
+	case types.TS:
+		bv := b.(types.TS)
+		return av.Equal(&bv)
+	case types.Blockid:
+		return av == b.(types.Blockid)
+	case types.Rowid:
+		return av.Equal(b.(types.Rowid))
+	case float32:
+		bv := b.(float32)
+		return av == bv || (math.IsNaN(float64(av)) && math.IsNaN(float64(bv)))
+	case float64:
+		bv := b.(float64)
+		return av == bv || (math.IsNaN(av) && math.IsNaN(bv))
+	default:
+		return a == b
+	}
+}
+
+func formatValue(vec Vector, i int) string {
+	if vec.IsNull(i) {
+		return "null"
+	}
+	switch v := vec.Get(i).(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return fmt.Sprintf("%q", v)
+		}
+		return fmt.Sprintf("0x%x", v)
+	case types.TS:
+		return v.ToString()
+	case types.Blockid:
+		return v.String()
+	case types.Rowid:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
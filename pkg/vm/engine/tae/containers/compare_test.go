@@ -0,0 +1,75 @@
+// Copyright 2022 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package containers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareBatches(t *testing.T) {
+	defer testutils.AfterTest(t)()
+	attrs := []string{"id", "ts", "blk", "name"}
+	vecTypes := []types.Type{
+		types.T_int32.ToType(),
+		types.T_TS.ToType(),
+		types.T_Blockid.ToType(),
+		types.T_varchar.ToType(),
+	}
+	blk := types.Blockid{1}
+	build := func(rows int) *Batch {
+		bat := BuildBatch(attrs, vecTypes, Options{})
+		for i := 0; i < rows; i++ {
+			bat.Vecs[0].Append(int32(i), false)
+			bat.Vecs[1].Append(types.BuildTS(int64(i), 0), false)
+			bat.Vecs[2].Append(blk, false)
+			bat.Vecs[3].Append([]byte("row"), i == 2)
+		}
+		return bat
+	}
+
+	a, b := build(4), build(4)
+	defer a.Close()
+	defer b.Close()
+	diff := CompareBatches(a, b, CompareOptions{})
+	assert.True(t, diff.Empty(), diff.String())
+
+	b.Vecs[1].Update(1, types.BuildTS(9, 0), false)
+	b.Vecs[2].Update(3, types.Blockid{2}, false)
+	b.Vecs[3].Update(2, []byte("row"), false)
+	diff = CompareBatches(a, b, CompareOptions{})
+	assert.Equal(t, 3, diff.Count)
+	assert.True(t, strings.HasPrefix(diff.Mismatches[0], "ts[1]: "))
+	assert.True(t, strings.HasPrefix(diff.Mismatches[1], "blk[3]: "))
+	assert.Equal(t, `name[2]: null vs "row"`, diff.Mismatches[2])
+
+	diff = CompareBatches(a, b, CompareOptions{MaxMismatches: 1, IgnoreAttrs: []string{"ts"}})
+	assert.Equal(t, 2, diff.Count)
+	assert.Equal(t, 1, len(diff.Mismatches))
+	assert.True(t, strings.HasSuffix(diff.String(), "..."))
+
+	c := build(3)
+	defer c.Close()
+	diff = CompareBatches(a, c, CompareOptions{IgnoreAttrs: attrs})
+	assert.Equal(t, []string{"length: 4 vs 3"}, diff.Mismatches)
+
+	var merged Diff
+	merged.Merge("batch 1: ", diff)
+	assert.Equal(t, []string{"batch 1: length: 4 vs 3"}, merged.Mismatches)
+}
@@ -15,6 +15,7 @@
 package logtail
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"math"
@@ -22,18 +23,19 @@ import (
 
 	"github.com/matrixorigin/matrixone/pkg/catalog"
 	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
 	"github.com/matrixorigin/matrixone/pkg/container/batch"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
 	"github.com/matrixorigin/matrixone/pkg/fileservice"
-	"github.com/matrixorigin/matrixone/pkg/logutil"
 	"github.com/matrixorigin/matrixone/pkg/objectio"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
 	catalog2 "github.com/matrixorigin/matrixone/pkg/vm/engine/tae/catalog"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/db/dbutils"
-	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/mergesort"
 	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+	"go.uber.org/zap"
 )
 
 type fileData struct {
@@ -55,6 +57,11 @@ type objData struct {
 	tid       uint64
 	delete    bool
 	isABlock  bool
+	// dropped is set when the aBlock has no rows at ts.
+	dropped bool
+	// parts are the stats of the objects after the first the aBlock is
+	// converted to, see WithConvertedObjectRows.
+	parts []objectio.ObjectStats
 }
 
 type blockData struct {
@@ -69,6 +76,158 @@ type blockData struct {
 	blockId   types.Blockid
 	tid       uint64
 	tombstone *blockData
+	// dropped is set when the aBlock has no rows at ts.
+	dropped bool
+	// filtered are the rows of the aBlock the row filter rejects, they
+	// are removed together with the deleted rows.
+	filtered []int64
+	// users is the number of pending uses of the data of a tombstone
+	// block, see retainTombstones.
+	users int
+}
+
+// release frees the data of the tombstone block b once its last user is
+// done with it, rather than with the other blocks when the rewrite
+// ends.
+func (b *blockData) release() {
+	if b.users--; b.users > 0 {
+		return
+	}
+	b.users = 0
+	if b.data == nil {
+		return
+	}
+	for _, vec := range b.data.Vecs {
+		vec.Free(common.CheckpointAllocator)
+	}
+	b.data = nil
+}
+
+// resetTrim drops what trimObject loaded for f, before f is trimmed
+// again or skipped.
+func (f *fileData) resetTrim() {
+	if f.obj != nil {
+		for _, bat := range f.obj.data {
+			for _, vec := range bat.Vecs {
+				vec.Free(common.CheckpointAllocator)
+			}
+		}
+		f.obj.data = nil
+		f.obj.dropped = false
+	}
+	for _, block := range f.data {
+		if block.data != nil {
+			for _, vec := range block.data.Vecs {
+				vec.Free(common.CheckpointAllocator)
+			}
+			block.data = nil
+		}
+		block.dropped = false
+		block.filtered = nil
+	}
+	f.isChange = false
+}
+
+// retainTombstones counts the users of the tombstone blocks linked to
+// aBlocks: the conversion of each aBlock, and the rewrite of the object
+// of the tombstone.
+func retainTombstones(objectsData map[string]*fileData) {
+	for _, objectData := range objectsData {
+		for _, block := range objectData.data {
+			if block.tombstone != nil {
+				block.tombstone.users++
+			}
+		}
+	}
+	for _, objectData := range objectsData {
+		if !objectData.rewrittenInPlace() {
+			continue
+		}
+		for _, block := range objectData.data {
+			if block.users > 0 {
+				block.users++
+			}
+		}
+	}
+}
+
+// sortBlocks returns the blocks of data ordered by num. Two blocks never
+// share a num unless the checkpoint is corrupted, they are then ordered
+// by block id and location so that the rewrite stays deterministic, and
+// the duplicated nums are returned.
+func sortBlocks(data map[uint16]*blockData) ([]*blockData, []uint16) {
+	blocks := make([]*blockData, 0, len(data))
+	for _, block := range data {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].num != blocks[j].num {
+			return blocks[i].num < blocks[j].num
+		}
+		if c := blocks[i].blockId.Compare(blocks[j].blockId); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(blocks[i].location, blocks[j].location) < 0
+	})
+	var duplicates []uint16
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].num != blocks[i-1].num {
+			continue
+		}
+		if len(duplicates) == 0 || duplicates[len(duplicates)-1] != blocks[i].num {
+			duplicates = append(duplicates, blocks[i].num)
+		}
+	}
+	return blocks, duplicates
+}
+
+// size returns the size of the object file. Without object stats it is
+// estimated from the meta extent, the meta is written right before the
+// footer at the end of the file.
+func (f *fileData) size() int64 {
+	if f.obj != nil && f.obj.stats != nil {
+		return int64(f.obj.stats.Size())
+	}
+	var size int64
+	for _, block := range f.data {
+		if end := int64(block.location.Extent().End()) + objectio.FooterSize; end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// table returns the table of the object, that of its first block for a
+// tombstone object without object entry.
+func (f *fileData) table() uint64 {
+	if f.obj != nil {
+		return f.obj.tid
+	}
+	var first *blockData
+	for _, block := range f.data {
+		if first == nil || block.num < first.num {
+			first = block
+		}
+	}
+	if first == nil {
+		return 0
+	}
+	return first.tid
+}
+
+// rewrittenInPlace tells if the object is written again under its own
+// name, either a changed data object or a changed tombstone object.
+func (f *fileData) rewrittenInPlace() bool {
+	return f.isChange &&
+		(!f.isDeleteBatch || (f.data[0] != nil && f.data[0].blockType == objectio.SchemaTombstone))
+}
+
+func sumObjectSizes(sizes map[string]int64) int64 {
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total
 }
 
 type iBlocks struct {
@@ -79,6 +238,38 @@ type iObjects struct {
 	rowObjects []*insertObjects
 }
 
+// addInsertBlock files ib under the table tid, unless the table already
+// has an entry for the same block: a block registered by more than one
+// row is transferred once.
+func addInsertBlock(insertBatch map[uint64]*iBlocks, tid uint64, ib *insertBlock) {
+	blocks := insertBatch[tid]
+	if blocks == nil {
+		blocks = &iBlocks{
+			insertBlocks: make([]*insertBlock, 0),
+		}
+		insertBatch[tid] = blocks
+	}
+	for _, other := range blocks.insertBlocks {
+		if other.blockId == ib.blockId {
+			return
+		}
+	}
+	blocks.insertBlocks = append(blocks.insertBlocks, ib)
+}
+
+// addMergedBlocks files the blocks of a merged nBlock object under their
+// own table, an object can hold blocks of several.
+func addMergedBlocks(insertBatch map[uint64]*iBlocks, dataBlocks []*blockData) {
+	for _, dt := range dataBlocks {
+		addInsertBlock(insertBatch, dt.tid, &insertBlock{
+			blockId:   dt.blockId,
+			apply:     false,
+			deleteRow: dt.deleteRow[len(dt.deleteRow)-1],
+			data:      dt,
+		})
+	}
+}
+
 type insertBlock struct {
 	blockId   objectio.Blockid
 	location  objectio.Location
@@ -91,34 +282,102 @@ type insertObjects struct {
 	location objectio.Location
 	apply    bool
 	obj      *objData
+	// merged is set for an aBlock converted into the object of another
+	// aBlock, see WithABlockBatching. Its row is kept as the row of a
+	// converted aBlock is, the object has the row of the other.
+	merged bool
 }
 
+// tableOffset is the range of rows of a table in a checkpoint batch.
+// The table meta of a checkpoint has a single range per table and
+// batch, so the rows of a table must be contiguous, see groupByTable.
 type tableOffset struct {
 	offset int
 	end    int
 }
 
+// groupByTable returns the range of rows of each table in bats, row
+// aligned batches of the checkpoint batches idxes whose tids are tids.
+// The rows of a table that are not contiguous are moved next to each
+// other first, keeping their order, and the batches are replaced by the
+// grouped ones, allocated from mp.
+func groupByTable(
+	idxes []uint16,
+	bats []*containers.Batch,
+	tids containers.Vector,
+	mp *mpool.MPool,
+) (map[uint64]*tableOffset, error) {
+	tables := make(map[uint64]*tableOffset)
+	order := make([]uint64, 0)
+	rows := make(map[uint64][]int)
+	contiguous := true
+	for i := 0; i < tids.Length(); i++ {
+		tid := tids.Get(i).(uint64)
+		if tables[tid] == nil {
+			tables[tid] = &tableOffset{
+				offset: i,
+				end:    i,
+			}
+			order = append(order, tid)
+		} else if tables[tid].end != i {
+			contiguous = false
+		}
+		tables[tid].end = i + 1
+		rows[tid] = append(rows[tid], i)
+	}
+	if contiguous {
+		return tables, nil
+	}
+
+	grouped := make([]*containers.Batch, len(bats))
+	for i, idx := range idxes {
+		grouped[i] = makeRespBatchFromSchema(checkpointDataSchemas_Curr[idx], mp)
+	}
+	for _, tid := range order {
+		table := tables[tid]
+		table.offset = grouped[0].Vecs[0].Length()
+		for _, row := range rows[tid] {
+			for i := range bats {
+				if err := appendValToBatch(bats[i], grouped[i], row); err != nil {
+					for _, bat := range grouped {
+						bat.Close()
+					}
+					return nil, err
+				}
+			}
+		}
+		table.end = grouped[0].Vecs[0].Length()
+	}
+	for i := range bats {
+		bats[i].Close()
+		bats[i] = grouped[i]
+	}
+	return tables, nil
+}
+
 func getCheckpointData(
 	ctx context.Context,
 	sid string,
 	fs fileservice.FileService,
 	location objectio.Location,
 	version uint32,
-) (*CheckpointData, error) {
-	data := NewCheckpointData(sid, common.CheckpointAllocator)
+) (data *CheckpointData, err error) {
+	data = NewCheckpointData(sid, common.CheckpointAllocator)
+	defer func() {
+		if err != nil {
+			data.Close()
+			data = nil
+		}
+	}()
 	reader, err := blockio.NewObjectReader(sid, fs, location)
 	if err != nil {
-		return nil, err
+		return
 	}
-	err = data.readMetaBatch(ctx, version, reader, nil)
-	if err != nil {
-		return nil, err
+	if err = data.readMetaBatch(ctx, version, reader, nil); err != nil {
+		return
 	}
 	err = data.readAll(ctx, version, fs)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return
 }
 
 func addObjectToObjectData(
@@ -222,158 +481,847 @@ func addBlockToObjectData(
 	}
 }
 
+// releaseObjectsData frees the blocks trimObjectsData loaded.
+func releaseObjectsData(objectsData map[string]*fileData) {
+	for i := range objectsData {
+		if objectsData[i].obj != nil && objectsData[i].obj.data != nil {
+			for z := range objectsData[i].obj.data {
+				for y := range objectsData[i].obj.data[z].Vecs {
+					objectsData[i].obj.data[z].Vecs[y].Free(common.DebugAllocator)
+				}
+			}
+		}
+		for j := range objectsData[i].data {
+			if objectsData[i].data[j].data == nil {
+				continue
+			}
+			for z := range objectsData[i].data[j].data.Vecs {
+				objectsData[i].data[j].data.Vecs[z].Free(common.CheckpointAllocator)
+			}
+		}
+	}
+}
+
+// trimObjectsData loads the aBlocks and tombstone blocks of objectsData
+// and cuts off the rows committed after ts. The commit timestamps of the
+// rows are only ever compared to ts, the current time is not involved,
+// so the result is fully determined by ts and the loaded blocks.
+//
+// Each object is trimmed as a whole or not at all. When an error is
+// returned, every object of objectsData is reset, none of them is left
+// marked as changed or holding a part of its trimmed blocks.
 func trimObjectsData(
 	ctx context.Context,
 	fs fileservice.FileService,
 	ts types.TS,
 	objectsData *map[string]*fileData,
+	options *backupOptions,
+) (isCkpChange bool, err error) {
+	defer func() {
+		if err != nil {
+			for _, objectData := range *objectsData {
+				objectData.resetTrim()
+			}
+			isCkpChange = false
+		}
+	}()
+	// The tombstone blocks the aBlocks are converted with.
+	linked := make(map[*blockData]bool)
+	for _, objectData := range *objectsData {
+		for _, block := range objectData.data {
+			if block.tombstone != nil {
+				linked[block.tombstone] = true
+			}
+		}
+	}
+	for name := range *objectsData {
+		if err := ctx.Err(); err != nil {
+			return isCkpChange, err
+		}
+		var changed bool
+		err = options.session.Attempt(ctx, name, func(ctx context.Context) (err error) {
+			report := &trimReport{audit: options.audit != nil}
+			if changed, err = trimObject(ctx, fs, ts, name, objectsData, linked, report, options); err != nil {
+				(*objectsData)[name].resetTrim()
+				return
+			}
+			return report.commit(options)
+		})
+		if options.skipped(err) {
+			// The object may have rows to trim, the checkpoint drops
+			// it rather than keep it as it is, see dropSkipped.
+			options.dropSkipped(name)
+			delete(*objectsData, name)
+			unlinkObject(*objectsData, name)
+			err = nil
+			isCkpChange = true
+			continue
+		}
+		if options.collectedObject(name, err) {
+			// The checkpoint drops the object, see dropCollected.
+			delete(*objectsData, name)
+			unlinkObject(*objectsData, name)
+			err = nil
+			isCkpChange = true
+			continue
+		}
+		if err != nil {
+			return isCkpChange, err
+		}
+		isCkpChange = isCkpChange || changed
+	}
+	return isCkpChange, nil
+}
+
+// trimReport holds what the trim of an object has to tell the options:
+// the first late commit, the trimmed blocks and, if audit is set, the
+// rows they lost. It is only committed once the whole object is
+// trimmed, an object that fails half way reports nothing.
+type trimReport struct {
+	firstLate types.TS
+	trimmed   []TrimmedBlock
+	audit     bool
+	audited   []TrimmedRow
+}
+
+func (r *trimReport) noteLate(commit types.TS) {
+	if r.firstLate.IsEmpty() || commit.Less(&r.firstLate) {
+		r.firstLate = commit
+	}
+}
+
+func (r *trimReport) observeTrim(location objectio.Location, rows, late, filtered int) {
+	r.trimmed = append(r.trimmed, TrimmedBlock{
+		Location: location,
+		Rows:     rows,
+		Late:     late,
+		Filtered: filtered,
+	})
+}
+
+func (r *trimReport) commit(options *backupOptions) error {
+	if !r.firstLate.IsEmpty() {
+		options.noteLate(r.firstLate)
+	}
+	for _, block := range r.trimmed {
+		options.observeTrim(block.Location, block.Rows, block.Late, block.Filtered)
+	}
+	if options.audit == nil {
+		return nil
+	}
+	return options.audit.write(r.audited)
+}
+
+// trimObject trims the object name of objectsData, see trimObjectsData,
+// and reports whether the checkpoint changes. What it loaded is left in
+// objectsData when it fails, for resetTrim to drop, and what it has to
+// report is kept in report until the caller commits it.
+func trimObject(
+	ctx context.Context,
+	fs fileservice.FileService,
+	ts types.TS,
+	name string,
+	objectsData *map[string]*fileData,
+	linked map[*blockData]bool,
+	report *trimReport,
+	options *backupOptions,
 ) (bool, error) {
 	isCkpChange := false
-	for name := range *objectsData {
-		isChange := false
-		if (*objectsData)[name].obj != nil && (*objectsData)[name].obj.isABlock {
-			if !(*objectsData)[name].obj.delete {
-				panic(fmt.Sprintf("object %s is not a delete batch", name))
-			}
-			if len((*objectsData)[name].data) == 0 {
-				var bat *batch.Batch
-				var err error
-				commitTs := types.TS{}
-				// As long as there is an aBlk to be deleted, isCkpChange must be set to true.
-				isCkpChange = true
-				obj := (*objectsData)[name].obj
-				location := obj.stats.ObjectLocation()
-				meta, err := objectio.FastLoadObjectMeta(ctx, &location, false, fs)
-				if err != nil {
-					return isCkpChange, err
-				}
-				sortKey := uint16(math.MaxUint16)
-				if meta.MustDataMeta().BlockHeader().Appendable() {
-					sortKey = meta.MustDataMeta().BlockHeader().SortKey()
-				}
-				bat, err = blockio.LoadOneBlock(ctx, fs, location, objectio.SchemaData)
-				if err != nil {
+	isChange := false
+	var tombstones []uint16
+	if (*objectsData)[name].obj != nil && (*objectsData)[name].obj.isABlock {
+		if !(*objectsData)[name].obj.delete {
+			panic(fmt.Sprintf("object %s is not a delete batch", name))
+		}
+		if len((*objectsData)[name].data) == 0 {
+			var bat *batch.Batch
+			var err error
+			// As long as there is an aBlk to be deleted, isCkpChange must be set to true.
+			isCkpChange = true
+			obj := (*objectsData)[name].obj
+			location := obj.stats.ObjectLocation()
+			sortKey, err := appendableSortKey(ctx, fs, location)
+			if err != nil {
+				return isCkpChange, err
+			}
+			bat, err = blockio.LoadOneBlock(ctx, fs, location, objectio.SchemaData)
+			if err != nil {
+				return isCkpChange, err
+			}
+			if err = options.checkLoadedBlock(ctx, bat, location); err != nil {
+				return isCkpChange, err
+			}
+			if err = options.scanDuplicateRowIDs(bat, obj.tid, location); err != nil {
+				return isCkpChange, err
+			}
+			late, inOrder, err := options.lateRows(bat, ts, location)
+			if err != nil {
+				return isCkpChange, err
+			}
+			rows := bat.Vecs[0].Length()
+			if err = report.auditRows(bat, late, obj.tid, location); err != nil {
+				return isCkpChange, err
+			}
+			if len(late) > 0 {
+				if err = cutRows(bat, late, inOrder, options.cnAllocator); err != nil {
 					return isCkpChange, err
 				}
-				for v := 0; v < bat.Vecs[0].Length(); v++ {
-					err = commitTs.Unmarshal(bat.Vecs[len(bat.Vecs)-2].GetRawBytesAt(v))
-					if err != nil {
-						return isCkpChange, err
-					}
-					if commitTs.Greater(&ts) {
-						windowCNBatch(bat, 0, uint64(v))
-						logutil.Debugf("blkCommitTs %v ts %v , block is %v",
-							commitTs.ToString(), ts.ToString(), location.String())
-						isChange = true
-						break
-					}
-				}
-				(*objectsData)[name].obj.sortKey = sortKey
-				(*objectsData)[name].obj.data = make([]*batch.Batch, 0)
-				bat = formatData(bat)
-				(*objectsData)[name].obj.data = append((*objectsData)[name].obj.data, bat)
+				isChange = true
+			}
+			filtered := options.filterRows(bat, nil)
+			if err = report.auditRows(bat, filtered, obj.tid, location); err != nil {
+				return isCkpChange, err
+			}
+			if len(filtered) > 0 {
+				bat.Shrink(filtered, true)
+				isChange = true
+			}
+			report.observeTrim(location, rows, len(late), len(filtered))
+			if bat.Vecs[0].Length() == 0 {
+				(*objectsData)[name].obj.dropped = true
 				(*objectsData)[name].isChange = isChange
-				continue
+				return isCkpChange, nil
+			}
+			(*objectsData)[name].obj.sortKey = sortKey
+			(*objectsData)[name].obj.data = make([]*batch.Batch, 0)
+			if bat, err = options.normalize(bat); err != nil {
+				return isCkpChange, err
 			}
+			if bat, err = options.upgradeColumns(obj.tid, bat); err != nil {
+				return isCkpChange, err
+			}
+			(*objectsData)[name].obj.data = append((*objectsData)[name].obj.data, bat)
+			(*objectsData)[name].isChange = isChange
+			return isCkpChange, nil
 		}
+	}
 
-		for id, block := range (*objectsData)[name].data {
-			if !block.isABlock && block.blockType == objectio.SchemaData {
-				continue
+	for id, block := range (*objectsData)[name].data {
+		if !block.isABlock && block.blockType == objectio.SchemaData {
+			continue
+		}
+		if block.blockType == objectio.SchemaTombstone {
+			// Only the commit ts are read to decide, the blocks are
+			// loaded once the object is known to be used.
+			late, first, err := tombstoneHasLateRows(ctx, fs, block.location, ts)
+			if err != nil {
+				return isCkpChange, err
 			}
-			var bat *batch.Batch
-			var err error
-			commitTs := types.TS{}
-			if block.blockType == objectio.SchemaTombstone {
-				bat, err = blockio.LoadOneBlock(ctx, fs, block.location, objectio.SchemaTombstone)
-				if err != nil {
-					return isCkpChange, err
-				}
-				deleteRow := make([]int64, 0)
-				for v := 0; v < bat.Vecs[0].Length(); v++ {
-					err = commitTs.Unmarshal(bat.Vecs[len(bat.Vecs)-3].GetRawBytesAt(v))
-					if err != nil {
-						return isCkpChange, err
-					}
-					if commitTs.Greater(&ts) {
-						logutil.Debugf("delete row %v, commitTs %v, location %v",
-							v, commitTs.ToString(), block.location.String())
-						isChange = true
-						isCkpChange = true
-					} else {
-						deleteRow = append(deleteRow, int64(v))
-					}
-				}
-				if len(deleteRow) != bat.Vecs[0].Length() {
-					bat.Shrink(deleteRow, false)
-				}
-			} else {
-				// As long as there is an aBlk to be deleted, isCkpChange must be set to true.
+			if late {
+				report.noteLate(first)
+				isChange = true
 				isCkpChange = true
-				meta, err := objectio.FastLoadObjectMeta(ctx, &block.location, false, fs)
-				if err != nil {
+			}
+			tombstones = append(tombstones, id)
+			continue
+		}
+		// As long as there is an aBlk to be deleted, isCkpChange must be set to true.
+		isCkpChange = true
+		sortKey, err := appendableSortKey(ctx, fs, block.location)
+		if err != nil {
+			return isCkpChange, err
+		}
+		bat, err := blockio.LoadOneBlock(ctx, fs, block.location, objectio.SchemaData)
+		if err != nil {
+			return isCkpChange, err
+		}
+		if err = options.checkLoadedBlock(ctx, bat, block.location); err != nil {
+			return isCkpChange, err
+		}
+		if err = options.scanDuplicateRowIDs(bat, block.tid, block.location); err != nil {
+			return isCkpChange, err
+		}
+		late, inOrder, err := options.lateRows(bat, ts, block.location)
+		if err != nil {
+			return isCkpChange, err
+		}
+		(*objectsData)[name].data[id].sortKey = sortKey
+		rows, lateRows := bat.Vecs[0].Length(), len(late)
+		if (*objectsData)[name].isDeleteBatch {
+			// The rows are removed on conversion, the deletes of the
+			// block refer to them by offset. Only a tail can be cut
+			// right away.
+			if len(late) > 0 && inOrder {
+				if err = report.auditRows(bat, late, block.tid, block.location); err != nil {
 					return isCkpChange, err
 				}
-				sortKey := uint16(math.MaxUint16)
-				if meta.MustDataMeta().BlockHeader().Appendable() {
-					sortKey = meta.MustDataMeta().BlockHeader().SortKey()
-				}
-				bat, err = blockio.LoadOneBlock(ctx, fs, block.location, objectio.SchemaData)
-				if err != nil {
+				if err = cutRows(bat, late, inOrder, options.cnAllocator); err != nil {
 					return isCkpChange, err
 				}
-				for v := 0; v < bat.Vecs[0].Length(); v++ {
-					err = commitTs.Unmarshal(bat.Vecs[len(bat.Vecs)-2].GetRawBytesAt(v))
-					if err != nil {
-						return isCkpChange, err
-					}
-					if commitTs.Greater(&ts) {
-						windowCNBatch(bat, 0, uint64(v))
-						logutil.Debugf("blkCommitTs %v ts %v , block is %v",
-							commitTs.ToString(), ts.ToString(), block.location.String())
-						isChange = true
-						break
-					}
-				}
-				(*objectsData)[name].data[id].sortKey = sortKey
+				late = nil
+				isChange = true
+			}
+			block.filtered = options.filterRows(bat, late)
+			if err = report.auditRows(bat, block.filtered, block.tid, block.location); err != nil {
+				return isCkpChange, err
+			}
+			if len(block.filtered) > 0 {
+				isChange = true
+			}
+			report.observeTrim(block.location, rows, lateRows, len(block.filtered)-len(late))
+		} else if len(late) > 0 {
+			if err = report.auditRows(bat, late, block.tid, block.location); err != nil {
+				return isCkpChange, err
 			}
-			bat = formatData(bat)
-			(*objectsData)[name].data[id].data = bat
+			if err = cutRows(bat, late, inOrder, options.cnAllocator); err != nil {
+				return isCkpChange, err
+			}
+			isChange = true
+			report.observeTrim(block.location, rows, lateRows, 0)
+		}
+		if bat.Vecs[0].Length() == len(block.filtered) {
+			(*objectsData)[name].data[id].dropped = true
+			continue
+		}
+		if bat, err = options.normalize(bat); err != nil {
+			return isCkpChange, err
+		}
+		if bat, err = options.upgradeColumns(block.tid, bat); err != nil {
+			return isCkpChange, err
+		}
+		(*objectsData)[name].data[id].data = bat
+	}
+	// The tombstone blocks of an object that is neither rewritten nor
+	// deleted are not used, nor loaded.
+	for _, id := range tombstones {
+		block := (*objectsData)[name].data[id]
+		if !isChange && !(*objectsData)[name].isDeleteBatch && !linked[block] {
+			continue
+		}
+		bat, err := loadTombstone(ctx, fs, block.location, ts)
+		if err != nil {
+			return isCkpChange, err
+		}
+		if block.data, err = options.normalize(bat); err != nil {
+			return isCkpChange, err
 		}
-		(*objectsData)[name].isChange = isChange
 	}
+	(*objectsData)[name].isChange = isChange
 	return isCkpChange, nil
 }
 
-func applyDelete(dataBatch *batch.Batch, deleteBatch *batch.Batch, id string) error {
-	if deleteBatch == nil {
-		return nil
+// tombstoneHasLateRows reports whether the tombstone block at location
+// has rows committed after ts, and the first commit ts of them. Only
+// its commit ts column is read.
+func tombstoneHasLateRows(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	ts types.TS,
+) (late bool, first types.TS, err error) {
+	tombstoneMeta, layout, err := readTombstoneMeta(ctx, fs, location)
+	if err != nil {
+		return false, first, err
 	}
-	deleteRow := make([]int64, 0)
-	rows := make(map[int64]bool)
-	for i := 0; i < deleteBatch.Vecs[0].Length(); i++ {
-		row := deleteBatch.Vecs[0].GetRawBytesAt(i)
-		rowId := objectio.HackBytes2Rowid(row)
-		blockId, ro := rowId.Decode()
-		if blockId.String() != id {
-			continue
+	columns := tombstoneMeta.BlockHeader().ColumnCount()
+	bat, err := readBlockColumns(ctx, fs, &tombstoneMeta, location,
+		[]uint16{uint16(layout.commitTsIdx(int(columns)))})
+	if err != nil {
+		return false, first, err
+	}
+	commitTs := types.TS{}
+	for v := 0; v < bat.Vecs[0].Length(); v++ {
+		if err = unmarshalCommitTs(&commitTs, bat.Vecs[0], v, location, true); err != nil {
+			return false, first, err
+		}
+		if commitTs.Greater(&ts) && (!late || commitTs.Less(&first)) {
+			late, first = true, commitTs
 		}
-		rows[int64(ro)] = true
 	}
-	for i := 0; i < dataBatch.Vecs[0].Length(); i++ {
-		if rows[int64(i)] {
-			deleteRow = append(deleteRow, int64(i))
+	return late, first, nil
+}
+
+// loadTombstone loads the tombstone block at location without the rows
+// committed after ts. The block is returned in the current layout
+// whatever the layout it is written in.
+func loadTombstone(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	ts types.TS,
+) (*batch.Batch, error) {
+	tombstoneMeta, layout, err := readTombstoneMeta(ctx, fs, location)
+	if err != nil {
+		return nil, err
+	}
+	bat, err := readBlockColumns(ctx, fs, &tombstoneMeta, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	layout.normalize(bat)
+	commitTs := types.TS{}
+	deleteRow := make([]int64, 0)
+	for v := 0; v < bat.Vecs[0].Length(); v++ {
+		err = unmarshalCommitTs(&commitTs,
+			bat.Vecs[currentTombstoneLayout.commitTsIdx(len(bat.Vecs))], v, location, true)
+		if err != nil {
+			return nil, err
+		}
+		if commitTs.Greater(&ts) {
+			jobLogger(ctx).Debug("[ReWrite Checkpoint]", common.OperationField("drop late delete"),
+				common.AnyField("row", v),
+				common.AnyField("commitTs", commitTs.ToString()),
+				common.AnyField("location", location.String()))
+		} else {
+			deleteRow = append(deleteRow, int64(v))
 		}
 	}
-	dataBatch.Shrink(deleteRow, true)
-	return nil
+	if len(deleteRow) != bat.Vecs[0].Length() {
+		bat.Shrink(deleteRow, false)
+	}
+	return bat, nil
 }
 
-func updateBlockMeta(blkMeta, blkMetaTxn *containers.Batch, row int, blockID types.Blockid, location objectio.Location, sort bool) {
-	blkMeta.GetVectorByName(catalog2.AttrRowID).Update(
-		row,
-		objectio.HackBlockid2Rowid(&blockID),
-		false)
+// checkLoadedBlock handles an aBlock that loaded with no rows. Its
+// location is stale, e.g. the rows were already moved by a merge, and
+// the block is dropped like one that has no rows at ts. With
+// WithStrictBlockLoad it is an error instead.
+func (o *backupOptions) checkLoadedBlock(
+	ctx context.Context,
+	bat *batch.Batch,
+	location objectio.Location,
+) error {
+	if bat.Vecs[0].Length() > 0 {
+		return nil
+	}
+	if o.strictLoad {
+		return moerr.NewInternalError(ctx, "block %s loaded with no rows", location.String())
+	}
+	o.log().Warn("[TrimObjects]", common.OperationField("drop stale block"),
+		common.AnyField("block", location.String()))
+	o.stats.Warn(BackupWarning{
+		Code:   WarnStaleBlock,
+		Block:  location.String(),
+		Detail: "loaded with no rows",
+	})
+	o.stats.Phase(StatsPhaseTrim).Add(StatStaleBlocks, 1)
+	return nil
+}
+
+// filterRows adds the rows of the aBlock bat the row filter rejects to
+// the sorted rows filtered and returns them sorted.
+func (o *backupOptions) filterRows(bat *batch.Batch, filtered []int64) []int64 {
+	if o.rowFilter == nil {
+		return filtered
+	}
+	result := make([]int64, 0, len(filtered))
+	for row, i := 0, 0; row < bat.Vecs[0].Length(); row++ {
+		if i < len(filtered) && filtered[i] == int64(row) {
+			result = append(result, int64(row))
+			i++
+			continue
+		}
+		if !o.rowFilter(bat, row) {
+			result = append(result, int64(row))
+		}
+	}
+	o.stats.Phase(StatsPhaseTrim).Add(StatFilteredRows, int64(len(result)-len(filtered)))
+	return result
+}
+
+// lateRows returns the rows of the aBlock bat committed after ts. The
+// rows of an aBlock are appended in commit order, so the late rows are
+// its tail and inOrder is true. Blocks written by older replays can
+// have their commit ts go back, the late rows are then anywhere in the
+// block, and such a block is logged and counted.
+func (o *backupOptions) lateRows(
+	bat *batch.Batch,
+	ts types.TS,
+	location objectio.Location,
+) (late []int64, inOrder bool, err error) {
+	inOrder = true
+	if bat.Vecs[0].Length() == 0 {
+		return nil, inOrder, nil
+	}
+	var commitTs, prev types.TS
+	commits := bat.Vecs[len(bat.Vecs)-2]
+	for v := 0; v < bat.Vecs[0].Length(); v++ {
+		if err = unmarshalCommitTs(&commitTs, commits, v, location, false); err != nil {
+			return nil, false, err
+		}
+		if v > 0 && commitTs.Less(&prev) {
+			inOrder = false
+		}
+		if commitTs.Greater(&ts) {
+			late = append(late, int64(v))
+			o.noteLate(commitTs)
+		}
+		prev = commitTs
+	}
+	if !inOrder {
+		o.log().Warn("[TrimObjects]", common.OperationField("commit ts out of order"),
+			common.AnyField("block", location.String()),
+			common.AnyField("late rows", len(late)))
+		o.stats.Warn(BackupWarning{
+			Code:   WarnUnorderedCommits,
+			Block:  location.String(),
+			Detail: fmt.Sprintf("%d late rows", len(late)),
+		})
+		o.stats.Phase(StatsPhaseTrim).Add(StatUnorderedBlocks, 1)
+	} else if len(late) > 0 {
+		o.log().Debug("[TrimObjects]", common.OperationField("late rows"),
+			common.AnyField("first row", late[0]),
+			common.AnyField("ts", ts.ToString()),
+			common.AnyField("block", location.String()))
+	}
+	return late, inOrder, nil
+}
+
+// unmarshalCommitTs reads the commit ts of row from commits, the commit
+// ts column of the tombstone or data block at location. The error names
+// the block and the row, so that a corrupt record can be found.
+func unmarshalCommitTs(
+	commitTs *types.TS,
+	commits *vector.Vector,
+	row int,
+	location objectio.Location,
+	tombstone bool,
+) error {
+	branch := "data"
+	if tombstone {
+		branch = "tombstone"
+	}
+	raw := commits.GetRawBytesAt(row)
+	if len(raw) < types.TxnTsSize {
+		return moerr.NewInternalErrorNoCtx("%s block %s row %d: commit ts has %d bytes, expected %d",
+			branch, location.String(), row, len(raw), types.TxnTsSize)
+	}
+	if err := commitTs.Unmarshal(raw); err != nil {
+		return moerr.NewInternalErrorNoCtx("%s block %s row %d: bad commit ts: %v",
+			branch, location.String(), row, err)
+	}
+	return nil
+}
+
+// cutRows removes the late rows returned by lateRows from bat. A tail
+// is cut by copying the rows before it, so that the loaded block can be
+// freed rather than kept alive by a window into it.
+func cutRows(bat *batch.Batch, late []int64, inOrder bool, mp *mpool.MPool) error {
+	if !inOrder {
+		bat.Shrink(late, true)
+		return nil
+	}
+	for i, vec := range bat.Vecs {
+		cut, err := vec.CloneWindow(0, int(late[0]), mp)
+		if err != nil {
+			return err
+		}
+		vec.Free(common.CheckpointAllocator)
+		bat.Vecs[i] = cut
+	}
+	bat.SetRowCount(int(late[0]))
+	return nil
+}
+
+// appendableSortKey returns the sort key of the appendable object at
+// location, or math.MaxUint16 if it has none. The meta comes from the
+// meta cache, asking again for an object already loaded is cheap.
+func appendableSortKey(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+) (uint16, error) {
+	meta, err := objectio.FastLoadObjectMeta(ctx, &location, false, fs)
+	if err != nil {
+		return math.MaxUint16, err
+	}
+	sortKey := uint16(math.MaxUint16)
+	if meta.MustDataMeta().BlockHeader().Appendable() {
+		sortKey = meta.MustDataMeta().BlockHeader().SortKey()
+	}
+	return sortKey, nil
+}
+
+// schemaSortKeys returns the sort key of the tables whose columns are
+// in bat, a TBLColInsert batch: the seqnum of the primary key column,
+// or of the cluster by column if the table has no primary key. The
+// seqnum is what the block headers record as the sort key.
+func schemaSortKeys(bat *containers.Batch) map[uint64]uint16 {
+	keys := make(map[uint64]uint16)
+	if bat == nil || bat.Length() == 0 {
+		return keys
+	}
+	tids := bat.GetVectorByName(catalog.SystemColAttr_RelID)
+	constraints := bat.GetVectorByName(catalog.SystemColAttr_ConstraintType)
+	clusterBys := bat.GetVectorByName(catalog.SystemColAttr_IsClusterBy)
+	seqnums := bat.GetVectorByName(catalog.SystemColAttr_Seqnum)
+	for i := 0; i < bat.Length(); i++ {
+		if tids.IsNull(i) || seqnums.IsNull(i) {
+			continue
+		}
+		tid := tids.Get(i).(uint64)
+		if !constraints.IsNull(i) && string(constraints.Get(i).([]byte)) == catalog.SystemColPKConstraint {
+			keys[tid] = seqnums.Get(i).(uint16)
+			continue
+		}
+		if _, ok := keys[tid]; ok {
+			continue
+		}
+		if !clusterBys.IsNull(i) && clusterBys.Get(i).(int8) == 1 {
+			keys[tid] = seqnums.Get(i).(uint16)
+		}
+	}
+	return keys
+}
+
+// sortABlock sorts the data of an aBlock of table tid that is converted
+// to an nBlock. sortKey is only filled by trimObjectsData when it
+// reloads the data block, so it is resolved here from the object meta
+// if still unset, otherwise the nBlock would be written and flagged
+// unsorted. When the object declares no sort key either, the block is
+// sorted by the key WithForceSort gives for the table, or else by the
+// sort key of the table schema in the checkpoint, if any.
+//
+// An unsorted nBlock is still a correct backup, so unless WithStrictSort
+// is set a block that fails to sort is returned as is, with sortKey
+// reset to flag it unsorted.
+func (o *backupOptions) sortABlock(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	sortKey *uint16,
+	tid uint64,
+	bat *batch.Batch,
+	pool *containers.VectorPool,
+) (*batch.Batch, error) {
+	if *sortKey == math.MaxUint16 {
+		key, err := appendableSortKey(ctx, fs, location)
+		if err != nil {
+			return nil, err
+		}
+		*sortKey = key
+	}
+	*sortKey = o.tableSortKey(tid, *sortKey, len(bat.Vecs)-appendableMetaColumns, location)
+	if forced := o.forcedSortKey(tid); *sortKey == math.MaxUint16 && forced != math.MaxUint16 {
+		if int(forced) >= len(bat.Vecs)-appendableMetaColumns {
+			return nil, moerr.NewInternalError(ctx, "forced sort key %d of block %s is not a data column",
+				forced, location.String())
+		}
+		o.log().Info("[ReWrite Checkpoint]", common.OperationField("force sort"),
+			common.AnyField("block", location.String()),
+			common.AnyField("sort key", forced))
+		*sortKey = forced
+	}
+	if key, ok := o.schemaSortKeys[tid]; *sortKey == math.MaxUint16 && ok {
+		// The schema may be newer than the block, a key past its data
+		// columns leaves it unsorted rather than failing the rewrite.
+		if int(key) < len(bat.Vecs)-appendableMetaColumns {
+			o.log().Info("[ReWrite Checkpoint]", common.OperationField("schema sort"),
+				common.AnyField("block", location.String()),
+				common.AnyField("sort key", key))
+			*sortKey = key
+		}
+	}
+	if *sortKey == math.MaxUint16 {
+		return bat, nil
+	}
+	sorted, err := o.sortColumns(ctx, bat, *sortKey, pool)
+	if err == nil {
+		return sorted, nil
+	}
+	if o.strictSort {
+		return nil, err
+	}
+	o.log().Warn("[ReWrite Checkpoint]", common.OperationField("write unsorted block"),
+		common.AnyField("block", location.String()),
+		common.AnyField("error", err))
+	o.stats.Warn(BackupWarning{
+		Code:   WarnSortFallback,
+		Block:  location.String(),
+		Detail: err.Error(),
+	})
+	o.stats.Phase(StatsPhaseRewrite).Add(StatSortFallbacks, 1)
+	o.result.SortFallbacks++
+	*sortKey = math.MaxUint16
+	return bat, nil
+}
+
+// sortColumns sorts a copy of bat by the column sortKey and frees bat.
+// SortBlockColumns shuffles the columns in place one after the other,
+// sorting a copy leaves bat intact when it fails half way.
+func (o *backupOptions) sortColumns(
+	ctx context.Context,
+	bat *batch.Batch,
+	sortKey uint16,
+	pool *containers.VectorPool,
+) (sorted *batch.Batch, err error) {
+	cloned := batch.New(true, bat.Attrs)
+	defer func() {
+		if r := recover(); r != nil {
+			err = moerr.ConvertPanicError(ctx, r)
+		}
+		if err != nil {
+			for _, vec := range cloned.Vecs {
+				if vec != nil {
+					vec.Free(o.cnAllocator)
+				}
+			}
+		}
+	}()
+	for i, vec := range bat.Vecs {
+		if cloned.Vecs[i], err = vec.CloneWindow(0, vec.Length(), o.cnAllocator); err != nil {
+			return nil, err
+		}
+	}
+	cloned.SetRowCount(bat.RowCount())
+	sortData := containers.ToTNBatch(cloned, o.tnAllocator)
+	if _, err = o.sortBlockColumns(sortData.Vecs, int(sortKey), pool); err != nil {
+		return nil, err
+	}
+	for _, vec := range bat.Vecs {
+		vec.Free(common.CheckpointAllocator)
+	}
+	return containers.ToCNBatch(sortData), nil
+}
+
+// applyDelete removes the rows of dataBatch that deleteBatch deletes from
+// block id and the filtered rows, both by their offset in dataBatch. It
+// returns the rows it removed and the delete rowids of block id that
+// match no row of dataBatch, which a consistent tombstone has none of.
+func applyDelete(dataBatch *batch.Batch, deleteBatch *batch.Batch, id string, filtered ...int64) (removed, unmatched int, err error) {
+	return applyDeleteJoin(DeleteJoinAuto, dataBatch, deleteBatch, id, filtered...)
+}
+
+// applyDeleteJoin is applyDelete joining the deletes to the rows with
+// join.
+func applyDeleteJoin(
+	join DeleteJoin,
+	dataBatch *batch.Batch,
+	deleteBatch *batch.Batch,
+	id string,
+	filtered ...int64,
+) (removed, unmatched int, err error) {
+	if deleteBatch == nil && len(filtered) == 0 {
+		return 0, 0, nil
+	}
+	length := dataBatch.Vecs[0].Length()
+	var rowids *vector.Vector
+	if deleteBatch != nil {
+		// deleteBatch is loaded by loadTombstone, in the current layout.
+		rowids = deleteBatch.Vecs[currentTombstoneLayout.rowid]
+		if typ := rowids.GetType(); typ.Oid != types.T_Rowid {
+			return 0, 0, moerr.NewInternalErrorNoCtx("delete batch of %s has %s rowid column", id, typ.String())
+		}
+	}
+	var deleteRow []int64
+	if join.merge(rowids) {
+		deleteRow, unmatched, err = mergeJoinDeletes(length, rowids, id, filtered)
+	} else {
+		deleteRow, unmatched, err = hashJoinDeletes(length, rowids, id, filtered)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	dataBatch.Shrink(deleteRow, true)
+	return len(deleteRow), unmatched, nil
+}
+
+// hashJoinDeletes returns the rows of a block of length rows, whose
+// block id is id, that rowids delete or filtered lists, in order, and
+// the number of deletes of rows past length. rowids may be nil.
+func hashJoinDeletes(length int, rowids *vector.Vector, id string, filtered []int64) ([]int64, int, error) {
+	unmatched := 0
+	deleteRow := make([]int64, 0)
+	rows := make(map[int64]bool)
+	for _, row := range filtered {
+		rows[row] = true
+	}
+	if rowids != nil {
+		for i := 0; i < rowids.Length(); i++ {
+			blockId, ro, err := decodeRowid(rowids.GetRawBytesAt(i))
+			if err != nil {
+				return nil, 0, err
+			}
+			if blockId.String() != id {
+				continue
+			}
+			if int(ro) >= length {
+				unmatched++
+				continue
+			}
+			rows[int64(ro)] = true
+		}
+	}
+	for i := 0; i < length; i++ {
+		if rows[int64(i)] {
+			deleteRow = append(deleteRow, int64(i))
+		}
+	}
+	return deleteRow, unmatched, nil
+}
+
+// decodeRowid splits a rowid into its block id and row offset. Unlike
+// objectio.HackBytes2Rowid it refuses input of any other length, which
+// would otherwise be truncated or hashed into a valid looking rowid.
+func decodeRowid(buf []byte) (types.Blockid, uint32, error) {
+	if len(buf) != types.RowidSize {
+		return types.Blockid{}, 0, moerr.NewInternalErrorNoCtx(
+			"invalid rowid length %d, expected %d", len(buf), types.RowidSize)
+	}
+	rowid := types.Rowid(buf)
+	blockId, offset := rowid.Decode()
+	return blockId, offset, nil
+}
+
+// checkpointHasObjectInfo tells if checkpoints of version carry the
+// object info batches, the object level stats of their objects.
+func checkpointHasObjectInfo(version uint32) bool {
+	return version >= CheckpointVersion10
+}
+
+// appendConvertedObjectInfo appends to dst the object info row of obj,
+// the object an aBlock was converted to, in place of row of src, that
+// of the aBlock, and one for each of its parts. The stats are those the writer returned for the new
+// object. It is created at the commit ts of the row, so that a replay
+// of the checkpoint creates it rather than looking up an object it has
+// never seen. The commit ts is kept and not set to the backup ts, a
+// later rewrite of the checkpoint at a later ts would refuse the row.
+func appendConvertedObjectInfo(src, dst *containers.Batch, row int, obj *objData) error {
+	if err := appendConvertedObjectRow(src, dst, row, obj.stats); err != nil {
+		return err
+	}
+	for i := range obj.parts {
+		if err := appendConvertedObjectRow(src, dst, row, &obj.parts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendConvertedObjectRow appends the object info row of stats, an
+// object an aBlock is converted to, built from row of src.
+func appendConvertedObjectRow(src, dst *containers.Batch, row int, stats *objectio.ObjectStats) error {
+	if err := appendValToBatch(src, dst, row); err != nil {
+		return err
+	}
+	row = dst.Length() - 1
+	ts := dst.GetVectorByName(txnbase.SnapshotAttr_CommitTS).Get(row).(types.TS)
+	dst.GetVectorByName(ObjectAttr_ObjectStats).Update(row, stats[:], false)
+	dst.GetVectorByName(ObjectAttr_State).Update(row, false, false)
+	dst.GetVectorByName(EntryNode_CreateAt).Update(row, ts, false)
+	dst.GetVectorByName(EntryNode_DeleteAt).Update(row, types.TS{}, false)
+	for _, attr := range []string{
+		txnbase.SnapshotAttr_StartTS,
+		txnbase.SnapshotAttr_PrepareTS,
+	} {
+		dst.GetVectorByName(attr).Update(row, ts, false)
+	}
+	return nil
+}
+
+func updateBlockMeta(
+	blkMeta, blkMetaTxn *containers.Batch,
+	row int,
+	blockID types.Blockid,
+	location objectio.Location,
+	sort bool,
+	stats *BackupStats,
+	logger *zap.Logger,
+) {
+	blkMeta.GetVectorByName(catalog2.AttrRowID).Update(
+		row,
+		objectio.HackBlockid2Rowid(&blockID),
+		false)
 	blkMeta.GetVectorByName(catalog.BlockMeta_ID).Update(
 		row,
 		blockID,
@@ -408,216 +1356,870 @@ func updateBlockMeta(blkMeta, blkMetaTxn *containers.Batch, row int, blockID typ
 		true)
 
 	if !sort {
-		logutil.Infof("block %v is not sorted", blockID.String())
+		logger.Info("[ReWrite Checkpoint]", common.OperationField("block is not sorted"),
+			common.AnyField("block", blockID.String()))
+		stats.Warn(BackupWarning{
+			Code:   WarnBlockNotSorted,
+			Object: location.Name().String(),
+			Block:  blockID.String(),
+		})
 	}
 }
 
-func appendValToBatch(src, dst *containers.Batch, row int) {
+// appendValToBatch appends row of src to dst. The two batches must have
+// the same columns, otherwise the values would land in the wrong ones.
+func appendValToBatch(src, dst *containers.Batch, row int) error {
+	if err := checkBatchSchema(src, dst); err != nil {
+		return err
+	}
 	for v, vec := range src.Vecs {
+		// Get returns the zero value of a null of a fixed type.
 		val := vec.Get(row)
-		if val == nil {
-			dst.Vecs[v].Append(val, true)
+		if val == nil || vec.IsNull(row) {
+			dst.Vecs[v].Append(nil, true)
 		} else {
 			dst.Vecs[v].Append(val, false)
 		}
 	}
+	return nil
+}
+
+func checkBatchSchema(src, dst *containers.Batch) error {
+	if len(src.Vecs) != len(dst.Vecs) {
+		return moerr.NewInternalErrorNoCtx("batch has %d columns, expected %d",
+			len(src.Vecs), len(dst.Vecs))
+	}
+	for i := range src.Vecs {
+		if i < len(src.Attrs) && i < len(dst.Attrs) && src.Attrs[i] != dst.Attrs[i] {
+			return moerr.NewInternalErrorNoCtx("column %d is %s, expected %s",
+				i, src.Attrs[i], dst.Attrs[i])
+		}
+		srcType, dstType := src.Vecs[i].GetType(), dst.Vecs[i].GetType()
+		if srcType.Oid != dstType.Oid {
+			return moerr.NewInternalErrorNoCtx("column %d has type %s, expected %s",
+				i, srcType.String(), dstType.String())
+		}
+	}
+	return nil
 }
 
 // Need to format the loaded batch, otherwise panic may occur when WriteBatch.
-func formatData(data *batch.Batch) *batch.Batch {
+func formatData(data *batch.Batch, mp *mpool.MPool) *batch.Batch {
 	if data.Vecs[0].Length() > 0 {
 		data.Attrs = make([]string, 0)
 		for i := range data.Vecs {
 			att := fmt.Sprintf("col_%d", i)
 			data.Attrs = append(data.Attrs, att)
 		}
-		tmp := containers.ToTNBatch(data, common.CheckpointAllocator)
+		tmp := containers.ToTNBatch(data, mp)
 		data = containers.ToCNBatch(tmp)
 	}
 	return data
 }
 
-func LoadCheckpointEntriesFromKey(
-	ctx context.Context,
-	sid string,
-	fs fileservice.FileService,
-	location objectio.Location,
-	version uint32,
-	softDeletes *map[string]bool,
-	baseTS *types.TS,
-) ([]*objectio.BackupObject, *CheckpointData, error) {
-	locations := make([]*objectio.BackupObject, 0)
-	data, err := getCheckpointData(ctx, sid, fs, location, version)
-	if err != nil {
-		return nil, nil, err
+// appendableMetaColumns is the number of metadata columns that follow
+// the data columns of an aBlock.
+const appendableMetaColumns = 3
+
+// projectColumns keeps the data columns cols of data, followed by its
+// last trailing columns, and returns the position of sortKey within the
+// result, math.MaxUint16 if it was dropped.
+func projectColumns(
+	data *batch.Batch,
+	cols []uint16,
+	trailing int,
+	sortKey uint16,
+) (*batch.Batch, uint16, error) {
+	dataCols := len(data.Vecs) - trailing
+	result := batch.NewWithSize(len(cols) + trailing)
+	projected := uint16(math.MaxUint16)
+	for i, col := range cols {
+		if int(col) >= dataCols {
+			return nil, sortKey, moerr.NewInternalErrorNoCtx(
+				"projected column %d out of range, %d data columns", col, dataCols)
+		}
+		result.Vecs[i] = data.Vecs[col]
+		if col == sortKey {
+			projected = uint16(i)
+		}
+	}
+	copy(result.Vecs[len(cols):], data.Vecs[dataCols:])
+	if len(data.Attrs) == len(data.Vecs) {
+		result.Attrs = make([]string, 0, len(result.Vecs))
+		for _, col := range cols {
+			result.Attrs = append(result.Attrs, data.Attrs[col])
+		}
+		result.Attrs = append(result.Attrs, data.Attrs[dataCols:]...)
 	}
+	result.SetRowCount(data.RowCount())
+	return result, projected, nil
+}
 
-	locations = append(locations, &objectio.BackupObject{
-		Location: location,
-		NeedCopy: true,
-	})
+// project applies the column projection of tid, if any, to data.
+func (o *backupOptions) project(
+	tid uint64,
+	data *batch.Batch,
+	trailing int,
+	sortKey uint16,
+) (*batch.Batch, uint16, error) {
+	cols, ok := o.projection[tid]
+	if !ok {
+		return data, sortKey, nil
+	}
+	return projectColumns(data, cols, trailing, sortKey)
+}
 
-	for _, location = range data.locations {
-		locations = append(locations, &objectio.BackupObject{
-			Location: location,
-			NeedCopy: true,
-		})
+// convertedName returns the name of the object the aBlock of src is
+// converted to, in the segment of src or the one it is remapped to,
+// unless the names are generated, see withObjectNameGenerator.
+func (o *backupOptions) convertedName(src objectio.ObjectName) objectio.ObjectName {
+	if o.nameGenerator != nil {
+		return o.nameGenerator(src)
 	}
-	for i := 0; i < data.bats[ObjectInfoIDX].Length(); i++ {
-		var objectStats objectio.ObjectStats
-		buf := data.bats[ObjectInfoIDX].GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte)
-		objectStats.UnMarshal(buf)
-		deletedAt := data.bats[ObjectInfoIDX].GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
-		createAt := data.bats[ObjectInfoIDX].GetVectorByName(EntryNode_CreateAt).Get(i).(types.TS)
-		commitAt := data.bats[ObjectInfoIDX].GetVectorByName(txnbase.SnapshotAttr_CommitTS).Get(i).(types.TS)
-		isAblk := data.bats[ObjectInfoIDX].GetVectorByName(ObjectAttr_State).Get(i).(bool)
-		if objectStats.Extent().End() == 0 {
-			panic(fmt.Sprintf("object %v Extent not empty", objectStats.ObjectName().String()))
-		}
-
-		if deletedAt.IsEmpty() && isAblk {
-			panic(fmt.Sprintf("object %v is not deleted", objectStats.ObjectName().String()))
-		}
-		bo := &objectio.BackupObject{
-			Location: objectStats.ObjectLocation(),
-			CrateTS:  createAt,
-			DropTS:   deletedAt,
-		}
-		if baseTS.IsEmpty() || (!baseTS.IsEmpty() &&
-			(createAt.GreaterEq(baseTS) || commitAt.GreaterEq(baseTS))) {
-			bo.NeedCopy = true
-		}
-		locations = append(locations, bo)
-		if !deletedAt.IsEmpty() {
-			if softDeletes != nil {
-				if !(*softDeletes)[objectStats.ObjectName().String()] {
-					(*softDeletes)[objectStats.ObjectName().String()] = true
-				}
-			}
-		}
+	segment := src.SegmentId()
+	if target, ok := o.segmentRemap[segment]; ok {
+		segment = target
 	}
+	return BackupDataObjectName(&segment, src.Num())
+}
 
-	for i := 0; i < data.bats[TNObjectInfoIDX].Length(); i++ {
-		var objectStats objectio.ObjectStats
-		buf := data.bats[TNObjectInfoIDX].GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte)
-		objectStats.UnMarshal(buf)
-		deletedAt := data.bats[TNObjectInfoIDX].GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
-		if objectStats.Extent().End() > 0 {
-			panic(any(fmt.Sprintf("extent end is not 0: %v, name is %v", objectStats.Extent().End(), objectStats.ObjectName().String())))
-		}
-		if !deletedAt.IsEmpty() {
-			panic(any(fmt.Sprintf("deleteAt is not empty: %v, name is %v", deletedAt.ToString(), objectStats.ObjectName().String())))
-		}
-		//locations = append(locations, objectStats.ObjectName())
+// countObject counts an object of table tid the rewrite wrote.
+func (o *backupOptions) countObject(counter string, tid uint64) {
+	rewrite := o.stats.Phase(StatsPhaseRewrite)
+	rewrite.Add(counter, 1)
+	rewrite.Table(tid).Add(counter, 1)
+}
+
+// convertABlock converts the aBlock of an object, dataBlocks[0], to an
+// nBlock object and returns the insertBlock that references it. An
+// aBlock split WithConvertedObjectRows has more objects, returned after
+// the insertBlock, each referenced by the insertBlock of the same index
+// in parts.
+//
+// Besides the aBlock the object can hold a tombstone block, tracked as
+// a block of its own, with the deletes of the aBlock. They are applied
+// before the rows are converted, the converted object has no tombstone.
+func convertABlock(
+	ctx context.Context,
+	fs, dstFs fileservice.FileService,
+	session *BackupSession,
+	options *backupOptions,
+	dataBlocks []*blockData,
+	pool *containers.VectorPool,
+) (*writtenObject, *insertBlock, []*writtenObject, []*insertBlock, error) {
+	aBlock, tombstone, blockID, err := splitABlock(ctx, dataBlocks)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
-	for i := 0; i < data.bats[BLKMetaInsertIDX].Length(); i++ {
-		deltaLoc := objectio.Location(
-			data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(i).([]byte))
-		commitTS := data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_CommitTs).Get(i).(types.TS)
-		if deltaLoc.IsEmpty() {
-			metaLoc := objectio.Location(
-				data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_MetaLoc).Get(i).([]byte))
-			panic(fmt.Sprintf("block %v deltaLoc is empty", metaLoc.String()))
+	// The tombstone linked to the aBlock is released as soon as it is
+	// applied, before the aBlock is sorted and written, or when the
+	// conversion is skipped.
+	released := false
+	releaseTombstone := func() {
+		if !released && aBlock.tombstone != nil {
+			released = true
+			aBlock.tombstone.release()
+		}
+	}
+	defer releaseTombstone()
+	name := options.convertedName(aBlock.location.Name())
+	converted := false
+	var parts []*writtenObject
+	written, err := options.convertedObject(ctx, session, dstFs, aBlock.location.Name(), name, func() (*writtenObject, error) {
+		converted = true
+		if err := options.applyABlockDeletes(aBlock, tombstone, blockID); err != nil {
+			return nil, err
+		}
+		releaseTombstone()
+		sorted, err := options.sortABlock(ctx, fs, aBlock.location, &aBlock.sortKey,
+			aBlock.tid, aBlock.data, pool)
+		if err != nil {
+			return nil, err
+		}
+		result := batch.NewWithSize(len(sorted.Vecs) - 3)
+		for i := range result.Vecs {
+			result.Vecs[i] = sorted.Vecs[i]
 		}
-		bo := &objectio.BackupObject{
-			Location: deltaLoc,
-			CrateTS:  commitTS,
+		// The names the BatchNormalizer gave the columns carry over
+		// to the export.
+		if len(sorted.Attrs) == len(sorted.Vecs) {
+			result.Attrs = sorted.Attrs[:len(result.Vecs)]
+		}
+		result.SetRowCount(result.Vecs[0].Length())
+		aBlock.data = result
+		projected, sortKey, err := options.project(aBlock.tid, result, 0, aBlock.sortKey)
+		if err != nil {
+			return nil, err
 		}
-		if baseTS.IsEmpty() ||
-			(!baseTS.IsEmpty() && commitTS.GreaterEq(baseTS)) {
-			bo.NeedCopy = true
+		if err = options.exportBlock(ctx, aBlock.tid, name, projected); err != nil {
+			return nil, err
 		}
-		locations = append(locations, bo)
+		var written *writtenObject
+		written, parts, err = options.writeConvertedParts(
+			ctx, session, dstFs, aBlock.location.Name(), name, projected, sortKey)
+		return written, err
+	})
+	if err == nil && !converted {
+		parts, err = options.convertedParts(ctx, session, dstFs, name, options.skipExisting)
 	}
-	for i := 0; i < data.bats[BLKCNMetaInsertIDX].Length(); i++ {
-		metaLoc := objectio.Location(
-			data.bats[BLKCNMetaInsertIDX].GetVectorByName(catalog.BlockMeta_MetaLoc).Get(i).([]byte))
-		commitTS := data.bats[BLKCNMetaInsertIDX].GetVectorByName(catalog.BlockMeta_CommitTs).Get(i).(types.TS)
-		if !metaLoc.IsEmpty() {
-			if softDeletes != nil {
-				if !(*softDeletes)[metaLoc.Name().String()] {
-					(*softDeletes)[metaLoc.Name().String()] = true
-					//Fixme:The objectlist has updated this object to the cropped object,
-					// and the expired object in the soft-deleted blocklist has not been processed.
-					logutil.Warnf("block %v metaLoc is not deleted", metaLoc.String())
-					//panic(fmt.Sprintf("block111 %v metaLoc is not deleted", metaLoc.String()))
-				}
-			}
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// Every part is referenced from the row the aBlock is deleted from.
+	newInsertBlock := func(written *writtenObject) *insertBlock {
+		ib := &insertBlock{
+			location: written.location(0),
+			blockId:  *objectio.BuildObjectBlockid(written.name, 0),
+			apply:    false,
+		}
+		if len(aBlock.deleteRow) > 0 {
+			ib.deleteRow = aBlock.deleteRow[0]
 		}
-		deltaLoc := objectio.Location(
-			data.bats[BLKCNMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(i).([]byte))
-		if deltaLoc.IsEmpty() {
-			panic(fmt.Sprintf("block %v deltaLoc is empty", deltaLoc.String()))
+		if options.mapBlockIDs {
+			options.result.RelocatedBlocks = append(options.result.RelocatedBlocks, RelocatedBlock{
+				Table:     aBlock.tid,
+				Source:    blockID,
+				Converted: ib.blockId,
+			})
 		}
-		bo := &objectio.BackupObject{
-			Location: deltaLoc,
-			CrateTS:  commitTS,
+		return ib
+	}
+	ib := newInsertBlock(written)
+	partBlocks := make([]*insertBlock, 0, len(parts))
+	for _, part := range parts {
+		partBlocks = append(partBlocks, newInsertBlock(part))
+	}
+	return written, ib, parts, partBlocks, nil
+}
+
+// splitABlock returns the aBlock of an object, dataBlocks[0], its block
+// id and the block that holds its deletes, if any.
+func splitABlock(ctx context.Context, dataBlocks []*blockData) (aBlock, tombstone *blockData, blockID types.Blockid, err error) {
+	aBlock = dataBlocks[0]
+	tombstone = aBlock.tombstone
+	blockID = aBlock.blockId
+	if blockID.IsEmpty() {
+		blockID = *objectio.BuildObjectBlockid(aBlock.location.Name(), aBlock.location.ID())
+	}
+	switch len(dataBlocks) {
+	case 1:
+	case 2:
+		if dataBlocks[1].blockType != objectio.SchemaTombstone {
+			return nil, nil, blockID, moerr.NewInternalError(ctx, "object %s holds the aBlock and another data block %d",
+				aBlock.location.Name().String(), dataBlocks[1].num)
 		}
-		if baseTS.IsEmpty() ||
-			(!baseTS.IsEmpty() && commitTS.GreaterEq(baseTS)) {
-			bo.NeedCopy = true
+		if tombstone == nil {
+			tombstone = dataBlocks[1]
 		}
-		locations = append(locations, bo)
+	default:
+		panic(any(fmt.Sprintf("dataBlocks len > 2: %v - %d", aBlock.location.String(), len(dataBlocks))))
 	}
-	return locations, data, nil
+	return
 }
 
-func ReWriteCheckpointAndBlockFromKey(
+// applyABlockDeletes removes from aBlock, whose block id is blockID, the
+// rows tombstone deletes and the rows the row filter rejects. Deletes of
+// rows the aBlock does not have are warned about.
+func (o *backupOptions) applyABlockDeletes(aBlock, tombstone *blockData, blockID types.Blockid) error {
+	var deletes *batch.Batch
+	if tombstone != nil {
+		deletes = tombstone.data
+	}
+	_, unmatched, err := applyDeleteJoin(o.deleteJoin, aBlock.data, deletes, blockID.String(), aBlock.filtered...)
+	if err != nil || unmatched == 0 {
+		return err
+	}
+	o.log().Warn("[ReWriteCheckpoint]", common.OperationField("unmatched deletes"),
+		common.AnyField("block", blockID.String()),
+		common.AnyField("tombstone", tombstone.location.String()),
+		common.AnyField("rows", unmatched))
+	o.stats.Warn(BackupWarning{
+		Code:   WarnUnmatchedDeletes,
+		Object: tombstone.location.Name().String(),
+		Block:  blockID.String(),
+		Detail: fmt.Sprintf("%d deletes of missing rows", unmatched),
+	})
+	o.stats.Phase(StatsPhaseVerify).Add(StatUnmatchedDeletes, int64(unmatched))
+	return nil
+}
+
+// convertedObject returns the object name the aBlock of src is
+// converted to. convert does the conversion and is only called when the
+// object is neither recorded by the session nor, with WithSkipExisting,
+// already in dstFs, e.g. left there by an interrupted backup.
+func (o *backupOptions) convertedObject(
 	ctx context.Context,
-	sid string,
-	fs, dstFs fileservice.FileService,
-	loc, tnLocation objectio.Location,
-	version uint32, ts types.TS,
-	softDeletes map[string]bool,
-) (objectio.Location, objectio.Location, []string, error) {
-	logutil.Info("[Start]", common.OperationField("ReWrite Checkpoint"),
-		common.OperandField(loc.String()),
-		common.OperandField(ts.ToString()))
-	phaseNumber := 0
-	var err error
-	defer func() {
-		if err != nil {
-			logutil.Error("[DoneWithErr]", common.OperationField("ReWrite Checkpoint"),
-				common.AnyField("error", err),
-				common.AnyField("phase", phaseNumber),
-			)
-		}
-	}()
-	objectsData := make(map[string]*fileData, 0)
+	session *BackupSession,
+	dstFs fileservice.FileService,
+	src, name objectio.ObjectName,
+	convert func() (*writtenObject, error),
+) (*writtenObject, error) {
+	return o.convertObject(ctx, session, dstFs, src, name, o.skipExisting, convert)
+}
 
-	defer func() {
-		for i := range objectsData {
-			if objectsData[i].obj != nil && objectsData[i].obj.data != nil {
-				for z := range objectsData[i].obj.data {
-					for y := range objectsData[i].obj.data[z].Vecs {
-						objectsData[i].obj.data[z].Vecs[y].Free(common.DebugAllocator)
-					}
-				}
-			}
-			for j := range objectsData[i].data {
-				if objectsData[i].data[j].data == nil {
-					continue
-				}
-				for z := range objectsData[i].data[j].data.Vecs {
-					objectsData[i].data[j].data.Vecs[z].Free(common.CheckpointAllocator)
-				}
-			}
+// convertObject is convertedObject, an object already in dstFs is only
+// reused when reuse is set.
+func (o *backupOptions) convertObject(
+	ctx context.Context,
+	session *BackupSession,
+	dstFs fileservice.FileService,
+	src, name objectio.ObjectName,
+	reuse bool,
+	convert func() (*writtenObject, error),
+) (*writtenObject, error) {
+	if err := session.register(name.String(), src.String()); err != nil {
+		return nil, err
+	}
+	if written, ok := session.lookup(name.String()); ok {
+		return written, nil
+	}
+	if reuse && session.finalized(name.String()) {
+		written, err := loadWrittenObject(ctx, dstFs, name)
+		if err == nil {
+			o.log().Info("[ReWrite Checkpoint]", common.OperationField("reuse converted object"),
+				common.AnyField("object", name.String()))
+			return written, nil
 		}
-	}()
-	phaseNumber = 1
-	// Load checkpoint
-	data, err := getCheckpointData(ctx, sid, fs, loc, version)
+		if !moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return nil, err
+		}
+	}
+	written, err := convert()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
-	data.FormatData(common.CheckpointAllocator)
-	defer data.Close()
+	o.recordWritten(session, written)
+	return written, nil
+}
 
-	phaseNumber = 2
-	// Analyze checkpoint to get the object file
-	var files []string
-	isCkpChange := false
+// exportBlock exports bat, the aBlock of table tid converted to the
+// object name, with the exporter of WithBlockExporter, if set.
+func (o *backupOptions) exportBlock(
+	ctx context.Context,
+	tid uint64,
+	name objectio.ObjectName,
+	bat *batch.Batch,
+) error {
+	if o.exporter == nil {
+		return nil
+	}
+	file, err := o.exporter(ctx, tid, name, bat)
+	if err != nil {
+		return err
+	}
+	o.result.Exported = append(o.result.Exported, file)
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("export block"),
+		common.AnyField("file", file),
+		common.AnyField("rows", bat.RowCount()))
+	return nil
+}
+
+// recordWritten records an object the rewrite wrote in the session and
+// in the result.
+func (o *backupOptions) recordWritten(session *BackupSession, written *writtenObject) {
+	session.record(written)
+	o.result.WrittenObjects++
+	o.result.WrittenBytes += written.size()
+	o.observeWritten(written)
+}
+
+// rewrittenLocation returns the location of block, block i of the
+// object name written again by writeRewritten. The blocks are written
+// one after the other, those of an object the checkpoint references
+// only some blocks of, e.g. the others were soft deleted by an earlier
+// checkpoint, are numbered anew from 0. WithBlockIDMapping records
+// their new block ids.
+func (o *backupOptions) rewrittenLocation(
+	name objectio.ObjectName,
+	written *writtenObject,
+	block *blockData,
+	i int,
+) objectio.Location {
+	location := written.location(uint16(i))
+	if block.num != uint16(i) && o.mapBlockIDs {
+		o.result.RelocatedBlocks = append(o.result.RelocatedBlocks, RelocatedBlock{
+			Table:     block.tid,
+			Source:    *objectio.BuildObjectBlockid(name, block.num),
+			Converted: *objectio.BuildObjectBlockid(name, uint16(i)),
+		})
+	}
+	return location
+}
+
+// rowKind is the list of blockData a block meta row of a block is
+// recorded in.
+type rowKind int
+
+const (
+	// insertRowKind is a row of blockData.insertRow.
+	insertRowKind rowKind = iota
+	// deleteRowKind is a row of blockData.deleteRow.
+	deleteRowKind
+)
+
+// setBlockLocation points the block meta row of block, a row of the
+// kind list, to location, the block written again, and reports whether
+// the row is updated. Both kinds of rows are rows of BLKMetaInsertIDX,
+// collectObjectsData refuses the checkpoints with BLKCNMetaInsertIDX
+// rows, and the location is their delta location.
+//
+// Only the rows of tombstone blocks are updated. The rows of a data
+// block are the rows of its tombstone, whatever their kind: those of an
+// aBlock are updated through the tombstone block, which is listed with
+// its own object, and the aBlock is replaced altogether on conversion.
+// An nBlock has no block meta row, its object info row is updated with
+// the object.
+func setBlockLocation(data *CheckpointData, kind rowKind, block *blockData, row int, location objectio.Location) bool {
+	if block.blockType != objectio.SchemaTombstone {
+		return false
+	}
+	switch kind {
+	case insertRowKind, deleteRowKind:
+		data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(row, []byte(location), false)
+		data.bats[BLKMetaInsertTxnIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(row, []byte(location), false)
+		return true
+	default:
+		panic(fmt.Sprintf("unknown row kind %d", kind))
+	}
+}
+
+// rewriteTarget returns the name the object name, whose blocks to
+// rewrite are dataBlocks, is written again under: its own, unless the
+// rewrite names them, see withRewrittenObjectNames. Only tombstone
+// objects are renamed, the rowids of the deletes refer to the blocks of
+// a data object by its name, see InPlaceRewriteError.
+func (o *backupOptions) rewriteTarget(name objectio.ObjectName, dataBlocks []*blockData) (objectio.ObjectName, error) {
+	if o.rewrittenName == nil {
+		return name, nil
+	}
+	for _, block := range dataBlocks {
+		if block.blockType != objectio.SchemaTombstone {
+			return nil, &InPlaceRewriteError{Objects: []string{name.String()}}
+		}
+	}
+	return o.rewrittenName(name), nil
+}
+
+// writeRewritten writes the blocks of the object name again under its
+// own name, or the one of rewriteTarget, name is then the target. An
+// object of that name already in dstFs, e.g. left by an interrupted
+// rewrite, is replaced, the source is only read.
+func (o *backupOptions) writeRewritten(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	name objectio.ObjectName,
+	dataBlocks []*blockData,
+) (*writtenObject, error) {
+	fileName := name.String()
+	writer, release, err := o.openWriter(ctx, dstFs, fileName, dataBlocks[0].blockType)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	prepared := o.prepareBlocks(dataBlocks)
+	defer prepared.close()
+	w := &objectWrite{name: name}
+	for i, block := range dataBlocks {
+		projected, sortKey, err := prepared.get(i)
+		if err != nil {
+			return nil, err
+		}
+		if sortKey != math.MaxUint16 {
+			writer.SetPrimaryKey(sortKey)
+		}
+		if block.blockType == objectio.SchemaData || block.blockType == objectio.SchemaTombstone {
+			if err = w.write(writer, block.blockType, projected); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	written, err := syncObject(ctx, writer, name)
+	if err != nil {
+		if !moerr.IsMoErrCode(err, moerr.ErrFileAlreadyExists) {
+			return nil, w.fail("sync", err)
+		}
+		err = dstFs.Delete(ctx, fileName)
+		if err != nil {
+			return nil, err
+		}
+		written, err = syncObject(ctx, writer, name)
+		if err != nil {
+			return nil, w.fail("sync", err)
+		}
+	}
+	if err = o.session.finalize(ctx, dstFs, written); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// sortTombstone orders the rows of bat, the tombstone block at location
+// in the current layout, by rowid then by commit ts, the order the
+// readers that apply a tombstone expect. The trim keeps the rows of a
+// tombstone in the order they were written, which need not be it.
+func sortTombstone(bat *batch.Batch, location objectio.Location, mp *mpool.MPool) error {
+	keys, err := tombstoneKeys(
+		bat.Vecs[currentTombstoneLayout.rowid],
+		currentTombstoneLayout.commitTsColumn(bat.Vecs),
+		location)
+	if err != nil {
+		return err
+	}
+	if keys.firstUnordered() < 0 {
+		return nil
+	}
+	sels := make([]int64, len(keys.rowids))
+	for i := range sels {
+		sels[i] = int64(i)
+	}
+	sort.SliceStable(sels, func(i, j int) bool {
+		return keys.less(int(sels[i]), int(sels[j]))
+	})
+	for _, vec := range bat.Vecs {
+		if err = vec.Shuffle(sels, mp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tombstoneRowKeys are what the rows of a tombstone block are ordered
+// by.
+type tombstoneRowKeys struct {
+	rowids  []types.Rowid
+	commits []types.TS
+}
+
+// tombstoneKeys reads the keys of the tombstone block at location whose
+// rowid and commit ts columns are rowids and commits. A block without
+// commit ts, commits is nil, is ordered by rowid.
+func tombstoneKeys(rowids, commits *vector.Vector, location objectio.Location) (*tombstoneRowKeys, error) {
+	keys := &tombstoneRowKeys{
+		rowids:  append([]types.Rowid(nil), vector.MustFixedCol[types.Rowid](rowids)...),
+		commits: make([]types.TS, rowids.Length()),
+	}
+	for i := 0; commits != nil && i < len(keys.commits); i++ {
+		if err := unmarshalCommitTs(&keys.commits[i], commits, i, location, true); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (k *tombstoneRowKeys) less(i, j int) bool {
+	if c := k.rowids[i].Compare(k.rowids[j]); c != 0 {
+		return c < 0
+	}
+	return k.commits[i].Less(&k.commits[j])
+}
+
+// firstUnordered returns the first row that is ordered before the
+// previous one, or -1 if the rows are ordered.
+func (k *tombstoneRowKeys) firstUnordered() int {
+	for i := 1; i < len(k.rowids); i++ {
+		if k.less(i, i-1) {
+			return i
+		}
+	}
+	return -1
+}
+
+// enterPhase reports that the rewrite enters phase, and stops it if ctx
+// is done.
+func (o *backupOptions) enterPhase(ctx context.Context, phase int) error {
+	o.report(phase, 0, 0)
+	o.observer.OnPhaseStart(phase)
+	return ctx.Err()
+}
+
+func (o *backupOptions) report(phase, done, total int) {
+	o.result.Phase = phase
+	if o.progress != nil {
+		o.progress(RewriteProgress{Phase: phase, Done: done, Total: total})
+	}
+}
+
+// openWriter opens the block writer of the object name of schema in
+// dstFs, once fewer than the WithMaxOpenWriters limit are open. release
+// must be called when the writer is synced or given up, on every path:
+// a writer it releases before a Sync succeeded is aborted, see
+// BlockWriterAborter.
+func (o *backupOptions) openWriter(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	name string,
+	schema objectio.DataMetaType,
+) (writer BlockWriterLike, release func(), err error) {
+	unlimit := func() {}
+	if o.writers != nil {
+		select {
+		case o.writers <- struct{}{}:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		unlimit = func() { <-o.writers }
+	}
+	if name, err = o.session.writerName(ctx, dstFs, name); err != nil {
+		unlimit()
+		return nil, nil, err
+	}
+	if writer, err = o.newWriter(dstFs, name); err != nil {
+		unlimit()
+		return nil, nil, err
+	}
+	if compression, ok := o.compression[schema]; ok {
+		if setter, ok := writer.(compressionSetter); ok {
+			setter.SetCompression(compression.Algo)
+			setter.SetCompressionLevel(compression.Level)
+		}
+	}
+	tracked := &trackedWriter{BlockWriterLike: writer}
+	release = func() {
+		if !tracked.synced {
+			o.abortWriter(ctx, dstFs, name, tracked)
+		}
+		unlimit()
+	}
+	return tracked, release, nil
+}
+
+// trackedWriter is a writer of openWriter, it records whether it was
+// synced and the error of its last failed Sync.
+type trackedWriter struct {
+	BlockWriterLike
+	synced  bool
+	syncErr error
+}
+
+func (w *trackedWriter) Sync(ctx context.Context) ([]objectio.BlockObject, objectio.Extent, error) {
+	blocks, extent, err := w.BlockWriterLike.Sync(ctx)
+	w.synced, w.syncErr = err == nil, err
+	return blocks, extent, err
+}
+
+// abortWriter releases writer, the writer of the object name in dstFs
+// given up before it was synced. A Sync that failed may have left part
+// of the object in dstFs, it is deleted, unless the Sync failed on an
+// object already there, which is not the writer's. The delete is not
+// cancelled with ctx, the rewrite may be given up on its cancel.
+func (o *backupOptions) abortWriter(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	name string,
+	writer *trackedWriter,
+) {
+	o.stats.Phase(StatsPhaseRewrite).Add(StatAbortedWriters, 1)
+	o.log().Info("[ReWriteCheckpoint]", common.OperationField("abort writer"),
+		common.AnyField("object", name))
+	if aborter, ok := writer.BlockWriterLike.(BlockWriterAborter); ok {
+		aborter.Abort()
+	}
+	if writer.syncErr == nil || moerr.IsMoErrCode(writer.syncErr, moerr.ErrFileAlreadyExists) {
+		return
+	}
+	err := dstFs.Delete(context.WithoutCancel(ctx), name)
+	if err != nil && !moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		o.log().Warn("[ReWriteCheckpoint]", common.OperationField("delete aborted object"),
+			common.AnyField("object", name), common.AnyField("error", err))
+	}
+}
+
+// writeConverted writes the rows of an aBlock as the nBlock object name,
+// and persists its journal entry once it is complete.
+func (o *backupOptions) writeConverted(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	name objectio.ObjectName,
+	bat *batch.Batch,
+	sortKey uint16,
+) (*writtenObject, error) {
+	if err := discardWrittenObject(ctx, dstFs, name); err != nil {
+		return nil, err
+	}
+	if o.skipExisting {
+		// The object of the name, if any, was left without its entry
+		// and is written again.
+		if err := dstFs.Delete(ctx, name.String()); err != nil &&
+			!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return nil, err
+		}
+	}
+	writer, release, err := o.openWriter(ctx, dstFs, name.String(), objectio.SchemaData)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if sortKey != math.MaxUint16 {
+		writer.SetPrimaryKey(sortKey)
+	}
+	w := &objectWrite{name: name}
+	if err = w.write(writer, objectio.SchemaData, bat); err != nil {
+		return nil, err
+	}
+	written, err := syncObject(ctx, writer, name)
+	if err != nil {
+		return nil, w.fail("sync", err)
+	}
+	if err = o.session.finalize(ctx, dstFs, written); err != nil {
+		return nil, err
+	}
+	if err = saveWrittenObject(ctx, dstFs, written, o.auxCreatedAt()); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+// LoadCheckpointEntriesFromKey loads the checkpoint of version at
+// location from fs and lists the objects it refers to, see
+// scanCheckpointEntries. The caller owns the returned data and must
+// Close it once done with it, its batches are allocated from
+// common.CheckpointAllocator and are not freed otherwise. Close can be
+// called more than once. The locations do not share memory with the
+// data, they stay valid after it is closed.
+//
+// softDeletes, if not nil, accumulates the soft deletes of a chain of
+// checkpoints loaded one after the other with it. It is read and
+// extended in the same pass: the objects it already has are not listed
+// nor the blocks of them, the objects this checkpoint drops are listed
+// and added to it.
+//
+// A caller that only needs the locations calls
+// ListCheckpointEntriesFromKey, which closes the data itself. On error
+// the data is nil and there is nothing to close.
+func LoadCheckpointEntriesFromKey(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, *CheckpointData, error) {
+	data, err := getCheckpointData(ctx, sid, fs, location, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	locations, err := scanCheckpointEntries(
+		ctx, location, data.locations, dataScanBatches(data), softDeletes, baseTS)
+	if err != nil {
+		data.Close()
+		return nil, nil, err
+	}
+	if data.provenance, err = loadCheckpointProvenance(ctx, fs, location); err != nil {
+		data.Close()
+		return nil, nil, err
+	}
+	return locations, data, nil
+}
+
+// ListCheckpointEntriesFromKey is LoadCheckpointEntriesFromKey for a
+// caller that does not need the data of the checkpoint, it is closed
+// before the locations are returned.
+func ListCheckpointEntriesFromKey(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, error) {
+	locations, data, err := LoadCheckpointEntriesFromKey(ctx, sid, fs, location, version, softDeletes, baseTS)
+	if err != nil {
+		return nil, err
+	}
+	data.Close()
+	return locations, nil
+}
+
+// NormalizeLocations merges the entries of locations that refer to the
+// same object, as the blocks of one object each have their own entry.
+// The first entry of an object keeps its position, so the checkpoint's
+// own location stays in front. The merged entry needs a copy if any of
+// the entries did and takes the earliest create ts.
+func NormalizeLocations(locations []*objectio.BackupObject) []*objectio.BackupObject {
+	merged := make(map[string]*objectio.BackupObject, len(locations))
+	res := make([]*objectio.BackupObject, 0, len(locations))
+	for _, bo := range locations {
+		name := bo.Location.Name().String()
+		entry, ok := merged[name]
+		if !ok {
+			entry = &objectio.BackupObject{}
+			*entry = *bo
+			merged[name] = entry
+			res = append(res, entry)
+			continue
+		}
+		entry.NeedCopy = entry.NeedCopy || bo.NeedCopy
+		if entry.CrateTS.IsEmpty() || (!bo.CrateTS.IsEmpty() && bo.CrateTS.Less(&entry.CrateTS)) {
+			entry.CrateTS = bo.CrateTS
+		}
+		if entry.DropTS.IsEmpty() {
+			entry.DropTS = bo.DropTS
+		}
+	}
+	return res
+}
+
+// checkpointValue returns row i of vec, a column of a checkpoint batch.
+// A corrupt checkpoint may have columns shorter than their batch or
+// null where a value is expected, they are errors.
+func checkpointValue[T any](vec containers.Vector, i int) (T, error) {
+	var zero T
+	if i >= vec.Length() {
+		return zero, moerr.NewInternalErrorNoCtx("row %d of checkpoint column %s of %d rows",
+			i, vec.GetType().String(), vec.Length())
+	}
+	v, ok := vec.Get(i).(T)
+	if !ok {
+		return zero, moerr.NewInternalErrorNoCtx("row %d of checkpoint column %s is %T, expected %T",
+			i, vec.GetType().String(), vec.Get(i), zero)
+	}
+	return v, nil
+}
+
+// checkpointStats returns the object stats at row i of vec.
+func checkpointStats(vec containers.Vector, i int) (*objectio.ObjectStats, error) {
+	buf, err := checkpointValue[[]byte](vec, i)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != objectio.ObjectStatsLen {
+		return nil, moerr.NewInternalErrorNoCtx("object stats of %d bytes at row %d, expected %d",
+			len(buf), i, objectio.ObjectStatsLen)
+	}
+	stats := objectio.NewObjectStats()
+	stats.UnMarshal(buf)
+	return stats, nil
+}
+
+// checkpointLocation returns the location at row i of vec, checked by
+// ValidateLocation.
+func checkpointLocation(vec containers.Vector, i int) (objectio.Location, error) {
+	buf, err := checkpointValue[[]byte](vec, i)
+	if err != nil {
+		return nil, err
+	}
+	if err = ValidateLocation(buf); err != nil {
+		return nil, moerr.NewInternalErrorNoCtx("location at row %d: %v", i, err)
+	}
+	return objectio.Location(buf), nil
+}
+
+// collectObjectsData groups the objects and blocks the checkpoint data
+// references by object, the analysis of the rewrite at ts, nil if the
+// data is corrupt.
+func collectObjectsData(data *CheckpointData, ts types.TS) map[string]*fileData {
+	objectsData, _ := collectLimitedObjectsData(data, ts, nil)
+	return objectsData
+}
+
+// collectLimitedObjectsData is collectObjectsData, it stops as soon as
+// what it collects exceeds a limit of limiter.
+func collectLimitedObjectsData(data *CheckpointData, ts types.TS, limiter *analysisLimiter) (map[string]*fileData, error) {
+	objectsData := make(map[string]*fileData, 0)
 	blkCNMetaInsert := data.bats[BLKCNMetaInsertIDX]
 	blkMetaInsTxnBat := data.bats[BLKMetaInsertTxnIDX]
 	blkMetaInsTxnBatTid := blkMetaInsTxnBat.GetVectorByName(SnapshotAttr_TID)
@@ -636,18 +2238,37 @@ func ReWriteCheckpointAndBlockFromKey(
 	objInfoCommit := objInfoData.GetVectorByName(txnbase.SnapshotAttr_CommitTS)
 
 	for i := 0; i < objInfoData.Length(); i++ {
-		stats := objectio.NewObjectStats()
-		stats.UnMarshal(objInfoStats.Get(i).([]byte))
-		isABlk := objInfoState.Get(i).(bool)
-		deleteAt := objInfoDelete.Get(i).(types.TS)
-		commitTS := objInfoCommit.Get(i).(types.TS)
-		tid := objInfoTid.Get(i).(uint64)
+		stats, err := checkpointStats(objInfoStats, i)
+		if err != nil {
+			return nil, err
+		}
+		isABlk, err := checkpointValue[bool](objInfoState, i)
+		if err != nil {
+			return nil, err
+		}
+		deleteAt, err := checkpointValue[types.TS](objInfoDelete, i)
+		if err != nil {
+			return nil, err
+		}
+		commitTS, err := checkpointValue[types.TS](objInfoCommit, i)
+		if err != nil {
+			return nil, err
+		}
+		tid, err := checkpointValue[uint64](objInfoTid, i)
+		if err != nil {
+			return nil, err
+		}
 		if commitTS.Less(&ts) {
-			panic(any(fmt.Sprintf("commitTs less than ts: %v-%v", commitTS.ToString(), ts.ToString())))
+			return nil, moerr.NewInternalErrorNoCtx("commitTs less than ts: %v-%v", commitTS.ToString(), ts.ToString())
 		}
 
 		if isABlk && deleteAt.IsEmpty() {
-			panic(any(fmt.Sprintf("block %v deleteAt is empty", stats.ObjectName().String())))
+			return nil, moerr.NewInternalErrorNoCtx("block %v deleteAt is empty", stats.ObjectName().String())
+		}
+		if objectsData[stats.ObjectName().String()] == nil {
+			if err := limiter.add(1, int(stats.BlkCnt()), int64(stats.Size())); err != nil {
+				return nil, err
+			}
 		}
 		addObjectToObjectData(stats, isABlk, !deleteAt.IsEmpty(), false, i, tid, &objectsData)
 	}
@@ -659,141 +2280,510 @@ func ReWriteCheckpointAndBlockFromKey(
 	tnObjInfoDelete := tnObjInfoData.GetVectorByName(EntryNode_DeleteAt)
 	tnObjInfoCommit := tnObjInfoData.GetVectorByName(txnbase.SnapshotAttr_CommitTS)
 	for i := 0; i < tnObjInfoData.Length(); i++ {
-		stats := objectio.NewObjectStats()
-		stats.UnMarshal(tnObjInfoStats.Get(i).([]byte))
-		isABlk := tnObjInfoState.Get(i).(bool)
-		deleteAt := tnObjInfoDelete.Get(i).(types.TS)
-		tid := tnObjInfoTid.Get(i).(uint64)
-		commitTS := tnObjInfoCommit.Get(i).(types.TS)
+		stats, err := checkpointStats(tnObjInfoStats, i)
+		if err != nil {
+			return nil, err
+		}
+		isABlk, err := checkpointValue[bool](tnObjInfoState, i)
+		if err != nil {
+			return nil, err
+		}
+		deleteAt, err := checkpointValue[types.TS](tnObjInfoDelete, i)
+		if err != nil {
+			return nil, err
+		}
+		tid, err := checkpointValue[uint64](tnObjInfoTid, i)
+		if err != nil {
+			return nil, err
+		}
+		commitTS, err := checkpointValue[types.TS](tnObjInfoCommit, i)
+		if err != nil {
+			return nil, err
+		}
 
 		if commitTS.Less(&ts) {
-			panic(any(fmt.Sprintf("commitTs less than ts: %v-%v", commitTS.ToString(), ts.ToString())))
+			return nil, moerr.NewInternalErrorNoCtx("commitTs less than ts: %v-%v", commitTS.ToString(), ts.ToString())
 		}
 
 		if stats.Extent().End() > 0 {
-			panic(any(fmt.Sprintf("extent end is not 0: %v, name is %v", stats.Extent().End(), stats.ObjectName().String())))
+			return nil, moerr.NewInternalErrorNoCtx("extent end is not 0: %v, name is %v", stats.Extent().End(), stats.ObjectName().String())
 		}
 		if !deleteAt.IsEmpty() {
-			panic(any(fmt.Sprintf("deleteAt is not empty: %v, name is %v", deleteAt.ToString(), stats.ObjectName().String())))
+			return nil, moerr.NewInternalErrorNoCtx("deleteAt is not empty: %v, name is %v", deleteAt.ToString(), stats.ObjectName().String())
+		}
+		if objectsData[stats.ObjectName().String()] == nil {
+			if err := limiter.add(1, int(stats.BlkCnt()), int64(stats.Size())); err != nil {
+				return nil, err
+			}
 		}
 		addObjectToObjectData(stats, isABlk, !deleteAt.IsEmpty(), true, i, tid, &objectsData)
 	}
-
-	if blkCNMetaInsert.Length() > 0 {
-		panic(any("blkCNMetaInsert is not empty"))
+
+	if blkCNMetaInsert.Length() > 0 {
+		return nil, moerr.NewInternalErrorNoCtx("blkCNMetaInsert is not empty")
+	}
+
+	for i := 0; i < blkMetaInsert.Length(); i++ {
+		metaLoc, err := checkpointLocation(blkMetaInsertMetaLoc, i)
+		if err != nil {
+			return nil, err
+		}
+		deltaLoc, err := checkpointLocation(blkMetaInsertDeltaLoc, i)
+		if err != nil {
+			return nil, err
+		}
+		blkID, err := checkpointValue[types.Blockid](blkMetaInsertBlkID, i)
+		if err != nil {
+			return nil, err
+		}
+		isABlk, err := checkpointValue[bool](blkMetaInsertEntryState, i)
+		if err != nil {
+			return nil, err
+		}
+		tid, err := checkpointValue[uint64](blkMetaInsTxnBatTid, i)
+		if err != nil {
+			return nil, err
+		}
+		if deltaLoc.IsEmpty() || !metaLoc.IsEmpty() {
+			return nil, moerr.NewInternalErrorNoCtx("deltaLoc is empty: %v-%v", deltaLoc.String(), metaLoc.String())
+		}
+		if err := limiter.addBlock(objectsData, deltaLoc); err != nil {
+			return nil, err
+		}
+		name := objectio.BuildObjectName(blkID.Segment(), blkID.Sequence())
+		if isABlk {
+			if objectsData[name.String()] == nil {
+				// A delta-only aBlock, the checkpoint has its deletes
+				// but not its object. The tombstone is carried forward
+				// like that of an nBlock, see WithMaterializeDeltaOnly.
+				addBlockToObjectData(deltaLoc, false, false, i,
+					tid, blkID, objectio.SchemaTombstone, &objectsData)
+				continue
+			}
+			if !objectsData[name.String()].isDeleteBatch {
+				return nil, moerr.NewInternalErrorNoCtx("object %v is not deleteBatch", name.String())
+			}
+			if objectsData[name.String()].data[blkID.Sequence()] == nil {
+				return nil, moerr.NewInternalErrorNoCtx("aBlock %v is not a block of object %v",
+					blkID.String(), name.String())
+			}
+			addBlockToObjectData(deltaLoc, isABlk, true, i,
+				tid, blkID, objectio.SchemaTombstone, &objectsData)
+			objectsData[name.String()].data[blkID.Sequence()].blockId = blkID
+			objectsData[name.String()].data[blkID.Sequence()].tombstone = objectsData[deltaLoc.Name().String()].data[deltaLoc.ID()]
+			if len(objectsData[name.String()].data[blkID.Sequence()].deleteRow) > 0 {
+				objectsData[name.String()].data[blkID.Sequence()].deleteRow = append(objectsData[name.String()].data[blkID.Sequence()].deleteRow, i)
+			} else {
+				objectsData[name.String()].data[blkID.Sequence()].deleteRow = []int{i}
+			}
+		} else {
+			if objectsData[name.String()] != nil {
+				if objectsData[name.String()].isDeleteBatch {
+					addBlockToObjectData(deltaLoc, isABlk, true, i,
+						tid, blkID, objectio.SchemaTombstone, &objectsData)
+					continue
+				}
+			}
+			addBlockToObjectData(deltaLoc, isABlk, false, i,
+				tid, blkID, objectio.SchemaTombstone, &objectsData)
+		}
+	}
+	return objectsData, nil
+}
+
+// blocksToRewrite returns the blocks of the object fileName sorted by
+// number, and false if the object has to be skipped. Only the object
+// entry of a deleted object is rewritten without any block, the other
+// objects need their blocks.
+func (o *backupOptions) blocksToRewrite(fileName string, objectData *fileData) ([]*blockData, bool) {
+	dataBlocks, duplicates := sortBlocks(objectData.data)
+	for _, num := range duplicates {
+		o.log().Warn("[ReWriteCheckpoint]", common.OperationField("duplicate block num"),
+			common.AnyField("object", fileName),
+			common.AnyField("num", num))
+		o.stats.Warn(BackupWarning{
+			Code:   WarnDuplicateBlock,
+			Object: fileName,
+			Detail: fmt.Sprintf("block num %d", num),
+		})
+		o.result.DuplicateBlocks = append(o.result.DuplicateBlocks,
+			DuplicateBlock{Object: fileName, Block: num})
+		o.stats.Phase(StatsPhaseVerify).Add(StatDuplicateBlocks, 1)
+	}
+	if len(dataBlocks) == 0 && (objectData.obj == nil || !objectData.isDeleteBatch) {
+		o.log().Warn("[ReWriteCheckpoint]", common.OperationField("skip object without blocks"),
+			common.AnyField("object", fileName))
+		o.stats.Warn(BackupWarning{Code: WarnObjectWithoutBlocks, Object: fileName})
+		return nil, false
+	}
+	return dataBlocks, true
+}
+
+// ReWriteCheckpointAndBlockFromKey rewrites the checkpoint at loc as of
+// ts to dstFs. If ctx is cancelled, it returns a RewriteAbortedError
+// that reports what was done before.
+func ReWriteCheckpointAndBlockFromKey(
+	ctx context.Context,
+	sid string,
+	fs, dstFs fileservice.FileService,
+	loc, tnLocation objectio.Location,
+	version uint32, ts types.TS,
+	softDeletes *SoftDeletes,
+	opts ...BackupOption,
+) (objectio.Location, objectio.Location, []string, error) {
+	options := newBackupOptions(opts...)
+	cnLocation, tnLocation, files, err := reWriteCheckpointAndBlockFromKey(ctx, sid, fs, dstFs,
+		loc, tnLocation, version, ts, softDeletes, nil, options)
+	if err != nil && ctx.Err() != nil {
+		err = options.abort(ctx, err)
+	}
+	if err == nil {
+		err = options.runRewriteHooks(ctx)
+	}
+	options.observer.OnComplete(options.result, err)
+	return cnLocation, tnLocation, files, err
+}
+
+// abort flushes the journal of the session of the rewrite cancelled
+// with err, so that a later session resumes from there, and returns
+// the RewriteAbortedError to report.
+func (o *backupOptions) abort(ctx context.Context, err error) error {
+	o.result.Files.sort()
+	o.result.sortRelocated()
+	aborted := &RewriteAbortedError{
+		Report: o.result,
+		Cause:  err,
+	}
+	// The journal is written although ctx is done.
+	if flushErr := o.session.Flush(context.WithoutCancel(ctx)); flushErr != nil {
+		o.log().Error("[ReWriteCheckpoint]", common.OperationField("flush journal on abort"),
+			common.AnyField("error", flushErr))
+		aborted.FlushErr = flushErr
+	}
+	o.log().Info("[ReWriteCheckpoint]", common.OperationField("aborted"),
+		common.AnyField("phase", o.result.Phase),
+		common.AnyField("objects", o.result.WrittenObjects),
+		common.AnyField("bytes", o.result.WrittenBytes))
+	return aborted
+}
+
+func reWriteCheckpointAndBlockFromKey(
+	ctx context.Context,
+	sid string,
+	fs, dstFs fileservice.FileService,
+	loc, tnLocation objectio.Location,
+	version uint32, ts types.TS,
+	softDeletes *SoftDeletes,
+	source *CheckpointData,
+	options *backupOptions,
+) (_ objectio.Location, _ objectio.Location, _ []string, err error) {
+	options.bindJobLogger(loc, dstFs)
+	ctx = options.withJobLogger(ctx)
+	// The rewrite owns source, it is closed however the rewrite ends.
+	data := source
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	if options.readOnlySource {
+		fs = readOnlySource(fs)
+	}
+	if staging := options.session.stagingFS(); staging != nil {
+		dstFs = staging
+	}
+	// The free space is that of the destination, not of its wrapper.
+	spaceFs := dstFs
+	if dstFs, err = options.session.taggedFS(dstFs); err != nil {
+		return nil, nil, nil, err
+	}
+	if options.encryption != nil {
+		if dstFs, err = NewEncryptedFS(dstFs, *options.encryption); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	dstFs = digestedFS(dstFs, options.digests)
+	session := options.session
+	options.log().Info("[Start]", common.OperationField("ReWrite Checkpoint"),
+		common.OperandField(loc.String()),
+		common.OperandField(ts.ToString()))
+	phaseNumber := 0
+	defer func() {
+		if err != nil {
+			options.log().Error("[DoneWithErr]", common.OperationField("ReWrite Checkpoint"),
+				common.AnyField("error", err),
+				common.AnyField("phase", phaseNumber),
+			)
+		}
+	}()
+	objectsData := make(map[string]*fileData, 0)
+
+	defer func() {
+		releaseObjectsData(objectsData)
+	}()
+	phaseNumber = 1
+	if err = options.enterPhase(ctx, phaseNumber); err != nil {
+		return nil, nil, nil, err
+	}
+	// Load checkpoint
+	if err = checkCheckpointVersion(loc, version); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = checkRewriteTS(loc, ts); err != nil {
+		return nil, nil, nil, err
+	}
+	if ts, err = options.resolveTS(ts); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = options.checkCheckpointEnd(loc, ts); err != nil {
+		return nil, nil, nil, err
+	}
+	// The provenance is all the checks below need, a checkpoint that
+	// is refused or already trimmed is not loaded.
+	var provenance *CheckpointProvenance
+	if data == nil {
+		if provenance, err = loadCheckpointProvenance(ctx, fs, loc); err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		provenance = data.provenance
+	}
+	if err = options.checkCNOnlySource(loc.String(), provenance); err != nil {
+		return nil, nil, nil, err
+	}
+	if !loc.IsEmpty() && options.alreadyTrimmed(provenance, ts) {
+		options.log().Info("[ReWriteCheckpoint]", common.OperationField("already trimmed"),
+			common.OperandField(loc.String()),
+			common.AnyField("ts", ts.ToString()))
+		options.result.AlreadyTrimmed = true
+		return loc, tnLocation, nil, nil
+	}
+	if data == nil {
+		if data, err = getCheckpointData(ctx, sid, fs, loc, version); err != nil {
+			return nil, nil, nil, err
+		}
+		data.provenance = provenance
+	}
+	data.FormatData(common.CheckpointAllocator)
+	sourceSizes := measureBatches(data)
+	sourceRefs := checkpointReferences(data)
+	corrupt, err := options.validateLocations(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = checkCheckpointFeatures(loc, data); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = options.checkRenamable(data); err != nil {
+		return nil, nil, nil, err
+	}
+
+	phaseNumber = 2
+	if err = options.enterPhase(ctx, phaseNumber); err != nil {
+		return nil, nil, nil, err
+	}
+	// Analyze checkpoint to get the object file
+	options.result.Files = RewriteFiles{}
+	files := &options.result.Files
+	isCkpChange := false
+	options.captureProvenance(data)
+	if err = options.checkSoftDeletes(ctx, data, softDeletes); err != nil {
+		return nil, nil, nil, err
+	}
+	options.schemaSortKeys = schemaSortKeys(data.bats[TBLColInsertIDX])
+	duplicates, err := options.resolveDuplicateBlocks(ctx, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dropped := resolveBlockOverlap(ctx, data, ts)
+	denied, err := options.dropDeniedBlocks(ctx, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	collected, err := options.dropCollectedObjects(ctx, fs, data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = options.deltaOnlyABlocks(ctx, data); err != nil {
+		return nil, nil, nil, err
+	}
+	objectsData, err = collectLimitedObjectsData(data, ts, options.analysisLimiter())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	objInfoData := data.bats[ObjectInfoIDX]
+
+	phaseNumber = 3
+	if err = options.enterPhase(ctx, phaseNumber); err != nil {
+		return nil, nil, nil, err
+	}
+	// Trim object files based on timestamp
+	if err = options.startTrimAudit(ctx, dstFs); err != nil {
+		return nil, nil, nil, options.finishTrimAudit(err)
+	}
+	isCkpChange, err = trimObjectsData(ctx, fs, ts, &objectsData, options)
+	if err = options.finishTrimAudit(err); err != nil {
+		return nil, nil, nil, err
 	}
-
-	for i := 0; i < blkMetaInsert.Length(); i++ {
-		metaLoc := objectio.Location(blkMetaInsertMetaLoc.Get(i).([]byte))
-		deltaLoc := objectio.Location(blkMetaInsertDeltaLoc.Get(i).([]byte))
-		blkID := blkMetaInsertBlkID.Get(i).(types.Blockid)
-		isABlk := blkMetaInsertEntryState.Get(i).(bool)
-		if deltaLoc.IsEmpty() || !metaLoc.IsEmpty() {
-			panic(any(fmt.Sprintf("deltaLoc is empty: %v-%v", deltaLoc.String(), metaLoc.String())))
-		}
-		name := objectio.BuildObjectName(blkID.Segment(), blkID.Sequence())
-		if isABlk {
-			if objectsData[name.String()] == nil {
+	if err = options.stampCheckpointEnd(loc); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = options.checkProjection(data, objectsData, ts); err != nil {
+		return nil, nil, nil, err
+	}
+	// The rows dropped by validateLocations, resolveDuplicateBlocks,
+	// resolveBlockOverlap, dropDeniedBlocks and dropCollectedObjects
+	// must not come back with the original checkpoint.
+	isCkpChange = isCkpChange || corrupt > 0 || duplicates > 0 || dropped > 0 || denied > 0 ||
+		collected > 0
+	options.stats.Phase(StatsPhaseTrim).Add(StatOverlapRows, int64(dropped))
+	if options.verifySort {
+		// The objects that are not rewritten keep their sorted flag,
+		// make sure the flag is not lying.
+		for _, objectData := range objectsData {
+			if objectData.isChange || objectData.obj == nil || objectData.obj.isABlock {
 				continue
 			}
-			if !objectsData[name.String()].isDeleteBatch {
-				panic(any(fmt.Sprintf("object %v is not deleteBatch", name.String())))
-			}
-			addBlockToObjectData(deltaLoc, isABlk, true, i,
-				blkMetaInsTxnBatTid.Get(i).(uint64), blkID, objectio.SchemaTombstone, &objectsData)
-			objectsData[name.String()].data[blkID.Sequence()].blockId = blkID
-			objectsData[name.String()].data[blkID.Sequence()].tombstone = objectsData[deltaLoc.Name().String()].data[deltaLoc.ID()]
-			if len(objectsData[name.String()].data[blkID.Sequence()].deleteRow) > 0 {
-				objectsData[name.String()].data[blkID.Sequence()].deleteRow = append(objectsData[name.String()].data[blkID.Sequence()].deleteRow, i)
-			} else {
-				objectsData[name.String()].data[blkID.Sequence()].deleteRow = []int{i}
-			}
-		} else {
-			if objectsData[name.String()] != nil {
-				if objectsData[name.String()].isDeleteBatch {
-					addBlockToObjectData(deltaLoc, isABlk, true, i,
-						blkMetaInsTxnBatTid.Get(i).(uint64), blkID, objectio.SchemaTombstone, &objectsData)
-					continue
-				}
+			var violations []SortViolation
+			violations, err = verifyObjectSorted(ctx, fs, objectData.obj.stats.ObjectLocation())
+			if err != nil {
+				return nil, nil, nil, err
 			}
-			addBlockToObjectData(deltaLoc, isABlk, false, i,
-				blkMetaInsTxnBatTid.Get(i).(uint64), blkID, objectio.SchemaTombstone, &objectsData)
+			options.result.SortViolations = append(options.result.SortViolations, violations...)
+			options.stats.Phase(StatsPhaseVerify).Add(StatSortViolations, int64(len(violations)))
+		}
+	}
+	// outputSizes tracks the objects the rewritten checkpoint will
+	// reference, starting from the source objects.
+	outputSizes := make(map[string]int64, len(objectsData))
+	outputTables := make(map[string]uint64, len(objectsData))
+	for name, objectData := range objectsData {
+		outputSizes[name] = objectData.size()
+		outputTables[name] = objectData.table()
+	}
+	options.result.Stats.InputBytes = sumObjectSizes(outputSizes)
+	rewriteStats := options.stats.Phase(StatsPhaseRewrite)
+	rewriteStats.Add(StatInputBytes, options.result.Stats.InputBytes)
+	// recordOutput records the output sizes in the result once, before
+	// the summary is logged or on any return.
+	outputRecorded := false
+	recordOutput := func() {
+		if outputRecorded {
+			return
 		}
+		outputRecorded = true
+		options.result.Stats.OutputBytes = sumObjectSizes(outputSizes)
+		options.result.Tables = tableBytes(outputSizes, outputTables)
+		rewriteStats.Add(StatOutputBytes, options.result.Stats.OutputBytes)
+	}
+	defer recordOutput()
+	// A checkpoint that has no location is written even if the rewrite
+	// does not change it.
+	if !isCkpChange && !loc.IsEmpty() {
+		// The checkpoint is kept as it is, its provenance in dstFs gets
+		// the hop of the rewrite all the same.
+		if err = writeCheckpointProvenance(
+			ctx, dstFs, data.provenance, loc, version, ts, loc.Name().String(), options.cnOnly,
+			options.rewrittenAt()); err != nil {
+			return nil, nil, nil, err
+		}
+		if options.cnOnly {
+			tnLocation = nil
+		}
+		options.recordMoves(sourceRefs, sourceRefs)
+		return loc, tnLocation, files.All(), nil
 	}
 
-	phaseNumber = 3
-	// Trim object files based on timestamp
-	isCkpChange, err = trimObjectsData(ctx, fs, ts, &objectsData)
-	if err != nil {
+	if err = options.checkFreeSpace(ctx, spaceFs, objectsData); err != nil {
 		return nil, nil, nil, err
 	}
-	if !isCkpChange {
-		return loc, tnLocation, files, nil
-	}
 
 	backupPool := dbutils.MakeDefaultSmallPool("backup-vector-pool")
 	defer backupPool.Destory()
 
 	insertBatch := make(map[uint64]*iBlocks)
 	insertObjBatch := make(map[uint64]*iObjects)
+	// small are the aBlocks converted in batches, by table.
+	small := make(map[uint64][]*smallABlock)
+	// emptied are the objects rewritten in place that trimming left
+	// without rows, see dropEmptied.
+	emptied := make(map[string]struct{})
 
 	phaseNumber = 4
+	// The progress of the phase is reported object by object, ctx is
+	// checked by the loop.
+	options.observer.OnPhaseStart(phaseNumber)
+	retainTombstones(objectsData)
+	options.resolveTableSortKeys(objectsData)
 	// Rewrite object file
+	done := 0
 	for fileName, objectData := range objectsData {
+		options.report(phaseNumber, done, len(objectsData))
+		done++
+		if err = ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
 		if !objectData.isChange && !objectData.isDeleteBatch {
 			continue
 		}
-		dataBlocks := make([]*blockData, 0)
-		var blocks []objectio.BlockObject
-		var extent objectio.Extent
-		for _, block := range objectData.data {
-			dataBlocks = append(dataBlocks, block)
+		var written *writtenObject
+		// rewritten is set when the object is written again under its own
+		// name, block i of written then replaces dataBlocks[i].
+		var rewritten bool
+		dataBlocks, ok := options.blocksToRewrite(fileName, objectData)
+		if !ok {
+			continue
 		}
-		sort.Slice(dataBlocks, func(i, j int) bool {
-			return dataBlocks[i].num < dataBlocks[j].num
-		})
 
-		if objectData.isChange &&
-			(!objectData.isDeleteBatch || (objectData.data[0] != nil &&
-				objectData.data[0].blockType == objectio.SchemaTombstone)) {
+		if objectData.rewrittenInPlace() && blocksEmptied(dataBlocks) {
+			options.dropEmptied(emptied, fileName, dataBlocks)
+			delete(outputSizes, fileName)
+			continue
+		}
+		if objectData.rewrittenInPlace() {
 			// Rewrite the insert block/delete block file.
-			objectData.isDeleteBatch = false
-			writer, err := blockio.NewBlockWriter(dstFs, fileName)
-			if err != nil {
+			var ok bool
+			var target objectio.ObjectName
+			if target, err = options.rewriteTarget(objectData.name, dataBlocks); err != nil {
 				return nil, nil, nil, err
 			}
-			for _, block := range dataBlocks {
-				if block.sortKey != math.MaxUint16 {
-					writer.SetPrimaryKey(block.sortKey)
-				}
-				if block.blockType == objectio.SchemaData {
-					// TODO: maybe remove
-					_, err = writer.WriteBatch(block.data)
-					if err != nil {
-						return nil, nil, nil, err
-					}
-				} else if block.blockType == objectio.SchemaTombstone {
-					_, err = writer.WriteTombstoneBatch(block.data)
-					if err != nil {
-						return nil, nil, nil, err
-					}
-				}
+			if err = session.register(target.String(), fileName); err != nil {
+				return nil, nil, nil, err
 			}
-
-			blocks, extent, err = writer.Sync(ctx)
-			if err != nil {
-				if !moerr.IsMoErrCode(err, moerr.ErrFileAlreadyExists) {
-					return nil, nil, nil, err
+			if written, ok = session.lookup(target.String()); !ok {
+				err = session.attemptOnce(ctx, fileName, func(ctx context.Context) (err error) {
+					written, err = options.writeRewritten(ctx, dstFs, target, dataBlocks)
+					return
+				})
+				if options.skipped(err) {
+					// The object is not kept untrimmed, see dropSkipped.
+					options.dropSkipped(fileName)
+					err = nil
+					continue
 				}
-				err = fs.Delete(ctx, fileName)
 				if err != nil {
 					return nil, nil, nil, err
 				}
-				blocks, extent, err = writer.Sync(ctx)
-				if err != nil {
-					return nil, nil, nil, err
+				options.recordWritten(session, written)
+			}
+			objectData.isDeleteBatch = false
+			rewritten = true
+			for _, block := range dataBlocks {
+				if block.users > 0 {
+					block.release()
 				}
 			}
+			files.Rewritten = append(files.Rewritten, target.String())
+			if dataBlocks[0].blockType == objectio.SchemaTombstone {
+				files.Tombstones = append(files.Tombstones, target.String())
+			}
+			options.countObject(StatRewritten, dataBlocks[0].tid)
+			if target.String() != fileName {
+				options.recordRenamed(fileName, target.String())
+				delete(outputSizes, fileName)
+				outputTables[target.String()] = outputTables[fileName]
+			}
+			outputSizes[target.String()] = written.size()
 		}
 
 		if objectData.isDeleteBatch &&
@@ -802,79 +2792,67 @@ func ReWriteCheckpointAndBlockFromKey(
 			var blockLocation objectio.Location
 			if !objectData.isABlock {
 				// Case of merge nBlock
-				for _, dt := range dataBlocks {
-					if insertBatch[dataBlocks[0].tid] == nil {
-						insertBatch[dataBlocks[0].tid] = &iBlocks{
-							insertBlocks: make([]*insertBlock, 0),
-						}
-					}
-					ib := &insertBlock{
-						apply:     false,
-						deleteRow: dt.deleteRow[len(dt.deleteRow)-1],
-						data:      dt,
-					}
-					insertBatch[dataBlocks[0].tid].insertBlocks = append(insertBatch[dataBlocks[0].tid].insertBlocks, ib)
+				addMergedBlocks(insertBatch, dataBlocks)
+			} else if dataBlocks[0].dropped {
+				// Nothing to convert, the empty blockLocation drops
+				// the object info row below.
+				delete(outputSizes, fileName)
+				if dataBlocks[0].tombstone != nil {
+					dataBlocks[0].tombstone.release()
 				}
 			} else {
 				// For the aBlock that needs to be retained,
 				// the corresponding NBlock is generated and inserted into the corresponding batch.
-				if len(dataBlocks) > 2 {
-					panic(any(fmt.Sprintf("dataBlocks len > 2: %v - %d", dataBlocks[0].location.String(), len(dataBlocks))))
-				}
-				if objectData.data[0].tombstone != nil {
-					applyDelete(dataBlocks[0].data, objectData.data[0].tombstone.data, dataBlocks[0].blockId.String())
-				}
-				sortData := containers.ToTNBatch(dataBlocks[0].data, common.CheckpointAllocator)
-				if dataBlocks[0].sortKey != math.MaxUint16 {
-					_, err = mergesort.SortBlockColumns(sortData.Vecs, int(dataBlocks[0].sortKey), backupPool)
-					if err != nil {
-						return nil, nil, nil, err
-					}
-				}
-				dataBlocks[0].data = containers.ToCNBatch(sortData)
-				result := batch.NewWithSize(len(dataBlocks[0].data.Vecs) - 3)
-				for i := range result.Vecs {
-					result.Vecs[i] = dataBlocks[0].data.Vecs[i]
-				}
-				dataBlocks[0].data = result
-				fileNum := uint16(1000) + dataBlocks[0].location.Name().Num()
-				segment := dataBlocks[0].location.Name().SegmentId()
-				name := objectio.BuildObjectName(&segment, fileNum)
-
-				writer, err := blockio.NewBlockWriter(dstFs, name.String())
-				if err != nil {
-					return nil, nil, nil, err
+				if options.isSmallABlock(dataBlocks) {
+					tid := dataBlocks[0].tid
+					small[tid] = append(small[tid], &smallABlock{
+						fileName:   fileName,
+						objectData: objectData,
+						dataBlocks: dataBlocks,
+					})
+					continue
 				}
-				if dataBlocks[0].sortKey != math.MaxUint16 {
-					writer.SetPrimaryKey(dataBlocks[0].sortKey)
+				var (
+					ib         *insertBlock
+					parts      []*writtenObject
+					partBlocks []*insertBlock
+				)
+				err = session.attemptOnce(ctx, fileName, func(ctx context.Context) (err error) {
+					written, ib, parts, partBlocks, err = convertABlock(ctx, fs, dstFs, session, options, dataBlocks, backupPool)
+					return
+				})
+				if options.skipped(err) {
+					// The checkpoint keeps the aBlock unconverted.
+					err = nil
+					continue
 				}
-				_, err = writer.WriteBatch(dataBlocks[0].data)
 				if err != nil {
 					return nil, nil, nil, err
 				}
-				blocks, extent, err = writer.Sync(ctx)
-				if err != nil {
-					panic("sync error")
-				}
-				files = append(files, name.String())
-				blockLocation = objectio.BuildLocation(name, extent, blocks[0].GetRows(), blocks[0].GetID())
-				if insertBatch[dataBlocks[0].tid] == nil {
-					insertBatch[dataBlocks[0].tid] = &iBlocks{
-						insertBlocks: make([]*insertBlock, 0),
-					}
-				}
-				ib := &insertBlock{
-					location: blockLocation,
-					blockId:  *objectio.BuildObjectBlockid(name, blocks[0].GetID()),
-					apply:    false,
-				}
-				if len(dataBlocks[0].deleteRow) > 0 {
-					ib.deleteRow = dataBlocks[0].deleteRow[0]
+				name := written.name
+				files.Converted = append(files.Converted, name.String())
+				options.countObject(StatConverted, dataBlocks[0].tid)
+				options.recordConverted(fileName, name.String())
+				delete(outputSizes, fileName)
+				outputSizes[name.String()] = written.size()
+				outputTables[name.String()] = dataBlocks[0].tid
+				blockLocation = ib.location
+				addInsertBlock(insertBatch, dataBlocks[0].tid, ib)
+				for i, part := range parts {
+					files.Converted = append(files.Converted, part.name.String())
+					options.countObject(StatConverted, dataBlocks[0].tid)
+					outputSizes[part.name.String()] = part.size()
+					outputTables[part.name.String()] = dataBlocks[0].tid
+					addInsertBlock(insertBatch, dataBlocks[0].tid, partBlocks[i])
 				}
-				insertBatch[dataBlocks[0].tid].insertBlocks = append(insertBatch[dataBlocks[0].tid].insertBlocks, ib)
 
 				if objectData.obj != nil {
-					objectData.obj.stats = &writer.GetObjectStats()[objectio.SchemaData]
+					stats := written.stats
+					objectData.obj.stats = &stats
+					objectData.obj.parts = objectData.obj.parts[:0]
+					for _, part := range parts {
+						objectData.obj.parts = append(objectData.obj.parts, part.stats)
+					}
 				}
 			}
 			if objectData.obj != nil {
@@ -893,8 +2871,13 @@ func ReWriteCheckpointAndBlockFromKey(
 			}
 		} else {
 			if objectData.isDeleteBatch && objectData.data[0] == nil {
-				if !objectData.isABlock {
-					// Case of merge nBlock
+				if objectData.obj.dropped {
+					delete(outputSizes, fileName)
+				}
+				if !objectData.isABlock || objectData.obj.dropped {
+					// Case of merge nBlock, or of an aBlock with no rows
+					// at ts. Without a location the object info row is
+					// dropped.
 					if insertObjBatch[objectData.obj.tid] == nil {
 						insertObjBatch[objectData.obj.tid] = &iObjects{
 							rowObjects: make([]*insertObjects, 0),
@@ -906,47 +2889,55 @@ func ReWriteCheckpointAndBlockFromKey(
 					}
 					insertObjBatch[objectData.obj.tid].rowObjects = append(insertObjBatch[objectData.obj.tid].rowObjects, io)
 				} else {
-					sortData := containers.ToTNBatch(objectData.obj.data[0], common.CheckpointAllocator)
-					if objectData.obj.sortKey != math.MaxUint16 {
-						_, err = mergesort.SortBlockColumns(sortData.Vecs, int(objectData.obj.sortKey), backupPool)
-						if err != nil {
-							return nil, nil, nil, err
-						}
-					}
-					objectData.obj.data[0] = containers.ToCNBatch(sortData)
-					result := batch.NewWithSize(len(objectData.obj.data[0].Vecs) - 3)
-					for i := range result.Vecs {
-						result.Vecs[i] = objectData.obj.data[0].Vecs[i]
-					}
-					objectData.obj.data[0] = result
-					fileNum := uint16(1000) + objectData.obj.stats.ObjectName().Num()
-					segment := objectData.obj.stats.ObjectName().SegmentId()
-					name := objectio.BuildObjectName(&segment, fileNum)
-
-					writer, err := blockio.NewBlockWriter(dstFs, name.String())
-					if err != nil {
-						return nil, nil, nil, err
-					}
-					if objectData.obj.sortKey != math.MaxUint16 {
-						writer.SetPrimaryKey(objectData.obj.sortKey)
+					obj := objectData.obj
+					name := options.convertedName(obj.stats.ObjectName())
+					err = session.attemptOnce(ctx, fileName, func(ctx context.Context) (err error) {
+						written, err = options.convertedObject(ctx, session, dstFs, obj.stats.ObjectName(), name, func() (*writtenObject, error) {
+							sorted, err := options.sortABlock(
+								ctx, fs, obj.stats.ObjectLocation(), &obj.sortKey,
+								obj.tid, obj.data[0], backupPool)
+							if err != nil {
+								return nil, err
+							}
+							result := batch.NewWithSize(len(sorted.Vecs) - 3)
+							for i := range result.Vecs {
+								result.Vecs[i] = sorted.Vecs[i]
+							}
+							result.SetRowCount(result.Vecs[0].Length())
+							obj.data[0] = result
+							projected, sortKey, err := options.project(obj.tid, result, 0, obj.sortKey)
+							if err != nil {
+								return nil, err
+							}
+							if err = options.exportBlock(ctx, obj.tid, name, projected); err != nil {
+								return nil, err
+							}
+							return options.writeConverted(ctx, dstFs, name, projected, sortKey)
+						})
+						return
+					})
+					if options.skipped(err) {
+						// The checkpoint keeps the aBlock unconverted.
+						err = nil
+						continue
 					}
-					_, err = writer.WriteBatch(objectData.obj.data[0])
 					if err != nil {
 						return nil, nil, nil, err
 					}
-					blocks, extent, err = writer.Sync(ctx)
-					if err != nil {
-						panic("sync error")
-					}
-					files = append(files, name.String())
-					blockLocation := objectio.BuildLocation(name, extent, blocks[0].GetRows(), blocks[0].GetID())
-					obj := objectData.obj
+					files.Converted = append(files.Converted, name.String())
+					options.countObject(StatConverted, obj.tid)
+					options.recordConverted(fileName, name.String())
+					delete(outputSizes, fileName)
+					outputSizes[name.String()] = written.size()
+					outputTables[name.String()] = obj.tid
+					blockLocation := written.location(0)
 					if insertObjBatch[obj.tid] == nil {
 						insertObjBatch[obj.tid] = &iObjects{
 							rowObjects: make([]*insertObjects, 0),
 						}
 					}
-					obj.stats = &writer.GetObjectStats()[objectio.SchemaData]
+					stats := written.stats
+					obj.stats = &stats
 					objectio.SetObjectStatsObjectName(obj.stats, blockLocation.Name())
 					io := &insertObjects{
 						location: blockLocation,
@@ -957,142 +2948,63 @@ func ReWriteCheckpointAndBlockFromKey(
 				}
 			}
 
+			if rewritten {
+				if err = checkWrittenBlocks(written, dataBlocks); err != nil {
+					return nil, nil, nil, err
+				}
+			}
 			for i := range dataBlocks {
 				blockLocation := dataBlocks[i].location
-				if objectData.isChange {
-					blockLocation = objectio.BuildLocation(objectData.name, extent, blocks[uint16(i)].GetRows(), dataBlocks[i].num)
+				if rewritten {
+					blockLocation = options.rewrittenLocation(objectData.name, written, dataBlocks[i], i)
 				}
 				for _, insertRow := range dataBlocks[i].insertRow {
-					if dataBlocks[uint16(i)].blockType == objectio.SchemaTombstone {
-						data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(
-							insertRow,
-							[]byte(blockLocation),
-							false)
-						data.bats[BLKMetaInsertTxnIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(
-							insertRow,
-							[]byte(blockLocation),
-							false)
-					}
+					setBlockLocation(data, insertRowKind, dataBlocks[i], insertRow, blockLocation)
 				}
-				for _, deleteRow := range dataBlocks[uint16(i)].deleteRow {
-					if dataBlocks[uint16(i)].blockType == objectio.SchemaTombstone {
-						data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(
-							deleteRow,
-							[]byte(blockLocation),
-							false)
-						data.bats[BLKMetaInsertTxnIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(
-							deleteRow,
-							[]byte(blockLocation),
-							false)
-					}
+				for _, deleteRow := range dataBlocks[i].deleteRow {
+					setBlockLocation(data, deleteRowKind, dataBlocks[i], deleteRow, blockLocation)
 				}
 			}
 		}
+		if session.Exceeded() {
+			// Finish the object in flight and stop, the journal lets
+			// the next session continue from here.
+			// The small aBlocks are left to the next session, which
+			// batches them with the ones this session did not reach.
+			releaseSmallABlocks(small)
+			err = session.Stop(ctx)
+			return nil, nil, nil, err
+		}
+	}
+	if err = convertSmallABlocks(ctx, fs, dstFs, session, options, small, backupPool,
+		outputSizes, outputTables, insertBatch, insertObjBatch); err != nil {
+		return nil, nil, nil, err
+	}
+
+	options.report(phaseNumber, done, len(objectsData))
+
+	if err = session.Flush(ctx); err != nil {
+		return nil, nil, nil, err
 	}
 
 	phaseNumber = 5
+	if err = options.enterPhase(ctx, phaseNumber); err != nil {
+		return nil, nil, nil, err
+	}
 	// Transfer the object file that needs to be deleted to insert
 	if len(insertBatch) > 0 {
-		blkMeta := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertIDX], common.CheckpointAllocator)
-		blkMetaTxn := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertTxnIDX], common.CheckpointAllocator)
-		for i := 0; i < blkMetaInsert.Length(); i++ {
-			tid := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
-			appendValToBatch(data.bats[BLKMetaInsertIDX], blkMeta, i)
-			appendValToBatch(data.bats[BLKMetaInsertTxnIDX], blkMetaTxn, i)
-			if insertBatch[tid] != nil {
-				for b, blk := range insertBatch[tid].insertBlocks {
-					if blk.apply {
-						continue
-					}
-					if insertBatch[tid].insertBlocks[b].data == nil {
-
-					} else {
-						insertBatch[tid].insertBlocks[b].apply = true
-
-						row := blkMeta.Vecs[0].Length() - 1
-						if !blk.location.IsEmpty() {
-							sort := true
-							if insertBatch[tid].insertBlocks[b].data != nil &&
-								insertBatch[tid].insertBlocks[b].data.isABlock &&
-								insertBatch[tid].insertBlocks[b].data.sortKey == math.MaxUint16 {
-								sort = false
-							}
-							updateBlockMeta(blkMeta, blkMetaTxn, row,
-								insertBatch[tid].insertBlocks[b].blockId,
-								insertBatch[tid].insertBlocks[b].location,
-								sort)
-						}
-					}
-				}
-			}
-		}
-
-		for tid := range insertBatch {
-			for b := range insertBatch[tid].insertBlocks {
-				if insertBatch[tid].insertBlocks[b].apply {
-					continue
-				}
-				if insertBatch[tid] != nil && !insertBatch[tid].insertBlocks[b].apply {
-					insertBatch[tid].insertBlocks[b].apply = true
-					if insertBatch[tid].insertBlocks[b].data == nil {
-
-					} else {
-						i := blkMeta.Vecs[0].Length() - 1
-						if !insertBatch[tid].insertBlocks[b].location.IsEmpty() {
-							sort := true
-							if insertBatch[tid].insertBlocks[b].data != nil &&
-								insertBatch[tid].insertBlocks[b].data.isABlock &&
-								insertBatch[tid].insertBlocks[b].data.sortKey == math.MaxUint16 {
-								sort = false
-							}
-							updateBlockMeta(blkMeta, blkMetaTxn, i,
-								insertBatch[tid].insertBlocks[b].blockId,
-								insertBatch[tid].insertBlocks[b].location,
-								sort)
-						}
-					}
-				}
-			}
-		}
-
-		for i := range insertBatch {
-			for _, block := range insertBatch[i].insertBlocks {
-				if block.data != nil {
-					for _, cnRow := range block.data.deleteRow {
-						if block.data.isABlock {
-							data.bats[BLKMetaInsertIDX].Delete(cnRow)
-							data.bats[BLKMetaInsertTxnIDX].Delete(cnRow)
-						}
-					}
-				}
-			}
-		}
-
-		data.bats[BLKMetaInsertIDX].Compact()
-		data.bats[BLKMetaInsertTxnIDX].Compact()
-		tableInsertOff := make(map[uint64]*tableOffset)
-		for i := 0; i < blkMetaTxn.Vecs[0].Length(); i++ {
-			tid := blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
-			if tableInsertOff[tid] == nil {
-				tableInsertOff[tid] = &tableOffset{
-					offset: i,
-					end:    i,
-				}
-			}
-			tableInsertOff[tid].end += 1
-		}
-
-		for tid, table := range tableInsertOff {
-			data.UpdateBlockInsertBlkMeta(tid, int32(table.offset), int32(table.end))
+		if err = transferInsertBlocks(ctx, data, insertBatch, options.stats); err != nil {
+			return nil, nil, nil, err
 		}
-		data.bats[BLKMetaInsertIDX].Close()
-		data.bats[BLKMetaInsertTxnIDX].Close()
-		data.bats[BLKMetaInsertIDX] = blkMeta
-		data.bats[BLKMetaInsertTxnIDX] = blkMetaTxn
 	}
 
 	phaseNumber = 6
-	if len(insertObjBatch) > 0 {
+	if err = options.enterPhase(ctx, phaseNumber); err != nil {
+		return nil, nil, nil, err
+	}
+	// Checkpoints without object info have no object level rows to
+	// convert, their converted aBlocks are only block meta rows.
+	if len(insertObjBatch) > 0 && checkpointHasObjectInfo(version) {
 		deleteRow := make([]int, 0)
 		objectInfoMeta := makeRespBatchFromSchema(checkpointDataSchemas_Curr[ObjectInfoIDX], common.CheckpointAllocator)
 		infoInsert := make(map[int]*objData, 0)
@@ -1102,6 +3014,12 @@ func ReWriteCheckpointAndBlockFromKey(
 				if insertObjBatch[tid].rowObjects[i].apply {
 					continue
 				}
+				if insertObjBatch[tid].rowObjects[i].merged {
+					if obj := insertObjBatch[tid].rowObjects[i].obj; len(obj.infoTNRow) > 0 {
+						data.bats[TNObjectInfoIDX].Delete(obj.infoTNRow[0])
+					}
+					continue
+				}
 				if !insertObjBatch[tid].rowObjects[i].location.IsEmpty() {
 					obj := insertObjBatch[tid].rowObjects[i].obj
 					if infoInsert[obj.infoDel[0]] != nil {
@@ -1123,16 +3041,16 @@ func ReWriteCheckpointAndBlockFromKey(
 
 		}
 		for i := 0; i < objInfoData.Length(); i++ {
-			appendValToBatch(objInfoData, objectInfoMeta, i)
+			if err = appendValToBatch(objInfoData, objectInfoMeta, i); err != nil {
+				return nil, nil, nil, err
+			}
 			if infoInsert[i] != nil && infoDelete[i] {
 				panic("info should not have info delete")
 			}
 			if infoInsert[i] != nil {
-				appendValToBatch(objInfoData, objectInfoMeta, i)
-				row := objectInfoMeta.Length() - 1
-				objectInfoMeta.GetVectorByName(ObjectAttr_ObjectStats).Update(row, infoInsert[i].stats[:], false)
-				objectInfoMeta.GetVectorByName(ObjectAttr_State).Update(row, false, false)
-				objectInfoMeta.GetVectorByName(EntryNode_DeleteAt).Update(row, types.TS{}, false)
+				if err = appendConvertedObjectInfo(objInfoData, objectInfoMeta, i, infoInsert[i]); err != nil {
+					return nil, nil, nil, err
+				}
 			}
 
 			if infoDelete[i] {
@@ -1145,34 +3063,280 @@ func ReWriteCheckpointAndBlockFromKey(
 		data.bats[TNObjectInfoIDX].Compact()
 		objectInfoMeta.Compact()
 		data.bats[ObjectInfoIDX].Close()
-		data.bats[ObjectInfoIDX] = objectInfoMeta
-		tableInsertOff := make(map[uint64]*tableOffset)
-		for i := 0; i < objectInfoMeta.Vecs[0].Length(); i++ {
-			tid := objectInfoMeta.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
-			if tableInsertOff[tid] == nil {
-				tableInsertOff[tid] = &tableOffset{
-					offset: i,
-					end:    i,
-				}
-			}
-			tableInsertOff[tid].end += 1
+		objectInfoBats := []*containers.Batch{objectInfoMeta}
+		var tableInsertOff map[uint64]*tableOffset
+		tableInsertOff, err = groupByTable([]uint16{ObjectInfoIDX}, objectInfoBats,
+			objectInfoMeta.GetVectorByName(SnapshotAttr_TID), common.CheckpointAllocator)
+		if err != nil {
+			return nil, nil, nil, err
 		}
+		data.bats[ObjectInfoIDX] = objectInfoBats[0]
 
 		for tid, table := range tableInsertOff {
 			data.UpdateObjectInsertMeta(tid, int32(table.offset), int32(table.end))
 		}
 	}
+	if err = options.removeEmptiedReferences(data, emptied); err != nil {
+		return nil, nil, nil, err
+	}
+	// The objects the trim found gone are dropped once the rows of the
+	// batches are no longer referred to by index.
+	options.dropCollected(data)
+	options.result.Stats.TableOffsets = checkpointTableOffsets(data)
+	if err = options.checkGrowth(sourceSizes, data); err != nil {
+		return nil, nil, nil, err
+	}
+	refs := checkpointReferences(data)
+	options.recordReleasable(sourceRefs, refs)
+	options.recordMoves(sourceRefs, refs)
+	data.SetCNOnly(options.cnOnly)
 	cnLocation, dnLocation, checkpointFiles, err := data.WriteTo(dstFs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	logutil.Info("[Done]",
-		common.AnyField("checkpoint", cnLocation.String()),
-		common.OperationField("ReWrite Checkpoint"),
-		common.AnyField("new object", checkpointFiles))
+	if err = writeCheckpointProvenance(
+		ctx, dstFs, data.provenance, loc, version, ts, cnLocation.Name().String(), options.cnOnly,
+		options.rewrittenAt()); err != nil {
+		return nil, nil, nil, err
+	}
+	options.dropWrittenEntries(ctx, dstFs, files.Converted)
 	loc = cnLocation
 	tnLocation = dnLocation
-	files = append(files, checkpointFiles...)
-	files = append(files, cnLocation.Name().String())
-	return loc, tnLocation, files, nil
+	files.Checkpoint = append(files.Checkpoint, checkpointFiles...)
+	files.Checkpoint = append(files.Checkpoint, cnLocation.Name().String())
+	files.Meta = cnLocation.Name().String()
+	files.sort()
+	if options.footer {
+		if options.result.Footer, err = writeCheckpointFooter(
+			ctx, dstFs, data, cnLocation, tnLocation, CheckpointCurrentVersion, ts, options.result.CheckpointEnd,
+			files, options.result.Provenance, options.cnOnly, options.session.objectTags(),
+			options.projection, options.auxCreatedAt()); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if options.manifest {
+		aux := []string{CheckpointProvenanceName(files.Meta)}
+		if options.result.Footer != "" {
+			aux = append(aux, options.result.Footer)
+		}
+		if options.auditName != "" {
+			aux = append(aux, options.auditName)
+		}
+		if options.result.Manifest, err = writeRestoreManifest(
+			ctx, dstFs, cnLocation, tnLocation, CheckpointCurrentVersion, ts, options.result.CheckpointEnd,
+			files, aux, nil, options.digests, options.cnOnly); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	options.result.sortRelocated()
+	recordOutput()
+	options.log().Info("[Done]",
+		common.AnyField("checkpoint", cnLocation.String()),
+		common.OperationField("ReWrite Checkpoint"),
+		common.AnyField("summary", options.result.String()))
+	return loc, tnLocation, files.All(), nil
+}
+
+// droppedInsertRows returns the rows of the block meta insert batches of
+// length rows the insertBlocks of the aBlocks of insertBatch were
+// deleted from, sorted. Every row an insertBlock refers to is checked to
+// be one of the batches before any is used.
+func droppedInsertRows(rows int, insertBatch map[uint64]*iBlocks) ([]int, error) {
+	checkRow := func(tid uint64, block *insertBlock, row int) error {
+		if row < 0 || row >= rows {
+			return moerr.NewInternalErrorNoCtx("block %v of table %d refers to row %d of %d block meta rows",
+				block.blockId.String(), tid, row, rows)
+		}
+		return nil
+	}
+	dropped := make(map[int]struct{})
+	for tid, blocks := range insertBatch {
+		for _, block := range blocks.insertBlocks {
+			if block.data == nil {
+				continue
+			}
+			if err := checkRow(tid, block, block.deleteRow); err != nil {
+				return nil, err
+			}
+			if !block.data.isABlock {
+				continue
+			}
+			for _, row := range block.data.deleteRow {
+				if err := checkRow(tid, block, row); err != nil {
+					return nil, err
+				}
+				dropped[row] = struct{}{}
+			}
+		}
+	}
+	sorted := make([]int, 0, len(dropped))
+	for row := range dropped {
+		sorted = append(sorted, row)
+	}
+	sort.Ints(sorted)
+	return sorted, nil
+}
+
+// checkTransferredBlocks checks that each block transferred to blkMeta
+// by transferInsertBlocks has exactly one row there.
+func checkTransferredBlocks(blkMeta *containers.Batch, insertBatch map[uint64]*iBlocks) error {
+	rows := make(map[types.Blockid]int, blkMeta.Length())
+	ids := blkMeta.GetVectorByName(catalog.BlockMeta_ID)
+	for i := 0; i < ids.Length(); i++ {
+		rows[ids.Get(i).(types.Blockid)]++
+	}
+	for tid, blocks := range insertBatch {
+		for _, ib := range blocks.insertBlocks {
+			if ib.data == nil || !ib.apply {
+				continue
+			}
+			if n := rows[ib.blockId]; n != 1 {
+				return moerr.NewInternalErrorNoCtx("block %v of table %d has %d rows in the block meta",
+					ib.blockId.String(), tid, n)
+			}
+		}
+	}
+	return nil
+}
+
+// transferInsertBlocks rebuilds the block meta insert batches with the
+// insertBlocks of insertBatch applied.
+//
+// The insertBlocks of a table are applied to the rows of the table. A
+// table with insertBlocks but no rows, e.g. one that only had CN block
+// meta rows in this checkpoint, gets a copy of the row its insertBlock
+// was deleted from instead, appended after all the others so that the
+// rows of every table stay contiguous.
+//
+// The rows the insertBlocks of aBlocks were deleted from are dropped.
+// Every row index of insertBatch is one of the source batches, which
+// are only read: the rows are copied to the new batches in their order
+// first, the dropped ones are deleted from those, and only then are
+// they compacted, so no index is used once the rows have moved.
+func transferInsertBlocks(
+	ctx context.Context,
+	data *CheckpointData,
+	insertBatch map[uint64]*iBlocks,
+	stats *BackupStats,
+) error {
+	logger := jobLogger(ctx)
+	blkMetaInsert := data.bats[BLKMetaInsertIDX]
+	dropped, err := droppedInsertRows(blkMetaInsert.Length(), insertBatch)
+	if err != nil {
+		return err
+	}
+	// The rows an insertBlock is applied to keep it.
+	updated := make(map[int]struct{})
+	blkMeta := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertIDX], common.CheckpointAllocator)
+	blkMetaTxn := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertTxnIDX], common.CheckpointAllocator)
+	for i := 0; i < blkMetaInsert.Length(); i++ {
+		tid := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		if err := appendValToBatch(data.bats[BLKMetaInsertIDX], blkMeta, i); err != nil {
+			return err
+		}
+		if err := appendValToBatch(data.bats[BLKMetaInsertTxnIDX], blkMetaTxn, i); err != nil {
+			return err
+		}
+		if insertBatch[tid] != nil {
+			for b, blk := range insertBatch[tid].insertBlocks {
+				if blk.apply {
+					continue
+				}
+				if insertBatch[tid].insertBlocks[b].data == nil {
+
+				} else {
+					insertBatch[tid].insertBlocks[b].apply = true
+
+					row := blkMeta.Vecs[0].Length() - 1
+					if !blk.location.IsEmpty() {
+						sort := true
+						if insertBatch[tid].insertBlocks[b].data != nil &&
+							insertBatch[tid].insertBlocks[b].data.isABlock &&
+							insertBatch[tid].insertBlocks[b].data.sortKey == math.MaxUint16 {
+							sort = false
+						}
+						updateBlockMeta(blkMeta, blkMetaTxn, row,
+							insertBatch[tid].insertBlocks[b].blockId,
+							insertBatch[tid].insertBlocks[b].location,
+							sort, stats, logger)
+						updated[row] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+
+	for tid := range insertBatch {
+		for b := range insertBatch[tid].insertBlocks {
+			if insertBatch[tid].insertBlocks[b].apply {
+				continue
+			}
+			if insertBatch[tid] != nil && !insertBatch[tid].insertBlocks[b].apply {
+				insertBatch[tid].insertBlocks[b].apply = true
+				if insertBatch[tid].insertBlocks[b].data == nil {
+
+				} else {
+					// The table has no row of its own, the source row the
+					// insertBlock was deleted from is copied under its tid.
+					src := insertBatch[tid].insertBlocks[b].deleteRow
+					if err := appendValToBatch(data.bats[BLKMetaInsertIDX], blkMeta, src); err != nil {
+						return err
+					}
+					if err := appendValToBatch(data.bats[BLKMetaInsertTxnIDX], blkMetaTxn, src); err != nil {
+						return err
+					}
+					i := blkMeta.Vecs[0].Length() - 1
+					blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Update(i, tid, false)
+					if !insertBatch[tid].insertBlocks[b].location.IsEmpty() {
+						sort := true
+						if insertBatch[tid].insertBlocks[b].data != nil &&
+							insertBatch[tid].insertBlocks[b].data.isABlock &&
+							insertBatch[tid].insertBlocks[b].data.sortKey == math.MaxUint16 {
+							sort = false
+						}
+						updateBlockMeta(blkMeta, blkMetaTxn, i,
+							insertBatch[tid].insertBlocks[b].blockId,
+							insertBatch[tid].insertBlocks[b].location,
+							sort, stats, logger)
+					}
+				}
+			}
+		}
+	}
+
+	// The first rows of blkMeta are those of blkMetaInsert, in order.
+	for _, row := range dropped {
+		if _, ok := updated[row]; !ok {
+			blkMeta.Delete(row)
+			blkMetaTxn.Delete(row)
+		}
+	}
+	blkMeta.Compact()
+	blkMetaTxn.Compact()
+
+	if err := checkTransferredBlocks(blkMeta, insertBatch); err != nil {
+		blkMeta.Close()
+		blkMetaTxn.Close()
+		return err
+	}
+
+	// The rows copied for the tables without a row of their own are
+	// appended last, a table can have rows on both sides of another.
+	blkMetaBats := []*containers.Batch{blkMeta, blkMetaTxn}
+	tableInsertOff, err := groupByTable([]uint16{BLKMetaInsertIDX, BLKMetaInsertTxnIDX}, blkMetaBats,
+		blkMetaTxn.GetVectorByName(SnapshotAttr_TID), common.CheckpointAllocator)
+	if err != nil {
+		blkMeta.Close()
+		blkMetaTxn.Close()
+		return err
+	}
+
+	for tid, table := range tableInsertOff {
+		data.UpdateBlockInsertBlkMeta(tid, int32(table.offset), int32(table.end))
+	}
+	data.bats[BLKMetaInsertIDX].Close()
+	data.bats[BLKMetaInsertTxnIDX].Close()
+	data.bats[BLKMetaInsertIDX] = blkMetaBats[0]
+	data.bats[BLKMetaInsertTxnIDX] = blkMetaBats[1]
+	return nil
 }
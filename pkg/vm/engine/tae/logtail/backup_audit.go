@@ -0,0 +1,225 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// AuditFormat is the format of the audit file of WithTrimAudit.
+type AuditFormat int
+
+const (
+	// AuditCSV writes a header line and a line per row: the table id,
+	// the rowid and the commit ts.
+	AuditCSV AuditFormat = iota
+	// AuditJSON writes a JSON array of TrimmedRow.
+	AuditJSON
+)
+
+// TrimmedRow is a row of an aBlock the trim removed from the backup,
+// late or filtered, as the audit file lists it.
+type TrimmedRow struct {
+	Table    uint64 `json:"table_id"`
+	RowID    string `json:"rowid"`
+	CommitTS string `json:"commit_ts"`
+}
+
+// WithTrimAudit writes the rows of the aBlocks the trim removes from
+// the backup, the late rows and those of the row filter, to the file
+// name of the destination, in format. The rows are streamed to the file
+// an object at a time, in the order the trim meets the objects, so
+// that a large trim is not held in memory. A rewrite that fails while
+// trimming does not write the file.
+//
+// The deletes the trim cuts off the tombstones are not listed, they
+// remove no row from the backup.
+func WithTrimAudit(name string, format AuditFormat) BackupOption {
+	return func(o *backupOptions) {
+		o.auditName = name
+		o.auditFormat = format
+	}
+}
+
+// trimAudit streams the rows of the audit file to the destination as
+// the trim commits them.
+type trimAudit struct {
+	format AuditFormat
+	pipe   *io.PipeWriter
+	buf    *bufio.Writer
+	csv    *csv.Writer
+	rows   int
+	// done receives the error of the write of the file once the pipe
+	// is closed.
+	done chan error
+}
+
+// startTrimAudit starts writing the audit file of WithTrimAudit to
+// dstFs, if it is set. The trim commits the rows it removes to it and
+// finishTrimAudit ends the file.
+func (o *backupOptions) startTrimAudit(ctx context.Context, dstFs fileservice.FileService) error {
+	if o.auditName == "" {
+		return nil
+	}
+	if o.auditFormat != AuditCSV && o.auditFormat != AuditJSON {
+		return moerr.NewInvalidInputNoCtx("unknown audit format %d", o.auditFormat)
+	}
+	reader, writer := io.Pipe()
+	audit := &trimAudit{
+		format: o.auditFormat,
+		pipe:   writer,
+		buf:    bufio.NewWriter(writer),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		err := dstFs.Write(ctx, fileservice.IOVector{
+			FilePath: o.auditName,
+			Entries: []fileservice.IOEntry{{
+				ReaderForWrite: reader,
+				Size:           -1,
+			}},
+		})
+		// A write that fails before the end of the stream unblocks
+		// the trim.
+		reader.CloseWithError(err)
+		audit.done <- err
+	}()
+	var err error
+	switch audit.format {
+	case AuditCSV:
+		audit.csv = csv.NewWriter(audit.buf)
+		err = audit.csv.Write([]string{"table_id", "rowid", "commit_ts"})
+	case AuditJSON:
+		_, err = audit.buf.WriteString("[")
+	}
+	o.audit = audit
+	return err
+}
+
+// finishTrimAudit ends the audit file, or drops it if the trim failed
+// with err, and returns err or the error of the write.
+func (o *backupOptions) finishTrimAudit(err error) error {
+	audit := o.audit
+	if audit == nil {
+		return err
+	}
+	o.audit = nil
+	if err == nil {
+		err = audit.flush(true)
+	}
+	if err != nil {
+		audit.pipe.CloseWithError(err)
+		<-audit.done
+		return err
+	}
+	audit.pipe.Close()
+	if err = <-audit.done; err != nil {
+		return err
+	}
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("trim audit"),
+		common.OperandField(o.auditName),
+		common.AnyField("rows", audit.rows))
+	return nil
+}
+
+func (a *trimAudit) write(rows []TrimmedRow) error {
+	for _, row := range rows {
+		switch a.format {
+		case AuditCSV:
+			err := a.csv.Write([]string{strconv.FormatUint(row.Table, 10), row.RowID, row.CommitTS})
+			if err != nil {
+				return err
+			}
+		case AuditJSON:
+			if a.rows > 0 {
+				if err := a.buf.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			line, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			if _, err = a.buf.Write(line); err != nil {
+				return err
+			}
+		}
+		a.rows++
+	}
+	return a.flush(false)
+}
+
+// flush writes what is buffered to the pipe, with the end of the file
+// if last is set.
+func (a *trimAudit) flush(last bool) error {
+	if a.csv != nil {
+		a.csv.Flush()
+		if err := a.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if last && a.format == AuditJSON {
+		if _, err := a.buf.WriteString("]"); err != nil {
+			return err
+		}
+	}
+	return a.buf.Flush()
+}
+
+// auditRows adds the rows of the aBlock bat at location, of table tid,
+// to the rows of the report to audit, if it audits. rows are offsets in
+// bat as it is.
+func (r *trimReport) auditRows(
+	bat *batch.Batch,
+	rows []int64,
+	tid uint64,
+	location objectio.Location,
+) error {
+	if !r.audit || len(rows) == 0 {
+		return nil
+	}
+	rowids := bat.Vecs[len(bat.Vecs)-3]
+	if rowids.GetType().Oid != types.T_Rowid {
+		return moerr.NewInternalErrorNoCtx("block %s: no rowid column to audit, found %s",
+			location.String(), rowids.GetType().String())
+	}
+	commits := bat.Vecs[len(bat.Vecs)-2]
+	var commitTs types.TS
+	for _, row := range rows {
+		if err := unmarshalCommitTs(&commitTs, commits, int(row), location, false); err != nil {
+			return err
+		}
+		rowid := vector.GetFixedAt[types.Rowid](rowids, int(row))
+		r.audited = append(r.audited, TrimmedRow{
+			Table:    tid,
+			RowID:    rowid.String(),
+			CommitTS: commitTs.ToString(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/version"
+)
+
+// Every auxiliary file starts with a header that says what it is:
+//
+//	magic      [4]byte  backupAuxMagic
+//	headerLen  uint32   length of the fields below, the payload follows
+//	version    uint16   format version of the payload
+//	kind       uint8 length, then the kind, e.g. BackupAuxJournal
+//	createdAt  types.TS
+//	build      uint16 length, then the build that wrote the file
+//
+// The integers are little endian. Fields are only ever added after
+// build: a reader skips the header fields it does not know through
+// headerLen, so it can read a file of a newer build as long as the
+// version of the payload is one it knows. A payload whose layout
+// changes gets a new version in backupAuxVersions, and the readers of
+// older builds reject it instead of misreading it.
+var backupAuxMagic = [4]byte{'M', 'O', 'B', 'A'}
+
+const backupAuxFixedLen = len(backupAuxMagic) + 4
+
+// backupAuxVersions is the current format version of the payload of
+// each kind of auxiliary file. A reader accepts any version up to it.
+var backupAuxVersions = map[string]uint16{
+	BackupAuxJournal:     1,
+	BackupAuxSoftDeletes: 1,
+	BackupAuxInPlace:     1,
+	BackupAuxRewriteTask: 1,
+	BackupAuxFooter:      1,
+	BackupAuxProvenance:  1,
+	BackupAuxWritten:     1,
+
+	BackupAuxCheckpointHeader: 1,
+}
+
+// BackupAuxHeader describes an auxiliary file.
+type BackupAuxHeader struct {
+	Kind      string
+	Version   uint16
+	CreatedAt types.TS
+	Build     string
+}
+
+// BackupAuxKindError is returned when an auxiliary file is not of the
+// kind its reader expects, e.g. a journal read as an in-place intent.
+type BackupAuxKindError struct {
+	Name string
+	Want string
+	Got  string
+}
+
+func (e *BackupAuxKindError) Error() string {
+	return fmt.Sprintf("backup file %s is a %q file, expected %q", e.Name, e.Got, e.Want)
+}
+
+func IsBackupAuxKindError(err error) bool {
+	var ke *BackupAuxKindError
+	return errors.As(err, &ke)
+}
+
+// BackupAuxVersionError is returned when an auxiliary file has a
+// format version its reader does not know, it was written by a newer
+// build.
+type BackupAuxVersionError struct {
+	Name      string
+	Kind      string
+	Version   uint16
+	Supported uint16
+	Build     string
+}
+
+func (e *BackupAuxVersionError) Error() string {
+	return fmt.Sprintf("backup file %s is a %q file of version %d written by %q, this build reads up to version %d",
+		e.Name, e.Kind, e.Version, e.Build, e.Supported)
+}
+
+func IsBackupAuxVersionError(err error) bool {
+	var ve *BackupAuxVersionError
+	return errors.As(err, &ve)
+}
+
+func backupAuxBuild() string {
+	return version.Version + "-" + version.CommitID
+}
+
+// EncodeBackupAux prepends the header of kind, at its current version
+// and stamped with createdAt, to payload.
+func EncodeBackupAux(kind string, createdAt types.TS, payload []byte) ([]byte, error) {
+	ver, ok := backupAuxVersions[kind]
+	if !ok {
+		return nil, moerr.NewInternalErrorNoCtx("unknown backup file kind %q", kind)
+	}
+	build := backupAuxBuild()
+	var header bytes.Buffer
+	header.Write(types.EncodeUint16(&ver))
+	header.WriteByte(byte(len(kind)))
+	header.WriteString(kind)
+	header.Write(createdAt[:])
+	buildLen := uint16(len(build))
+	header.Write(types.EncodeUint16(&buildLen))
+	header.WriteString(build)
+
+	buf := make([]byte, 0, backupAuxFixedLen+header.Len()+len(payload))
+	buf = append(buf, backupAuxMagic[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(header.Len()))
+	buf = append(buf, header.Bytes()...)
+	return append(buf, payload...), nil
+}
+
+// DecodeBackupAux checks that buf, the content of the auxiliary file
+// name, is a file of kind at a version this build reads, and returns
+// its header and payload.
+func DecodeBackupAux(name, kind string, buf []byte) (*BackupAuxHeader, []byte, error) {
+	supported, ok := backupAuxVersions[kind]
+	if !ok {
+		return nil, nil, moerr.NewInternalErrorNoCtx("unknown backup file kind %q", kind)
+	}
+	malformed := func() error {
+		return moerr.NewInternalErrorNoCtx("backup file %s has no valid header", name)
+	}
+	if len(buf) < backupAuxFixedLen || !bytes.Equal(buf[:len(backupAuxMagic)], backupAuxMagic[:]) {
+		return nil, nil, malformed()
+	}
+	headerLen := int(binary.LittleEndian.Uint32(buf[len(backupAuxMagic):]))
+	if len(buf)-backupAuxFixedLen < headerLen {
+		return nil, nil, malformed()
+	}
+	fields := buf[backupAuxFixedLen : backupAuxFixedLen+headerLen]
+	payload := buf[backupAuxFixedLen+headerLen:]
+
+	header := &BackupAuxHeader{}
+	if len(fields) < 3 {
+		return nil, nil, malformed()
+	}
+	header.Version = binary.LittleEndian.Uint16(fields)
+	kindLen := int(fields[2])
+	fields = fields[3:]
+	if len(fields) < kindLen+types.TxnTsSize+2 {
+		return nil, nil, malformed()
+	}
+	header.Kind = string(fields[:kindLen])
+	fields = fields[kindLen:]
+	copy(header.CreatedAt[:], fields[:types.TxnTsSize])
+	fields = fields[types.TxnTsSize:]
+	buildLen := int(binary.LittleEndian.Uint16(fields))
+	fields = fields[2:]
+	if len(fields) < buildLen {
+		return nil, nil, malformed()
+	}
+	header.Build = string(fields[:buildLen])
+	// Whatever follows in fields was added by a newer build.
+
+	if header.Kind != kind {
+		return nil, nil, &BackupAuxKindError{Name: name, Want: kind, Got: header.Kind}
+	}
+	if header.Version == 0 || header.Version > supported {
+		return nil, nil, &BackupAuxVersionError{
+			Name:      name,
+			Kind:      kind,
+			Version:   header.Version,
+			Supported: supported,
+			Build:     header.Build,
+		}
+	}
+	return header, payload, nil
+}
+
+// writeBackupAux writes payload to the auxiliary file name of kind,
+// stamped with createdAt.
+func writeBackupAux(
+	ctx context.Context,
+	fs fileservice.FileService,
+	name, kind string,
+	createdAt types.TS,
+	payload []byte,
+) error {
+	buf, err := EncodeBackupAux(kind, createdAt, payload)
+	if err != nil {
+		return err
+	}
+	return writeBackupFile(ctx, fs, name, buf)
+}
+
+// auxWallClock returns the now the auxiliary files that hold the state
+// of a run, e.g. a journal or a spilled shard, are stamped with. They
+// are not part of the backup, unlike those of the rewrite, see
+// WithClock.
+func auxWallClock() types.TS {
+	return types.BuildTS(time.Now().UnixNano(), 0)
+}
+
+// WithClock stamps the auxiliary files the rewrite writes, and the hop
+// of the rewrite in the provenance of the checkpoint, with the time of
+// now. Without it they are stamped with the ts of the backup, so that a
+// rewrite run again writes the same bytes.
+func WithClock(now func() time.Time) BackupOption {
+	return func(o *backupOptions) {
+		o.clock = now
+	}
+}
+
+// rewrittenAt returns the time the rewrite is stamped with, see
+// WithClock. The ts of the backup is only known once it is resolved.
+func (o *backupOptions) rewrittenAt() time.Time {
+	if o.clock != nil {
+		return o.clock().UTC()
+	}
+	return time.Unix(0, o.result.EffectiveTS.Physical()).UTC()
+}
+
+// auxCreatedAt is rewrittenAt as the creation ts of an auxiliary file.
+func (o *backupOptions) auxCreatedAt() types.TS {
+	return types.BuildTS(o.rewrittenAt().UnixNano(), 0)
+}
+
+// readBackupAux returns the payload of the auxiliary file name of kind.
+func readBackupAux(ctx context.Context, fs fileservice.FileService, name, kind string) ([]byte, error) {
+	buf, err := readBackupFile(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	_, payload, err := DecodeBackupAux(name, kind, buf)
+	return payload, err
+}
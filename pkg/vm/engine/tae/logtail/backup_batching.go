@@ -0,0 +1,312 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/options"
+)
+
+// smallABlock is an aBlock with fewer rows than the batching threshold
+// of WithABlockBatching, its conversion is deferred until the small
+// aBlocks of its table are known.
+type smallABlock struct {
+	fileName   string
+	objectData *fileData
+	dataBlocks []*blockData
+}
+
+func (b *smallABlock) rows() int {
+	return b.dataBlocks[0].data.Vecs[0].Length()
+}
+
+// isSmallABlock tells whether the aBlock of dataBlocks is converted in
+// a batch rather than on its own.
+func (o *backupOptions) isSmallABlock(dataBlocks []*blockData) bool {
+	return o.batchRows > 0 && dataBlocks[0].data != nil &&
+		dataBlocks[0].data.Vecs[0].Length() < o.batchRows
+}
+
+// batchSmallABlocks splits the small aBlocks of each table into the
+// batches converted together, in the order of their source objects so
+// that a resumed session forms the same batches. A batch is at most a
+// block of rows, and its aBlocks have the same columns and sort key.
+func batchSmallABlocks(small map[uint64][]*smallABlock) [][]*smallABlock {
+	tids := make([]uint64, 0, len(small))
+	for tid := range small {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool {
+		return tids[i] < tids[j]
+	})
+	batches := make([][]*smallABlock, 0)
+	for _, tid := range tids {
+		blocks := small[tid]
+		sort.Slice(blocks, func(i, j int) bool {
+			return blocks[i].fileName < blocks[j].fileName
+		})
+		var current []*smallABlock
+		rows := 0
+		for _, block := range blocks {
+			if len(current) > 0 && (rows+block.rows() > int(options.DefaultBlockMaxRows) ||
+				!sameColumns(current[0], block)) {
+				batches = append(batches, current)
+				current, rows = nil, 0
+			}
+			current = append(current, block)
+			rows += block.rows()
+		}
+		if len(current) > 0 {
+			batches = append(batches, current)
+		}
+	}
+	return batches
+}
+
+func sameColumns(a, b *smallABlock) bool {
+	x, y := a.dataBlocks[0], b.dataBlocks[0]
+	if x.sortKey != y.sortKey || len(x.data.Vecs) != len(y.data.Vecs) {
+		return false
+	}
+	for i := range x.data.Vecs {
+		if *x.data.Vecs[i].GetType() != *y.data.Vecs[i].GetType() {
+			return false
+		}
+	}
+	return true
+}
+
+// convertABlocks converts the aBlocks of blocks, of one table, to the
+// single object the first of them would be converted to on its own.
+// The deletes of each aBlock are applied before its rows are merged,
+// the merged rows are then sorted and written as one aBlock is.
+func convertABlocks(
+	ctx context.Context,
+	fs, dstFs fileservice.FileService,
+	session *BackupSession,
+	o *backupOptions,
+	blocks []*smallABlock,
+	pool *containers.VectorPool,
+) (*writtenObject, error) {
+	leader := blocks[0].dataBlocks[0]
+	defer func() {
+		for _, block := range blocks {
+			if tombstone := block.dataBlocks[0].tombstone; tombstone != nil && tombstone.users > 0 {
+				tombstone.release()
+			}
+		}
+	}()
+	name := o.convertedName(leader.location.Name())
+	// The object of a batch is named after its first aBlock, the object
+	// of that name in dstFs may hold it alone or with other aBlocks, it
+	// is only reused when it is not a batch.
+	reuse := o.skipExisting && len(blocks) == 1
+	return o.convertObject(ctx, session, dstFs, leader.location.Name(), name, reuse, func() (*writtenObject, error) {
+		for _, block := range blocks {
+			aBlock, tombstone, blockID, err := splitABlock(ctx, block.dataBlocks)
+			if err != nil {
+				return nil, err
+			}
+			if err = o.applyABlockDeletes(aBlock, tombstone, blockID); err != nil {
+				return nil, err
+			}
+		}
+		merged, err := o.mergeABlocks(blocks)
+		if err != nil {
+			return nil, err
+		}
+		sorted, err := o.sortABlock(ctx, fs, leader.location, &leader.sortKey, leader.tid, merged, pool)
+		if err != nil {
+			return nil, err
+		}
+		result := batch.NewWithSize(len(sorted.Vecs) - 3)
+		for i := range result.Vecs {
+			result.Vecs[i] = sorted.Vecs[i]
+		}
+		result.SetRowCount(result.Vecs[0].Length())
+		leader.data = result
+		projected, sortKey, err := o.project(leader.tid, result, 0, leader.sortKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = o.exportBlock(ctx, leader.tid, name, projected); err != nil {
+			return nil, err
+		}
+		o.log().Info("[ReWrite Checkpoint]", common.OperationField("batch aBlocks"),
+			common.AnyField("object", name.String()),
+			common.AnyField("aBlocks", len(blocks)),
+			common.AnyField("rows", result.RowCount()))
+		return o.writeConverted(ctx, dstFs, name, projected, sortKey)
+	})
+}
+
+// mergeABlocks appends the rows of the aBlocks of blocks to a copy of
+// the first and frees the others, as sortColumns frees what it sorts.
+func (o *backupOptions) mergeABlocks(blocks []*smallABlock) (*batch.Batch, error) {
+	first := blocks[0].dataBlocks[0].data
+	merged := batch.NewWithSize(len(first.Vecs))
+	merged.Attrs = first.Attrs
+	for i, vec := range first.Vecs {
+		cloned, err := vec.CloneWindow(0, vec.Length(), o.cnAllocator)
+		if err != nil {
+			merged.Clean(o.cnAllocator)
+			return nil, err
+		}
+		merged.Vecs[i] = cloned
+	}
+	for _, block := range blocks[1:] {
+		data := block.dataBlocks[0].data
+		for i, vec := range data.Vecs {
+			if err := merged.Vecs[i].UnionBatch(vec, 0, vec.Length(), nil, o.cnAllocator); err != nil {
+				merged.Clean(o.cnAllocator)
+				return nil, err
+			}
+		}
+	}
+	merged.SetRowCount(merged.Vecs[0].Length())
+	for _, block := range blocks {
+		for _, vec := range block.dataBlocks[0].data.Vecs {
+			vec.Free(common.CheckpointAllocator)
+		}
+		block.dataBlocks[0].data = nil
+	}
+	return merged, nil
+}
+
+// relocateABlocks records the blocks of the aBlocks of blocks as
+// converted to the block of the object name.
+func (o *backupOptions) relocateABlocks(blocks []*smallABlock, name objectio.ObjectName) {
+	if !o.mapBlockIDs {
+		return
+	}
+	for _, block := range blocks {
+		aBlock := block.dataBlocks[0]
+		source := aBlock.blockId
+		if source.IsEmpty() {
+			source = *objectio.BuildObjectBlockid(aBlock.location.Name(), aBlock.location.ID())
+		}
+		o.result.RelocatedBlocks = append(o.result.RelocatedBlocks, RelocatedBlock{
+			Table:     aBlock.tid,
+			Source:    source,
+			Converted: *objectio.BuildObjectBlockid(name, 0),
+		})
+	}
+}
+
+// releaseSmallABlocks drops the small aBlocks phase 4 deferred without
+// converting them.
+func releaseSmallABlocks(small map[uint64][]*smallABlock) {
+	for _, blocks := range small {
+		for _, block := range blocks {
+			if tombstone := block.dataBlocks[0].tombstone; tombstone != nil && tombstone.users > 0 {
+				tombstone.release()
+			}
+		}
+	}
+}
+
+// convertSmallABlocks converts the small aBlocks phase 4 deferred, a
+// batch at a time, and records them as convertABlock does one aBlock.
+// The first aBlock of a batch has the converted object in its place,
+// the others are merged into it.
+func convertSmallABlocks(
+	ctx context.Context,
+	fs, dstFs fileservice.FileService,
+	session *BackupSession,
+	o *backupOptions,
+	small map[uint64][]*smallABlock,
+	pool *containers.VectorPool,
+	outputSizes map[string]int64,
+	outputTables map[string]uint64,
+	insertBatch map[uint64]*iBlocks,
+	insertObjBatch map[uint64]*iObjects,
+) error {
+	files := &o.result.Files
+	for _, blocks := range batchSmallABlocks(small) {
+		var written *writtenObject
+		err := session.attemptOnce(ctx, blocks[0].fileName, func(ctx context.Context) (err error) {
+			written, err = convertABlocks(ctx, fs, dstFs, session, o, blocks, pool)
+			return
+		})
+		if o.skipped(err) {
+			// The checkpoint keeps the aBlocks of the batch unconverted.
+			reason := o.result.Skipped[len(o.result.Skipped)-1].Reason
+			for _, block := range blocks[1:] {
+				o.result.Skipped = append(o.result.Skipped, SkippedObject{
+					Name:   block.fileName,
+					Reason: reason,
+				})
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		tid := blocks[0].dataBlocks[0].tid
+		name := written.name
+		files.Converted = append(files.Converted, name.String())
+		o.countObject(StatConverted, tid)
+		o.stats.Phase(StatsPhaseRewrite).Add(StatBatchedABlocks, int64(len(blocks)-1))
+		for _, block := range blocks {
+			delete(outputSizes, block.fileName)
+			o.recordConverted(block.fileName, name.String())
+		}
+		outputSizes[name.String()] = written.size()
+		outputTables[name.String()] = tid
+		o.relocateABlocks(blocks, name)
+
+		blockLocation := written.location(0)
+		ib := &insertBlock{
+			location: blockLocation,
+			blockId:  *objectio.BuildObjectBlockid(name, 0),
+			apply:    false,
+		}
+		if leader := blocks[0].dataBlocks[0]; len(leader.deleteRow) > 0 {
+			ib.deleteRow = leader.deleteRow[0]
+		}
+		addInsertBlock(insertBatch, tid, ib)
+
+		for i, block := range blocks {
+			obj := block.objectData.obj
+			if obj == nil {
+				continue
+			}
+			if i == 0 {
+				stats := written.stats
+				obj.stats = &stats
+			}
+			if insertObjBatch[obj.tid] == nil {
+				insertObjBatch[obj.tid] = &iObjects{
+					rowObjects: make([]*insertObjects, 0),
+				}
+			}
+			insertObjBatch[obj.tid].rowObjects = append(insertObjBatch[obj.tid].rowObjects, &insertObjects{
+				location: blockLocation,
+				apply:    false,
+				obj:      obj,
+				merged:   i > 0,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"go.uber.org/zap"
+)
+
+// ObjectSkippedError is returned for an object a best effort session
+// gave up on. It is not a failure: the backup goes on without the
+// object and is partial.
+type ObjectSkippedError struct {
+	Name string
+	Err  error
+}
+
+func (e *ObjectSkippedError) Error() string {
+	return fmt.Sprintf("object %s skipped: %v", e.Name, e.Err)
+}
+
+func (e *ObjectSkippedError) Unwrap() error {
+	return e.Err
+}
+
+func IsObjectSkipped(err error) bool {
+	var se *ObjectSkippedError
+	return errors.As(err, &se)
+}
+
+// SkippedObject is an object left out of a partial backup.
+type SkippedObject struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// Dropped is set for an object the rewritten checkpoint no longer
+	// references: it needed trimming, and is not kept untrimmed.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// BestEffort is the policy of a best effort backup, one that never
+// hangs on a single object. An object that cannot be read or written
+// within Timeout, after Retries retries, is skipped and the backup goes
+// on, partial. The deadline is passed down with the context, the file
+// service gives up when it expires. Only the deadline and a transient
+// IO error skip an object, any other error fails the backup as it does
+// a strict one.
+//
+// The sessions of one backup share its BestEffort, which lists every
+// object any of them skipped.
+type BestEffort struct {
+	Timeout time.Duration
+	Retries int
+
+	mu      sync.Mutex
+	skipped map[string]string
+}
+
+func NewBestEffort(timeout time.Duration, retries int) *BestEffort {
+	return &BestEffort{
+		Timeout: timeout,
+		Retries: retries,
+		skipped: make(map[string]string),
+	}
+}
+
+// WithBestEffort makes the session skip the objects b gives up on
+// instead of failing, the session is strict otherwise.
+func WithBestEffort(b *BestEffort) SessionOption {
+	return func(s *BackupSession) {
+		s.bestEffort = b
+	}
+}
+
+// Partial reports whether an object was skipped.
+func (b *BestEffort) Partial() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.skipped) > 0
+}
+
+// Skipped returns the skipped objects by name.
+func (b *BestEffort) Skipped() []SkippedObject {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	skipped := make([]SkippedObject, 0, len(b.skipped))
+	for name, reason := range b.skipped {
+		skipped = append(skipped, SkippedObject{Name: name, Reason: reason})
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].Name < skipped[j].Name
+	})
+	return skipped
+}
+
+// skip records that name is skipped for err. An object skipped twice,
+// e.g. by the copy and by the rewrite, keeps its first reason.
+func (b *BestEffort) skip(logger *zap.Logger, name string, err error) *ObjectSkippedError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.skipped[name]; !ok {
+		b.skipped[name] = err.Error()
+	}
+	logger.Warn("[BestEffort]", common.OperationField("skip object"),
+		common.AnyField("object", name),
+		common.AnyField("error", err))
+	return &ObjectSkippedError{Name: name, Err: err}
+}
+
+// attempt runs fn for the object name, up to retries times more while
+// it fails with a transient error, each run within the deadline of b.
+// Any other error is returned as it is, e.g. a missing object, what it
+// means is up to the caller, or a session that stops for its quota.
+// Once the backup itself is cancelled, its error is returned. What it
+// logs goes to logger.
+func (b *BestEffort) attempt(
+	ctx context.Context,
+	logger *zap.Logger,
+	name string,
+	retries int,
+	fn func(ctx context.Context) error,
+) error {
+	var err error
+	for i := 0; i <= retries; i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = b.try(ctx, fn); err == nil || !transient(err) {
+			return err
+		}
+		logger.Warn("[BestEffort]", common.OperationField("attempt failed"),
+			common.AnyField("object", name),
+			common.AnyField("attempt", i+1),
+			common.AnyField("error", err))
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return b.skip(logger, name, err)
+}
+
+// transient reports whether err may go away on retry: the deadline of
+// the attempt expired, or the IO failed in a way the file service
+// retries. An object is never skipped for a corruption or a bug.
+func transient(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || fileservice.IsRetryableError(err)
+}
+
+func (b *BestEffort) try(ctx context.Context, fn func(ctx context.Context) error) error {
+	if b.Timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.Timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// Attempt runs fn for the object name. A strict session just runs it, a
+// best effort one retries it and returns an ObjectSkippedError when it
+// gives up. fn must be safe to run again after it failed.
+func (s *BackupSession) Attempt(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if s == nil || s.bestEffort == nil {
+		return fn(ctx)
+	}
+	return s.bestEffort.attempt(ctx, s.logFor(ctx), name, s.bestEffort.Retries, fn)
+}
+
+// attemptOnce is Attempt for an fn that cannot run again, it is given a
+// single deadline and no retry.
+func (s *BackupSession) attemptOnce(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if s == nil || s.bestEffort == nil {
+		return fn(ctx)
+	}
+	return s.bestEffort.attempt(ctx, s.logFor(ctx), name, 0, fn)
+}
+
+// skipped reports whether err is an ObjectSkippedError, and records the
+// skipped object in the result of the rewrite.
+func (o *backupOptions) skipped(err error) bool {
+	var se *ObjectSkippedError
+	if !errors.As(err, &se) {
+		return false
+	}
+	o.result.Partial = true
+	o.result.Skipped = append(o.result.Skipped, SkippedObject{
+		Name:   se.Name,
+		Reason: se.Err.Error(),
+	})
+	return true
+}
+
+// dropSkipped drops the skipped object name from the rewritten
+// checkpoint, as dropCollected does a collected one, and reports it
+// in the result. The object needed trimming, keeping it as it is would
+// put the rows committed after the ts of the backup in the backup.
+func (o *backupOptions) dropSkipped(name string) {
+	if o.skippedDrops == nil {
+		o.skippedDrops = make(map[string]struct{})
+	}
+	o.skippedDrops[name] = struct{}{}
+	for i := range o.result.Skipped {
+		if o.result.Skipped[i].Name == name {
+			o.result.Skipped[i].Dropped = true
+		}
+	}
+	o.log().Warn("[ReWrite Checkpoint]", common.OperationField("drop skipped object"),
+		common.AnyField("object", name))
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BlockMetaSource is the checkpoint batch a block meta row is in.
+type BlockMetaSource uint16
+
+const (
+	// BlockMetaInsert rows are in BLKMetaInsert, the blocks of the TN
+	// with their tombstone.
+	BlockMetaInsert BlockMetaSource = BlockMetaSource(BLKMetaInsertIDX)
+	// BlockMetaCN rows are in BLKCNMetaInsert, the blocks written by a
+	// CN, soft deleted once their object is listed.
+	BlockMetaCN BlockMetaSource = BlockMetaSource(BLKCNMetaInsertIDX)
+)
+
+func (s BlockMetaSource) String() string {
+	switch s {
+	case BlockMetaInsert:
+		return "BLKMetaInsert"
+	case BlockMetaCN:
+		return "BLKCNMetaInsert"
+	}
+	return "unknown"
+}
+
+// blockMetaSources are the block meta batches in the order they are
+// walked.
+var blockMetaSources = []struct {
+	source  BlockMetaSource
+	metaIdx int
+}{
+	{BlockMetaInsert, BlockInsert},
+	{BlockMetaCN, CNBlockInsert},
+}
+
+// blockMetaColumns are the columns of a block meta batch, a column a
+// walk does not read is nil.
+type blockMetaColumns struct {
+	id         *vector.Vector
+	metaLoc    *vector.Vector
+	deltaLoc   *vector.Vector
+	entryState *vector.Vector
+	sorted     *vector.Vector
+	commitTs   *vector.Vector
+	// tids are those of the rows, from BLKMetaInsertTxn or the table
+	// ranges of the checkpoint meta.
+	tids []uint64
+}
+
+// BlockMetaView is a row of a block meta batch of a checkpoint, see
+// CheckpointData.ForEachBlockMeta. The locations it returns point into
+// the checkpoint and are only valid until the data is closed.
+type BlockMetaView struct {
+	source BlockMetaSource
+	row    int
+	// base numbers the rows of a batch read in several blocks.
+	base int
+	cols *blockMetaColumns
+}
+
+// Source is the batch of the row.
+func (v BlockMetaView) Source() BlockMetaSource {
+	return v.source
+}
+
+// Row is the row in its batch.
+func (v BlockMetaView) Row() int {
+	return v.base + v.row
+}
+
+func (v BlockMetaView) Blockid() types.Blockid {
+	return vector.GetFixedAt[types.Blockid](v.cols.id, v.row)
+}
+
+func (v BlockMetaView) MetaLoc() objectio.Location {
+	return blockMetaLocation(v.cols.metaLoc, v.row)
+}
+
+func (v BlockMetaView) DeltaLoc() objectio.Location {
+	return blockMetaLocation(v.cols.deltaLoc, v.row)
+}
+
+// EntryState tells whether the block is that of an aBlock.
+func (v BlockMetaView) EntryState() bool {
+	return vector.GetFixedAt[bool](v.cols.entryState, v.row)
+}
+
+func (v BlockMetaView) Sorted() bool {
+	return vector.GetFixedAt[bool](v.cols.sorted, v.row)
+}
+
+func (v BlockMetaView) CommitTs() types.TS {
+	return vector.GetFixedAt[types.TS](v.cols.commitTs, v.row)
+}
+
+// TID is the table of the block, 0 for a row of BLKCNMetaInsert not in
+// the range of a table.
+func (v BlockMetaView) TID() uint64 {
+	if v.row >= len(v.cols.tids) {
+		return 0
+	}
+	return v.cols.tids[v.row]
+}
+
+func blockMetaLocation(vec *vector.Vector, row int) objectio.Location {
+	if vec.IsNull(uint64(row)) {
+		return nil
+	}
+	return objectio.Location(vec.GetBytesAt(row))
+}
+
+// ForEachBlockMeta calls fn with every row of the block meta batches of
+// data, those of BLKMetaInsert first. It stops at the first error fn
+// returns. fn must not change the batches.
+func (data *CheckpointData) ForEachBlockMeta(fn func(BlockMetaView) error) error {
+	for _, batch := range blockMetaSources {
+		bat := data.bats[batch.source]
+		cols := &blockMetaColumns{
+			id:         bat.GetVectorByName(catalog.BlockMeta_ID).GetDownstreamVector(),
+			metaLoc:    bat.GetVectorByName(catalog.BlockMeta_MetaLoc).GetDownstreamVector(),
+			deltaLoc:   bat.GetVectorByName(catalog.BlockMeta_DeltaLoc).GetDownstreamVector(),
+			entryState: bat.GetVectorByName(catalog.BlockMeta_EntryState).GetDownstreamVector(),
+			sorted:     bat.GetVectorByName(catalog.BlockMeta_Sorted).GetDownstreamVector(),
+			commitTs:   bat.GetVectorByName(catalog.BlockMeta_CommitTs).GetDownstreamVector(),
+			tids:       data.blockMetaTids(batch.source, batch.metaIdx, bat.Length()),
+		}
+		for i := 0; i < bat.Length(); i++ {
+			if err := fn(BlockMetaView{source: batch.source, row: i, cols: cols}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockMetaTids returns the tables of the rows rows of the block meta
+// batch source. BLKCNMetaInsert has no txn batch, its rows are found in
+// the table ranges metaIdx of the checkpoint meta.
+func (data *CheckpointData) blockMetaTids(source BlockMetaSource, metaIdx int, rows int) []uint64 {
+	tids := make([]uint64, rows)
+	if source == BlockMetaInsert {
+		txn := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID).GetDownstreamVector()
+		copy(tids, vector.MustFixedCol[uint64](txn))
+		return tids
+	}
+	fill := func(tid, start, end uint64) {
+		for row := start; row < end && row < uint64(rows); row++ {
+			tids[row] = tid
+		}
+	}
+	for tid, meta := range data.meta {
+		table := meta.tables[metaIdx]
+		if source == BlockMetaCN && (table == nil || table.End <= table.Start && len(table.locations) == 0) {
+			// A checkpoint read back has the ranges of BLKCNMetaInsert
+			// in those of BlockDelete, the two are written alike.
+			table = meta.tables[BlockDelete]
+		}
+		if table == nil {
+			continue
+		}
+		if table.End > table.Start {
+			fill(tid, table.Start, table.End)
+			continue
+		}
+		// The ranges of a checkpoint not formatted are still in the
+		// locations of its blocks.
+		it := table.locations.MakeIterator()
+		for it.HasNext() {
+			block := it.Next()
+			fill(tid, block.GetStartOffset(), block.GetEndOffset())
+		}
+	}
+	return tids
+}
+
+// forEachScanBlockMeta calls fn with every block meta row of batches,
+// the scanColumns of a checkpoint read a block at a time. The rows of a
+// batch read in several blocks are numbered in the order the blocks
+// were read, from rows, which counts them. Only the columns of
+// scanColumns can be read from the views.
+func forEachScanBlockMeta(batches []scanBatch, rows map[uint16]int, fn func(BlockMetaView) error) error {
+	for _, batch := range blockMetaSources {
+		for _, scan := range batches {
+			if scan.idx != uint16(batch.source) {
+				continue
+			}
+			cols := &blockMetaColumns{
+				id:       scan.cols[catalog.BlockMeta_ID],
+				metaLoc:  scan.cols[catalog.BlockMeta_MetaLoc],
+				deltaLoc: scan.cols[catalog.BlockMeta_DeltaLoc],
+				commitTs: scan.cols[catalog.BlockMeta_CommitTs],
+			}
+			for i := 0; i < scan.rows; i++ {
+				view := BlockMetaView{source: batch.source, row: i, base: rows[scan.idx], cols: cols}
+				if err := fn(view); err != nil {
+					return err
+				}
+			}
+			rows[scan.idx] += scan.rows
+		}
+	}
+	return nil
+}
+
+// deleteBlockMetaRows deletes the rows drop lists by source from the
+// block meta batches of data, and their txn rows. It returns the number
+// of rows deleted.
+func (data *CheckpointData) deleteBlockMetaRows(drop map[BlockMetaSource][]int) int {
+	deleted := 0
+	for _, batch := range blockMetaSources {
+		rows := drop[batch.source]
+		if len(rows) == 0 {
+			continue
+		}
+		bat := data.bats[batch.source]
+		for _, row := range rows {
+			bat.Delete(row)
+			if batch.source == BlockMetaInsert {
+				data.bats[BLKMetaInsertTxnIDX].Delete(row)
+			}
+		}
+		bat.Compact()
+		if batch.source == BlockMetaInsert {
+			data.bats[BLKMetaInsertTxnIDX].Compact()
+		}
+		data.shrinkTableMeta(batch.metaIdx, rows)
+		deleted += len(rows)
+	}
+	return deleted
+}
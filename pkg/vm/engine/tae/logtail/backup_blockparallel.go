@@ -0,0 +1,128 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// WithBlockParallelism prepares the blocks of an object the rewrite
+// writes again, the projection of the data blocks and the sort of the
+// tombstone blocks, with up to workers goroutines, GOMAXPROCS if workers
+// is not positive. The blocks are still written in order by a single
+// writer, as each is ready, so that the sort of the next blocks overlaps
+// with the write of the previous ones. The blocks are loaded and trimmed
+// before, in the trim phase.
+func WithBlockParallelism(workers int) BackupOption {
+	return func(o *backupOptions) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		o.blockWorkers = workers
+	}
+}
+
+// prepareBlock returns the batch block is written with and its sort
+// key, math.MaxUint16 for none.
+func (o *backupOptions) prepareBlock(block *blockData) (*batch.Batch, uint16, error) {
+	switch block.blockType {
+	case objectio.SchemaData:
+		return o.project(block.tid, block.data, appendableMetaColumns, block.sortKey)
+	case objectio.SchemaTombstone:
+		if !o.unorderedTombstones {
+			if err := sortTombstone(block.data, block.location, o.cnAllocator); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return block.data, block.sortKey, nil
+}
+
+type preparedBlock struct {
+	data    *batch.Batch
+	sortKey uint16
+	err     error
+}
+
+// blockPreparer prepares the blocks of an object ahead of the writer,
+// in parallel with WithBlockParallelism.
+type blockPreparer struct {
+	o      *backupOptions
+	blocks []*blockData
+	// ready has the block i once it is prepared, nil when the blocks
+	// are prepared by the writer itself.
+	ready []chan preparedBlock
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// prepareBlocks starts preparing blocks, get returns them in order.
+// close must be called before the blocks are released.
+func (o *backupOptions) prepareBlocks(blocks []*blockData) *blockPreparer {
+	p := &blockPreparer{o: o, blocks: blocks}
+	if o.blockWorkers < 2 || len(blocks) < 2 {
+		return p
+	}
+	p.ready = make([]chan preparedBlock, len(blocks))
+	for i := range p.ready {
+		p.ready[i] = make(chan preparedBlock, 1)
+	}
+	p.stop = make(chan struct{})
+	// The slots bound the blocks being prepared, the first blocks are
+	// started first so that the writer waits the least.
+	slots := make(chan struct{}, o.blockWorkers)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for i, block := range blocks {
+			select {
+			case slots <- struct{}{}:
+			case <-p.stop:
+				return
+			}
+			p.wg.Add(1)
+			go func(i int, block *blockData) {
+				defer p.wg.Done()
+				defer func() { <-slots }()
+				data, sortKey, err := o.prepareBlock(block)
+				p.ready[i] <- preparedBlock{data: data, sortKey: sortKey, err: err}
+			}(i, block)
+		}
+	}()
+	return p
+}
+
+// get returns the prepared block i.
+func (p *blockPreparer) get(i int) (*batch.Batch, uint16, error) {
+	if p.ready == nil {
+		return p.o.prepareBlock(p.blocks[i])
+	}
+	prepared := <-p.ready[i]
+	return prepared.data, prepared.sortKey, prepared.err
+}
+
+// close stops preparing the blocks the writer did not get and waits for
+// those being prepared.
+func (p *blockPreparer) close() {
+	if p.ready == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// SizeMismatch is an object of a backup whose size is not the one its
+// CheckpointFooter lists.
+type SizeMismatch struct {
+	Name     string
+	Expected int64
+	Actual   int64
+}
+
+// BackupCheck is the result of VerifyBackup.
+type BackupCheck struct {
+	// Checked is the number of objects of the footer checked.
+	Checked int
+	// Missing are the objects the footer lists that are not in the
+	// backup, sorted.
+	Missing []string
+	// Mismatched are the objects whose size differs from the footer,
+	// sorted by name.
+	Mismatched []SizeMismatch
+}
+
+func (c *BackupCheck) OK() bool {
+	return len(c.Missing) == 0 && len(c.Mismatched) == 0
+}
+
+// VerifyProgress is called by VerifyBackup after each object with the
+// number of objects checked so far and the number to check. The calls
+// are never concurrent.
+type VerifyProgress func(checked, total int)
+
+type verifyBackupOptions struct {
+	concurrency int
+	progress    VerifyProgress
+}
+
+type VerifyBackupOption func(*verifyBackupOptions)
+
+// WithVerifyConcurrency checks up to n objects at a time, one by
+// default. The result does not depend on n.
+func WithVerifyConcurrency(n int) VerifyBackupOption {
+	return func(o *verifyBackupOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithVerifyProgress reports the progress of VerifyBackup to progress.
+func WithVerifyProgress(progress VerifyProgress) VerifyBackupOption {
+	return func(o *verifyBackupOptions) {
+		o.progress = progress
+	}
+}
+
+// VerifyBackup checks that every object the CheckpointFooter
+// manifestName lists is in fs, with the size the footer gives it when
+// it gives one. Only the files are stat'ed, their content is not read.
+// Missing and mismatched objects are collected in the check, the error
+// is for the footer or a stat that fails for another reason, and stops
+// the objects not checked yet.
+func VerifyBackup(
+	ctx context.Context,
+	fs fileservice.FileService,
+	manifestName string,
+	opts ...VerifyBackupOption,
+) (*BackupCheck, error) {
+	options := &verifyBackupOptions{concurrency: 1}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.concurrency < 1 {
+		options.concurrency = 1
+	}
+	buf, err := readBackupFile(ctx, fs, manifestName)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := DecodeCheckpointFooter(manifestName, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := make(chan FooterObject)
+	check := &BackupCheck{}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < options.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range objects {
+				entry, err := fs.StatFile(ctx, object.Name)
+				mu.Lock()
+				switch {
+				case moerr.IsMoErrCode(err, moerr.ErrFileNotFound):
+					check.Missing = append(check.Missing, object.Name)
+				case err != nil:
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+					continue
+				case object.Size > 0 && entry.Size != object.Size:
+					check.Mismatched = append(check.Mismatched, SizeMismatch{
+						Name:     object.Name,
+						Expected: object.Size,
+						Actual:   entry.Size,
+					})
+				}
+				check.Checked++
+				if options.progress != nil {
+					options.progress(check.Checked, len(footer.Objects))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, object := range footer.Objects {
+		select {
+		case objects <- object:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(objects)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(check.Missing)
+	sort.Slice(check.Mismatched, func(i, j int) bool {
+		return check.Mismatched[i].Name < check.Mismatched[j].Name
+	})
+	return check, nil
+}
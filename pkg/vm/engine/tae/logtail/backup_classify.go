@@ -0,0 +1,96 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BlockClassification counts the blocks of a checkpoint by state. The
+// object entries count their blocks, the block entries count the
+// distinct blocks they name.
+type BlockClassification struct {
+	// LiveNBlocks are the blocks of the non-appendable objects that are
+	// not deleted.
+	LiveNBlocks int
+	// LiveABlocks are the blocks of the appendable objects that are not
+	// deleted. A checkpoint only lists flushed objects, so it is zero
+	// unless the checkpoint is broken.
+	LiveABlocks int
+	// DeletedBlocks are the blocks of the objects that are deleted.
+	DeletedBlocks int
+	// TombstonedBlocks are the blocks that have a delta location.
+	TombstonedBlocks int
+	// SoftDeletedBlocks are the blocks that CN wrote that have a meta
+	// location, the backup soft deletes their objects.
+	SoftDeletedBlocks int
+}
+
+// ClassifyBlocks loads the checkpoint at location and counts its blocks
+// by state, the way LoadCheckpointEntriesFromKey reads the entries.
+func ClassifyBlocks(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+) (*BlockClassification, error) {
+	data, err := getCheckpointData(ctx, sid, fs, location, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	return classifyBlocks(data), nil
+}
+
+func classifyBlocks(data *CheckpointData) *BlockClassification {
+	classification := &BlockClassification{}
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		deletedAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		appendable := objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool)
+		blocks := int(stats.BlkCnt())
+		switch {
+		case !deletedAt.IsEmpty():
+			classification.DeletedBlocks += blocks
+		case appendable:
+			classification.LiveABlocks += blocks
+		default:
+			classification.LiveNBlocks += blocks
+		}
+	}
+
+	tombstoned := make(map[types.Blockid]struct{})
+	softDeleted := make(map[types.Blockid]struct{})
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		blkID := view.Blockid()
+		if !view.DeltaLoc().IsEmpty() {
+			tombstoned[blkID] = struct{}{}
+		}
+		if view.Source() == BlockMetaCN && !view.MetaLoc().IsEmpty() {
+			softDeleted[blkID] = struct{}{}
+		}
+		return nil
+	})
+	classification.TombstonedBlocks = len(tombstoned)
+	classification.SoftDeletedBlocks = len(softDeleted)
+	return classification
+}
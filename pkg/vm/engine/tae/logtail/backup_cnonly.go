@@ -0,0 +1,75 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// CNOnlyBackupError is returned when a checkpoint written WithCNOnly is
+// used where the TN side of the checkpoint is needed: a full restore,
+// or a rewrite or an incremental checkpoint that is not CN only itself.
+type CNOnlyBackupError struct {
+	Checkpoint string
+	// Use is what the checkpoint was refused for.
+	Use string
+}
+
+func (e *CNOnlyBackupError) Error() string {
+	return fmt.Sprintf("checkpoint %s is CN only, it cannot be used for %s", e.Checkpoint, e.Use)
+}
+
+func IsCNOnlyBackup(err error) bool {
+	var ce *CNOnlyBackupError
+	return errors.As(err, &ce)
+}
+
+// WithCNOnly writes the checkpoint without its TN meta, for backups
+// that are only ever restored to CNs. The rewrite returns an empty TN
+// location, and the provenance and the footer of the checkpoint mark it
+// CN only, so that it is refused where the TN side is needed. A CN only
+// checkpoint can only be rewritten CN only again.
+func WithCNOnly() BackupOption {
+	return func(o *backupOptions) {
+		o.cnOnly = true
+	}
+}
+
+// checkCNOnlySource refuses to rewrite the CN only checkpoint of
+// provenance, at checkpoint, into one that is not.
+func (o *backupOptions) checkCNOnlySource(checkpoint string, provenance *CheckpointProvenance) error {
+	if o.cnOnly || !provenance.IsCNOnly() {
+		return nil
+	}
+	return &CNOnlyBackupError{Checkpoint: checkpoint, Use: "a rewrite with the TN side"}
+}
+
+// IsCNOnly reports whether the checkpoint of p was written WithCNOnly,
+// by the last rewrite or by any before it.
+func (p *CheckpointProvenance) IsCNOnly() bool {
+	return p != nil && p.CNOnly
+}
+
+// CheckFullRestore returns a CNOnlyBackupError if the backup of f has
+// no TN side to restore a whole cluster from.
+func (f *CheckpointFooter) CheckFullRestore() error {
+	if !f.CNOnly {
+		return nil
+	}
+	return &CNOnlyBackupError{Checkpoint: objectio.Location(f.Checkpoint).String(), Use: "a full-cluster restore"}
+}
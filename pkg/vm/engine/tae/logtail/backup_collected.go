@@ -0,0 +1,188 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithSkipCollectedObjects lets the rewrite go on without the source
+// objects that are gone, e.g. removed by a GC that ran after the
+// checkpoint was written, rather than failing on the first it reads.
+// Such an object is taken for soft-deleted: its object entries and the
+// block meta rows of its blocks, or of the deletes it holds, are
+// dropped from the rewritten checkpoint, and it is listed in
+// RewriteResult.Collected.
+//
+// The objects the checkpoint references are looked for before they are
+// analyzed, and an object removed while the rewrite trims it is skipped
+// the same. One removed after it was trimmed still fails the rewrite.
+// Without the option a missing object always does.
+func WithSkipCollectedObjects() BackupOption {
+	return func(o *backupOptions) {
+		o.skipCollected = true
+	}
+}
+
+// dropCollectedObjects records the objects data references by an object
+// entry or a block location that are not in fs, and drops their rows.
+// It returns the number of rows dropped.
+func (o *backupOptions) dropCollectedObjects(
+	ctx context.Context,
+	fs fileservice.FileService,
+	data *CheckpointData,
+) (int, error) {
+	if !o.skipCollected {
+		return 0, nil
+	}
+	names := make(map[string]struct{})
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			names[stats.ObjectName().String()] = struct{}{}
+		}
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		for _, location := range []objectio.Location{view.MetaLoc(), view.DeltaLoc()} {
+			if !location.IsEmpty() {
+				names[location.Name().String()] = struct{}{}
+			}
+		}
+		return nil
+	})
+	for name := range names {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		_, err := fs.StatFile(ctx, name)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			o.collect(name, err)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return o.dropCollected(data), nil
+}
+
+// collectedObject reports whether err, the error the object name failed
+// with, is that of an object that is gone and to be skipped, and
+// records it if so.
+func (o *backupOptions) collectedObject(name string, err error) bool {
+	if !o.skipCollected || !moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return false
+	}
+	o.collect(name, err)
+	return true
+}
+
+func (o *backupOptions) collect(name string, err error) {
+	if _, ok := o.collected[name]; ok {
+		return
+	}
+	if o.collected == nil {
+		o.collected = make(map[string]struct{})
+	}
+	o.collected[name] = struct{}{}
+	o.result.Collected = append(o.result.Collected, name)
+	sort.Strings(o.result.Collected)
+	o.log().Warn("[ReWrite Checkpoint]", common.OperationField("skip collected object"),
+		common.AnyField("object", name),
+		common.AnyField("error", err))
+	o.stats.Warn(BackupWarning{Code: WarnCollectedObject, Object: name, Detail: err.Error()})
+}
+
+// dropCollected drops the object entries of the objects recorded as
+// collected, or skipped by dropSkipped, and the block meta rows that
+// refer to them or to their blocks. It returns the number of rows
+// dropped, those of an earlier call are already gone.
+func (o *backupOptions) dropCollected(data *CheckpointData) int {
+	if len(o.collected) == 0 && len(o.skippedDrops) == 0 {
+		return 0
+	}
+	drops := func(name string) bool {
+		_, collected := o.collected[name]
+		_, skipped := o.skippedDrops[name]
+		return collected || skipped
+	}
+	dropped := 0
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		var rows []int
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			if drops(stats.ObjectName().String()) {
+				rows = append(rows, i)
+			}
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		for _, row := range rows {
+			bat.Delete(row)
+		}
+		bat.Compact()
+		if idx == ObjectInfoIDX {
+			data.shrinkTableMeta(ObjectInfo, rows)
+		}
+		dropped += len(rows)
+	}
+	drop := make(map[BlockMetaSource][]int)
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		// The rows of the blocks of a dropped object go with it, e.g.
+		// its deletes written to another object.
+		id := view.Blockid()
+		if drops(id.ObjectNameString()) {
+			drop[view.Source()] = append(drop[view.Source()], view.Row())
+			return nil
+		}
+		for _, location := range []objectio.Location{view.MetaLoc(), view.DeltaLoc()} {
+			if location.IsEmpty() {
+				continue
+			}
+			if drops(location.Name().String()) {
+				drop[view.Source()] = append(drop[view.Source()], view.Row())
+				break
+			}
+		}
+		return nil
+	})
+	dropped += data.deleteBlockMetaRows(drop)
+	return dropped
+}
+
+// unlinkObject forgets the tombstone blocks of the object name the
+// blocks of objectsData are linked to, once it is skipped.
+func unlinkObject(objectsData map[string]*fileData, name string) {
+	for _, objectData := range objectsData {
+		for _, block := range objectData.data {
+			if block.tombstone != nil && block.tombstone.location.Name().String() == name {
+				block.tombstone = nil
+			}
+		}
+	}
+}
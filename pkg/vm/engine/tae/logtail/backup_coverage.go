@@ -0,0 +1,73 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// WithCheckpointEnd stamps end as the end ts of the rewritten
+// checkpoint, the ts it covers the data up to, in
+// RewriteResult.CheckpointEnd and in the footer, for the checkpoint
+// entry a restore or the GC reads. An empty end is the ts of the
+// rewrite. The rewrite fails if end is before its ts, the rows up to
+// it are kept, or if the trim dropped rows committed up to end.
+func WithCheckpointEnd(end types.TS) BackupOption {
+	return func(o *backupOptions) {
+		o.stampEnd = true
+		o.checkpointEnd = end
+	}
+}
+
+// checkCheckpointEnd checks the end the checkpoint at location is
+// stamped with against ts, the ts of the rewrite, before the rewrite
+// loads anything.
+func (o *backupOptions) checkCheckpointEnd(location objectio.Location, ts types.TS) error {
+	if !o.stampEnd {
+		return nil
+	}
+	if o.checkpointEnd.IsEmpty() {
+		o.checkpointEnd = ts
+	}
+	if o.checkpointEnd.Less(&ts) {
+		return moerr.NewInvalidInputNoCtx("checkpoint %s rewritten as of %s cannot end at %s, before the rows it keeps",
+			location.String(), ts.ToString(), o.checkpointEnd.ToString())
+	}
+	return nil
+}
+
+// noteLate records commit, the commit ts of a row the trim drops.
+func (o *backupOptions) noteLate(commit types.TS) {
+	if o.firstLate.IsEmpty() || commit.Less(&o.firstLate) {
+		o.firstLate = commit
+	}
+}
+
+// stampCheckpointEnd checks the end the checkpoint at location is
+// stamped with against the rows the trim dropped and records it in the
+// result.
+func (o *backupOptions) stampCheckpointEnd(location objectio.Location) error {
+	if !o.stampEnd {
+		return nil
+	}
+	if !o.firstLate.IsEmpty() && !o.checkpointEnd.Less(&o.firstLate) {
+		return moerr.NewInvalidInputNoCtx("checkpoint %s cannot end at %s, the rewrite dropped rows committed at %s",
+			location.String(), o.checkpointEnd.ToString(), o.firstLate.ToString())
+	}
+	o.result.CheckpointEnd = o.checkpointEnd
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"slices"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+)
+
+// DeleteJoin is how the deletes of a tombstone are joined to the rows of
+// the aBlock they delete, see WithDeleteJoin.
+type DeleteJoin int
+
+const (
+	// DeleteJoinAuto hash joins the tombstones of fewer than
+	// MergeJoinDeletes deletes and merge joins the others.
+	DeleteJoinAuto DeleteJoin = iota
+	// DeleteJoinHash collects the deleted rows in a map and scans the
+	// rows of the block for them.
+	DeleteJoinHash
+	// DeleteJoinMerge sorts the deleted rows and merges them with the
+	// rows of the block, which are in order. It allocates a slice of
+	// the deletes and no map, and looks up the block of a run of
+	// deletes of one block once, which is what the tombstones written
+	// in rowid order are made of.
+	DeleteJoinMerge
+)
+
+// MergeJoinDeletes is the number of deletes from which DeleteJoinAuto
+// merge joins a tombstone.
+const MergeJoinDeletes = 4096
+
+// WithDeleteJoin joins the deletes of the aBlocks to their rows with
+// join, DeleteJoinAuto by default. The rows removed are the same
+// whatever the join.
+func WithDeleteJoin(join DeleteJoin) BackupOption {
+	return func(o *backupOptions) {
+		o.deleteJoin = join
+	}
+}
+
+// merge tells if the deletes rowids, nil if none, are merge joined.
+func (join DeleteJoin) merge(rowids *vector.Vector) bool {
+	switch join {
+	case DeleteJoinHash:
+		return false
+	case DeleteJoinMerge:
+		return true
+	default:
+		return rowids != nil && rowids.Length() >= MergeJoinDeletes
+	}
+}
+
+// mergeJoinDeletes is hashJoinDeletes merge joining the deletes.
+func mergeJoinDeletes(length int, rowids *vector.Vector, id string, filtered []int64) ([]int64, int, error) {
+	n := len(filtered)
+	if rowids != nil {
+		n += rowids.Length()
+	}
+	deleteRow := make([]int64, 0, n)
+	deleteRow = append(deleteRow, filtered...)
+	unmatched := 0
+	if rowids != nil {
+		var last types.Blockid
+		seen, match := false, false
+		for i := 0; i < rowids.Length(); i++ {
+			blockId, ro, err := decodeRowid(rowids.GetRawBytesAt(i))
+			if err != nil {
+				return nil, 0, err
+			}
+			if !seen || blockId != last {
+				last, seen, match = blockId, true, blockId.String() == id
+			}
+			if !match {
+				continue
+			}
+			if int(ro) >= length {
+				unmatched++
+				continue
+			}
+			deleteRow = append(deleteRow, int64(ro))
+		}
+	}
+	if !slices.IsSorted(deleteRow) {
+		slices.Sort(deleteRow)
+	}
+	deleteRow = slices.Compact(deleteRow)
+	// The filtered rows past the block are not rows of it either.
+	start, _ := slices.BinarySearch(deleteRow, 0)
+	end, _ := slices.BinarySearch(deleteRow, int64(length))
+	return deleteRow[start:end], unmatched, nil
+}
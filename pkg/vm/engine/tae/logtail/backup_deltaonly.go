@@ -0,0 +1,162 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+)
+
+// ABlockLocator returns the stats of the object of the aBlock blkID of
+// table tid, e.g. from the catalog or from the checkpoint that has the
+// entry of the object. nil leaves the aBlock as it is, see
+// WithMaterializeDeltaOnly.
+type ABlockLocator func(ctx context.Context, tid uint64, blkID types.Blockid) (*objectio.ObjectStats, error)
+
+// WithMaterializeDeltaOnly converts the delta-only aBlocks of the
+// checkpoint, the aBlocks it has deletes of but not the entry of their
+// object, as the other aBlocks are: the entry of the object locate
+// finds is added to the checkpoint, deleted as of the commit of the
+// deletes, and the aBlock is converted with the deletes applied.
+//
+// Without it a delta-only aBlock is carried forward: its tombstone is
+// trimmed and copied like that of an nBlock and its block meta row
+// keeps referencing the aBlock, whose data the backup does not have.
+// The delta-only aBlocks are listed in RewriteResult.DeltaOnlyBlocks
+// either way.
+func WithMaterializeDeltaOnly(locate ABlockLocator) BackupOption {
+	return func(o *backupOptions) {
+		o.locateABlock = locate
+	}
+}
+
+// deltaOnlyABlocks lists the delta-only aBlocks of data in the result
+// and, with WithMaterializeDeltaOnly, adds the entries of the objects
+// of those locate finds to data, before the objects of data are
+// collected.
+func (o *backupOptions) deltaOnlyABlocks(ctx context.Context, data *CheckpointData) error {
+	objects := make(map[string]struct{})
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		statsVec := data.bats[idx].GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < data.bats[idx].Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			objects[stats.ObjectName().String()] = struct{}{}
+		}
+	}
+	// The row of each delta-only aBlock, the last one if there are
+	// several.
+	rows := make(map[types.Blockid]BlockMetaView)
+	err := data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if view.Source() != BlockMetaInsert || !view.EntryState() {
+			return nil
+		}
+		blkID := view.Blockid()
+		if _, ok := objects[blkID.ObjectNameString()]; !ok {
+			rows[blkID] = view
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	blocks := make([]types.Blockid, 0, len(rows))
+	for blkID := range rows {
+		blocks = append(blocks, blkID)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i][:], blocks[j][:]) < 0
+	})
+	o.result.DeltaOnlyBlocks = make([]string, 0, len(blocks))
+	for i := range blocks {
+		o.result.DeltaOnlyBlocks = append(o.result.DeltaOnlyBlocks, blocks[i].String())
+	}
+	sort.Strings(o.result.DeltaOnlyBlocks)
+	if len(blocks) == 0 {
+		return nil
+	}
+	materialized := 0
+	if o.locateABlock != nil {
+		for _, blkID := range blocks {
+			view := rows[blkID]
+			stats, err := o.locateABlock(ctx, view.TID(), blkID)
+			if err != nil {
+				return err
+			}
+			if stats == nil {
+				continue
+			}
+			if name := stats.ObjectName(); !name.Equal(objectio.BuildObjectName(blkID.Segment(), blkID.Sequence())) {
+				return moerr.NewInvalidInputNoCtx("aBlock %s located in object %s", blkID.String(), name.String())
+			}
+			appendDeltaOnlyObjectInfo(data, view, stats)
+			materialized++
+		}
+	}
+	if materialized > 0 {
+		// The entries are appended after those of the other tables.
+		bats := []*containers.Batch{data.bats[ObjectInfoIDX]}
+		tables, err := groupByTable([]uint16{ObjectInfoIDX}, bats,
+			bats[0].GetVectorByName(SnapshotAttr_TID), common.CheckpointAllocator)
+		if err != nil {
+			return err
+		}
+		data.bats[ObjectInfoIDX] = bats[0]
+		for tid, table := range tables {
+			data.UpdateObjectInsertMeta(tid, int32(table.offset), int32(table.end))
+		}
+	}
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("delta-only aBlocks"),
+		common.AnyField("blocks", len(blocks)),
+		common.AnyField("materialized", materialized))
+	return nil
+}
+
+// appendDeltaOnlyObjectInfo appends the entry of the object of the
+// delta-only aBlock of the block meta row view to the object info of
+// data, with stats. The object is an aBlock deleted, and so converted,
+// when the deletes of the row are committed.
+func appendDeltaOnlyObjectInfo(data *CheckpointData, view BlockMetaView, stats *objectio.ObjectStats) {
+	commitTS := view.CommitTs()
+	dbid := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_DBID)
+	bat := data.bats[ObjectInfoIDX]
+	for i, attr := range bat.Attrs {
+		switch attr {
+		case ObjectAttr_ObjectStats:
+			bat.Vecs[i].Append(stats[:], false)
+		case ObjectAttr_State:
+			bat.Vecs[i].Append(true, false)
+		case ObjectAttr_Sorted:
+			bat.Vecs[i].Append(false, false)
+		case SnapshotAttr_DBID:
+			bat.Vecs[i].Append(dbid.Get(view.Row()), dbid.IsNull(view.Row()))
+		case SnapshotAttr_TID:
+			bat.Vecs[i].Append(view.TID(), false)
+		case EntryNode_CreateAt, EntryNode_DeleteAt,
+			txnbase.SnapshotAttr_StartTS, txnbase.SnapshotAttr_PrepareTS, txnbase.SnapshotAttr_CommitTS:
+			bat.Vecs[i].Append(commitTS, false)
+		default:
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithBlockDenylist removes the blocks from the checkpoint, e.g. the
+// blocks that hold the rows of an erasure request: the block meta rows
+// of the blocks are deleted, and with them the references to their
+// tombstones, and the object entries of the objects all of whose
+// blocks are denied. The blocks the rewrite removed are listed in
+// RewriteResult.DeniedBlocks.
+//
+// An object is rewritten by blocks, not by rows. Denying some blocks
+// of an object with others fails the rewrite, the object would have to
+// be written again without them.
+func WithBlockDenylist(blocks []types.Blockid) BackupOption {
+	return func(o *backupOptions) {
+		o.denied = make(map[types.Blockid]struct{}, len(blocks))
+		for _, block := range blocks {
+			o.denied[block] = struct{}{}
+		}
+	}
+}
+
+// dropDeniedBlocks removes the denied blocks from data, before the
+// objects of data are collected. It returns the number of rows it
+// removed.
+func (o *backupOptions) dropDeniedBlocks(ctx context.Context, data *CheckpointData) (int, error) {
+	if len(o.denied) == 0 {
+		return 0, nil
+	}
+	objects := make(map[string][]uint16)
+	for block := range o.denied {
+		_, num := block.Offsets()
+		objects[block.ObjectNameString()] = append(objects[block.ObjectNameString()], num)
+	}
+	removed := make(map[types.Blockid]struct{})
+
+	drop := make(map[BlockMetaSource][]int)
+	err := data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if _, ok := o.denied[view.Blockid()]; ok {
+			drop[view.Source()] = append(drop[view.Source()], view.Row())
+			removed[view.Blockid()] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		rows := make([]int, 0)
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			name := stats.ObjectName().String()
+			denied := 0
+			for _, num := range objects[name] {
+				if uint32(num) < stats.BlkCnt() {
+					denied++
+				}
+			}
+			if denied == 0 {
+				continue
+			}
+			if denied != int(stats.BlkCnt()) {
+				return 0, moerr.NewNotSupported(ctx, "deny %d of the %d blocks of object %s",
+					denied, stats.BlkCnt(), name)
+			}
+			rows = append(rows, i)
+			for num := uint16(0); num < uint16(stats.BlkCnt()); num++ {
+				removed[*objectio.BuildObjectBlockid(stats.ObjectName(), num)] = struct{}{}
+			}
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		for _, row := range rows {
+			bat.Delete(row)
+		}
+		bat.Compact()
+		if idx == ObjectInfoIDX {
+			data.shrinkTableMeta(ObjectInfo, rows)
+		}
+		dropped += len(rows)
+	}
+	dropped += data.deleteBlockMetaRows(drop)
+
+	for block := range removed {
+		o.result.DeniedBlocks = append(o.result.DeniedBlocks, block.String())
+	}
+	sort.Strings(o.result.DeniedBlocks)
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("drop denied blocks"),
+		common.AnyField("blocks", len(removed)),
+		common.AnyField("dropped rows", dropped))
+	return dropped, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// WithManifestSHA256 records the sha256 of every file of the backup, the
+// objects and the checkpoint, in its RestoreManifest, for a tool to
+// tell an archived backup was tampered with, see VerifyManifestSHA256.
+// It implies WithRestoreManifest.
+//
+// The sums are computed as the files are written, and checked against
+// the files read back when the manifest is written: a file the storage
+// does not return as it was written fails the rewrite. The files the
+// rewrite did not write itself, e.g. the objects reused WithSkipExisting,
+// have the sum of what is read back.
+func WithManifestSHA256() BackupOption {
+	return func(o *backupOptions) {
+		o.manifest = true
+		o.digests = &fileDigests{sums: make(map[string]string)}
+	}
+}
+
+// fileDigests are the hex sha256 of the files written through a
+// digestingFS, by path.
+type fileDigests struct {
+	mu   sync.Mutex
+	sums map[string]string
+}
+
+func (d *fileDigests) record(name, sum string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sums[name] = sum
+}
+
+func (d *fileDigests) forget(names ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range names {
+		delete(d.sums, name)
+	}
+}
+
+func (d *fileDigests) get(name string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sum, ok := d.sums[name]
+	return sum, ok
+}
+
+// digestedFS returns dstFs recording the sha256 of what is written to
+// it in digests, dstFs itself when digests is nil.
+func digestedFS(dstFs fileservice.FileService, digests *fileDigests) fileservice.FileService {
+	if digests == nil {
+		return dstFs
+	}
+	return digestingFS{FileService: dstFs, digests: digests}
+}
+
+// digestingFS hashes the files written to it while they are written.
+// Only a file written in one vector of consecutive entries from its
+// start is recorded, the objects and the auxiliary files are.
+type digestingFS struct {
+	fileservice.FileService
+	digests *fileDigests
+}
+
+func (fs digestingFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	h := sha256.New()
+	whole := true
+	var offset int64
+	// The entries are the caller's, the readers are wrapped in a copy.
+	entries := make([]fileservice.IOEntry, len(vector.Entries))
+	copy(entries, vector.Entries)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Offset != offset || entry.Size < 0 {
+			whole = false
+		}
+		if entry.ReaderForWrite != nil {
+			entry.ReaderForWrite = io.TeeReader(entry.ReaderForWrite, h)
+		} else if entry.Size >= 0 && entry.Size <= int64(len(entry.Data)) {
+			h.Write(entry.Data[:entry.Size])
+		} else {
+			whole = false
+		}
+		offset += entry.Size
+	}
+	vector.Entries = entries
+	fs.digests.forget(vector.FilePath)
+	if err := fs.FileService.Write(ctx, vector); err != nil {
+		return err
+	}
+	if whole {
+		fs.digests.record(vector.FilePath, hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+func (fs digestingFS) Delete(ctx context.Context, filePaths ...string) error {
+	fs.digests.forget(filePaths...)
+	return fs.FileService.Delete(ctx, filePaths...)
+}
+
+// fileSHA256 returns the hex sha256 of buf, the content of the file
+// name of the backup, checked against the sum digests recorded when it
+// was written, if any.
+func fileSHA256(name string, buf []byte, digests *fileDigests) (string, error) {
+	sum := sha256.Sum256(buf)
+	actual := hex.EncodeToString(sum[:])
+	if written, ok := digests.get(name); ok && written != actual {
+		return "", moerr.NewInternalErrorNoCtx("%s changed since it was written: sha256 %s, written %s",
+			name, actual, written)
+	}
+	return actual, nil
+}
+
+// DigestMismatch is a file of a backup whose content is not the one its
+// RestoreManifest has the sha256 of.
+type DigestMismatch struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+// ManifestDigestCheck is the result of VerifyManifestSHA256.
+type ManifestDigestCheck struct {
+	// Checked is the number of files of the manifest checked.
+	Checked int
+	// Missing are the files the manifest lists that are not in the
+	// backup, Unhashed those it has no sha256 of, both sorted.
+	Missing  []string
+	Unhashed []string
+	// Mismatched are the files whose content differs from the
+	// manifest, sorted by path.
+	Mismatched []DigestMismatch
+}
+
+func (c *ManifestDigestCheck) OK() bool {
+	return len(c.Missing) == 0 && len(c.Unhashed) == 0 && len(c.Mismatched) == 0
+}
+
+// VerifyManifestSHA256 reads every file the RestoreManifest of the
+// checkpoint whose CN meta object is meta lists from fs and compares its
+// sha256 with the one the manifest records, see WithManifestSHA256.
+// Unlike VerifyBackup the whole content of the files is read. Missing,
+// unhashed and mismatched files are collected in the check, the error
+// is for the manifest or a read that fails for another reason.
+func VerifyManifestSHA256(
+	ctx context.Context,
+	fs fileservice.FileService,
+	meta string,
+) (*ManifestDigestCheck, error) {
+	manifest, err := ReadRestoreManifest(ctx, fs, meta)
+	if err != nil {
+		return nil, err
+	}
+	check := &ManifestDigestCheck{}
+	for _, file := range manifest.Files {
+		if file.SHA256 == "" {
+			check.Unhashed = append(check.Unhashed, file.Path)
+			continue
+		}
+		buf, err := readBackupFile(ctx, fs, file.Path)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			check.Missing = append(check.Missing, file.Path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		check.Checked++
+		sum := sha256.Sum256(buf)
+		if actual := hex.EncodeToString(sum[:]); actual != file.SHA256 {
+			check.Mismatched = append(check.Mismatched, DigestMismatch{
+				Path:     file.Path,
+				Expected: file.SHA256,
+				Actual:   actual,
+			})
+		}
+	}
+	sort.Strings(check.Missing)
+	sort.Strings(check.Unhashed)
+	sort.Slice(check.Mismatched, func(i, j int) bool {
+		return check.Mismatched[i].Path < check.Mismatched[j].Path
+	})
+	return check, nil
+}
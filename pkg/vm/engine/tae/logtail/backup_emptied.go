@@ -0,0 +1,102 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+)
+
+// blocksEmptied tells whether trimming left no rows in any of blocks,
+// those of an object rewritten in place. The writer of such an object
+// would sync it without blocks, which is invalid.
+func blocksEmptied(blocks []*blockData) bool {
+	for _, block := range blocks {
+		if !block.dropped && (block.data == nil || block.data.RowCount() > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// dropEmptied records the object fileName, whose blocks trimming
+// emptied, as not written. Its references are removed by
+// removeEmptiedReferences once the rewrite is done with the batches.
+func (o *backupOptions) dropEmptied(emptied map[string]struct{}, fileName string, blocks []*blockData) {
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("drop emptied object"),
+		common.AnyField("object", fileName),
+		common.AnyField("blocks", len(blocks)))
+	emptied[fileName] = struct{}{}
+	o.result.Emptied = append(o.result.Emptied, fileName)
+	o.stats.Phase(StatsPhaseRewrite).Add(StatEmptiedObjects, 1)
+	for _, block := range blocks {
+		if block.users > 0 {
+			block.release()
+		}
+	}
+}
+
+// removeEmptiedReferences removes the references of the block meta
+// batches of data to the emptied objects. A row of a block of one of
+// them is deleted. A row whose tombstone is in one of them has its
+// delta location cleared, the block has no deletes as of the backup,
+// and is deleted if it has no meta location either.
+func (o *backupOptions) removeEmptiedReferences(data *CheckpointData, emptied map[string]struct{}) error {
+	if len(emptied) == 0 {
+		return nil
+	}
+	sort.Strings(o.result.Emptied)
+	in := func(location objectio.Location) bool {
+		if location.IsEmpty() {
+			return false
+		}
+		_, ok := emptied[location.Name().String()]
+		return ok
+	}
+	drop := make(map[BlockMetaSource][]int)
+	cleared := make(map[BlockMetaSource][]int)
+	err := data.ForEachBlockMeta(func(view BlockMetaView) error {
+		metaLoc := view.MetaLoc()
+		if in(metaLoc) || (in(view.DeltaLoc()) && metaLoc.IsEmpty()) {
+			drop[view.Source()] = append(drop[view.Source()], view.Row())
+		} else if in(view.DeltaLoc()) {
+			cleared[view.Source()] = append(cleared[view.Source()], view.Row())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for source, rows := range cleared {
+		vecs := []containers.Vector{data.bats[source].GetVectorByName(catalog.BlockMeta_DeltaLoc)}
+		if source == BlockMetaInsert {
+			vecs = append(vecs, data.bats[BLKMetaInsertTxnIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc))
+		}
+		for _, row := range rows {
+			for _, vec := range vecs {
+				vec.Update(row, nil, true)
+			}
+		}
+	}
+	dropped := data.deleteBlockMetaRows(drop)
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("remove emptied references"),
+		common.AnyField("objects", len(emptied)),
+		common.AnyField("dropped rows", dropped))
+	return nil
+}
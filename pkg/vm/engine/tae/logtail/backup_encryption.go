@@ -0,0 +1,448 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// EncryptionKey is a key the files of a backup are encrypted with. ID
+// names the key in the files, Block is its cipher, e.g. the one
+// aes.NewCipher returns for it. The key itself is never written.
+type EncryptionKey struct {
+	ID    string
+	Block cipher.Block
+}
+
+// EncryptionKeys returns the cipher of the key id, to read the files
+// encrypted with it.
+type EncryptionKeys func(id string) (cipher.Block, error)
+
+// WithEncryption encrypts the files the rewrite writes with key: the
+// objects its writers write, those of a BlockWriterFactory too, the
+// checkpoint and the auxiliary files next to it, e.g. the footer. The
+// source objects the checkpoint still references are not written by
+// the rewrite, the caller copies them through NewEncryptedFS for them
+// to be encrypted as well. The files of the session, e.g. its journal,
+// are not encrypted.
+//
+// The backup is read back through NewDecryptingFS, e.g. by
+// LoadCheckpointEntriesFromKey or VerifyRewrittenCheckpoint.
+func WithEncryption(key EncryptionKey) BackupOption {
+	return func(o *backupOptions) {
+		o.encryption = &key
+	}
+}
+
+// An encrypted file is a header followed by its content sealed with
+// AES-GCM in chunks of encryptedChunkSize bytes, the last one shorter,
+// each with its tag. An object is read at the offsets of its extents,
+// only the chunks they fall in are read and opened.
+//
+//	magic  [4]byte  encryptedMagic
+//	idLen  uint8
+//	id     [maxEncryptionKeyID]byte, the key id, zero padded
+//	nonce  [encryptedNoncePrefix]byte, random for every file
+//
+// The nonce of chunk i is the nonce of the file followed by i, big
+// endian. A chunk is sealed with the header, i and whether it is the
+// last one as additional data: a chunk that is changed, moved within
+// its file or to another one, or a file cut after a chunk, fails to
+// open. An empty file has one empty chunk.
+var encryptedMagic = [4]byte{'M', 'O', 'E', 'N'}
+
+const (
+	maxEncryptionKeyID   = 64
+	encryptedNoncePrefix = 8
+	encryptedHeaderLen   = len(encryptedMagic) + 1 + maxEncryptionKeyID + encryptedNoncePrefix
+	encryptedChunkSize   = 64 << 10
+	encryptedTagSize     = 16
+	encryptedChunkLen    = encryptedChunkSize + encryptedTagSize
+)
+
+// encryptedSize is the size of the encrypted file of size bytes of
+// content.
+func encryptedSize(size int64) int64 {
+	chunks := size/encryptedChunkSize + 1
+	if size > 0 && size%encryptedChunkSize == 0 {
+		chunks--
+	}
+	return int64(encryptedHeaderLen) + size + chunks*encryptedTagSize
+}
+
+// contentSize is the size of the content of the encrypted file of size
+// bytes, -1 if no encrypted file has that size.
+func contentSize(size int64) int64 {
+	size -= int64(encryptedHeaderLen)
+	if size < encryptedTagSize {
+		return -1
+	}
+	chunks := (size + encryptedChunkLen - 1) / encryptedChunkLen
+	if size%encryptedChunkLen != 0 && size%encryptedChunkLen < encryptedTagSize {
+		return -1
+	}
+	return size - chunks*encryptedTagSize
+}
+
+// NewEncryptedFS returns fs encrypting the files written to it with key
+// and decrypting the files read from it, which must have been encrypted
+// with key too. The sizes it lists and stats are those of the content.
+func NewEncryptedFS(fs fileservice.FileService, key EncryptionKey) (fileservice.FileService, error) {
+	if err := checkEncryptionKey(key.ID, key.Block); err != nil {
+		return nil, err
+	}
+	return &encryptedFS{
+		FileService: fs,
+		key:         &key,
+		keys: func(id string) (cipher.Block, error) {
+			if id != key.ID {
+				return nil, moerr.NewInternalErrorNoCtx("file encrypted with key %q, not %q", id, key.ID)
+			}
+			return key.Block, nil
+		},
+	}, nil
+}
+
+// NewDecryptingFS returns fs decrypting the files read from it with the
+// keys their headers name, e.g. to read a backup written WithEncryption.
+// A file that was changed fails to read. It cannot write.
+func NewDecryptingFS(fs fileservice.FileService, keys EncryptionKeys) fileservice.FileService {
+	return &encryptedFS{FileService: fs, keys: keys}
+}
+
+func checkEncryptionKey(id string, block cipher.Block) error {
+	if id == "" || len(id) > maxEncryptionKeyID {
+		return moerr.NewInvalidInputNoCtx("encryption key id %q, 1 to %d bytes", id, maxEncryptionKeyID)
+	}
+	if block == nil || block.BlockSize() != aes.BlockSize {
+		return moerr.NewNotSupportedNoCtx("encryption key %q: cipher of another block size than %d", id, aes.BlockSize)
+	}
+	return nil
+}
+
+// encryptedFS encrypts the files it writes with key, nil if it only
+// reads, and decrypts the files it reads with keys.
+type encryptedFS struct {
+	fileservice.FileService
+	key  *EncryptionKey
+	keys EncryptionKeys
+}
+
+// fileCipher seals and opens the chunks of one encrypted file.
+type fileCipher struct {
+	aead   cipher.AEAD
+	header []byte
+}
+
+func newFileCipher(block cipher.Block, header []byte) (*fileCipher, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{aead: aead, header: header}, nil
+}
+
+// nonceAndData returns the nonce and the additional data of chunk i.
+func (c *fileCipher) nonceAndData(i int64, last bool) ([]byte, []byte) {
+	nonce := make([]byte, 0, c.aead.NonceSize())
+	nonce = append(nonce, c.header[encryptedHeaderLen-encryptedNoncePrefix:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(i))
+	data := make([]byte, 0, len(c.header)+5)
+	data = append(data, c.header...)
+	data = binary.BigEndian.AppendUint32(data, uint32(i))
+	if last {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	return nonce, data
+}
+
+func (c *fileCipher) seal(dst, chunk []byte, i int64, last bool) []byte {
+	nonce, data := c.nonceAndData(i, last)
+	return c.aead.Seal(dst, nonce, chunk, data)
+}
+
+func (c *fileCipher) open(dst, chunk []byte, i int64, last bool) ([]byte, error) {
+	nonce, data := c.nonceAndData(i, last)
+	return c.aead.Open(dst, nonce, chunk, data)
+}
+
+// sealingReader reads the chunks of the content read from r sealed.
+type sealingReader struct {
+	cipher *fileCipher
+	r      io.Reader
+	chunk  []byte
+	// next is the first byte of the next chunk, read to tell whether
+	// the chunk is the last.
+	next   []byte
+	sealed []byte
+	i      int64
+	done   bool
+}
+
+func (r *sealingReader) Read(p []byte) (int, error) {
+	for len(r.sealed) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+func (r *sealingReader) seal() error {
+	n := copy(r.chunk, r.next)
+	r.next = r.next[:0]
+	m, err := io.ReadFull(r.r, r.chunk[n:])
+	n += m
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		var one [1]byte
+		if _, err = io.ReadFull(r.r, one[:]); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		} else {
+			r.next = append(r.next, one[0])
+		}
+	}
+	r.sealed = r.cipher.seal(r.sealed[:0], r.chunk[:n], r.i, last)
+	r.i++
+	r.done = last
+	return nil
+}
+
+func (fs *encryptedFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if fs.key == nil {
+		return moerr.NewNotSupportedNoCtx("write %s to a decrypting file service", vector.FilePath)
+	}
+	header := make([]byte, 0, encryptedHeaderLen)
+	header = append(header, encryptedMagic[:]...)
+	header = append(header, byte(len(fs.key.ID)))
+	header = append(header, fs.key.ID...)
+	header = append(header, make([]byte, maxEncryptionKeyID+encryptedNoncePrefix-len(fs.key.ID))...)
+	if _, err := rand.Read(header[encryptedHeaderLen-encryptedNoncePrefix:]); err != nil {
+		return err
+	}
+	c, err := newFileCipher(fs.key.Block, header)
+	if err != nil {
+		return err
+	}
+
+	// The entries are the content one after the other, sealed as one.
+	readers := make([]io.Reader, 0, len(vector.Entries))
+	streamed := false
+	offset := int64(0)
+	for i, entry := range vector.Entries {
+		if entry.Offset != offset {
+			return moerr.NewInternalErrorNoCtx("write %s: entry at %d, expected %d", vector.FilePath, entry.Offset, offset)
+		}
+		if entry.ReaderForWrite != nil {
+			streamed = true
+			if entry.Size < 0 {
+				if i != len(vector.Entries)-1 {
+					return moerr.NewInternalErrorNoCtx("write %s: entry of unknown size before the last", vector.FilePath)
+				}
+				readers = append(readers, entry.ReaderForWrite)
+				break
+			}
+			readers = append(readers, io.LimitReader(entry.ReaderForWrite, entry.Size))
+			offset += entry.Size
+			continue
+		}
+		data := entry.Data
+		if entry.Size >= 0 && entry.Size < int64(len(data)) {
+			data = data[:entry.Size]
+		}
+		readers = append(readers, bytes.NewReader(data))
+		offset += int64(len(data))
+	}
+	sealed := &sealingReader{
+		cipher: c,
+		r:      io.MultiReader(readers...),
+		chunk:  make([]byte, encryptedChunkSize),
+	}
+	entry := fileservice.IOEntry{Size: -1}
+	if streamed {
+		entry.ReaderForWrite = io.MultiReader(bytes.NewReader(header), sealed)
+	} else {
+		// The whole content is at hand, it is written with its size.
+		if entry.Data, err = io.ReadAll(io.MultiReader(bytes.NewReader(header), sealed)); err != nil {
+			return err
+		}
+		entry.Size = int64(len(entry.Data))
+	}
+	vector.Entries = []fileservice.IOEntry{entry}
+	return fs.FileService.Write(ctx, vector)
+}
+
+func (fs *encryptedFS) Read(ctx context.Context, vector *fileservice.IOVector) error {
+	if len(vector.Entries) == 0 {
+		return moerr.NewEmptyVectorNoCtx()
+	}
+	// The size of the file tells which chunk is the last.
+	stat, err := fs.FileService.StatFile(ctx, vector.FilePath)
+	if err != nil {
+		return err
+	}
+	size := contentSize(stat.Size)
+	if size < 0 {
+		return moerr.NewInternalErrorNoCtx("%s is not an encrypted file of %d bytes", vector.FilePath, stat.Size)
+	}
+	last := int64(0)
+	if size > 0 {
+		last = (size - 1) / encryptedChunkSize
+	}
+	// The header is read with the chunks of the entries.
+	raw := fileservice.IOVector{
+		FilePath: vector.FilePath,
+		Entries:  make([]fileservice.IOEntry, 0, len(vector.Entries)+1),
+		Policy:   vector.Policy,
+	}
+	raw.Entries = append(raw.Entries, fileservice.IOEntry{Size: int64(encryptedHeaderLen)})
+	firsts := make([]int64, len(vector.Entries))
+	for i, entry := range vector.Entries {
+		end := size
+		if entry.Size >= 0 {
+			end = entry.Offset + entry.Size
+		}
+		if entry.Offset < 0 || entry.Offset > end || end > size {
+			return moerr.NewUnexpectedEOFNoCtx(vector.FilePath)
+		}
+		first := entry.Offset / encryptedChunkSize
+		if first > last {
+			first = last
+		}
+		lastOfEntry := first
+		if end > entry.Offset {
+			lastOfEntry = (end - 1) / encryptedChunkSize
+		}
+		rawEnd := encryptedSize(size)
+		if lastOfEntry < last {
+			rawEnd = int64(encryptedHeaderLen) + (lastOfEntry+1)*encryptedChunkLen
+		}
+		rawOffset := int64(encryptedHeaderLen) + first*encryptedChunkLen
+		firsts[i] = first
+		raw.Entries = append(raw.Entries, fileservice.IOEntry{
+			Offset: rawOffset,
+			Size:   rawEnd - rawOffset,
+		})
+	}
+	if err = fs.FileService.Read(ctx, &raw); err != nil {
+		return err
+	}
+	c, err := fs.decodeHeader(vector.FilePath, raw.Entries[0].Data)
+	if err != nil {
+		return err
+	}
+	for i := range vector.Entries {
+		entry := &vector.Entries[i]
+		sealed := raw.Entries[i+1].Data
+		content := make([]byte, 0, len(sealed))
+		for chunk := firsts[i]; len(sealed) > 0; chunk++ {
+			n := min(len(sealed), encryptedChunkLen)
+			if content, err = c.open(content, sealed[:n], chunk, chunk == last); err != nil {
+				return moerr.NewInternalErrorNoCtx("%s: chunk %d does not authenticate: %v", vector.FilePath, chunk, err)
+			}
+			sealed = sealed[n:]
+		}
+		start := entry.Offset - firsts[i]*encryptedChunkSize
+		end := int64(len(content))
+		if entry.Size >= 0 {
+			end = start + entry.Size
+		}
+		content = content[start:end]
+		data := entry.Data
+		if len(data) < len(content) {
+			data = make([]byte, len(content))
+		}
+		data = data[:len(content)]
+		copy(data, content)
+		entry.Size = int64(len(data))
+		if err = fillReadEntry(entry, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeHeader returns the cipher of the file name whose header is buf.
+func (fs *encryptedFS) decodeHeader(name string, buf []byte) (*fileCipher, error) {
+	if len(buf) < encryptedHeaderLen || !bytes.Equal(buf[:len(encryptedMagic)], encryptedMagic[:]) {
+		return nil, moerr.NewInternalErrorNoCtx("%s is not an encrypted file", name)
+	}
+	header := buf[:encryptedHeaderLen]
+	idLen := int(header[len(encryptedMagic)])
+	if idLen == 0 || idLen > maxEncryptionKeyID {
+		return nil, moerr.NewInternalErrorNoCtx("%s: encryption key id of %d bytes", name, idLen)
+	}
+	id := string(header[len(encryptedMagic)+1 : len(encryptedMagic)+1+idLen])
+	block, err := fs.keys(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkEncryptionKey(id, block); err != nil {
+		return nil, err
+	}
+	return newFileCipher(block, bytes.Clone(header))
+}
+
+// ReadCache never hits, the caches of fs have the encrypted content.
+func (fs *encryptedFS) ReadCache(context.Context, *fileservice.IOVector) error {
+	return nil
+}
+
+func (fs *encryptedFS) List(ctx context.Context, dirPath string) ([]fileservice.DirEntry, error) {
+	entries, err := fs.FileService.List(ctx, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if size := contentSize(entries[i].Size); !entries[i].IsDir && size >= 0 {
+			entries[i].Size = size
+		}
+	}
+	return entries, nil
+}
+
+func (fs *encryptedFS) StatFile(ctx context.Context, filePath string) (*fileservice.DirEntry, error) {
+	entry, err := fs.FileService.StatFile(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if size := contentSize(entry.Size); size >= 0 {
+		entry.Size = size
+	}
+	return entry, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/compress"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// UnsupportedFeatureError is returned when a checkpoint uses features
+// this build does not know, e.g. it was written by a newer build. The
+// rewrite refuses it rather than writing a subtly wrong backup.
+type UnsupportedFeatureError struct {
+	Location string
+	// Missing are the features, sorted.
+	Missing []string
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("checkpoint %s uses features this build does not support: %s",
+		e.Location, strings.Join(e.Missing, ", "))
+}
+
+func IsUnsupportedFeatureError(err error) bool {
+	var fe *UnsupportedFeatureError
+	return errors.As(err, &fe)
+}
+
+// checkCheckpointVersion checks the version of the checkpoint at
+// location before it is loaded, the batches of a newer version cannot
+// be read.
+func checkCheckpointVersion(location objectio.Location, version uint32) error {
+	if version <= CheckpointCurrentVersion {
+		return nil
+	}
+	return &UnsupportedFeatureError{
+		Location: location.String(),
+		Missing:  []string{fmt.Sprintf("checkpoint version %d", version)},
+	}
+}
+
+// checkRewriteTS checks the ts a checkpoint is rewritten as of, the
+// rewrite would trim every row of it as of an empty ts.
+func checkRewriteTS(location objectio.Location, ts types.TS) error {
+	if ts.IsEmpty() {
+		return moerr.NewInvalidInputNoCtx("rewrite checkpoint %s as of an empty ts", location.String())
+	}
+	return nil
+}
+
+// checkCheckpointFeatures checks the features the loaded checkpoint
+// declares for the objects it references, i.e. the compression of the
+// objects and of the blocks.
+func checkCheckpointFeatures(location objectio.Location, data *CheckpointData) error {
+	missing := make(map[string]struct{})
+	checkAlg := func(extent objectio.Extent) {
+		switch extent.Alg() {
+		case compress.None, compress.Lz4:
+		default:
+			missing[fmt.Sprintf("compression algorithm %d", extent.Alg())] = struct{}{}
+		}
+	}
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		statsVec := data.bats[idx].GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < statsVec.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			checkAlg(stats.Extent())
+		}
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		for _, loc := range []objectio.Location{view.MetaLoc(), view.DeltaLoc()} {
+			if !loc.IsEmpty() {
+				checkAlg(loc.Extent())
+			}
+		}
+		return nil
+	})
+	if len(missing) == 0 {
+		return nil
+	}
+	err := &UnsupportedFeatureError{Location: location.String()}
+	for feature := range missing {
+		err.Missing = append(err.Missing, feature)
+	}
+	sort.Strings(err.Missing)
+	return err
+}
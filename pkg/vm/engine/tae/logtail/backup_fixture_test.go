@@ -0,0 +1,6147 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/compress"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/logutil"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
+	catalog2 "github.com/matrixorigin/matrixone/pkg/vm/engine/tae/catalog"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/iface/data"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fixtureFirstTable is the id of the first table of a fixture.
+const fixtureFirstTable = 1000
+
+// checkpointSpec describes the checkpoint newCheckpointFixture builds.
+type checkpointSpec struct {
+	Tables int
+	// BlocksPerTable is the number of objects of a table, each has one
+	// block.
+	BlocksPerTable int
+	RowsPerBlock   int
+	// ABlockFraction of the objects of a table are appendable objects
+	// merged away after Pivot, the others are live nBlocks.
+	ABlockFraction float64
+	// TombstoneDensity is the fraction of the rows of every block that a
+	// tombstone deletes, blocks have no tombstone when it is 0.
+	TombstoneDensity float64
+	// Pivot is the ts the backup is taken at. LateFraction of the rows
+	// of the aBlocks and of the tombstones commit after it, the others
+	// before it. The deletes do not commit after the rows they delete,
+	// an early delete of a late row of an aBlock is an unmatched delete
+	// once the late rows are trimmed.
+	Pivot        types.TS
+	LateFraction float64
+	// Unordered shuffles the commit ts of the rows of a block, the rows
+	// are in commit order otherwise, as appends are.
+	Unordered bool
+	// DuplicateMetaRows tombstoned blocks have their block meta row
+	// listed twice, the copy committed earlier, as an old replay bug
+	// left them.
+	DuplicateMetaRows int
+	// CorruptDeltaLocs tombstoned blocks have a truncated delta location
+	// in their block meta row.
+	CorruptDeltaLocs int
+	// LegacyTombstones writes the tombstones in the layout of the
+	// objects whose meta predates IOET_ObjectMeta_V3.
+	LegacyTombstones bool
+	// LiveABlocks of the aBlocks are not merged away, they are still
+	// appendable when the checkpoint is taken.
+	LiveABlocks int
+	// MixedSortKeys has every other aBlock declare the second column as
+	// its sort key rather than the first.
+	MixedSortKeys bool
+	Seed          int64
+}
+
+func (s checkpointSpec) aBlocksPerTable() int {
+	return int(math.Round(float64(s.BlocksPerTable) * s.ABlockFraction))
+}
+
+// defaultCheckpointSpec is a small mixed workload, large enough for
+// every path of the rewrite to be taken.
+func defaultCheckpointSpec() checkpointSpec {
+	return checkpointSpec{
+		Tables:           2,
+		BlocksPerTable:   4,
+		RowsPerBlock:     64,
+		ABlockFraction:   0.5,
+		TombstoneDensity: 0.25,
+		Pivot:            types.BuildTS(1<<20, 0),
+		LateFraction:     0.25,
+		Seed:             1,
+	}
+}
+
+// checkpointFixture is a checkpoint and the objects it references,
+// written with the real writers.
+type checkpointFixture struct {
+	spec       checkpointSpec
+	fs         fileservice.FileService
+	cnLocation objectio.Location
+	tnLocation objectio.Location
+	aBlocks    int
+	nBlocks    int
+	tombstones int
+}
+
+type fixtureBuilder struct {
+	t    testing.TB
+	spec checkpointSpec
+	fs   fileservice.FileService
+	mp   *mpool.MPool
+	rng  *rand.Rand
+	data *CheckpointData
+	// end is the ts the checkpoint is taken at, after every commit.
+	end        types.TS
+	duplicates int
+	corrupted  int
+	live       int
+	aBlocks    int
+}
+
+// trackCheckpointAllocator replaces common.CheckpointAllocator, which
+// the rewrite and the checkpoint data allocate from, with a pool that
+// tracks its allocations until t ends. The test fails if any of them is
+// still not freed then, after its deferred frees, with the stacks that
+// made them. Benchmarks are not tracked, recording the stacks would
+// dominate them.
+func trackCheckpointAllocator(t testing.TB) {
+	if _, ok := t.(*testing.B); ok {
+		return
+	}
+	allocator := common.CheckpointAllocator
+	tracked := mpool.MustNewZeroNoFixed()
+	tracked.EnableLeakTracking(true)
+	common.CheckpointAllocator = tracked
+	t.Cleanup(func() {
+		common.CheckpointAllocator = allocator
+		var leaks strings.Builder
+		if tracked.ReportLeaks(&leaks) {
+			t.Errorf("checkpoint allocator leaks:\n%s", leaks.String())
+			return
+		}
+		mpool.DeleteMPool(tracked)
+	})
+}
+
+// newCheckpointFixture builds the checkpoint spec describes on a new
+// in-memory FileService. The checkpoint allocator is tracked for leaks
+// until t ends.
+func newCheckpointFixture(t testing.TB, spec checkpointSpec) *checkpointFixture {
+	blockio.Start("")
+	trackCheckpointAllocator(t)
+	b := &fixtureBuilder{
+		t:    t,
+		spec: spec,
+		fs:   newBackupTestFS(t),
+		mp:   mpool.MustNewZero(),
+		rng:  rand.New(rand.NewSource(spec.Seed)),
+		data: NewCheckpointData("", mpool.MustNewZero()),
+		end:  types.BuildTS(spec.Pivot.Physical()+int64(spec.RowsPerBlock)+1, 0),
+	}
+	defer b.data.Close()
+	fixture := &checkpointFixture{
+		spec: spec,
+		fs:   b.fs,
+	}
+	for i := 0; i < spec.Tables; i++ {
+		tid := uint64(fixtureFirstTable + i)
+		objStart := b.data.bats[ObjectInfoIDX].Length()
+		blkStart := b.data.bats[BLKMetaInsertIDX].Length()
+		for j := 0; j < spec.BlocksPerTable; j++ {
+			isABlock := j < spec.aBlocksPerTable()
+			blkID, pks := b.addObject(tid, isABlock, int32(j*spec.RowsPerBlock))
+			if isABlock {
+				fixture.aBlocks++
+			} else {
+				fixture.nBlocks++
+			}
+			if b.addTombstone(tid, isABlock, blkID, pks) {
+				fixture.tombstones++
+			}
+		}
+		b.data.UpdateObjectInsertMeta(tid, int32(objStart), int32(b.data.bats[ObjectInfoIDX].Length()))
+		b.data.UpdateBlockInsertBlkMeta(tid, int32(blkStart), int32(b.data.bats[BLKMetaInsertIDX].Length()))
+	}
+	var err error
+	fixture.cnLocation, fixture.tnLocation, _, err = b.data.WriteTo(b.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+	return fixture
+}
+
+// commits returns the commit ts of n rows, LateFraction of them after
+// the pivot.
+func (b *fixtureBuilder) commits(n int) []types.TS {
+	late := int(math.Round(float64(n) * b.spec.LateFraction))
+	early := n - late
+	pivot := b.spec.Pivot.Physical()
+	commits := make([]types.TS, n)
+	for i := range commits {
+		if i < early {
+			commits[i] = types.BuildTS(pivot-int64(early-i), 0)
+		} else {
+			commits[i] = types.BuildTS(pivot+int64(i-early+1), 0)
+		}
+	}
+	if b.spec.Unordered {
+		b.rng.Shuffle(n, func(i, j int) {
+			commits[i], commits[j] = commits[j], commits[i]
+		})
+	}
+	return commits
+}
+
+// addObject writes an object of one block for table tid and adds its
+// object info row. The primary keys of the block start at base, in
+// order for an nBlock and shuffled for an aBlock.
+func (b *fixtureBuilder) addObject(tid uint64, isABlock bool, base int32) (*types.Blockid, []int32) {
+	rows := b.spec.RowsPerBlock
+	pks := make([]int32, rows)
+	vals := make([]int64, rows)
+	for i := range pks {
+		pks[i] = base + int32(i)
+		vals[i] = b.rng.Int63()
+	}
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	blkID := objectio.BuildObjectBlockid(name, 0)
+	bat := batch.NewWithSize(2)
+	bat.Vecs[0] = vector.NewVec(types.T_int32.ToType())
+	bat.Vecs[1] = vector.NewVec(types.T_int64.ToType())
+	if isABlock {
+		b.rng.Shuffle(rows, func(i, j int) {
+			pks[i], pks[j] = pks[j], pks[i]
+		})
+		// The trailing columns of an aBlock: the rowid, the commit ts
+		// and the abort flag.
+		rowids := make([]types.Rowid, rows)
+		for i := range rowids {
+			rowids[i] = *types.NewRowid(blkID, uint32(i))
+		}
+		bat.Vecs = append(bat.Vecs,
+			vector.NewVec(types.T_Rowid.ToType()),
+			vector.NewVec(types.T_TS.ToType()),
+			vector.NewVec(types.T_bool.ToType()))
+		require.NoError(b.t, vector.AppendFixedList(bat.Vecs[2], rowids, nil, b.mp))
+		require.NoError(b.t, vector.AppendFixedList(bat.Vecs[3], b.commits(rows), nil, b.mp))
+		require.NoError(b.t, vector.AppendFixedList(bat.Vecs[4], make([]bool, rows), nil, b.mp))
+	}
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[0], pks, nil, b.mp))
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[1], vals, nil, b.mp))
+	bat.SetRowCount(rows)
+	defer bat.Clean(b.mp)
+
+	writer, err := blockio.NewBlockWriterNew(b.fs, name, 0, nil)
+	require.NoError(b.t, err)
+	sortKey := uint16(0)
+	if isABlock {
+		if b.spec.MixedSortKeys && b.aBlocks%2 == 1 {
+			sortKey = 1
+		}
+		b.aBlocks++
+	}
+	writer.SetPrimaryKey(sortKey)
+	if isABlock {
+		writer.SetAppendable()
+	}
+	_, err = writer.WriteBatch(bat)
+	require.NoError(b.t, err)
+	_, _, err = writer.Sync(context.Background())
+	require.NoError(b.t, err)
+	stats := writer.GetObjectStats()[objectio.SchemaData]
+
+	// An aBlock was merged away, after the pivot, unless it is live.
+	deleteAt := types.TS{}
+	if isABlock && b.live < b.spec.LiveABlocks {
+		b.live++
+	} else if isABlock {
+		deleteAt = b.end
+	}
+	appendFixtureRow(b.data.bats[ObjectInfoIDX], map[string]any{
+		ObjectAttr_ObjectStats:        []byte(stats[:]),
+		ObjectAttr_State:              isABlock,
+		EntryNode_CreateAt:            types.BuildTS(1, 0),
+		EntryNode_DeleteAt:            deleteAt,
+		txnbase.SnapshotAttr_CommitTS: b.end,
+		SnapshotAttr_TID:              tid,
+	})
+	return blkID, pks
+}
+
+// addTombstone writes the tombstone of TombstoneDensity of the rows of
+// block blkID, whose primary keys are pks, and adds its block meta
+// row. It reports whether there is one.
+func (b *fixtureBuilder) addTombstone(tid uint64, isABlock bool, blkID *types.Blockid, pks []int32) bool {
+	count := int(math.Round(float64(len(pks)) * b.spec.TombstoneDensity))
+	if count == 0 {
+		return false
+	}
+	rows := b.rng.Perm(len(pks))[:count]
+	sort.Ints(rows)
+	rowids := make([]types.Rowid, count)
+	deleted := make([]int32, count)
+	for i, row := range rows {
+		rowids[i] = *types.NewRowid(blkID, uint32(row))
+		deleted[i] = pks[row]
+	}
+	// The rowids are followed by the commit ts, the primary key and the
+	// abort flag, the legacy layout has the primary key first.
+	commitTs, pk := 1, 2
+	if b.spec.LegacyTombstones {
+		commitTs, pk = 2, 1
+	}
+	bat := batch.NewWithSize(4)
+	bat.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	bat.Vecs[commitTs] = vector.NewVec(types.T_TS.ToType())
+	bat.Vecs[pk] = vector.NewVec(types.T_int32.ToType())
+	bat.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[0], rowids, nil, b.mp))
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[commitTs], b.commits(count), nil, b.mp))
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[pk], deleted, nil, b.mp))
+	require.NoError(b.t, vector.AppendFixedList(bat.Vecs[3], make([]bool, count), nil, b.mp))
+	bat.SetRowCount(count)
+	defer bat.Clean(b.mp)
+	var deltaLoc objectio.Location
+	if b.spec.LegacyTombstones {
+		deltaLoc = writeLegacyTombstoneBatch(b.t, b.fs, bat)
+	} else {
+		deltaLoc = writeTombstoneBatch(b.t, b.fs, bat)
+	}
+	if b.corrupted < b.spec.CorruptDeltaLocs {
+		b.corrupted++
+		deltaLoc = deltaLoc[:objectio.LocationLen/2]
+	}
+
+	if b.duplicates < b.spec.DuplicateMetaRows {
+		b.duplicates++
+		appendFixtureRow(b.data.bats[BLKMetaInsertIDX], map[string]any{
+			catalog.BlockMeta_ID:         *blkID,
+			catalog.BlockMeta_EntryState: isABlock,
+			catalog.BlockMeta_DeltaLoc:   []byte(deltaLoc),
+			catalog.BlockMeta_CommitTs:   types.BuildTS(1, 0),
+		})
+		appendFixtureRow(b.data.bats[BLKMetaInsertTxnIDX], map[string]any{
+			SnapshotAttr_TID:           tid,
+			catalog.BlockMeta_DeltaLoc: []byte(deltaLoc),
+		})
+	}
+	appendFixtureRow(b.data.bats[BLKMetaInsertIDX], map[string]any{
+		catalog.BlockMeta_ID:         *blkID,
+		catalog.BlockMeta_EntryState: isABlock,
+		catalog.BlockMeta_DeltaLoc:   []byte(deltaLoc),
+		catalog.BlockMeta_CommitTs:   b.end,
+	})
+	appendFixtureRow(b.data.bats[BLKMetaInsertTxnIDX], map[string]any{
+		SnapshotAttr_TID:           tid,
+		catalog.BlockMeta_DeltaLoc: []byte(deltaLoc),
+	})
+	return true
+}
+
+// appendFixtureRow appends a row of vals by attr to bat, the attrs not
+// in vals are null.
+func appendFixtureRow(bat *containers.Batch, vals map[string]any) {
+	for i, attr := range bat.Attrs {
+		if val, ok := vals[attr]; ok {
+			bat.Vecs[i].Append(val, false)
+		} else {
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
+
+// loadObjectsData loads the checkpoint of the fixture and collects its
+// objects as the analysis phase of the rewrite does.
+func (f *checkpointFixture) loadObjectsData(t testing.TB) (*CheckpointData, map[string]*fileData) {
+	data, err := getCheckpointData(context.Background(), "", f.fs, f.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	data.FormatData(common.CheckpointAllocator)
+	return data, collectObjectsData(data, f.spec.Pivot)
+}
+
+// freeObjectsData frees the blocks trimObjectsData loaded.
+func freeObjectsData(objectsData map[string]*fileData) {
+	for _, objectData := range objectsData {
+		if objectData.obj != nil {
+			for _, bat := range objectData.obj.data {
+				bat.Clean(common.CheckpointAllocator)
+			}
+		}
+		for _, block := range objectData.data {
+			if block.data != nil {
+				block.data.Clean(common.CheckpointAllocator)
+			}
+		}
+	}
+}
+
+func TestCheckpointFixture(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Unordered = true
+	fixture := newCheckpointFixture(t, spec)
+	require.Equal(t, 4, fixture.aBlocks)
+	require.Equal(t, 4, fixture.nBlocks)
+	require.Equal(t, 8, fixture.tombstones)
+
+	classification, err := ClassifyBlocks(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, &BlockClassification{
+		LiveNBlocks:      4,
+		DeletedBlocks:    4,
+		TombstonedBlocks: 8,
+	}, classification)
+
+	data, objectsData := fixture.loadObjectsData(t)
+	defer data.Close()
+	defer freeObjectsData(objectsData)
+	// The objects, and the tombstone objects.
+	require.Equal(t, 16, len(objectsData))
+	views := make(map[BlockMetaSource]int)
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		views[view.Source()]++
+		require.NotZero(t, view.TID())
+		require.False(t, view.DeltaLoc().IsEmpty())
+		return nil
+	}))
+	require.Equal(t, map[BlockMetaSource]int{BlockMetaInsert: fixture.tombstones}, views)
+	changed, err := trimObjectsData(ctx, fixture.fs, spec.Pivot, &objectsData, newBackupOptions())
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(result.Files.Converted))
+	// Every tombstone has rows committed after the pivot.
+	require.Equal(t, 8, len(result.Files.Rewritten))
+	require.Equal(t, result.Files.Rewritten, result.Files.Tombstones)
+	// The output bytes are split by the tables of the fixture.
+	require.Equal(t, spec.Tables, len(result.Tables))
+	var tableBytes int64
+	for _, table := range result.Tables {
+		require.NotZero(t, table.Table)
+		tableBytes += table.Bytes
+	}
+	require.Equal(t, result.Stats.OutputBytes, tableBytes)
+	summary := result.Summary()
+	require.Equal(t, 4, summary.Files.Converted)
+	require.Equal(t, spec.Tables, len(summary.TopTables))
+	require.GreaterOrEqual(t, summary.TopTables[0].Bytes, summary.TopTables[1].Bytes)
+
+	// The objects are restored before the checkpoint, whose meta object
+	// comes last.
+	order := result.Files.RestoreOrder()
+	require.Equal(t, len(result.Files.All()), len(order))
+	require.Equal(t, RestoreFile{Name: cnLocation.Name().String(), Role: FileRoleCheckpoint}, order[len(order)-1])
+	for i, file := range order[:4] {
+		require.Equal(t, FileRoleData, file.Role, i)
+	}
+	for i, file := range order[4:12] {
+		require.Equal(t, FileRoleTombstone, file.Role, i)
+	}
+	for _, file := range order[12:] {
+		require.Equal(t, FileRoleCheckpoint, file.Role)
+	}
+
+	// The aBlocks are converted to nBlocks, their object info rows are
+	// kept deleted next to the new ones.
+	classification, err = ClassifyBlocks(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, 8, classification.LiveNBlocks)
+	require.Equal(t, 4, classification.DeletedBlocks)
+	require.Zero(t, classification.LiveABlocks)
+}
+
+func TestRewriteDuplicateBlockMeta(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.DuplicateMetaRows = 3
+	fixture := newCheckpointFixture(t, spec)
+
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithStrictBlockMeta())
+	require.Error(t, err)
+
+	result := &RewriteResult{}
+	stats := NewBackupStats()
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupStats(stats))
+	require.NoError(t, err)
+	require.Equal(t, 3, len(result.DuplicateBlockRows))
+	for _, row := range result.DuplicateBlockRows {
+		require.Equal(t, "BLKMetaInsert", row.Batch)
+		require.True(t, row.Dropped.Less(&row.Kept))
+	}
+	require.Equal(t, int64(3), stats.Phase(StatsPhaseVerify).Get(StatDuplicateMeta))
+	require.Equal(t, 8, len(result.Files.Rewritten))
+
+	// Every block is listed once in the rewritten checkpoint.
+	data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	require.Equal(t, fixture.tombstones, blkMeta.Length())
+	require.Equal(t, blkMeta.Length(), data.bats[BLKMetaInsertTxnIDX].Length())
+	seen := make(map[types.Blockid]bool)
+	for i := 0; i < blkMeta.Length(); i++ {
+		blkID := blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid)
+		require.False(t, seen[blkID], blkID.String())
+		seen[blkID] = true
+	}
+}
+
+func TestRewriteUnsupportedFeature(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion+1, spec.Pivot, nil)
+	require.True(t, IsUnsupportedFeatureError(err), err)
+	require.Equal(t, []string{fmt.Sprintf("checkpoint version %d", CheckpointCurrentVersion+1)},
+		err.(*UnsupportedFeatureError).Missing)
+
+	// An object compressed with an algorithm this build does not know.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	statsVec := data.bats[ObjectInfoIDX].GetVectorByName(ObjectAttr_ObjectStats)
+	var stats objectio.ObjectStats
+	stats.UnMarshal(statsVec.Get(0).([]byte))
+	stats.Extent().SetAlg(7)
+	statsVec.Update(0, []byte(stats[:]), false)
+	cnLocation, tnLocation, _, err := data.WriteTo(fixture.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	dstFs := newBackupTestFS(t)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		cnLocation, tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.True(t, IsUnsupportedFeatureError(err), err)
+	require.Equal(t, []string{"compression algorithm 7"}, err.(*UnsupportedFeatureError).Missing)
+	// Nothing is written.
+	files, err := dstFs.List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestRewriteAnalysisLimits(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	for _, c := range []struct {
+		limits AnalysisLimits
+		limit  string
+	}{
+		{AnalysisLimits{MaxObjects: 3}, "objects"},
+		{AnalysisLimits{MaxBlocks: 2}, "blocks"},
+		{AnalysisLimits{MaxBytes: 1}, "bytes"},
+	} {
+		dstFs := newBackupTestFS(t)
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithAnalysisLimits(c.limits))
+		require.True(t, IsAnalysisLimitError(err), err)
+		limitErr := err.(*AnalysisLimitError)
+		require.Equal(t, c.limit, limitErr.Limit)
+		// The analysis stops at the object that exceeds the limit.
+		switch c.limit {
+		case "objects":
+			require.Equal(t, c.limits.MaxObjects+1, limitErr.Objects)
+		case "blocks":
+			require.Equal(t, c.limits.MaxBlocks+1, limitErr.Blocks)
+		case "bytes":
+			require.Equal(t, 1, limitErr.Objects)
+			// The limits not set are the default ones.
+			require.Equal(t, DefaultAnalysisLimits.MaxObjects, limitErr.Limits.MaxObjects)
+		}
+		files, err := dstFs.List(ctx, "")
+		require.NoError(t, err)
+		require.Empty(t, files)
+
+		_, err = PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation,
+			CheckpointCurrentVersion, spec.Pivot, nil, WithAnalysisLimits(c.limits))
+		require.True(t, IsAnalysisLimitError(err), err)
+
+		// The override lets the checkpoint through.
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithAnalysisLimits(c.limits), WithoutAnalysisLimits())
+		require.NoError(t, err)
+	}
+}
+
+func TestRewriteEmptiedObjects(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	// Every row of the tombstones commits after the pivot, trimming
+	// empties every block of the tombstone objects.
+	spec.LateFraction = 1
+	fixture := newCheckpointFixture(t, spec)
+
+	tombstones := make(map[string]bool)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		tombstones[view.DeltaLoc().Name().String()] = true
+		return nil
+	}))
+	data.Close()
+	require.Equal(t, fixture.tombstones, len(tombstones))
+
+	result := &RewriteResult{}
+	stats := NewBackupStats()
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, files, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupStats(stats))
+	require.NoError(t, err)
+	require.Equal(t, fixture.tombstones, len(result.Emptied))
+	require.Equal(t, int64(fixture.tombstones), stats.Phase(StatsPhaseRewrite).Get(StatEmptiedObjects))
+	require.Empty(t, result.Files.Rewritten)
+
+	// No object file is written for them, nor listed.
+	entries, err := dstFs.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.False(t, tombstones[entry.Name], entry.Name)
+	}
+	for _, name := range result.Emptied {
+		require.True(t, tombstones[name], name)
+		require.NotContains(t, files, name)
+	}
+
+	// The rewritten checkpoint no longer references them.
+	data, err = getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	// The rows of the fixture only reference a tombstone, they are
+	// deleted.
+	require.Zero(t, data.bats[BLKMetaInsertIDX].Length())
+	require.Zero(t, data.bats[BLKMetaInsertTxnIDX].Length())
+	locations, entriesData, err := LoadCheckpointEntriesFromKey(ctx, "", dstFs, cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.NoError(t, err)
+	defer entriesData.Close()
+	for _, location := range locations {
+		require.False(t, tombstones[location.Location.Name().String()])
+	}
+}
+
+func TestRewriteSampling(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.RowsPerBlock = 2000
+	spec.ABlockFraction = 1
+	fixture := newCheckpointFixture(t, spec)
+
+	// The rows of the aBlocks of the fixture committed by the pivot.
+	type sourceRow struct {
+		tid uint64
+		bat *batch.Batch
+		row int
+	}
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	var committed []sourceRow
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		bat, err := blockio.LoadOneBlock(ctx, fixture.fs, stats.ObjectLocation(), objectio.SchemaData)
+		require.NoError(t, err)
+		for row := 0; row < bat.RowCount(); row++ {
+			if commit := vector.GetFixedAt[types.TS](bat.Vecs[3], row); !commit.Greater(&spec.Pivot) {
+				committed = append(committed, sourceRow{
+					tid: objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64),
+					bat: bat,
+					row: row,
+				})
+			}
+		}
+	}
+
+	// sampledKeys rewrites the fixture with sampling and returns the
+	// primary keys of the converted objects, by table.
+	sampledKeys := func(sampling Sampling) (map[uint64][]int32, int) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithSampling(sampling), WithRewriteResult(result))
+		require.NoError(t, err)
+		keys := make(map[uint64][]int32)
+		rows := 0
+		for tid, bats := range convertedBlocks(t, ctx, dstFs, cnLocation, result) {
+			for _, bat := range bats {
+				keys[tid] = append(keys[tid], vector.MustFixedCol[int32](bat.Vecs[0])...)
+				rows += bat.RowCount()
+			}
+		}
+		return keys, rows
+	}
+
+	// Unsampled, the rows deleted by the pivot are gone.
+	all, total := sampledKeys(Sampling{Fraction: 1})
+	require.Less(t, total, len(committed))
+	kept := make(map[uint64]map[int32]bool)
+	for tid, pks := range all {
+		kept[tid] = make(map[int32]bool)
+		for _, pk := range pks {
+			kept[tid][pk] = true
+		}
+	}
+
+	// A sample keeps the rows it picks that are not deleted: the
+	// deletes still apply to them.
+	for _, sampling := range []Sampling{{EveryNth: 4}, {Fraction: 0.25}} {
+		expected := make(map[uint64][]int32)
+		picked, rows := 0, 0
+		for _, source := range committed {
+			if !sampling.keep(source.bat, source.row) {
+				continue
+			}
+			picked++
+			pk := vector.GetFixedAt[int32](source.bat.Vecs[0], source.row)
+			if kept[source.tid][pk] {
+				expected[source.tid] = append(expected[source.tid], pk)
+				rows++
+			}
+		}
+		require.InDelta(t, len(committed)/4, picked, float64(len(committed))/20)
+		require.Less(t, rows, picked)
+		sampled, sampledRows := sampledKeys(sampling)
+		require.Equal(t, rows, sampledRows)
+		require.Equal(t, len(expected), len(sampled))
+		for tid, pks := range expected {
+			require.ElementsMatch(t, pks, sampled[tid], tid)
+		}
+		// The same rows are kept again.
+		again, _ := sampledKeys(sampling)
+		require.Equal(t, sampled, again)
+	}
+}
+
+// countingFS counts the bytes read from and written to each file. It
+// calls onWrite, if set, before each write, and onRead before each
+// read, which fail with the error they return.
+type countingFS struct {
+	fileservice.FileService
+	sync.Mutex
+	reads   map[string]int64
+	writes  map[string]int64
+	onWrite func(name string) error
+	onRead  func(ctx context.Context, name string) error
+}
+
+func newCountingFS(fs fileservice.FileService) *countingFS {
+	return &countingFS{
+		FileService: fs,
+		reads:       make(map[string]int64),
+		writes:      make(map[string]int64),
+	}
+}
+
+func (c *countingFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if c.onWrite != nil {
+		if err := c.onWrite(vector.FilePath); err != nil {
+			return err
+		}
+	}
+	if err := c.FileService.Write(ctx, vector); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, entry := range vector.Entries {
+		c.writes[vector.FilePath] += entry.Size
+	}
+	return nil
+}
+
+// written returns the objects written to c, the auxiliary files
+// excluded, and their total size.
+func (c *countingFS) written() ([]string, int64) {
+	c.Lock()
+	defer c.Unlock()
+	names := make([]string, 0, len(c.writes))
+	size := int64(0)
+	for name, n := range c.writes {
+		if isBackupAuxName(name) {
+			continue
+		}
+		names = append(names, name)
+		size += n
+	}
+	sort.Strings(names)
+	return names, size
+}
+
+func (c *countingFS) Read(ctx context.Context, vector *fileservice.IOVector) error {
+	if c.onRead != nil {
+		if err := c.onRead(ctx, vector.FilePath); err != nil {
+			return err
+		}
+	}
+	c.Lock()
+	for _, entry := range vector.Entries {
+		c.reads[vector.FilePath] += entry.Size
+	}
+	c.Unlock()
+	return c.FileService.Read(ctx, vector)
+}
+
+func (c *countingFS) read(name string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.reads[name]
+}
+
+func TestTrimProjectedTombstoneLoad(t *testing.T) {
+	// Without late rows only the tombstones of the aBlocks are used,
+	// with them every tombstone is trimmed.
+	for _, lateFraction := range []float64{0, 0.25} {
+		t.Run(fmt.Sprintf("late=%v", lateFraction), func(t *testing.T) {
+			testTrimProjectedTombstoneLoad(t, lateFraction)
+		})
+	}
+}
+
+func testTrimProjectedTombstoneLoad(t *testing.T, lateFraction float64) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.LateFraction = lateFraction
+	fixture := newCheckpointFixture(t, spec)
+	data, objectsData := fixture.loadObjectsData(t)
+	defer data.Close()
+	defer freeObjectsData(objectsData)
+
+	linked := make(map[*blockData]bool)
+	for _, objectData := range objectsData {
+		for _, block := range objectData.data {
+			if block.tombstone != nil {
+				linked[block.tombstone] = true
+			}
+		}
+	}
+	// The size of the commit ts column and of the whole block of each
+	// tombstone, and its rows. Each load of a tombstone reads its meta
+	// too, past the meta cache.
+	commitTsSize := make(map[*blockData]int64)
+	blockSize := make(map[*blockData]int64)
+	metaSize := make(map[*blockData]int64)
+	rows := make(map[*blockData]int)
+	for _, objectData := range objectsData {
+		for _, block := range objectData.data {
+			if block.blockType != objectio.SchemaTombstone {
+				continue
+			}
+			meta, err := readObjectMeta(ctx, fixture.fs, block.location)
+			require.NoError(t, err)
+			tombstoneMeta := meta.MustGetMeta(objectio.SchemaTombstone)
+			blkMeta := tombstoneMeta.GetBlockMeta(uint32(block.location.ID()))
+			columns := tombstoneMeta.BlockHeader().ColumnCount()
+			for i := uint16(0); i < columns; i++ {
+				blockSize[block] += int64(blkMeta.ColumnMeta(i).Location().Length())
+			}
+			commitTsSize[block] = int64(blkMeta.ColumnMeta(columns - 3).Location().Length())
+			metaSize[block] = int64(block.location.Extent().Length())
+			rows[block] = int(blkMeta.GetRows())
+		}
+	}
+	require.Equal(t, fixture.tombstones, len(commitTsSize))
+
+	fs := newCountingFS(fixture.fs)
+	changed, err := trimObjectsData(ctx, fs, spec.Pivot, &objectsData, newBackupOptions())
+	require.NoError(t, err)
+	require.True(t, changed)
+	untouched, trimmed := 0, 0
+	kept := int(math.Round(float64(spec.RowsPerBlock) * spec.TombstoneDensity * (1 - lateFraction)))
+	for block, size := range commitTsSize {
+		read := fs.read(block.location.Name().String())
+		if block.data == nil {
+			untouched++
+			require.False(t, linked[block])
+			require.Equal(t, size+metaSize[block], read)
+			require.Less(t, size, blockSize[block])
+			continue
+		}
+		require.Equal(t, size+blockSize[block]+2*metaSize[block], read)
+		if block.data.Vecs[0].Length() < rows[block] {
+			trimmed++
+			require.Equal(t, kept, block.data.Vecs[0].Length())
+		}
+	}
+	if lateFraction == 0 {
+		require.Equal(t, fixture.nBlocks, untouched)
+		require.Zero(t, trimmed)
+	} else {
+		require.Zero(t, untouched)
+		require.Equal(t, fixture.tombstones, trimmed)
+	}
+}
+
+func TestTrimObjectsDataInterrupted(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+
+	// Each read in turn fails, until the trim gets through. Wherever it
+	// stops, in the middle of an object or between two, no object is
+	// left looking trimmed.
+	injected := moerr.NewInternalErrorNoCtx("injected read fault")
+	fs := newCountingFS(fixture.fs)
+	for failAt := int32(1); ; failAt++ {
+		var reads atomic.Int32
+		fs.onRead = func(context.Context, string) error {
+			if reads.Add(1) == failAt {
+				return injected
+			}
+			return nil
+		}
+		objectsData := collectObjectsData(data, spec.Pivot)
+		observer := &recordingObserver{}
+		options := newBackupOptions(WithRewriteObserver(observer))
+		changed, err := trimObjectsData(ctx, fs, spec.Pivot, &objectsData, options)
+		if err == nil {
+			require.True(t, changed)
+			freeObjectsData(objectsData)
+			require.Greater(t, failAt, int32(1))
+			break
+		}
+		require.ErrorIs(t, err, injected)
+		require.False(t, changed)
+		for name, objectData := range objectsData {
+			require.False(t, objectData.isChange, name)
+			if objectData.obj != nil {
+				require.Nil(t, objectData.obj.data, name)
+				require.False(t, objectData.obj.dropped, name)
+			}
+			for _, block := range objectData.data {
+				require.Nil(t, block.data, name)
+				require.False(t, block.dropped, name)
+				require.Nil(t, block.filtered, name)
+			}
+		}
+	}
+}
+
+func TestRewriteAbortReport(t *testing.T) {
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// abort rewrites the fixture to a new destination, cancelled by
+	// cancelAt or by a write, and checks that the report of the abort
+	// matches what the destination saw.
+	abort := func(t *testing.T, cancelAt func(RewriteProgress) bool, cancelOnWrite int) *RewriteResult {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dstFs := newCountingFS(newBackupTestFS(t))
+		writes := 0
+		dstFs.onWrite = func(name string) error {
+			if !isBackupAuxName(name) {
+				if writes++; writes == cancelOnWrite {
+					cancel()
+				}
+			}
+			return nil
+		}
+		session, err := NewBackupSession(ctx, dstFs, WithJournal("abort"))
+		require.NoError(t, err)
+		result := &RewriteResult{}
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithBackupSession(session),
+			WithProgress(func(p RewriteProgress) {
+				if cancelAt(p) {
+					cancel()
+				}
+			}))
+		require.True(t, IsRewriteAborted(err), err)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Same(t, result, err.(*RewriteAbortedError).Report)
+
+		names, size := dstFs.written()
+		require.Equal(t, len(names), result.WrittenObjects)
+		require.Equal(t, size, result.WrittenBytes)
+		rewritten := append(append([]string{}, result.Files.Rewritten...), result.Files.Converted...)
+		sort.Strings(rewritten)
+		require.Equal(t, names, rewritten)
+		require.Empty(t, result.Files.Checkpoint)
+
+		// The journal lists every object written before the abort.
+		resumed, err := NewBackupSession(context.Background(), dstFs, WithJournal("abort"))
+		require.NoError(t, err)
+		for _, name := range names {
+			_, ok := resumed.Written(name)
+			require.True(t, ok, name)
+		}
+		return result
+	}
+
+	for phase := 1; phase <= RewritePhases; phase++ {
+		t.Run(fmt.Sprintf("phase-%d", phase), func(t *testing.T) {
+			result := abort(t, func(p RewriteProgress) bool {
+				return p.Phase == phase && p.Done == 0
+			}, 0)
+			require.Equal(t, phase, result.Phase)
+			if phase <= 4 {
+				require.Zero(t, result.WrittenObjects)
+			} else {
+				// Every object is written by the end of phase 4.
+				require.Equal(t, 12, result.WrittenObjects)
+			}
+		})
+	}
+	t.Run("write", func(t *testing.T) {
+		// The fourth object is cancelled as it is written, the three
+		// written before are reported.
+		result := abort(t, func(RewriteProgress) bool { return false }, 4)
+		require.Equal(t, 4, result.Phase)
+		require.Equal(t, 3, result.WrittenObjects)
+	})
+}
+
+// faultyWriter fails the sync of its object with err, if set, and the
+// writes of its data or tombstone blocks with writeErr or
+// tombstoneErr.
+type faultyWriter struct {
+	BlockWriterLike
+	err error
+	// once fails only the first sync.
+	once         bool
+	writeErr     error
+	tombstoneErr error
+}
+
+func (w *faultyWriter) WriteBatch(bat *batch.Batch) (objectio.BlockObject, error) {
+	if w.writeErr != nil {
+		return nil, w.writeErr
+	}
+	return w.BlockWriterLike.WriteBatch(bat)
+}
+
+func (w *faultyWriter) WriteTombstoneBatch(bat *batch.Batch) (objectio.BlockObject, error) {
+	if w.tombstoneErr != nil {
+		return nil, w.tombstoneErr
+	}
+	return w.BlockWriterLike.WriteTombstoneBatch(bat)
+}
+
+func (w *faultyWriter) Sync(ctx context.Context) ([]objectio.BlockObject, objectio.Extent, error) {
+	if err := w.err; err != nil {
+		if w.once {
+			w.err = nil
+		}
+		return nil, nil, err
+	}
+	return w.BlockWriterLike.Sync(ctx)
+}
+
+func TestRewriteBlockWriterFactory(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// factory opens the real writers, the sync of the failAt-th one
+	// fails. It returns the names of the objects opened.
+	injected := moerr.NewInternalErrorNoCtx("injected sync fault")
+	factory := func(failAt int) (BlockWriterFactory, *[]string) {
+		var mu sync.Mutex
+		names := make([]string, 0)
+		return func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+			writer, err := blockio.NewBlockWriter(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, name)
+			faulty := &faultyWriter{BlockWriterLike: writer}
+			if len(names) == failAt {
+				faulty.err = injected
+			}
+			return faulty, nil
+		}, &names
+	}
+
+	// Every object the rewrite writes goes through the factory.
+	newWriter, names := factory(0)
+	result := &RewriteResult{}
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockWriterFactory(newWriter))
+	require.NoError(t, err)
+	written := append(append([]string{}, result.Files.Rewritten...), result.Files.Converted...)
+	sort.Strings(written)
+	sort.Strings(*names)
+	require.Equal(t, written, *names)
+
+	// A failed sync fails the rewrite, the objects synced before are
+	// reported.
+	newWriter, _ = factory(3)
+	result = &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockWriterFactory(newWriter))
+	require.ErrorIs(t, err, injected)
+	require.Equal(t, 2, result.WrittenObjects)
+}
+
+// abortableWriter records whether its object was synced or aborted.
+type abortableWriter struct {
+	BlockWriterLike
+	name   string
+	mu     *sync.Mutex
+	synced map[string]int
+	abort  map[string]int
+}
+
+func (w *abortableWriter) Sync(ctx context.Context) ([]objectio.BlockObject, objectio.Extent, error) {
+	blocks, extent, err := w.BlockWriterLike.Sync(ctx)
+	if err == nil {
+		w.mu.Lock()
+		w.synced[w.name]++
+		w.mu.Unlock()
+	}
+	return blocks, extent, err
+}
+
+func (w *abortableWriter) Abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.abort[w.name]++
+}
+
+func TestRewriteAbortsWriters(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	injected := moerr.NewInternalErrorNoCtx("injected write fault")
+
+	// rewrite fails the writes of the failAt-th writer opened, 0 for
+	// none, and returns the objects opened, synced and aborted.
+	rewrite := func(failAt int) (*BackupStats, []string, map[string]int, map[string]int, error) {
+		var mu sync.Mutex
+		var opened []string
+		synced, aborted := make(map[string]int), make(map[string]int)
+		newWriter := func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+			writer, err := blockio.NewBlockWriter(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			opened = append(opened, name)
+			faulty := &faultyWriter{BlockWriterLike: writer}
+			if len(opened) == failAt {
+				faulty.writeErr = injected
+				faulty.tombstoneErr = injected
+			}
+			return &abortableWriter{BlockWriterLike: faulty, name: name,
+				mu: &mu, synced: synced, abort: aborted}, nil
+		}
+		stats := NewBackupStats()
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithBlockWriterFactory(newWriter), WithBackupStats(stats))
+		return stats, opened, synced, aborted, err
+	}
+
+	// Every writer of a rewrite that succeeds is synced, none aborted.
+	stats, opened, synced, aborted, err := rewrite(0)
+	require.NoError(t, err)
+	require.NotEmpty(t, opened)
+	require.Len(t, synced, len(opened))
+	require.Empty(t, aborted)
+	require.Zero(t, stats.Phase(StatsPhaseRewrite).Get(StatAbortedWriters))
+
+	// A write failing after its writer is opened, before its sync,
+	// aborts it. Every writer opened is either synced or aborted, once.
+	stats, opened, synced, aborted, err = rewrite(2)
+	require.ErrorIs(t, err, injected)
+	require.GreaterOrEqual(t, len(opened), 2)
+	require.Equal(t, 1, aborted[opened[1]])
+	require.Zero(t, synced[opened[1]])
+	for _, name := range opened {
+		require.Equal(t, 1, synced[name]+aborted[name], name)
+	}
+	require.Equal(t, int64(len(aborted)), stats.Phase(StatsPhaseRewrite).Get(StatAbortedWriters))
+}
+
+func TestRewriteWriteErrors(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	injected := moerr.NewInternalErrorNoCtx("injected write fault")
+
+	// Each call of the writers fails in turn, the error names the
+	// object it failed on, one the rewrite opened.
+	for _, op := range []string{"write batch", "write tombstone batch", "sync"} {
+		var mu sync.Mutex
+		opened := make([]string, 0)
+		newWriter := func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+			writer, err := blockio.NewBlockWriter(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			opened = append(opened, name)
+			mu.Unlock()
+			faulty := &faultyWriter{BlockWriterLike: writer}
+			switch op {
+			case "write batch":
+				faulty.writeErr = injected
+			case "write tombstone batch":
+				faulty.tombstoneErr = injected
+			default:
+				faulty.err = injected
+			}
+			return faulty, nil
+		}
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithBlockWriterFactory(newWriter))
+		require.ErrorIs(t, err, injected, op)
+		var backupErr *BackupError
+		require.ErrorAs(t, err, &backupErr, op)
+		require.Equal(t, op, backupErr.Op)
+		require.Contains(t, opened, backupErr.Object)
+		require.Contains(t, err.Error(), backupErr.Object)
+	}
+
+	// The error of a converted object says what was written to it.
+	mp := mpool.MustNewZero()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	options := newBackupOptions(WithBlockWriterFactory(
+		func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+			writer, err := blockio.NewBlockWriter(fs, name)
+			return &faultyWriter{BlockWriterLike: writer, err: injected}, err
+		}))
+	_, err := options.writeConverted(ctx, newBackupTestFS(t), name,
+		newInt32Batch(t, mp, []int32{1, 2, 3}), math.MaxUint16)
+	var backupErr *BackupError
+	require.ErrorAs(t, err, &backupErr)
+	require.Equal(t, "sync", backupErr.Op)
+	require.Equal(t, name.String(), backupErr.Object)
+	require.Equal(t, 1, backupErr.Blocks)
+	require.Equal(t, 3, backupErr.Rows)
+	require.Positive(t, backupErr.Bytes)
+	require.Contains(t, err.Error(), name.String())
+}
+
+// benchCheckpointSpec is the workload of the backup benchmarks.
+func benchCheckpointSpec() checkpointSpec {
+	spec := defaultCheckpointSpec()
+	spec.Tables = 4
+	spec.BlocksPerTable = 16
+	spec.RowsPerBlock = 8192
+	spec.TombstoneDensity = 0.1
+	return spec
+}
+
+func BenchmarkCollectObjectsData(b *testing.B) {
+	fixture := newCheckpointFixture(b, benchCheckpointSpec())
+	data, objectsData := fixture.loadObjectsData(b)
+	defer data.Close()
+	freeObjectsData(objectsData)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		collectObjectsData(data, fixture.spec.Pivot)
+	}
+}
+
+func BenchmarkTrimObjectsData(b *testing.B) {
+	for _, unordered := range []bool{false, true} {
+		name := "ordered"
+		if unordered {
+			name = "unordered"
+		}
+		b.Run(name, func(b *testing.B) {
+			spec := benchCheckpointSpec()
+			spec.Unordered = unordered
+			fixture := newCheckpointFixture(b, spec)
+			data, objectsData := fixture.loadObjectsData(b)
+			defer data.Close()
+			options := newBackupOptions()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := trimObjectsData(context.Background(), fixture.fs, spec.Pivot, &objectsData, options)
+				require.NoError(b, err)
+				b.StopTimer()
+				freeObjectsData(objectsData)
+				objectsData = collectObjectsData(data, spec.Pivot)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkApplyDelete(b *testing.B) {
+	spec := benchCheckpointSpec()
+	mp := mpool.MustNewZero()
+	col := make([]int32, spec.RowsPerBlock)
+	for i := range col {
+		col[i] = int32(i)
+	}
+	data := newInt32Batch(b, mp, col, col)
+	defer data.Clean(mp)
+	blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	other := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	// The tombstone deletes from another block as much as from this one.
+	stride := int(1 / spec.TombstoneDensity)
+	rowids := make([]types.Rowid, 0, 2*spec.RowsPerBlock/stride)
+	for row := 0; row < spec.RowsPerBlock; row += stride {
+		rowids = append(rowids, *types.NewRowid(blkID, uint32(row)), *types.NewRowid(other, uint32(row)))
+	}
+	deletes := batch.NewWithSize(1)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(b, vector.AppendFixedList(deletes.Vecs[0], rowids, nil, mp))
+	deletes.SetRowCount(len(rowids))
+	defer deletes.Clean(mp)
+	id := blkID.String()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		bat, err := data.Dup(mp)
+		require.NoError(b, err)
+		b.StartTimer()
+		_, _, err = applyDelete(bat, deletes, id)
+		require.NoError(b, err)
+		b.StopTimer()
+		bat.Clean(mp)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkApplyDeleteJoin(b *testing.B) {
+	mp := mpool.MustNewZero()
+	const rows = 1 << 16
+	col := make([]int32, rows)
+	for i := range col {
+		col[i] = int32(i)
+	}
+	data := newInt32Batch(b, mp, col)
+	defer data.Clean(mp)
+	blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	// A large tombstone deleting every other row, in rowid order.
+	rowids := make([]types.Rowid, 0, rows/2)
+	for row := 0; row < rows; row += 2 {
+		rowids = append(rowids, *types.NewRowid(blkID, uint32(row)))
+	}
+	deletes := batch.NewWithSize(1)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(b, vector.AppendFixedList(deletes.Vecs[0], rowids, nil, mp))
+	deletes.SetRowCount(len(rowids))
+	defer deletes.Clean(mp)
+	id := blkID.String()
+	for _, join := range []struct {
+		name string
+		join DeleteJoin
+	}{{"hash", DeleteJoinHash}, {"merge", DeleteJoinMerge}} {
+		b.Run(join.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				bat, err := data.Dup(mp)
+				require.NoError(b, err)
+				b.StartTimer()
+				_, _, err = applyDeleteJoin(join.join, bat, deletes, id)
+				require.NoError(b, err)
+				b.StopTimer()
+				bat.Clean(mp)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkReWriteCheckpoint(b *testing.B) {
+	fixture := newCheckpointFixture(b, benchCheckpointSpec())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dstFs := newBackupTestFS(b)
+		b.StartTimer()
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(context.Background(), "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, fixture.spec.Pivot, nil)
+		require.NoError(b, err)
+	}
+}
+
+func TestRewriteCorruptLocation(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.CorruptDeltaLocs = 1
+	fixture := newCheckpointFixture(t, spec)
+
+	_, _, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.True(t, IsCorruptLocation(err), err)
+
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.True(t, IsCorruptLocation(err), err)
+	corrupt := err.(*CorruptLocationError)
+	require.Equal(t, BLKMetaInsertIDX, corrupt.Batch)
+	require.Equal(t, catalog.BlockMeta_DeltaLoc, corrupt.Attr)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	deltaLoc := data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(corrupt.Row).([]byte)
+	// IsEmpty alone takes the truncated location for an empty one.
+	require.True(t, objectio.Location(deltaLoc).IsEmpty())
+	require.Len(t, deltaLoc, objectio.LocationLen/2)
+
+	result := &RewriteResult{}
+	stats := NewBackupStats()
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupStats(stats), WithLenientLocations())
+	require.NoError(t, err)
+	require.Equal(t, []*CorruptLocationError{corrupt}, result.CorruptLocations)
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseVerify).Get(StatCorruptLocations))
+
+	// The row is dropped, the other locations are all valid.
+	rewritten, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	blkMeta := rewritten.bats[BLKMetaInsertIDX]
+	require.Equal(t, fixture.tombstones-1, blkMeta.Length())
+	require.Equal(t, fixture.tombstones-1, rewritten.bats[BLKMetaInsertTxnIDX].Length())
+	require.NoError(t, rewritten.ForEachBlockMeta(func(view BlockMetaView) error {
+		require.Nil(t, validateBlockMeta(view))
+		return nil
+	}))
+}
+
+// entrySummary is what a listed entry tells the copy, keyed by object.
+func entrySummary(locations []*objectio.BackupObject) map[string]string {
+	summary := make(map[string]string, len(locations))
+	for _, bo := range locations {
+		summary[bo.Location.Name().String()] = fmt.Sprintf("%s %v %s %s",
+			bo.Location.String(), bo.NeedCopy, bo.CrateTS.ToString(), bo.DropTS.ToString())
+	}
+	return summary
+}
+
+func TestScanCheckpointEntries(t *testing.T) {
+	ctx := context.Background()
+	session, err := NewBackupSession(ctx, newBackupTestFS(t))
+	require.NoError(t, err)
+
+	// The session scans a chain, the vectors of the first checkpoint are
+	// reused for the second one.
+	for _, seed := range []int64{1, 2} {
+		spec := defaultCheckpointSpec()
+		spec.Seed = seed
+		spec.Tables = int(seed) + 1
+		fixture := newCheckpointFixture(t, spec)
+		for _, baseTS := range []types.TS{{}, spec.Pivot} {
+			full := NewSoftDeletes()
+			expected, data, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+				CheckpointCurrentVersion, full, &baseTS)
+			require.NoError(t, err)
+			data.Close()
+
+			scanned := NewSoftDeletes()
+			locations, err := session.ScanCheckpointEntries(ctx, "", fixture.fs, fixture.cnLocation,
+				CheckpointCurrentVersion, scanned, &baseTS)
+			require.NoError(t, err)
+			require.Equal(t, entrySummary(expected), entrySummary(locations))
+			require.Equal(t, full.Len(), scanned.Len())
+			require.Equal(t, spec.Tables*spec.aBlocksPerTable(), scanned.Len())
+		}
+	}
+
+	spec := defaultCheckpointSpec()
+	spec.CorruptDeltaLocs = 1
+	fixture := newCheckpointFixture(t, spec)
+	_, err = session.ScanCheckpointEntries(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.True(t, IsCorruptLocation(err), err)
+	corrupt := err.(*CorruptLocationError)
+	require.Equal(t, BLKMetaInsertIDX, corrupt.Batch)
+	require.Equal(t, catalog.BlockMeta_DeltaLoc, corrupt.Attr)
+}
+
+func TestLoadCheckpointEntriesSoftDeleteLayers(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	all, data, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.NoError(t, err)
+	defer data.Close()
+
+	// An nBlock and an aBlock soft-deleted by an earlier checkpoint, the
+	// aBlock is one this checkpoint drops as well.
+	var earlier []objectio.ObjectName
+	var own []objectio.ObjectName
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		name := objectio.ObjectName(bytes.Clone(stats.ObjectName()))
+		isABlock := objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool)
+		switch {
+		case len(earlier) == 0 && !isABlock:
+			earlier = append(earlier, name)
+		case len(earlier) == 1 && isABlock:
+			earlier = append(earlier, name)
+		case isABlock:
+			own = append(own, name)
+		}
+	}
+	require.Len(t, earlier, 2)
+	require.NotEmpty(t, own)
+	incoming := func() *SoftDeletes {
+		softDeletes := NewSoftDeletes()
+		for _, name := range earlier {
+			_, err := softDeletes.Add(ctx, name)
+			require.NoError(t, err)
+		}
+		return softDeletes
+	}
+
+	// The objects soft-deleted earlier are skipped with the tombstones
+	// of their blocks, the rest is listed as without soft deletes.
+	skipped := make(map[string]bool)
+	for _, name := range earlier {
+		skipped[name.String()] = true
+	}
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		blkID := view.Blockid()
+		if skipped[objectio.BuildObjectNameWithObjectID(blkID.Object()).String()] && !view.DeltaLoc().IsEmpty() {
+			skipped[view.DeltaLoc().Name().String()] = true
+		}
+		return nil
+	}))
+	require.Greater(t, len(skipped), len(earlier))
+	expected := entrySummary(all)
+	for name := range skipped {
+		require.Contains(t, expected, name)
+		delete(expected, name)
+	}
+
+	softDeletes := incoming()
+	locations, err := ListCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, softDeletes, &types.TS{})
+	require.NoError(t, err)
+	require.Equal(t, expected, entrySummary(locations))
+	// The aBlocks this checkpoint drops are added to the earlier ones.
+	require.Equal(t, len(earlier)+len(own), softDeletes.Len())
+	for _, name := range own {
+		ok, err := softDeletes.Contains(ctx, name)
+		require.NoError(t, err)
+		require.True(t, ok, name.String())
+	}
+
+	// The paged listing skips and adds the same.
+	softDeletes = incoming()
+	paged := make([]*objectio.BackupObject, 0)
+	require.NoError(t, LoadCheckpointEntriesPaged(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, softDeletes, &types.TS{}, 3, 0, func(page EntryPage) error {
+			paged = append(paged, page.Entries...)
+			return nil
+		}))
+	require.Equal(t, expected, entrySummary(NormalizeLocations(paged)))
+	require.Equal(t, len(earlier)+len(own), softDeletes.Len())
+}
+
+func TestLoadCheckpointLocationEntries(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Tables = 3
+	fixture := newCheckpointFixture(t, spec)
+	for _, baseTS := range []types.TS{{}, spec.Pivot} {
+		full := NewSoftDeletes()
+		expected, fullData, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+			CheckpointCurrentVersion, full, &baseTS)
+		require.NoError(t, err)
+
+		loaded := NewSoftDeletes()
+		locations, data, err := LoadCheckpointLocationEntries(ctx, "", fixture.fs, fixture.cnLocation,
+			CheckpointCurrentVersion, loaded, &baseTS)
+		require.NoError(t, err)
+		require.Equal(t, entrySummary(expected), entrySummary(locations))
+		require.Equal(t, full.Len(), loaded.Len())
+		require.Equal(t, fullData.locations, data.locations)
+
+		// Only the scanColumns are loaded, with every row of their batch.
+		for _, batch := range scanColumns {
+			require.Equal(t, batch.attrs, data.bats[batch.idx].Attrs)
+			require.Equal(t, fullData.bats[batch.idx].Length(), data.bats[batch.idx].Length())
+		}
+		require.Nil(t, data.bats[TBLInsertIDX])
+		metaLocs := data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_MetaLoc)
+		fullMetaLocs := fullData.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_MetaLoc)
+		for i := 0; i < metaLocs.Length(); i++ {
+			require.Equal(t, fullMetaLocs.Get(i), metaLocs.Get(i))
+		}
+		fullData.Close()
+		data.Close()
+	}
+
+	corrupt := defaultCheckpointSpec()
+	corrupt.CorruptDeltaLocs = 1
+	fixture = newCheckpointFixture(t, corrupt)
+	_, data, err := LoadCheckpointLocationEntries(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.True(t, IsCorruptLocation(err), err)
+	require.Nil(t, data)
+}
+
+func TestLoadCheckpointEntriesPaged(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Tables = 4
+	fixture := newCheckpointFixture(t, spec)
+	// The checkpoint is written again in small files, so that its
+	// entries are listed a file at a time.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	cnLocation, _, _, err := data.WriteTo(fixture.fs, 4, 4)
+	data.Close()
+	require.NoError(t, err)
+	meta, err := loadScanMeta(ctx, "", fixture.fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Greater(t, len(meta.locations), 1)
+	meta.Close()
+
+	baseTS := spec.Pivot
+	full := NewSoftDeletes()
+	expected, data, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, cnLocation,
+		CheckpointCurrentVersion, full, &baseTS)
+	require.NoError(t, err)
+	data.Close()
+
+	for _, pageSize := range []int{1, 3, len(expected) * 2} {
+		paged := NewSoftDeletes()
+		var pages []EntryPage
+		var union []*objectio.BackupObject
+		require.NoError(t, LoadCheckpointEntriesPaged(ctx, "", fixture.fs, cnLocation,
+			CheckpointCurrentVersion, paged, &baseTS, pageSize, 0, func(page EntryPage) error {
+				require.LessOrEqual(t, len(page.Entries), pageSize)
+				require.Equal(t, len(pages), page.Index)
+				pages = append(pages, page)
+				union = append(union, page.Entries...)
+				return nil
+			}))
+		require.Equal(t, entrySummary(expected), entrySummary(NormalizeLocations(union)), pageSize)
+		require.Equal(t, full.Len(), paged.Len())
+		if pageSize > 1 {
+			continue
+		}
+
+		// A listing stopped after the second page resumes from the third,
+		// the objects of the pages skipped are still soft deleted.
+		resumed := NewSoftDeletes()
+		var rest []EntryPage
+		require.NoError(t, LoadCheckpointEntriesPaged(ctx, "", fixture.fs, cnLocation,
+			CheckpointCurrentVersion, resumed, &baseTS, pageSize, 2, func(page EntryPage) error {
+				rest = append(rest, page)
+				return nil
+			}))
+		require.Equal(t, pages[2:], rest)
+		require.Equal(t, full.Len(), resumed.Len())
+	}
+
+	err = LoadCheckpointEntriesPaged(ctx, "", fixture.fs, cnLocation,
+		CheckpointCurrentVersion, nil, &baseTS, 0, 0, nil)
+	require.Error(t, err)
+}
+
+// BenchmarkLoadCheckpointChain lists the entries of a chain of
+// checkpoints, loading each in full, loading only the columns read, or
+// scanning them.
+func BenchmarkLoadCheckpointChain(b *testing.B) {
+	ctx := context.Background()
+	fixtures := make([]*checkpointFixture, 20)
+	for i := range fixtures {
+		spec := defaultCheckpointSpec()
+		spec.Tables = 4
+		spec.BlocksPerTable = 16
+		spec.Seed = int64(i + 1)
+		fixtures[i] = newCheckpointFixture(b, spec)
+	}
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, fixture := range fixtures {
+				_, data, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+					CheckpointCurrentVersion, nil, &types.TS{})
+				require.NoError(b, err)
+				data.Close()
+			}
+		}
+	})
+	b.Run("locations", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, fixture := range fixtures {
+				_, data, err := LoadCheckpointLocationEntries(ctx, "", fixture.fs, fixture.cnLocation,
+					CheckpointCurrentVersion, nil, &types.TS{})
+				require.NoError(b, err)
+				data.Close()
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		session, err := NewBackupSession(ctx, newBackupTestFS(b))
+		require.NoError(b, err)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, fixture := range fixtures {
+				_, err := session.ScanCheckpointEntries(ctx, "", fixture.fs, fixture.cnLocation,
+					CheckpointCurrentVersion, nil, &types.TS{})
+				require.NoError(b, err)
+			}
+		}
+	})
+}
+
+func TestRewriteBlockIDMapping(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The aBlocks of the source checkpoint, by table.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	aBlocks := make(map[types.Blockid]uint64)
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		if !objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool) {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		tid := objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		aBlocks[*objectio.BuildObjectBlockid(stats.ObjectName(), 0)] = tid
+	}
+	require.Equal(t, fixture.aBlocks, len(aBlocks))
+
+	// The mapping is only recorded on demand.
+	result := &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.Empty(t, result.RelocatedBlocks)
+
+	result = &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockIDMapping())
+	require.NoError(t, err)
+
+	// Every aBlock is mapped once, to a block of its converted object.
+	require.Equal(t, len(aBlocks), len(result.RelocatedBlocks))
+	require.True(t, sort.SliceIsSorted(result.RelocatedBlocks, func(i, j int) bool {
+		return result.RelocatedBlocks[i].Source.Less(result.RelocatedBlocks[j].Source)
+	}))
+	relocated := result.RelocatedBlockMap()
+	require.Equal(t, len(aBlocks), len(relocated))
+	converted := make(map[string]bool)
+	for _, name := range result.Files.Converted {
+		converted[name] = true
+	}
+	for _, block := range result.RelocatedBlocks {
+		require.Equal(t, aBlocks[block.Source], block.Table, block.String())
+		require.NotEqual(t, block.Source, block.Converted)
+		name := objectio.BuildObjectNameWithObjectID(block.Converted.Object())
+		require.True(t, converted[name.String()], block.String())
+	}
+
+	// The rewritten checkpoint lists the converted objects under the
+	// table of their aBlock.
+	rewritten, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	listed := make(map[types.Objectid]uint64)
+	objectInfo = rewritten.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		listed[*stats.ObjectName().ObjectId()] = objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+	}
+	for _, block := range result.RelocatedBlocks {
+		tid, ok := listed[*block.Converted.Object()]
+		require.True(t, ok, block.String())
+		require.Equal(t, block.Table, tid)
+	}
+}
+
+// checkFooterStats restores the counts of the rewritten checkpoint at
+// cnLocation the way a restore would, the data rows from the objects
+// themselves, and checks stats, its footer stats, against them.
+func checkFooterStats(
+	t *testing.T,
+	ctx context.Context,
+	fixture *checkpointFixture,
+	dstFs fileservice.FileService,
+	cnLocation objectio.Location,
+	files []string,
+	stats []TableRowStats,
+) {
+	spec := fixture.spec
+	written := make(map[string]bool, len(files))
+	for _, name := range files {
+		written[name] = true
+	}
+	data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+
+	actual := make(map[uint64]uint64)
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		deleteAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		if !deleteAt.IsEmpty() {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		fs := fixture.fs
+		if written[stats.ObjectName().String()] {
+			fs = dstFs
+		}
+		location := stats.ObjectLocation()
+		meta, err := objectio.FastLoadObjectMeta(ctx, &location, false, fs)
+		require.NoError(t, err)
+		dataMeta := meta.MustDataMeta()
+		tid := objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		for b := uint32(0); b < dataMeta.BlockCount(); b++ {
+			actual[tid] += uint64(dataMeta.GetBlockMeta(b).GetRows())
+		}
+	}
+	// The tombstones of the nBlocks keep the rows committed before the
+	// pivot, those of the aBlocks are applied to the converted objects.
+	deletes := uint64(spec.BlocksPerTable-spec.aBlocksPerTable()) *
+		uint64(math.Round(float64(spec.RowsPerBlock)*spec.TombstoneDensity*(1-spec.LateFraction)))
+	for _, stat := range stats {
+		require.Equal(t, uint64(spec.BlocksPerTable), stat.DataBlocks)
+		require.Equal(t, uint64(spec.BlocksPerTable-spec.aBlocksPerTable()), stat.TombstoneBlocks)
+		require.Equal(t, deletes, stat.TombstoneRows)
+		actual[stat.Table] -= deletes
+	}
+	require.Len(t, stats, spec.Tables)
+	require.Empty(t, VerifyRestoreCounts(stats, actual))
+
+	actual[fixtureFirstTable]--
+	require.Equal(t, []RestoreCountDiff{{
+		Table:    fixtureFirstTable,
+		Expected: actual[fixtureFirstTable] + 1,
+		Actual:   actual[fixtureFirstTable],
+	}}, VerifyRestoreCounts(stats, actual))
+}
+
+func TestRewriteCheckpointFooter(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// Not written unless asked for.
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.Empty(t, result.Footer)
+	_, err = ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+
+	result = &RewriteResult{}
+	dstFs = newBackupTestFS(t)
+	cnLocation, tnLocation, files, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	require.Equal(t, CheckpointFooterName(result.Files.Meta), result.Footer)
+
+	footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, backupAuxVersions[BackupAuxFooter], footer.Format)
+	require.Equal(t, []byte(cnLocation), footer.Checkpoint)
+	require.Equal(t, []byte(tnLocation), footer.TNCheckpoint)
+	require.Equal(t, uint32(CheckpointCurrentVersion), footer.Version)
+	require.Equal(t, spec.Pivot, footer.BackupTS())
+	require.Equal(t, []uint64{fixtureFirstTable, fixtureFirstTable + 1}, footer.Tables)
+	checkFooterStats(t, ctx, fixture, dstFs, cnLocation, files, footer.Stats)
+
+	// Every file the rewrite wrote has its checksum, the live objects
+	// of the source are only listed.
+	objects := make(map[string]FooterObject, len(footer.Objects))
+	for _, object := range footer.Objects {
+		objects[object.Name] = object
+	}
+	for _, name := range files {
+		object, ok := objects[name]
+		require.True(t, ok, name)
+		buf, err := readBackupFile(ctx, dstFs, name)
+		require.NoError(t, err)
+		sum := sha256.Sum256(buf)
+		require.Equal(t, hex.EncodeToString(sum[:]), object.Checksum, name)
+		require.Equal(t, int64(len(buf)), object.Size, name)
+	}
+	require.Greater(t, len(objects), len(files))
+	for _, object := range objects {
+		if object.Checksum == "" {
+			_, err = readBackupFile(ctx, fixture.fs, object.Name)
+			require.NoError(t, err, object.Name)
+		}
+	}
+
+	// The footer is an auxiliary file of its own kind.
+	buf, err := readBackupFile(ctx, dstFs, result.Footer)
+	require.NoError(t, err)
+	_, _, err = DecodeBackupAux(result.Footer, BackupAuxJournal, buf)
+	require.True(t, IsBackupAuxKindError(err), err)
+	buf[0] = 'X'
+	_, err = DecodeCheckpointFooter(result.Footer, buf)
+	require.Error(t, err)
+
+	// The stats count what a row filter kept, from the rewritten meta.
+	// The same checkpoint is built again, the objects converted from the
+	// first one have the same names and their meta is cached.
+	even := func(bat *batch.Batch, row int) bool {
+		return vector.GetFixedAt[int32](bat.Vecs[0], row)%2 == 0
+	}
+	fixture = newCheckpointFixture(t, spec)
+	result = &RewriteResult{}
+	dstFs = newBackupTestFS(t)
+	cnLocation, _, files, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter(), WithRowFilter(even))
+	require.NoError(t, err)
+	filtered, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	checkFooterStats(t, ctx, fixture, dstFs, cnLocation, files, filtered.Stats)
+	for i := range filtered.Stats {
+		require.Less(t, filtered.Stats[i].DataRows, footer.Stats[i].DataRows)
+	}
+}
+
+func TestRewriteRestoreManifest(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	require.True(t, json.Valid([]byte(RestoreManifestJSONSchema)))
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, tnLocation, files, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter(), WithRestoreManifest())
+	require.NoError(t, err)
+	require.Equal(t, RestoreManifestName(result.Files.Meta), result.Manifest)
+
+	manifest, err := ReadRestoreManifest(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, RestoreManifestSchema, manifest.Schema)
+	require.Equal(t, RestoreManifestVersion, manifest.Version)
+	require.Equal(t, cnLocation.String(), manifest.Entrypoint.Checkpoint)
+	require.Equal(t, tnLocation.String(), manifest.Entrypoint.TNCheckpoint)
+	require.Equal(t, uint32(CheckpointCurrentVersion), manifest.Entrypoint.CheckpointVersion)
+	require.Equal(t, spec.Pivot.ToString(), manifest.Entrypoint.TS)
+
+	// Every file the rewrite wrote, but the manifest itself, is listed
+	// exactly once with its size and checksum.
+	listed := make(map[string]ManifestFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		_, ok := listed[file.Path]
+		require.False(t, ok, file.Path)
+		listed[file.Path] = file
+	}
+	written := listBackupTestFS(t, ctx, dstFs, "")
+	require.Len(t, listed, len(written)-1)
+	for _, name := range written {
+		if name == result.Manifest {
+			continue
+		}
+		file, ok := listed[name]
+		require.True(t, ok, name)
+		buf, err := readBackupFile(ctx, dstFs, name)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(buf)), file.Size, name)
+		require.Equal(t, "crc32c", file.Checksum.Algorithm)
+		require.Equal(t, fmt.Sprintf("%08x", crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))),
+			file.Checksum.Value, name)
+	}
+	for _, name := range files {
+		require.NotEqual(t, ManifestRoleAuxiliary, listed[name].Role, name)
+	}
+	require.Equal(t, ManifestRoleAuxiliary, listed[result.Footer].Role)
+	// The checkpoint is restored last.
+	require.Equal(t, result.Files.Meta, manifest.Files[len(files)-1].Path)
+
+	// A manifest of a newer version is refused.
+	manifest.Version = RestoreManifestVersion + 1
+	buf, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, dstFs.Delete(ctx, result.Manifest))
+	require.NoError(t, writeBackupFile(ctx, dstFs, result.Manifest, buf))
+	_, err = ReadRestoreManifest(ctx, dstFs, result.Files.Meta)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported), err)
+}
+
+func TestRewriteManifestSHA256(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...BackupOption) (fileservice.FileService, *RewriteResult) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result), WithCheckpointFooter())...)
+		require.NoError(t, err)
+		return dstFs, result
+	}
+
+	// Every file, the objects and the checkpoint, has its sha256.
+	dstFs, result := rewrite(WithManifestSHA256())
+	manifest, err := ReadRestoreManifest(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	for _, file := range manifest.Files {
+		buf, err := readBackupFile(ctx, dstFs, file.Path)
+		require.NoError(t, err)
+		sum := sha256.Sum256(buf)
+		require.Equal(t, hex.EncodeToString(sum[:]), file.SHA256, file.Path)
+	}
+	check, err := VerifyManifestSHA256(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.True(t, check.OK())
+	require.Equal(t, len(manifest.Files), check.Checked)
+
+	// A byte flipped in an object is reported, its size is the same.
+	name := result.Files.Rewritten[0]
+	buf, err := readBackupFile(ctx, dstFs, name)
+	require.NoError(t, err)
+	buf[len(buf)/2] ^= 0xff
+	require.NoError(t, writeBackupFile(ctx, dstFs, name, buf))
+	check, err = VerifyManifestSHA256(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.False(t, check.OK())
+	require.Len(t, check.Mismatched, 1)
+	require.Equal(t, name, check.Mismatched[0].Path)
+	require.Empty(t, check.Missing)
+	sizes, err := VerifyBackup(ctx, dstFs, result.Footer)
+	require.NoError(t, err)
+	require.Empty(t, sizes.Mismatched)
+
+	// A manifest written without sums has every file unhashed.
+	dstFs, result = rewrite(WithRestoreManifest())
+	check, err = VerifyManifestSHA256(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.False(t, check.OK())
+	require.Zero(t, check.Checked)
+	require.NotEmpty(t, check.Unhashed)
+}
+
+func TestRewriteCheckpointEnd(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...BackupOption) (*RewriteResult, error) {
+		result := &RewriteResult{}
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result), WithCheckpointFooter())...)
+		return result, err
+	}
+
+	// Not stamped unless asked for, the footer ends at the backup ts.
+	dstFs := newBackupTestFS(t)
+	result := &RewriteResult{}
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	require.True(t, result.CheckpointEnd.IsEmpty())
+	footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.Empty(t, footer.End)
+	require.Equal(t, spec.Pivot, footer.EndTS())
+
+	// An empty end is the ts of the rewrite.
+	dstFs = newBackupTestFS(t)
+	result = &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter(), WithCheckpointEnd(types.TS{}))
+	require.NoError(t, err)
+	require.Equal(t, spec.Pivot, result.CheckpointEnd)
+	footer, err = ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, spec.Pivot, footer.EndTS())
+
+	// The end cannot be before the rows kept, nor cover the first late
+	// row the trim dropped, one tick after the pivot.
+	early := types.BuildTS(spec.Pivot.Physical()-1, 0)
+	_, err = rewrite(WithCheckpointEnd(early))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	firstLate := types.BuildTS(spec.Pivot.Physical()+1, 0)
+	_, err = rewrite(WithCheckpointEnd(firstLate))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	_, err = PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithCheckpointEnd(firstLate))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	justBefore := spec.Pivot.Next()
+	require.True(t, justBefore.Less(&firstLate))
+	result, err = rewrite(WithCheckpointEnd(justBefore))
+	require.NoError(t, err)
+	require.Equal(t, justBefore, result.CheckpointEnd)
+
+	// Taken past the late rows, nothing is trimmed and any later end is
+	// consistent.
+	backupTS := types.BuildTS(spec.Pivot.Physical()+int64(spec.RowsPerBlock), 0)
+	end := types.BuildTS(backupTS.Physical()+1, 0)
+	result = &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, backupTS, nil,
+		WithRewriteResult(result), WithCheckpointFooter(), WithCheckpointEnd(end))
+	require.NoError(t, err)
+	require.Empty(t, result.Files.Tombstones)
+	require.Equal(t, end, result.CheckpointEnd)
+}
+
+func TestRewriteSoftDeleteConflicts(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	var dropped, live []objectio.ObjectName
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		deletedAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		if deletedAt.IsEmpty() {
+			live = append(live, stats.ObjectName())
+		} else {
+			dropped = append(dropped, stats.ObjectName())
+		}
+	}
+	require.Equal(t, fixture.aBlocks, len(dropped))
+	require.Equal(t, fixture.nBlocks, len(live))
+
+	softDeletes := func(names ...[]objectio.ObjectName) *SoftDeletes {
+		set := NewSoftDeletes()
+		for _, list := range names {
+			for _, name := range list {
+				_, err := set.Add(ctx, name)
+				require.NoError(t, err)
+			}
+		}
+		return set
+	}
+	rewrite := func(set *SoftDeletes, opts ...BackupOption) (*RewriteResult, *BackupStats, error) {
+		result := &RewriteResult{}
+		stats := NewBackupStats()
+		opts = append(opts, WithRewriteResult(result), WithBackupStats(stats))
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, set, opts...)
+		return result, stats, err
+	}
+	conflicts := func(kind SoftDeleteConflictKind, names []objectio.ObjectName) []SoftDeleteConflict {
+		conflicts := make([]SoftDeleteConflict, 0, len(names))
+		for _, name := range names {
+			conflicts = append(conflicts, SoftDeleteConflict{Object: name.String(), Kind: kind})
+		}
+		sort.Slice(conflicts, func(i, j int) bool {
+			return conflicts[i].Object < conflicts[j].Object
+		})
+		return conflicts
+	}
+
+	// The soft deletes agree with the checkpoint.
+	result, _, err := rewrite(softDeletes(dropped))
+	require.NoError(t, err)
+	require.Empty(t, result.SoftDeleteConflicts)
+
+	// A stale map misses the objects the checkpoint drops.
+	result, stats, err := rewrite(softDeletes())
+	require.NoError(t, err)
+	require.Equal(t, conflicts(SoftDeleteMissing, dropped), result.SoftDeleteConflicts)
+	softDeleteWarnings := 0
+	for _, warning := range stats.Warnings() {
+		if warning.Code == WarnSoftDeleteConflict {
+			softDeleteWarnings++
+		}
+	}
+	require.Equal(t, len(dropped), softDeleteWarnings)
+
+	// An over-eager map also deletes the live objects.
+	result, _, err = rewrite(softDeletes(dropped, live))
+	require.NoError(t, err)
+	require.Equal(t, conflicts(SoftDeleteOfLiveObject, live), result.SoftDeleteConflicts)
+
+	result, _, err = rewrite(softDeletes(dropped, live), WithStrictSoftDeletes())
+	require.True(t, IsSoftDeleteConflict(err), err)
+	require.Equal(t, result.SoftDeleteConflicts, err.(*SoftDeleteConflictError).Conflicts)
+	require.Zero(t, result.WrittenObjects)
+}
+
+func TestRewritePartlyReferencedObject(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+
+	// The tombstone of an nBlock is moved to block 1 of an object whose
+	// block 0 holds the deletes of an object an earlier checkpoint soft
+	// deleted, which the checkpoint no longer references.
+	blkMeta, blkMetaTxn := data.bats[BLKMetaInsertIDX], data.bats[BLKMetaInsertTxnIDX]
+	row := -1
+	for i := 0; i < blkMeta.Length(); i++ {
+		if !blkMeta.GetVectorByName(catalog.BlockMeta_EntryState).Get(i).(bool) {
+			row = i
+			break
+		}
+	}
+	require.NotEqual(t, -1, row)
+	blkID := blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(row).(types.Blockid)
+	source := objectio.Location(blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(row).([]byte))
+	live, err := blockio.LoadOneBlock(ctx, fixture.fs, source, objectio.SchemaTombstone)
+	require.NoError(t, err)
+
+	mp := mpool.MustNewZero()
+	softDeleted := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	dead := batch.NewWithSize(4)
+	dead.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	dead.Vecs[1] = vector.NewVec(types.T_TS.ToType())
+	dead.Vecs[2] = vector.NewVec(types.T_int32.ToType())
+	dead.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+	deadRows := 4
+	for i := 0; i < deadRows; i++ {
+		require.NoError(t, vector.AppendFixed(dead.Vecs[0],
+			*types.NewRowid(objectio.BuildObjectBlockid(softDeleted, 0), uint32(i)), false, mp))
+		require.NoError(t, vector.AppendFixed(dead.Vecs[1], types.BuildTS(1, 0), false, mp))
+		require.NoError(t, vector.AppendFixed(dead.Vecs[2], int32(i), false, mp))
+		require.NoError(t, vector.AppendFixed(dead.Vecs[3], false, false, mp))
+	}
+	dead.SetRowCount(deadRows)
+	defer dead.Clean(mp)
+	mixed := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fixture.fs, mixed, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(dead)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(live)
+	require.NoError(t, err)
+	blocks, _, err := writer.Sync(ctx)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	moved := objectio.BuildLocation(mixed, blocks[1].GetExtent(), uint32(live.RowCount()), blocks[1].GetID())
+	blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(row, []byte(moved), false)
+	blkMetaTxn.GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(row, []byte(moved), false)
+	cnLocation, tnLocation, _, err := data.WriteTo(fixture.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	softDeletes := NewSoftDeletes()
+	_, err = softDeletes.Add(ctx, softDeleted)
+	require.NoError(t, err)
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	rewritten, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		cnLocation, tnLocation, CheckpointCurrentVersion, spec.Pivot, softDeletes,
+		WithRewriteResult(result), WithBlockIDMapping())
+	require.NoError(t, err)
+	require.Contains(t, result.Files.Tombstones, mixed.String())
+
+	// Only the live block is written, as block 0, the meta row points
+	// at it and the new number is mapped.
+	rewrittenData, err := getCheckpointData(ctx, "", dstFs, rewritten, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewrittenData.Close()
+	var deltaLoc objectio.Location
+	ids := rewrittenData.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_ID)
+	for i := 0; i < ids.Length(); i++ {
+		if ids.Get(i).(types.Blockid) == blkID {
+			deltaLoc = objectio.Location(rewrittenData.bats[BLKMetaInsertIDX].
+				GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(i).([]byte))
+		}
+	}
+	require.Equal(t, mixed.String(), deltaLoc.Name().String())
+	require.Equal(t, uint16(0), deltaLoc.ID())
+	// The meta is read past the object meta cache, see objectCodecs.
+	extent := deltaLoc.Extent()
+	meta, err := objectio.ReadObjectMeta(ctx, mixed.String(), &extent, fileservice.SkipAllCache, dstFs)
+	require.NoError(t, err)
+	tombstoneMeta := meta.MustGetMeta(objectio.SchemaTombstone)
+	require.Equal(t, uint32(1), tombstoneMeta.BlockCount())
+	expected, err := loadTombstone(ctx, fixture.fs, moved, spec.Pivot)
+	require.NoError(t, err)
+	require.NotEqual(t, deadRows, expected.RowCount())
+	require.Equal(t, uint32(expected.RowCount()), tombstoneMeta.GetBlockMeta(0).GetRows())
+	require.Equal(t, uint32(expected.RowCount()), deltaLoc.Rows())
+	require.Contains(t, result.RelocatedBlocks, RelocatedBlock{
+		Table:     blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Get(row).(uint64),
+		Source:    *objectio.BuildObjectBlockid(mixed, 1),
+		Converted: *objectio.BuildObjectBlockid(mixed, 0),
+	})
+}
+
+// tombstoneRows returns the rows of the tombstone block bat, in the
+// current layout, as offset/pk@commitTs.
+func tombstoneRows(t testing.TB, bat *batch.Batch) []string {
+	rows := make([]string, 0, bat.RowCount())
+	rowids := vector.MustFixedCol[types.Rowid](bat.Vecs[currentTombstoneLayout.rowid])
+	commits := vector.MustFixedCol[types.TS](bat.Vecs[currentTombstoneLayout.commitTsIdx(len(bat.Vecs))])
+	pks := vector.MustFixedCol[int32](bat.Vecs[currentTombstoneLayout.pkIdx(len(bat.Vecs))])
+	for i := range rowids {
+		_, offset, err := decodeRowid(rowids[i][:])
+		require.NoError(t, err)
+		rows = append(rows, fmt.Sprintf("%d/%d@%s", offset, pks[i], commits[i].ToString()))
+	}
+	return rows
+}
+
+func TestLegacyTombstoneLayout(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Unordered = true
+	legacySpec := spec
+	legacySpec.LegacyTombstones = true
+
+	type outcome struct {
+		trimmed []string
+		files   [3]int
+	}
+	run := func(spec checkpointSpec) outcome {
+		fixture := newCheckpointFixture(t, spec)
+		var out outcome
+
+		data, objectsData := fixture.loadObjectsData(t)
+		defer data.Close()
+		defer freeObjectsData(objectsData)
+		for _, object := range objectsData {
+			for _, block := range object.data {
+				if block.blockType != objectio.SchemaTombstone {
+					continue
+				}
+				_, layout, err := readTombstoneMeta(ctx, fixture.fs, block.location)
+				require.NoError(t, err)
+				if spec.LegacyTombstones {
+					require.Equal(t, legacyTombstoneLayout, layout)
+				} else {
+					require.Equal(t, currentTombstoneLayout, layout)
+				}
+				late, _, err := tombstoneHasLateRows(ctx, fixture.fs, block.location, spec.Pivot)
+				require.NoError(t, err)
+				require.True(t, late)
+				// The verify path finds every rowid whatever the layout.
+				dangling, err := countTombstoneRows(ctx, fixture.fs, block.location,
+					func(*types.Rowid) bool { return false })
+				require.NoError(t, err)
+				require.Equal(t, int(block.location.Rows()), dangling)
+			}
+		}
+		_, err := trimObjectsData(ctx, fixture.fs, spec.Pivot, &objectsData, newBackupOptions())
+		require.NoError(t, err)
+		for _, object := range objectsData {
+			for _, block := range object.data {
+				if block.blockType == objectio.SchemaTombstone && block.data != nil {
+					out.trimmed = append(out.trimmed, tombstoneRows(t, block.data)...)
+				}
+			}
+		}
+		sort.Strings(out.trimmed)
+
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result))
+		require.NoError(t, err)
+		out.files = [3]int{len(result.Files.Converted), len(result.Files.Rewritten), len(result.Files.Tombstones)}
+		return out
+	}
+
+	current := run(spec)
+	legacy := run(legacySpec)
+	require.NotEmpty(t, current.trimmed)
+	require.Equal(t, current, legacy)
+}
+
+func TestRewriteBestEffort(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	var hung string
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length() && hung == ""; i++ {
+		if objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool) {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+			hung = stats.ObjectName().String()
+		}
+	}
+	data.Close()
+	require.NotEmpty(t, hung)
+
+	// The reads of one aBlock hang until they are given up.
+	srcFs := newCountingFS(fixture.fs)
+	var attempts atomic.Int32
+	srcFs.onRead = func(ctx context.Context, name string) error {
+		if name != hung {
+			return nil
+		}
+		attempts.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	bestEffort := NewBestEffort(20*time.Millisecond, 1)
+	session, err := NewBackupSession(ctx, newBackupTestFS(t), WithBestEffort(bestEffort))
+	require.NoError(t, err)
+	result := &RewriteResult{}
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", srcFs, session.dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupSession(session))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), attempts.Load())
+	require.True(t, result.Partial)
+	require.Equal(t, 1, len(result.Skipped))
+	require.Equal(t, hung, result.Skipped[0].Name)
+	require.Contains(t, result.Skipped[0].Reason, context.DeadlineExceeded.Error())
+	require.Equal(t, []SkippedObject{{Name: hung, Reason: result.Skipped[0].Reason}},
+		bestEffort.Skipped())
+	// The other aBlocks are converted.
+	require.Equal(t, fixture.aBlocks-1, len(result.Files.Converted))
+	// The hung aBlock could not be trimmed, the checkpoint drops it
+	// rather than keep its rows after the ts.
+	require.True(t, result.Skipped[0].Dropped)
+	require.Equal(t, MoveDropped, result.Stats.Moves[hung].Kind)
+	rewritten, err := getCheckpointData(ctx, "", session.dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	rewritten.FormatData(common.CheckpointAllocator)
+	require.NotContains(t, checkpointReferences(rewritten), hung)
+
+	// A strict rewrite fails on the same object.
+	injected := moerr.NewInternalErrorNoCtx("injected read fault")
+	srcFs.onRead = func(ctx context.Context, name string) error {
+		if name == hung {
+			return injected
+		}
+		return nil
+	}
+	result = &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", srcFs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.ErrorIs(t, err, injected)
+	require.False(t, result.Partial)
+}
+
+func TestRewriteInjectedFaultsFreeEverything(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Unordered = true
+	fixture := newCheckpointFixture(t, spec)
+	allocator := common.CheckpointAllocator
+	injected := moerr.NewInternalErrorNoCtx("injected fault")
+
+	// Each fault fails the rewrite at its nth chance, n grows until the
+	// rewrite no longer gets to fail, which takes every error path the
+	// fault leads to.
+	faults := map[string]func(n int32, srcFs, dstFs *countingFS, cancel context.CancelFunc) []BackupOption{
+		"read": func(n int32, srcFs, _ *countingFS, _ context.CancelFunc) []BackupOption {
+			var reads atomic.Int32
+			srcFs.onRead = func(context.Context, string) error {
+				if reads.Add(1) == n {
+					return injected
+				}
+				return nil
+			}
+			return nil
+		},
+		"write": func(n int32, _, dstFs *countingFS, _ context.CancelFunc) []BackupOption {
+			var writes atomic.Int32
+			dstFs.onWrite = func(string) error {
+				if writes.Add(1) == n {
+					return injected
+				}
+				return nil
+			}
+			return nil
+		},
+		"cancel": func(n int32, srcFs, _ *countingFS, cancel context.CancelFunc) []BackupOption {
+			var reads atomic.Int32
+			srcFs.onRead = func(context.Context, string) error {
+				if reads.Add(1) == n {
+					cancel()
+				}
+				return nil
+			}
+			return nil
+		},
+		"export": func(n int32, _, _ *countingFS, _ context.CancelFunc) []BackupOption {
+			var exports atomic.Int32
+			return []BackupOption{WithBlockExporter(
+				func(context.Context, uint64, objectio.ObjectName, *batch.Batch) (string, error) {
+					if exports.Add(1) == n {
+						return "", injected
+					}
+					return "", nil
+				})}
+		},
+	}
+	for name, fault := range faults {
+		for _, batching := range []int{0, 1000} {
+			failed := 0
+			for n := int32(1); ; n++ {
+				srcFs := newCountingFS(fixture.fs)
+				dstFs := newCountingFS(newBackupTestFS(t))
+				faultCtx, cancel := context.WithCancel(ctx)
+				opts := append(fault(n, srcFs, dstFs, cancel), WithABlockBatching(batching))
+				_, _, _, err := ReWriteCheckpointAndBlockFromKey(faultCtx, "", srcFs, dstFs,
+					fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil, opts...)
+				cancel()
+				require.Empty(t, allocator.Leaks(), "%s fault %d, batching %d: %v", name, n, batching, err)
+				if err == nil {
+					break
+				}
+				failed++
+			}
+			require.NotZero(t, failed, "%s fault, batching %d", name, batching)
+		}
+	}
+
+	// The entries of a checkpoint, its data freed by Close.
+	for n := int32(1); ; n++ {
+		srcFs := newCountingFS(fixture.fs)
+		faults["read"](n, srcFs, nil, nil)
+		_, data, err := LoadCheckpointEntriesFromKey(ctx, "", srcFs, fixture.cnLocation,
+			CheckpointCurrentVersion, nil, &types.TS{})
+		if err == nil {
+			data.Close()
+		}
+		require.Empty(t, allocator.Leaks(), "read fault %d: %v", n, err)
+		if err == nil {
+			require.Greater(t, n, int32(1))
+			break
+		}
+	}
+}
+
+// checkpointContent adds the object info and block meta rows of data to
+// content, by object and by block, a later row overriding an earlier
+// one as it does when checkpoints are replayed.
+func checkpointContent(data *CheckpointData, content map[string]string) map[string]string {
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		content["object "+stats.ObjectName().String()] = rowKey([]*containers.Batch{objectInfo}, i)
+	}
+	blkMeta, blkMetaTxn := data.bats[BLKMetaInsertIDX], data.bats[BLKMetaInsertTxnIDX]
+	for i := 0; i < blkMeta.Length(); i++ {
+		blkID := blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid)
+		content["block "+blkID.String()] = rowKey([]*containers.Batch{blkMeta, blkMetaTxn}, i)
+	}
+	return content
+}
+
+func TestRewriteProvenance(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// What the source checkpoint says of its objects.
+	expected := make(map[string]ObjectProvenance)
+	aBlocks := make(map[string]bool)
+	source, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	objectInfo := source.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		object := ObjectProvenance{
+			Source:   stats.ObjectName().String(),
+			Object:   stats.ObjectName().String(),
+			Table:    objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64),
+			CreateAt: objectInfo.GetVectorByName(EntryNode_CreateAt).Get(i).(types.TS).ToString(),
+			CommitTS: objectInfo.GetVectorByName(txnbase.SnapshotAttr_CommitTS).Get(i).(types.TS).ToString(),
+		}
+		if deleteAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS); !deleteAt.IsEmpty() {
+			object.DeleteAt = deleteAt.ToString()
+		}
+		aBlocks[object.Source] = objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool)
+		expected[object.Source] = object
+	}
+	blkMeta, blkMetaTxn := source.bats[BLKMetaInsertIDX], source.bats[BLKMetaInsertTxnIDX]
+	for i := 0; i < blkMeta.Length(); i++ {
+		deltaLoc := objectio.Location(blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(i).([]byte))
+		expected[deltaLoc.Name().String()] = ObjectProvenance{
+			Source:   deltaLoc.Name().String(),
+			Object:   deltaLoc.Name().String(),
+			Table:    blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64),
+			CommitTS: blkMeta.GetVectorByName(catalog.BlockMeta_CommitTs).Get(i).(types.TS).ToString(),
+		}
+	}
+	source.Close()
+	require.Equal(t, fixture.aBlocks+fixture.nBlocks+fixture.tombstones, len(expected))
+
+	for _, batching := range []int{0, 1000} {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithProvenance(), WithCheckpointFooter(), WithABlockBatching(batching))
+		require.NoError(t, err)
+		require.Equal(t, len(expected), len(result.Provenance))
+
+		// The aBlocks are traced to the objects they were converted to,
+		// the other objects keep their names.
+		converted := make(map[string]struct{})
+		for i, object := range result.Provenance {
+			if i > 0 {
+				require.Less(t, result.Provenance[i-1].Source, object.Source)
+			}
+			want := expected[object.Source]
+			if aBlocks[object.Source] {
+				require.NotEqual(t, object.Source, object.Object)
+				require.Contains(t, result.Files.Converted, object.Object)
+				converted[object.Object] = struct{}{}
+				want.Object = object.Object
+			}
+			require.Equal(t, want, object)
+		}
+		require.Equal(t, len(result.Files.Converted), len(converted))
+
+		footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+		require.NoError(t, err)
+		require.Equal(t, result.Provenance, footer.Provenance)
+	}
+
+	// Without the option nothing is recorded.
+	result := &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.Empty(t, result.Provenance)
+}
+
+func TestCheckpointProvenanceRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	source := objectio.MockLocation(objectio.MockObjectName())
+	ts := types.BuildTS(42, 1)
+	prev := &CheckpointProvenance{Hops: []ProvenanceHop{{
+		Source:      "earlier",
+		Version:     CheckpointVersion11,
+		TS:          types.BuildTS(7, 0).ToString(),
+		RewrittenAt: time.Unix(100, 0).UTC(),
+		Build:       "older build",
+	}}}
+	rewrittenAt := time.Unix(200, 0)
+	require.NoError(t, writeCheckpointProvenance(ctx, fs, prev, source, CheckpointCurrentVersion, ts, "meta", false,
+		rewrittenAt))
+
+	provenance, err := ReadCheckpointProvenance(ctx, fs, "meta")
+	require.NoError(t, err)
+	require.Len(t, provenance.Hops, 2)
+	require.Equal(t, prev.Hops[0], provenance.Hops[0])
+	hop := provenance.Hops[1]
+	require.Equal(t, source.String(), hop.Source)
+	require.Equal(t, CheckpointCurrentVersion, hop.Version)
+	require.Equal(t, ts, types.StringToTS(hop.TS))
+	require.Equal(t, backupAuxBuild(), hop.Build)
+	require.Equal(t, rewrittenAt.UTC(), hop.RewrittenAt)
+	require.Len(t, prev.Hops, 1)
+
+	// A checkpoint that was not rewritten has none.
+	_, err = ReadCheckpointProvenance(ctx, fs, "other")
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+	provenance, err = loadCheckpointProvenance(ctx, fs, source)
+	require.NoError(t, err)
+	require.Nil(t, provenance)
+}
+
+func TestRewriteAuxCreatedAt(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...BackupOption) (provenance, footer []byte) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append([]BackupOption{WithRewriteResult(result), WithCheckpointFooter()}, opts...)...)
+		require.NoError(t, err)
+		provenance, err = readBackupFile(ctx, dstFs, CheckpointProvenanceName(cnLocation.Name().String()))
+		require.NoError(t, err)
+		footer, err = readBackupFile(ctx, dstFs, result.Footer)
+		require.NoError(t, err)
+		return provenance, footer
+	}
+	createdAt := func(name, kind string, buf []byte) types.TS {
+		header, _, err := DecodeBackupAux(name, kind, buf)
+		require.NoError(t, err)
+		return header.CreatedAt
+	}
+
+	// Without a clock the files are stamped with the backup ts, the
+	// provenance of a rewrite run again is the same bytes.
+	provenance, footer := rewrite()
+	again, _ := rewrite()
+	require.Equal(t, provenance, again)
+	require.Equal(t, spec.Pivot, createdAt("provenance", BackupAuxProvenance, provenance))
+	require.Equal(t, spec.Pivot, createdAt("footer", BackupAuxFooter, footer))
+
+	// With one they are stamped with its time.
+	now := time.Unix(1700000000, 0)
+	provenance, footer = rewrite(WithClock(func() time.Time { return now }))
+	stamp := types.BuildTS(now.UnixNano(), 0)
+	require.Equal(t, stamp, createdAt("provenance", BackupAuxProvenance, provenance))
+	require.Equal(t, stamp, createdAt("footer", BackupAuxFooter, footer))
+	_, payload, err := DecodeBackupAux("provenance", BackupAuxProvenance, provenance)
+	require.NoError(t, err)
+	chain := &CheckpointProvenance{}
+	require.NoError(t, json.Unmarshal(payload, chain))
+	require.Equal(t, now.UTC(), chain.Hops[len(chain.Hops)-1].RewrittenAt)
+}
+
+func TestRewriteProvenanceChain(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The checkpoint of the cluster has no provenance.
+	_, source, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.NoError(t, err)
+	require.Nil(t, source.Provenance())
+	source.Close()
+
+	// The first hop converts the aBlocks, the checkpoint is written anew.
+	result := &RewriteResult{}
+	firstFs := copyBackupTestFS(t, ctx, fixture.fs)
+	first, firstTN, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, firstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	require.False(t, first.Name().Equal(fixture.cnLocation.Name()))
+	// The second hop reads the tombstones the first one trimmed.
+	require.NotEmpty(t, result.Files.Tombstones)
+	footer, err := ReadCheckpointFooter(ctx, firstFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, CheckpointProvenanceName(first.Name().String()), footer.CheckpointProvenance)
+	provenance, err := ReadCheckpointProvenance(ctx, firstFs, first.Name().String())
+	require.NoError(t, err)
+	require.Len(t, provenance.Hops, 1)
+	require.Equal(t, fixture.cnLocation.String(), provenance.Hops[0].Source)
+	require.Equal(t, CheckpointCurrentVersion, provenance.Hops[0].Version)
+	require.Equal(t, spec.Pivot.ToString(), provenance.Hops[0].TS)
+
+	// The entries scan of the backup surfaces it.
+	_, source, err = LoadCheckpointEntriesFromKey(ctx, "", firstFs, first,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.NoError(t, err)
+	defer source.Close()
+	require.Equal(t, provenance, source.Provenance())
+
+	// The provenance of the second hop records both, from the key or
+	// from the data of the scan.
+	secondTS := spec.Pivot.Next()
+	for _, fromData := range []bool{false, true} {
+		secondFs := newBackupTestFS(t)
+		var second objectio.Location
+		if fromData {
+			second, _, _, err = ReWriteCheckpointAndBlockFromData(ctx, "", firstFs, secondFs,
+				source, true, first, firstTN, CheckpointCurrentVersion, secondTS, nil)
+		} else {
+			second, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", firstFs, secondFs,
+				first, firstTN, CheckpointCurrentVersion, secondTS, nil)
+		}
+		require.NoError(t, err)
+		chain, err := ReadCheckpointProvenance(ctx, secondFs, second.Name().String())
+		require.NoError(t, err)
+		require.Len(t, chain.Hops, 2)
+		require.Equal(t, provenance.Hops[0], chain.Hops[0])
+		require.Equal(t, first.String(), chain.Hops[1].Source)
+		require.Equal(t, secondTS.ToString(), chain.Hops[1].TS)
+		require.False(t, chain.Hops[1].RewrittenAt.Before(chain.Hops[0].RewrittenAt))
+	}
+	require.Len(t, source.Provenance().Hops, 1)
+
+	// A checkpoint kept as it is gets the hop in the destination too.
+	spec.ABlockFraction = 0
+	spec.TombstoneDensity = 0
+	fixture = newCheckpointFixture(t, spec)
+	dstFs := newBackupTestFS(t)
+	kept, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	require.True(t, kept.Name().Equal(fixture.cnLocation.Name()))
+	provenance, err = ReadCheckpointProvenance(ctx, dstFs, kept.Name().String())
+	require.NoError(t, err)
+	require.Len(t, provenance.Hops, 1)
+	require.Equal(t, fixture.cnLocation.String(), provenance.Hops[0].Source)
+}
+
+func TestPlanRewrite(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The aBlocks are converted or dropped, the checkpoint still
+	// refers to their source objects in the rows it deletes.
+	aBlocks := make(map[string]bool)
+	source, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	for name, objectData := range collectObjectsData(source, spec.Pivot) {
+		aBlocks[name] = objectData.isABlock
+	}
+	source.Close()
+
+	for _, batching := range []int{0, spec.RowsPerBlock + 1} {
+		plan, err := PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation,
+			CheckpointCurrentVersion, spec.Pivot, nil, WithABlockBatching(batching))
+		require.NoError(t, err)
+		require.True(t, plan.Changed)
+
+		result := &RewriteResult{}
+		stats := NewBackupStats()
+		dstFs := newBackupTestFS(t)
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithBackupStats(stats), WithCheckpointFooter(),
+			WithABlockBatching(batching))
+		require.NoError(t, err)
+		require.Equal(t, len(result.Files.Rewritten), plan.Rewritten)
+		relocated := len(result.Files.Converted) +
+			int(stats.Phase(StatsPhaseRewrite).Get(StatBatchedABlocks))
+		require.Equal(t, relocated, plan.Relocated)
+		require.Equal(t, spec.Tables*spec.aBlocksPerTable(), plan.Relocated+plan.Dropped)
+
+		// The other objects the rewritten checkpoint refers to that it
+		// did not write are passed through.
+		footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+		require.NoError(t, err)
+		written := make(map[string]bool)
+		for _, name := range result.Files.All() {
+			written[name] = true
+		}
+		passedThrough := 0
+		for _, object := range footer.Objects {
+			if !written[object.Name] && !aBlocks[object.Name] {
+				passedThrough++
+			}
+		}
+		require.Equal(t, passedThrough, plan.PassedThrough)
+	}
+
+	// Nothing to trim, the checkpoint is kept with all of its objects.
+	spec.ABlockFraction = 0
+	spec.TombstoneDensity = 0
+	fixture = newCheckpointFixture(t, spec)
+	plan, err := PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	require.Equal(t, &RewritePlan{PassedThrough: fixture.nBlocks}, plan)
+	kept, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	require.True(t, kept.Name().Equal(fixture.cnLocation.Name()))
+
+	_, err = PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, types.TS{}, nil)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+}
+
+func TestRewriteStagedWrites(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...SessionOption) (map[string]string, *RewriteResult, fileservice.FileService) {
+		dstFs := newBackupTestFS(t)
+		session, err := NewBackupSession(ctx, dstFs, opts...)
+		require.NoError(t, err)
+		result := &RewriteResult{}
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithBackupSession(session), WithRewriteResult(result))
+		require.NoError(t, err)
+		return rewrittenContent(t, ctx, dstFs, cnLocation), result, dstFs
+	}
+	expected, _, _ := rewrite()
+	content, result, dstFs := rewrite(WithStagedWrites(StagedWritesOn))
+	require.Equal(t, expected, content)
+	entries, err := fileservice.SubPath(dstFs, StagedWritesDir).List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	for _, name := range append(result.Files.Converted, result.Files.Rewritten...) {
+		_, err = dstFs.StatFile(ctx, name)
+		require.NoError(t, err)
+	}
+}
+
+// objectCodecs returns the codecs of the column extents of the object
+// name in fs. The meta is read past the object meta cache, which still
+// has the tombstones the rewrite wrote again under their names as they
+// were.
+func objectCodecs(t *testing.T, ctx context.Context, fs fileservice.FileService, name string) map[uint8]int {
+	buf, err := readBackupFile(ctx, fs, name)
+	require.NoError(t, err)
+	extent := objectio.Header(buf).Extent()
+	meta, err := objectio.ReadObjectMeta(ctx, name, &extent, fileservice.SkipAllCache, fs)
+	require.NoError(t, err)
+	codecs := make(map[uint8]int)
+	dataMeta, _ := meta.DataMeta()
+	tombstoneMeta, _ := meta.TombstoneMeta()
+	for _, schemaMeta := range []objectio.ObjectDataMeta{dataMeta, tombstoneMeta} {
+		if schemaMeta == nil {
+			continue
+		}
+		for i := uint32(0); i < schemaMeta.BlockCount(); i++ {
+			blk := schemaMeta.GetBlockMeta(i)
+			for seqnum := uint16(0); seqnum < blk.GetMetaColumnCount(); seqnum++ {
+				codecs[blk.ColumnMeta(seqnum).Location().Alg()]++
+			}
+		}
+	}
+	return codecs
+}
+
+func TestRewriteObjectCompression(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...BackupOption) (*RewriteResult, fileservice.FileService) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result))...)
+		require.NoError(t, err)
+		require.NotEmpty(t, result.Files.Converted)
+		require.NotEmpty(t, result.Files.Tombstones)
+		return result, dstFs
+	}
+	check := func(result *RewriteResult, dstFs fileservice.FileService, data, tombstone uint8) {
+		for _, name := range result.Files.Converted {
+			codecs := objectCodecs(t, ctx, dstFs, name)
+			require.Len(t, codecs, 1, name)
+			require.NotZero(t, codecs[data], name)
+		}
+		for _, name := range result.Files.Tombstones {
+			codecs := objectCodecs(t, ctx, dstFs, name)
+			require.Len(t, codecs, 1, name)
+			require.NotZero(t, codecs[tombstone], name)
+		}
+	}
+
+	// The writers compress everything with lz4 by default.
+	result, dstFs := rewrite()
+	check(result, dstFs, compress.Lz4, compress.Lz4)
+
+	result, dstFs = rewrite(
+		WithObjectCompression(objectio.SchemaData, compress.None, 0),
+		WithObjectCompression(objectio.SchemaTombstone, compress.Lz4, compress.MaxLevel))
+	check(result, dstFs, compress.None, compress.Lz4)
+
+	result, dstFs = rewrite(WithObjectCompression(objectio.SchemaTombstone, compress.None, 0))
+	check(result, dstFs, compress.Lz4, compress.None)
+}
+
+// rewrittenContent returns the checkpoint content of the rewritten
+// checkpoint at cnLocation in fs.
+func rewrittenContent(t *testing.T, ctx context.Context, fs fileservice.FileService, cnLocation objectio.Location) map[string]string {
+	data, err := getCheckpointData(ctx, "", fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	return checkpointContent(data, make(map[string]string))
+}
+
+func TestRewriteFromData(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(data *CheckpointData, keepSource bool, loc objectio.Location, ts types.TS) (map[string]string, error) {
+		dstFs := newBackupTestFS(t)
+		var cnLocation objectio.Location
+		var err error
+		if data == nil {
+			cnLocation, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+				loc, fixture.tnLocation, CheckpointCurrentVersion, ts, nil)
+		} else {
+			cnLocation, _, _, err = ReWriteCheckpointAndBlockFromData(ctx, "", fixture.fs, dstFs,
+				data, keepSource, loc, fixture.tnLocation, CheckpointCurrentVersion, ts, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !loc.IsEmpty() && cnLocation.Name().Equal(loc.Name()) {
+			return nil, nil
+		}
+		return rewrittenContent(t, ctx, dstFs, cnLocation), nil
+	}
+	expected, err := rewrite(nil, false, fixture.cnLocation, spec.Pivot)
+	require.NoError(t, err)
+	require.NotEmpty(t, expected)
+
+	// The data of the entries scan, kept by the caller.
+	_, source, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs, fixture.cnLocation,
+		CheckpointCurrentVersion, nil, &types.TS{})
+	require.NoError(t, err)
+	defer source.Close()
+	before := checkpointContent(source, make(map[string]string))
+	content, err := rewrite(source, true, fixture.cnLocation, spec.Pivot)
+	require.NoError(t, err)
+	require.Equal(t, expected, content)
+	require.Equal(t, before, checkpointContent(source, make(map[string]string)))
+
+	// The rewrite takes the data over.
+	owned, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	content, err = rewrite(owned, false, fixture.cnLocation, spec.Pivot)
+	require.NoError(t, err)
+	require.Equal(t, expected, content)
+	require.Nil(t, owned.bats[ObjectInfoIDX])
+
+	// Also when it fails its checks.
+	owned, err = getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	_, err = rewrite(owned, false, fixture.cnLocation, types.TS{})
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	require.Nil(t, owned.bats[ObjectInfoIDX])
+	_, err = rewrite(nil, false, fixture.cnLocation, types.TS{})
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+
+	// Nothing to trim, the checkpoint is kept, unless it has no location.
+	spec.ABlockFraction = 0
+	spec.TombstoneDensity = 0
+	fixture = newCheckpointFixture(t, spec)
+	content, err = rewrite(nil, false, fixture.cnLocation, spec.Pivot)
+	require.NoError(t, err)
+	require.Nil(t, content)
+	expected = rewrittenContent(t, ctx, fixture.fs, fixture.cnLocation)
+	owned, err = getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	content, err = rewrite(owned, false, nil, spec.Pivot)
+	require.NoError(t, err)
+	require.Equal(t, expected, content)
+}
+
+func TestIncrementalCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The newer checkpoint is the fixture later on: the first nBlock is
+	// merged away and a new table has two nBlocks.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+	b := &fixtureBuilder{
+		t:    t,
+		spec: spec,
+		fs:   fixture.fs,
+		mp:   mpool.MustNewZero(),
+		rng:  rand.New(rand.NewSource(spec.Seed + 1)),
+		data: data,
+		end:  types.BuildTS(spec.Pivot.Physical()+int64(spec.RowsPerBlock)+2, 0),
+	}
+	data.bats[ObjectInfoIDX].GetVectorByName(EntryNode_DeleteAt).Update(spec.aBlocksPerTable(), b.end, false)
+	tid := uint64(fixtureFirstTable + spec.Tables)
+	objStart := data.bats[ObjectInfoIDX].Length()
+	blkStart := data.bats[BLKMetaInsertIDX].Length()
+	for j := 0; j < 2; j++ {
+		blkID, pks := b.addObject(tid, false, int32(j*spec.RowsPerBlock))
+		require.True(t, b.addTombstone(tid, false, blkID, pks))
+	}
+	data.UpdateObjectInsertMeta(tid, int32(objStart), int32(data.bats[ObjectInfoIDX].Length()))
+	data.UpdateBlockInsertBlkMeta(tid, int32(blkStart), int32(data.bats[BLKMetaInsertIDX].Length()))
+	newer, _, _, err := data.WriteTo(fixture.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, files, err := WriteIncrementalCheckpoint(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, CheckpointCurrentVersion, newer, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, cnLocation.Name().String(), files[len(files)-1])
+
+	incremental, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer incremental.Close()
+	// The merged nBlock and the objects and tombstones of the new table.
+	require.Equal(t, 3, incremental.bats[ObjectInfoIDX].Length())
+	require.Equal(t, 2, incremental.bats[BLKMetaInsertIDX].Length())
+	// Only the tables with new rows have a meta.
+	require.Len(t, incremental.meta, 2)
+	require.NotEmpty(t, incremental.meta[fixtureFirstTable].tables[ObjectInfo].locations)
+	require.NotEmpty(t, incremental.meta[tid].tables[BlockInsert].locations)
+
+	baseData, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer baseData.Close()
+	newerData, err := getCheckpointData(ctx, "", fixture.fs, newer, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer newerData.Close()
+	layered := checkpointContent(incremental, checkpointContent(baseData, make(map[string]string)))
+	require.Equal(t, checkpointContent(newerData, make(map[string]string)), layered)
+}
+
+func TestRewriteBlockExporter(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The exporter sees each converted aBlock once, with the rows of
+	// the object it is converted to.
+	exported := make(map[string]int)
+	tables := make(map[uint64]bool)
+	exporter := func(_ context.Context, tid uint64, name objectio.ObjectName, bat *batch.Batch) (string, error) {
+		tables[tid] = true
+		exported[name.String()] += bat.RowCount()
+		return fmt.Sprintf("%d_%s.export", tid, name.String()), nil
+	}
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockExporter(exporter))
+	require.NoError(t, err)
+	require.Equal(t, len(result.Files.Converted), len(exported))
+	require.Equal(t, len(result.Files.Converted), len(result.Exported))
+	require.Equal(t, spec.Tables, len(tables))
+
+	data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	checked := 0
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		rows, ok := exported[stats.ObjectName().String()]
+		if !ok {
+			continue
+		}
+		location := stats.ObjectLocation()
+		meta, err := objectio.FastLoadObjectMeta(ctx, &location, false, dstFs)
+		require.NoError(t, err)
+		require.Equal(t, int(meta.MustDataMeta().GetBlockMeta(0).GetRows()), rows)
+		checked++
+	}
+	require.Equal(t, len(exported), checked)
+
+	// An export that fails fails the rewrite.
+	fixture = newCheckpointFixture(t, spec)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithBlockExporter(func(context.Context, uint64, objectio.ObjectName, *batch.Batch) (string, error) {
+			return "", moerr.NewNotSupportedNoCtx("export")
+		}))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported))
+}
+
+// copyBackupTestFS copies the files of src to a new memory FS, the way
+// a backup copies the objects it does not rewrite.
+func copyBackupTestFS(t *testing.T, ctx context.Context, src fileservice.FileService) fileservice.FileService {
+	dst := newBackupTestFS(t)
+	entries, err := src.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.False(t, entry.IsDir, entry.Name)
+		buf, err := readBackupFile(ctx, src, entry.Name)
+		require.NoError(t, err)
+		require.NoError(t, writeBackupFile(ctx, dst, entry.Name, buf))
+	}
+	return dst
+}
+
+func TestBackupSetExtractTable(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	result := &RewriteResult{}
+	backupFs := copyBackupTestFS(t, ctx, fixture.fs)
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, backupFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	// The tombstones are trimmed in place, under the names the source
+	// metas of the process have.
+	require.NotEmpty(t, result.Files.Tombstones)
+
+	set, err := OpenBackupSet(ctx, backupFs, result.Footer)
+	require.NoError(t, err)
+	require.Equal(t, spec.Pivot, set.Footer().BackupTS())
+	tables := set.Tables()
+	require.Len(t, tables, spec.Tables)
+	require.Equal(t, uint64(fixtureFirstTable), tables[0].ID)
+	require.Empty(t, set.ObjectsForTable(0))
+
+	// Extract all rows of the first table.
+	table := tables[0]
+	objects := set.ObjectsForTable(table.ID)
+	require.Len(t, objects, table.Objects)
+	// The deletes the trimmed tombstones keep are those committed up to
+	// the pivot.
+	deletes := uint32(math.Round(float64(spec.RowsPerBlock) * spec.TombstoneDensity * (1 - spec.LateFraction)))
+	require.Positive(t, deletes)
+	var blocks, rows uint64
+	tombstones := 0
+	for _, object := range objects {
+		require.Equal(t, table.ID, object.Table)
+		tombstones += len(object.Tombstones)
+		meta, err := readObjectMeta(ctx, backupFs,
+			objectio.BuildLocation(object.Name(), object.Stats.Extent(), 0, 0))
+		require.NoError(t, err)
+		for blk := uint16(0); blk < object.Blocks(); blk++ {
+			bat, err := set.ReadBlock(ctx, object, blk)
+			require.NoError(t, err)
+			blocks++
+			rows += uint64(bat.Vecs[0].Length())
+			expected := meta.MustDataMeta().GetBlockMeta(uint32(blk)).GetRows()
+			if _, ok := object.Tombstones[blk]; ok {
+				expected -= deletes
+			}
+			require.Equal(t, int(expected), bat.Vecs[0].Length())
+		}
+	}
+	require.Equal(t, table.Blocks, blocks)
+	require.Equal(t, table.Rows, rows)
+	require.Positive(t, rows)
+	// The deletes of the nBlocks are applied.
+	require.Equal(t, spec.BlocksPerTable-spec.aBlocksPerTable(), tombstones)
+
+	// Only the backup is read, a file missing from it fails.
+	_, err = OpenBackupSet(ctx, newBackupTestFS(t), result.Footer)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+}
+
+// backupSetRows returns the rows of each table of the backup set whose
+// footer is manifest, and checks that every block is sorted by its
+// primary key.
+func backupSetRows(t *testing.T, ctx context.Context, fs fileservice.FileService, manifest string) map[uint64][]string {
+	set, err := OpenBackupSet(ctx, fs, manifest)
+	require.NoError(t, err)
+	rows := make(map[uint64][]string)
+	for _, table := range set.Tables() {
+		for _, object := range set.ObjectsForTable(table.ID) {
+			for blk := uint16(0); blk < object.Blocks(); blk++ {
+				bat, err := set.ReadBlock(ctx, object, blk)
+				require.NoError(t, err)
+				pks := vector.MustFixedCol[int32](bat.Vecs[0])
+				vals := vector.MustFixedCol[int64](bat.Vecs[1])
+				require.True(t, sort.SliceIsSorted(pks, func(i, j int) bool {
+					return pks[i] < pks[j]
+				}), object.Name().String())
+				for i := range pks {
+					rows[table.ID] = append(rows[table.ID], fmt.Sprintf("%d/%d", pks[i], vals[i]))
+				}
+			}
+		}
+		sort.Strings(rows[table.ID])
+	}
+	return rows
+}
+
+func TestRewriteTableSortKeysDeterministic(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.MixedSortKeys = true
+	fixture := newCheckpointFixture(t, spec)
+	require.GreaterOrEqual(t, spec.aBlocksPerTable(), 2)
+
+	// The order of the rows of each converted object of each table, the
+	// names of the objects change from a rewrite to the next.
+	rewrite := func() map[uint64][]string {
+		result := &RewriteResult{}
+		backupFs := copyBackupTestFS(t, ctx, fixture.fs)
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, backupFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithCheckpointFooter(), WithTableSortKeys())
+		require.NoError(t, err)
+		require.NotEmpty(t, result.Files.Tombstones)
+		converted := make(map[string]bool)
+		for _, name := range result.Files.Converted {
+			converted[name] = true
+		}
+		set, err := OpenBackupSet(ctx, backupFs, result.Footer)
+		require.NoError(t, err)
+		orders := make(map[uint64][]string)
+		for _, table := range set.Tables() {
+			for _, object := range set.ObjectsForTable(table.ID) {
+				if !converted[object.Name().String()] {
+					continue
+				}
+				var order []string
+				for blk := uint16(0); blk < object.Blocks(); blk++ {
+					bat, err := set.ReadBlock(ctx, object, blk)
+					require.NoError(t, err)
+					for _, pk := range vector.MustFixedCol[int32](bat.Vecs[0]) {
+						order = append(order, fmt.Sprint(pk))
+					}
+				}
+				orders[table.ID] = append(orders[table.ID], strings.Join(order, ","))
+			}
+			sort.Strings(orders[table.ID])
+		}
+		return orders
+	}
+
+	// Without a schema sort key every aBlock of a table is sorted by the
+	// key of the aBlock with the lowest object name, whichever the
+	// rewrite reaches first.
+	expected := rewrite()
+	require.Len(t, expected, spec.Tables)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, expected, rewrite(), i)
+	}
+}
+
+func TestRewriteColumnProjection(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	projection := map[uint64][]uint16{fixtureFirstTable: {0}}
+	rewrite := func(fixture *checkpointFixture, dstFs fileservice.FileService) (*RewriteResult, error) {
+		result := &RewriteResult{}
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithCheckpointFooter(), WithColumnProjection(projection))
+		return result, err
+	}
+
+	// The nBlocks of the table would be copied with all their columns,
+	// the projection is refused before anything is written.
+	fixture := newCheckpointFixture(t, spec)
+	require.NotZero(t, fixture.nBlocks)
+	dstFs := newBackupTestFS(t)
+	_, err := rewrite(fixture, dstFs)
+	require.True(t, IsProjectionRefused(err), err)
+	var pe *ProjectionRefusedError
+	require.ErrorAs(t, err, &pe)
+	require.Equal(t, uint64(fixtureFirstTable), pe.Table)
+	require.NotEmpty(t, pe.Objects)
+	require.Empty(t, listBackupTestFS(t, ctx, dstFs, ""))
+
+	// A table of aBlocks only is converted through it, the footer
+	// records the projection and the objects it was applied to.
+	spec.ABlockFraction = 1
+	fixture = newCheckpointFixture(t, spec)
+	require.Zero(t, fixture.nBlocks)
+	backupFs := copyBackupTestFS(t, ctx, fixture.fs)
+	result, err := rewrite(fixture, backupFs)
+	require.NoError(t, err)
+	footer, err := ReadCheckpointFooter(ctx, backupFs, result.Files.Meta)
+	require.NoError(t, err)
+	require.NotNil(t, footer.Projection)
+	require.Equal(t, projection, footer.Projection.Tables)
+	require.Len(t, footer.Projection.Objects, spec.aBlocksPerTable())
+	converted := make(map[string]bool)
+	for _, name := range result.Files.Converted {
+		converted[name] = true
+	}
+	projected := make(map[string]bool)
+	for _, name := range footer.Projection.Objects {
+		require.True(t, converted[name], name)
+		projected[name] = true
+	}
+	set, err := OpenBackupSet(ctx, backupFs, result.Footer)
+	require.NoError(t, err)
+	for _, table := range set.Tables() {
+		for _, object := range set.ObjectsForTable(table.ID) {
+			bat, err := set.ReadBlock(ctx, object, 0)
+			require.NoError(t, err)
+			columns := 2
+			if table.ID == fixtureFirstTable {
+				columns = 1
+			}
+			require.Equal(t, table.ID == fixtureFirstTable, projected[object.Name().String()])
+			require.Len(t, bat.Vecs, columns, object.Name().String())
+			// The late rows are trimmed from the projected columns too.
+			require.Less(t, bat.Vecs[0].Length(), spec.RowsPerBlock, object.Name().String())
+		}
+	}
+}
+
+func TestRewriteSessionQuota(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	unbounded := &RewriteResult{}
+	unboundedFs := copyBackupTestFS(t, ctx, fixture.fs)
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, unboundedFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(unbounded), WithCheckpointFooter())
+	require.NoError(t, err)
+
+	// Under a quota of two objects the rewrite stops, each session goes
+	// on from the journal of the one before.
+	backupFs := copyBackupTestFS(t, ctx, fixture.fs)
+	var result *RewriteResult
+	parts := 0
+	for {
+		parts++
+		require.Less(t, parts, 20)
+		session, err := NewBackupSession(ctx, backupFs, WithQuota(0, 2), WithJournal("quota"))
+		require.NoError(t, err)
+		result = &RewriteResult{}
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, backupFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithCheckpointFooter(), WithBackupSession(session))
+		if !IsQuotaExceeded(err) {
+			require.NoError(t, err)
+			break
+		}
+	}
+	require.GreaterOrEqual(t, parts, 2)
+
+	// Together the sessions write what a single unbounded run does.
+	require.Equal(t, len(unbounded.Files.Converted), len(result.Files.Converted))
+	require.Equal(t, len(unbounded.Files.Rewritten), len(result.Files.Rewritten))
+	require.NotEmpty(t, result.Files.Tombstones)
+	require.Equal(t, unbounded.Files.Tombstones, result.Files.Tombstones)
+	require.Equal(t, backupSetRows(t, ctx, unboundedFs, unbounded.Footer),
+		backupSetRows(t, ctx, backupFs, result.Footer))
+}
+
+func TestRewriteABlockBatching(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+
+	var stats *BackupStats
+	rewrite := func(opts ...BackupOption) (*RewriteResult, map[uint64][]string) {
+		fixture := newCheckpointFixture(t, spec)
+		result := &RewriteResult{}
+		stats = NewBackupStats()
+		backupFs := copyBackupTestFS(t, ctx, fixture.fs)
+		opts = append(opts, WithRewriteResult(result), WithCheckpointFooter(), WithBlockIDMapping(),
+			WithBackupStats(stats))
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, backupFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil, opts...)
+		require.NoError(t, err)
+		return result, backupSetRows(t, ctx, backupFs, result.Footer)
+	}
+
+	single, singleRows := rewrite()
+	require.Len(t, single.Files.Converted, spec.Tables*spec.aBlocksPerTable())
+	require.Len(t, singleRows, spec.Tables)
+	require.NotEmpty(t, single.Files.Tombstones)
+	// The rows of an aBlock at the backup ts, its late rows trimmed.
+	kept := spec.RowsPerBlock - int(math.Round(float64(spec.RowsPerBlock)*spec.LateFraction))
+
+	// Under the threshold the aBlocks of a table are converted together,
+	// and a restore sees the same rows.
+	batched, batchedRows := rewrite(WithABlockBatching(kept + 1))
+	require.Len(t, batched.Files.Converted, spec.Tables)
+	require.Equal(t, singleRows, batchedRows)
+	require.Equal(t, int64(spec.Tables*(spec.aBlocksPerTable()-1)),
+		stats.Phase(StatsPhaseRewrite).Get(StatBatchedABlocks))
+	require.Len(t, batched.RelocatedBlocks, spec.Tables*spec.aBlocksPerTable())
+	objects := make(map[uint64]map[types.Objectid]bool)
+	for _, block := range batched.RelocatedBlocks {
+		if objects[block.Table] == nil {
+			objects[block.Table] = make(map[types.Objectid]bool)
+		}
+		objects[block.Table][*block.Converted.Object()] = true
+	}
+	for tid, converted := range objects {
+		require.Len(t, converted, 1, tid)
+	}
+	// The batched objects count for their table.
+	require.Len(t, batched.Tables, spec.Tables)
+	for _, table := range batched.Tables {
+		require.NotZero(t, table.Table)
+	}
+
+	// Over it they are converted one by one.
+	unbatched, unbatchedRows := rewrite(WithABlockBatching(kept))
+	require.Len(t, unbatched.Files.Converted, spec.Tables*spec.aBlocksPerTable())
+	require.Equal(t, singleRows, unbatchedRows)
+}
+
+// replayFactory replays the entries of a catalog without their data.
+type replayFactory struct{}
+
+func (replayFactory) MakeTableFactory() catalog2.TableDataFactory {
+	return func(*catalog2.TableEntry) data.Table { return nil }
+}
+
+func (replayFactory) MakeObjectFactory() catalog2.ObjectDataFactory {
+	return func(*catalog2.ObjectEntry) data.Object { return nil }
+}
+
+func (replayFactory) MakeTombstoneFactory() catalog2.TombstoneFactory {
+	return func(*catalog2.ObjectEntry) data.Tombstone { return nil }
+}
+
+func TestRewriteConvertedObjectInfo(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Files.Converted)
+	converted := make(map[string]bool)
+	for _, name := range result.Files.Converted {
+		converted[name] = true
+	}
+
+	// The object info rows of the converted objects, the rows of the
+	// aBlocks they replace are dropped by a replay of the checkpoint
+	// they are in.
+	rewritten, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	objectInfo := rewritten.bats[ObjectInfoIDX]
+	rows := makeRespBatchFromSchema(ObjectInfoSchema, common.CheckpointAllocator)
+	defer rows.Close()
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		if !converted[stats.ObjectName().String()] {
+			continue
+		}
+		// They are created when they are committed, a replay does not
+		// take them for objects it should know of.
+		require.Equal(t,
+			objectInfo.GetVectorByName(txnbase.SnapshotAttr_CommitTS).Get(i).(types.TS),
+			objectInfo.GetVectorByName(EntryNode_CreateAt).Get(i).(types.TS))
+		require.Equal(t, types.TS{}, objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS))
+		require.NoError(t, appendValToBatch(objectInfo, rows, i))
+	}
+	require.Equal(t, len(converted), rows.Length())
+
+	// A replay creates them, with the stats of the objects written.
+	c := catalog2.MockCatalog()
+	defer c.Close()
+	db := catalog2.NewDBEntryWithID(c, "backup", "", "", 0, nil)
+	require.NoError(t, c.AddEntryLocked(db, nil, true))
+	tables := make([]*catalog2.TableEntry, 0, spec.Tables)
+	for i := 0; i < spec.Tables; i++ {
+		table, err := db.CreateTableEntryWithTableId(catalog2.MockSchema(2, 0), nil, nil, uint64(fixtureFirstTable+i))
+		require.NoError(t, err)
+		tables = append(tables, table)
+	}
+	c.OnReplayObjectBatch(rows, replayFactory{})
+	replayed := 0
+	for _, table := range tables {
+		it := table.MakeObjectIt(true)
+		for it.Next() {
+			object := it.Item()
+			stats := object.GetObjectStats()
+			require.True(t, converted[stats.ObjectName().String()], stats.String())
+			require.False(t, object.IsAppendable())
+			location := stats.ObjectLocation()
+			meta, err := objectio.FastLoadObjectMeta(ctx, &location, false, dstFs)
+			require.NoError(t, err)
+			dataMeta := meta.MustDataMeta()
+			require.Equal(t, dataMeta.BlockCount(), stats.BlkCnt())
+			require.Equal(t, dataMeta.BlockHeader().Rows(), stats.Rows())
+			require.NotZero(t, stats.Rows())
+			require.NotZero(t, stats.Size())
+			replayed++
+		}
+		it.Release()
+	}
+	require.Equal(t, len(converted), replayed)
+}
+
+// recordingObserver records the calls of a RewriteObserver, as
+// "phase N", "trim", "object NAME" and "complete".
+type recordingObserver struct {
+	calls   []string
+	trimmed []TrimmedBlock
+	objects []RewrittenObject
+	result  *RewriteResult
+	err     error
+}
+
+func (r *recordingObserver) OnPhaseStart(phase int) {
+	r.calls = append(r.calls, fmt.Sprintf("phase %d", phase))
+}
+
+func (r *recordingObserver) OnBlockTrimmed(block TrimmedBlock) {
+	r.calls = append(r.calls, "trim")
+	r.trimmed = append(r.trimmed, block)
+}
+
+func (r *recordingObserver) OnObjectRewritten(object RewrittenObject) {
+	r.calls = append(r.calls, "object "+object.Name)
+	r.objects = append(r.objects, object)
+}
+
+func (r *recordingObserver) OnComplete(result *RewriteResult, err error) {
+	r.calls = append(r.calls, "complete")
+	r.result, r.err = result, err
+}
+
+func TestRewriteObserver(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	observer := &recordingObserver{}
+	result := &RewriteResult{}
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithRewriteObserver(observer))
+	require.NoError(t, err)
+
+	// The phases are entered in order, the blocks are trimmed in phase
+	// 3 and the objects written from phase 4 on, complete comes last.
+	phase := 0
+	for i, call := range observer.calls {
+		switch {
+		case strings.HasPrefix(call, "phase "):
+			phase++
+			require.Equal(t, fmt.Sprintf("phase %d", phase), call)
+		case call == "trim":
+			require.Equal(t, 3, phase)
+		case strings.HasPrefix(call, "object "):
+			require.GreaterOrEqual(t, phase, 4, call)
+		default:
+			require.Equal(t, "complete", call)
+			require.Equal(t, len(observer.calls)-1, i)
+		}
+	}
+	require.Equal(t, RewritePhases, phase)
+	require.Same(t, result, observer.result)
+	require.NoError(t, observer.err)
+
+	// Every late row of the fixture is reported cut.
+	require.NotEmpty(t, observer.trimmed)
+	for _, block := range observer.trimmed {
+		require.Positive(t, block.Late, block.Location.String())
+		require.Less(t, block.Late, block.Rows)
+		require.Zero(t, block.Filtered)
+	}
+	require.Equal(t, result.WrittenObjects, len(observer.objects))
+	written := make([]string, 0, len(observer.objects))
+	var bytes int64
+	for _, object := range observer.objects {
+		require.NotZero(t, object.Rows, object.Name)
+		require.NotZero(t, object.Blocks, object.Name)
+		written = append(written, object.Name)
+		bytes += object.Bytes
+	}
+	require.Equal(t, result.WrittenBytes, bytes)
+	require.ElementsMatch(t, append(append([]string{}, result.Files.Rewritten...), result.Files.Converted...), written)
+
+	// A rewrite that fails completes with its error.
+	observer = &recordingObserver{}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(cancelled, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteObserver(observer))
+	require.Error(t, err)
+	require.Equal(t, "complete", observer.calls[len(observer.calls)-1])
+	require.Equal(t, err, observer.err)
+}
+
+// BenchmarkABlockBatching converts many tiny aBlocks one by one and in
+// batches.
+func BenchmarkABlockBatching(b *testing.B) {
+	spec := defaultCheckpointSpec()
+	spec.BlocksPerTable = 128
+	spec.RowsPerBlock = 16
+	spec.ABlockFraction = 1
+	fixture := newCheckpointFixture(b, spec)
+	for _, bench := range []struct {
+		name string
+		opts []BackupOption
+	}{
+		{name: "single"},
+		{name: "batched", opts: []BackupOption{WithABlockBatching(spec.RowsPerBlock + 1)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dstFs := newBackupTestFS(b)
+				b.StartTimer()
+				_, _, _, err := ReWriteCheckpointAndBlockFromKey(context.Background(), "", fixture.fs, dstFs,
+					fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil, bench.opts...)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// FuzzCheckpointAnalysis loads corrupted checkpoints and analyzes them
+// as the first two phases of the rewrite do. The rewrite must fail with
+// an error, never panic. A checkpoint is its meta object, at location,
+// and the data object dataName it references. The inputs that failed
+// are kept in testdata/fuzz/FuzzCheckpointAnalysis.
+func FuzzCheckpointAnalysis(f *testing.F) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Tables = 1
+	spec.BlocksPerTable = 2
+	spec.RowsPerBlock = 8
+	fixture := newCheckpointFixture(f, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(f, err)
+	require.Len(f, data.locations, 1)
+	for dataName := range data.locations {
+		meta, err := readBackupFile(ctx, fixture.fs, fixture.cnLocation.Name().String())
+		require.NoError(f, err)
+		dataFile, err := readBackupFile(ctx, fixture.fs, dataName)
+		require.NoError(f, err)
+		f.Add([]byte(fixture.cnLocation), meta, dataName, dataFile)
+	}
+	data.Close()
+
+	f.Fuzz(func(t *testing.T, location, meta []byte, dataName string, dataFile []byte) {
+		if len(location) != objectio.LocationLen {
+			t.Skip()
+		}
+		loc := objectio.Location(location)
+		metaName := loc.Name().String()
+		if metaName == dataName || dataName == "" {
+			t.Skip()
+		}
+		fs := newBackupTestFS(t)
+		if writeBackupFile(ctx, fs, metaName, meta) != nil ||
+			writeBackupFile(ctx, fs, dataName, dataFile) != nil {
+			// Not a valid file name.
+			t.Skip()
+		}
+		analyzed, cancel := context.WithCancel(ctx)
+		defer cancel()
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(analyzed, "", fs, newBackupTestFS(t),
+			loc, loc, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithProgress(func(progress RewriteProgress) {
+				if progress.Phase > 2 {
+					cancel()
+				}
+			}))
+		if err != nil && !IsRewriteAborted(err) {
+			t.Log(err)
+		}
+	})
+}
+
+// rejectWritesFS is a source FileService with read-only credentials,
+// the test fails on any write or delete that reaches it.
+type rejectWritesFS struct {
+	fileservice.FileService
+	t testing.TB
+}
+
+func (fs rejectWritesFS) Write(_ context.Context, vector fileservice.IOVector) error {
+	fs.t.Errorf("write %s on the source", vector.FilePath)
+	return moerr.NewInternalErrorNoCtx("read-only")
+}
+
+func (fs rejectWritesFS) Delete(_ context.Context, filePaths ...string) error {
+	fs.t.Errorf("delete %v on the source", filePaths)
+	return moerr.NewInternalErrorNoCtx("read-only")
+}
+
+func TestRewriteReadOnlySource(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	panicOnSourceMutation = true
+	t.Cleanup(func() {
+		panicOnSourceMutation = false
+	})
+
+	expectedFs := newBackupTestFS(t)
+	expectedLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, expectedFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	expected := rewrittenContent(t, ctx, expectedFs, expectedLocation)
+
+	// The first sync of each object rewritten in place finds it in the
+	// destination, as left by an interrupted rewrite, it is replaced
+	// there.
+	newWriter := func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+		writer, err := blockio.NewBlockWriter(fs, name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fixture.fs.StatFile(ctx, name); err != nil {
+			return writer, nil
+		}
+		return &faultyWriter{BlockWriterLike: writer, err: moerr.NewFileAlreadyExistsNoCtx(name), once: true}, nil
+	}
+	source := rejectWritesFS{FileService: fixture.fs, t: t}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", source, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithReadOnlySource(), WithBlockWriterFactory(newWriter))
+	require.NoError(t, err)
+	require.Equal(t, expected, rewrittenContent(t, ctx, dstFs, cnLocation))
+
+	readOnly := readOnlySource(fixture.fs)
+	require.Equal(t, readOnly, readOnlySource(readOnly))
+	require.Panics(t, func() {
+		_ = readOnly.Delete(ctx, "object")
+	})
+	panicOnSourceMutation = false
+	err = readOnly.Delete(ctx, "object")
+	require.True(t, IsSourceMutation(err), err)
+	require.Equal(t, "delete object on the read-only source of the rewrite", err.Error())
+}
+
+// sequentialNames names the converted objects in segment with the file
+// numbers 0, 1, ... in the order they are asked for. It returns the
+// names given, by source.
+func sequentialNames(segment objectio.Segmentid) (objectNameGenerator, map[string]objectio.ObjectName) {
+	var mu sync.Mutex
+	names := make(map[string]objectio.ObjectName)
+	return func(src objectio.ObjectName) objectio.ObjectName {
+		mu.Lock()
+		defer mu.Unlock()
+		name, ok := names[src.String()]
+		if !ok {
+			name = objectio.BuildObjectName(&segment, uint16(len(names)))
+			names[src.String()] = name
+		}
+		return name
+	}, names
+}
+
+func TestRewriteObjectNameGenerator(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	segment := objectio.NewSegmentid()
+	gen, names := sequentialNames(*segment)
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockIDMapping(), withObjectNameGenerator(gen))
+	require.NoError(t, err)
+
+	// One name per aBlock, the numbers given in turn.
+	require.Equal(t, fixture.aBlocks, len(names))
+	expected := make([]string, 0, len(names))
+	for i := 0; i < len(names); i++ {
+		expected = append(expected, objectio.BuildObjectName(segment, uint16(i)).String())
+	}
+	sort.Strings(expected)
+	require.Equal(t, expected, result.Files.Converted)
+	for _, block := range result.RelocatedBlocks {
+		src := objectio.BuildObjectNameWithObjectID(block.Source.Object())
+		converted := objectio.BuildObjectNameWithObjectID(block.Converted.Object())
+		require.Equal(t, names[src.String()].String(), converted.String(), block.String())
+	}
+
+	// The rewritten checkpoint refers to the converted objects by their
+	// generated names.
+	rewritten, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	listed := make(map[string]bool)
+	objectInfo := rewritten.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		listed[stats.ObjectName().String()] = true
+	}
+	for _, name := range expected {
+		require.True(t, listed[name], name)
+	}
+}
+
+// recordingFS records the files written to it, in order.
+type recordingFS struct {
+	fileservice.FileService
+	mu      sync.Mutex
+	written []string
+}
+
+func (fs *recordingFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	fs.mu.Lock()
+	fs.written = append(fs.written, vector.FilePath)
+	fs.mu.Unlock()
+	return fs.FileService.Write(ctx, vector)
+}
+
+func TestRewriteStagingFS(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(dstFs fileservice.FileService) (objectio.Location, *RewriteResult, *BackupSession, fileservice.FileService) {
+		staging := newBackupTestFS(t)
+		session, err := NewBackupSession(ctx, dstFs, WithStagingFS(staging), WithJournal("staged"))
+		require.NoError(t, err)
+		result := &RewriteResult{}
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithBackupSession(session), WithRewriteResult(result), WithCheckpointFooter(),
+			WithRestoreManifest())
+		require.NoError(t, err)
+		// The objects the rewrite keeps are copied by the session, to
+		// staging too.
+		footer, err := ReadCheckpointFooter(ctx, staging, result.Files.Meta)
+		require.NoError(t, err)
+		for _, object := range footer.Objects {
+			if _, err = staging.StatFile(ctx, object.Name); err == nil {
+				continue
+			}
+			buf, err := readBackupFile(ctx, fixture.fs, object.Name)
+			require.NoError(t, err)
+			require.NoError(t, session.Copy(ctx, object.Name, int64(len(buf)), func(ctx context.Context) error {
+				return writeBackupFile(ctx, session.CopyFS(dstFs), object.Name, buf)
+			}))
+		}
+		require.NotEmpty(t, session.CopiedFiles())
+		require.NoError(t, session.Flush(ctx))
+		return cnLocation, result, session, staging
+	}
+
+	// The verification fails on an object it cannot read, or reports
+	// the ones missing.
+	verified := func(stagingFs fileservice.FileService, cnLocation objectio.Location) bool {
+		report, err := VerifyStagedCheckpoint(ctx, stagingFs, fixture.fs, cnLocation, CheckpointCurrentVersion)
+		return err == nil && report.OK()
+	}
+
+	// A staged backup that fails its verification is not promoted,
+	// nothing reaches the destination.
+	untouched := rejectWritesFS{FileService: newBackupTestFS(t), t: t}
+	cnLocation, result, _, staging := rewrite(untouched)
+	// The tombstones are trimmed in place, the staged ones are verified
+	// and not the source ones of the same names.
+	require.NotEmpty(t, result.Files.Tombstones)
+	for _, name := range result.Files.Tombstones {
+		_, err := staging.StatFile(ctx, name)
+		require.NoError(t, err)
+	}
+	require.True(t, verified(staging, cnLocation))
+	require.NoError(t, staging.Delete(ctx, result.Files.Converted[0]))
+	require.False(t, verified(staging, cnLocation))
+	entries, err := untouched.List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// A verified one is promoted with the objects copied, its footer and
+	// its manifest last.
+	dstFs := &recordingFS{FileService: newBackupTestFS(t)}
+	cnLocation, result, session, staging := rewrite(dstFs)
+	require.True(t, verified(staging, cnLocation))
+	require.Empty(t, dstFs.written)
+	files := result.BackupFiles(cnLocation, session)
+	for _, name := range session.CopiedFiles() {
+		require.Contains(t, files, name)
+	}
+	require.Contains(t, files, result.Manifest)
+	require.NoError(t, PromoteBackup(ctx, staging, dstFs, files))
+	require.Equal(t, len(files), len(dstFs.written))
+	require.ElementsMatch(t, []string{result.Footer, result.Manifest}, dstFs.written[len(dstFs.written)-2:])
+	footer, err := ReadCheckpointFooter(ctx, dstFs, cnLocation.Name().String())
+	require.NoError(t, err)
+	require.Equal(t, []byte(cnLocation), footer.Checkpoint)
+	// The destination holds the whole backup, without the source.
+	report, err := VerifyRewrittenCheckpoint(ctx, dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Positive(t, report.Tombstones.ScannedBlocks)
+	for _, name := range result.Files.Tombstones {
+		staged, err := readBackupFile(ctx, staging, name)
+		require.NoError(t, err)
+		promoted, err := readBackupFile(ctx, dstFs, name)
+		require.NoError(t, err)
+		require.Equal(t, staged, promoted)
+	}
+}
+
+// completeBackup rewrites the checkpoint of fixture with a footer and
+// copies the objects it does not rewrite next to it, and returns the
+// backup and the name of its footer.
+func completeBackup(t testing.TB, fixture *checkpointFixture) (fileservice.FileService, string) {
+	ctx := context.Background()
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, fixture.spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	for _, object := range footer.Objects {
+		if _, err = dstFs.StatFile(ctx, object.Name); err == nil {
+			continue
+		}
+		buf, err := readBackupFile(ctx, fixture.fs, object.Name)
+		require.NoError(t, err)
+		require.NoError(t, writeBackupFile(ctx, dstFs, object.Name, buf))
+	}
+	return dstFs, result.Footer
+}
+
+func TestVerifyTrimmedTombstones(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	result := &RewriteResult{}
+	dstFs := copyBackupTestFS(t, ctx, fixture.fs)
+	location, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Files.Tombstones)
+
+	// The object meta cache of the process has the metas of the
+	// tombstones as they were in the source, under the names they are
+	// trimmed in place with.
+	for _, name := range result.Files.Tombstones {
+		objectName, ok := parseObjectName(name)
+		require.True(t, ok, name)
+		src, err := readBackupFile(ctx, fixture.fs, name)
+		require.NoError(t, err)
+		trimmed, err := readBackupFile(ctx, dstFs, name)
+		require.NoError(t, err)
+		require.Less(t, len(trimmed), len(src), name)
+		srcLocation := objectio.BuildLocation(objectName, objectio.Header(src).Extent(), 0, 0)
+		_, err = objectio.FastLoadObjectMeta(ctx, &srcLocation, false, fixture.fs)
+		require.NoError(t, err)
+	}
+
+	report, err := VerifyRewrittenCheckpoint(ctx, dstFs, location, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%+v", report)
+	require.Greater(t, report.Tombstones.ScannedBlocks, 0)
+	tombstones, err := VerifyTombstoneReferences(ctx, "", dstFs, location, CheckpointCurrentVersion, 0)
+	require.NoError(t, err)
+	require.Zero(t, tombstones.DanglingRows())
+	require.Equal(t, report.Tombstones.ScannedBlocks, tombstones.ScannedBlocks)
+}
+
+func TestVerifyBackup(t *testing.T) {
+	ctx := context.Background()
+	fixture := newCheckpointFixture(t, defaultCheckpointSpec())
+	fs, manifest := completeBackup(t, fixture)
+	buf, err := readBackupFile(ctx, fs, manifest)
+	require.NoError(t, err)
+	footer, err := DecodeCheckpointFooter(manifest, buf)
+	require.NoError(t, err)
+	total := len(footer.Objects)
+	require.Greater(t, total, 8)
+
+	check, err := VerifyBackup(ctx, fs, manifest)
+	require.NoError(t, err)
+	require.True(t, check.OK(), "%+v", check)
+	require.Equal(t, total, check.Checked)
+
+	// A few objects go missing and one is cut short.
+	var missing []string
+	for _, object := range footer.Objects[:4] {
+		require.NoError(t, fs.Delete(ctx, object.Name))
+		missing = append(missing, object.Name)
+	}
+	sort.Strings(missing)
+	var short FooterObject
+	for _, object := range footer.Objects[4:] {
+		if object.Size > 0 {
+			short = object
+			break
+		}
+	}
+	require.NotEmpty(t, short.Name)
+	buf, err = readBackupFile(ctx, fs, short.Name)
+	require.NoError(t, err)
+	require.NoError(t, writeBackupFile(ctx, fs, short.Name, buf[:len(buf)/2]))
+
+	for _, concurrency := range []int{1, 4, 64} {
+		var calls, last atomic.Int32
+		check, err = VerifyBackup(ctx, fs, manifest,
+			WithVerifyConcurrency(concurrency),
+			WithVerifyProgress(func(checked, n int) {
+				require.Equal(t, total, n)
+				calls.Add(1)
+				last.Store(int32(checked))
+			}))
+		require.NoError(t, err)
+		require.False(t, check.OK())
+		require.Equal(t, total, check.Checked)
+		require.Equal(t, missing, check.Missing)
+		require.Equal(t, []SizeMismatch{{
+			Name:     short.Name,
+			Expected: short.Size,
+			Actual:   int64(len(buf) / 2),
+		}}, check.Mismatched)
+		require.Equal(t, int32(total), calls.Load())
+		require.Equal(t, int32(total), last.Load())
+	}
+
+	// A stat that fails otherwise fails the check.
+	injected := moerr.NewInternalErrorNoCtx("injected stat fault")
+	_, err = VerifyBackup(ctx, &slowStatFS{FileService: fs, fail: footer.Objects[total-1].Name, err: injected}, manifest,
+		WithVerifyConcurrency(4))
+	require.ErrorIs(t, err, injected)
+}
+
+// slowStatFS delays each StatFile by delay, as an object store does,
+// and fails the StatFile of fail with err.
+type slowStatFS struct {
+	fileservice.FileService
+	delay time.Duration
+	fail  string
+	err   error
+}
+
+func (fs *slowStatFS) StatFile(ctx context.Context, filePath string) (*fileservice.DirEntry, error) {
+	time.Sleep(fs.delay)
+	if filePath == fs.fail {
+		return nil, fs.err
+	}
+	return fs.FileService.StatFile(ctx, filePath)
+}
+
+func BenchmarkVerifyBackup(b *testing.B) {
+	fixture := newCheckpointFixture(b, benchCheckpointSpec())
+	fs, manifest := completeBackup(b, fixture)
+	slow := &slowStatFS{FileService: fs, delay: 100 * time.Microsecond}
+	for _, concurrency := range []int{1, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				check, err := VerifyBackup(context.Background(), slow, manifest,
+					WithVerifyConcurrency(concurrency))
+				require.NoError(b, err)
+				require.True(b, check.OK())
+			}
+		})
+	}
+}
+
+func TestRewriteCNOnly(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	rewrite := func(opts ...BackupOption) (fileservice.FileService, objectio.Location, objectio.Location, *CheckpointFooter) {
+		result := &RewriteResult{}
+		dstFs := copyBackupTestFS(t, ctx, fixture.fs)
+		cnLocation, tnLocation, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append([]BackupOption{WithRewriteResult(result), WithCheckpointFooter(), WithRestoreManifest()}, opts...)...)
+		require.NoError(t, err)
+		// The hops after it read the tombstones it trimmed.
+		require.NotEmpty(t, result.Files.Tombstones)
+		footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+		require.NoError(t, err)
+		// The manifest tells it as the footer does.
+		manifest, err := ReadRestoreManifest(ctx, dstFs, result.Files.Meta)
+		require.NoError(t, err)
+		require.Equal(t, footer.CNOnly, manifest.Entrypoint.CNOnly)
+		return dstFs, cnLocation, tnLocation, footer
+	}
+
+	fullFs, full, fullTN, footer := rewrite()
+	require.False(t, fullTN.IsEmpty())
+	require.False(t, footer.CNOnly)
+	require.NoError(t, footer.CheckFullRestore())
+
+	// The CN side is the same, the TN side is not written.
+	cnFs, cnOnly, cnOnlyTN, footer := rewrite(WithCNOnly())
+	require.True(t, cnOnlyTN.IsEmpty())
+	require.Empty(t, footer.TNCheckpoint)
+	require.True(t, footer.CNOnly)
+	err := footer.CheckFullRestore()
+	require.True(t, IsCNOnlyBackup(err), err)
+	require.Equal(t, rewrittenContent(t, ctx, fullFs, full), rewrittenContent(t, ctx, cnFs, cnOnly))
+	provenance, err := ReadCheckpointProvenance(ctx, cnFs, cnOnly.Name().String())
+	require.NoError(t, err)
+	require.True(t, provenance.IsCNOnly())
+
+	// The CN only backup is not rewritten into one with a TN side, nor
+	// used for an incremental checkpoint.
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", cnFs, newBackupTestFS(t),
+		cnOnly, cnOnlyTN, CheckpointCurrentVersion, spec.Pivot.Next(), nil)
+	require.True(t, IsCNOnlyBackup(err), err)
+	_, err = IncrementalCheckpoint(ctx, "", cnFs, cnOnly, CheckpointCurrentVersion, cnOnly, CheckpointCurrentVersion)
+	require.True(t, IsCNOnlyBackup(err), err)
+
+	// It stays CN only down the chain.
+	secondFs := newBackupTestFS(t)
+	second, secondTN, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", cnFs, secondFs,
+		cnOnly, cnOnlyTN, CheckpointCurrentVersion, spec.Pivot.Next(), nil, WithCNOnly())
+	require.NoError(t, err)
+	require.True(t, secondTN.IsEmpty())
+	chain, err := ReadCheckpointProvenance(ctx, secondFs, second.Name().String())
+	require.NoError(t, err)
+	require.True(t, chain.IsCNOnly())
+	require.Len(t, chain.Hops, 2)
+
+	// The full backup is used either way.
+	data, err := IncrementalCheckpoint(ctx, "", fullFs, full, CheckpointCurrentVersion, full, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	data.Close()
+}
+
+func TestRewriteTableOffsets(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Tables = 3
+	fixture := newCheckpointFixture(t, spec)
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Stats.TableOffsets)
+
+	data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	// The tables of each batch follow each other from its first row to
+	// its last, and every row in the range of a table is of the table.
+	tids := map[uint16]containers.Vector{
+		ObjectInfoIDX:    data.bats[ObjectInfoIDX].GetVectorByName(SnapshotAttr_TID),
+		BLKMetaInsertIDX: data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID),
+	}
+	next := make(map[uint16]int)
+	tables := make(map[uint16]map[uint64]bool)
+	for _, offset := range result.Stats.TableOffsets {
+		require.Equal(t, next[offset.Batch], offset.Offset, offset.String())
+		require.Less(t, offset.Offset, offset.End, offset.String())
+		for row := offset.Offset; row < offset.End; row++ {
+			require.Equal(t, offset.Table, tids[offset.Batch].Get(row).(uint64), offset.String())
+		}
+		if tables[offset.Batch] == nil {
+			tables[offset.Batch] = make(map[uint64]bool)
+		}
+		require.False(t, tables[offset.Batch][offset.Table], offset.String())
+		tables[offset.Batch][offset.Table] = true
+		next[offset.Batch] = offset.End
+	}
+	for idx, vec := range tids {
+		require.Equal(t, vec.Length(), next[idx], "batch %d", idx)
+	}
+	require.Len(t, tables[ObjectInfoIDX], spec.Tables)
+}
+
+// taggingTestFS is an ObjectTagger that records the tags of each file.
+type taggingTestFS struct {
+	fileservice.FileService
+	sync.Mutex
+	tags map[string]map[string]string
+}
+
+func (fs *taggingTestFS) TagObject(_ context.Context, filePath string, tags map[string]string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.tags[filePath] = tags
+	return nil
+}
+
+// listBackupTestFS returns the files of fs, those of its directories
+// included.
+func listBackupTestFS(t *testing.T, ctx context.Context, fs fileservice.FileService, dir string) []string {
+	entries, err := fs.List(ctx, dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		if entry.IsDir {
+			names = append(names, listBackupTestFS(t, ctx, fs, name)...)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestRewriteObjectTags(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	tags := map[string]string{"backup-id": "b-1", "retention-class": "cold"}
+
+	rewrite := func(dstFs fileservice.FileService) *CheckpointFooter {
+		session, err := NewBackupSession(ctx, dstFs, WithObjectTags(tags), WithJournal("tags"))
+		require.NoError(t, err)
+		result := &RewriteResult{}
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithBackupSession(session), WithCheckpointFooter())
+		require.NoError(t, err)
+		footer, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+		require.NoError(t, err)
+		// The nBlocks the rewrite keeps are copied by the session.
+		for _, object := range footer.Objects {
+			if _, err = dstFs.StatFile(ctx, object.Name); err == nil {
+				continue
+			}
+			buf, err := readBackupFile(ctx, fixture.fs, object.Name)
+			require.NoError(t, err)
+			require.NoError(t, session.Copy(ctx, object.Name, int64(len(buf)), func(ctx context.Context) error {
+				return writeBackupFile(ctx, session.CopyFS(dstFs), object.Name, buf)
+			}))
+		}
+		require.NotEmpty(t, session.CopiedFiles())
+		require.NoError(t, session.Flush(ctx))
+		return footer
+	}
+
+	// Every file written is tagged: the objects, the copied ones
+	// included, the checkpoint, the journal, the provenance and the
+	// footer.
+	dstFs := &taggingTestFS{
+		FileService: newBackupTestFS(t),
+		tags:        make(map[string]map[string]string),
+	}
+	footer := rewrite(dstFs)
+	require.Equal(t, tags, footer.Tags)
+	names := listBackupTestFS(t, ctx, dstFs, "")
+	require.NotEmpty(t, names)
+	kinds := make(map[bool]int)
+	for _, name := range names {
+		require.Equal(t, tags, dstFs.tags[name], name)
+		kinds[isBackupAuxName(name)]++
+	}
+	require.NotZero(t, kinds[true])
+	require.NotZero(t, kinds[false])
+	for _, object := range footer.Objects {
+		require.Equal(t, tags, dstFs.tags[object.Name], object.Name)
+	}
+
+	// A destination that cannot tag still has them in the footer.
+	footer = rewrite(newBackupTestFS(t))
+	require.Equal(t, tags, footer.Tags)
+}
+
+// taggedWriterTestFS is a TaggedWriter that records the tags each file
+// is written with. Tagging a file after it is written fails the test.
+type taggedWriterTestFS struct {
+	taggingTestFS
+	t *testing.T
+}
+
+func (fs *taggedWriterTestFS) WriteTagged(ctx context.Context, vector fileservice.IOVector, tags map[string]string) error {
+	if err := fs.FileService.Write(ctx, vector); err != nil {
+		return err
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	fs.tags[vector.FilePath] = tags
+	return nil
+}
+
+func (fs *taggedWriterTestFS) TagObject(_ context.Context, filePath string, _ map[string]string) error {
+	fs.t.Errorf("%s tagged after it is written", filePath)
+	return nil
+}
+
+func TestRewriteTaggedWrites(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	tags := map[string]string{"backup-id": "b-2"}
+
+	dstFs := &taggedWriterTestFS{
+		taggingTestFS: taggingTestFS{
+			FileService: newBackupTestFS(t),
+			tags:        make(map[string]map[string]string),
+		},
+		t: t,
+	}
+	session, err := NewBackupSession(ctx, dstFs, WithObjectTags(tags), WithStrictObjectTags())
+	require.NoError(t, err)
+	result := &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupSession(session), WithCheckpointFooter())
+	require.NoError(t, err)
+	for _, name := range listBackupTestFS(t, ctx, dstFs, "") {
+		require.Equal(t, tags, dstFs.tags[name], name)
+	}
+	require.NotEmpty(t, dstFs.tags[result.Files.Meta])
+	require.NotEmpty(t, dstFs.tags[result.Footer])
+
+	// A destination that cannot tag is refused when the tags are strict,
+	// and written without them otherwise.
+	_, err = NewBackupSession(ctx, newBackupTestFS(t), WithObjectTags(tags), WithStrictObjectTags())
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported), err)
+	session, err = NewBackupSession(ctx, dstFs, WithObjectTags(tags), WithStrictObjectTags())
+	require.NoError(t, err)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithBackupSession(session))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported), err)
+	session, err = NewBackupSession(ctx, newBackupTestFS(t), WithObjectTags(tags))
+	require.NoError(t, err)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, session.dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithBackupSession(session))
+	require.NoError(t, err)
+}
+
+func TestRewriteSkipTrimmed(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The first run trims the late rows of the tombstones in place, the
+	// runs after it read them as trimmed.
+	trimmed := &RewriteResult{}
+	dstFs := copyBackupTestFS(t, ctx, fixture.fs)
+	first, firstTN, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithSkipTrimmed(), WithRewriteResult(trimmed))
+	require.NoError(t, err)
+	require.NotEmpty(t, trimmed.Files.Tombstones)
+
+	// The second run at the same ts returns the checkpoint as it is
+	// without writing anything, nor loading it: only its provenance is
+	// read.
+	result := &RewriteResult{}
+	source := newCountingFS(dstFs)
+	again := newCountingFS(newBackupTestFS(t))
+	cnLocation, tnLocation, files, err := ReWriteCheckpointAndBlockFromKey(ctx, "", source, again,
+		first, firstTN, CheckpointCurrentVersion, spec.Pivot, nil, WithSkipTrimmed(), WithRewriteResult(result))
+	require.NoError(t, err)
+	require.True(t, result.AlreadyTrimmed)
+	require.Equal(t, first, cnLocation)
+	require.Equal(t, firstTN, tnLocation)
+	require.Empty(t, files)
+	require.Empty(t, again.writes)
+	require.NotEmpty(t, source.reads)
+	for name := range source.reads {
+		require.True(t, isBackupAuxName(name), name)
+	}
+
+	// It is rewritten at another ts, or when asked to drop its TN side.
+	for _, c := range []struct {
+		ts   types.TS
+		opts []BackupOption
+	}{
+		{ts: spec.Pivot.Next()},
+		{ts: spec.Pivot, opts: []BackupOption{WithCNOnly()}},
+	} {
+		*result = RewriteResult{}
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", dstFs, newBackupTestFS(t),
+			first, firstTN, CheckpointCurrentVersion, c.ts, nil,
+			append([]BackupOption{WithSkipTrimmed(), WithRewriteResult(result)}, c.opts...)...)
+		require.NoError(t, err)
+		require.False(t, result.AlreadyTrimmed)
+	}
+
+	// Without WithSkipTrimmed it is rewritten all the same.
+	*result = RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", dstFs, newBackupTestFS(t),
+		first, firstTN, CheckpointCurrentVersion, spec.Pivot, nil, WithRewriteResult(result))
+	require.NoError(t, err)
+	require.False(t, result.AlreadyTrimmed)
+}
+
+// namingNormalizer names the columns of the batches after the columns
+// of a schema, the way an integration that keeps the real names would,
+// and does not round trip them.
+type namingNormalizer struct {
+	names []string
+	calls int
+}
+
+func (n *namingNormalizer) Normalize(bat *batch.Batch, _ *mpool.MPool) (*batch.Batch, error) {
+	n.calls++
+	bat.Attrs = make([]string, len(bat.Vecs))
+	for i := range bat.Vecs {
+		// The trailing columns of the aBlocks and tombstones are not in
+		// the schema.
+		if i < len(n.names) {
+			bat.Attrs[i] = n.names[i]
+		} else {
+			bat.Attrs[i] = fmt.Sprintf("hidden_%d", i)
+		}
+	}
+	return bat, nil
+}
+
+func TestRewriteBatchNormalizer(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	rewrite := func(opts ...BackupOption) (map[string]string, map[string][]string) {
+		attrs := make(map[string][]string)
+		exporter := func(_ context.Context, _ uint64, name objectio.ObjectName, bat *batch.Batch) (string, error) {
+			attrs[name.String()] = append([]string(nil), bat.Attrs...)
+			return name.String() + ".export", nil
+		}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append([]BackupOption{WithBlockExporter(exporter)}, opts...)...)
+		require.NoError(t, err)
+		return rewrittenContent(t, ctx, dstFs, cnLocation), attrs
+	}
+
+	expected, formatted := rewrite()
+	require.NotEmpty(t, formatted)
+	for _, names := range formatted {
+		require.Equal(t, "col_0", names[0])
+	}
+
+	normalizer := &namingNormalizer{names: []string{"id", "name", "amount"}}
+	content, named := rewrite(WithBatchNormalizer(normalizer))
+	require.Positive(t, normalizer.calls)
+	require.Equal(t, expected, content)
+	require.Equal(t, len(formatted), len(named))
+	for _, names := range named {
+		require.Equal(t, "id", names[0])
+	}
+}
+
+func TestRewriteCheckpointChain(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	later := types.BuildTS(spec.Pivot.Physical()+5, 0)
+	chain := []CheckpointSpan{{End: spec.Pivot}}
+
+	rewrite := func(ts types.TS, opts ...BackupOption) (*RewriteResult, map[string]string, error) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, ts, nil,
+			append([]BackupOption{WithRewriteResult(result)}, opts...)...)
+		if err != nil {
+			return result, nil, err
+		}
+		return result, rewrittenContent(t, ctx, dstFs, cnLocation), nil
+	}
+
+	result, expected, err := rewrite(spec.Pivot)
+	require.NoError(t, err)
+	require.Equal(t, spec.Pivot, result.RequestedTS)
+	require.Equal(t, spec.Pivot, result.EffectiveTS)
+
+	// A ts past the end of the chain is resolved to its end.
+	result, content, err := rewrite(later, WithCheckpointChain(chain))
+	require.NoError(t, err)
+	require.Equal(t, later, result.RequestedTS)
+	require.Equal(t, spec.Pivot, result.EffectiveTS)
+	require.Equal(t, expected, content)
+
+	result, _, err = rewrite(later, WithCheckpointChain(chain), WithExactBackupTS())
+	require.NoError(t, err)
+	require.Equal(t, later, result.EffectiveTS)
+
+	// No checkpoint of the chain ends by the ts.
+	_, _, err = rewrite(spec.Pivot.Prev(), WithCheckpointChain(chain))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+}
+
+func TestRewriteBlockDenylist(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// Deny an nBlock with a tombstone.
+	source, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	var (
+		denied    types.Blockid
+		tombstone string
+	)
+	require.NoError(t, source.ForEachBlockMeta(func(view BlockMetaView) error {
+		if tombstone == "" && !view.EntryState() && !view.DeltaLoc().IsEmpty() {
+			denied = view.Blockid()
+			tombstone = view.DeltaLoc().Name().String()
+		}
+		return nil
+	}))
+	source.Close()
+	require.NotEmpty(t, tombstone)
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBlockDenylist([]types.Blockid{denied}))
+	require.NoError(t, err)
+	require.Equal(t, []string{denied.String()}, result.DeniedBlocks)
+
+	// Neither the block, its object nor its tombstone is referenced.
+	data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		require.NotEqual(t, denied, view.Blockid())
+		if deltaLoc := view.DeltaLoc(); !deltaLoc.IsEmpty() {
+			require.NotEqual(t, tombstone, deltaLoc.Name().String())
+		}
+		return nil
+	}))
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		statsVec := data.bats[idx].GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < statsVec.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			require.NotEqual(t, denied.ObjectNameString(), stats.ObjectName().String())
+		}
+	}
+	for _, name := range result.Files.All() {
+		require.NotEqual(t, tombstone, name)
+	}
+
+	// Only the rows of the block and its object are gone.
+	allFs := newBackupTestFS(t)
+	all, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, allFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	allData, err := getCheckpointData(ctx, "", allFs, all, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer allData.Close()
+	require.Equal(t, allData.bats[ObjectInfoIDX].Length()-1, data.bats[ObjectInfoIDX].Length())
+	require.Equal(t, allData.bats[BLKMetaInsertIDX].Length()-1, data.bats[BLKMetaInsertIDX].Length())
+}
+
+// deletingObserver deletes an object of fs when the rewrite enters
+// phase, as a GC running along the rewrite would.
+type deletingObserver struct {
+	NopRewriteObserver
+	t     *testing.T
+	fs    fileservice.FileService
+	phase int
+	name  string
+}
+
+func (o *deletingObserver) OnPhaseStart(phase int) {
+	if phase == o.phase {
+		require.NoError(o.t, o.fs.Delete(context.Background(), o.name))
+	}
+}
+
+func TestRewriteSkipCollectedObjects(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	// collectedABlock returns a fixture and the name of an aBlock of it
+	// the rewrite converts.
+	collectedABlock := func() (*checkpointFixture, string) {
+		fixture := newCheckpointFixture(t, spec)
+		data, objectsData := fixture.loadObjectsData(t)
+		defer data.Close()
+		for name, objectData := range objectsData {
+			if objectData.obj != nil && objectData.obj.isABlock {
+				return fixture, name
+			}
+		}
+		t.Fatal("no aBlock")
+		return nil, ""
+	}
+	rewrite := func(fixture *checkpointFixture, dstFs fileservice.FileService, opts ...BackupOption) (objectio.Location, *RewriteResult, error) {
+		result := &RewriteResult{}
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result))...)
+		return cnLocation, result, err
+	}
+
+	// The aBlock is collected once the rewrite started, strict it fails.
+	fixture, name := collectedABlock()
+	_, _, err := rewrite(fixture, newBackupTestFS(t),
+		WithRewriteObserver(&deletingObserver{t: t, fs: fixture.fs, phase: 3, name: name}))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+
+	// Skipping collected objects, the backup completes without it.
+	fixture, name = collectedABlock()
+	dstFs := newBackupTestFS(t)
+	cnLocation, result, err := rewrite(fixture, dstFs, WithSkipCollectedObjects(),
+		WithRewriteObserver(&deletingObserver{t: t, fs: fixture.fs, phase: 3, name: name}))
+	require.NoError(t, err)
+	require.Equal(t, []string{name}, result.Collected)
+	require.Equal(t, 3, len(result.Files.Converted))
+	summary := result.Summary()
+	require.Contains(t, summary.Warnings, WarningCount{Code: WarnCollectedObject, Count: 1})
+	data, err := getCheckpointData(ctx, "", stagedView{FileService: dstFs, source: fixture.fs},
+		cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		for _, location := range []objectio.Location{view.MetaLoc(), view.DeltaLoc()} {
+			if !location.IsEmpty() {
+				require.NotEqual(t, name, location.Name().String())
+			}
+		}
+		return nil
+	}))
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		statsVec := data.bats[idx].GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < statsVec.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			require.NotEqual(t, name, stats.ObjectName().String())
+		}
+	}
+
+	// An object already gone when the rewrite starts is found before
+	// the analysis.
+	_, result, err = rewrite(fixture, newBackupTestFS(t), WithSkipCollectedObjects())
+	require.NoError(t, err)
+	require.Equal(t, []string{name}, result.Collected)
+	require.Equal(t, 3, len(result.Files.Converted))
+}
+
+func TestVerifyCheckpointOffsets(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.Tables = 3
+	fixture := newCheckpointFixture(t, spec)
+
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	for _, loc := range []objectio.Location{fixture.cnLocation, cnLocation} {
+		fs := fixture.fs
+		if loc.Name().Equal(cnLocation.Name()) {
+			fs = dstFs
+		}
+		mismatches, err := VerifyCheckpointOffsets(ctx, "", fs, loc, CheckpointCurrentVersion)
+		require.NoError(t, err)
+		require.Empty(t, mismatches)
+	}
+
+	// corrupt writes the rewritten checkpoint back with fn applied and
+	// verifies it.
+	corrupt := func(fn func(data *CheckpointData)) []OffsetMismatch {
+		data, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+		require.NoError(t, err)
+		defer data.Close()
+		require.NoError(t, data.FormatData(common.CheckpointAllocator))
+		fn(data)
+		loc, _, _, err := data.WriteTo(dstFs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+		require.NoError(t, err)
+		mismatches, err := VerifyCheckpointOffsets(ctx, "", dstFs, loc, CheckpointCurrentVersion)
+		require.NoError(t, err)
+		return mismatches
+	}
+	first, second := uint64(fixtureFirstTable), uint64(fixtureFirstTable+1)
+	problems := func(mismatches []OffsetMismatch) map[uint64]OffsetProblem {
+		byTable := make(map[uint64]OffsetProblem)
+		for _, mismatch := range mismatches {
+			require.Equal(t, BLKMetaInsertIDX, mismatch.Batch, mismatch.String())
+			byTable[mismatch.Table] = mismatch.Problem
+		}
+		return byTable
+	}
+
+	// The range of the first table ends one row late, into the second.
+	mismatches := corrupt(func(data *CheckpointData) {
+		data.meta[first].tables[BlockInsert].End++
+	})
+	require.Equal(t, map[uint64]OffsetProblem{first: OffsetOverlapping, second: OffsetOverlapping}, problems(mismatches))
+
+	// The range of the last table ends one row early.
+	last := uint64(fixtureFirstTable + spec.Tables - 1)
+	mismatches = corrupt(func(data *CheckpointData) {
+		data.meta[last].tables[BlockInsert].End--
+	})
+	require.Equal(t, map[uint64]OffsetProblem{last: OffsetShifted}, problems(mismatches))
+
+	// The first rows of the first two tables are swapped, the rows of
+	// the first table move down one row, the ones of the second
+	// interleave.
+	mismatches = corrupt(func(data *CheckpointData) {
+		tids := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID)
+		a := int(data.meta[first].tables[BlockInsert].Start)
+		b := int(data.meta[second].tables[BlockInsert].Start)
+		tids.Update(a, second, false)
+		tids.Update(b, first, false)
+	})
+	require.Equal(t, map[uint64]OffsetProblem{first: OffsetShifted, second: OffsetScattered}, problems(mismatches))
+
+	// The range of the last table is dropped.
+	mismatches = corrupt(func(data *CheckpointData) {
+		data.meta[last].tables[BlockInsert].Start = 0
+		data.meta[last].tables[BlockInsert].End = 0
+	})
+	require.Equal(t, map[uint64]OffsetProblem{last: OffsetMissing}, problems(mismatches))
+}
+
+func TestRewriteTrimAudit(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	filter := func(bat *batch.Batch, row int) bool {
+		return vector.GetFixedAt[int32](bat.Vecs[0], row)%5 != 0
+	}
+
+	// The rows of the aBlocks of the fixture that are late or that the
+	// filter drops.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	expected := make([]TrimmedRow, 0)
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		if !objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool) {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		tid := objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		bat, err := blockio.LoadOneBlock(ctx, fixture.fs, stats.ObjectLocation(), objectio.SchemaData)
+		require.NoError(t, err)
+		for row := 0; row < bat.RowCount(); row++ {
+			commit := vector.GetFixedAt[types.TS](bat.Vecs[3], row)
+			if !commit.Greater(&spec.Pivot) && filter(bat, row) {
+				continue
+			}
+			rowid := vector.GetFixedAt[types.Rowid](bat.Vecs[2], row)
+			expected = append(expected, TrimmedRow{
+				Table:    tid,
+				RowID:    rowid.String(),
+				CommitTS: commit.ToString(),
+			})
+		}
+	}
+	require.NotEmpty(t, expected)
+
+	readAudit := func(dstFs fileservice.FileService, name string) []byte {
+		vec := fileservice.IOVector{
+			FilePath: name,
+			Entries:  []fileservice.IOEntry{{Size: -1}},
+		}
+		require.NoError(t, dstFs.Read(ctx, &vec))
+		return vec.Entries[0].Data
+	}
+
+	// CSV, a header and a line per row.
+	dstFs := newBackupTestFS(t)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRowFilter(filter), WithTrimAudit("audit.csv", AuditCSV))
+	require.NoError(t, err)
+	records, err := csv.NewReader(bytes.NewReader(readAudit(dstFs, "audit.csv"))).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"table_id", "rowid", "commit_ts"}, records[0])
+	listed := make([]TrimmedRow, 0, len(records)-1)
+	for _, record := range records[1:] {
+		tid, err := strconv.ParseUint(record[0], 10, 64)
+		require.NoError(t, err)
+		listed = append(listed, TrimmedRow{Table: tid, RowID: record[1], CommitTS: record[2]})
+	}
+	require.ElementsMatch(t, expected, listed)
+
+	// JSON, an array of the rows.
+	dstFs = newBackupTestFS(t)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRowFilter(filter), WithTrimAudit("audit.json", AuditJSON))
+	require.NoError(t, err)
+	listed = nil
+	require.NoError(t, json.Unmarshal(readAudit(dstFs, "audit.json"), &listed))
+	require.ElementsMatch(t, expected, listed)
+
+	// A rewrite that trims nothing writes an empty audit.
+	end := types.BuildTS(spec.Pivot.Physical()+int64(spec.RowsPerBlock)+1, 0)
+	dstFs = newBackupTestFS(t)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, end, nil,
+		WithTrimAudit("audit.json", AuditJSON))
+	require.NoError(t, err)
+	require.Equal(t, "[]", string(readAudit(dstFs, "audit.json")))
+}
+
+func TestRewriteDeltaOnlyABlocks(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The entries of the aBlock objects with deletes are dropped, the
+	// checkpoint is left with the deletes of the aBlocks only.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	require.NoError(t, data.FormatData(common.CheckpointAllocator))
+	deltaLocs := make(map[types.Blockid]objectio.Location)
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if view.Source() == BlockMetaInsert && view.EntryState() {
+			deltaLocs[view.Blockid()] = view.DeltaLoc()
+		}
+		return nil
+	}))
+	aBlocks := make(map[types.Blockid]*objectio.ObjectStats)
+	objectInfo := data.bats[ObjectInfoIDX]
+	rows := make([]int, 0)
+	for i := 0; i < objectInfo.Length(); i++ {
+		stats := objectio.NewObjectStats()
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		blkID := *objectio.BuildObjectBlockid(stats.ObjectName(), 0)
+		if _, ok := deltaLocs[blkID]; ok {
+			aBlocks[blkID] = stats
+			rows = append(rows, i)
+		}
+	}
+	require.NotEmpty(t, aBlocks)
+	for _, row := range rows {
+		objectInfo.Delete(row)
+	}
+	objectInfo.Compact()
+	data.shrinkTableMeta(ObjectInfo, rows)
+	cnLocation, tnLocation, _, err := data.WriteTo(fixture.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+	deltaOnly := make([]string, 0, len(aBlocks))
+	for blkID := range aBlocks {
+		deltaOnly = append(deltaOnly, blkID.String())
+	}
+	sort.Strings(deltaOnly)
+
+	rewrite := func(opts ...BackupOption) (fileservice.FileService, objectio.Location, *RewriteResult, error) {
+		dstFs := newBackupTestFS(t)
+		result := &RewriteResult{}
+		loc, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			cnLocation, tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result))...)
+		return dstFs, loc, result, err
+	}
+	// metaRows returns the block meta rows of the delta-only aBlocks of
+	// the checkpoint at loc.
+	metaRows := func(dstFs fileservice.FileService, loc objectio.Location) map[types.Blockid]BlockMetaView {
+		rewritten, err := getCheckpointData(ctx, "", dstFs, loc, CheckpointCurrentVersion)
+		require.NoError(t, err)
+		t.Cleanup(rewritten.Close)
+		views := make(map[types.Blockid]BlockMetaView)
+		require.NoError(t, rewritten.ForEachBlockMeta(func(view BlockMetaView) error {
+			if _, ok := aBlocks[view.Blockid()]; ok && view.Source() == BlockMetaInsert {
+				views[view.Blockid()] = view
+			}
+			return nil
+		}))
+		return views
+	}
+
+	// Carried forward, the rows keep referencing the aBlocks and their
+	// tombstones are trimmed.
+	dstFs, loc, result, err := rewrite()
+	require.NoError(t, err)
+	require.Equal(t, deltaOnly, result.DeltaOnlyBlocks)
+	views := metaRows(dstFs, loc)
+	require.Len(t, views, len(aBlocks))
+	rewritten := make(map[string]bool)
+	for _, name := range result.Files.Rewritten {
+		rewritten[name] = true
+	}
+	for blkID, view := range views {
+		require.True(t, view.EntryState(), blkID.String())
+		require.True(t, view.MetaLoc().IsEmpty(), blkID.String())
+		late, _, err := tombstoneHasLateRows(ctx, fixture.fs, deltaLocs[blkID], spec.Pivot)
+		require.NoError(t, err)
+		require.Equal(t, late, rewritten[view.DeltaLoc().Name().String()], blkID.String())
+	}
+
+	// Materialized, the aBlocks are converted with their deletes
+	// applied, the entries of the objects they are converted to are
+	// added.
+	dstFs, loc, result, err = rewrite(WithBlockIDMapping(), WithMaterializeDeltaOnly(
+		func(_ context.Context, _ uint64, blkID types.Blockid) (*objectio.ObjectStats, error) {
+			return aBlocks[blkID], nil
+		}))
+	require.NoError(t, err)
+	require.Equal(t, deltaOnly, result.DeltaOnlyBlocks)
+	rewrittenData, err := getCheckpointData(ctx, "", dstFs, loc, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewrittenData.Close()
+	objects := make(map[string]objectio.Location)
+	objectInfo = rewrittenData.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		objects[stats.ObjectName().String()] = stats.ObjectLocation()
+	}
+	relocated := make(map[types.Blockid]types.Blockid)
+	for _, block := range result.RelocatedBlocks {
+		relocated[block.Source] = block.Converted
+	}
+	for blkID, stats := range aBlocks {
+		converted, ok := relocated[blkID]
+		require.True(t, ok, blkID.String())
+		location, ok := objects[converted.ObjectNameString()]
+		require.True(t, ok, blkID.String())
+
+		// The rows of the aBlock committed by the pivot and not deleted
+		// by then.
+		bat, err := blockio.LoadOneBlock(ctx, fixture.fs, stats.ObjectLocation(), objectio.SchemaData)
+		require.NoError(t, err)
+		tombstone, err := blockio.LoadOneBlock(ctx, fixture.fs, deltaLocs[blkID], objectio.SchemaTombstone)
+		require.NoError(t, err)
+		deleted := make(map[uint32]bool)
+		for i := 0; i < tombstone.RowCount(); i++ {
+			if commit := vector.GetFixedAt[types.TS](tombstone.Vecs[1], i); !commit.Greater(&spec.Pivot) {
+				rowid := vector.GetFixedAt[types.Rowid](tombstone.Vecs[0], i)
+				deleted[rowid.GetRowOffset()] = true
+			}
+		}
+		expected := make([]int32, 0)
+		for i := 0; i < bat.RowCount(); i++ {
+			commit := vector.GetFixedAt[types.TS](bat.Vecs[3], i)
+			rowid := vector.GetFixedAt[types.Rowid](bat.Vecs[2], i)
+			if !commit.Greater(&spec.Pivot) && !deleted[rowid.GetRowOffset()] {
+				expected = append(expected, vector.GetFixedAt[int32](bat.Vecs[0], i))
+			}
+		}
+		rows, err := blockio.LoadOneBlock(ctx, dstFs, location, objectio.SchemaData)
+		require.NoError(t, err)
+		require.ElementsMatch(t, expected, vector.MustFixedCol[int32](rows.Vecs[0]))
+	}
+
+	// The object of another aBlock is refused.
+	var other types.Blockid
+	for blkID := range aBlocks {
+		other = blkID
+		break
+	}
+	_, _, _, err = rewrite(WithMaterializeDeltaOnly(
+		func(_ context.Context, _ uint64, blkID types.Blockid) (*objectio.ObjectStats, error) {
+			if blkID == other {
+				for id, stats := range aBlocks {
+					if id != other {
+						return stats, nil
+					}
+				}
+			}
+			return aBlocks[blkID], nil
+		}))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+}
+
+// spaceFS is a FileService that reports available bytes of space.
+type spaceFS struct {
+	fileservice.FileService
+	available int64
+}
+
+func (fs *spaceFS) AvailableSpace(context.Context) (int64, error) {
+	return fs.available, nil
+}
+
+func TestRewriteFreeSpaceCheck(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	plan, err := PlanRewrite(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	require.Positive(t, plan.EstimatedBytes)
+
+	rewrite := func(dstFs fileservice.FileService, opts ...BackupOption) error {
+		_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil, opts...)
+		return err
+	}
+	written := func(dstFs fileservice.FileService) int {
+		files, err := dstFs.List(ctx, "")
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	// Short of the estimate, or of the reserve on top of it, the
+	// rewrite fails before it writes anything.
+	for _, c := range []struct {
+		available, reserve int64
+	}{
+		{available: plan.EstimatedBytes - 1},
+		{available: plan.EstimatedBytes + 10, reserve: 11},
+	} {
+		dstFs := &spaceFS{FileService: newBackupTestFS(t), available: c.available}
+		err = rewrite(dstFs, WithFreeSpaceCheck(c.reserve))
+		require.True(t, IsInsufficientSpace(err), err)
+		var se *InsufficientSpaceError
+		require.ErrorAs(t, err, &se)
+		require.Equal(t, plan.EstimatedBytes+c.reserve, se.Required)
+		require.Equal(t, c.available, se.Available)
+		require.Zero(t, written(dstFs))
+	}
+
+	// With the space, it is written.
+	dstFs := &spaceFS{FileService: newBackupTestFS(t), available: plan.EstimatedBytes + 10}
+	require.NoError(t, rewrite(dstFs, WithFreeSpaceCheck(10)))
+	require.NotZero(t, written(dstFs))
+
+	// Without the option, or on a destination that reports no space,
+	// there is no check.
+	require.NoError(t, rewrite(&spaceFS{FileService: newBackupTestFS(t)}))
+	require.NoError(t, rewrite(newBackupTestFS(t), WithFreeSpaceCheck(1<<62)))
+
+	// A LocalFS reports the space of its file system.
+	localFs, err := fileservice.NewLocalFS(ctx, "local", t.TempDir(), fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+	err = rewrite(localFs, WithFreeSpaceCheck(1<<62))
+	require.True(t, IsInsufficientSpace(err), err)
+	require.Zero(t, written(localFs))
+	require.NoError(t, rewrite(localFs, WithFreeSpaceCheck(0)))
+	require.NotZero(t, written(localFs))
+}
+
+func TestRewriteGrowthLimits(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The rewrite converts the aBlocks, the checkpoint does not double.
+	stats := NewBackupStats()
+	result := &RewriteResult{}
+	_, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithBackupStats(stats))
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Growth)
+	for _, growth := range result.Growth {
+		require.LessOrEqual(t, growth.RowRatio, DefaultGrowthLimits.Warn, growth.String())
+	}
+	for _, warning := range stats.Warnings() {
+		require.NotEqual(t, WarnBatchGrowth, warning.Code)
+	}
+
+	// A checkpoint whose insert batch doubles warns, and fails over the cap.
+	data, objectsData := fixture.loadObjectsData(t)
+	defer data.Close()
+	defer freeObjectsData(objectsData)
+	source := measureBatches(data)
+	insert := data.bats[BLKMetaInsertIDX]
+	require.Positive(t, insert.Length())
+	for _, length := range []int{insert.Length(), 1} {
+		window := insert.CloneWindow(0, length, common.CheckpointAllocator)
+		insert.Extend(window)
+		window.Close()
+	}
+
+	options := newBackupOptions()
+	require.NoError(t, options.checkGrowth(source, data))
+	var doubled *BatchGrowth
+	for i := range options.result.Growth {
+		if options.result.Growth[i].Batch == BLKMetaInsertIDX {
+			doubled = &options.result.Growth[i]
+		}
+	}
+	require.NotNil(t, doubled)
+	require.Equal(t, 2*source[BLKMetaInsertIDX].rows+1, doubled.Rows)
+	require.Greater(t, doubled.RowRatio, 2.0)
+	require.Greater(t, doubled.ByteRatio, 1.0)
+	warnings := 0
+	for _, warning := range options.stats.Warnings() {
+		if warning.Code == WarnBatchGrowth {
+			warnings++
+		}
+	}
+	require.Equal(t, 1, warnings)
+
+	options = newBackupOptions(WithGrowthLimits(GrowthLimits{Max: 2}))
+	require.Error(t, options.checkGrowth(source, data))
+	require.Empty(t, options.stats.Warnings())
+	options = newBackupOptions(WithGrowthLimits(GrowthLimits{Max: 3}))
+	require.NoError(t, options.checkGrowth(source, data))
+}
+
+// checkpointPhaseObserver tells when the rewrite enters the phase that
+// writes the checkpoint.
+type checkpointPhaseObserver struct {
+	NopRewriteObserver
+	entered atomic.Bool
+}
+
+func (o *checkpointPhaseObserver) OnPhaseStart(phase int) {
+	if phase == RewritePhases {
+		o.entered.Store(true)
+	}
+}
+
+func TestRewriteCompleteHooks(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	var calls []string
+	hook := func(name string, err error) RewriteHook {
+		return func(ctx context.Context, res *RewriteResult) error {
+			require.NotNil(t, res.Footer)
+			calls = append(calls, name)
+			return err
+		}
+	}
+	rewrite := func(dstFs fileservice.FileService, opts []SessionOption, hooks ...RewriteHook) (*RewriteResult, error) {
+		session, err := NewBackupSession(ctx, dstFs, opts...)
+		require.NoError(t, err)
+		for _, hook := range hooks {
+			session.OnRewriteComplete(hook)
+		}
+		calls = calls[:0]
+		result := &RewriteResult{}
+		observer := &checkpointPhaseObserver{}
+		if counting, ok := dstFs.(*countingFS); ok {
+			counting.onWrite = func(string) error {
+				if observer.entered.Load() {
+					return moerr.NewInternalErrorNoCtx("checkpoint write failed")
+				}
+				return nil
+			}
+		}
+		_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			WithRewriteResult(result), WithBackupSession(session), WithCheckpointFooter(),
+			WithRewriteObserver(observer))
+		return result, err
+	}
+	failed := moerr.NewInternalErrorNoCtx("catalog unavailable")
+
+	// The hooks run in the order they are registered, once the
+	// checkpoint and its footer are written.
+	result, err := rewrite(newBackupTestFS(t), nil, hook("catalog", nil), hook("verify", nil))
+	require.NoError(t, err)
+	require.Equal(t, []string{"catalog", "verify"}, calls)
+	require.Empty(t, result.HookErrors)
+
+	// A rewrite whose checkpoint is not written calls none.
+	_, err = rewrite(newCountingFS(newBackupTestFS(t)), nil, hook("catalog", nil))
+	require.Error(t, err)
+	require.Empty(t, calls)
+
+	// A failed hook is reported, the others still run.
+	result, err = rewrite(newBackupTestFS(t), nil, hook("catalog", failed), hook("verify", nil))
+	require.NoError(t, err)
+	require.Equal(t, []string{"catalog", "verify"}, calls)
+	require.Equal(t, []string{failed.Error()}, result.HookErrors)
+
+	// Unless the hooks are strict, the rewrite fails then.
+	result, err = rewrite(newBackupTestFS(t), []SessionOption{WithStrictHooks()},
+		hook("catalog", failed), hook("verify", nil))
+	require.ErrorIs(t, err, failed)
+	require.Equal(t, []string{"catalog"}, calls)
+	require.Equal(t, []string{failed.Error()}, result.HookErrors)
+}
+
+func TestRewriteReleasableObjects(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+
+	// Two nBlocks with a tombstone: the first is denied, which leaves
+	// its object and its tombstone unreferenced. The tombstone of the
+	// second is moved to block 1 of an object whose block 0 holds the
+	// deletes of a soft deleted object, only block 1 stays referenced.
+	var rows []int
+	require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if view.Source() == BlockMetaInsert && !view.EntryState() && !view.DeltaLoc().IsEmpty() {
+			rows = append(rows, view.Row())
+		}
+		return nil
+	}))
+	require.GreaterOrEqual(t, len(rows), 2)
+	blkMeta, blkMetaTxn := data.bats[BLKMetaInsertIDX], data.bats[BLKMetaInsertTxnIDX]
+	denied := blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(rows[0]).(types.Blockid)
+	deniedTombstone := objectio.Location(blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(rows[0]).([]byte))
+	source := objectio.Location(blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Get(rows[1]).([]byte))
+	live, err := blockio.LoadOneBlock(ctx, fixture.fs, source, objectio.SchemaTombstone)
+	require.NoError(t, err)
+
+	mp := mpool.MustNewZero()
+	softDeleted := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	dead := batch.NewWithSize(4)
+	dead.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	dead.Vecs[1] = vector.NewVec(types.T_TS.ToType())
+	dead.Vecs[2] = vector.NewVec(types.T_int32.ToType())
+	dead.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+	require.NoError(t, vector.AppendFixed(dead.Vecs[0],
+		*types.NewRowid(objectio.BuildObjectBlockid(softDeleted, 0), 0), false, mp))
+	require.NoError(t, vector.AppendFixed(dead.Vecs[1], types.BuildTS(1, 0), false, mp))
+	require.NoError(t, vector.AppendFixed(dead.Vecs[2], int32(0), false, mp))
+	require.NoError(t, vector.AppendFixed(dead.Vecs[3], false, false, mp))
+	dead.SetRowCount(1)
+	defer dead.Clean(mp)
+	mixed := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fixture.fs, mixed, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(dead)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(live)
+	require.NoError(t, err)
+	blocks, _, err := writer.Sync(ctx)
+	require.NoError(t, err)
+	moved := objectio.BuildLocation(mixed, blocks[1].GetExtent(), uint32(live.RowCount()), blocks[1].GetID())
+	blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(rows[1], []byte(moved), false)
+	blkMetaTxn.GetVectorByName(catalog.BlockMeta_DeltaLoc).Update(rows[1], []byte(moved), false)
+	cnLocation, tnLocation, _, err := data.WriteTo(fixture.fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	softDeletes := NewSoftDeletes()
+	_, err = softDeletes.Add(ctx, softDeleted)
+	require.NoError(t, err)
+	result := &RewriteResult{}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		cnLocation, tnLocation, CheckpointCurrentVersion, spec.Pivot, softDeletes,
+		WithRewriteResult(result), WithBlockIDMapping(), WithBlockDenylist([]types.Blockid{denied}))
+	require.NoError(t, err)
+	require.Contains(t, result.Files.Tombstones, mixed.String())
+
+	// Only the objects of the denied block are released, the mixed
+	// object is still referenced by its live block.
+	names := make([]string, 0, len(result.Releasable))
+	for _, object := range result.Releasable {
+		require.Positive(t, object.Bytes, object.String())
+		names = append(names, object.Name)
+	}
+	expected := []string{denied.ObjectNameString(), deniedTombstone.Name().String()}
+	sort.Strings(expected)
+	require.Equal(t, expected, names)
+	for _, object := range result.Releasable {
+		if object.Name == deniedTombstone.Name().String() {
+			require.Equal(t, int64(deniedTombstone.Extent().End())+objectio.FooterSize, object.Bytes)
+		}
+	}
+}
+
+func TestRewriteObjectMoves(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+	source := checkpointReferences(data)
+
+	dstFs := newBackupTestFS(t)
+	result := &RewriteResult{}
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result))
+	require.NoError(t, err)
+	rewritten, err := getCheckpointData(ctx, "", dstFs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	rewritten.FormatData(common.CheckpointAllocator)
+	refs := checkpointReferences(rewritten)
+
+	// Every object of the source has a move, to an object the rewritten
+	// checkpoint references unless it is dropped.
+	require.Equal(t, len(source), len(result.Stats.Moves))
+	kinds := make(map[MoveKind]int)
+	for name := range source {
+		move, ok := result.Stats.Moves[name]
+		require.True(t, ok, name)
+		kinds[move.Kind]++
+		switch move.Kind {
+		case MoveUnchanged:
+			require.Equal(t, name, move.Target)
+		case MoveTrimmed:
+			require.Equal(t, name, move.Target)
+			require.Contains(t, result.Files.Rewritten, name)
+		case MoveRelocated:
+			require.Contains(t, result.Files.Converted, move.Target)
+		case MoveDropped:
+			require.Empty(t, move.Target)
+			continue
+		}
+		require.Contains(t, refs, move.Target, move.String())
+	}
+	require.NotZero(t, kinds[MoveUnchanged])
+	require.NotZero(t, kinds[MoveTrimmed])
+	require.NotZero(t, kinds[MoveRelocated])
+
+	// The releasable objects are those relocated or dropped.
+	for _, object := range result.Releasable {
+		kind := result.Stats.Moves[object.Name].Kind
+		require.Contains(t, []MoveKind{MoveRelocated, MoveDropped}, kind, object.Name)
+	}
+}
+
+func TestRewriteJobLogger(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(core)
+
+	// The reads of one aBlock hang, the best effort sessions skip it.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	var hung string
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length() && hung == ""; i++ {
+		if objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool) {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+			hung = stats.ObjectName().String()
+		}
+	}
+	data.Close()
+	srcFs := newCountingFS(fixture.fs)
+	srcFs.onRead = func(ctx context.Context, name string) error {
+		if name != hung {
+			return nil
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// Two backups run concurrently, each in a session of its own job.
+	jobs := []string{"job-a", "job-b"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(jobs))
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job string) {
+			defer wg.Done()
+			dstFs := newBackupTestFS(t)
+			session, err := NewBackupSession(ctx, dstFs, WithSessionJobLogger(job, logger),
+				WithBestEffort(NewBestEffort(20*time.Millisecond, 1)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, _, _, errs[i] = ReWriteCheckpointAndBlockFromKey(ctx, "", srcFs, dstFs,
+				fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+				WithBackupSession(session), WithBlockParallelism(2))
+			// The fixture has no block in a compaction window, the
+			// overlap is resolved on data that has.
+			options := newBackupOptions(WithBackupSession(session))
+			options.bindJobLogger(fixture.cnLocation, dstFs)
+			overlap, ts, _ := overlapCheckpointData()
+			defer overlap.Close()
+			resolveBlockOverlap(options.withJobLogger(ctx), overlap, ts)
+		}(i, job)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Every line is attributable to exactly one job, and carries the
+	// checkpoint and destination of its rewrite.
+	lines := make(map[string]int)
+	for _, entry := range logs.All() {
+		var job []string
+		fields := entry.ContextMap()
+		for _, field := range entry.Context {
+			if field.Key == LogFieldBackupJob {
+				job = append(job, field.String)
+			}
+		}
+		require.Len(t, job, 1, entry.Message)
+		require.Contains(t, jobs, job[0])
+		require.Equal(t, fixture.cnLocation.String(), fields[LogFieldSource], entry.Message)
+		require.NotEmpty(t, fields[LogFieldDestination], entry.Message)
+		// How often a hung read is retried depends on the timing.
+		if entry.Message != "[BestEffort]" {
+			lines[job[0]]++
+		}
+	}
+	require.NotZero(t, lines["job-a"])
+	require.Equal(t, lines["job-a"], lines["job-b"])
+	for _, job := range jobs {
+		for _, message := range []string{"[BestEffort]", "[ResolveOverlap]"} {
+			require.NotZero(t, logs.FilterMessage(message).FilterField(zap.String(LogFieldBackupJob, job)).Len(),
+				"%s %s", job, message)
+		}
+	}
+
+	// A job logger of a rewrite overrides that of its session, without
+	// any the global logger is used as before.
+	core, logs = observer.New(zap.DebugLevel)
+	session, err := NewBackupSession(ctx, newBackupTestFS(t), WithSessionJobLogger("job-a", logger))
+	require.NoError(t, err)
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithBackupSession(session), WithJobLogger("job-c", zap.New(core)))
+	require.NoError(t, err)
+	require.NotZero(t, logs.Len())
+	for _, entry := range logs.All() {
+		require.Equal(t, "job-c", entry.ContextMap()[LogFieldBackupJob])
+	}
+	require.Equal(t, logutil.GetGlobalLogger(), (&backupOptions{}).log())
+}
+
+func TestImportLegacyBackup(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// A legacy set is the rewritten checkpoint and the objects it
+	// references, without any auxiliary file.
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, tnLocation, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter())
+	require.NoError(t, err)
+	written, err := ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.NoError(t, err)
+	var fileList []string
+	for _, object := range written.Objects {
+		if object.Checksum == "" {
+			buf, err := readBackupFile(ctx, fixture.fs, object.Name)
+			require.NoError(t, err)
+			require.NoError(t, writeBackupFile(ctx, dstFs, object.Name, buf))
+		}
+		fileList = append(fileList, object.Name)
+	}
+	for _, name := range listBackupTestFS(t, ctx, dstFs, "") {
+		if isBackupAuxName(name) {
+			require.NoError(t, dstFs.Delete(ctx, name))
+		}
+	}
+	// The source checkpoint is left over, an object is lost and the
+	// footer of an earlier attempt is listed.
+	stray := fixture.cnLocation.Name().String()
+	buf, err := readBackupFile(ctx, fixture.fs, stray)
+	require.NoError(t, err)
+	require.NoError(t, writeBackupFile(ctx, dstFs, stray, buf))
+	missing := objectio.BuildObjectName(objectio.NewSegmentid(), 1).String()
+	fileList = append(fileList, stray, missing, result.Footer, fileList[0])
+
+	imported, err := ImportLegacyBackup(ctx, dstFs, fileList, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, result.Files.Meta, imported.Files.Meta)
+	require.Equal(t, result.Files.Checkpoint, imported.Files.Checkpoint)
+	require.Equal(t, result.Files.Converted, imported.Files.Converted)
+	require.Subset(t, imported.Files.Tombstones, result.Files.Tombstones)
+	require.Contains(t, imported.Files.Rewritten, stray)
+	require.Equal(t, []byte(tnLocation), []byte(imported.TNCheckpoint))
+	require.False(t, imported.TS.IsEmpty())
+	// The source checkpoint is neither data nor tombstone, and is not
+	// referenced.
+	require.Len(t, imported.Warnings, 5)
+	for i, name := range []string{stray, stray, missing, result.Footer} {
+		require.Contains(t, imported.Warnings[i], name)
+	}
+	require.Contains(t, imported.Warnings[4], "backup ts")
+
+	// The set reads like one the current build wrote.
+	footer, err := ReadCheckpointFooter(ctx, dstFs, imported.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, imported.Footer, CheckpointFooterName(imported.Files.Meta))
+	require.Equal(t, written.Checkpoint, footer.Checkpoint)
+	require.Equal(t, written.TNCheckpoint, footer.TNCheckpoint)
+	require.Equal(t, written.Tables, footer.Tables)
+	require.Empty(t, footer.CheckpointProvenance)
+	require.Len(t, footer.Objects, len(written.Objects)+1)
+	check, err := VerifyBackup(ctx, dstFs, imported.Footer)
+	require.NoError(t, err)
+	require.True(t, check.OK())
+	set, err := OpenBackupSet(ctx, dstFs, imported.Footer)
+	require.NoError(t, err)
+	require.Len(t, set.Tables(), len(written.Tables))
+
+	manifest, err := ReadRestoreManifest(ctx, dstFs, imported.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, imported.Manifest, RestoreManifestName(imported.Files.Meta))
+	require.Equal(t, cnLocation.String(), manifest.Entrypoint.Checkpoint)
+	require.Equal(t, imported.TS.ToString(), manifest.Entrypoint.TS)
+	require.Equal(t, imported.Warnings, manifest.Warnings)
+
+	// The provenance of the checkpoint, when there is one, gives the ts.
+	dstFs = newBackupTestFS(t)
+	cnLocation, _, files, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil)
+	require.NoError(t, err)
+	imported, err = ImportLegacyBackup(ctx, dstFs, files, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, spec.Pivot, imported.TS)
+	footer, err = ReadCheckpointFooter(ctx, dstFs, imported.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, CheckpointProvenanceName(imported.Files.Meta), footer.CheckpointProvenance)
+}
+
+func TestLoadCheckpointEntriesClose(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	// The allocator of the fixture fails the test on a leak.
+	fixture := newCheckpointFixture(t, spec)
+
+	var baseTS types.TS
+	locations, data, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs,
+		fixture.cnLocation, CheckpointCurrentVersion, NewSoftDeletes(), &baseTS)
+	require.NoError(t, err)
+	want := make([]string, 0, len(locations))
+	for _, location := range locations {
+		want = append(want, location.Location.String())
+	}
+	// The locations outlive the data, it is closed once and again.
+	data.Close()
+	data.Close()
+	for i, location := range locations {
+		require.Equal(t, want[i], location.Location.String(), i)
+	}
+	var closed *CheckpointData
+	closed.Close()
+
+	listed, err := ListCheckpointEntriesFromKey(ctx, "", fixture.fs,
+		fixture.cnLocation, CheckpointCurrentVersion, NewSoftDeletes(), &baseTS)
+	require.NoError(t, err)
+	require.Len(t, listed, len(want))
+	for i, location := range listed {
+		require.Equal(t, want[i], location.Location.String(), i)
+	}
+
+	// There is no data to close on error.
+	_, data, err = LoadCheckpointEntriesFromKey(ctx, "", newBackupTestFS(t),
+		fixture.cnLocation, CheckpointCurrentVersion, NewSoftDeletes(), &baseTS)
+	require.Error(t, err)
+	require.Nil(t, data)
+}
+
+func TestLoadCheckpointFromReaderAt(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	files := make(map[string][]byte)
+	for _, name := range listBackupTestFS(t, ctx, fixture.fs, "") {
+		buf, err := readBackupFile(ctx, fixture.fs, name)
+		require.NoError(t, err)
+		files[name] = buf
+	}
+	opened := make(map[string]int)
+	open := func(name string) (io.ReaderAt, int64, error) {
+		buf, ok := files[name]
+		if !ok {
+			return nil, 0, moerr.NewFileNotFoundNoCtx(name)
+		}
+		opened[name]++
+		return bytes.NewReader(buf), int64(len(buf)), nil
+	}
+
+	var baseTS types.TS
+	want, wantData, err := LoadCheckpointEntriesFromKey(ctx, "", fixture.fs,
+		fixture.cnLocation, CheckpointCurrentVersion, NewSoftDeletes(), &baseTS)
+	require.NoError(t, err)
+	defer wantData.Close()
+	got, gotData, err := LoadCheckpointEntriesFromReaderAt(ctx, open,
+		fixture.cnLocation, CheckpointCurrentVersion, NewSoftDeletes(), &baseTS)
+	require.NoError(t, err)
+	defer gotData.Close()
+
+	require.Equal(t, len(want), len(got))
+	for i := range want {
+		require.Equal(t, want[i].Location.String(), got[i].Location.String(), i)
+		require.Equal(t, want[i].NeedCopy, got[i].NeedCopy, i)
+	}
+	require.Len(t, gotData.bats, len(wantData.bats))
+	for i := range wantData.bats {
+		if wantData.bats[i] == nil {
+			require.Nil(t, gotData.bats[i], i)
+			continue
+		}
+		require.Equal(t, wantData.bats[i].Length(), gotData.bats[i].Length(), i)
+	}
+	require.Equal(t, tableRowStats(wantData), tableRowStats(gotData))
+	for name := range wantData.locations {
+		require.NotZero(t, opened[name], name)
+	}
+
+	// It is only read.
+	fs := NewReaderAtFS("archive", open)
+	entry, err := fs.StatFile(ctx, fixture.cnLocation.Name().String())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(files[fixture.cnLocation.Name().String()])), entry.Size)
+	err = writeBackupFile(ctx, fs, "x", []byte("x"))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported), err)
+	_, err = readBackupFile(ctx, fs, "missing")
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+}
+
+func TestRewriteConvertedObjectRows(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	rewrite := func(opts ...BackupOption) (fileservice.FileService, objectio.Location, *RewriteResult) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result), WithCheckpointFooter())...)
+		require.NoError(t, err)
+		return dstFs, cnLocation, result
+	}
+	// The objects are checked before the rewrite without a limit writes
+	// the first parts again under the same names.
+	dstFs, cnLocation, split := rewrite(WithConvertedObjectRows(1))
+	require.NotEmpty(t, split.Files.Tombstones)
+	report, err := VerifyStagedCheckpoint(ctx, dstFs, fixture.fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%+v", report)
+	require.Positive(t, report.Tombstones.ScannedBlocks)
+	for _, name := range split.Files.Converted {
+		_, err := dstFs.StatFile(ctx, name)
+		require.NoError(t, err, name)
+	}
+	splitFooter, err := ReadCheckpointFooter(ctx, dstFs, split.Files.Meta)
+	require.NoError(t, err)
+
+	// Every aBlock with more than a row is split, the tables have the
+	// same rows in more blocks.
+	wholeFs, _, whole := rewrite()
+	require.Greater(t, len(split.Files.Converted), len(whole.Files.Converted))
+	wholeFooter, err := ReadCheckpointFooter(ctx, wholeFs, whole.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, len(wholeFooter.Stats), len(splitFooter.Stats))
+	for i, stats := range wholeFooter.Stats {
+		require.Equal(t, stats.Table, splitFooter.Stats[i].Table)
+		require.Equal(t, stats.DataRows, splitFooter.Stats[i].DataRows, stats.Table)
+		require.Greater(t, splitFooter.Stats[i].DataBlocks, stats.DataBlocks, stats.Table)
+	}
+}
+
+// convertedBlocks returns the blocks of the objects the rewrite of
+// result converted the aBlocks to, by table. Rewrites of a fixture
+// convert to the same names, the metas are read past the meta cache.
+func convertedBlocks(
+	t *testing.T,
+	ctx context.Context,
+	fs fileservice.FileService,
+	cnLocation objectio.Location,
+	result *RewriteResult,
+) map[uint64][]*batch.Batch {
+	converted := make(map[string]bool)
+	for _, name := range result.Files.Converted {
+		converted[name] = true
+	}
+	rewritten, err := getCheckpointData(ctx, "", fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	blocks := make(map[uint64][]*batch.Batch)
+	objectInfo := rewritten.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		if !converted[stats.ObjectName().String()] {
+			continue
+		}
+		require.Equal(t, uint32(1), stats.BlkCnt())
+		tid := objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		meta, err := readObjectMeta(ctx, fs, stats.ObjectLocation())
+		require.NoError(t, err)
+		dataMeta := meta.MustDataMeta()
+		bat, err := readBlockColumns(ctx, fs, &dataMeta, stats.ObjectLocation(), nil)
+		require.NoError(t, err)
+		blocks[tid] = append(blocks[tid], bat)
+	}
+	return blocks
+}
+
+func TestRewriteColumnTypeUpgrades(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+
+	// The rows of the aBlocks of the fixture committed by the pivot.
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+	committed := 0
+	upgrades := make(map[uint64]map[uint16]types.Type)
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		tid := objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)
+		upgrades[tid] = map[uint16]types.Type{0: types.T_int64.ToType()}
+		if !objectInfo.GetVectorByName(ObjectAttr_State).Get(i).(bool) {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		bat, err := blockio.LoadOneBlock(ctx, fixture.fs, stats.ObjectLocation(), objectio.SchemaData)
+		require.NoError(t, err)
+		for row := 0; row < bat.RowCount(); row++ {
+			if commit := vector.GetFixedAt[types.TS](bat.Vecs[3], row); !commit.Greater(&spec.Pivot) {
+				committed++
+			}
+		}
+	}
+
+	// The primary keys of the converted objects of a rewrite, by table,
+	// and whether they were all upgraded to int64.
+	convertedKeys := func(opts ...BackupOption) (map[uint64][]int64, bool) {
+		result := &RewriteResult{}
+		dstFs := newBackupTestFS(t)
+		cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+			fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+			append(opts, WithRewriteResult(result))...)
+		require.NoError(t, err)
+		keys := make(map[uint64][]int64)
+		upgraded := true
+		for tid, blocks := range convertedBlocks(t, ctx, dstFs, cnLocation, result) {
+			for _, bat := range blocks {
+				if bat.Vecs[0].GetType().Oid != types.T_int64 {
+					upgraded = false
+					for _, pk := range vector.MustFixedCol[int32](bat.Vecs[0]) {
+						keys[tid] = append(keys[tid], int64(pk))
+					}
+					continue
+				}
+				require.Equal(t, types.T_int64, bat.Vecs[1].GetType().Oid)
+				keys[tid] = append(keys[tid], vector.MustFixedCol[int64](bat.Vecs[0])...)
+			}
+		}
+		return keys, upgraded
+	}
+
+	// The converted objects have the primary keys as int64, and keep the
+	// other columns as they were. The deletes of the aBlocks committed
+	// by the pivot still apply to them.
+	expected, upgraded := convertedKeys()
+	require.False(t, upgraded)
+	require.NotEmpty(t, expected)
+	kept := 0
+	for _, pks := range expected {
+		kept += len(pks)
+	}
+	require.Less(t, kept, committed)
+	actual, upgraded := convertedKeys(WithColumnTypeUpgrades(upgrades))
+	require.True(t, upgraded)
+	require.Equal(t, len(expected), len(actual))
+	for tid, pks := range expected {
+		require.ElementsMatch(t, pks, actual[tid], tid)
+	}
+
+	// A value that does not fit the new type fails the rewrite.
+	for tid := range upgrades {
+		upgrades[tid] = map[uint16]types.Type{1: types.T_int32.ToType()}
+	}
+	_, _, _, err = ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, newBackupTestFS(t),
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithColumnTypeUpgrades(upgrades))
+	require.ErrorContains(t, err, "does not fit")
+}
+
+func TestCheckpointHeader(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	// The duplicate block meta row is committed before the others.
+	spec.DuplicateMetaRows = 1
+	fixture := newCheckpointFixture(t, spec)
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer data.Close()
+
+	dstFs := newBackupTestFS(t)
+	meta := fixture.cnLocation.Name().String()
+	name, err := WriteCheckpointHeader(ctx, dstFs, meta, data)
+	require.NoError(t, err)
+	require.Equal(t, CheckpointHeaderName(meta), name)
+	header, err := ReadCheckpointHeader(ctx, dstFs, meta)
+	require.NoError(t, err)
+
+	// Every object of the fixture has one block, committed at its end
+	// like the block meta rows but the duplicate.
+	end := types.BuildTS(spec.Pivot.Physical()+int64(spec.RowsPerBlock)+1, 0)
+	require.Equal(t, fixture.aBlocks+fixture.nBlocks, header.Objects)
+	require.Equal(t, uint64(fixture.aBlocks+fixture.nBlocks), header.Blocks)
+	require.Equal(t, types.BuildTS(1, 0).ToString(), header.Start)
+	require.Equal(t, end.ToString(), header.End)
+	require.Len(t, header.Tables, spec.Tables)
+	metaRows := 0
+	for i, table := range header.Tables {
+		require.Equal(t, uint64(fixtureFirstTable+i), table.Table)
+		require.Equal(t, spec.BlocksPerTable, table.Objects)
+		require.Equal(t, uint64(spec.BlocksPerTable), table.Blocks)
+		require.Equal(t, end.ToString(), table.End)
+		metaRows += table.BlockMetaRows
+	}
+	require.Equal(t, types.BuildTS(1, 0).ToString(), header.Tables[0].Start)
+	require.Equal(t, fixture.tombstones+spec.DuplicateMetaRows, metaRows)
+
+	// The header is the one built from the metadata, in a few hundred
+	// bytes.
+	require.Equal(t, BuildCheckpointHeader(data), header)
+	entry, err := dstFs.StatFile(ctx, name)
+	require.NoError(t, err)
+	require.Less(t, entry.Size, int64(1024))
+}
+
+func TestRewriteEncryption(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	fixture := newCheckpointFixture(t, spec)
+	secret := bytes.Repeat([]byte("0123456789abcdef"), 2)
+	block, err := aes.NewCipher(secret)
+	require.NoError(t, err)
+	key := EncryptionKey{ID: "backup-2026", Block: block}
+
+	result := &RewriteResult{}
+	dstFs := newBackupTestFS(t)
+	cnLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, dstFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(result), WithCheckpointFooter(), WithEncryption(key))
+	require.NoError(t, err)
+	require.NotEmpty(t, result.Files.Converted)
+	decrypting := NewDecryptingFS(dstFs, func(id string) (cipher.Block, error) {
+		require.Equal(t, key.ID, id)
+		return block, nil
+	})
+
+	// Every file the rewrite wrote is its header, with the key id but
+	// not the key, and its content encrypted.
+	files := append(result.Files.All(), result.Footer)
+	for _, name := range files {
+		raw, err := readBackupFile(ctx, dstFs, name)
+		require.NoError(t, err)
+		content, err := readBackupFile(ctx, decrypting, name)
+		require.NoError(t, err)
+		require.Equal(t, encryptedSize(int64(len(content))), int64(len(raw)), name)
+		require.Equal(t, encryptedMagic[:], raw[:len(encryptedMagic)], name)
+		require.Contains(t, string(raw[:encryptedHeaderLen]), key.ID)
+		require.False(t, bytes.Contains(raw, secret), name)
+		require.NotEqual(t, content, raw[encryptedHeaderLen:], name)
+		entry, err := decrypting.StatFile(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), entry.Size, name)
+	}
+
+	// Decrypted, the checkpoint verifies and its converted objects have
+	// the rows of those of a rewrite without encryption, the deletes
+	// committed by the pivot applied.
+	report, err := VerifyStagedCheckpoint(ctx, decrypting, fixture.fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Empty(t, report.Unresolved)
+	require.Positive(t, report.Tombstones.ScannedBlocks)
+	pks := func(blocks map[uint64][]*batch.Batch) map[uint64][]int32 {
+		keys := make(map[uint64][]int32)
+		for tid, bats := range blocks {
+			for _, bat := range bats {
+				keys[tid] = append(keys[tid], vector.MustFixedCol[int32](bat.Vecs[0])...)
+			}
+		}
+		return keys
+	}
+	plain := &RewriteResult{}
+	plainFs := newBackupTestFS(t)
+	plainLocation, _, _, err := ReWriteCheckpointAndBlockFromKey(ctx, "", fixture.fs, plainFs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		WithRewriteResult(plain))
+	require.NoError(t, err)
+	expected := pks(convertedBlocks(t, ctx, plainFs, plainLocation, plain))
+	actual := pks(convertedBlocks(t, ctx, decrypting, cnLocation, result))
+	require.NotEmpty(t, expected)
+	require.Equal(t, len(expected), len(actual))
+	for tid, pks := range expected {
+		require.ElementsMatch(t, pks, actual[tid], tid)
+	}
+	rewritten, err := getCheckpointData(ctx, "", decrypting, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer rewritten.Close()
+	footer, err := ReadCheckpointFooter(ctx, decrypting, result.Files.Meta)
+	require.NoError(t, err)
+	require.Equal(t, tableRowStats(rewritten), footer.Stats)
+
+	// Without the key, or read as they are, the files cannot be read.
+	_, err = ReadCheckpointFooter(ctx, NewDecryptingFS(dstFs, func(id string) (cipher.Block, error) {
+		return nil, moerr.NewInternalErrorNoCtx("unknown key %s", id)
+	}), result.Files.Meta)
+	require.ErrorContains(t, err, "unknown key")
+	_, err = ReadCheckpointFooter(ctx, dstFs, result.Files.Meta)
+	require.Error(t, err)
+	_, err = NewEncryptedFS(dstFs, EncryptionKey{ID: "", Block: block})
+	require.Error(t, err)
+}
+
+// swapCrashFS crashes the copy of the crash-th object the swap of an
+// in-place rewrite streams into place, after half of it is written.
+type swapCrashFS struct {
+	fileservice.FileService
+	crash  int
+	copies int
+}
+
+func (f *swapCrashFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if vector.Entries[0].ReaderForWrite == nil {
+		return f.FileService.Write(ctx, vector)
+	}
+	if f.copies++; f.copies != f.crash {
+		return f.FileService.Write(ctx, vector)
+	}
+	data, err := io.ReadAll(vector.Entries[0].ReaderForWrite)
+	if err != nil {
+		return err
+	}
+	half := data[:len(data)/2]
+	if err = f.FileService.Write(ctx, fileservice.IOVector{
+		FilePath: vector.FilePath,
+		Entries: []fileservice.IOEntry{
+			{Offset: 0, Size: int64(len(half)), Data: half},
+		},
+	}); err != nil {
+		return err
+	}
+	return moerr.NewInternalErrorNoCtx("crash copying %s", vector.FilePath)
+}
+
+func TestRewriteCheckpointInPlaceCrash(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.ABlockFraction = 0.25
+	fixture := newCheckpointFixture(t, spec)
+	crashFS := &swapCrashFS{FileService: fixture.fs, crash: 2}
+	exists := func(name string) bool {
+		_, err := fixture.fs.StatFile(ctx, name)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	var published []objectio.Location
+	publish := func(_ context.Context, loc, _ objectio.Location) error {
+		published = append(published, loc)
+		return nil
+	}
+	result := &RewriteResult{}
+	_, _, _, err := RewriteCheckpointInPlace(ctx, "", crashFS,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil,
+		publish, WithRewriteResult(result))
+	require.Error(t, err)
+	require.Greater(t, crashFS.copies, 1)
+	require.Empty(t, published)
+
+	// The crash is after the commit point, the old checkpoint and every
+	// object it references are still there.
+	originals := replacedObjects(result)
+	require.NotEmpty(t, originals)
+	for _, name := range originals {
+		require.True(t, exists(name), name)
+	}
+	data, err := getCheckpointData(ctx, "", fixture.fs, fixture.cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	data.Close()
+	require.True(t, exists(InPlaceIntentName))
+
+	// Recovery rolls the swap forward and publishes the new checkpoint,
+	// whose objects are all in place, then deletes the replaced objects.
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fixture.fs, publish))
+	require.Len(t, published, 1)
+	require.False(t, exists(InPlaceIntentName))
+	for _, name := range originals {
+		require.False(t, exists(name), name)
+	}
+	for _, move := range result.Stats.Moves {
+		if move.Kind != MoveDropped {
+			require.True(t, exists(move.Target), move.Target)
+		}
+	}
+	report, err := VerifyRewrittenCheckpoint(ctx, fixture.fs, published[0], CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report)
+	// Every staged file was moved into place, the auxiliary files of the
+	// new checkpoint included.
+	staged, err := listStaged(ctx, fileservice.SubPath(fixture.fs, InPlaceStagingDir), "")
+	require.NoError(t, err)
+	require.Empty(t, staged)
+	provenance, err := ReadCheckpointProvenance(ctx, fixture.fs, published[0].Name().String())
+	require.NoError(t, err)
+	require.NotEmpty(t, provenance.Hops)
+}
+
+func TestRewriteCheckpointInPlaceLiveABlock(t *testing.T) {
+	ctx := context.Background()
+	spec := defaultCheckpointSpec()
+	spec.LiveABlocks = 1
+	fixture := newCheckpointFixture(t, spec)
+	before, err := listStaged(ctx, fixture.fs, "")
+	require.NoError(t, err)
+
+	// The live aBlock has rows after the pivot, it would have to be
+	// written again under its own name.
+	_, _, _, err = RewriteCheckpointInPlace(ctx, "", fixture.fs,
+		fixture.cnLocation, fixture.tnLocation, CheckpointCurrentVersion, spec.Pivot, nil, nil)
+	require.True(t, IsInPlaceRewriteRefused(err), err)
+	var refused *InPlaceRewriteError
+	require.ErrorAs(t, err, &refused)
+	require.Len(t, refused.Objects, 1)
+
+	// Nothing was written.
+	after, err := listStaged(ctx, fixture.fs, "")
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// CheckpointFooter describes a rewritten checkpoint so that a restore
+// tool can understand a backup without any other metadata. It is an
+// auxiliary file of kind BackupAuxFooter, the magic number and format
+// version are those of its header.
+type CheckpointFooter struct {
+	// Format is the format version of the footer, read from its header.
+	Format uint16 `json:"-"`
+	// Checkpoint and TNCheckpoint are the locations of the CN and TN
+	// meta objects of the checkpoint, written in Version.
+	Checkpoint   []byte `json:"checkpoint"`
+	TNCheckpoint []byte `json:"tn_checkpoint"`
+	Version      uint32 `json:"version"`
+	// TS is the ts the backup is taken at. End is the end ts the
+	// checkpoint is stamped with, see WithCheckpointEnd, a footer
+	// without it ends at TS.
+	TS      string         `json:"ts"`
+	End     string         `json:"end,omitempty"`
+	Tables  []uint64       `json:"tables"`
+	Objects []FooterObject `json:"objects"`
+	// Stats are the row counts of the tables, for a restore to check
+	// its own against, see VerifyRestoreCounts. A footer of an older
+	// build has none.
+	Stats []TableRowStats `json:"stats,omitempty"`
+	// Provenance lists the objects of the source checkpoint, see
+	// WithProvenance.
+	Provenance []ObjectProvenance `json:"provenance,omitempty"`
+	// CheckpointProvenance is the name of the CheckpointProvenance of
+	// the checkpoint. A footer of an older build has none.
+	CheckpointProvenance string `json:"checkpoint_provenance,omitempty"`
+	// CNOnly is set for a checkpoint written WithCNOnly, TNCheckpoint
+	// is empty and the backup cannot restore a whole cluster, see
+	// CheckFullRestore.
+	CNOnly bool `json:"cn_only,omitempty"`
+	// Tags are the tags attached to the files of the backup, see
+	// WithObjectTags, whether the storage keeps them or not.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Projection is set for a checkpoint written WithColumnProjection,
+	// its objects lack the other columns of their table.
+	Projection *FooterProjection `json:"projection,omitempty"`
+}
+
+// FooterObject is an object the checkpoint consists of or refers to.
+// The objects the rewrite wrote have their size and the sha256 of
+// their content, the others are copied as they are and only have what
+// the checkpoint says of them.
+type FooterObject struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size,omitempty"`
+	Rows     uint32 `json:"rows,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// CheckpointFooterName returns the name of the footer of the checkpoint
+// whose CN meta object is meta.
+func CheckpointFooterName(meta string) string {
+	return BackupAuxName(BackupAuxFooter, meta)
+}
+
+// BackupTS returns the ts the backup is taken at.
+func (f *CheckpointFooter) BackupTS() types.TS {
+	return types.StringToTS(f.TS)
+}
+
+// EndTS returns the end ts of the checkpoint.
+func (f *CheckpointFooter) EndTS() types.TS {
+	if f.End == "" {
+		return f.BackupTS()
+	}
+	return types.StringToTS(f.End)
+}
+
+// EncodeCheckpointFooter returns the content of the footer file of f,
+// stamped with createdAt.
+func EncodeCheckpointFooter(f *CheckpointFooter, createdAt types.TS) ([]byte, error) {
+	payload, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeBackupAux(BackupAuxFooter, createdAt, payload)
+}
+
+// DecodeCheckpointFooter parses buf, the content of the footer file
+// name.
+func DecodeCheckpointFooter(name string, buf []byte) (*CheckpointFooter, error) {
+	header, payload, err := DecodeBackupAux(name, BackupAuxFooter, buf)
+	if err != nil {
+		return nil, err
+	}
+	footer := &CheckpointFooter{}
+	if err = json.Unmarshal(payload, footer); err != nil {
+		return nil, err
+	}
+	footer.Format = header.Version
+	return footer, nil
+}
+
+// ReadCheckpointFooter reads the footer of the checkpoint whose CN meta
+// object is meta from fs.
+func ReadCheckpointFooter(ctx context.Context, fs fileservice.FileService, meta string) (*CheckpointFooter, error) {
+	name := CheckpointFooterName(meta)
+	buf, err := readBackupFile(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCheckpointFooter(name, buf)
+}
+
+// writeCheckpointFooter writes the footer of the checkpoint data of
+// version the rewrite wrote to dstFs at cnLocation and returns its
+// name. An empty end is left out, so is a nil projection.
+func writeCheckpointFooter(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	data *CheckpointData,
+	cnLocation, tnLocation objectio.Location,
+	version uint32,
+	ts, end types.TS,
+	files *RewriteFiles,
+	provenance []ObjectProvenance,
+	cnOnly bool,
+	tags map[string]string,
+	projection map[uint64][]uint16,
+	createdAt types.TS,
+) (string, error) {
+	footer, err := buildCheckpointFooter(
+		ctx, dstFs, data, cnLocation, tnLocation, version, ts, end, files, provenance, cnOnly, tags)
+	if err != nil {
+		return "", err
+	}
+	footer.Projection = footerProjection(data, projection, files)
+	return putCheckpointFooter(ctx, dstFs, files.Meta, footer, createdAt)
+}
+
+// buildCheckpointFooter is the footer writeCheckpointFooter writes.
+func buildCheckpointFooter(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	data *CheckpointData,
+	cnLocation, tnLocation objectio.Location,
+	version uint32,
+	ts, end types.TS,
+	files *RewriteFiles,
+	provenance []ObjectProvenance,
+	cnOnly bool,
+	tags map[string]string,
+) (*CheckpointFooter, error) {
+	footer := &CheckpointFooter{
+		Checkpoint:   cnLocation,
+		TNCheckpoint: tnLocation,
+		Version:      version,
+		TS:           ts.ToString(),
+		Stats:        tableRowStats(data),
+		Provenance:   provenance,
+		CNOnly:       cnOnly,
+		Tags:         tags,
+
+		CheckpointProvenance: CheckpointProvenanceName(files.Meta),
+	}
+	if !end.IsEmpty() {
+		footer.End = end.ToString()
+	}
+
+	tables := make(map[uint64]struct{}, len(data.meta))
+	for tid := range data.meta {
+		// The meta of table 0 lists the objects of the checkpoint.
+		if tid != 0 {
+			tables[tid] = struct{}{}
+		}
+	}
+	objects := make(map[string]*FooterObject)
+	addObject := func(name string) *FooterObject {
+		if objects[name] == nil {
+			objects[name] = &FooterObject{Name: name}
+		}
+		return objects[name]
+	}
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		tables[objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)] = struct{}{}
+		object := addObject(stats.ObjectName().String())
+		object.Size = int64(stats.Size())
+		object.Rows = stats.Rows()
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		for _, location := range []objectio.Location{view.MetaLoc(), view.DeltaLoc()} {
+			if !location.IsEmpty() {
+				addObject(location.Name().String())
+			}
+		}
+		return nil
+	})
+	// The sizes in the checkpoint are what the objects were written
+	// with, the files the rewrite wrote are read back for their size
+	// and checksum.
+	for _, name := range files.All() {
+		buf, err := readBackupFile(ctx, dstFs, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(buf)
+		object := addObject(name)
+		object.Size = int64(len(buf))
+		object.Checksum = hex.EncodeToString(sum[:])
+	}
+
+	for tid := range tables {
+		footer.Tables = append(footer.Tables, tid)
+	}
+	sort.Slice(footer.Tables, func(i, j int) bool {
+		return footer.Tables[i] < footer.Tables[j]
+	})
+	for _, object := range objects {
+		footer.Objects = append(footer.Objects, *object)
+	}
+	sort.Slice(footer.Objects, func(i, j int) bool {
+		return footer.Objects[i].Name < footer.Objects[j].Name
+	})
+
+	return footer, nil
+}
+
+// putCheckpointFooter writes footer as the footer of the checkpoint
+// whose CN meta object is meta, stamped with createdAt, and returns its
+// name.
+func putCheckpointFooter(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	meta string,
+	footer *CheckpointFooter,
+	createdAt types.TS,
+) (string, error) {
+	buf, err := EncodeCheckpointFooter(footer, createdAt)
+	if err != nil {
+		return "", err
+	}
+	name := CheckpointFooterName(meta)
+	return name, writeBackupFile(ctx, dstFs, name, buf)
+}
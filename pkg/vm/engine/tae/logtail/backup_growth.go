@@ -0,0 +1,132 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// GrowthLimits bound how much a batch of the rewritten checkpoint may
+// grow over the same batch of the source, in rows or in bytes. The
+// rewrite only ever converts and moves rows, a batch that grows a lot
+// is most likely the work of a bug or of a corrupt source.
+type GrowthLimits struct {
+	// Warn is the factor above which a warning is logged and reported,
+	// 0 never warns.
+	Warn float64
+	// Max is the factor above which the rewrite fails, 0 never fails.
+	Max float64
+}
+
+// DefaultGrowthLimits warn when a batch doubles and do not fail.
+var DefaultGrowthLimits = GrowthLimits{Warn: 2}
+
+// WithGrowthLimits sets the growth limits of the rewritten checkpoint,
+// see GrowthLimits, DefaultGrowthLimits are used otherwise.
+func WithGrowthLimits(limits GrowthLimits) BackupOption {
+	return func(o *backupOptions) {
+		o.growthLimits = limits
+	}
+}
+
+// BatchGrowth is the size of a batch of the rewritten checkpoint next to
+// the size of the same batch of the source. The ratios are 0 for a batch
+// the source has no rows of.
+type BatchGrowth struct {
+	Batch       uint16
+	SourceRows  int
+	Rows        int
+	SourceBytes int64
+	Bytes       int64
+	RowRatio    float64
+	ByteRatio   float64
+}
+
+func (g BatchGrowth) String() string {
+	return fmt.Sprintf("batch %d: %d -> %d rows (%.2fx), %d -> %d bytes (%.2fx)",
+		g.Batch, g.SourceRows, g.Rows, g.RowRatio, g.SourceBytes, g.Bytes, g.ByteRatio)
+}
+
+// factor is the larger of the ratios.
+func (g BatchGrowth) factor() float64 {
+	return max(g.RowRatio, g.ByteRatio)
+}
+
+// batchSize is the size of a batch of a checkpoint.
+type batchSize struct {
+	rows  int
+	bytes int64
+}
+
+// measureBatches returns the size of every batch of data.
+func measureBatches(data *CheckpointData) []batchSize {
+	sizes := make([]batchSize, len(data.bats))
+	for i, bat := range data.bats {
+		if bat == nil {
+			continue
+		}
+		sizes[i] = batchSize{
+			rows:  bat.Length(),
+			bytes: int64(bat.ApproxSize()),
+		}
+	}
+	return sizes
+}
+
+// checkGrowth records in the result the growth of the batches of data
+// over source, the sizes of the batches of the source checkpoint, and
+// warns or fails above the growth limits.
+func (o *backupOptions) checkGrowth(source []batchSize, data *CheckpointData) error {
+	o.result.Growth = o.result.Growth[:0]
+	var worst *BatchGrowth
+	for i, size := range measureBatches(data) {
+		if source[i].rows == 0 && size.rows == 0 {
+			continue
+		}
+		growth := BatchGrowth{
+			Batch:       uint16(i),
+			SourceRows:  source[i].rows,
+			Rows:        size.rows,
+			SourceBytes: source[i].bytes,
+			Bytes:       size.bytes,
+		}
+		if source[i].rows > 0 {
+			growth.RowRatio = float64(size.rows) / float64(source[i].rows)
+		}
+		if source[i].bytes > 0 {
+			growth.ByteRatio = float64(size.bytes) / float64(source[i].bytes)
+		}
+		o.result.Growth = append(o.result.Growth, growth)
+		if o.growthLimits.Warn > 0 && growth.factor() > o.growthLimits.Warn {
+			o.log().Warn("[ReWrite Checkpoint]", common.OperationField("batch growth"),
+				common.AnyField("growth", growth.String()))
+			o.stats.Warn(BackupWarning{
+				Code:   WarnBatchGrowth,
+				Detail: growth.String(),
+			})
+		}
+		if worst == nil || growth.factor() > worst.factor() {
+			worst = &o.result.Growth[len(o.result.Growth)-1]
+		}
+	}
+	if worst != nil && o.growthLimits.Max > 0 && worst.factor() > o.growthLimits.Max {
+		return moerr.NewInternalErrorNoCtx("rewritten checkpoint grows over %.2fx: %s",
+			o.growthLimits.Max, worst.String())
+	}
+	return nil
+}
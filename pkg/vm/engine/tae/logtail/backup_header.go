@@ -0,0 +1,176 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+)
+
+// CheckpointHeader is the shape of a checkpoint: its tables, the
+// objects and blocks of each and the commit ts its entries span, for a
+// tool to inspect a checkpoint without loading its data. It is an
+// auxiliary file of kind BackupAuxCheckpointHeader, see
+// WriteCheckpointHeader, of a few hundred bytes per table.
+type CheckpointHeader struct {
+	// Start and End are the first and last commit ts of the entries of
+	// the checkpoint, empty if it has none.
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+	Objects int    `json:"objects"`
+	Blocks  uint64 `json:"blocks"`
+	// Tables are sorted by table.
+	Tables []TableHeader `json:"tables"`
+}
+
+// TableHeader is the shape of a table of a CheckpointHeader. Objects
+// counts its object entries, CN and TN, and Blocks the blocks of those
+// objects. BlockMetaRows counts the rows of the block meta batches of
+// the table, those of the checkpoints that list blocks rather than
+// objects.
+type TableHeader struct {
+	Table         uint64 `json:"table"`
+	Objects       int    `json:"objects"`
+	Blocks        uint64 `json:"blocks"`
+	BlockMetaRows int    `json:"block_meta_rows"`
+	Start         string `json:"start,omitempty"`
+	End           string `json:"end,omitempty"`
+}
+
+// CheckpointHeaderName returns the name of the header of the checkpoint
+// whose CN meta object is meta.
+func CheckpointHeaderName(meta string) string {
+	return BackupAuxName(BackupAuxCheckpointHeader, meta)
+}
+
+// tsSpan is the first and last of the ts it is extended with.
+type tsSpan struct {
+	start, end types.TS
+}
+
+func (s *tsSpan) extend(ts types.TS) {
+	if ts.IsEmpty() {
+		return
+	}
+	if s.start.IsEmpty() || ts.Less(&s.start) {
+		s.start = ts
+	}
+	if ts.Greater(&s.end) {
+		s.end = ts
+	}
+}
+
+func (s *tsSpan) strings() (start, end string) {
+	if s.start.IsEmpty() {
+		return "", ""
+	}
+	return s.start.ToString(), s.end.ToString()
+}
+
+// BuildCheckpointHeader returns the header of the checkpoint of data. It
+// only reads the batches already loaded.
+func BuildCheckpointHeader(data *CheckpointData) *CheckpointHeader {
+	tables := make(map[uint64]*TableHeader)
+	spans := make(map[uint64]*tsSpan)
+	table := func(tid uint64) (*TableHeader, *tsSpan) {
+		if tables[tid] == nil {
+			tables[tid] = &TableHeader{Table: tid}
+			spans[tid] = &tsSpan{}
+		}
+		return tables[tid], spans[tid]
+	}
+	for tid := range data.meta {
+		// The meta of table 0 lists the objects of the checkpoint.
+		if tid != 0 {
+			table(tid)
+		}
+	}
+
+	header := &CheckpointHeader{Tables: make([]TableHeader, 0, len(tables))}
+	var span tsSpan
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		tids := bat.GetVectorByName(SnapshotAttr_TID)
+		commits := bat.GetVectorByName(txnbase.SnapshotAttr_CommitTS)
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			commit := commits.Get(i).(types.TS)
+			tableHeader, tableSpan := table(tids.Get(i).(uint64))
+			tableHeader.Objects++
+			tableHeader.Blocks += uint64(stats.BlkCnt())
+			tableSpan.extend(commit)
+			span.extend(commit)
+		}
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		tableHeader, tableSpan := table(view.TID())
+		tableHeader.BlockMetaRows++
+		tableSpan.extend(view.CommitTs())
+		span.extend(view.CommitTs())
+		return nil
+	})
+
+	for tid, tableHeader := range tables {
+		tableHeader.Start, tableHeader.End = spans[tid].strings()
+		header.Objects += tableHeader.Objects
+		header.Blocks += tableHeader.Blocks
+		header.Tables = append(header.Tables, *tableHeader)
+	}
+	sort.Slice(header.Tables, func(i, j int) bool {
+		return header.Tables[i].Table < header.Tables[j].Table
+	})
+	header.Start, header.End = span.strings()
+	return header
+}
+
+// WriteCheckpointHeader writes the header of the checkpoint of data,
+// whose CN meta object is meta, to fs and returns its name. It is
+// stamped with the latest commit of data, writing it again writes the
+// same bytes.
+func WriteCheckpointHeader(
+	ctx context.Context,
+	fs fileservice.FileService,
+	meta string,
+	data *CheckpointData,
+) (string, error) {
+	payload, err := json.Marshal(BuildCheckpointHeader(data))
+	if err != nil {
+		return "", err
+	}
+	name := CheckpointHeaderName(meta)
+	return name, writeBackupAux(ctx, fs, name, BackupAuxCheckpointHeader, latestCommitTS(data), payload)
+}
+
+// ReadCheckpointHeader reads the header of the checkpoint whose CN meta
+// object is meta from fs.
+func ReadCheckpointHeader(ctx context.Context, fs fileservice.FileService, meta string) (*CheckpointHeader, error) {
+	payload, err := readBackupAux(ctx, fs, CheckpointHeaderName(meta), BackupAuxCheckpointHeader)
+	if err != nil {
+		return nil, err
+	}
+	header := &CheckpointHeader{}
+	if err = json.Unmarshal(payload, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
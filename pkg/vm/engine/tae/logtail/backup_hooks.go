@@ -0,0 +1,84 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// RewriteHook is called once a rewrite of the session is done, e.g. to
+// register the backup in a catalog or to start its verification.
+type RewriteHook func(ctx context.Context, res *RewriteResult) error
+
+// WithStrictHooks fails a rewrite whose RewriteHook fails, after the
+// hooks registered before it ran. The hooks after it do not run. What
+// the rewrite wrote stays written.
+func WithStrictHooks() SessionOption {
+	return func(s *BackupSession) {
+		s.strictHooks = true
+	}
+}
+
+// OnRewriteComplete registers hook to be called, with the ctx of the
+// rewrite, by every rewrite of the session that succeeds, once the
+// checkpoint, its CheckpointFooter with WithCheckpointFooter and its
+// RestoreManifest with WithRestoreManifest are written. The hooks are
+// called in the order they are registered, a rewrite that fails calls
+// none.
+//
+// A hook that fails is logged and listed in RewriteResult.HookErrors,
+// the rewrite does not fail unless the session has WithStrictHooks.
+func (s *BackupSession) OnRewriteComplete(hook RewriteHook) {
+	s.Lock()
+	defer s.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// rewriteHooks returns the hooks registered on the session.
+func (s *BackupSession) rewriteHooks() ([]RewriteHook, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.hooks[:len(s.hooks):len(s.hooks)], s.strictHooks
+}
+
+// runRewriteHooks calls the hooks of the session on the result of the
+// rewrite, and returns the error of the first that fails if they are
+// strict.
+func (o *backupOptions) runRewriteHooks(ctx context.Context) error {
+	hooks, strict := o.session.rewriteHooks()
+	for i, hook := range hooks {
+		err := hook(ctx, o.result)
+		if err == nil {
+			continue
+		}
+		o.log().Error("[ReWrite Checkpoint]", common.OperationField("rewrite hook"),
+			common.AnyField("hook", i),
+			common.AnyField("error", err))
+		o.result.HookErrors = append(o.result.HookErrors, err.Error())
+		if strict {
+			return err
+		}
+		o.stats.Warn(BackupWarning{
+			Code:   WarnHookFailed,
+			Detail: err.Error(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+)
+
+// incrementalBatches are the batches an incremental checkpoint diffs,
+// the ones a backup finds its objects in. A batch and the batches row
+// aligned with it are diffed together, meta is the kind of table meta
+// of their rows, -1 when they have none.
+var incrementalBatches = []struct {
+	idxes []uint16
+	meta  int
+}{
+	{idxes: []uint16{ObjectInfoIDX}, meta: ObjectInfo},
+	{idxes: []uint16{TNObjectInfoIDX}, meta: -1},
+	{idxes: []uint16{BLKMetaInsertIDX, BLKMetaInsertTxnIDX}, meta: BlockInsert},
+}
+
+// IncrementalCheckpoint returns the checkpoint data of what newer adds
+// to base, both in fs: the object info and block meta rows of newer
+// that base does not have, a row newer changed is one base does not
+// have. Replayed after base, as a checkpoint is after the ones before
+// it, a later row of an object or a block overriding the earlier ones,
+// it gives the objects and block metas of newer. A row of base newer
+// no longer has stays, as it would in the chain.
+//
+// The other batches, the storage usage among them, are not diffed and
+// are left to base. The caller closes the returned data.
+func IncrementalCheckpoint(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	base objectio.Location,
+	baseVersion uint32,
+	newer objectio.Location,
+	newerVersion uint32,
+) (*CheckpointData, error) {
+	// The incremental checkpoint has a TN side, neither of its
+	// checkpoints can be CN only.
+	for _, location := range []objectio.Location{base, newer} {
+		provenance, err := loadCheckpointProvenance(ctx, fs, location)
+		if err != nil {
+			return nil, err
+		}
+		if provenance.IsCNOnly() {
+			return nil, &CNOnlyBackupError{Checkpoint: location.String(), Use: "an incremental checkpoint"}
+		}
+	}
+	baseData, err := getCheckpointData(ctx, sid, fs, base, baseVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer baseData.Close()
+	newerData, err := getCheckpointData(ctx, sid, fs, newer, newerVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer newerData.Close()
+
+	data := NewCheckpointData(sid, common.CheckpointAllocator)
+	for _, batches := range incrementalBatches {
+		rows, err := appendIncrementalRows(
+			pickBatches(baseData, batches.idxes),
+			pickBatches(newerData, batches.idxes),
+			pickBatches(data, batches.idxes))
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+		if batches.meta < 0 {
+			continue
+		}
+		for tid, table := range rows {
+			data.resetTableMeta(tid, batches.meta, int32(table.offset), int32(table.end))
+		}
+	}
+	jobLogger(ctx).Info("[IncrementalCheckpoint]",
+		common.AnyField("base", base.String()),
+		common.AnyField("newer", newer.String()),
+		common.AnyField("objects", data.bats[ObjectInfoIDX].Length()),
+		common.AnyField("tn objects", data.bats[TNObjectInfoIDX].Length()),
+		common.AnyField("block metas", data.bats[BLKMetaInsertIDX].Length()))
+	return data, nil
+}
+
+// WriteIncrementalCheckpoint writes the incremental checkpoint of newer
+// on base to dstFs. It returns the locations of the CN and TN meta
+// objects and the files it wrote, the CN meta object last.
+func WriteIncrementalCheckpoint(
+	ctx context.Context,
+	sid string,
+	fs, dstFs fileservice.FileService,
+	base objectio.Location,
+	baseVersion uint32,
+	newer objectio.Location,
+	newerVersion uint32,
+) (cnLocation, tnLocation objectio.Location, files []string, err error) {
+	data, err := IncrementalCheckpoint(ctx, sid, fs, base, baseVersion, newer, newerVersion)
+	if err != nil {
+		return
+	}
+	defer data.Close()
+	if cnLocation, tnLocation, files, err = data.WriteTo(
+		dstFs, DefaultCheckpointBlockRows, DefaultCheckpointSize); err != nil {
+		return
+	}
+	files = append(files, cnLocation.Name().String())
+	return
+}
+
+func pickBatches(data *CheckpointData, idxes []uint16) []*containers.Batch {
+	bats := make([]*containers.Batch, len(idxes))
+	for i, idx := range idxes {
+		bats[i] = data.bats[idx]
+	}
+	return bats
+}
+
+// appendIncrementalRows appends to dst the rows of newer that base does
+// not have, grouped by table, and returns the rows of each table in
+// dst. The batches of each slice are row aligned, one of them has the
+// tid of the rows.
+func appendIncrementalRows(base, newer, dst []*containers.Batch) (map[uint64]*tableOffset, error) {
+	baseRows, err := alignedLength(base)
+	if err != nil {
+		return nil, err
+	}
+	newerRows, err := alignedLength(newer)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, baseRows)
+	for i := 0; i < baseRows; i++ {
+		seen[rowKey(base, i)] = struct{}{}
+	}
+	added := make(map[uint64][]int)
+	tids := make([]uint64, 0)
+	for i := 0; i < newerRows; i++ {
+		if _, ok := seen[rowKey(newer, i)]; ok {
+			continue
+		}
+		tid := rowTID(newer, i)
+		if added[tid] == nil {
+			tids = append(tids, tid)
+		}
+		added[tid] = append(added[tid], i)
+	}
+	sort.Slice(tids, func(i, j int) bool {
+		return tids[i] < tids[j]
+	})
+
+	tables := make(map[uint64]*tableOffset, len(tids))
+	for _, tid := range tids {
+		table := &tableOffset{
+			offset: dst[0].Length(),
+		}
+		for _, row := range added[tid] {
+			for i := range newer {
+				if err = appendValToBatch(newer[i], dst[i], row); err != nil {
+					return nil, err
+				}
+			}
+		}
+		table.end = dst[0].Length()
+		tables[tid] = table
+	}
+	return tables, nil
+}
+
+// alignedLength returns the rows of bats, which must all have as many.
+func alignedLength(bats []*containers.Batch) (int, error) {
+	rows := bats[0].Vecs[0].Length()
+	for _, bat := range bats[1:] {
+		if bat.Vecs[0].Length() != rows {
+			return 0, moerr.NewInternalErrorNoCtx("aligned batches have %d and %d rows",
+				rows, bat.Vecs[0].Length())
+		}
+	}
+	return rows, nil
+}
+
+// rowTID returns the tid of row, from the first of bats that has one.
+func rowTID(bats []*containers.Batch, row int) uint64 {
+	for _, bat := range bats {
+		if pos, ok := bat.Nameidx[SnapshotAttr_TID]; ok {
+			return bat.Vecs[pos].Get(row).(uint64)
+		}
+	}
+	return 0
+}
+
+// rowKey is the content of row of bats, two rows are the same entry in
+// the same state when their keys are.
+func rowKey(bats []*containers.Batch, row int) string {
+	var key strings.Builder
+	for _, bat := range bats {
+		for _, vec := range bat.Vecs {
+			if vec.IsNull(row) {
+				key.WriteString("null")
+			} else {
+				fmt.Fprintf(&key, "%v", vec.Get(row))
+			}
+			key.WriteByte(0)
+		}
+	}
+	return key.String()
+}
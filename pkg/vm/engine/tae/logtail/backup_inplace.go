@@ -0,0 +1,412 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+const (
+	// InPlaceStagingDir holds the objects of an in-place rewrite until
+	// they are swapped into place.
+	InPlaceStagingDir = BackupAuxDir + "/" + BackupAuxInPlace + "/staging"
+	// InPlaceIntentName is written once the staged objects are verified.
+	// While it exists the staged objects are authoritative.
+	InPlaceIntentName = BackupAuxDir + "/" + BackupAuxInPlace + "/intent"
+)
+
+// swapIntent lists the staged objects to copy into place, the
+// checkpoint that references them and the objects of the old
+// checkpoint they replace.
+type swapIntent struct {
+	Files      []string `json:"files"`
+	Location   []byte   `json:"location"`
+	TNLocation []byte   `json:"tn_location"`
+	Originals  []string `json:"originals,omitempty"`
+}
+
+// InPlaceRewriteError is returned by RewriteCheckpointInPlace for a
+// checkpoint that has objects which can only be written again under
+// their own name: the aBlocks still live in it. The rowids of their
+// rows and of the deletes of their rows refer to the blocks by the name
+// of the object, it cannot be renamed, and the object of the old
+// checkpoint is never overwritten. The checkpoint is refused before
+// anything is written, fs is left as it was.
+type InPlaceRewriteError struct {
+	Objects []string
+}
+
+func (e *InPlaceRewriteError) Error() string {
+	return fmt.Sprintf("cannot rewrite in place the live aBlocks %s",
+		strings.Join(e.Objects, ", "))
+}
+
+func IsInPlaceRewriteRefused(err error) bool {
+	var ie *InPlaceRewriteError
+	return errors.As(err, &ie)
+}
+
+// PublishCheckpoint makes the checkpoint at loc and tnLocation the one
+// readers load, e.g. by recording it in the checkpoint meta. It may be
+// called again for the same checkpoint, after a crash.
+type PublishCheckpoint func(ctx context.Context, loc, tnLocation objectio.Location) error
+
+// withRewrittenObjectNames writes the objects the rewrite trims under a
+// new name, in a new segment, instead of their own, see rewriteTarget.
+func withRewrittenObjectNames() BackupOption {
+	return func(o *backupOptions) {
+		o.rewrittenName = func(src objectio.ObjectName) objectio.ObjectName {
+			return objectio.BuildObjectName(objectio.NewSegmentid(), src.Num())
+		}
+	}
+}
+
+// RewriteCheckpointInPlace is ReWriteCheckpointAndBlockFromKey with fs as
+// both the source and the destination.
+//
+// No object of the old checkpoint is overwritten: the objects the
+// rewrite trims are written under new names, as are the converted ones
+// and the checkpoint. They are first written under InPlaceStagingDir
+// and the new checkpoint is read back from there. Only then the intent
+// file is written, which is the commit point: a crash before it leaves
+// fs as it was, a crash after it is rolled forward by
+// RecoverInPlaceRewrite. The staged objects are then copied into place,
+// next to the objects of the old checkpoint, which stays readable.
+//
+// Once they are all in place, publish publishes the new checkpoint and
+// the objects of the old one it replaced are deleted, they are no
+// longer referenced. With a nil publish the caller publishes the
+// returned locations itself and the replaced objects are left to the
+// GC.
+//
+// A checkpoint with live aBlocks is refused with an InPlaceRewriteError,
+// see checkRenamable.
+func RewriteCheckpointInPlace(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	loc, tnLocation objectio.Location,
+	version uint32, ts types.TS,
+	softDeletes *SoftDeletes,
+	publish PublishCheckpoint,
+	opts ...BackupOption,
+) (objectio.Location, objectio.Location, []string, error) {
+	options := newBackupOptions(opts...)
+	options.bindJobLogger(loc, fs)
+	ctx = options.withJobLogger(ctx)
+	if err := RecoverInPlaceRewrite(ctx, fs, publish); err != nil {
+		return nil, nil, nil, err
+	}
+	// The result of the caller, if it asked for one, tells which source
+	// objects are replaced.
+	result := options.result
+	opts = append(opts, withRewrittenObjectNames(), WithRewriteResult(result))
+	staging := fileservice.SubPath(fs, InPlaceStagingDir)
+	newLoc, newTNLoc, files, err := ReWriteCheckpointAndBlockFromKey(
+		ctx, sid, fs, staging, loc, tnLocation, version, ts, softDeletes, opts...)
+	if err != nil {
+		abortInPlaceRewrite(ctx, fs, err)
+		return nil, nil, nil, err
+	}
+	intent, err := stageSwap(ctx, sid, staging, newLoc, newTNLoc, version)
+	if err != nil {
+		abortInPlaceRewrite(ctx, fs, err)
+		return nil, nil, nil, err
+	}
+	if len(intent.Files) == 0 {
+		// Nothing changed, the checkpoint is kept as it is. The hop its
+		// provenance got in staging is dropped with it.
+		if err = discardStaging(ctx, fs); err != nil {
+			return nil, nil, nil, err
+		}
+		return newLoc, newTNLoc, files, nil
+	}
+	intent.Originals = replacedObjects(result)
+	if err = commitSwap(ctx, fs, intent); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = applySwap(ctx, fs, intent, publish); err != nil {
+		return nil, nil, nil, err
+	}
+	return newLoc, newTNLoc, files, nil
+}
+
+// replacedObjects returns the source objects of the rewrite of result
+// that the rewritten checkpoint no longer references. A relocated aBlock
+// is not one of them: its object info row is kept, with the delete ts
+// it had, next to the row of the object it was converted to.
+func replacedObjects(result *RewriteResult) []string {
+	originals := make([]string, 0, len(result.Stats.Moves))
+	for name, move := range result.Stats.Moves {
+		if move.Kind != MoveUnchanged && move.Kind != MoveRelocated && move.Target != name {
+			originals = append(originals, name)
+		}
+	}
+	sort.Strings(originals)
+	return originals
+}
+
+// RecoverInPlaceRewrite finishes the swap of an in-place rewrite that
+// crashed after its commit point, publishing its checkpoint with
+// publish, or drops the staged objects of one that crashed before it.
+func RecoverInPlaceRewrite(ctx context.Context, fs fileservice.FileService, publish PublishCheckpoint) error {
+	buf, err := readBackupAux(ctx, fs, InPlaceIntentName, BackupAuxInPlace)
+	if err != nil {
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return discardStaging(ctx, fs)
+		}
+		return err
+	}
+	intent := &swapIntent{}
+	if err = json.Unmarshal(buf, intent); err != nil {
+		return err
+	}
+	jobLogger(ctx).Info("[InPlaceRewrite]", common.OperationField("roll forward"),
+		common.AnyField("files", len(intent.Files)))
+	return applySwap(ctx, fs, intent, publish)
+}
+
+// checkRenamable refuses an in-place rewrite of a checkpoint that has
+// live aBlocks, see InPlaceRewriteError. It only reads the object info
+// of data, the check is made before any object is loaded or written.
+func (o *backupOptions) checkRenamable(data *CheckpointData) error {
+	if o.rewrittenName == nil {
+		return nil
+	}
+	objInfo := data.bats[ObjectInfoIDX]
+	stateVec := objInfo.GetVectorByName(ObjectAttr_State)
+	deleteVec := objInfo.GetVectorByName(EntryNode_DeleteAt)
+	statsVec := objInfo.GetVectorByName(ObjectAttr_ObjectStats)
+	var live []string
+	for i := 0; i < objInfo.Length(); i++ {
+		isABlk, err := checkpointValue[bool](stateVec, i)
+		if err != nil {
+			return err
+		}
+		deleteAt, err := checkpointValue[types.TS](deleteVec, i)
+		if err != nil {
+			return err
+		}
+		if !isABlk || !deleteAt.IsEmpty() {
+			continue
+		}
+		stats, err := checkpointStats(statsVec, i)
+		if err != nil {
+			return err
+		}
+		live = append(live, stats.ObjectName().String())
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	sort.Strings(live)
+	return &InPlaceRewriteError{Objects: live}
+}
+
+// listStaged returns the files under dir of staging, those of its
+// subdirectories included, e.g. the provenance and the footer of the
+// new checkpoint under BackupAuxDir.
+func listStaged(ctx context.Context, staging fileservice.FileService, dir string) ([]string, error) {
+	entries, err := staging.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name)
+		if !entry.IsDir {
+			files = append(files, name)
+			continue
+		}
+		sub, err := listStaged(ctx, staging, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// stageSwap verifies that the new checkpoint can be read back from
+// staging and collects the staged files.
+func stageSwap(
+	ctx context.Context,
+	sid string,
+	staging fileservice.FileService,
+	loc, tnLocation objectio.Location,
+	version uint32,
+) (*swapIntent, error) {
+	intent := &swapIntent{
+		Location:   loc,
+		TNLocation: tnLocation,
+	}
+	staged, err := listStaged(ctx, staging, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range staged {
+		if name == loc.Name().String() {
+			intent.Files = staged
+			break
+		}
+	}
+	if len(intent.Files) == 0 {
+		// The checkpoint is not staged, the rewrite kept it as it is.
+		return intent, nil
+	}
+	for _, location := range []objectio.Location{loc, tnLocation} {
+		if location.IsEmpty() {
+			// The TN location of a checkpoint written WithCNOnly.
+			continue
+		}
+		data, err := getCheckpointData(ctx, sid, staging, location, version)
+		if err != nil {
+			return nil, err
+		}
+		data.Close()
+	}
+	return intent, nil
+}
+
+func commitSwap(ctx context.Context, fs fileservice.FileService, intent *swapIntent) error {
+	buf, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	return writeBackupAux(ctx, fs, InPlaceIntentName, BackupAuxInPlace, auxWallClock(), buf)
+}
+
+// applySwap copies the staged files into place, the objects and their
+// auxiliary files under BackupAuxDir, publishes the new checkpoint with
+// publish, if not nil, then deletes the objects it replaced and the
+// intent file. It can be repeated after a crash: the files already
+// copied are no longer in staging and are skipped.
+//
+// The staged objects have names no object of the old checkpoint has,
+// a copy never overwrites one of them. A copy left incomplete by a
+// crash is not referenced yet, it is written again.
+func applySwap(ctx context.Context, fs fileservice.FileService, intent *swapIntent, publish PublishCheckpoint) error {
+	staging := fileservice.SubPath(fs, InPlaceStagingDir)
+	originals := make(map[string]struct{}, len(intent.Originals))
+	for _, name := range intent.Originals {
+		originals[name] = struct{}{}
+	}
+	for _, name := range intent.Files {
+		if _, ok := originals[name]; ok {
+			return moerr.NewInternalErrorNoCtx("staged object %s replaces an object of the old checkpoint", name)
+		}
+		err := copyBackupFile(ctx, staging, fs, name)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			continue
+		}
+		if moerr.IsMoErrCode(err, moerr.ErrFileAlreadyExists) {
+			if err = fs.Delete(ctx, name); err != nil {
+				return err
+			}
+			err = copyBackupFile(ctx, staging, fs, name)
+		}
+		if err != nil {
+			return err
+		}
+		if err = staging.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	if publish != nil {
+		if err := publish(ctx, intent.Location, intent.TNLocation); err != nil {
+			return err
+		}
+		for _, name := range intent.Originals {
+			if err := fs.Delete(ctx, name); err != nil &&
+				!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+				return err
+			}
+		}
+	}
+	if err := fs.Delete(ctx, InPlaceIntentName); err != nil &&
+		!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return err
+	}
+	jobLogger(ctx).Info("[InPlaceRewrite]", common.OperationField("swapped"),
+		common.AnyField("checkpoint", objectio.Location(intent.Location).String()),
+		common.AnyField("files", len(intent.Files)),
+		common.AnyField("published", publish != nil),
+		common.AnyField("originals", len(intent.Originals)))
+	return nil
+}
+
+// copyBackupFile streams the file name from src to dst, without holding
+// it in memory.
+func copyBackupFile(ctx context.Context, src, dst fileservice.FileService, name string) error {
+	var reader io.ReadCloser
+	if err := src.Read(ctx, &fileservice.IOVector{
+		FilePath: name,
+		Entries: []fileservice.IOEntry{{
+			Offset:            0,
+			Size:              -1,
+			ReadCloserForRead: &reader,
+		}},
+	}); err != nil {
+		return err
+	}
+	defer reader.Close()
+	return dst.Write(ctx, fileservice.IOVector{
+		FilePath: name,
+		Entries: []fileservice.IOEntry{{
+			Offset:         0,
+			Size:           -1,
+			ReaderForWrite: reader,
+		}},
+	})
+}
+
+// abortInPlaceRewrite drops the staged objects of a rewrite that failed
+// before its commit point. A failure to do so is only logged, the next
+// RecoverInPlaceRewrite retries.
+func abortInPlaceRewrite(ctx context.Context, fs fileservice.FileService, cause error) {
+	if err := discardStaging(ctx, fs); err != nil {
+		jobLogger(ctx).Warn("[InPlaceRewrite]", common.OperationField("discard staging"),
+			common.AnyField("cause", cause.Error()),
+			common.AnyField("error", err.Error()))
+	}
+}
+
+func discardStaging(ctx context.Context, fs fileservice.FileService) error {
+	staging := fileservice.SubPath(fs, InPlaceStagingDir)
+	staged, err := listStaged(ctx, staging, "")
+	if err != nil {
+		return err
+	}
+	for _, name := range staged {
+		if err = staging.Delete(ctx, name); err != nil &&
+			!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// tombstoneLayout tells where the columns of a tombstone block are.
+// The rowid is counted from the first column, the commit ts and the
+// primary key from the last one, the abort flag is always last.
+type tombstoneLayout struct {
+	name     string
+	rowid    int
+	commitTs int
+	pk       int
+}
+
+var (
+	// currentTombstoneLayout is [rowid, commitTs, pk, abort], what the
+	// writers write today.
+	currentTombstoneLayout = &tombstoneLayout{
+		name:     "current",
+		rowid:    0,
+		commitTs: 3,
+		pk:       2,
+	}
+	// legacyTombstoneLayout is [rowid, pk, commitTs, abort], what the
+	// objects whose meta is older than IOET_ObjectMeta_V3 hold.
+	legacyTombstoneLayout = &tombstoneLayout{
+		name:     "legacy",
+		rowid:    0,
+		commitTs: 2,
+		pk:       3,
+	}
+)
+
+// tombstoneLayouts is the layout of the tombstone blocks of an object
+// by the version of its meta.
+var tombstoneLayouts = map[uint16]*tombstoneLayout{
+	objectio.IOET_ObjectMeta_V1: legacyTombstoneLayout,
+	objectio.IOET_ObjectMeta_V2: legacyTombstoneLayout,
+	objectio.IOET_ObjectMeta_V3: currentTombstoneLayout,
+}
+
+// readTombstoneMeta reads the tombstone meta of the object of the
+// tombstone block at location, past the meta cache like readObjectMeta,
+// and the layout of its blocks.
+func readTombstoneMeta(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+) (objectio.ObjectDataMeta, *tombstoneLayout, error) {
+	name := location.Name()
+	extent := location.Extent()
+	meta, version, err := objectio.ReadObjectMetaWithVersion(
+		ctx, name.String(), &extent, fileservice.SkipAllCache, fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	layout := tombstoneLayouts[version]
+	if layout == nil {
+		return nil, nil, moerr.NewInternalError(ctx, "tombstone %s has unknown meta version %d",
+			location.String(), version)
+	}
+	return meta.MustGetMeta(objectio.SchemaTombstone), layout, nil
+}
+
+// commitTsIdx returns the commit ts column of a block of columns
+// columns.
+func (l *tombstoneLayout) commitTsIdx(columns int) int {
+	return columns - l.commitTs
+}
+
+// commitTsColumn returns the commit ts column of vecs, the columns of a
+// tombstone block, nil for a block that only has rowids.
+func (l *tombstoneLayout) commitTsColumn(vecs []*vector.Vector) *vector.Vector {
+	if idx := l.commitTsIdx(len(vecs)); idx > l.rowid {
+		return vecs[idx]
+	}
+	return nil
+}
+
+// pkIdx returns the primary key column of a block of columns columns.
+func (l *tombstoneLayout) pkIdx(columns int) int {
+	return columns - l.pk
+}
+
+// normalize reorders the columns of bat, a tombstone block in l, into
+// the current layout. A tombstone the rewrite writes is always in the
+// current layout, as its meta is.
+func (l *tombstoneLayout) normalize(bat *batch.Batch) {
+	if l == currentTombstoneLayout {
+		return
+	}
+	columns := len(bat.Vecs)
+	from := []int{l.rowid, l.commitTsIdx(columns), l.pkIdx(columns)}
+	to := []int{
+		currentTombstoneLayout.rowid,
+		currentTombstoneLayout.commitTsIdx(columns),
+		currentTombstoneLayout.pkIdx(columns),
+	}
+	vecs := append(bat.Vecs[:0:0], bat.Vecs...)
+	for i := range from {
+		vecs[to[i]] = bat.Vecs[from[i]]
+	}
+	bat.Vecs = vecs
+	if len(bat.Attrs) == columns {
+		attrs := append(bat.Attrs[:0:0], bat.Attrs...)
+		for i := range from {
+			attrs[to[i]] = bat.Attrs[from[i]]
+		}
+		bat.Attrs = attrs
+	}
+}
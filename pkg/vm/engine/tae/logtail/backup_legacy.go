@@ -0,0 +1,314 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+)
+
+// LegacyBackup is what ImportLegacyBackup made of a legacy backup set.
+type LegacyBackup struct {
+	// Files are the files of the set by what they are. A legacy set
+	// does not tell the objects the rewrite wrote from those it copied,
+	// its data and tombstone objects are all Rewritten but the
+	// converted ones.
+	Files RewriteFiles
+	// TS is the ts the backup is taken at, TNCheckpoint the location of
+	// the TN meta object of the checkpoint, empty if it has none.
+	TS           types.TS
+	TNCheckpoint objectio.Location
+	// Footer and Manifest are the CheckpointFooter and RestoreManifest
+	// written for the set.
+	Footer   string
+	Manifest string
+	// Warnings are what the import could not tell for sure, the
+	// manifest lists them too.
+	Warnings []string
+}
+
+// ImportLegacyBackup writes a CheckpointFooter and a RestoreManifest for
+// a backup set in fs written by a build that wrote neither: fileList,
+// the files of the set as recorded outside of it, and the checkpoint of
+// version at checkpointLoc. The tools that read a backup by its footer
+// or manifest, e.g. VerifyBackup and OpenBackupSet, then read it like
+// any other.
+//
+// The files are classified the way the rewrite would have: the objects
+// of the checkpoint by the checkpoint, the others by their object meta,
+// checked against what the checkpoint references them as. The data
+// objects named with the legacy numbering of BackupDataObjectName are
+// taken for converted aBlocks. The backup ts is that of the provenance
+// of the checkpoint or else the latest commit of its rows. Whatever is
+// guessed or does not add up, e.g. a file listed but not in fs or an
+// object the checkpoint does not reference, is recorded as a warning
+// rather than failing the import.
+func ImportLegacyBackup(
+	ctx context.Context,
+	fs fileservice.FileService,
+	fileList []string,
+	checkpointLoc objectio.Location,
+	version uint32,
+) (*LegacyBackup, error) {
+	data, err := getCheckpointData(ctx, "", fs, checkpointLoc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+	imported := &LegacyBackup{}
+	warn := func(format string, args ...any) {
+		imported.Warnings = append(imported.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	meta := checkpointLoc.Name().String()
+	checkpoint := map[string]struct{}{meta: {}}
+	for name := range data.locations {
+		checkpoint[name] = struct{}{}
+	}
+	if imported.TNCheckpoint, err = legacyTNLocation(ctx, fs, checkpointLoc); err != nil {
+		return nil, err
+	}
+	if imported.TNCheckpoint.IsEmpty() {
+		warn("checkpoint %s has no TN meta, the backup is CN only", meta)
+	}
+	tombstones := make(map[string]struct{})
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if deltaLoc := view.DeltaLoc(); !deltaLoc.IsEmpty() {
+			tombstones[deltaLoc.Name().String()] = struct{}{}
+		}
+		return nil
+	})
+	refs := checkpointReferences(data)
+
+	files := &imported.Files
+	listed := make(map[string]struct{}, len(fileList))
+	for _, name := range fileList {
+		if _, ok := listed[name]; ok {
+			continue
+		}
+		listed[name] = struct{}{}
+		if isBackupAuxName(name) {
+			warn("%s is an auxiliary file, left out", name)
+			continue
+		}
+		if _, ok := checkpoint[name]; ok {
+			files.Checkpoint = append(files.Checkpoint, name)
+			continue
+		}
+		role, known, err := legacyObjectRole(ctx, fs, name)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			warn("%s is listed but not in the backup", name)
+			continue
+		}
+		if err != nil {
+			warn("%s is not an object, left out: %v", name, err)
+			continue
+		}
+		_, referenced := refs[name]
+		if _, ok := tombstones[name]; ok {
+			if known && role != FileRoleTombstone {
+				warn("%s is a tombstone of the checkpoint but its meta has data blocks", name)
+			}
+			role = FileRoleTombstone
+		} else if !known {
+			warn("the meta of %s does not tell data from tombstone, taken for data", name)
+		}
+		if !referenced {
+			warn("%s is not referenced by the checkpoint", name)
+		}
+		switch {
+		case role == FileRoleTombstone:
+			files.Rewritten = append(files.Rewritten, name)
+			files.Tombstones = append(files.Tombstones, name)
+		case isLegacyConvertedName(name):
+			files.Converted = append(files.Converted, name)
+		default:
+			files.Rewritten = append(files.Rewritten, name)
+		}
+	}
+	// The checkpoint was just read from fs, its objects are there even
+	// if the list misses them.
+	for name := range checkpoint {
+		if _, ok := listed[name]; !ok {
+			warn("checkpoint object %s is not listed, added", name)
+			files.Checkpoint = append(files.Checkpoint, name)
+		}
+	}
+	for name := range refs {
+		_, ok := listed[name]
+		if _, isCheckpoint := checkpoint[name]; !ok && !isCheckpoint {
+			warn("%s is referenced by the checkpoint but not listed", name)
+		}
+	}
+	files.Meta = meta
+	files.sort()
+
+	provenance, err := loadCheckpointProvenance(ctx, fs, checkpointLoc)
+	if err != nil {
+		return nil, err
+	}
+	if provenance != nil && len(provenance.Hops) > 0 {
+		imported.TS = types.StringToTS(provenance.Hops[len(provenance.Hops)-1].TS)
+	} else {
+		imported.TS = latestCommitTS(data)
+		warn("the backup ts is not recorded, %s, the latest commit of the checkpoint, is used",
+			imported.TS.ToString())
+	}
+	footer, err := buildCheckpointFooter(
+		ctx, fs, data, checkpointLoc, imported.TNCheckpoint, version, imported.TS, types.TS{},
+		files, nil, imported.TNCheckpoint.IsEmpty(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if provenance == nil {
+		footer.CheckpointProvenance = ""
+	}
+	if imported.Footer, err = putCheckpointFooter(ctx, fs, meta, footer, imported.TS); err != nil {
+		return nil, err
+	}
+	if imported.Manifest, err = writeRestoreManifest(
+		ctx, fs, checkpointLoc, imported.TNCheckpoint, version, imported.TS, types.TS{},
+		files, []string{imported.Footer}, imported.Warnings, nil, imported.TNCheckpoint.IsEmpty()); err != nil {
+		return nil, err
+	}
+	jobLogger(ctx).Info("[ImportLegacyBackup]", common.OperationField("imported"),
+		common.OperandField(checkpointLoc.String()),
+		common.AnyField("files", len(files.All())),
+		common.AnyField("warnings", len(imported.Warnings)))
+	return imported, nil
+}
+
+// legacyTNLocation returns the location of the TN meta of the checkpoint
+// at cnLocation, the second sub batch of the object of the CN meta, see
+// WriteTo, empty if the checkpoint was written without one.
+func legacyTNLocation(
+	ctx context.Context,
+	fs fileservice.FileService,
+	cnLocation objectio.Location,
+) (objectio.Location, error) {
+	meta, err := objectio.FastLoadObjectMeta(ctx, &cnLocation, false, fs)
+	if err != nil {
+		return nil, err
+	}
+	if meta.SubMetaCount() < 2 {
+		return nil, nil
+	}
+	tnMeta, _ := meta.SubMeta(1)
+	return objectio.BuildLocation(
+		cnLocation.Name(), cnLocation.Extent(), 0, tnMeta.BlockHeader().StartID()), nil
+}
+
+// legacyObjectRole reads the meta of the object name in fs and tells
+// whether it holds data or tombstone blocks. known is false for an
+// object that has both or neither.
+func legacyObjectRole(
+	ctx context.Context,
+	fs fileservice.FileService,
+	name string,
+) (role FileRole, known bool, err error) {
+	buf, err := readBackupFile(ctx, fs, name)
+	if err != nil {
+		return FileRoleData, false, err
+	}
+	if len(buf) < objectio.HeaderSize+objectio.FooterSize {
+		return FileRoleData, false, moerr.NewInternalErrorNoCtx("object %s is too short", name)
+	}
+	extent := objectio.Header(buf).Extent()
+	objectName, ok := parseObjectName(name)
+	if !ok {
+		return FileRoleData, false, moerr.NewInternalErrorNoCtx("%s is not an object name", name)
+	}
+	location := objectio.BuildLocation(objectName, extent, 0, 0)
+	meta, err := readObjectMeta(ctx, fs, location)
+	if err != nil {
+		return FileRoleData, false, err
+	}
+	var dataBlocks, tombstoneBlocks uint32
+	if dataMeta, ok := meta.DataMeta(); ok {
+		dataBlocks = dataMeta.BlockCount()
+	}
+	if tombstoneMeta, ok := meta.TombstoneMeta(); ok {
+		tombstoneBlocks = tombstoneMeta.BlockCount()
+	}
+	switch {
+	case tombstoneBlocks > 0 && dataBlocks == 0:
+		return FileRoleTombstone, true, nil
+	case dataBlocks > 0 && tombstoneBlocks == 0:
+		return FileRoleData, true, nil
+	default:
+		return FileRoleData, false, nil
+	}
+}
+
+// latestCommitTS returns the latest commit ts of the rows of data.
+func latestCommitTS(data *CheckpointData) types.TS {
+	var latest types.TS
+	for _, bat := range data.bats {
+		if bat == nil {
+			continue
+		}
+		for i, attr := range bat.Attrs {
+			if attr != txnbase.SnapshotAttr_CommitTS && attr != catalog.BlockMeta_CommitTs {
+				continue
+			}
+			vec := bat.Vecs[i]
+			for row := 0; row < vec.Length(); row++ {
+				if ts := vec.Get(row).(types.TS); ts.Greater(&latest) {
+					latest = ts
+				}
+			}
+		}
+	}
+	return latest
+}
+
+// isLegacyConvertedName tells if name is that of an object an aBlock
+// was converted to, see BackupDataObjectName.
+func isLegacyConvertedName(name string) bool {
+	objectName, ok := parseObjectName(name)
+	return ok && objectName.Num() >= convertedNumOffset
+}
+
+// parseObjectName is the inverse of ObjectName.String.
+func parseObjectName(name string) (objectio.ObjectName, bool) {
+	i := strings.LastIndexByte(name, '_')
+	if i < 0 {
+		return nil, false
+	}
+	segment, err := types.ParseUuid(name[:i])
+	if err != nil {
+		return nil, false
+	}
+	num, err := strconv.ParseUint(name[i+1:], 10, 16)
+	if err != nil {
+		return nil, false
+	}
+	objectName := objectio.BuildObjectName(&segment, uint16(num))
+	if objectName.String() != name {
+		return nil, false
+	}
+	return objectName, true
+}
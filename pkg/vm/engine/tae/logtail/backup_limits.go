@@ -0,0 +1,149 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// AnalysisLimits bound what the analysis phase of a rewrite collects
+// from a checkpoint: the objects it references, their blocks and the
+// bytes of the objects and tombstone blocks. A checkpoint over a limit
+// is most likely corrupt, the rewrite refuses it before it runs out of
+// memory. A limit of 0 is that of DefaultAnalysisLimits.
+type AnalysisLimits struct {
+	MaxObjects int
+	MaxBlocks  int
+	MaxBytes   int64
+}
+
+// DefaultAnalysisLimits are far above what a checkpoint of a healthy
+// cluster references.
+var DefaultAnalysisLimits = AnalysisLimits{
+	MaxObjects: 4 << 20,
+	MaxBlocks:  32 << 20,
+	MaxBytes:   256 << 40,
+}
+
+// AnalysisLimitError is returned when a checkpoint references more than
+// an AnalysisLimits allows. The counts are those collected when the
+// limit was exceeded, not those of the whole checkpoint.
+type AnalysisLimitError struct {
+	// Limit is the limit exceeded, "objects", "blocks" or "bytes".
+	Limit   string
+	Objects int
+	Blocks  int
+	Bytes   int64
+	Limits  AnalysisLimits
+}
+
+func (e *AnalysisLimitError) Error() string {
+	return fmt.Sprintf("checkpoint exceeds the analysis limit of %s: %d objects, %d blocks, %d bytes, limits %d objects, %d blocks, %d bytes",
+		e.Limit, e.Objects, e.Blocks, e.Bytes, e.Limits.MaxObjects, e.Limits.MaxBlocks, e.Limits.MaxBytes)
+}
+
+func IsAnalysisLimitError(err error) bool {
+	var le *AnalysisLimitError
+	return errors.As(err, &le)
+}
+
+// WithAnalysisLimits sets the limits of the analysis phase, see
+// AnalysisLimits, DefaultAnalysisLimits are used otherwise.
+func WithAnalysisLimits(limits AnalysisLimits) BackupOption {
+	return func(o *backupOptions) {
+		o.analysisLimits = limits
+	}
+}
+
+// WithoutAnalysisLimits lets the analysis phase collect whatever the
+// checkpoint references, for a checkpoint known to be over the limits.
+func WithoutAnalysisLimits() BackupOption {
+	return func(o *backupOptions) {
+		o.unlimitedAnalysis = true
+	}
+}
+
+// analysisLimiter counts what the analysis phase collects against its
+// limits, a nil limiter has none.
+type analysisLimiter struct {
+	limits  AnalysisLimits
+	objects int
+	blocks  int
+	bytes   int64
+}
+
+func (o *backupOptions) analysisLimiter() *analysisLimiter {
+	if o.unlimitedAnalysis {
+		return nil
+	}
+	limits := o.analysisLimits
+	if limits.MaxObjects <= 0 {
+		limits.MaxObjects = DefaultAnalysisLimits.MaxObjects
+	}
+	if limits.MaxBlocks <= 0 {
+		limits.MaxBlocks = DefaultAnalysisLimits.MaxBlocks
+	}
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultAnalysisLimits.MaxBytes
+	}
+	return &analysisLimiter{limits: limits}
+}
+
+// add counts objects more objects, of blocks blocks and bytes bytes.
+func (l *analysisLimiter) add(objects, blocks int, bytes int64) error {
+	if l == nil {
+		return nil
+	}
+	l.objects += objects
+	l.blocks += blocks
+	l.bytes += bytes
+	limit := ""
+	switch {
+	case l.objects > l.limits.MaxObjects:
+		limit = "objects"
+	case l.blocks > l.limits.MaxBlocks:
+		limit = "blocks"
+	case l.bytes > l.limits.MaxBytes:
+		limit = "bytes"
+	default:
+		return nil
+	}
+	return &AnalysisLimitError{
+		Limit:   limit,
+		Objects: l.objects,
+		Blocks:  l.blocks,
+		Bytes:   l.bytes,
+		Limits:  l.limits,
+	}
+}
+
+// addBlock counts the tombstone block at location, unless objectsData
+// has it already.
+func (l *analysisLimiter) addBlock(objectsData map[string]*fileData, location objectio.Location) error {
+	if l == nil {
+		return nil
+	}
+	objects := 0
+	object := objectsData[location.Name().String()]
+	if object == nil {
+		objects = 1
+	} else if object.data[location.ID()] != nil {
+		return nil
+	}
+	return l.add(objects, 1, int64(location.Extent().Length()))
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// CorruptLocationError is returned when a location read from a block
+// meta batch of a checkpoint cannot be a valid location. A truncated
+// location would otherwise be taken for an empty one by IsEmpty.
+type CorruptLocationError struct {
+	// Batch is the index of the checkpoint batch, Row the row in it.
+	Batch  uint16
+	Row    int
+	Attr   string
+	Reason string
+}
+
+func (e *CorruptLocationError) Error() string {
+	return fmt.Sprintf("corrupt %s in row %d of checkpoint batch %d: %s", e.Attr, e.Row, e.Batch, e.Reason)
+}
+
+func IsCorruptLocation(err error) bool {
+	var ce *CorruptLocationError
+	return errors.As(err, &ce)
+}
+
+// ValidateLocation checks that buf is either empty or a location whose
+// name, extent and rows are sane. An empty location is one of no bytes
+// or of LocationLen zero bytes.
+func ValidateLocation(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if len(buf) != objectio.LocationLen {
+		return moerr.NewInternalErrorNoCtx("length %d, expected %d", len(buf), objectio.LocationLen)
+	}
+	location := objectio.Location(buf)
+	if location.IsEmpty() {
+		if bytes.Count(buf, []byte{0}) != len(buf) {
+			return moerr.NewInternalErrorNoCtx("no object name but not empty")
+		}
+		return nil
+	}
+	name := location.Name()
+	segment := name.SegmentId()
+	if !bytes.Equal(objectio.BuildObjectName(&segment, name.Num()), name) {
+		return moerr.NewInternalErrorNoCtx("object name %q does not match its id", name.String())
+	}
+	extent := location.Extent()
+	if extent.Length() == 0 || extent.OriginSize() == 0 {
+		return moerr.NewInternalErrorNoCtx("empty extent %s", extent.String())
+	}
+	if uint64(extent.Offset())+uint64(extent.Length()) > math.MaxUint32 {
+		return moerr.NewInternalErrorNoCtx("extent %s ends past the object size limit", extent.String())
+	}
+	if location.Rows() == 0 {
+		return moerr.NewInternalErrorNoCtx("no rows")
+	}
+	return nil
+}
+
+// validateBlockLocations returns an error if buf, the block locations
+// of a checkpoint meta row, is not a whole number of block locations,
+// the iterator would read past its end.
+func validateBlockLocations(buf BlockLocations) error {
+	if len(buf)%BlockLocationLength != 0 {
+		return moerr.NewInternalErrorNoCtx("block locations of %d bytes, not a multiple of %d",
+			len(buf), BlockLocationLength)
+	}
+	return nil
+}
+
+// validateLocations validates the locations of the block meta batches
+// of data, the later phases read them all from there. A row with a
+// corrupt location fails the rewrite, or with WithLenientLocations is
+// dropped and reported. It returns the number of rows dropped.
+func (o *backupOptions) validateLocations(data *CheckpointData) (int, error) {
+	drop := make(map[BlockMetaSource][]int)
+	err := data.ForEachBlockMeta(func(view BlockMetaView) error {
+		corrupt := validateBlockMeta(view)
+		if corrupt == nil {
+			return nil
+		}
+		if !o.lenientLocations {
+			return corrupt
+		}
+		o.result.CorruptLocations = append(o.result.CorruptLocations, corrupt)
+		o.log().Warn("[ValidateLocations]", common.OperationField("drop corrupt block meta row"),
+			common.AnyField("error", corrupt.Error()))
+		o.stats.Warn(BackupWarning{Code: WarnCorruptLocation, Detail: corrupt.Error()})
+		drop[view.Source()] = append(drop[view.Source()], view.Row())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	dropped := data.deleteBlockMetaRows(drop)
+	o.stats.Phase(StatsPhaseVerify).Add(StatCorruptLocations, int64(dropped))
+	return dropped, nil
+}
+
+// validateBlockMeta validates the locations of the block meta row of
+// view.
+func validateBlockMeta(view BlockMetaView) *CorruptLocationError {
+	for _, attr := range []struct {
+		name string
+		loc  objectio.Location
+	}{
+		{catalog.BlockMeta_MetaLoc, view.MetaLoc()},
+		{catalog.BlockMeta_DeltaLoc, view.DeltaLoc()},
+	} {
+		if err := ValidateLocation(attr.loc); err != nil {
+			return &CorruptLocationError{
+				Batch:  uint16(view.Source()),
+				Row:    view.Row(),
+				Attr:   attr.name,
+				Reason: err.Error(),
+			}
+		}
+	}
+	return nil
+}
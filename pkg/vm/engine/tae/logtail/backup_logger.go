@@ -0,0 +1,131 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/logutil"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"go.uber.org/zap"
+)
+
+// The fields every line a rewrite of a backup job logs carries, see
+// WithJobLogger.
+const (
+	LogFieldBackupJob   = "backup-job"
+	LogFieldSource      = "source-checkpoint"
+	LogFieldDestination = "destination"
+)
+
+// WithJobLogger logs the rewrite with logger, the global logger if nil,
+// and tags every line it logs, those of its workers included, with the
+// backup job jobID, the source checkpoint and the destination, so that
+// the lines of concurrent backups can be told apart. It overrides the
+// WithSessionJobLogger of the session of the rewrite.
+func WithJobLogger(jobID string, logger *zap.Logger) BackupOption {
+	return func(o *backupOptions) {
+		o.jobID, o.jobLogger = jobID, logger
+	}
+}
+
+// WithSessionJobLogger is WithJobLogger for every rewrite of the
+// session, the session logs with it too.
+func WithSessionJobLogger(jobID string, logger *zap.Logger) SessionOption {
+	return func(s *BackupSession) {
+		s.jobID, s.jobLogger = jobID, logger
+	}
+}
+
+// log returns the logger of the session, the global logger without
+// WithSessionJobLogger.
+func (s *BackupSession) log() *zap.Logger {
+	if s == nil || (s.jobID == "" && s.jobLogger == nil) {
+		return logutil.GetGlobalLogger()
+	}
+	logger := s.jobLogger
+	if logger == nil {
+		logger = logutil.GetGlobalLogger()
+	}
+	return logger.With(zap.String(LogFieldBackupJob, s.jobID))
+}
+
+// logFor returns the logger of the rewrite ctx carries, the logger of
+// the session otherwise, e.g. for its copies.
+func (s *BackupSession) logFor(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(jobLoggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return s.log()
+}
+
+// bindJobLogger tags the logger of the rewrite of the checkpoint at loc
+// to dstFs with the job it is part of, if any.
+func (o *backupOptions) bindJobLogger(loc objectio.Location, dstFs fileservice.FileService) {
+	jobID, logger := o.jobID, o.jobLogger
+	if jobID == "" && logger == nil && o.session != nil {
+		jobID, logger = o.session.jobID, o.session.jobLogger
+	}
+	if jobID == "" && logger == nil {
+		return
+	}
+	if logger == nil {
+		logger = logutil.GetGlobalLogger()
+	}
+	o.logger = logger.With(
+		zap.String(LogFieldBackupJob, jobID),
+		zap.String(LogFieldSource, loc.String()),
+		zap.String(LogFieldDestination, dstFs.Name()))
+}
+
+// log returns the logger of the rewrite, the global logger unless it is
+// part of a job.
+func (o *backupOptions) log() *zap.Logger {
+	if o.logger == nil {
+		return logutil.GetGlobalLogger()
+	}
+	return o.logger
+}
+
+type jobLoggerKey struct{}
+
+// withJobLogger returns ctx carrying the logger of the rewrite, for the
+// functions that log without its options.
+func (o *backupOptions) withJobLogger(ctx context.Context) context.Context {
+	if o.logger == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, jobLoggerKey{}, o.logger)
+}
+
+// ContextWithJobLogger returns ctx carrying logger, the global logger
+// if nil, tagged with the backup job jobID, for the functions that take
+// no BackupOption, e.g. PromoteBackup or IncrementalCheckpoint, to log
+// the lines of the job with.
+func ContextWithJobLogger(ctx context.Context, jobID string, logger *zap.Logger) context.Context {
+	if logger == nil {
+		logger = logutil.GetGlobalLogger()
+	}
+	return context.WithValue(ctx, jobLoggerKey{}, logger.With(zap.String(LogFieldBackupJob, jobID)))
+}
+
+// jobLogger returns the logger ctx carries, the global logger if none.
+func jobLogger(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(jobLoggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return logutil.GetGlobalLogger()
+}
@@ -0,0 +1,250 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BackupAuxManifest is the kind of the RestoreManifest files. Unlike
+// the other auxiliary files a manifest has no header, it is plain JSON
+// for the tools outside of MatrixOne to read.
+const BackupAuxManifest = "manifest"
+
+const (
+	// RestoreManifestSchema names the format of a RestoreManifest.
+	RestoreManifestSchema = "matrixone.backup.manifest"
+	// RestoreManifestVersion is the version of the format it is
+	// written in. A field is only ever added within a version, a
+	// reader ignores the fields it does not know.
+	RestoreManifestVersion = 1
+)
+
+// RestoreManifestJSONSchema is the JSON schema of a RestoreManifest of
+// RestoreManifestVersion.
+const RestoreManifestJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "matrixone.backup.manifest",
+  "type": "object",
+  "required": ["schema", "version", "entrypoint", "files"],
+  "properties": {
+    "schema": {"const": "matrixone.backup.manifest"},
+    "version": {"const": 1},
+    "entrypoint": {
+      "type": "object",
+      "required": ["checkpoint", "checkpoint_version", "ts"],
+      "properties": {
+        "checkpoint": {"type": "string", "description": "location of the CN meta object"},
+        "tn_checkpoint": {"type": "string", "description": "location of the TN meta object"},
+        "checkpoint_version": {"type": "integer"},
+        "ts": {"type": "string"},
+        "end": {"type": "string"},
+        "cn_only": {"type": "boolean", "description": "the backup has no TN side, it cannot restore a whole cluster"}
+      }
+    },
+    "files": {
+      "type": "array",
+      "description": "in the order a restore applies them",
+      "items": {
+        "type": "object",
+        "required": ["path", "role", "size", "checksum"],
+        "properties": {
+          "path": {"type": "string"},
+          "role": {"enum": ["data", "tombstone", "checkpoint", "auxiliary"]},
+          "size": {"type": "integer"},
+          "checksum": {
+            "type": "object",
+            "required": ["algorithm", "value"],
+            "properties": {
+              "algorithm": {"const": "crc32c"},
+              "value": {"type": "string", "description": "8 hex digits"}
+            }
+          },
+          "sha256": {"type": "string", "description": "64 hex digits"}
+        }
+      }
+    },
+    "warnings": {
+      "type": "array",
+      "items": {"type": "string"}
+    }
+  }
+}`
+
+// RestoreManifest describes a rewritten checkpoint in a format a restore
+// orchestrator outside of MatrixOne can drive a restore with: where the
+// checkpoint starts and every file of the backup, see
+// RestoreManifestJSONSchema.
+type RestoreManifest struct {
+	Schema     string             `json:"schema"`
+	Version    int                `json:"version"`
+	Entrypoint ManifestEntrypoint `json:"entrypoint"`
+	// Files are the files the rewrite wrote, the objects in the order
+	// of RewriteFiles.RestoreOrder, then the auxiliary files.
+	Files []ManifestFile `json:"files"`
+	// Warnings are what the writer of the manifest could not tell for
+	// sure, see ImportLegacyBackup.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ManifestEntrypoint is the checkpoint a restore loads the backup from.
+type ManifestEntrypoint struct {
+	Checkpoint        string `json:"checkpoint"`
+	TNCheckpoint      string `json:"tn_checkpoint,omitempty"`
+	CheckpointVersion uint32 `json:"checkpoint_version"`
+	TS                string `json:"ts"`
+	End               string `json:"end,omitempty"`
+	// CNOnly is set for a checkpoint written WithCNOnly, as it is in
+	// its CheckpointFooter.
+	CNOnly bool `json:"cn_only,omitempty"`
+}
+
+// ManifestFile is a file of a RestoreManifest.
+type ManifestFile struct {
+	Path     string           `json:"path"`
+	Role     string           `json:"role"`
+	Size     int64            `json:"size"`
+	Checksum ManifestChecksum `json:"checksum"`
+	// SHA256 is the sha256 of the file in hex, only recorded
+	// WithManifestSHA256.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type ManifestChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// ManifestRoleAuxiliary is the role of the auxiliary files the rewrite
+// wrote, e.g. its CheckpointFooter, the others are those of FileRole.
+const ManifestRoleAuxiliary = "auxiliary"
+
+var manifestCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// RestoreManifestName returns the name of the manifest of the
+// checkpoint whose CN meta object is meta.
+func RestoreManifestName(meta string) string {
+	return BackupAuxName(BackupAuxManifest, meta+".json")
+}
+
+// WithRestoreManifest writes a RestoreManifest of the rewritten
+// checkpoint next to it, see RestoreManifestName.
+func WithRestoreManifest() BackupOption {
+	return func(o *backupOptions) {
+		o.manifest = true
+	}
+}
+
+// ReadRestoreManifest reads the manifest of the checkpoint whose CN
+// meta object is meta from fs.
+func ReadRestoreManifest(ctx context.Context, fs fileservice.FileService, meta string) (*RestoreManifest, error) {
+	name := RestoreManifestName(meta)
+	buf, err := readBackupFile(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &RestoreManifest{}
+	if err = json.Unmarshal(buf, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Schema != RestoreManifestSchema || manifest.Version > RestoreManifestVersion {
+		return nil, moerr.NewNotSupportedNoCtx("manifest %s of schema %q version %d",
+			name, manifest.Schema, manifest.Version)
+	}
+	return manifest, nil
+}
+
+// writeRestoreManifest writes the manifest of the checkpoint of version
+// the rewrite wrote to dstFs at cnLocation, of files and of the
+// auxiliary files aux, with warnings, and returns its name. The files
+// are read back for their size and checksum, and their sha256 when
+// digests is set. An empty end is left out. cnOnly marks a checkpoint
+// without its TN side, see WithCNOnly.
+func writeRestoreManifest(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	cnLocation, tnLocation objectio.Location,
+	version uint32,
+	ts, end types.TS,
+	files *RewriteFiles,
+	aux []string,
+	warnings []string,
+	digests *fileDigests,
+	cnOnly bool,
+) (string, error) {
+	manifest := &RestoreManifest{
+		Schema:  RestoreManifestSchema,
+		Version: RestoreManifestVersion,
+		Entrypoint: ManifestEntrypoint{
+			Checkpoint:        cnLocation.String(),
+			CheckpointVersion: version,
+			TS:                ts.ToString(),
+			CNOnly:            cnOnly,
+		},
+		Warnings: warnings,
+	}
+	if !tnLocation.IsEmpty() {
+		manifest.Entrypoint.TNCheckpoint = tnLocation.String()
+	}
+	if !end.IsEmpty() {
+		manifest.Entrypoint.End = end.ToString()
+	}
+	add := func(name, role string) error {
+		buf, err := readBackupFile(ctx, dstFs, name)
+		if err != nil {
+			return err
+		}
+		file := ManifestFile{
+			Path: name,
+			Role: role,
+			Size: int64(len(buf)),
+			Checksum: ManifestChecksum{
+				Algorithm: "crc32c",
+				Value:     fmt.Sprintf("%08x", crc32.Checksum(buf, manifestCRC)),
+			},
+		}
+		if digests != nil {
+			if file.SHA256, err = fileSHA256(name, buf, digests); err != nil {
+				return err
+			}
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	}
+	for _, file := range files.RestoreOrder() {
+		if err := add(file.Name, file.Role.String()); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range aux {
+		if err := add(name, ManifestRoleAuxiliary); err != nil {
+			return "", err
+		}
+	}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := RestoreManifestName(files.Meta)
+	return name, writeBackupFile(ctx, dstFs, name, buf)
+}
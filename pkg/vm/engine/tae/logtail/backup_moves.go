@@ -0,0 +1,94 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import "fmt"
+
+// MoveKind tells what the rewrite did to an object of the source
+// checkpoint, see ObjectMove.
+type MoveKind int
+
+const (
+	// MoveUnchanged is an object the rewritten checkpoint references as
+	// the source did.
+	MoveUnchanged MoveKind = iota
+	// MoveTrimmed is an object written again under its own name, or a
+	// new one by an in-place rewrite, with the rows after the ts of the
+	// backup removed.
+	MoveTrimmed
+	// MoveRelocated is an aBlock object whose rows were converted to
+	// another object.
+	MoveRelocated
+	// MoveDropped is an object the rewritten checkpoint no longer
+	// references, e.g. one trimming left without rows.
+	MoveDropped
+)
+
+func (k MoveKind) String() string {
+	switch k {
+	case MoveUnchanged:
+		return "unchanged"
+	case MoveTrimmed:
+		return "trimmed"
+	case MoveRelocated:
+		return "relocated"
+	case MoveDropped:
+		return "dropped"
+	default:
+		return fmt.Sprintf("MoveKind(%d)", int(k))
+	}
+}
+
+// ObjectMove is where an object of the source checkpoint is in the
+// rewritten one, see RewriteStats.Moves.
+type ObjectMove struct {
+	Kind MoveKind
+	// Target is the object of the rewritten checkpoint that holds the
+	// rows of the source object: itself unless it is relocated or
+	// renamed, empty if it is dropped.
+	Target string
+}
+
+func (m ObjectMove) String() string {
+	if m.Kind == MoveUnchanged || m.Kind == MoveDropped {
+		return m.Kind.String()
+	}
+	return m.Kind.String() + " to " + m.Target
+}
+
+// recordMoves records in the result where each object of source, the
+// references of the source checkpoint, is in the rewritten checkpoint
+// that has the references refs.
+func (o *backupOptions) recordMoves(source, refs map[string]int64) {
+	trimmed := make(map[string]struct{}, len(o.result.Files.Rewritten))
+	for _, name := range o.result.Files.Rewritten {
+		trimmed[name] = struct{}{}
+	}
+	moves := make(map[string]ObjectMove, len(source))
+	for name := range source {
+		if target, ok := o.relocated[name]; ok {
+			moves[name] = ObjectMove{Kind: MoveRelocated, Target: target}
+		} else if target, ok := o.renamed[name]; ok {
+			moves[name] = ObjectMove{Kind: MoveTrimmed, Target: target}
+		} else if _, ok := trimmed[name]; ok {
+			moves[name] = ObjectMove{Kind: MoveTrimmed, Target: name}
+		} else if _, ok := refs[name]; !ok {
+			moves[name] = ObjectMove{Kind: MoveDropped}
+		} else {
+			moves[name] = ObjectMove{Kind: MoveUnchanged, Target: name}
+		}
+	}
+	o.result.Stats.Moves = moves
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BackupAuxDir holds every auxiliary file the backup writers create.
+// Object names never contain a '/', so an auxiliary file can not have
+// the name of a data object.
+const BackupAuxDir = "backup_aux"
+
+// The kinds of auxiliary files, each gets its own directory under
+// BackupAuxDir.
+const (
+	BackupAuxJournal     = "journal"
+	BackupAuxSoftDeletes = "softdeletes"
+	BackupAuxInPlace     = "inplace"
+	BackupAuxRewriteTask = "rewritetasks"
+	BackupAuxFooter      = "footer"
+	BackupAuxProvenance  = "provenance"
+	BackupAuxStaged      = "staged"
+	BackupAuxWritten     = "written"
+	// BackupAuxCheckpointHeader is the kind of the CheckpointHeader files.
+	BackupAuxCheckpointHeader = "header"
+)
+
+// convertedNumOffset is added to the file number of an aBlock object
+// to name the object it is converted to.
+const convertedNumOffset = 1000
+
+// BackupDataObjectName returns the name of the object the aBlock of the
+// object with file number num is converted to, in segment.
+func BackupDataObjectName(segment *objectio.Segmentid, num uint16) objectio.ObjectName {
+	return objectio.BuildObjectName(segment, convertedNumOffset+num)
+}
+
+// objectNameGenerator names the object the aBlock of the object src is
+// converted to, in place of convertedName. It must give distinct
+// sources distinct names, and the same name to a source named again.
+type objectNameGenerator func(src objectio.ObjectName) objectio.ObjectName
+
+// BackupAuxName returns the name of the auxiliary file id of kind.
+func BackupAuxName(kind, id string) string {
+	return BackupAuxDir + "/" + kind + "/" + id
+}
+
+func isBackupAuxName(name string) bool {
+	return strings.HasPrefix(name, BackupAuxDir+"/")
+}
+
+// checkBackupName rejects a name that is neither an auxiliary file nor
+// can be a data object.
+func checkBackupName(name string) error {
+	if name == "" {
+		return moerr.NewInternalErrorNoCtx("empty backup file name")
+	}
+	if isBackupAuxName(name) {
+		return nil
+	}
+	if strings.Contains(name, "/") {
+		return moerr.NewInternalErrorNoCtx("backup file %s is not under %s", name, BackupAuxDir)
+	}
+	return nil
+}
+
+// BackupNames records the names a backup session is going to write,
+// together with what each one is written from.
+type BackupNames struct {
+	sync.Mutex
+	names map[string]string
+}
+
+func NewBackupNames() *BackupNames {
+	return &BackupNames{
+		names: make(map[string]string),
+	}
+}
+
+// Register records that name is written from source, e.g. the object
+// an aBlock is converted from. Registering a name again for the same
+// source is fine, for another source it fails, as does a name that is
+// not a valid backup file name.
+func (r *BackupNames) Register(name, source string) error {
+	if r == nil {
+		return nil
+	}
+	if err := checkBackupName(name); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if prev, ok := r.names[name]; ok && prev != source {
+		return moerr.NewInternalErrorNoCtx("backup file %s is written from both %s and %s",
+			name, prev, source)
+	}
+	r.names[name] = source
+	return nil
+}
+
+// Names returns the registered names, sorted.
+func (r *BackupNames) Names() []string {
+	r.Lock()
+	defer r.Unlock()
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
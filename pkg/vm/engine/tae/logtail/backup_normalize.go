@@ -0,0 +1,56 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+)
+
+// BatchNormalizer prepares each batch the rewrite loads, the blocks of
+// the aBlocks and of the tombstones, before the rewrite trims, sorts
+// and writes it. mp is the allocator of the rewrite for the TN side,
+// see WithBatchAllocators, a normalizer may use its own. It returns the
+// batch the rewrite goes on with, bat itself or one that replaces it,
+// and frees bat when it fails.
+type BatchNormalizer interface {
+	Normalize(bat *batch.Batch, mp *mpool.MPool) (*batch.Batch, error)
+}
+
+// DefaultBatchNormalizer is the BatchNormalizer of the rewrite unless
+// WithBatchNormalizer is set: it names the columns col_0, col_1, ...
+// and round trips the batch through its TN form.
+var DefaultBatchNormalizer BatchNormalizer = formatNormalizer{}
+
+type formatNormalizer struct{}
+
+func (formatNormalizer) Normalize(bat *batch.Batch, mp *mpool.MPool) (*batch.Batch, error) {
+	return formatData(bat, mp), nil
+}
+
+// WithBatchNormalizer prepares the batches the rewrite loads with
+// normalizer instead of DefaultBatchNormalizer, e.g. to keep the names
+// of the columns for an export.
+func WithBatchNormalizer(normalizer BatchNormalizer) BackupOption {
+	return func(o *backupOptions) {
+		o.normalizer = normalizer
+	}
+}
+
+// normalize prepares bat, loaded by the rewrite, with the normalizer
+// of the rewrite.
+func (o *backupOptions) normalize(bat *batch.Batch) (*batch.Batch, error) {
+	return o.normalizer.Normalize(bat, o.tnAllocator)
+}
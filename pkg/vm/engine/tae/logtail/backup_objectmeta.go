@@ -0,0 +1,58 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// readObjectMeta reads the meta of the object at location from fs,
+// past the meta cache of the process. The cache is keyed by the short
+// name of an object only, and a rewrite writes objects under the names
+// of other ones: the tombstones it trims in place, the objects a rerun
+// converts again. A cached meta may be the one of the other object.
+func readObjectMeta(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+) (objectio.ObjectMeta, error) {
+	name := location.Name()
+	extent := location.Extent()
+	return objectio.ReadObjectMeta(ctx, name.String(), &extent, fileservice.SkipAllCache, fs)
+}
+
+// readBlockColumns loads the columns cols of the block at location,
+// all of them if cols is nil. dataMeta is the meta of its blocks, read
+// by readObjectMeta, the block is not cached either.
+func readBlockColumns(
+	ctx context.Context,
+	fs fileservice.FileService,
+	dataMeta *objectio.ObjectDataMeta,
+	location objectio.Location,
+	cols []uint16,
+) (*batch.Batch, error) {
+	if cols == nil {
+		cols = make([]uint16, dataMeta.BlockHeader().ColumnCount())
+		for i := range cols {
+			cols[i] = uint16(i)
+		}
+	}
+	return objectio.ReadOneBlockAllColumns(ctx, dataMeta, location.Name().String(),
+		uint32(location.ID()), cols, fileservice.SkipAllCache, fs)
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithConvertedObjectRows splits an aBlock with more than rows rows at
+// the backup ts into objects of at most rows rows each when it is
+// converted, instead of writing all of its rows to one object.
+//
+// The first object has the name the aBlock is converted to, the others
+// are named after it, see convertedPartName, and each has its own object
+// info row and insertBlock, the rows a restore sees are the same. The
+// rows are split once sorted, so every object is sorted on its own but
+// their ranges do not overlap. A session resumed with another limit
+// must not reuse the objects of the first: the objects after the first
+// are found by their names.
+//
+// Only the aBlocks converted on their own are split, those converted
+// WithABlockBatching have fewer rows than a block.
+func WithConvertedObjectRows(rows int) BackupOption {
+	return func(o *backupOptions) {
+		o.objectRows = rows
+	}
+}
+
+// convertedPartName returns the name of part part of the object name an
+// aBlock is converted to, name itself for part 0. The others are in a
+// segment derived from that of name, so that a resumed rewrite names
+// them the same.
+func convertedPartName(name objectio.ObjectName, part int) objectio.ObjectName {
+	if part == 0 {
+		return name
+	}
+	segment := name.SegmentId()
+	sum := sha256.Sum256(append(segment[:], byte(part>>8), byte(part)))
+	// The bytes after the version and variant of the uuid are random.
+	copy(segment[9:], sum[:len(segment)-9])
+	return objectio.BuildObjectName(&segment, name.Num())
+}
+
+// writeConvertedParts is writeConverted for an aBlock converted from
+// src to name, split in parts of at most objectRows rows. It returns
+// the first part and the others, which are written and recorded before
+// it so that a session that recorded the first has them all.
+func (o *backupOptions) writeConvertedParts(
+	ctx context.Context,
+	session *BackupSession,
+	dstFs fileservice.FileService,
+	src, name objectio.ObjectName,
+	bat *batch.Batch,
+	sortKey uint16,
+) (*writtenObject, []*writtenObject, error) {
+	rows := bat.RowCount()
+	if o.objectRows <= 0 || rows <= o.objectRows {
+		written, err := o.writeConverted(ctx, dstFs, name, bat, sortKey)
+		return written, nil, err
+	}
+	var parts []*writtenObject
+	for start := o.objectRows; start < rows; start += o.objectRows {
+		partName := convertedPartName(name, len(parts)+1)
+		if err := session.register(partName.String(), src.String()); err != nil {
+			return nil, nil, err
+		}
+		window, err := windowBatch(bat, start, min(start+o.objectRows, rows))
+		if err != nil {
+			return nil, nil, err
+		}
+		written, err := o.writeConverted(ctx, dstFs, partName, window, sortKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		o.recordWritten(session, written)
+		parts = append(parts, written)
+	}
+	window, err := windowBatch(bat, 0, o.objectRows)
+	if err != nil {
+		return nil, nil, err
+	}
+	written, err := o.writeConverted(ctx, dstFs, name, window, sortKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("split aBlock"),
+		common.AnyField("object", name.String()),
+		common.AnyField("objects", len(parts)+1),
+		common.AnyField("rows", rows))
+	return written, parts, nil
+}
+
+// convertedParts returns the parts after the first of the object name
+// an aBlock was converted to by an earlier attempt, the session or,
+// when reuse is set, an earlier rewrite that left them in dstFs.
+func (o *backupOptions) convertedParts(
+	ctx context.Context,
+	session *BackupSession,
+	dstFs fileservice.FileService,
+	name objectio.ObjectName,
+	reuse bool,
+) ([]*writtenObject, error) {
+	if o.objectRows <= 0 {
+		return nil, nil
+	}
+	var parts []*writtenObject
+	for {
+		partName := convertedPartName(name, len(parts)+1)
+		if written, ok := session.lookup(partName.String()); ok {
+			parts = append(parts, written)
+			continue
+		}
+		if !reuse || !session.finalized(partName.String()) {
+			return parts, nil
+		}
+		written, err := loadWrittenObject(ctx, dstFs, partName)
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, written)
+	}
+}
+
+// windowBatch returns the rows [start, end) of bat, sharing its memory.
+func windowBatch(bat *batch.Batch, start, end int) (*batch.Batch, error) {
+	window := batch.NewWithSize(len(bat.Vecs))
+	window.Attrs = bat.Attrs
+	for i, vec := range bat.Vecs {
+		w, err := vec.Window(start, end)
+		if err != nil {
+			return nil, err
+		}
+		window.Vecs[i] = w
+	}
+	window.SetRowCount(end - start)
+	return window, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// RewriteObserver is told what the checkpoint rewrite does as it goes,
+// e.g. to keep custom metrics or check the objects written, without
+// changing the rewrite. Its methods run on the goroutine of the rewrite
+// and must return quickly, embed NopRewriteObserver to implement only
+// some of them.
+type RewriteObserver interface {
+	// OnPhaseStart is called when the rewrite enters phase, from 1 to
+	// RewritePhases.
+	OnPhaseStart(phase int)
+	// OnBlockTrimmed is called for each aBlock the trim cuts rows off,
+	// late or filtered.
+	OnBlockTrimmed(block TrimmedBlock)
+	// OnObjectRewritten is called for each object the rewrite writes to
+	// the destination, the checkpoint objects excluded. The objects a
+	// session recorded or WithSkipExisting reused are not written again
+	// and not reported.
+	OnObjectRewritten(object RewrittenObject)
+	// OnComplete is called once the rewrite returns, with the error it
+	// returns, if any. result is that of WithRewriteResult.
+	OnComplete(result *RewriteResult, err error)
+}
+
+// TrimmedBlock is an aBlock the trim cut rows off.
+type TrimmedBlock struct {
+	Location objectio.Location
+	// Rows is the number of rows of the block as it was loaded, Late
+	// those committed after the ts of the rewrite and Filtered those
+	// the row filter dropped, see WithRowFilter.
+	Rows, Late, Filtered int
+}
+
+// RewrittenObject is an object the rewrite wrote.
+type RewrittenObject struct {
+	Name   string
+	Bytes  int64
+	Blocks int
+	Rows   uint32
+}
+
+// NopRewriteObserver is a RewriteObserver that does nothing.
+type NopRewriteObserver struct{}
+
+func (NopRewriteObserver) OnPhaseStart(int)                  {}
+func (NopRewriteObserver) OnBlockTrimmed(TrimmedBlock)       {}
+func (NopRewriteObserver) OnObjectRewritten(RewrittenObject) {}
+func (NopRewriteObserver) OnComplete(*RewriteResult, error)  {}
+
+// WithRewriteObserver tells observer what the rewrite does, see
+// RewriteObserver.
+func WithRewriteObserver(observer RewriteObserver) BackupOption {
+	return func(o *backupOptions) {
+		o.observer = observer
+	}
+}
+
+// observeTrim reports the aBlock at location, of rows rows, if the
+// trim cut rows off it.
+func (o *backupOptions) observeTrim(location objectio.Location, rows, late, filtered int) {
+	if late+filtered == 0 {
+		return
+	}
+	o.observer.OnBlockTrimmed(TrimmedBlock{
+		Location: location,
+		Rows:     rows,
+		Late:     late,
+		Filtered: filtered,
+	})
+}
+
+func (o *backupOptions) observeWritten(written *writtenObject) {
+	object := RewrittenObject{
+		Name:   written.name.String(),
+		Bytes:  written.size(),
+		Blocks: len(written.rows),
+	}
+	for _, rows := range written.rows {
+		object.Rows += rows
+	}
+	o.observer.OnObjectRewritten(object)
+}
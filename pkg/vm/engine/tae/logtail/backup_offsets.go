@@ -0,0 +1,228 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// TableOffset is the range of rows of a table in a batch of the
+// rewritten checkpoint, as the table meta of the checkpoint records it,
+// i.e. what a restore reads for the table.
+type TableOffset struct {
+	Table uint64
+	// Batch is the checkpoint batch, ObjectInfoIDX or BLKMetaInsertIDX.
+	Batch uint16
+	// Offset is the first row of the table, End the row after its last.
+	Offset int
+	End    int
+}
+
+func (o TableOffset) String() string {
+	return fmt.Sprintf("table %d batch %d rows [%d, %d)", o.Table, o.Batch, o.Offset, o.End)
+}
+
+// OffsetProblem is what is wrong with the range of rows the table meta
+// of a checkpoint records for a table, see VerifyCheckpointOffsets.
+type OffsetProblem string
+
+const (
+	// OffsetMissing is a table with rows in the batch but no range.
+	OffsetMissing OffsetProblem = "missing"
+	// OffsetStale is a range of a table without rows in the batch.
+	OffsetStale OffsetProblem = "stale"
+	// OffsetShifted is a range that is not the rows of the table.
+	OffsetShifted OffsetProblem = "shifted"
+	// OffsetOverlapping is a range that overlaps the range of another
+	// table of the batch.
+	OffsetOverlapping OffsetProblem = "overlapping"
+	// OffsetScattered is a table whose rows are not contiguous, no
+	// range can be right, e.g. when the rows of two tables interleave.
+	OffsetScattered OffsetProblem = "scattered"
+)
+
+// OffsetMismatch is a table whose range of rows in a batch of a
+// checkpoint is wrong.
+type OffsetMismatch struct {
+	Table   uint64
+	Batch   uint16
+	Problem OffsetProblem
+	// Stored is the range the table meta records, Actual the rows of
+	// the table from its first to its last. Either is empty when there
+	// is none.
+	Stored TableOffset
+	Actual TableOffset
+}
+
+func (m OffsetMismatch) String() string {
+	return fmt.Sprintf("table %d batch %d %s: stored [%d, %d), rows [%d, %d)",
+		m.Table, m.Batch, m.Problem, m.Stored.Offset, m.Stored.End, m.Actual.Offset, m.Actual.End)
+}
+
+// VerifyCheckpointOffsets loads the checkpoint at loc from fs and checks
+// the range of rows its table meta records for each table in the
+// batches a restore slices by table, the object info and the block
+// meta, against the rows of the table, found from their tid. A
+// checkpoint whose ranges are right has no mismatch.
+func VerifyCheckpointOffsets(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	loc objectio.Location,
+	version uint32,
+) ([]OffsetMismatch, error) {
+	data, err := getCheckpointData(ctx, sid, fs, loc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	// A loaded table meta has its ranges in its locations only.
+	if err = data.FormatData(common.CheckpointAllocator); err != nil {
+		return nil, err
+	}
+	return verifyTableOffsets(data), nil
+}
+
+// verifyTableOffsets is VerifyCheckpointOffsets for data, the
+// mismatches are sorted by batch and table, a table has at most one
+// per batch.
+func verifyTableOffsets(data *CheckpointData) []OffsetMismatch {
+	stored := make(map[uint16]map[uint64]TableOffset)
+	for _, offset := range checkpointTableOffsets(data) {
+		if stored[offset.Batch] == nil {
+			stored[offset.Batch] = make(map[uint64]TableOffset)
+		}
+		stored[offset.Batch][offset.Table] = offset
+	}
+	mismatches := make([]OffsetMismatch, 0)
+	for _, batch := range tableOffsetBatches {
+		tidIdx := batch.idx
+		if batch.idx == BLKMetaInsertIDX {
+			tidIdx = BLKMetaInsertTxnIDX
+		}
+		tids := data.bats[tidIdx].GetVectorByName(SnapshotAttr_TID)
+		actual := make(map[uint64]TableOffset)
+		rows := make(map[uint64]int)
+		for i := 0; i < tids.Length(); i++ {
+			tid := tids.Get(i).(uint64)
+			offset, ok := actual[tid]
+			if !ok {
+				offset = TableOffset{Table: tid, Batch: batch.idx, Offset: i}
+			}
+			offset.End = i + 1
+			actual[tid] = offset
+			rows[tid]++
+		}
+
+		problems := make(map[uint64]OffsetMismatch)
+		note := func(tid uint64, problem OffsetProblem) {
+			if _, ok := problems[tid]; ok {
+				return
+			}
+			problems[tid] = OffsetMismatch{
+				Table:   tid,
+				Batch:   batch.idx,
+				Problem: problem,
+				Stored:  stored[batch.idx][tid],
+				Actual:  actual[tid],
+			}
+		}
+		for tid, offset := range actual {
+			if offset.End-offset.Offset != rows[tid] {
+				note(tid, OffsetScattered)
+			}
+		}
+		ranges := make([]TableOffset, 0, len(stored[batch.idx]))
+		for _, offset := range stored[batch.idx] {
+			ranges = append(ranges, offset)
+		}
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i].Offset < ranges[j].Offset
+		})
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i].Offset < ranges[i-1].End {
+				note(ranges[i-1].Table, OffsetOverlapping)
+				note(ranges[i].Table, OffsetOverlapping)
+			}
+		}
+		for tid, offset := range actual {
+			got, ok := stored[batch.idx][tid]
+			switch {
+			case !ok:
+				note(tid, OffsetMissing)
+			case got.Offset != offset.Offset || got.End != offset.End:
+				note(tid, OffsetShifted)
+			}
+		}
+		for tid := range stored[batch.idx] {
+			if _, ok := actual[tid]; !ok {
+				note(tid, OffsetStale)
+			}
+		}
+		for _, problem := range problems {
+			mismatches = append(mismatches, problem)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Batch != mismatches[j].Batch {
+			return mismatches[i].Batch < mismatches[j].Batch
+		}
+		return mismatches[i].Table < mismatches[j].Table
+	})
+	return mismatches
+}
+
+// tableOffsetBatches are the batches the rewrite moves the rows of, by
+// the table meta they are recorded with.
+var tableOffsetBatches = []struct {
+	meta int
+	idx  uint16
+}{
+	{ObjectInfo, ObjectInfoIDX},
+	{BlockInsert, BLKMetaInsertIDX},
+}
+
+// checkpointTableOffsets returns the range of rows of every table in the
+// batches of tableOffsetBatches of data, sorted by batch and offset.
+func checkpointTableOffsets(data *CheckpointData) []TableOffset {
+	offsets := make([]TableOffset, 0)
+	for tid, meta := range data.meta {
+		for _, batch := range tableOffsetBatches {
+			table := meta.tables[batch.meta]
+			if table == nil || table.Start == table.End {
+				continue
+			}
+			offsets = append(offsets, TableOffset{
+				Table:  tid,
+				Batch:  batch.idx,
+				Offset: int(table.Start),
+				End:    int(table.End),
+			})
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].Batch != offsets[j].Batch {
+			return offsets[i].Batch < offsets[j].Batch
+		}
+		return offsets[i].Offset < offsets[j].Offset
+	})
+	return offsets
+}
@@ -0,0 +1,622 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"go.uber.org/zap"
+)
+
+type BackupOption func(*backupOptions)
+
+type backupOptions struct {
+	// clock stamps the auxiliary files of the rewrite, see WithClock.
+	clock func() time.Time
+	// verifySort reads the sort key column of passthrough blocks
+	// flagged as sorted and checks that it is really ordered.
+	verifySort bool
+	result     *RewriteResult
+	session    *BackupSession
+	// projection maps a table id to the data columns kept for it.
+	projection map[uint64][]uint16
+	// strictLoad fails the rewrite on an aBlock that loads with no rows.
+	strictLoad bool
+	// segmentRemap maps the segment of a source object to the segment
+	// the objects converted from it are named in.
+	segmentRemap map[objectio.Segmentid]objectio.Segmentid
+	// skipExisting reuses the converted objects already in the
+	// destination instead of converting the aBlocks again.
+	skipExisting bool
+	stats        *BackupStats
+	rowFilter    RowFilter
+	// writers holds a token per open block writer, nil means the
+	// number of open writers is not limited.
+	writers   chan struct{}
+	newWriter BlockWriterFactory
+	progress  func(RewriteProgress)
+	// forceSort maps a table id to the data column its aBlocks are
+	// sorted by when their object declares no sort key.
+	forceSort map[uint64]uint16
+	// schemaSortKeys maps a table id to the sort key its schema in the
+	// checkpoint declares, it is filled by the analysis phase.
+	schemaSortKeys map[uint64]uint16
+	// tableSortKeys are the sort keys the aBlocks of each table are
+	// sorted by, see WithTableSortKeys.
+	tableSortKeys *tableSortKeys
+	// strictSort fails the rewrite on an aBlock that fails to sort
+	// instead of writing it unsorted.
+	strictSort bool
+	// strictMeta fails the rewrite on a block listed more than once in
+	// a block meta batch instead of keeping its last row.
+	strictMeta bool
+	// lenientLocations drops the block meta rows with a corrupt
+	// location instead of failing the rewrite.
+	lenientLocations bool
+	// mapBlockIDs records the block each converted aBlock is converted
+	// to in RewriteResult.RelocatedBlocks.
+	mapBlockIDs bool
+	// strictSoftDeletes fails the rewrite when the soft deletes passed
+	// to it disagree with the checkpoint.
+	strictSoftDeletes bool
+	// unorderedTombstones writes the trimmed tombstones in the order of
+	// their rows instead of sorting them by rowid.
+	unorderedTombstones bool
+	// batchRows is the number of rows under which aBlocks are converted
+	// in batches instead of one object each, 0 disables batching.
+	batchRows int
+	// exporter exports the data of the converted aBlocks, nil means
+	// they are not exported.
+	exporter BlockExporter
+	// footer writes a CheckpointFooter next to the rewritten checkpoint.
+	footer bool
+	// provenance records the provenance of the source objects, sources
+	// their index in the result by source name.
+	provenance bool
+	sources    map[string]int
+	sampling   *Sampling
+	// compression maps the schema of the objects written to the codec
+	// they are written with, the others keep that of the writer.
+	compression map[objectio.DataMetaType]ObjectCompression
+	// analysisLimits bound what the analysis phase collects, unless
+	// unlimitedAnalysis is set.
+	analysisLimits    AnalysisLimits
+	unlimitedAnalysis bool
+	// tnAllocator holds the TN batches the rewrite converts its data
+	// to, cnAllocator the CN batches it copies.
+	tnAllocator *mpool.MPool
+	cnAllocator *mpool.MPool
+	observer    RewriteObserver
+	// stampEnd stamps checkpointEnd as the end of the rewritten
+	// checkpoint. firstLate is the first commit ts of the rows the
+	// trim dropped, checked against it.
+	stampEnd      bool
+	checkpointEnd types.TS
+	firstLate     types.TS
+	// readOnlySource fails any write or delete of the source.
+	readOnlySource bool
+	// nameGenerator names the converted objects, nil means they are
+	// named by convertedName.
+	nameGenerator objectNameGenerator
+	// cnOnly leaves the TN meta out of the checkpoint, see WithCNOnly.
+	cnOnly bool
+	// skipTrimmed returns a checkpoint already rewritten as of the ts
+	// of the rewrite as it is, see WithSkipTrimmed.
+	skipTrimmed bool
+	// parallelSort sorts the large aBlocks in parallel, see
+	// WithParallelSort.
+	parallelSort *parallelSort
+	// normalizer prepares the batches the rewrite loads, see
+	// WithBatchNormalizer.
+	normalizer BatchNormalizer
+	// chain is the checkpoint chain the ts of the rewrite is resolved
+	// against unless exactTS is set, see WithCheckpointChain.
+	chain   []CheckpointSpan
+	exactTS bool
+	// denied are the blocks removed from the checkpoint, see
+	// WithBlockDenylist.
+	denied map[types.Blockid]struct{}
+	// auditName is the file the trimmed rows are written to in
+	// auditFormat, audit the file being written, see WithTrimAudit.
+	auditName   string
+	auditFormat AuditFormat
+	audit       *trimAudit
+	// locateABlock finds the objects of the delta-only aBlocks, see
+	// WithMaterializeDeltaOnly.
+	locateABlock ABlockLocator
+	// checkSpace checks that the destination has the space for the
+	// rewrite and spaceReserve bytes more, see WithFreeSpaceCheck.
+	checkSpace   bool
+	spaceReserve int64
+	// growthLimits bound the growth of the rewritten checkpoint, see
+	// WithGrowthLimits.
+	growthLimits GrowthLimits
+	// blockWorkers prepare the blocks of an object, see
+	// WithBlockParallelism.
+	blockWorkers int
+	// manifest writes the RestoreManifest of the checkpoint, see
+	// WithRestoreManifest.
+	manifest bool
+	// jobID and jobLogger are those of WithJobLogger, logger the
+	// logger the rewrite logs with, nil means the global logger.
+	jobID     string
+	jobLogger *zap.Logger
+	logger    *zap.Logger
+	// deleteJoin joins the deletes of the aBlocks to their rows, see
+	// WithDeleteJoin.
+	deleteJoin DeleteJoin
+	// rewrittenName, if set, names the objects rewritten in place, see
+	// withRewrittenObjectNames. renamed maps those objects to their
+	// name.
+	rewrittenName objectNameGenerator
+	renamed       map[string]string
+	// relocated maps the source objects converted to the object they
+	// were converted to, see RewriteStats.Moves.
+	relocated map[string]string
+	// objectRows is the most rows of an object an aBlock is converted
+	// to, 0 means no limit. See WithConvertedObjectRows.
+	objectRows int
+	// digests are the sha256 of the files written to the destination,
+	// nil unless WithManifestSHA256.
+	digests *fileDigests
+	// skipCollected skips the source objects that are gone, collected
+	// the ones skipped, see WithSkipCollectedObjects.
+	skipCollected bool
+	collected     map[string]struct{}
+	// skippedDrops are the objects a best effort session skipped that
+	// the checkpoint drops, see dropSkipped.
+	skippedDrops map[string]struct{}
+	// upgrades maps a table id to the new types of its data columns, by
+	// position, see WithColumnTypeUpgrades.
+	upgrades map[uint64]map[uint16]types.Type
+	// scanRowIDs looks for the rowids an aBlock has twice, see
+	// WithDuplicateRowIDScan.
+	scanRowIDs bool
+	// encryption is the key the files the rewrite writes are encrypted
+	// with, see WithEncryption.
+	encryption *EncryptionKey
+}
+
+// BlockWriterLike is what the rewrite writes its objects with. It is
+// the subset of blockio.BlockWriter the rewrite uses, so that a writer
+// can be wrapped, e.g. to compute a digest of what is written.
+type BlockWriterLike interface {
+	SetPrimaryKey(idx uint16)
+	WriteBatch(bat *batch.Batch) (objectio.BlockObject, error)
+	WriteTombstoneBatch(bat *batch.Batch) (objectio.BlockObject, error)
+	Sync(ctx context.Context) ([]objectio.BlockObject, objectio.Extent, error)
+	GetObjectStats() []objectio.ObjectStats
+}
+
+// ObjectCompression is the codec and level, see compress.CompressLevel,
+// the objects of a schema are written with.
+type ObjectCompression struct {
+	Algo  uint8
+	Level int
+}
+
+// compressionSetter is the part of blockio.BlockWriter that sets its
+// codec, a writer of a BlockWriterFactory need not have it.
+type compressionSetter interface {
+	SetCompression(algo uint8)
+	SetCompressionLevel(level int)
+}
+
+// BlockWriterAborter is the part of a block writer that releases what
+// it holds, e.g. its buffers or a connection, when the rewrite gives it
+// up before syncing it, on an error or a cancel. blockio.BlockWriter,
+// the writer of the default factory, implements it. A writer of a
+// BlockWriterFactory that holds such resources implements it too, the
+// others are left to the garbage collector.
+type BlockWriterAborter interface {
+	Abort()
+}
+
+// BlockWriterFactory opens the block writer of the object name in fs.
+type BlockWriterFactory func(fs fileservice.FileService, name string) (BlockWriterLike, error)
+
+// BlockExporter exports bat, the data of an aBlock of table tid the
+// rewrite converted to the object name, after its deletes are applied
+// and its columns projected. It returns the name of the file it wrote.
+type BlockExporter func(ctx context.Context, tid uint64, name objectio.ObjectName, bat *batch.Batch) (string, error)
+
+// newBlockWriter is the default BlockWriterFactory.
+func newBlockWriter(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+	return blockio.NewBlockWriter(fs, name)
+}
+
+func newBackupOptions(opts ...BackupOption) *backupOptions {
+	o := &backupOptions{
+		growthLimits: DefaultGrowthLimits,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.result == nil {
+		o.result = &RewriteResult{}
+	}
+	if o.stats == nil {
+		o.stats = NewBackupStats()
+	}
+	if o.newWriter == nil {
+		o.newWriter = newBlockWriter
+	}
+	if o.tnAllocator == nil {
+		o.tnAllocator = common.CheckpointAllocator
+	}
+	if o.normalizer == nil {
+		o.normalizer = DefaultBatchNormalizer
+	}
+	if o.cnAllocator == nil {
+		o.cnAllocator = common.CheckpointAllocator
+	}
+	if o.observer == nil {
+		o.observer = NopRewriteObserver{}
+	}
+	if o.sampling != nil {
+		filter, sampling := o.rowFilter, o.sampling
+		o.rowFilter = func(bat *batch.Batch, row int) bool {
+			return (filter == nil || filter(bat, row)) && sampling.keep(bat, row)
+		}
+	}
+	return o
+}
+
+// WithVerifySort enables sort order verification of the blocks
+// that are passed through without being rewritten. It costs an
+// extra read of the sort key column of every such block.
+func WithVerifySort() BackupOption {
+	return func(o *backupOptions) {
+		o.verifySort = true
+	}
+}
+
+// WithRewriteResult makes the rewrite fill res with what it did.
+func WithRewriteResult(res *RewriteResult) BackupOption {
+	return func(o *backupOptions) {
+		o.result = res
+	}
+}
+
+// WithBackupSession runs the rewrite within session, the objects it
+// writes are charged to the session quota and recorded in its journal.
+func WithBackupSession(session *BackupSession) BackupOption {
+	return func(o *backupOptions) {
+		o.session = session
+	}
+}
+
+// WithColumnProjection keeps only the listed data columns, by position,
+// of the tables in projection when their blocks are written, the
+// trailing metadata columns are always kept. Such a backup cannot be
+// restored with full fidelity, its CheckpointFooter records the
+// projection and the objects written through it. Only the objects the
+// rewrite writes are projected: a table with data objects copied as
+// they are, e.g. its nBlocks, is refused with a
+// ProjectionRefusedError before anything is written.
+func WithColumnProjection(projection map[uint64][]uint16) BackupOption {
+	return func(o *backupOptions) {
+		o.projection = projection
+	}
+}
+
+// WithStrictBlockLoad fails the rewrite when an aBlock loads with no
+// rows instead of dropping it, for setups where a stale block location
+// means the source is corrupted.
+func WithStrictBlockLoad() BackupOption {
+	return func(o *backupOptions) {
+		o.strictLoad = true
+	}
+}
+
+// WithSegmentRemap names the objects the aBlocks are converted to in
+// the segment remap gives for the segment of their source, for a
+// restore into a cluster with another segment namespace. The block ids
+// of the converted blocks follow their object name. Segments not in
+// remap are kept.
+func WithSegmentRemap(remap map[objectio.Segmentid]objectio.Segmentid) BackupOption {
+	return func(o *backupOptions) {
+		o.segmentRemap = remap
+	}
+}
+
+// WithSkipExisting reuses a converted object that is already in the
+// destination, e.g. left by an interrupted backup, instead of loading
+// and sorting its aBlock again. The object is reused with the journal
+// entry persisted next to it, one left without its entry is written
+// again. Only use it when the destination is not shared with another
+// backup.
+func WithSkipExisting() BackupOption {
+	return func(o *backupOptions) {
+		o.skipExisting = true
+	}
+}
+
+// WithBackupStats counts what the rewrite does in stats, which can be
+// shared with the other stages of the backup.
+func WithBackupStats(stats *BackupStats) BackupOption {
+	return func(o *backupOptions) {
+		o.stats = stats
+	}
+}
+
+// RowFilter reports whether row of bat is kept. bat holds an aBlock as
+// it is loaded: the data columns by position, followed by the commit ts
+// and the other metadata columns.
+type RowFilter func(bat *batch.Batch, row int) bool
+
+// WithRowFilter keeps only the rows of the converted aBlocks for which
+// filter returns true, on top of the ts trim, e.g. the rows of a single
+// account for an analytics restore.
+//
+// filter is called for every row of every aBlock the rewrite loads, it
+// should be cheap and not allocate. A block it drops rows from is
+// copied once more, and an object it drops all rows from is dropped.
+// The aBlocks of objects that are still appendable at ts are rewritten
+// in place and not filtered, their tombstones address the rows by
+// offset.
+func WithRowFilter(filter RowFilter) BackupOption {
+	return func(o *backupOptions) {
+		o.rowFilter = filter
+	}
+}
+
+// Sampling keeps a sample of the rows of the converted aBlocks. Set
+// one of Fraction and EveryNth.
+type Sampling struct {
+	// Fraction keeps about this fraction of the rows. The rows are
+	// picked by a hash of their rowid, a backup of the same data keeps
+	// the same rows.
+	Fraction float64
+	// EveryNth keeps the rows whose offset in their block is a multiple
+	// of EveryNth.
+	EveryNth int
+}
+
+func (s *Sampling) keep(bat *batch.Batch, row int) bool {
+	if s.EveryNth > 0 {
+		return row%s.EveryNth == 0
+	}
+	rowid := bat.Vecs[len(bat.Vecs)-appendableMetaColumns].GetRawBytesAt(row)
+	return float64(xxhash.Sum64(rowid))/math.MaxUint64 < s.Fraction
+}
+
+// WithSampling keeps only a sample of the rows of the converted aBlocks,
+// to build a small dataset that looks like the backed up one, e.g. for
+// tests. It is a row filter, see WithRowFilter, applied together with
+// the one set by it: the deletes of the dropped rows are dropped with
+// them, and the nBlocks and the aBlocks rewritten in place are kept
+// whole. A sampled backup cannot be restored with full fidelity and
+// must be tagged as sampled.
+func WithSampling(sampling Sampling) BackupOption {
+	return func(o *backupOptions) {
+		o.sampling = &sampling
+	}
+}
+
+// WithMaxOpenWriters bounds the number of block writers the rewrite has
+// open on the destination at the same time, whatever the number of
+// workers writing, so that it does not run out of file descriptors or
+// connections. Opening a writer waits for another one to be synced.
+func WithMaxOpenWriters(n int) BackupOption {
+	return func(o *backupOptions) {
+		if n > 0 {
+			o.writers = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithBlockWriterFactory opens the writers of the objects the rewrite
+// writes with factory instead of blockio.NewBlockWriter. The checkpoint
+// objects themselves are still written by CheckpointData.WriteTo.
+func WithBlockWriterFactory(factory BlockWriterFactory) BackupOption {
+	return func(o *backupOptions) {
+		o.newWriter = factory
+	}
+}
+
+// WithObjectCompression writes the objects of schema, e.g. the
+// tombstones that compress well, with the codec algo at level. The
+// checkpoint objects themselves are written by CheckpointData.WriteTo
+// with its own codec, and a writer of WithBlockWriterFactory that
+// cannot set its codec keeps its own.
+func WithObjectCompression(schema objectio.DataMetaType, algo uint8, level int) BackupOption {
+	return func(o *backupOptions) {
+		if o.compression == nil {
+			o.compression = make(map[objectio.DataMetaType]ObjectCompression)
+		}
+		o.compression[schema] = ObjectCompression{Algo: algo, Level: level}
+	}
+}
+
+// RewritePhases is the number of phases of the checkpoint rewrite.
+const RewritePhases = 6
+
+// RewriteProgress tells how far the checkpoint rewrite is.
+type RewriteProgress struct {
+	// Phase is the phase the rewrite is in, from 1 to RewritePhases.
+	Phase int
+	// Done and Total count the objects of the phase, Total is 0 for
+	// the phases that do not go object by object.
+	Done, Total int
+}
+
+// WithProgress calls progress when the rewrite enters a phase and
+// before each object it rewrites. progress runs on the goroutine of
+// the rewrite and must return quickly.
+func WithProgress(progress func(RewriteProgress)) BackupOption {
+	return func(o *backupOptions) {
+		o.progress = progress
+	}
+}
+
+// WithForceSort sorts the converted aBlocks of the tables in keys by
+// the data column, by position, keys gives for them when their object
+// declares no sort key, so that the backup of a table with a primary
+// key has only sorted blocks, which a restore reads faster. keys gives
+// the primary key of each table.
+func WithForceSort(keys map[uint64]uint16) BackupOption {
+	return func(o *backupOptions) {
+		o.forceSort = keys
+	}
+}
+
+// WithStrictSort fails the rewrite when the data of an aBlock fails to
+// sort, e.g. the sort cannot allocate, instead of writing the block
+// unsorted and flagging it so.
+func WithStrictSort() BackupOption {
+	return func(o *backupOptions) {
+		o.strictSort = true
+	}
+}
+
+// WithStrictBlockMeta fails the rewrite when the source checkpoint lists
+// a block more than once in BLKMetaInsert or BLKCNMetaInsert, instead
+// of keeping the row committed last.
+func WithStrictBlockMeta() BackupOption {
+	return func(o *backupOptions) {
+		o.strictMeta = true
+	}
+}
+
+// WithLenientLocations drops the rows of the block meta batches whose
+// location is corrupt, and lists them in RewriteResult.CorruptLocations,
+// instead of failing the rewrite with a CorruptLocationError.
+func WithLenientLocations() BackupOption {
+	return func(o *backupOptions) {
+		o.lenientLocations = true
+	}
+}
+
+// WithBlockIDMapping records in RewriteResult.RelocatedBlocks the block
+// id each converted aBlock gets, and that of each renumbered block of
+// the objects rewritten in place, so that what references the blocks by
+// block id, e.g. an index rebuilt on restore, can be updated.
+func WithBlockIDMapping() BackupOption {
+	return func(o *backupOptions) {
+		o.mapBlockIDs = true
+	}
+}
+
+// WithStrictSoftDeletes fails the rewrite with a SoftDeleteConflictError
+// when the soft deletes passed to it disagree with what the checkpoint
+// drops, instead of only reporting the conflicts.
+func WithStrictSoftDeletes() BackupOption {
+	return func(o *backupOptions) {
+		o.strictSoftDeletes = true
+	}
+}
+
+// WithCheckpointFooter writes a CheckpointFooter describing the
+// rewritten checkpoint next to it, see CheckpointFooterName.
+func WithCheckpointFooter() BackupOption {
+	return func(o *backupOptions) {
+		o.footer = true
+	}
+}
+
+// WithProvenance records what the source checkpoint says of each of
+// its objects, its table and its timestamps, and which object of the
+// backup has its rows, in the result and in the CheckpointFooter, if
+// one is written. It only reads the source checkpoint.
+func WithProvenance() BackupOption {
+	return func(o *backupOptions) {
+		o.provenance = true
+	}
+}
+
+// WithUnorderedTombstones writes the tombstones the rewrite trims with
+// their rows in the order they were written, as the rewrite did before
+// it sorted them by rowid then commit ts.
+func WithUnorderedTombstones() BackupOption {
+	return func(o *backupOptions) {
+		o.unorderedTombstones = true
+	}
+}
+
+// WithBlockExporter also exports the data of each aBlock the rewrite
+// converts with exporter, e.g. to a format read without MatrixOne. The
+// blocks copied as they are and the aBlocks a session already
+// converted are not exported.
+func WithBlockExporter(exporter BlockExporter) BackupOption {
+	return func(o *backupOptions) {
+		o.exporter = exporter
+	}
+}
+
+// WithABlockBatching converts the aBlocks with fewer than rows rows at
+// the backup ts together, the small aBlocks of a table into as few
+// objects as a block of rows allows, instead of one object each.
+//
+// Converting an aBlock writes a new object, with its own meta, zone
+// maps and IO, whatever its size, so many tiny aBlocks cost far more
+// than their rows. Batched, the rows of the small aBlocks are held in
+// memory until the end of the rewrite phase, and the converted object
+// no longer maps to a single aBlock, RelocatedBlocks maps each of them
+// to it. The rows a restore sees are the same.
+func WithABlockBatching(rows int) BackupOption {
+	return func(o *backupOptions) {
+		o.batchRows = rows
+	}
+}
+
+// WithBatchAllocators attributes the memory of the batches the rewrite
+// converts to TN batches to tn, and of the CN batches it copies, e.g.
+// when late rows are cut or a block is sorted, to cn. Both default to
+// common.CheckpointAllocator.
+func WithBatchAllocators(tn, cn *mpool.MPool) BackupOption {
+	return func(o *backupOptions) {
+		o.tnAllocator = tn
+		o.cnAllocator = cn
+	}
+}
+
+// WithReadOnlySource fails the rewrite with a SourceMutationError on
+// any write or delete of the source FileService, for backups that only
+// have read-only credentials on it. The rewrite only reads the source,
+// the option makes sure of it before the FileService refuses a write
+// halfway through the rewrite.
+func WithReadOnlySource() BackupOption {
+	return func(o *backupOptions) {
+		o.readOnlySource = true
+	}
+}
+
+// withObjectNameGenerator names the objects the aBlocks are converted
+// to with gen, so that tests know the names the rewrite writes.
+func withObjectNameGenerator(gen objectNameGenerator) BackupOption {
+	return func(o *backupOptions) {
+		o.nameGenerator = gen
+	}
+}
+
+// forcedSortKey returns the sort key of the aBlocks of table tid whose
+// object declares none, math.MaxUint16 to leave them unsorted.
+func (o *backupOptions) forcedSortKey(tid uint64) uint16 {
+	if key, ok := o.forceSort[tid]; ok {
+		return key
+	}
+	return math.MaxUint16
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// resolveBlockOverlap handles a ts that falls inside a compaction: the
+// same block is then listed both in BLKMetaInsert and BLKCNMetaInsert,
+// and the two rows were committed on opposite sides of ts. Only the row
+// visible at ts is kept, the other one is dropped so that the rows of
+// the block are not backed up twice. It returns the number of rows
+// dropped.
+func resolveBlockOverlap(ctx context.Context, data *CheckpointData, ts types.TS) int {
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	cnMeta := data.bats[BLKCNMetaInsertIDX]
+	if blkMeta.Length() == 0 || cnMeta.Length() == 0 {
+		return 0
+	}
+	metaRows := make(map[types.Blockid]int, blkMeta.Length())
+	metaIDs := blkMeta.GetVectorByName(catalog.BlockMeta_ID)
+	metaCommits := blkMeta.GetVectorByName(catalog.BlockMeta_CommitTs)
+	for i := 0; i < blkMeta.Length(); i++ {
+		metaRows[metaIDs.Get(i).(types.Blockid)] = i
+	}
+
+	dropMeta := make([]int, 0)
+	dropCN := make([]int, 0)
+	cnIDs := cnMeta.GetVectorByName(catalog.BlockMeta_ID)
+	cnCommits := cnMeta.GetVectorByName(catalog.BlockMeta_CommitTs)
+	for i := 0; i < cnMeta.Length(); i++ {
+		blkID := cnIDs.Get(i).(types.Blockid)
+		row, ok := metaRows[blkID]
+		if !ok {
+			continue
+		}
+		metaCommit := metaCommits.Get(row).(types.TS)
+		cnCommit := cnCommits.Get(i).(types.TS)
+		metaVisible := metaCommit.LessEq(&ts)
+		if metaVisible == cnCommit.LessEq(&ts) {
+			continue
+		}
+		if metaVisible {
+			dropCN = append(dropCN, i)
+		} else {
+			dropMeta = append(dropMeta, row)
+		}
+		jobLogger(ctx).Info("[ResolveOverlap]", common.OperationField("block in compaction window"),
+			common.AnyField("block", blkID.String()),
+			common.AnyField("meta commit", metaCommit.ToString()),
+			common.AnyField("cn commit", cnCommit.ToString()),
+			common.AnyField("keep meta insert", metaVisible))
+	}
+
+	for _, row := range dropMeta {
+		blkMeta.Delete(row)
+		data.bats[BLKMetaInsertTxnIDX].Delete(row)
+	}
+	for _, row := range dropCN {
+		cnMeta.Delete(row)
+	}
+	blkMeta.Compact()
+	data.bats[BLKMetaInsertTxnIDX].Compact()
+	cnMeta.Compact()
+	data.shrinkTableMeta(BlockInsert, dropMeta)
+	data.shrinkTableMeta(CNBlockInsert, dropCN)
+	return len(dropMeta) + len(dropCN)
+}
+
+// resolveDuplicateBlocks handles the checkpoints written by an old
+// replay bug, that list a block more than once in BLKMetaInsert or in
+// BLKCNMetaInsert. The rows of a block would all be rewritten and the
+// block restored twice, so only the row committed last is kept. A
+// block listed once in each of the two batches is a compaction, left
+// to resolveBlockOverlap. With WithStrictBlockMeta a duplicated block
+// is an error instead. It returns the number of rows dropped.
+func (o *backupOptions) resolveDuplicateBlocks(ctx context.Context, data *CheckpointData) (int, error) {
+	dropped := 0
+	for _, batch := range []struct {
+		idx     uint16
+		name    string
+		metaIdx int
+	}{
+		{BLKMetaInsertIDX, "BLKMetaInsert", BlockInsert},
+		{BLKCNMetaInsertIDX, "BLKCNMetaInsert", CNBlockInsert},
+	} {
+		bat := data.bats[batch.idx]
+		ids := bat.GetVectorByName(catalog.BlockMeta_ID)
+		commits := bat.GetVectorByName(catalog.BlockMeta_CommitTs)
+		kept := make(map[types.Blockid]int, bat.Length())
+		drop := make([]int, 0)
+		for i := 0; i < bat.Length(); i++ {
+			blkID := ids.Get(i).(types.Blockid)
+			row, ok := kept[blkID]
+			if !ok {
+				kept[blkID] = i
+				continue
+			}
+			if o.strictMeta {
+				return dropped, moerr.NewInternalError(ctx, "block %s is listed more than once in %s",
+					blkID.String(), batch.name)
+			}
+			keptCommit := commits.Get(row).(types.TS)
+			commit := commits.Get(i).(types.TS)
+			dropRow := i
+			if commit.Greater(&keptCommit) {
+				kept[blkID] = i
+				dropRow = row
+				keptCommit, commit = commit, keptCommit
+			}
+			drop = append(drop, dropRow)
+			o.result.DuplicateBlockRows = append(o.result.DuplicateBlockRows, DuplicateBlockRow{
+				Block:   blkID.String(),
+				Batch:   batch.name,
+				Kept:    keptCommit,
+				Dropped: commit,
+			})
+			o.log().Warn("[ResolveDuplicates]", common.OperationField("drop duplicate block meta row"),
+				common.AnyField("block", blkID.String()),
+				common.AnyField("batch", batch.name),
+				common.AnyField("kept commit", keptCommit.ToString()),
+				common.AnyField("dropped commit", commit.ToString()))
+			o.stats.Warn(BackupWarning{
+				Code:   WarnDuplicateMetaRow,
+				Block:  blkID.String(),
+				Detail: fmt.Sprintf("%s, kept commit %s, dropped commit %s", batch.name, keptCommit.ToString(), commit.ToString()),
+			})
+		}
+		if len(drop) == 0 {
+			continue
+		}
+		for _, row := range drop {
+			bat.Delete(row)
+			if batch.idx == BLKMetaInsertIDX {
+				data.bats[BLKMetaInsertTxnIDX].Delete(row)
+			}
+		}
+		bat.Compact()
+		if batch.idx == BLKMetaInsertIDX {
+			data.bats[BLKMetaInsertTxnIDX].Compact()
+		}
+		data.shrinkTableMeta(batch.metaIdx, drop)
+		dropped += len(drop)
+	}
+	o.stats.Phase(StatsPhaseVerify).Add(StatDuplicateMeta, int64(dropped))
+	return dropped, nil
+}
+
+// shrinkTableMeta moves the per table ranges of metaIdx to account for
+// the removed rows of the batch they index.
+func (data *CheckpointData) shrinkTableMeta(metaIdx int, removed []int) {
+	sort.Sort(sort.Reverse(sort.IntSlice(removed)))
+	for _, row := range removed {
+		for _, meta := range data.meta {
+			table := meta.tables[metaIdx]
+			if table == nil {
+				continue
+			}
+			if table.Start > uint64(row) {
+				table.Start--
+				table.End--
+			} else if table.End > uint64(row) {
+				table.End--
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// EntryPage is a page of the entries of a checkpoint, see
+// LoadCheckpointEntriesPaged.
+type EntryPage struct {
+	// Index is that of the page, from 0.
+	Index   int
+	Entries []*objectio.BackupObject
+}
+
+// LoadCheckpointEntriesPaged lists the entries of the checkpoint at
+// location as LoadCheckpointEntriesFromKey does, and calls fn with them
+// a page of at most pageSize entries at a time, as the files of the
+// checkpoint are scanned. A page is handed over before the later files
+// are read, fn may start on it while the listing goes on, it returns an
+// error to stop the listing.
+//
+// The first page has the checkpoint files. An object whose entries are
+// in more than one file can be in more than one page,
+// NormalizeLocations merges the pages into the entries
+// LoadCheckpointEntriesFromKey returns.
+//
+// The pages up to resume, excluded, are listed again but not handed
+// over, a listing stopped after a page resumes from the next one. The
+// objects the checkpoint drops are added to softDeletes whichever pages
+// are handed over, as the rows of the pages skipped are scanned too.
+// Checkpoints of versions that cannot be read column by column are
+// loaded in full and handed over in pages.
+func LoadCheckpointEntriesPaged(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+	pageSize int,
+	resume int,
+	fn func(EntryPage) error,
+) error {
+	if pageSize <= 0 {
+		return moerr.NewInvalidInputNoCtx("page size %d", pageSize)
+	}
+	pager := &entryPager{
+		size:   pageSize,
+		resume: resume,
+		fn:     fn,
+	}
+	idxs, typs, ok := scanColumnsIdxs(version)
+	if !ok {
+		locations, err := ListCheckpointEntriesFromKey(ctx, sid, fs, location, version, softDeletes, baseTS)
+		if err != nil {
+			return err
+		}
+		if err = pager.add(locations); err != nil {
+			return err
+		}
+		return pager.flush()
+	}
+
+	data, err := loadScanMeta(ctx, sid, fs, location, version)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	// The files are scanned in the order of their names, so that a
+	// resumed listing has the same pages.
+	names := make([]string, 0, len(data.locations))
+	for name := range data.locations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*objectio.BackupObject, 0, len(names)+1)
+	files = append(files, &objectio.BackupObject{
+		Location: location,
+		NeedCopy: true,
+	})
+	for _, name := range names {
+		files = append(files, &objectio.BackupObject{
+			Location: objectio.Location(bytes.Clone(data.locations[name])),
+			NeedCopy: true,
+		})
+	}
+	if err = pager.add(NormalizeLocations(files)); err != nil {
+		return err
+	}
+
+	sc := &checkpointScanner{}
+	rows := make(map[uint16]int)
+	layer := newSoftDeleteLayer(softDeletes)
+	for _, name := range names {
+		var ioVecs []*fileservice.IOVector
+		sc.used = 0
+		batches, err := sc.scanFile(ctx, sid, fs, data.locations[name], idxs, typs, &ioVecs)
+		if err == nil {
+			var entries []*objectio.BackupObject
+			if entries, err = scanBatchEntries(ctx, batches, rows, layer, baseTS); err == nil {
+				err = pager.add(NormalizeLocations(entries))
+			}
+		}
+		releaseIOVectors(ioVecs)
+		if err != nil {
+			return err
+		}
+	}
+	return pager.flush()
+}
+
+// entryPager cuts entries into the pages of LoadCheckpointEntriesPaged.
+type entryPager struct {
+	size    int
+	resume  int
+	fn      func(EntryPage) error
+	index   int
+	pending []*objectio.BackupObject
+}
+
+// add hands over the full pages of the pending entries and entries.
+func (p *entryPager) add(entries []*objectio.BackupObject) error {
+	p.pending = append(p.pending, entries...)
+	for len(p.pending) >= p.size {
+		if err := p.handOver(p.pending[:p.size]); err != nil {
+			return err
+		}
+		p.pending = p.pending[p.size:]
+	}
+	return nil
+}
+
+// flush hands over the last page, if any entries are pending.
+func (p *entryPager) flush() error {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	err := p.handOver(p.pending)
+	p.pending = nil
+	return err
+}
+
+func (p *entryPager) handOver(entries []*objectio.BackupObject) error {
+	page := EntryPage{Index: p.index}
+	p.index++
+	if page.Index < p.resume {
+		return nil
+	}
+	page.Entries = append([]*objectio.BackupObject(nil), entries...)
+	return p.fn(page)
+}
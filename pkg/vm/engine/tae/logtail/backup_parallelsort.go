@@ -0,0 +1,240 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"container/heap"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	mosort "github.com/matrixorigin/matrixone/pkg/sort"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/compute"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/mergesort"
+)
+
+// WithParallelSort sorts the aBlocks of at least threshold rows that
+// are converted with up to workers goroutines, GOMAXPROCS if workers is
+// not positive: each sorts a range of the rows, the ranges are then
+// merged. Once set, every aBlock is sorted stably, the rows of equal
+// sort keys keep their order, so that the order does not depend on
+// whether an aBlock is sorted in parallel or how.
+func WithParallelSort(threshold, workers int) BackupOption {
+	return func(o *backupOptions) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		o.parallelSort = &parallelSort{threshold: threshold, workers: workers}
+	}
+}
+
+type parallelSort struct {
+	threshold int
+	workers   int
+}
+
+// sortBlockColumns is mergesort.SortBlockColumns, stable and in
+// parallel for the large blocks with WithParallelSort.
+func (o *backupOptions) sortBlockColumns(
+	cols []containers.Vector, pk int, pool *containers.VectorPool,
+) ([]int64, error) {
+	if o.parallelSort == nil {
+		return mergesort.SortBlockColumns(cols, pk, pool)
+	}
+	key := cols[pk].GetDownstreamVector()
+	workers := 1
+	if key.Length() >= o.parallelSort.threshold {
+		workers = o.parallelSort.workers
+	}
+	sortedIdx := stableSortIndex(key, workers)
+	for i := range cols {
+		if err := cols[i].GetDownstreamVector().Shuffle(sortedIdx, pool.GetMPool()); err != nil {
+			return nil, err
+		}
+	}
+	return sortedIdx, nil
+}
+
+// stableSortIndex returns the rows of key in ascending order of key,
+// nulls first and equal keys by row. The rows are split in one range
+// per worker, sorted each in its own goroutine and merged.
+func stableSortIndex(key *vector.Vector, workers int) []int64 {
+	n := key.Length()
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	sortedIdx := make([]int64, n)
+	for i := range sortedIdx {
+		sortedIdx[i] = int64(i)
+	}
+	cmp := rowComparator(key)
+	ranges := make([][]int64, workers)
+	var wg sync.WaitGroup
+	for w := range ranges {
+		ranges[w] = sortedIdx[w*n/workers : (w+1)*n/workers]
+		wg.Add(1)
+		go func(rows []int64) {
+			defer wg.Done()
+			mosort.Sort(false, false, key.HasNull(), rows, key)
+			breakTies(rows, cmp)
+		}(ranges[w])
+	}
+	wg.Wait()
+	if workers == 1 {
+		return sortedIdx
+	}
+	return mergeSortedRanges(ranges, n, cmp)
+}
+
+// rowComparator compares two rows of key, a null before any value.
+func rowComparator(key *vector.Vector) func(a, b int64) int {
+	values := valueComparator(key)
+	if !key.HasNull() {
+		return values
+	}
+	nulls := key.GetNulls()
+	return func(a, b int64) int {
+		aNull, bNull := nulls.Contains(uint64(a)), nulls.Contains(uint64(b))
+		switch {
+		case aNull && bNull:
+			return 0
+		case aNull:
+			return -1
+		case bNull:
+			return 1
+		}
+		return values(a, b)
+	}
+}
+
+// valueComparator compares the values of two rows of key, on the fixed
+// column for the ordered types, which the sort keys mostly are.
+func valueComparator(key *vector.Vector) func(a, b int64) int {
+	typ := key.GetType()
+	switch typ.Oid {
+	case types.T_int8:
+		return orderedComparator[int8](key)
+	case types.T_int16:
+		return orderedComparator[int16](key)
+	case types.T_int32:
+		return orderedComparator[int32](key)
+	case types.T_int64:
+		return orderedComparator[int64](key)
+	case types.T_uint8:
+		return orderedComparator[uint8](key)
+	case types.T_uint16:
+		return orderedComparator[uint16](key)
+	case types.T_uint32:
+		return orderedComparator[uint32](key)
+	case types.T_uint64:
+		return orderedComparator[uint64](key)
+	case types.T_float32:
+		return orderedComparator[float32](key)
+	case types.T_float64:
+		return orderedComparator[float64](key)
+	case types.T_date:
+		return orderedComparator[types.Date](key)
+	case types.T_datetime:
+		return orderedComparator[types.Datetime](key)
+	case types.T_timestamp:
+		return orderedComparator[types.Timestamp](key)
+	}
+	return func(a, b int64) int {
+		return compute.Compare(key.GetRawBytesAt(int(a)), key.GetRawBytesAt(int(b)), typ.Oid, typ.Scale, typ.Scale)
+	}
+}
+
+func orderedComparator[T types.OrderedT](key *vector.Vector) func(a, b int64) int {
+	col := vector.MustFixedCol[T](key)
+	return func(a, b int64) int {
+		return compute.CompareOrdered(col[a], col[b])
+	}
+}
+
+// breakTies orders the runs of equal keys of the sorted rows by row,
+// the sort of mosort.Sort is not stable.
+func breakTies(rows []int64, cmp func(a, b int64) int) {
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && cmp(rows[start], rows[end]) == 0 {
+			end++
+		}
+		if end-start > 1 {
+			run := rows[start:end]
+			sort.Slice(run, func(i, j int) bool { return run[i] < run[j] })
+		}
+		start = end
+	}
+}
+
+// mergeSortedRanges merges the sorted ranges of rows, of n rows in
+// all. The ranges are of ascending rows, an equal key is taken from the
+// first range first, which keeps the merge stable.
+func mergeSortedRanges(ranges [][]int64, n int, cmp func(a, b int64) int) []int64 {
+	h := &rangeHeap{cmp: cmp}
+	for i, rows := range ranges {
+		if len(rows) > 0 {
+			h.cursors = append(h.cursors, rangeCursor{rows: rows, rank: i})
+		}
+	}
+	heap.Init(h)
+	merged := make([]int64, 0, n)
+	for h.Len() > 0 {
+		top := &h.cursors[0]
+		merged = append(merged, top.rows[0])
+		top.rows = top.rows[1:]
+		if len(top.rows) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
+}
+
+type rangeCursor struct {
+	rows []int64
+	rank int
+}
+
+type rangeHeap struct {
+	cursors []rangeCursor
+	cmp     func(a, b int64) int
+}
+
+func (h *rangeHeap) Len() int { return len(h.cursors) }
+
+func (h *rangeHeap) Less(i, j int) bool {
+	if c := h.cmp(h.cursors[i].rows[0], h.cursors[j].rows[0]); c != 0 {
+		return c < 0
+	}
+	return h.cursors[i].rank < h.cursors[j].rank
+}
+
+func (h *rangeHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *rangeHeap) Push(x any) { h.cursors = append(h.cursors, x.(rangeCursor)) }
+
+func (h *rangeHeap) Pop() any {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// RewritePlan counts what a rewrite of a checkpoint would do with the
+// objects the checkpoint refers to, see PlanRewrite.
+type RewritePlan struct {
+	// Rewritten are the objects trimmed and written again under their
+	// own name, RewriteFiles.Rewritten.
+	Rewritten int
+	// Relocated are the aBlocks converted to objects of new names. An
+	// aBlock converted in a batch of WithABlockBatching counts although
+	// it shares the object of the batch.
+	Relocated int
+	// PassedThrough are the objects the rewritten checkpoint refers to
+	// as they are.
+	PassedThrough int
+	// Dropped are the aBlocks without rows at ts, the rewritten
+	// checkpoint no longer refers to them.
+	Dropped int
+	// Changed tells whether the rewrite writes a checkpoint, a rewrite
+	// that does not change it passes every object through.
+	Changed bool
+	// EstimatedBytes bounds the bytes of the objects the rewrite
+	// writes, the size of the source objects it rewrites or relocates.
+	// The checkpoint itself is not counted.
+	EstimatedBytes int64
+}
+
+// PlanRewrite runs the phases of ReWriteCheckpointAndBlockFromKey up to
+// the trim, phases 1 to 3, on the checkpoint at loc and returns what
+// the rewrite at ts with opts would do with its objects, without
+// writing anything. It loads the aBlocks and the tombstones the trim
+// needs as the rewrite does. The objects a best effort session would
+// skip while writing are not predicted.
+func PlanRewrite(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	loc objectio.Location,
+	version uint32, ts types.TS,
+	softDeletes *SoftDeletes,
+	opts ...BackupOption,
+) (*RewritePlan, error) {
+	options := newBackupOptions(opts...)
+	options.bindJobLogger(loc, fs)
+	ctx = options.withJobLogger(ctx)
+	if err := checkCheckpointVersion(loc, version); err != nil {
+		return nil, err
+	}
+	if err := checkRewriteTS(loc, ts); err != nil {
+		return nil, err
+	}
+	if err := options.checkCheckpointEnd(loc, ts); err != nil {
+		return nil, err
+	}
+	data, err := getCheckpointData(ctx, sid, fs, loc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	data.FormatData(common.CheckpointAllocator)
+	corrupt, err := options.validateLocations(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkCheckpointFeatures(loc, data); err != nil {
+		return nil, err
+	}
+
+	if err = options.checkSoftDeletes(ctx, data, softDeletes); err != nil {
+		return nil, err
+	}
+	options.schemaSortKeys = schemaSortKeys(data.bats[TBLColInsertIDX])
+	duplicates, err := options.resolveDuplicateBlocks(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	dropped := resolveBlockOverlap(ctx, data, ts)
+	if err = options.deltaOnlyABlocks(ctx, data); err != nil {
+		return nil, err
+	}
+	objectsData, err := collectLimitedObjectsData(data, ts, options.analysisLimiter())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		releaseObjectsData(objectsData)
+	}()
+
+	changed, err := trimObjectsData(ctx, fs, ts, &objectsData, options)
+	if err != nil {
+		return nil, err
+	}
+	if err = options.stampCheckpointEnd(loc); err != nil {
+		return nil, err
+	}
+	plan := &RewritePlan{
+		Changed: changed || corrupt > 0 || duplicates > 0 || dropped > 0,
+	}
+	if plan.Changed {
+		plan.EstimatedBytes = estimateRewriteBytes(objectsData)
+	}
+	for _, objectData := range objectsData {
+		if !plan.Changed {
+			plan.PassedThrough++
+			continue
+		}
+		switch planObject(objectData) {
+		case plannedRewrite:
+			plan.Rewritten++
+		case plannedRelocate:
+			plan.Relocated++
+		case plannedDrop:
+			plan.Dropped++
+		default:
+			plan.PassedThrough++
+		}
+	}
+	return plan, nil
+}
+
+const (
+	plannedPassThrough = iota
+	plannedRewrite
+	plannedRelocate
+	plannedDrop
+)
+
+// planObject tells what phase 4 of the rewrite does with the trimmed
+// object objectData, following its branches.
+func planObject(objectData *fileData) int {
+	if !objectData.isChange && !objectData.isDeleteBatch {
+		return plannedPassThrough
+	}
+	dataBlocks, _ := sortBlocks(objectData.data)
+	if len(dataBlocks) == 0 && (objectData.obj == nil || !objectData.isDeleteBatch) {
+		return plannedPassThrough
+	}
+	if objectData.rewrittenInPlace() {
+		return plannedRewrite
+	}
+	if objectData.data[0] != nil && objectData.data[0].blockType != objectio.SchemaTombstone {
+		switch {
+		case !objectData.isABlock:
+			return plannedPassThrough
+		case dataBlocks[0].dropped:
+			return plannedDrop
+		default:
+			return plannedRelocate
+		}
+	}
+	if objectData.data[0] == nil {
+		switch {
+		case objectData.obj.dropped:
+			return plannedDrop
+		case !objectData.isABlock:
+			return plannedPassThrough
+		default:
+			return plannedRelocate
+		}
+	}
+	return plannedPassThrough
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// ProjectionRefusedError is returned by a rewrite WithColumnProjection
+// when a table it projects has data objects the rewrite does not write,
+// e.g. its nBlocks: they are copied as they are, with all their
+// columns, and the backup would mix projected and full objects.
+type ProjectionRefusedError struct {
+	Table   uint64
+	Objects []string
+}
+
+func (e *ProjectionRefusedError) Error() string {
+	return fmt.Sprintf("column projection of table %d: %d objects are copied with all their columns, e.g. %s",
+		e.Table, len(e.Objects), e.Objects[0])
+}
+
+func IsProjectionRefused(err error) bool {
+	var pe *ProjectionRefusedError
+	return errors.As(err, &pe)
+}
+
+// FooterProjection records the column projection a checkpoint was
+// written with, see WithColumnProjection: the data columns kept of each
+// table, and the objects they were kept of.
+type FooterProjection struct {
+	Tables  map[uint64][]uint16 `json:"tables"`
+	Objects []string            `json:"objects"`
+}
+
+// checkProjection refuses the column projection of the rewrite if a
+// table it projects has a data object alive at ts, in the source
+// checkpoint data, that the trimmed objectsData do not convert or
+// rewrite. Only those are written through the projection.
+func (o *backupOptions) checkProjection(
+	data *CheckpointData,
+	objectsData map[string]*fileData,
+	ts types.TS,
+) error {
+	if len(o.projection) == 0 {
+		return nil
+	}
+	copied := make(map[uint64]map[string]struct{})
+	check := func(tid uint64, name string) {
+		if _, ok := o.projection[tid]; !ok {
+			return
+		}
+		if objectData, ok := objectsData[name]; ok {
+			switch planObject(objectData) {
+			case plannedRewrite, plannedRelocate, plannedDrop:
+				return
+			}
+		}
+		if copied[tid] == nil {
+			copied[tid] = make(map[string]struct{})
+		}
+		copied[tid][name] = struct{}{}
+	}
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		deleteAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		if !deleteAt.IsEmpty() && deleteAt.LessEq(&ts) {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		check(objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64), stats.ObjectName().String())
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if location := view.MetaLoc(); !location.IsEmpty() {
+			check(view.TID(), location.Name().String())
+		}
+		return nil
+	})
+
+	if len(copied) == 0 {
+		return nil
+	}
+	tables := make([]uint64, 0, len(copied))
+	for tid := range copied {
+		tables = append(tables, tid)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	err := &ProjectionRefusedError{Table: tables[0]}
+	for name := range copied[tables[0]] {
+		err.Objects = append(err.Objects, name)
+	}
+	sort.Strings(err.Objects)
+	return err
+}
+
+// footerProjection returns the FooterProjection of the checkpoint data
+// written with projection, whose objects the rewrite wrote are files.
+// The objects are those of the projected tables, nil without one.
+func footerProjection(
+	data *CheckpointData,
+	projection map[uint64][]uint16,
+	files *RewriteFiles,
+) *FooterProjection {
+	if len(projection) == 0 {
+		return nil
+	}
+	written := make(map[string]struct{})
+	for _, name := range files.All() {
+		written[name] = struct{}{}
+	}
+	projected := &FooterProjection{
+		Tables:  projection,
+		Objects: make([]string, 0),
+	}
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		if _, ok := projection[objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64)]; !ok {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		if _, ok := written[stats.ObjectName().String()]; ok {
+			projected.Objects = append(projected.Objects, stats.ObjectName().String())
+		}
+	}
+	sort.Strings(projected.Objects)
+	return projected
+}
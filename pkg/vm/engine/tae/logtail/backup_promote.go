@@ -0,0 +1,176 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithStagingFS makes the session write to staging, e.g. a memory or a
+// local FileService, in place of the destination of the rewrites it
+// runs and of the copies it records: the objects, the checkpoint and
+// its auxiliary files, the journal and the staged writes included. The
+// destination is not touched until the staged backup is verified, see
+// VerifyStagedCheckpoint, and promoted to it with PromoteBackup.
+func WithStagingFS(staging fileservice.FileService) SessionOption {
+	return func(s *BackupSession) {
+		s.staging = staging
+	}
+}
+
+// stagingFS returns the FileService the rewrites of the session write
+// to in place of their destination, nil if it has none.
+func (s *BackupSession) stagingFS() fileservice.FileService {
+	if s == nil {
+		return nil
+	}
+	return s.staging
+}
+
+// CopyFS returns the FileService the copies run with Copy write to in
+// place of dstFs, the destination of the session: its staging
+// FileService if it has one, with the tags of the session.
+func (s *BackupSession) CopyFS(dstFs fileservice.FileService) fileservice.FileService {
+	if s == nil {
+		return dstFs
+	}
+	return s.dstFs
+}
+
+// CopiedFiles returns the files the session, or an earlier one whose
+// journal it resumes, copied with Copy, sorted by name.
+func (s *BackupSession) CopiedFiles() []string {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	files := make([]string, 0)
+	for name, entry := range s.journal.Objects {
+		// The objects the rewrites write have a name and a location.
+		if len(entry.Name) == 0 {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// BackupFiles returns the files the rewrite that returned cnLocation
+// wrote: the objects and the checkpoint of r.Files, the provenance of
+// the checkpoint, its footer and its manifest, if any, and the files
+// session copied. They are what PromoteBackup copies from a staging
+// FileService, sorted by name.
+func (r *RewriteResult) BackupFiles(cnLocation objectio.Location, session *BackupSession) []string {
+	files := r.Files.All()
+	files = append(files, CheckpointProvenanceName(cnLocation.Name().String()))
+	if r.Footer != "" {
+		files = append(files, r.Footer)
+	}
+	if r.Manifest != "" {
+		files = append(files, r.Manifest)
+	}
+	files = append(files, session.CopiedFiles()...)
+	sort.Strings(files)
+	return files
+}
+
+// isCommitPointName tells if name is a CheckpointFooter or a
+// RestoreManifest, which describe the backup and are promoted last.
+func isCommitPointName(name string) bool {
+	return strings.HasPrefix(name, BackupAuxName(BackupAuxFooter, "")) ||
+		strings.HasPrefix(name, BackupAuxName(BackupAuxManifest, ""))
+}
+
+// PromoteBackup copies files, a backup staged in stagingFs and
+// verified there, to dstFs. The footers and the manifests of the
+// checkpoints are copied last, once every file they describe is in
+// dstFs, they are the commit point of the backup: a promotion that fails before leaves dstFs
+// without them, and is run again. A file already in dstFs is replaced.
+func PromoteBackup(
+	ctx context.Context,
+	stagingFs, dstFs fileservice.FileService,
+	files []string,
+) error {
+	manifests := make([]string, 0)
+	promote := func(name string) error {
+		buf, err := readBackupFile(ctx, stagingFs, name)
+		if err != nil {
+			return err
+		}
+		return writeBackupFile(ctx, dstFs, name, buf)
+	}
+	for _, name := range files {
+		if isCommitPointName(name) {
+			manifests = append(manifests, name)
+			continue
+		}
+		if err := promote(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range manifests {
+		if err := promote(name); err != nil {
+			return err
+		}
+	}
+	jobLogger(ctx).Info("[PromoteBackup]", common.OperationField("promoted"),
+		common.AnyField("files", len(files)),
+		common.AnyField("manifests", len(manifests)))
+	return nil
+}
+
+// stagedView reads the files of a staged backup, and the files it does
+// not have from the source of the backup, i.e. the objects a backup
+// copies as they are. It is only read.
+type stagedView struct {
+	fileservice.FileService
+	source fileservice.FileService
+}
+
+func (v stagedView) Read(ctx context.Context, vector *fileservice.IOVector) error {
+	err := v.FileService.Read(ctx, vector)
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return v.source.Read(ctx, vector)
+	}
+	return err
+}
+
+func (v stagedView) StatFile(ctx context.Context, filePath string) (*fileservice.DirEntry, error) {
+	entry, err := v.FileService.StatFile(ctx, filePath)
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return v.source.StatFile(ctx, filePath)
+	}
+	return entry, err
+}
+
+// VerifyStagedCheckpoint is VerifyRewrittenCheckpoint for the
+// checkpoint at location staged in stagingFs, before it is promoted.
+// The objects the backup copies from srcFs as they are are read there.
+func VerifyStagedCheckpoint(
+	ctx context.Context,
+	stagingFs, srcFs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+) (*VerifyReport, error) {
+	return VerifyRewrittenCheckpoint(ctx, stagedView{FileService: stagingFs, source: srcFs}, location, version)
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+)
+
+// ObjectProvenance is what the source checkpoint of a backup says of
+// one of its objects, kept so that the objects of the backup can be
+// traced back to it although the rewrite converted some of them to
+// objects of other names.
+type ObjectProvenance struct {
+	// Source is the name of the object in the source checkpoint, Object
+	// the name of the object of the backup that holds its rows, the
+	// same unless the rewrite converted it.
+	Source string `json:"source"`
+	Object string `json:"object"`
+	Table  uint64 `json:"table"`
+	// CreateAt and DeleteAt are those of the object entry, a tombstone
+	// object has no entry and neither. DeleteAt is empty for an object
+	// not deleted.
+	CreateAt string `json:"create_at,omitempty"`
+	DeleteAt string `json:"delete_at,omitempty"`
+	// CommitTS is the commit ts of the latest row of the source
+	// checkpoint for the object, the object entry or, for a tombstone
+	// object, the block meta.
+	CommitTS string `json:"commit_ts"`
+}
+
+// captureProvenance records the provenance of the objects of data, the
+// source checkpoint, in the result, before the rewrite changes data.
+func (o *backupOptions) captureProvenance(data *CheckpointData) {
+	if !o.provenance {
+		return
+	}
+	objects := make(map[string]*ObjectProvenance)
+	commits := make(map[string]types.TS)
+	// An object listed more than once has the row committed last.
+	record := func(name string, tid uint64, commitTS types.TS) *ObjectProvenance {
+		if prev, ok := commits[name]; ok && commitTS.Less(&prev) {
+			return nil
+		}
+		commits[name] = commitTS
+		objects[name] = &ObjectProvenance{
+			Source:   name,
+			Object:   name,
+			Table:    tid,
+			CommitTS: commitTS.ToString(),
+		}
+		return objects[name]
+	}
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(bat.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+			object := record(stats.ObjectName().String(),
+				bat.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64),
+				bat.GetVectorByName(txnbase.SnapshotAttr_CommitTS).Get(i).(types.TS))
+			if object == nil {
+				continue
+			}
+			object.CreateAt = bat.GetVectorByName(EntryNode_CreateAt).Get(i).(types.TS).ToString()
+			if deleteAt := bat.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS); !deleteAt.IsEmpty() {
+				object.DeleteAt = deleteAt.ToString()
+			}
+		}
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		deltaLoc := view.DeltaLoc()
+		if view.Source() != BlockMetaInsert || deltaLoc.IsEmpty() {
+			return nil
+		}
+		name := deltaLoc.Name().String()
+		if _, ok := objects[name]; ok && objects[name].CreateAt != "" {
+			return nil
+		}
+		record(name, view.TID(), view.CommitTs())
+		return nil
+	})
+
+	o.result.Provenance = make([]ObjectProvenance, 0, len(objects))
+	for _, object := range objects {
+		o.result.Provenance = append(o.result.Provenance, *object)
+	}
+	sort.Slice(o.result.Provenance, func(i, j int) bool {
+		return o.result.Provenance[i].Source < o.result.Provenance[j].Source
+	})
+	o.sources = make(map[string]int, len(o.result.Provenance))
+	for i, object := range o.result.Provenance {
+		o.sources[object.Source] = i
+	}
+}
+
+// recordConverted records that the rows of the source object are in the
+// object converted in the backup.
+func (o *backupOptions) recordConverted(source, converted string) {
+	if o.relocated == nil {
+		o.relocated = make(map[string]string)
+	}
+	o.relocated[source] = converted
+	if i, ok := o.sources[source]; ok {
+		o.result.Provenance[i].Object = converted
+	}
+}
+
+// recordRenamed records that the rows of the source object, trimmed, are
+// in the object renamed, see withRewrittenObjectNames.
+func (o *backupOptions) recordRenamed(source, renamed string) {
+	if o.renamed == nil {
+		o.renamed = make(map[string]string)
+	}
+	o.renamed[source] = renamed
+	if i, ok := o.sources[source]; ok {
+		o.result.Provenance[i].Object = renamed
+	}
+}
+
+// CheckpointProvenance traces a rewritten checkpoint back to the source
+// checkpoint it was derived from. It is an auxiliary file of kind
+// BackupAuxProvenance next to the CN meta object of the checkpoint, the
+// rewrite writes it whenever it writes a checkpoint.
+type CheckpointProvenance struct {
+	// Hops are the rewrites the checkpoint went through, the first
+	// from a checkpoint of the cluster, the last the one that wrote it.
+	// A rewrite of a checkpoint with a provenance extends its hops.
+	Hops []ProvenanceHop `json:"hops"`
+	// CNOnly is set once a rewrite wrote the checkpoint WithCNOnly, the
+	// later rewrites keep it.
+	CNOnly bool `json:"cn_only,omitempty"`
+}
+
+// ProvenanceHop is a rewrite of a checkpoint.
+type ProvenanceHop struct {
+	// Source and Version are the location of the CN meta object of the
+	// checkpoint rewritten and its version, Source is empty for a
+	// checkpoint built in memory.
+	Source  string `json:"source"`
+	Version uint32 `json:"version"`
+	// TS is the ts the backup is taken at.
+	TS string `json:"ts"`
+	// RewrittenAt is when the rewrite wrote the checkpoint, Build the
+	// build that did.
+	RewrittenAt time.Time `json:"rewritten_at"`
+	Build       string    `json:"build"`
+}
+
+// Provenance returns the provenance of the checkpoint of data, nil
+// unless LoadCheckpointEntriesFromKey loaded it from a rewritten
+// checkpoint. The rewrite of data extends it.
+func (data *CheckpointData) Provenance() *CheckpointProvenance {
+	return data.provenance
+}
+
+// CheckpointProvenanceName returns the name of the provenance of the
+// checkpoint whose CN meta object is meta.
+func CheckpointProvenanceName(meta string) string {
+	return BackupAuxName(BackupAuxProvenance, meta)
+}
+
+// ReadCheckpointProvenance reads the provenance of the checkpoint whose
+// CN meta object is meta from fs.
+func ReadCheckpointProvenance(ctx context.Context, fs fileservice.FileService, meta string) (*CheckpointProvenance, error) {
+	payload, err := readBackupAux(ctx, fs, CheckpointProvenanceName(meta), BackupAuxProvenance)
+	if err != nil {
+		return nil, err
+	}
+	provenance := &CheckpointProvenance{}
+	if err = json.Unmarshal(payload, provenance); err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
+
+// loadCheckpointProvenance is ReadCheckpointProvenance for the
+// checkpoint at loc, nil for a checkpoint that has none, e.g. one
+// written by a cluster rather than rewritten.
+func loadCheckpointProvenance(
+	ctx context.Context,
+	fs fileservice.FileService,
+	loc objectio.Location,
+) (*CheckpointProvenance, error) {
+	if loc.IsEmpty() {
+		return nil, nil
+	}
+	provenance, err := ReadCheckpointProvenance(ctx, fs, loc.Name().String())
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return nil, nil
+	}
+	return provenance, err
+}
+
+// writeCheckpointProvenance writes the provenance of the checkpoint the
+// rewrite of the checkpoint of version at source, of provenance prev,
+// wrote to dstFs as meta, CN only if cnOnly, at rewrittenAt.
+func writeCheckpointProvenance(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	prev *CheckpointProvenance,
+	source objectio.Location,
+	version uint32,
+	ts types.TS,
+	meta string,
+	cnOnly bool,
+	rewrittenAt time.Time,
+) error {
+	provenance := &CheckpointProvenance{CNOnly: cnOnly || prev.IsCNOnly()}
+	if prev != nil {
+		provenance.Hops = append(provenance.Hops, prev.Hops...)
+	}
+	hop := ProvenanceHop{
+		Version:     version,
+		TS:          ts.ToString(),
+		RewrittenAt: rewrittenAt.UTC(),
+		Build:       backupAuxBuild(),
+	}
+	if !source.IsEmpty() {
+		hop.Source = source.String()
+	}
+	provenance.Hops = append(provenance.Hops, hop)
+	payload, err := json.Marshal(provenance)
+	if err != nil {
+		return err
+	}
+	return writeBackupAux(ctx, dstFs, CheckpointProvenanceName(meta), BackupAuxProvenance,
+		types.BuildTS(rewrittenAt.UnixNano(), 0), payload)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// ReaderAtOpener opens the file name as an io.ReaderAt of size bytes,
+// e.g. an entry of a tar archive or bytes in memory. It returns
+// ErrFileNotFound for a file it does not have.
+type ReaderAtOpener func(name string) (r io.ReaderAt, size int64, err error)
+
+// NewReaderAtFS returns a FileService that reads its files from open,
+// for the tools that have a checkpoint but not a FileService of its
+// storage, e.g. LoadCheckpointEntriesFromKey or OpenBackupSet on an
+// archived backup. It is only read: it cannot list, write nor delete,
+// and it does not cache what it reads. name is the name of the service,
+// that of the paths it is read at.
+func NewReaderAtFS(name string, open ReaderAtOpener) fileservice.FileService {
+	return &readerAtFS{name: name, open: open}
+}
+
+// LoadCheckpointEntriesFromReaderAt is LoadCheckpointEntriesFromKey for
+// the checkpoint of version at location in the files open opens. The
+// caller closes the data the same.
+func LoadCheckpointEntriesFromReaderAt(
+	ctx context.Context,
+	open ReaderAtOpener,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, *CheckpointData, error) {
+	return LoadCheckpointEntriesFromKey(ctx, "", NewReaderAtFS("readerat", open),
+		location, version, softDeletes, baseTS)
+}
+
+type readerAtFS struct {
+	name string
+	open ReaderAtOpener
+}
+
+var _ fileservice.FileService = (*readerAtFS)(nil)
+
+func (fs *readerAtFS) Name() string {
+	return fs.name
+}
+
+func (fs *readerAtFS) Write(_ context.Context, vector fileservice.IOVector) error {
+	return moerr.NewNotSupportedNoCtx("write %s to a ReaderAt source", vector.FilePath)
+}
+
+func (fs *readerAtFS) Read(ctx context.Context, vector *fileservice.IOVector) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(vector.Entries) == 0 {
+		return moerr.NewEmptyVectorNoCtx()
+	}
+	path, err := fileservice.ParsePathAtService(vector.FilePath, fs.name)
+	if err != nil {
+		return err
+	}
+	r, size, err := fs.open(path.File)
+	if err != nil {
+		return err
+	}
+	for i := range vector.Entries {
+		entry := &vector.Entries[i]
+		if entry.Size == 0 {
+			return moerr.NewEmptyRangeNoCtx(path.File)
+		}
+		if entry.Size < 0 {
+			entry.Size = size - entry.Offset
+		}
+		if entry.Offset < 0 || entry.Offset+entry.Size > size {
+			return moerr.NewUnexpectedEOFNoCtx(path.File)
+		}
+		data := entry.Data
+		if int64(len(data)) < entry.Size {
+			data = make([]byte, entry.Size)
+		}
+		data = data[:entry.Size]
+		if _, err = r.ReadAt(data, entry.Offset); err != nil && err != io.EOF {
+			return err
+		}
+		if err = fillReadEntry(entry, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillReadEntry hands data, the content read for entry, over to it the
+// ways a reader of a FileService asks for it.
+func fillReadEntry(entry *fileservice.IOEntry, data []byte) (err error) {
+	if entry.WriterForRead != nil {
+		if _, err = entry.WriterForRead.Write(data); err != nil {
+			return err
+		}
+	}
+	if entry.ReadCloserForRead != nil {
+		*entry.ReadCloserForRead = io.NopCloser(bytes.NewReader(data))
+	}
+	entry.Data = data
+	if entry.ToCacheData != nil {
+		if entry.CachedData, err = entry.ToCacheData(
+			bytes.NewReader(data), data, fileservice.GetDefaultCacheDataAllocator()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *readerAtFS) ReadCache(context.Context, *fileservice.IOVector) error {
+	return nil
+}
+
+func (fs *readerAtFS) List(_ context.Context, dirPath string) ([]fileservice.DirEntry, error) {
+	return nil, moerr.NewNotSupportedNoCtx("list %s of a ReaderAt source", dirPath)
+}
+
+func (fs *readerAtFS) Delete(_ context.Context, filePaths ...string) error {
+	return moerr.NewNotSupportedNoCtx("delete from a ReaderAt source")
+}
+
+func (fs *readerAtFS) StatFile(_ context.Context, filePath string) (*fileservice.DirEntry, error) {
+	path, err := fileservice.ParsePathAtService(filePath, fs.name)
+	if err != nil {
+		return nil, err
+	}
+	_, size, err := fs.open(path.File)
+	if err != nil {
+		return nil, err
+	}
+	return &fileservice.DirEntry{Name: path.File, Size: size}, nil
+}
+
+func (fs *readerAtFS) PrefetchFile(context.Context, string) error {
+	return nil
+}
+
+func (fs *readerAtFS) Cost() *fileservice.CostAttr {
+	return &fileservice.CostAttr{List: fileservice.CostHigh}
+}
+
+func (fs *readerAtFS) Close() {}
@@ -0,0 +1,77 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// SourceMutationError is returned when a rewrite WithReadOnlySource
+// writes or deletes files of its source FileService. The rewrite never
+// should, it is a bug of the rewrite rather than of the source.
+type SourceMutationError struct {
+	// Op is write or delete.
+	Op    string
+	Paths []string
+}
+
+func (e *SourceMutationError) Error() string {
+	return fmt.Sprintf("%s %s on the read-only source of the rewrite",
+		e.Op, strings.Join(e.Paths, ", "))
+}
+
+func IsSourceMutation(err error) bool {
+	var me *SourceMutationError
+	return errors.As(err, &me)
+}
+
+// panicOnSourceMutation panics with the SourceMutationError instead of
+// returning it, the tests set it so that a mutation of the source fails
+// them where it is made, whatever the rewrite does with the error.
+var panicOnSourceMutation bool
+
+// readOnlyFS is the source FileService of a rewrite WithReadOnlySource,
+// its writes and deletes fail without reaching the source.
+type readOnlyFS struct {
+	fileservice.FileService
+}
+
+func readOnlySource(fs fileservice.FileService) fileservice.FileService {
+	if _, ok := fs.(readOnlyFS); ok {
+		return fs
+	}
+	return readOnlyFS{FileService: fs}
+}
+
+func (fs readOnlyFS) Write(_ context.Context, vector fileservice.IOVector) error {
+	return sourceMutation("write", vector.FilePath)
+}
+
+func (fs readOnlyFS) Delete(_ context.Context, filePaths ...string) error {
+	return sourceMutation("delete", filePaths...)
+}
+
+func sourceMutation(op string, paths ...string) error {
+	err := &SourceMutationError{Op: op, Paths: paths}
+	if panicOnSourceMutation {
+		panic(err)
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// ReleasableObject is an object the source checkpoint references and
+// the rewritten one does not, see RewriteResult.Releasable.
+type ReleasableObject struct {
+	Name string
+	// Bytes is the size of the object as the source checkpoint tells
+	// it: that of its object entry, or else the end of the furthest
+	// block of it a row locates.
+	Bytes int64
+}
+
+func (r ReleasableObject) String() string {
+	return fmt.Sprintf("%s(%d bytes)", r.Name, r.Bytes)
+}
+
+// checkpointReferences returns the objects a row of data references, by
+// its object entry, the location of a block or the id of a block, with
+// the largest size the references tell of each, 0 if none does.
+func checkpointReferences(data *CheckpointData) map[string]int64 {
+	refs := make(map[string]int64)
+	add := func(name string, size int64) {
+		if known, ok := refs[name]; !ok || size > known {
+			refs[name] = size
+		}
+	}
+	for _, bat := range data.bats {
+		if bat == nil {
+			continue
+		}
+		for i, attr := range bat.Attrs {
+			vec := bat.Vecs[i]
+			for row := 0; row < vec.Length(); row++ {
+				if vec.IsNull(row) {
+					continue
+				}
+				switch attr {
+				case ObjectAttr_ObjectStats:
+					var stats objectio.ObjectStats
+					stats.UnMarshal(vec.Get(row).([]byte))
+					add(stats.ObjectName().String(), int64(stats.Size()))
+				case catalog.BlockMeta_MetaLoc, catalog.BlockMeta_DeltaLoc:
+					location := objectio.Location(vec.Get(row).([]byte))
+					if location.IsEmpty() {
+						continue
+					}
+					add(location.Name().String(), int64(location.Extent().End())+objectio.FooterSize)
+				case catalog.BlockMeta_ID:
+					blkID := vec.Get(row).(types.Blockid)
+					add(blkID.ObjectNameString(), 0)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// recordReleasable lists in the result the objects of source, the
+// references of the source checkpoint, that refs, those of the
+// rewritten checkpoint, do not have.
+func (o *backupOptions) recordReleasable(source, refs map[string]int64) {
+	o.result.Releasable = o.result.Releasable[:0]
+	var bytes int64
+	for name, size := range source {
+		if _, ok := refs[name]; ok {
+			continue
+		}
+		o.result.Releasable = append(o.result.Releasable, ReleasableObject{Name: name, Bytes: size})
+		bytes += size
+	}
+	sort.Slice(o.result.Releasable, func(i, j int) bool {
+		return o.result.Releasable[i].Name < o.result.Releasable[j].Name
+	})
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("releasable objects"),
+		common.AnyField("objects", len(o.result.Releasable)),
+		common.AnyField("bytes", bytes))
+}
@@ -0,0 +1,364 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+)
+
+// RewriteResult records what ReWriteCheckpointAndBlockFromKey did
+// besides the returned locations and files.
+type RewriteResult struct {
+	// SortViolations lists the passthrough blocks whose sort key
+	// column is not ordered although the block claims to be sorted.
+	// Only filled when WithVerifySort is set.
+	SortViolations []SortViolation
+	// DuplicateBlocks lists the block nums shared by more than one
+	// block of an object, which means the checkpoint is corrupted.
+	DuplicateBlocks []DuplicateBlock
+	// DuplicateBlockRows lists the block meta rows dropped because the
+	// batch lists their block again, committed later.
+	DuplicateBlockRows []DuplicateBlockRow
+	// CorruptLocations lists the block meta rows dropped because of a
+	// corrupt location. Only filled when WithLenientLocations is set.
+	CorruptLocations []*CorruptLocationError
+	// RelocatedBlocks maps the blocks of the converted aBlocks to the
+	// blocks they were converted to, and the renumbered blocks of the
+	// objects rewritten in place to their new numbers, sorted by source
+	// block. Only filled when WithBlockIDMapping is set.
+	RelocatedBlocks []RelocatedBlock
+	// SoftDeleteConflicts lists the objects the soft deletes passed to
+	// the rewrite disagree with the checkpoint on, sorted by object.
+	SoftDeleteConflicts []SoftDeleteConflict
+	// Footer is the name of the CheckpointFooter of the rewritten
+	// checkpoint. Only set when WithCheckpointFooter is set.
+	Footer string
+	// Manifest is the name of the RestoreManifest of the rewritten
+	// checkpoint. Only set when WithRestoreManifest is set.
+	Manifest string
+	// CheckpointEnd is the end ts stamped on the rewritten checkpoint.
+	// Only set when WithCheckpointEnd is set.
+	CheckpointEnd types.TS
+	// Partial is set when the best effort session of the rewrite
+	// skipped objects, listed in Skipped. The checkpoint references
+	// them as they were before the rewrite.
+	Partial bool
+	Skipped []SkippedObject
+	// Emptied are the objects rewritten in place whose blocks trimming
+	// left without rows, sorted by name. They are not written, the
+	// checkpoint no longer references them.
+	Emptied []string
+	// Exported are the files the converted aBlocks were exported to.
+	// Only filled when WithBlockExporter is set.
+	Exported []string
+	// Provenance lists the objects of the source checkpoint, sorted by
+	// source name. Only filled when WithProvenance is set.
+	Provenance []ObjectProvenance
+	// AlreadyTrimmed is set when the checkpoint was already rewritten
+	// as of the ts of the rewrite and is returned as it is. Only set
+	// when WithSkipTrimmed is set.
+	AlreadyTrimmed bool
+	// RequestedTS is the ts the rewrite was asked for, EffectiveTS the
+	// one it is as of, the ts resolved against the checkpoint chain of
+	// WithCheckpointChain or else the same.
+	RequestedTS types.TS
+	EffectiveTS types.TS
+	// DeniedBlocks are the blocks WithBlockDenylist removed from the
+	// checkpoint, sorted. A denied block the checkpoint does not have
+	// is not listed.
+	DeniedBlocks []string
+	// Collected are the source objects that were gone, sorted, see
+	// WithSkipCollectedObjects.
+	Collected []string
+	// DuplicateRowIDs are the rowids an aBlock has more than once, in
+	// the order the blocks are loaded. Only filled when
+	// WithDuplicateRowIDScan is set.
+	DuplicateRowIDs []DuplicateRowID
+	// DeltaOnlyBlocks are the aBlocks the checkpoint has deletes of but
+	// not the entry of their object, sorted, see
+	// WithMaterializeDeltaOnly.
+	DeltaOnlyBlocks []string
+	// Growth compares every batch of the rewritten checkpoint with the
+	// same batch of the source, see WithGrowthLimits. The batches both
+	// have no rows of are not listed.
+	Growth []BatchGrowth
+	// HookErrors are the errors of the hooks of OnRewriteComplete that
+	// failed, in the order they ran.
+	HookErrors []string
+	// Releasable are the objects the source checkpoint references and
+	// the rewritten one does not, sorted by name, e.g. those whose
+	// blocks were all relocated or dropped. An object is listed only
+	// if no row of the rewritten checkpoint references it, by its
+	// entry, a block location or a block id. Whether another live
+	// checkpoint or a snapshot still references it is for the caller
+	// to check before handing it to GC.
+	Releasable []ReleasableObject
+
+	Stats RewriteStats
+	Files RewriteFiles
+	// Tables splits Stats.OutputBytes by table, sorted by table. A
+	// tombstone object without object entry counts for the table of
+	// its first block.
+	Tables []TableBytes
+	// SortFallbacks counts the blocks written unsorted because sorting
+	// them failed, see WithStrictSort.
+	SortFallbacks int
+
+	// Phase is the last phase the rewrite entered, see RewriteProgress.
+	Phase int
+	// WrittenObjects and WrittenBytes count the objects the rewrite
+	// wrote to the destination, the checkpoint objects excluded.
+	WrittenObjects int
+	WrittenBytes   int64
+}
+
+// RewriteAbortedError is returned when the context of the rewrite is
+// cancelled, e.g. by an operator aborting the backup. Report is the
+// result of the rewrite up to then, the journal of its session, if
+// any, is flushed before it is returned.
+type RewriteAbortedError struct {
+	Report *RewriteResult
+	// Cause is the error the rewrite stopped with.
+	Cause error
+	// FlushErr is set if the journal could not be flushed.
+	FlushErr error
+}
+
+func (e *RewriteAbortedError) Error() string {
+	msg := fmt.Sprintf("checkpoint rewrite aborted in phase %d after writing %d objects, %d bytes: %v",
+		e.Report.Phase, e.Report.WrittenObjects, e.Report.WrittenBytes, e.Cause)
+	if e.FlushErr != nil {
+		msg += fmt.Sprintf(", journal not flushed: %v", e.FlushErr)
+	}
+	return msg
+}
+
+func (e *RewriteAbortedError) Unwrap() error {
+	return e.Cause
+}
+
+func IsRewriteAborted(err error) bool {
+	var ae *RewriteAbortedError
+	return errors.As(err, &ae)
+}
+
+// RewriteFiles lists the objects the rewrite wrote to the destination
+// by what they are. Each list is sorted by name.
+type RewriteFiles struct {
+	// Rewritten are written in place of the source object of the same
+	// name, with the deleted rows removed.
+	Rewritten []string
+	// Tombstones are the Rewritten objects that hold tombstones.
+	Tombstones []string
+	// Converted are the new objects the retained appendable blocks were
+	// converted to.
+	Converted []string
+	// Checkpoint are the objects of the rewritten checkpoint, the CN and
+	// TN meta object included.
+	Checkpoint []string
+	// Meta is the CN meta object of the rewritten checkpoint, the one
+	// a restore loads it from. It is also in Checkpoint.
+	Meta string
+}
+
+// FileRole tells what a file of the rewrite holds.
+type FileRole int
+
+const (
+	FileRoleData FileRole = iota
+	FileRoleTombstone
+	FileRoleCheckpoint
+)
+
+func (r FileRole) String() string {
+	switch r {
+	case FileRoleData:
+		return "data"
+	case FileRoleTombstone:
+		return "tombstone"
+	case FileRoleCheckpoint:
+		return "checkpoint"
+	default:
+		return fmt.Sprintf("FileRole(%d)", int(r))
+	}
+}
+
+type RestoreFile struct {
+	Name string
+	Role FileRole
+}
+
+// RestoreOrder returns every file of f in the order a restore applies
+// them safely one after another: the data objects, then the tombstone
+// objects, then the checkpoint objects with Meta last, as the
+// checkpoint references all the others. Files of the same role are
+// sorted by name.
+func (f *RewriteFiles) RestoreOrder() []RestoreFile {
+	tombstones := make(map[string]struct{}, len(f.Tombstones))
+	for _, name := range f.Tombstones {
+		tombstones[name] = struct{}{}
+	}
+	data := make([]string, 0, len(f.Rewritten)+len(f.Converted))
+	for _, name := range f.Rewritten {
+		if _, ok := tombstones[name]; !ok {
+			data = append(data, name)
+		}
+	}
+	data = append(data, f.Converted...)
+	sort.Strings(data)
+
+	files := make([]RestoreFile, 0, len(data)+len(f.Tombstones)+len(f.Checkpoint))
+	for _, name := range data {
+		files = append(files, RestoreFile{Name: name, Role: FileRoleData})
+	}
+	for _, name := range f.Tombstones {
+		files = append(files, RestoreFile{Name: name, Role: FileRoleTombstone})
+	}
+	for _, name := range f.Checkpoint {
+		if name != f.Meta {
+			files = append(files, RestoreFile{Name: name, Role: FileRoleCheckpoint})
+		}
+	}
+	if f.Meta != "" {
+		files = append(files, RestoreFile{Name: f.Meta, Role: FileRoleCheckpoint})
+	}
+	return files
+}
+
+// All returns every file of f, sorted by name.
+func (f *RewriteFiles) All() []string {
+	all := make([]string, 0, len(f.Rewritten)+len(f.Converted)+len(f.Checkpoint))
+	all = append(all, f.Rewritten...)
+	all = append(all, f.Converted...)
+	all = append(all, f.Checkpoint...)
+	sort.Strings(all)
+	return all
+}
+
+func (f *RewriteFiles) sort() {
+	sort.Strings(f.Rewritten)
+	sort.Strings(f.Tombstones)
+	sort.Strings(f.Converted)
+	sort.Strings(f.Checkpoint)
+}
+
+type RewriteStats struct {
+	// InputBytes is the size of the objects referenced by the source
+	// checkpoint that the rewrite looked at.
+	InputBytes int64
+	// OutputBytes is the size of the same set of objects after the
+	// rewrite, i.e. what the rewritten checkpoint references instead.
+	OutputBytes int64
+	// TableOffsets are the rows of each table in the object info and
+	// block meta batches of the rewritten checkpoint, sorted by batch
+	// and offset. Only set when the checkpoint is written anew.
+	TableOffsets []TableOffset
+	// Moves maps every object the source checkpoint references to where
+	// it is in the rewritten checkpoint, trimmed in place, relocated to
+	// the object its aBlocks were converted to, dropped or unchanged.
+	// It is the record GC and index rebuilds go by.
+	Moves map[string]ObjectMove
+}
+
+// ReductionRatio returns the fraction of InputBytes removed by the
+// rewrite, 0.25 means the output is a quarter smaller.
+func (s *RewriteStats) ReductionRatio() float64 {
+	if s.InputBytes == 0 {
+		return 0
+	}
+	return float64(s.InputBytes-s.OutputBytes) / float64(s.InputBytes)
+}
+
+type SortViolation struct {
+	Object string
+	Block  uint16
+	// Row is the first row that is smaller than its predecessor.
+	Row int
+}
+
+func (v SortViolation) String() string {
+	return fmt.Sprintf("%s-%d row %d", v.Object, v.Block, v.Row)
+}
+
+// RelocatedBlock is an aBlock of table Table converted to the nBlock
+// Converted, under a new block id, or a block of an object rewritten in
+// place under another block number.
+type RelocatedBlock struct {
+	Table     uint64
+	Source    types.Blockid
+	Converted types.Blockid
+}
+
+func (r RelocatedBlock) String() string {
+	return fmt.Sprintf("%d: %s -> %s", r.Table, r.Source.String(), r.Converted.String())
+}
+
+// RelocatedBlockMap returns RelocatedBlocks keyed by source block. A
+// block split WithConvertedObjectRows maps to the block of its first
+// object.
+func (r *RewriteResult) RelocatedBlockMap() map[types.Blockid]types.Blockid {
+	relocated := make(map[types.Blockid]types.Blockid, len(r.RelocatedBlocks))
+	for _, block := range r.RelocatedBlocks {
+		if _, ok := relocated[block.Source]; !ok {
+			relocated[block.Source] = block.Converted
+		}
+	}
+	return relocated
+}
+
+func (r *RewriteResult) sortRelocated() {
+	sort.SliceStable(r.RelocatedBlocks, func(i, j int) bool {
+		return r.RelocatedBlocks[i].Source.Less(r.RelocatedBlocks[j].Source)
+	})
+}
+
+type DuplicateBlock struct {
+	Object string
+	Block  uint16
+}
+
+func (d DuplicateBlock) String() string {
+	return fmt.Sprintf("%s-%d", d.Object, d.Block)
+}
+
+// DuplicateRowID is a rowid the aBlock Block of table Table has at the
+// offsets Rows, see WithDuplicateRowIDScan.
+type DuplicateRowID struct {
+	Table uint64
+	Block string
+	RowID string
+	Rows  []int
+}
+
+func (d DuplicateRowID) String() string {
+	return fmt.Sprintf("%s rowid %s rows %v", d.Block, d.RowID, d.Rows)
+}
+
+type DuplicateBlockRow struct {
+	Block string
+	// Batch is the checkpoint batch of the rows, BLKMetaInsert or
+	// BLKCNMetaInsert.
+	Batch   string
+	Kept    types.TS
+	Dropped types.TS
+}
+
+func (d DuplicateBlockRow) String() string {
+	return fmt.Sprintf("%s in %s, kept %s dropped %s", d.Block, d.Batch, d.Kept.ToString(), d.Dropped.ToString())
+}
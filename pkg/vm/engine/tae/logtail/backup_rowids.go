@@ -0,0 +1,100 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithDuplicateRowIDScan checks that no rowid is twice in an aBlock the
+// rewrite loads, and lists those that are in
+// RewriteResult.DuplicateRowIDs. The deletes of a block are applied by
+// the offset of their rowid, a rowid that is twice in a block, e.g. of
+// a corrupt block, deletes the wrong row once restored.
+//
+// The rows are scanned as the blocks are loaded, before they are
+// trimmed, which costs a pass over the rowids of every aBlock. The
+// nBlocks have no rowid column, their rowids are their offsets.
+func WithDuplicateRowIDScan() BackupOption {
+	return func(o *backupOptions) {
+		o.scanRowIDs = true
+	}
+}
+
+// scanDuplicateRowIDs records the rowids that bat, the aBlock of table
+// tid at location as it is loaded, has more than once.
+func (o *backupOptions) scanDuplicateRowIDs(
+	bat *batch.Batch,
+	tid uint64,
+	location objectio.Location,
+) error {
+	if !o.scanRowIDs {
+		return nil
+	}
+	rowids := bat.Vecs[len(bat.Vecs)-appendableMetaColumns]
+	if rowids.GetType().Oid != types.T_Rowid {
+		return moerr.NewInternalErrorNoCtx("block %s: no rowid column to scan, found %s",
+			location.String(), rowids.GetType().String())
+	}
+	duplicates := findDuplicateRowIDs(rowids)
+	for _, duplicate := range duplicates {
+		duplicate.Table = tid
+		duplicate.Block = location.String()
+		o.result.DuplicateRowIDs = append(o.result.DuplicateRowIDs, duplicate)
+		o.log().Warn("[TrimObjects]", common.OperationField("duplicate rowid"),
+			common.AnyField("block", duplicate.Block),
+			common.AnyField("rowid", duplicate.RowID),
+			common.AnyField("rows", duplicate.Rows))
+		o.stats.Warn(BackupWarning{
+			Code:   WarnDuplicateRowID,
+			Block:  duplicate.Block,
+			Detail: duplicate.String(),
+		})
+	}
+	o.stats.Phase(StatsPhaseTrim).Add(StatDuplicateRowIDs, int64(len(duplicates)))
+	return nil
+}
+
+// findDuplicateRowIDs returns the rowids that are more than once in
+// rowids with their offsets, by first offset.
+func findDuplicateRowIDs(rowids *vector.Vector) []DuplicateRowID {
+	rows := make(map[types.Rowid][]int, rowids.Length())
+	var duplicated []types.Rowid
+	for i := 0; i < rowids.Length(); i++ {
+		rowid := vector.GetFixedAt[types.Rowid](rowids, i)
+		if len(rows[rowid]) == 1 {
+			duplicated = append(duplicated, rowid)
+		}
+		rows[rowid] = append(rows[rowid], i)
+	}
+	duplicates := make([]DuplicateRowID, 0, len(duplicated))
+	for _, rowid := range duplicated {
+		duplicates = append(duplicates, DuplicateRowID{
+			RowID: rowid.String(),
+			Rows:  rows[rowid],
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Rows[0] < duplicates[j].Rows[0]
+	})
+	return duplicates
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// TableRowStats counts what a backup holds of a table, so that a
+// restore can check its row counts without scanning the backup.
+type TableRowStats struct {
+	Table uint64 `json:"table"`
+	// DataBlocks and DataRows are the blocks and the rows of the live
+	// data objects of the table, after the rewrite trimmed them and
+	// applied their deletes. An aBlock deleted after the backup ts is
+	// not live, the object the rewrite converted it to is.
+	DataBlocks uint64 `json:"data_blocks"`
+	DataRows   uint64 `json:"data_rows"`
+	// TombstoneBlocks and TombstoneRows are the tombstone blocks of
+	// the blocks of the live data objects and their rows.
+	TombstoneBlocks uint64 `json:"tombstone_blocks"`
+	TombstoneRows   uint64 `json:"tombstone_rows"`
+}
+
+// Rows returns the rows a restore of the table should see, the data
+// rows its tombstones do not delete.
+func (s TableRowStats) Rows() uint64 {
+	if s.TombstoneRows > s.DataRows {
+		return 0
+	}
+	return s.DataRows - s.TombstoneRows
+}
+
+// tableRowStats counts the rows of each table of data, a rewritten
+// checkpoint. The counts come from its meta batches, the object stats
+// and the delta locations carry the rows, so nothing is loaded. What
+// the rewrite filtered out is no longer in them.
+func tableRowStats(data *CheckpointData) []TableRowStats {
+	tables := make(map[uint64]*TableRowStats)
+	table := func(tid uint64) *TableRowStats {
+		if tables[tid] == nil {
+			tables[tid] = &TableRowStats{Table: tid}
+		}
+		return tables[tid]
+	}
+
+	live := make(map[types.Objectid]struct{})
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		deleteAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		if !deleteAt.IsEmpty() {
+			continue
+		}
+		var stats objectio.ObjectStats
+		stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		live[*stats.ObjectName().ObjectId()] = struct{}{}
+		stat := table(objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64))
+		stat.DataBlocks += uint64(stats.BlkCnt())
+		stat.DataRows += uint64(stats.Rows())
+	}
+
+	// The deletes of a converted aBlock are in the object it became, its
+	// tombstone is not counted. A block listed twice has its tombstone
+	// counted once.
+	tombstones := make(map[string]struct{})
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		deltaLoc := view.DeltaLoc()
+		if view.Source() != BlockMetaInsert || deltaLoc.IsEmpty() {
+			return nil
+		}
+		blkID := view.Blockid()
+		if _, ok := live[*blkID.Object()]; !ok {
+			return nil
+		}
+		if _, ok := tombstones[deltaLoc.String()]; ok {
+			return nil
+		}
+		tombstones[deltaLoc.String()] = struct{}{}
+		stat := table(view.TID())
+		stat.TombstoneBlocks++
+		stat.TombstoneRows += uint64(deltaLoc.Rows())
+		return nil
+	})
+
+	stats := make([]TableRowStats, 0, len(tables))
+	for _, stat := range tables {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Table < stats[j].Table
+	})
+	return stats
+}
+
+// RestoreCountDiff is a table whose restored rows are not what the
+// backup holds.
+type RestoreCountDiff struct {
+	Table    uint64
+	Expected uint64
+	Actual   uint64
+}
+
+// VerifyRestoreCounts compares the rows of each table a restore counted,
+// actual, with the stats of the footer of the backup. It returns the
+// tables that differ by tid, none when the restore is complete. A table
+// missing from either side counts zero rows there.
+func VerifyRestoreCounts(stats []TableRowStats, actual map[uint64]uint64) []RestoreCountDiff {
+	expected := make(map[uint64]uint64, len(stats))
+	for _, stat := range stats {
+		expected[stat.Table] += stat.Rows()
+	}
+	diffs := make([]RestoreCountDiff, 0)
+	for tid, rows := range expected {
+		if actual[tid] != rows {
+			diffs = append(diffs, RestoreCountDiff{Table: tid, Expected: rows, Actual: actual[tid]})
+		}
+	}
+	for tid, rows := range actual {
+		if _, ok := expected[tid]; !ok && rows != 0 {
+			diffs = append(diffs, RestoreCountDiff{Table: tid, Actual: rows})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Table < diffs[j].Table
+	})
+	return diffs
+}
@@ -0,0 +1,569 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/logutil"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/txn/txnbase"
+)
+
+// scanColumns are the columns of the checkpoint batches that listing
+// the entries of a checkpoint reads, the other batches and columns are
+// not needed.
+var scanColumns = []struct {
+	idx   uint16
+	attrs []string
+}{
+	{ObjectInfoIDX, []string{
+		ObjectAttr_ObjectStats,
+		EntryNode_CreateAt,
+		EntryNode_DeleteAt,
+		txnbase.SnapshotAttr_CommitTS,
+		ObjectAttr_State,
+	}},
+	{TNObjectInfoIDX, []string{
+		ObjectAttr_ObjectStats,
+		EntryNode_DeleteAt,
+	}},
+	{BLKMetaInsertIDX, []string{
+		catalog.BlockMeta_ID,
+		catalog.BlockMeta_MetaLoc,
+		catalog.BlockMeta_DeltaLoc,
+		catalog.BlockMeta_CommitTs,
+	}},
+	{BLKCNMetaInsertIDX, []string{
+		catalog.BlockMeta_ID,
+		catalog.BlockMeta_MetaLoc,
+		catalog.BlockMeta_DeltaLoc,
+		catalog.BlockMeta_CommitTs,
+	}},
+}
+
+// scanBatch holds the scanColumns of one block of a checkpoint batch.
+type scanBatch struct {
+	idx  uint16
+	rows int
+	cols map[string]*vector.Vector
+}
+
+// dataScanBatches returns the scanColumns of a loaded checkpoint.
+func dataScanBatches(data *CheckpointData) []scanBatch {
+	batches := make([]scanBatch, 0, len(scanColumns))
+	for _, batch := range scanColumns {
+		bat := data.bats[batch.idx]
+		cols := make(map[string]*vector.Vector, len(batch.attrs))
+		for _, attr := range batch.attrs {
+			cols[attr] = bat.GetVectorByName(attr).GetDownstreamVector()
+		}
+		batches = append(batches, scanBatch{idx: batch.idx, rows: bat.Length(), cols: cols})
+	}
+	return batches
+}
+
+// scanCheckpointEntries lists the objects the checkpoint at key refers
+// to: the checkpoint files, the objects and the block locations read
+// from batches, and adds the objects it drops to softDeletes. The
+// objects softDeletes already has, soft-deleted by the checkpoints
+// scanned before, are skipped with their blocks, see softDeleteLayer.
+// The returned locations do not share memory with batches.
+func scanCheckpointEntries(
+	ctx context.Context,
+	key objectio.Location,
+	files map[string]objectio.Location,
+	batches []scanBatch,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, error) {
+	locations := make([]*objectio.BackupObject, 0)
+	locations = append(locations, &objectio.BackupObject{
+		Location: key,
+		NeedCopy: true,
+	})
+	for _, location := range files {
+		locations = append(locations, &objectio.BackupObject{
+			Location: objectio.Location(bytes.Clone(location)),
+			NeedCopy: true,
+		})
+	}
+	entries, err := scanBatchEntries(ctx, batches, make(map[uint16]int), newSoftDeleteLayer(softDeletes), baseTS)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeLocations(append(locations, entries...)), nil
+}
+
+// scanBatchEntries lists the objects and block locations read from
+// batches, not normalized, but those layer skips, and adds the objects
+// it drops to layer. rows numbers the block meta rows of the batches
+// scanned so far, see forEachScanBlockMeta.
+func scanBatchEntries(
+	ctx context.Context,
+	batches []scanBatch,
+	rows map[uint16]int,
+	layer *softDeleteLayer,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, error) {
+	locations := make([]*objectio.BackupObject, 0)
+	needCopy := func(ts types.TS) bool {
+		return baseTS.IsEmpty() || ts.GreaterEq(baseTS)
+	}
+
+	for _, batch := range batches {
+		if batch.idx != ObjectInfoIDX {
+			continue
+		}
+		statsVec := batch.cols[ObjectAttr_ObjectStats]
+		for i := 0; i < batch.rows; i++ {
+			var objectStats objectio.ObjectStats
+			objectStats.UnMarshal(statsVec.GetBytesAt(i))
+			deletedAt := vector.GetFixedAt[types.TS](batch.cols[EntryNode_DeleteAt], i)
+			createAt := vector.GetFixedAt[types.TS](batch.cols[EntryNode_CreateAt], i)
+			commitAt := vector.GetFixedAt[types.TS](batch.cols[txnbase.SnapshotAttr_CommitTS], i)
+			isAblk := vector.GetFixedAt[bool](batch.cols[ObjectAttr_State], i)
+			if objectStats.Extent().End() == 0 {
+				panic(fmt.Sprintf("object %v Extent not empty", objectStats.ObjectName().String()))
+			}
+			if deletedAt.IsEmpty() && isAblk {
+				panic(fmt.Sprintf("object %v is not deleted", objectStats.ObjectName().String()))
+			}
+			skip, err := layer.skip(ctx, objectStats.ObjectName())
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+			locations = append(locations, &objectio.BackupObject{
+				Location: objectStats.ObjectLocation(),
+				CrateTS:  createAt,
+				DropTS:   deletedAt,
+				NeedCopy: needCopy(createAt) || needCopy(commitAt),
+			})
+			if !deletedAt.IsEmpty() {
+				if _, err := layer.add(ctx, objectStats.ObjectName()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, batch := range batches {
+		if batch.idx != TNObjectInfoIDX {
+			continue
+		}
+		statsVec := batch.cols[ObjectAttr_ObjectStats]
+		for i := 0; i < batch.rows; i++ {
+			var objectStats objectio.ObjectStats
+			objectStats.UnMarshal(statsVec.GetBytesAt(i))
+			deletedAt := vector.GetFixedAt[types.TS](batch.cols[EntryNode_DeleteAt], i)
+			if objectStats.Extent().End() > 0 {
+				panic(any(fmt.Sprintf("extent end is not 0: %v, name is %v", objectStats.Extent().End(), objectStats.ObjectName().String())))
+			}
+			if !deletedAt.IsEmpty() {
+				panic(any(fmt.Sprintf("deleteAt is not empty: %v, name is %v", deletedAt.ToString(), objectStats.ObjectName().String())))
+			}
+		}
+	}
+
+	scanned := make(map[uint16]int, len(rows))
+	for idx, n := range rows {
+		scanned[idx] = n
+	}
+	err := forEachScanBlockMeta(batches, scanned, func(view BlockMetaView) error {
+		if err := validateBlockMeta(view); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEachScanBlockMeta(batches, rows, func(view BlockMetaView) error {
+		deltaLoc := view.DeltaLoc()
+		commitTS := view.CommitTs()
+		if layer != nil {
+			if skip, err := layer.skip(ctx, blockObjectName(view)); err != nil || skip {
+				return err
+			}
+		}
+		if view.Source() == BlockMetaCN {
+			metaLoc := view.MetaLoc()
+			if !metaLoc.IsEmpty() {
+				added, err := layer.add(ctx, metaLoc.Name())
+				if err != nil {
+					return err
+				}
+				if added {
+					//Fixme:The objectlist has updated this object to the cropped object,
+					// and the expired object in the soft-deleted blocklist has not been processed.
+					logutil.Warnf("block %v metaLoc is not deleted", metaLoc.String())
+				}
+			}
+			if deltaLoc.IsEmpty() {
+				panic(fmt.Sprintf("block %v deltaLoc is empty", deltaLoc.String()))
+			}
+		} else if deltaLoc.IsEmpty() {
+			panic(fmt.Sprintf("block %v deltaLoc is empty", view.MetaLoc().String()))
+		}
+		locations = append(locations, &objectio.BackupObject{
+			Location: objectio.Location(bytes.Clone(deltaLoc)),
+			CrateTS:  commitTS,
+			NeedCopy: needCopy(commitTS),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// blockObjectName returns the name of the object of the block of view.
+func blockObjectName(view BlockMetaView) objectio.ObjectName {
+	if metaLoc := view.MetaLoc(); !metaLoc.IsEmpty() {
+		return metaLoc.Name()
+	}
+	blkID := view.Blockid()
+	return objectio.BuildObjectNameWithObjectID(blkID.Object())
+}
+
+// checkpointScanner decodes the scanColumns of checkpoints into
+// vectors it keeps from one checkpoint to the next. The vectors point
+// into the read buffers, which are released once a checkpoint is
+// scanned.
+type checkpointScanner struct {
+	sync.Mutex
+	vecs []*vector.Vector
+	used int
+}
+
+func (sc *checkpointScanner) vector() *vector.Vector {
+	if sc.used == len(sc.vecs) {
+		sc.vecs = append(sc.vecs, vector.NewVec(types.Type{}))
+	}
+	vec := sc.vecs[sc.used]
+	sc.used++
+	return vec
+}
+
+// scanColumnIdxs returns the positions and types of attrs in the batch
+// idx of version, false if the version does not have them all.
+func scanColumnIdxs(version uint32, idx uint16, attrs []string) ([]uint16, []types.Type, bool) {
+	item := checkpointDataReferVersions[version][idx]
+	if item == nil {
+		return nil, nil, false
+	}
+	idxs := make([]uint16, 0, len(attrs))
+	typs := make([]types.Type, 0, len(attrs))
+	for _, attr := range attrs {
+		pos := -1
+		for i, name := range item.attrs {
+			if name == attr {
+				pos = i
+				break
+			}
+		}
+		if pos < 0 {
+			return nil, nil, false
+		}
+		idxs = append(idxs, uint16(pos))
+		typs = append(typs, item.types[pos])
+	}
+	return idxs, typs, true
+}
+
+// scanColumnsIdxs returns the positions and types of scanColumns in the
+// batches of version, false if it cannot be read column by column.
+func scanColumnsIdxs(version uint32) ([][]uint16, [][]types.Type, bool) {
+	if version <= CheckpointVersion4 {
+		return nil, nil, false
+	}
+	idxs := make([][]uint16, len(scanColumns))
+	typs := make([][]types.Type, len(scanColumns))
+	for i, batch := range scanColumns {
+		var ok bool
+		if idxs[i], typs[i], ok = scanColumnIdxs(version, batch.idx, batch.attrs); !ok {
+			return nil, nil, false
+		}
+	}
+	return idxs, typs, true
+}
+
+// loadScanMeta reads the meta batch of the checkpoint at location, the
+// returned data only has the locations of its files. The meta batch is
+// small and replayMetaBatch needs all of it.
+func loadScanMeta(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+) (*CheckpointData, error) {
+	data := &CheckpointData{
+		sid:       sid,
+		meta:      make(map[uint64]*CheckpointMeta),
+		allocator: common.CheckpointAllocator,
+	}
+	reader, err := blockio.NewObjectReader(sid, fs, location)
+	if err != nil {
+		return nil, err
+	}
+	item := checkpointDataReferVersions[version][MetaIDX]
+	metaBats, err := LoadBlkColumnsByMeta(
+		version, ctx, item.types, item.attrs, uint16(0), reader, data.allocator)
+	if err != nil {
+		return nil, err
+	}
+	data.bats[MetaIDX] = metaBats[0]
+	if err = data.replayMetaBatch(version); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// scanFile reads the scanColumns of the checkpoint file at file, idxs
+// and typs are those of scanColumnsIdxs. The read buffers are appended
+// to ioVecs, for the caller to release once the batches are scanned.
+func (sc *checkpointScanner) scanFile(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	file objectio.Location,
+	idxs [][]uint16,
+	typs [][]types.Type,
+	ioVecs *[]*fileservice.IOVector,
+) ([]scanBatch, error) {
+	reader, err := blockio.NewObjectReader(sid, fs, file)
+	if err != nil {
+		return nil, err
+	}
+	batches := make([]scanBatch, 0)
+	for i, batch := range scanColumns {
+		blocks, err := reader.GetObjectReader().ReadSubBlock(ctx, idxs[i], typs[i], batch.idx, nil)
+		*ioVecs = append(*ioVecs, blocks...)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			cols := make(map[string]*vector.Vector, len(batch.attrs))
+			rows := 0
+			for j, attr := range batch.attrs {
+				vec := sc.vector()
+				buf := block.Entries[j].CachedData.Bytes()
+				if err = vec.UnmarshalBinary(buf[objectio.IOEntryHeaderSize:]); err != nil {
+					return nil, err
+				}
+				cols[attr] = vec
+				rows = vec.Length()
+			}
+			batches = append(batches, scanBatch{idx: batch.idx, rows: rows, cols: cols})
+		}
+	}
+	return batches, nil
+}
+
+func releaseIOVectors(ioVecs []*fileservice.IOVector) {
+	for _, ioVec := range ioVecs {
+		objectio.ReleaseIOVector(ioVec)
+	}
+}
+
+// scanCheckpoint reads the scanColumns of the checkpoint at location
+// and lists its entries, it returns false if version cannot be read
+// column by column.
+func (sc *checkpointScanner) scanCheckpoint(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, bool, error) {
+	idxs, typs, ok := scanColumnsIdxs(version)
+	if !ok {
+		return nil, false, nil
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+	sc.used = 0
+	var ioVecs []*fileservice.IOVector
+	defer func() {
+		releaseIOVectors(ioVecs)
+	}()
+
+	data, err := loadScanMeta(ctx, sid, fs, location, version)
+	if err != nil {
+		return nil, true, err
+	}
+	defer data.Close()
+
+	batches := make([]scanBatch, 0)
+	for _, file := range data.locations {
+		fileBatches, err := sc.scanFile(ctx, sid, fs, file, idxs, typs, &ioVecs)
+		if err != nil {
+			return nil, true, err
+		}
+		batches = append(batches, fileBatches...)
+	}
+	locations, err := scanCheckpointEntries(ctx, location, data.locations, batches, softDeletes, baseTS)
+	return locations, true, err
+}
+
+// ScanCheckpointEntries lists the entries of the checkpoint at location
+// as LoadCheckpointEntriesFromKey does, without loading its data. Only
+// the columns the listing reads are decoded, into vectors the session
+// reuses for the next checkpoint of the chain. Checkpoints of versions
+// that cannot be read column by column are loaded in full.
+func (s *BackupSession) ScanCheckpointEntries(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) ([]*objectio.BackupObject, error) {
+	locations, ok, err := s.scanner.scanCheckpoint(ctx, sid, fs, location, version, softDeletes, baseTS)
+	if ok || err != nil {
+		return locations, err
+	}
+	return ListCheckpointEntriesFromKey(ctx, sid, fs, location, version, softDeletes, baseTS)
+}
+
+// loadScanFile reads the scanColumns of the checkpoint file at file and
+// appends them to the batches of data, idxs and typs are those of
+// scanColumnsIdxs. Unlike scanFile, the columns are copied into vectors
+// allocated from the allocator of data, they outlive the read buffers.
+func (data *CheckpointData) loadScanFile(
+	ctx context.Context,
+	fs fileservice.FileService,
+	file objectio.Location,
+	idxs [][]uint16,
+	typs [][]types.Type,
+) error {
+	reader, err := blockio.NewObjectReader(data.sid, fs, file)
+	if err != nil {
+		return err
+	}
+	for i, batch := range scanColumns {
+		blocks, release, err := reader.LoadSubColumns(ctx, idxs[i], typs[i], batch.idx, nil)
+		if err == nil {
+			err = data.appendScanBlocks(batch.idx, batch.attrs, typs[i], blocks)
+		}
+		if release != nil {
+			release()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendScanBlocks appends the columns attrs of blocks, read from the
+// batch idx, to that batch of data. The batch only has attrs.
+func (data *CheckpointData) appendScanBlocks(
+	idx uint16,
+	attrs []string,
+	typs []types.Type,
+	blocks []*batch.Batch,
+) error {
+	if data.bats[idx] == nil {
+		bat := containers.NewBatch()
+		for j, attr := range attrs {
+			bat.AddVector(attr, containers.MakeVector(typs[j], data.allocator))
+		}
+		data.bats[idx] = bat
+	}
+	bat := data.bats[idx]
+	for _, block := range blocks {
+		for j, attr := range attrs {
+			vec := block.Vecs[j]
+			if typ := vec.GetType(); typ.Oid != typs[j].Oid {
+				return moerr.NewInternalErrorNoCtx("column %s of checkpoint batch %d is %s, expected %s",
+					attr, idx, typ.String(), typs[j].String())
+			}
+			if err := checkColumn(vec); err != nil {
+				return moerr.NewInternalErrorNoCtx("column %s of checkpoint batch %d: %v", attr, idx, err)
+			}
+		}
+		for j := range attrs {
+			if err := bat.Vecs[j].ExtendVec(block.Vecs[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadCheckpointLocationEntries lists the entries of the checkpoint at
+// location as LoadCheckpointEntriesFromKey does, loading only what the
+// listing reads: the locations of the checkpoint files and the
+// scanColumns. The other batches of the returned data are nil, and the
+// loaded ones only have the scanColumns, Close frees them. Checkpoints
+// of versions that cannot be read column by column are loaded in full.
+func LoadCheckpointLocationEntries(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	softDeletes *SoftDeletes,
+	baseTS *types.TS,
+) (locations []*objectio.BackupObject, data *CheckpointData, err error) {
+	idxs, typs, ok := scanColumnsIdxs(version)
+	if !ok {
+		return LoadCheckpointEntriesFromKey(ctx, sid, fs, location, version, softDeletes, baseTS)
+	}
+	if data, err = loadScanMeta(ctx, sid, fs, location, version); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			data.Close()
+			locations, data = nil, nil
+		}
+	}()
+	for _, file := range data.locations {
+		if err = data.loadScanFile(ctx, fs, file, idxs, typs); err != nil {
+			return
+		}
+	}
+	if locations, err = scanCheckpointEntries(
+		ctx, location, data.locations, dataScanBatches(data), softDeletes, baseTS); err != nil {
+		return
+	}
+	data.provenance, err = loadCheckpointProvenance(ctx, fs, location)
+	return
+}
@@ -0,0 +1,544 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"go.uber.org/zap"
+)
+
+// QuotaExceededError is returned when a BackupSession stops because
+// its quota is used up. It is not a failure: everything written so far
+// is recorded in the journal and the next session with the same
+// journal continues from there.
+type QuotaExceededError struct {
+	Bytes   int64
+	Objects int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("backup quota exceeded: %d bytes, %d objects written",
+		e.Bytes, e.Objects)
+}
+
+func IsQuotaExceeded(err error) bool {
+	var qe *QuotaExceededError
+	return errors.As(err, &qe)
+}
+
+// JournalEntry is what is needed to reference an object that was
+// written by an earlier session without writing it again.
+type JournalEntry struct {
+	Name   []byte   `json:"name"`
+	Extent []byte   `json:"extent"`
+	Rows   []uint32 `json:"rows"`
+	Stats  []byte   `json:"stats"`
+	Size   int64    `json:"size"`
+}
+
+type BackupJournal struct {
+	Objects map[string]*JournalEntry `json:"objects"`
+}
+
+// writtenObject describes an object written to dstFs, either by this
+// session or by an earlier one recorded in the journal.
+type writtenObject struct {
+	name   objectio.ObjectName
+	extent objectio.Extent
+	rows   []uint32
+	stats  objectio.ObjectStats
+}
+
+func (o *writtenObject) location(id uint16) objectio.Location {
+	return objectio.BuildLocation(o.name, o.extent, o.rows[id], id)
+}
+
+func (o *writtenObject) size() int64 {
+	return int64(o.extent.End()) + objectio.FooterSize
+}
+
+func (o *writtenObject) toEntry() *JournalEntry {
+	return &JournalEntry{
+		Name:   o.name,
+		Extent: o.extent,
+		Rows:   o.rows,
+		Stats:  o.stats[:],
+		Size:   o.size(),
+	}
+}
+
+func (e *JournalEntry) toObject() *writtenObject {
+	o := &writtenObject{
+		name:   objectio.ObjectName(e.Name),
+		extent: objectio.Extent(e.Extent),
+		rows:   e.Rows,
+	}
+	copy(o.stats[:], e.Stats)
+	return o
+}
+
+// checkWrittenBlocks makes sure that every block written to obj has a
+// block in it, the i-th written block is referenced by its position.
+func checkWrittenBlocks(obj *writtenObject, blocks []*blockData) error {
+	if len(obj.rows) != len(blocks) {
+		return moerr.NewInternalErrorNoCtx("object %s has %d blocks, %d were written",
+			obj.name.String(), len(obj.rows), len(blocks))
+	}
+	return nil
+}
+
+// syncObject syncs the writer of the object name and collects what the
+// later phases need to reference the written blocks.
+func syncObject(ctx context.Context, writer BlockWriterLike, name objectio.ObjectName) (*writtenObject, error) {
+	blocks, extent, err := writer.Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj := &writtenObject{
+		name:   name,
+		extent: extent,
+		rows:   make([]uint32, len(blocks)),
+	}
+	for i := range blocks {
+		obj.rows[i] = blocks[i].GetRows()
+	}
+	if stats := writer.GetObjectStats(); len(stats) > int(objectio.SchemaData) {
+		obj.stats = stats[objectio.SchemaData]
+		// Writers created without a name put a placeholder into the stats.
+		objectio.SetObjectStatsObjectName(&obj.stats, name)
+	}
+	return obj, nil
+}
+
+// writtenEntryName is the name of the journal entry saveWrittenObject
+// keeps for the object name.
+func writtenEntryName(name objectio.ObjectName) string {
+	return BackupAuxName(BackupAuxWritten, name.String())
+}
+
+// saveWrittenObject persists the journal entry of obj once it is
+// complete in fs, a later rewrite reuses the object with the stats its
+// writer gave it, see loadWrittenObject. It is stamped with createdAt.
+func saveWrittenObject(
+	ctx context.Context,
+	fs fileservice.FileService,
+	obj *writtenObject,
+	createdAt types.TS,
+) error {
+	buf, err := json.Marshal(obj.toEntry())
+	if err != nil {
+		return err
+	}
+	return writeBackupAux(ctx, fs, writtenEntryName(obj.name), BackupAuxWritten, createdAt, buf)
+}
+
+// discardWrittenObject deletes the journal entry of the object name
+// before it is written again, an object whose writer dies is left
+// without one.
+func discardWrittenObject(ctx context.Context, fs fileservice.FileService, name objectio.ObjectName) error {
+	if err := fs.Delete(ctx, writtenEntryName(name)); err != nil &&
+		!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
+
+// dropWrittenEntries deletes the journal entries of the converted
+// objects names once the checkpoint that references them is written,
+// the backup does not need them. An entry left behind is only logged.
+func (o *backupOptions) dropWrittenEntries(ctx context.Context, fs fileservice.FileService, names []string) {
+	for _, name := range names {
+		err := fs.Delete(ctx, BackupAuxName(BackupAuxWritten, name))
+		if err != nil && !moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			o.log().Warn("[ReWrite Checkpoint]", common.OperationField("delete journal entry"),
+				common.AnyField("object", name), common.AnyField("error", err))
+		}
+	}
+}
+
+// loadWrittenObject reads back what syncObject returned when the data
+// object name in fs was written, from the journal entry
+// saveWrittenObject persisted. An object without its entry is reported
+// missing, it may not be complete.
+func loadWrittenObject(
+	ctx context.Context,
+	fs fileservice.FileService,
+	name objectio.ObjectName,
+) (*writtenObject, error) {
+	buf, err := readBackupAux(ctx, fs, writtenEntryName(name), BackupAuxWritten)
+	if err != nil {
+		return nil, err
+	}
+	var entry JournalEntry
+	if err = json.Unmarshal(buf, &entry); err != nil {
+		return nil, err
+	}
+	if objectio.ObjectName(entry.Name).String() != name.String() {
+		return nil, moerr.NewInternalErrorNoCtx("journal entry of %s is for %s",
+			name.String(), objectio.ObjectName(entry.Name).String())
+	}
+	stat, err := fs.StatFile(ctx, name.String())
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size != entry.Size {
+		return nil, moerr.NewInternalErrorNoCtx("object %s has %d bytes, its journal entry %d",
+			name.String(), stat.Size, entry.Size)
+	}
+	return entry.toObject(), nil
+}
+
+type SessionOption func(*BackupSession)
+
+// WithQuota limits the bytes and objects a session writes, zero
+// means unlimited.
+func WithQuota(maxBytes, maxObjects int64) SessionOption {
+	return func(s *BackupSession) {
+		s.maxBytes = maxBytes
+		s.maxObjects = maxObjects
+	}
+}
+
+// WithJournal persists the objects written by the session to the
+// journal file name on the destination, so that a later session can
+// resume.
+func WithJournal(name string) SessionOption {
+	return func(s *BackupSession) {
+		s.journalName = BackupAuxName(BackupAuxJournal, name)
+	}
+}
+
+// WithSessionStats counts the objects the session writes in stats.
+func WithSessionStats(stats *BackupStats) SessionOption {
+	return func(s *BackupSession) {
+		s.stats = stats
+	}
+}
+
+// BackupSession holds the state shared by the rewrite and the copy
+// helpers of one backup run.
+type BackupSession struct {
+	sync.Mutex
+	dstFs       fileservice.FileService
+	journalName string
+	journal     BackupJournal
+	names       *BackupNames
+	stats       *BackupStats
+	bestEffort  *BestEffort
+
+	// staging is written in place of the destinations, see
+	// WithStagingFS.
+	staging fileservice.FileService
+	// tags are attached to the files written, see WithObjectTags.
+	tags       map[string]string
+	strictTags bool
+
+	stagedWrites StagedWrites
+	staged       bool
+	// unfinalized are the objects whose staged object was not deleted,
+	// see WithStagedWrites.
+	unfinalized map[string]struct{}
+
+	maxBytes   int64
+	maxObjects int64
+	bytes      int64
+	objects    int64
+
+	scanner checkpointScanner
+
+	// hooks are called by the rewrites that succeed, see
+	// OnRewriteComplete.
+	hooks       []RewriteHook
+	strictHooks bool
+
+	// jobID and jobLogger tag what the session logs, see
+	// WithSessionJobLogger.
+	jobID     string
+	jobLogger *zap.Logger
+}
+
+func NewBackupSession(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	opts ...SessionOption,
+) (*BackupSession, error) {
+	s := &BackupSession{
+		dstFs: dstFs,
+		journal: BackupJournal{
+			Objects: make(map[string]*JournalEntry),
+		},
+		names:       NewBackupNames(),
+		unfinalized: make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.staging != nil {
+		dstFs = s.staging
+		s.dstFs = dstFs
+	}
+	var err error
+	if s.dstFs, err = s.taggedFS(s.dstFs); err != nil {
+		return nil, err
+	}
+	if s.staged = stagesWrites(s.stagedWrites, dstFs); s.staged {
+		if err := s.discardStagedWrites(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if s.journalName == "" {
+		return s, nil
+	}
+	if err := s.names.Register(s.journalName, BackupAuxJournal); err != nil {
+		return nil, err
+	}
+	buf, err := readBackupAux(ctx, dstFs, s.journalName, BackupAuxJournal)
+	if err != nil {
+		if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, &s.journal); err != nil {
+		return nil, err
+	}
+	if s.journal.Objects == nil {
+		s.journal.Objects = make(map[string]*JournalEntry)
+	}
+	s.log().Info("[BackupSession]", common.OperationField("resume"),
+		common.AnyField("journal", s.journalName),
+		common.AnyField("objects", len(s.journal.Objects)))
+	return s, nil
+}
+
+// Written returns the entry of name if an earlier session or this one
+// has already written it.
+func (s *BackupSession) Written(name string) (*JournalEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.journal.Objects[name]
+	return e, ok
+}
+
+// Names returns the registry of the files the session writes.
+func (s *BackupSession) Names() *BackupNames {
+	return s.names
+}
+
+// register records that the session writes name from source.
+func (s *BackupSession) register(name, source string) error {
+	if s == nil {
+		return nil
+	}
+	return s.names.Register(name, source)
+}
+
+func (s *BackupSession) lookup(name string) (*writtenObject, bool) {
+	if s == nil {
+		return nil, false
+	}
+	e, ok := s.Written(name)
+	if !ok {
+		return nil, false
+	}
+	return e.toObject(), true
+}
+
+// Record adds a freshly written object to the journal and charges it
+// to the quota.
+func (s *BackupSession) Record(name string, entry *JournalEntry) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.journal.Objects[name] = entry
+	s.bytes += entry.Size
+	s.objects++
+	sessionStats := s.stats.Phase(StatsPhaseSession)
+	sessionStats.Add(StatWrittenBytes, entry.Size)
+	sessionStats.Add(StatWrittenObjects, 1)
+}
+
+func (s *BackupSession) record(obj *writtenObject) {
+	if s == nil {
+		return
+	}
+	s.Record(obj.name.String(), obj.toEntry())
+}
+
+// Exceeded reports whether the quota is used up. It is checked between
+// objects, so the object in flight is always finished.
+func (s *BackupSession) Exceeded() bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return (s.maxBytes > 0 && s.bytes >= s.maxBytes) ||
+		(s.maxObjects > 0 && s.objects >= s.maxObjects)
+}
+
+// Stop persists the journal and returns the QuotaExceededError the
+// caller should return.
+func (s *BackupSession) Stop(ctx context.Context) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.log().Info("[BackupSession]", common.OperationField("quota exceeded"),
+		common.AnyField("bytes", s.bytes),
+		common.AnyField("objects", s.objects))
+	return &QuotaExceededError{
+		Bytes:   s.bytes,
+		Objects: s.objects,
+	}
+}
+
+func (s *BackupSession) Flush(ctx context.Context) error {
+	if s == nil || s.journalName == "" {
+		return nil
+	}
+	s.Lock()
+	buf, err := json.Marshal(&s.journal)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeBackupAux(ctx, s.dstFs, s.journalName, BackupAuxJournal, auxWallClock(), buf)
+}
+
+// Copy runs copyFn for name unless it was already copied, and charges
+// size to the quota. It returns a QuotaExceededError instead of
+// starting a new copy once the quota is used up, and an
+// ObjectSkippedError when a best effort session gives up on name.
+func (s *BackupSession) Copy(
+	ctx context.Context,
+	name string,
+	size int64,
+	copyFn func(ctx context.Context) error,
+) error {
+	if s == nil {
+		return copyFn(ctx)
+	}
+	if err := s.register(name, name); err != nil {
+		return err
+	}
+	if _, ok := s.Written(name); ok {
+		return nil
+	}
+	if s.Exceeded() {
+		return s.Stop(ctx)
+	}
+	if err := s.Attempt(ctx, name, copyFn); err != nil {
+		return err
+	}
+	s.Record(name, &JournalEntry{Size: size})
+	return nil
+}
+
+func readBackupFile(ctx context.Context, fs fileservice.FileService, name string) ([]byte, error) {
+	buf, err := readWholeFile(ctx, fs, name)
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		// A crash of writeBackupFile between the delete of the old
+		// version and the write of the new one left only the new one.
+		if next, nextErr := readWholeFile(ctx, fs, nextBackupFileName(name)); nextErr == nil {
+			return next, nil
+		}
+	}
+	return buf, err
+}
+
+func readWholeFile(ctx context.Context, fs fileservice.FileService, name string) ([]byte, error) {
+	iov := &fileservice.IOVector{
+		FilePath: name,
+		Entries: []fileservice.IOEntry{
+			{
+				Offset: 0,
+				Size:   -1,
+			},
+		},
+	}
+	if err := fs.Read(ctx, iov); err != nil {
+		return nil, err
+	}
+	return iov.Entries[0].Data, nil
+}
+
+// nextBackupFileName is the name the new version of the file name is
+// written under before it replaces it, see writeBackupFile.
+func nextBackupFileName(name string) string {
+	return name + ".next"
+}
+
+// writeBackupFile writes a small auxiliary file, replacing any older
+// version of it. The file service cannot rename, the new version is
+// written under nextBackupFileName first: a crash at any point leaves
+// either version whole, which readBackupFile reads.
+func writeBackupFile(ctx context.Context, fs fileservice.FileService, name string, data []byte) error {
+	next := nextBackupFileName(name)
+	_, err := fs.StatFile(ctx, name)
+	switch {
+	case err == nil:
+		if err = deleteBackupFile(ctx, fs, next); err != nil {
+			return err
+		}
+		if err = putBackupFile(ctx, fs, next, data); err != nil {
+			return err
+		}
+		if err = deleteBackupFile(ctx, fs, name); err != nil {
+			return err
+		}
+	case !moerr.IsMoErrCode(err, moerr.ErrFileNotFound):
+		return err
+	}
+	if err = putBackupFile(ctx, fs, name, data); err != nil {
+		return err
+	}
+	return deleteBackupFile(ctx, fs, next)
+}
+
+func putBackupFile(ctx context.Context, fs fileservice.FileService, name string, data []byte) error {
+	return fs.Write(ctx, fileservice.IOVector{
+		FilePath: name,
+		Entries: []fileservice.IOEntry{
+			{
+				Offset: 0,
+				Size:   int64(len(data)),
+				Data:   data,
+			},
+		},
+	})
+}
+
+// deleteBackupFile deletes the file name, if it exists.
+func deleteBackupFile(ctx context.Context, fs fileservice.FileService, name string) error {
+	if err := fs.Delete(ctx, name); err != nil &&
+		!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return err
+	}
+	return nil
+}
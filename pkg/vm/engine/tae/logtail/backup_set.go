@@ -0,0 +1,179 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BackupTableInfo is a table of a BackupSet.
+type BackupTableInfo struct {
+	ID      uint64
+	Objects int
+	Blocks  uint64
+	// Rows are the rows a restore of the table sees, see
+	// TableRowStats.Rows.
+	Rows uint64
+}
+
+// ObjectEntry is a live data object of a table of a BackupSet.
+type ObjectEntry struct {
+	Table uint64
+	Stats objectio.ObjectStats
+	// Tombstones are the tombstones of the blocks of the object, by
+	// block offset. A block without deletes has none.
+	Tombstones map[uint16]objectio.Location
+}
+
+// Name returns the name of the object.
+func (e *ObjectEntry) Name() objectio.ObjectName {
+	return e.Stats.ObjectName()
+}
+
+// Blocks returns the number of blocks of the object.
+func (e *ObjectEntry) Blocks() uint16 {
+	return uint16(e.Stats.BlkCnt())
+}
+
+// BackupSet is a read only view of a backup, the rewritten checkpoint
+// its CheckpointFooter describes and the objects it refers to, for
+// tools that read a backup without a cluster. It only reads through
+// the FileService it is opened with, which can be one that wraps how
+// the backup is stored.
+type BackupSet struct {
+	fs      fileservice.FileService
+	footer  *CheckpointFooter
+	tables  []BackupTableInfo
+	objects map[uint64][]ObjectEntry
+}
+
+// OpenBackupSet opens the backup in fs whose CheckpointFooter is
+// manifestName.
+func OpenBackupSet(ctx context.Context, fs fileservice.FileService, manifestName string) (*BackupSet, error) {
+	buf, err := readBackupFile(ctx, fs, manifestName)
+	if err != nil {
+		return nil, err
+	}
+	footer, err := DecodeCheckpointFooter(manifestName, buf)
+	if err != nil {
+		return nil, err
+	}
+	data, err := getCheckpointData(ctx, "", fs, footer.Checkpoint, footer.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	set := &BackupSet{
+		fs:      fs,
+		footer:  footer,
+		objects: make(map[uint64][]ObjectEntry),
+	}
+	// A block listed more than once has the tombstone of its last row.
+	tombstones := make(map[types.Blockid]objectio.Location)
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if deltaLoc := view.DeltaLoc(); !deltaLoc.IsEmpty() {
+			tombstones[view.Blockid()] = objectio.Location(bytes.Clone(deltaLoc))
+		}
+		return nil
+	})
+	objectInfo := data.bats[ObjectInfoIDX]
+	for i := 0; i < objectInfo.Length(); i++ {
+		deleteAt := objectInfo.GetVectorByName(EntryNode_DeleteAt).Get(i).(types.TS)
+		if !deleteAt.IsEmpty() {
+			continue
+		}
+		entry := ObjectEntry{
+			Table: objectInfo.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64),
+		}
+		entry.Stats.UnMarshal(objectInfo.GetVectorByName(ObjectAttr_ObjectStats).Get(i).([]byte))
+		for blk := uint16(0); blk < entry.Blocks(); blk++ {
+			deltaLoc, ok := tombstones[*objectio.BuildObjectBlockid(entry.Name(), blk)]
+			if !ok {
+				continue
+			}
+			if entry.Tombstones == nil {
+				entry.Tombstones = make(map[uint16]objectio.Location)
+			}
+			entry.Tombstones[blk] = deltaLoc
+		}
+		set.objects[entry.Table] = append(set.objects[entry.Table], entry)
+	}
+
+	for _, stat := range tableRowStats(data) {
+		set.tables = append(set.tables, BackupTableInfo{
+			ID:      stat.Table,
+			Objects: len(set.objects[stat.Table]),
+			Blocks:  stat.DataBlocks,
+			Rows:    stat.Rows(),
+		})
+	}
+	return set, nil
+}
+
+// Footer returns the CheckpointFooter of the backup.
+func (s *BackupSet) Footer() *CheckpointFooter {
+	return s.footer
+}
+
+// Tables returns the tables of the backup, sorted by id.
+func (s *BackupSet) Tables() []BackupTableInfo {
+	return s.tables
+}
+
+// ObjectsForTable returns the live data objects of the table tid, none
+// when the backup has no such table.
+func (s *BackupSet) ObjectsForTable(tid uint64) []ObjectEntry {
+	objects := append([]ObjectEntry(nil), s.objects[tid]...)
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name().String() < objects[j].Name().String()
+	})
+	return objects
+}
+
+// ReadBlock reads the block blkIdx of entry with the rows its tombstone
+// deletes at the ts of the backup removed.
+func (s *BackupSet) ReadBlock(ctx context.Context, entry ObjectEntry, blkIdx uint16) (*batch.Batch, error) {
+	location := objectio.BuildLocation(entry.Name(), entry.Stats.Extent(), 0, blkIdx)
+	meta, err := readObjectMeta(ctx, s.fs, location)
+	if err != nil {
+		return nil, err
+	}
+	dataMeta := meta.MustDataMeta()
+	bat, err := readBlockColumns(ctx, s.fs, &dataMeta, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	deltaLoc, ok := entry.Tombstones[blkIdx]
+	if !ok {
+		return bat, nil
+	}
+	deletes, err := loadTombstone(ctx, s.fs, deltaLoc, s.footer.BackupTS())
+	if err != nil {
+		return nil, err
+	}
+	blockID := objectio.BuildObjectBlockid(entry.Name(), blkIdx)
+	if _, _, err = applyDelete(bat, deletes, blockID.String()); err != nil {
+		return nil, err
+	}
+	return bat, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// FileSink receives the files of a backup instead of a fileservice,
+// e.g. to stream them into an archive.
+type FileSink interface {
+	WriteFile(ctx context.Context, name string, data []byte) error
+}
+
+// TarSink writes the files it receives as a tar stream to w.
+type TarSink struct {
+	tw *tar.Writer
+}
+
+func NewTarSink(w io.Writer) *TarSink {
+	return &TarSink{
+		tw: tar.NewWriter(w),
+	}
+}
+
+func (s *TarSink) WriteFile(_ context.Context, name string, data []byte) error {
+	if err := s.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	_, err := s.tw.Write(data)
+	return err
+}
+
+// Close finishes the tar stream, it does not close the underlying
+// writer.
+func (s *TarSink) Close() error {
+	return s.tw.Close()
+}
+
+// UnpackTar writes the files of a tar stream written by TarSink to fs
+// and returns their names.
+func UnpackTar(ctx context.Context, r io.Reader, fs fileservice.FileService) ([]string, error) {
+	tr := tar.NewReader(r)
+	names := make([]string, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeBackupFile(ctx, fs, header.Name, data); err != nil {
+			return nil, err
+		}
+		names = append(names, header.Name)
+	}
+}
+
+// WriteToSink is WriteTo for a sink. The checkpoint is serialized in
+// memory first, the object writer needs to seek, and then handed to
+// sink file by file, the meta file included.
+func (data *CheckpointData) WriteToSink(
+	ctx context.Context,
+	sink FileSink,
+	blockRows int,
+	checkpointSize int,
+) (CNLocation, TNLocation objectio.Location, err error) {
+	mem, err := fileservice.NewMemoryFS("checkpoint-sink", fileservice.DisabledCacheConfig, nil)
+	if err != nil {
+		return
+	}
+	CNLocation, TNLocation, _, err = data.WriteTo(mem, blockRows, checkpointSize)
+	if err != nil {
+		return
+	}
+	entries, err := mem.List(ctx, "")
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir {
+			names = append(names, entry.Name)
+		}
+	}
+	err = SinkFiles(ctx, mem, names, sink)
+	return
+}
+
+// SinkFiles hands the files names of fs to sink in name order, e.g. the
+// objects written by a rewrite into a memory fs.
+func SinkFiles(ctx context.Context, fs fileservice.FileService, names []string, sink FileSink) error {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	for _, name := range names {
+		buf, err := readBackupFile(ctx, fs, name)
+		if err != nil {
+			return err
+		}
+		if err = sink.WriteFile(ctx, name, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+)
+
+// CheckpointSpan is the range of commit ts a checkpoint of the chain
+// covers, the start and end of its checkpoint entry. The start of a
+// global checkpoint is empty, it covers everything up to its end.
+type CheckpointSpan struct {
+	Start types.TS
+	End   types.TS
+}
+
+// ResolveBackupTS returns the ts a backup requested at requested is
+// taken at: the latest end of a checkpoint of entries, at or before
+// requested, that the checkpoints up to it cover without a gap. A
+// checkpoint covers its rows up to its end, a ts within a checkpoint
+// or within a gap of the chain is not one the checkpoints hold a
+// consistent snapshot of. It fails if there is no such end, e.g. when
+// requested is before the chain.
+func ResolveBackupTS(entries []CheckpointSpan, requested types.TS) (types.TS, error) {
+	sorted := append([]CheckpointSpan(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].End.Less(&sorted[j].End)
+	})
+	var (
+		resolved types.TS
+		covered  bool
+		end      types.TS
+	)
+	for _, entry := range sorted {
+		if entry.End.Greater(&requested) {
+			break
+		}
+		// A global checkpoint starts the chain over, an incremental one
+		// continues it if it starts right after the end of the last.
+		next := end.Next()
+		covered = entry.Start.IsEmpty() || covered && entry.Start.LessEq(&next)
+		end = entry.End
+		if covered {
+			resolved = end
+		}
+	}
+	if resolved.IsEmpty() {
+		return types.TS{}, moerr.NewInvalidInputNoCtx(
+			"no checkpoint of the chain ends at a consistent ts at or before %s", requested.ToString())
+	}
+	return resolved, nil
+}
+
+// WithCheckpointChain gives the rewrite the checkpoint chain the
+// checkpoint it rewrites is taken from. The ts of the rewrite is then
+// resolved against it with ResolveBackupTS, unless WithExactBackupTS
+// is set, and the rewrite is as of the ts resolved.
+// RewriteResult.RequestedTS and RewriteResult.EffectiveTS record both.
+func WithCheckpointChain(entries []CheckpointSpan) BackupOption {
+	return func(o *backupOptions) {
+		o.chain = entries
+	}
+}
+
+// WithExactBackupTS rewrites as of the ts passed to the rewrite even
+// if the checkpoint chain of WithCheckpointChain resolves it to another.
+func WithExactBackupTS() BackupOption {
+	return func(o *backupOptions) {
+		o.exactTS = true
+	}
+}
+
+// resolveTS returns the ts the rewrite requested at ts is as of, and
+// records both in the result.
+func (o *backupOptions) resolveTS(ts types.TS) (types.TS, error) {
+	o.result.RequestedTS = ts
+	if o.chain != nil && !o.exactTS {
+		resolved, err := ResolveBackupTS(o.chain, ts)
+		if err != nil {
+			return types.TS{}, err
+		}
+		ts = resolved
+	}
+	o.result.EffectiveTS = ts
+	return ts, nil
+}
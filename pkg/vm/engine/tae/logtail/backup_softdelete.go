@@ -0,0 +1,229 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+const (
+	softDeleteShards = 64
+	// softDeleteEntrySize is the approximate memory of one entry of a
+	// shard map, the short name plus the map overhead.
+	softDeleteEntrySize = int64(objectio.ObjectNameShortLen + 14)
+)
+
+// SoftDeletes is the set of soft-deleted objects collected across the
+// checkpoints of a backup chain.
+//
+// Objects are keyed by their short name and hashed into shards. When
+// spilling is enabled and MemUsage goes over the budget, the least
+// recently used shards are written to the spill fs and read back the
+// next time they are needed.
+type SoftDeletes struct {
+	fs     fileservice.FileService
+	dir    string
+	budget int64
+
+	shards [softDeleteShards]softDeleteShard
+	tick   uint64
+	len    int
+	inMem  int
+}
+
+type softDeleteShard struct {
+	names    map[objectio.ObjectNameShort]struct{}
+	spilled  bool
+	lastUsed uint64
+}
+
+type SoftDeletesOption func(*SoftDeletes)
+
+// WithSoftDeletesSpill spills shards to the auxiliary files of dir on
+// fs once the set uses more than budget bytes.
+func WithSoftDeletesSpill(fs fileservice.FileService, dir string, budget int64) SoftDeletesOption {
+	return func(s *SoftDeletes) {
+		s.fs = fs
+		s.dir = dir
+		s.budget = budget
+	}
+}
+
+func NewSoftDeletes(opts ...SoftDeletesOption) *SoftDeletes {
+	s := &SoftDeletes{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for i := range s.shards {
+		s.shards[i].names = make(map[objectio.ObjectNameShort]struct{})
+	}
+	return s
+}
+
+// Add marks name as soft-deleted and reports whether it was not yet.
+func (s *SoftDeletes) Add(ctx context.Context, name objectio.ObjectName) (bool, error) {
+	key := *name.Short()
+	shard, err := s.load(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := shard.names[key]; ok {
+		return false, nil
+	}
+	shard.names[key] = struct{}{}
+	s.len++
+	s.inMem++
+	return true, s.spill(ctx)
+}
+
+func (s *SoftDeletes) Contains(ctx context.Context, name objectio.ObjectName) (bool, error) {
+	key := *name.Short()
+	shard, err := s.load(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	_, ok := shard.names[key]
+	return ok, s.spill(ctx)
+}
+
+// Len returns the number of objects in the set, spilled or not.
+func (s *SoftDeletes) Len() int {
+	return s.len
+}
+
+// MemUsage returns the approximate memory used by the shards that are
+// not spilled.
+func (s *SoftDeletes) MemUsage() int64 {
+	return int64(s.inMem) * softDeleteEntrySize
+}
+
+func (s *SoftDeletes) load(ctx context.Context, key objectio.ObjectNameShort) (*softDeleteShard, error) {
+	h := fnv.New32a()
+	h.Write(key[:])
+	idx := h.Sum32() % softDeleteShards
+	shard := &s.shards[idx]
+	s.tick++
+	shard.lastUsed = s.tick
+	if !shard.spilled {
+		return shard, nil
+	}
+	buf, err := readBackupAux(ctx, s.fs, s.shardName(idx), BackupAuxSoftDeletes)
+	if err != nil {
+		return nil, err
+	}
+	shard.names = make(map[objectio.ObjectNameShort]struct{}, len(buf)/objectio.ObjectNameShortLen)
+	for off := 0; off+objectio.ObjectNameShortLen <= len(buf); off += objectio.ObjectNameShortLen {
+		var name objectio.ObjectNameShort
+		copy(name[:], buf[off:])
+		shard.names[name] = struct{}{}
+	}
+	shard.spilled = false
+	s.inMem += len(shard.names)
+	return shard, nil
+}
+
+// spill writes out the least recently used shards until the set fits
+// its budget again. The shard used last is never spilled.
+func (s *SoftDeletes) spill(ctx context.Context) error {
+	if s.fs == nil || s.budget <= 0 {
+		return nil
+	}
+	for s.MemUsage() > s.budget {
+		victim := -1
+		for i := range s.shards {
+			shard := &s.shards[i]
+			if shard.spilled || len(shard.names) == 0 || shard.lastUsed == s.tick {
+				continue
+			}
+			if victim < 0 || shard.lastUsed < s.shards[victim].lastUsed {
+				victim = i
+			}
+		}
+		if victim < 0 {
+			return nil
+		}
+		shard := &s.shards[victim]
+		buf := make([]byte, 0, len(shard.names)*objectio.ObjectNameShortLen)
+		for name := range shard.names {
+			buf = append(buf, name[:]...)
+		}
+		if err := writeBackupAux(ctx, s.fs, s.shardName(uint32(victim)), BackupAuxSoftDeletes,
+			auxWallClock(), buf); err != nil {
+			return err
+		}
+		jobLogger(ctx).Debug("[SoftDeletes]", common.OperationField("spill"),
+			common.AnyField("shard", victim),
+			common.AnyField("objects", len(shard.names)))
+		s.inMem -= len(shard.names)
+		shard.names = nil
+		shard.spilled = true
+	}
+	return nil
+}
+
+func (s *SoftDeletes) shardName(idx uint32) string {
+	return BackupAuxName(BackupAuxSoftDeletes, path.Join(s.dir, fmt.Sprintf("shard-%d", idx)))
+}
+
+// softDeleteLayer is the soft deletes of the scan of a checkpoint on top
+// of those of the checkpoints scanned before it, both in the same
+// SoftDeletes. The objects the set had before the scan are skipped, the
+// ones the scan adds are this checkpoint's own and still listed however
+// many of its rows refer to them. A nil layer neither skips nor adds.
+type softDeleteLayer struct {
+	softDeletes *SoftDeletes
+	own         map[objectio.ObjectNameShort]struct{}
+}
+
+func newSoftDeleteLayer(softDeletes *SoftDeletes) *softDeleteLayer {
+	if softDeletes == nil {
+		return nil
+	}
+	return &softDeleteLayer{
+		softDeletes: softDeletes,
+		own:         make(map[objectio.ObjectNameShort]struct{}),
+	}
+}
+
+// skip reports whether name was soft-deleted by an earlier checkpoint.
+func (l *softDeleteLayer) skip(ctx context.Context, name objectio.ObjectName) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	if _, ok := l.own[*name.Short()]; ok {
+		return false, nil
+	}
+	return l.softDeletes.Contains(ctx, name)
+}
+
+// add marks name as soft-deleted by this checkpoint and reports whether
+// it was not yet.
+func (l *softDeleteLayer) add(ctx context.Context, name objectio.ObjectName) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	added, err := l.softDeletes.Add(ctx, name)
+	if added {
+		l.own[*name.Short()] = struct{}{}
+	}
+	return added, err
+}
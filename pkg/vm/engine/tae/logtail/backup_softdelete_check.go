@@ -0,0 +1,151 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// SoftDeleteConflictKind says how the soft deletes passed to the
+// rewrite disagree with the checkpoint.
+type SoftDeleteConflictKind int
+
+const (
+	// SoftDeleteOfLiveObject is an object the soft deletes mark deleted
+	// that the checkpoint lists live, e.g. the map is over-eager.
+	SoftDeleteOfLiveObject SoftDeleteConflictKind = iota
+	// SoftDeleteMissing is an object the checkpoint drops that the soft
+	// deletes do not mark deleted, e.g. the map is stale.
+	SoftDeleteMissing
+)
+
+func (k SoftDeleteConflictKind) String() string {
+	switch k {
+	case SoftDeleteOfLiveObject:
+		return "soft deleted but live"
+	case SoftDeleteMissing:
+		return "dropped but not soft deleted"
+	default:
+		return fmt.Sprintf("SoftDeleteConflictKind(%d)", int(k))
+	}
+}
+
+type SoftDeleteConflict struct {
+	Object string
+	Kind   SoftDeleteConflictKind
+}
+
+func (c SoftDeleteConflict) String() string {
+	return fmt.Sprintf("%s: %s", c.Object, c.Kind)
+}
+
+// SoftDeleteConflictError is returned with WithStrictSoftDeletes when
+// the soft deletes passed to the rewrite disagree with the checkpoint.
+type SoftDeleteConflictError struct {
+	Conflicts []SoftDeleteConflict
+}
+
+func (e *SoftDeleteConflictError) Error() string {
+	return fmt.Sprintf("soft deletes disagree with the checkpoint on %d objects, first %s",
+		len(e.Conflicts), e.Conflicts[0].String())
+}
+
+func IsSoftDeleteConflict(err error) bool {
+	var ce *SoftDeleteConflictError
+	return errors.As(err, &ce)
+}
+
+// checkSoftDeletes compares softDeletes with what data drops: the
+// deleted objects of its object entries and the objects of the blocks
+// CN wrote. The conflicts are reported in the result and as warnings,
+// with WithStrictSoftDeletes they fail the rewrite.
+func (o *backupOptions) checkSoftDeletes(
+	ctx context.Context,
+	data *CheckpointData,
+	softDeletes *SoftDeletes,
+) error {
+	if softDeletes == nil {
+		return nil
+	}
+	dropped := make(map[objectio.ObjectNameShort]bool)
+	names := make(map[objectio.ObjectNameShort]objectio.ObjectName)
+	objectInfo := data.bats[ObjectInfoIDX]
+	statsVec := objectInfo.GetVectorByName(ObjectAttr_ObjectStats)
+	deleteVec := objectInfo.GetVectorByName(EntryNode_DeleteAt)
+	for i := 0; i < objectInfo.Length(); i++ {
+		var stats objectio.ObjectStats
+		stats.UnMarshal(statsVec.Get(i).([]byte))
+		deletedAt := deleteVec.Get(i).(types.TS)
+		name := stats.ObjectName()
+		key := *name.Short()
+		names[key] = name
+		// An object is dropped if any of its entries drops it.
+		dropped[key] = dropped[key] || !deletedAt.IsEmpty()
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		metaLoc := view.MetaLoc()
+		if view.Source() != BlockMetaCN || metaLoc.IsEmpty() {
+			return nil
+		}
+		key := *metaLoc.Name().Short()
+		names[key] = metaLoc.Name()
+		dropped[key] = true
+		return nil
+	})
+
+	var conflicts []SoftDeleteConflict
+	for key, isDropped := range dropped {
+		softDeleted, err := softDeletes.Contains(ctx, names[key])
+		if err != nil {
+			return err
+		}
+		if softDeleted == isDropped {
+			continue
+		}
+		kind := SoftDeleteMissing
+		if softDeleted {
+			kind = SoftDeleteOfLiveObject
+		}
+		conflicts = append(conflicts, SoftDeleteConflict{Object: names[key].String(), Kind: kind})
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Object < conflicts[j].Object
+	})
+	for _, conflict := range conflicts {
+		o.log().Warn("[ReWriteCheckpoint]", common.OperationField("soft delete conflict"),
+			common.AnyField("object", conflict.Object),
+			common.AnyField("conflict", conflict.Kind.String()))
+		o.stats.Warn(BackupWarning{
+			Code:   WarnSoftDeleteConflict,
+			Object: conflict.Object,
+			Detail: conflict.Kind.String(),
+		})
+	}
+	o.result.SoftDeleteConflicts = conflicts
+	if o.strictSoftDeletes {
+		return &SoftDeleteConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// ReWriteCheckpointAndBlockFromData is ReWriteCheckpointAndBlockFromKey
+// with data, the checkpoint of version at loc the caller loaded already,
+// e.g. with LoadCheckpointEntriesFromKey, in place of loading it again.
+// The objects data refers to are still read from fs. The version and ts
+// are checked as they are for a checkpoint loaded from loc.
+//
+// The rewrite takes data over, it changes it and closes it however it
+// ends. With keepSource, it rewrites a copy of data instead and leaves
+// data to the caller.
+//
+// loc is returned when the rewrite does not change the checkpoint, data
+// built in memory has no location and is written all the same.
+func ReWriteCheckpointAndBlockFromData(
+	ctx context.Context,
+	sid string,
+	fs, dstFs fileservice.FileService,
+	data *CheckpointData,
+	keepSource bool,
+	loc, tnLocation objectio.Location,
+	version uint32, ts types.TS,
+	softDeletes *SoftDeletes,
+	opts ...BackupOption,
+) (objectio.Location, objectio.Location, []string, error) {
+	if keepSource {
+		data = cloneCheckpointData(data)
+	}
+	options := newBackupOptions(opts...)
+	cnLocation, tnLocation, files, err := reWriteCheckpointAndBlockFromKey(ctx, sid, fs, dstFs,
+		loc, tnLocation, version, ts, softDeletes, data, options)
+	if err != nil && ctx.Err() != nil {
+		err = options.abort(ctx, err)
+	}
+	if err == nil {
+		err = options.runRewriteHooks(ctx)
+	}
+	options.observer.OnComplete(options.result, err)
+	return cnLocation, tnLocation, files, err
+}
+
+// cloneCheckpointData returns a deep copy of data, its batches on the
+// checkpoint allocator.
+func cloneCheckpointData(data *CheckpointData) *CheckpointData {
+	cloned := NewCheckpointData(data.sid, common.CheckpointAllocator)
+	cloned.compression = data.compression
+	cloned.provenance = data.provenance
+	for idx, bat := range data.bats {
+		if bat == nil {
+			continue
+		}
+		cloned.bats[idx].Close()
+		cloned.bats[idx] = bat.CloneWindow(0, bat.Length(), common.CheckpointAllocator)
+	}
+	for tid, meta := range data.meta {
+		clonedMeta := NewCheckpointMeta()
+		for i, table := range meta.tables {
+			if table == nil {
+				continue
+			}
+			clonedTable := *table
+			clonedTable.locations = append(BlockLocations(nil), table.locations...)
+			clonedMeta.tables[i] = &clonedTable
+		}
+		cloned.meta[tid] = clonedMeta
+	}
+	if data.locations != nil {
+		cloned.locations = make(map[string]objectio.Location, len(data.locations))
+		for name, location := range data.locations {
+			cloned.locations[name] = location
+		}
+	}
+	return cloned
+}
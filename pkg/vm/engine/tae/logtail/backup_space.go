@@ -0,0 +1,111 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// SpaceReporter is implemented by a FileService that can tell how many
+// bytes can still be written to it, e.g. a fileservice.LocalFS.
+type SpaceReporter interface {
+	AvailableSpace(ctx context.Context) (int64, error)
+}
+
+// InsufficientSpaceError is returned by a rewrite with
+// WithFreeSpaceCheck when the destination has less space available
+// than the rewrite is estimated to write. Nothing is written then.
+type InsufficientSpaceError struct {
+	// Required is the estimate with the reserve, Available what the
+	// destination reported.
+	Required  int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("insufficient space in the backup destination: %d bytes required, %d available",
+		e.Required, e.Available)
+}
+
+func IsInsufficientSpace(err error) bool {
+	var se *InsufficientSpaceError
+	return errors.As(err, &se)
+}
+
+// WithFreeSpaceCheck checks, before anything is written, that the
+// destination has the space for what the rewrite is estimated to
+// write, RewritePlan.EstimatedBytes, and reserve bytes more, e.g. for
+// the checkpoint itself. A destination that is not a SpaceReporter is
+// not checked.
+func WithFreeSpaceCheck(reserve int64) BackupOption {
+	return func(o *backupOptions) {
+		o.checkSpace = true
+		o.spaceReserve = reserve
+	}
+}
+
+// estimateRewriteBytes returns an upper bound of the bytes the rewrite
+// writes for the trimmed objectsData: the size of the source objects it
+// rewrites or relocates. The trim only makes them smaller.
+func estimateRewriteBytes(objectsData map[string]*fileData) int64 {
+	var estimate int64
+	for _, objectData := range objectsData {
+		switch planObject(objectData) {
+		case plannedRewrite, plannedRelocate:
+			estimate += objectData.size()
+		}
+	}
+	return estimate
+}
+
+// checkFreeSpace fails with an InsufficientSpaceError when dstFs has
+// less space than the rewrite of objectsData needs, with
+// WithFreeSpaceCheck.
+func (o *backupOptions) checkFreeSpace(
+	ctx context.Context,
+	dstFs fileservice.FileService,
+	objectsData map[string]*fileData,
+) error {
+	if !o.checkSpace {
+		return nil
+	}
+	reporter, ok := dstFs.(SpaceReporter)
+	if !ok {
+		o.log().Info("[ReWrite Checkpoint]", common.OperationField("skip free space check"),
+			common.OperandField(dstFs.Name()))
+		return nil
+	}
+	available, err := reporter.AvailableSpace(ctx)
+	if err != nil {
+		return err
+	}
+	required := estimateRewriteBytes(objectsData) + o.spaceReserve
+	o.log().Info("[ReWrite Checkpoint]", common.OperationField("free space check"),
+		common.OperandField(dstFs.Name()),
+		common.AnyField("required", required),
+		common.AnyField("available", available))
+	if required > available {
+		return &InsufficientSpaceError{
+			Required:  required,
+			Available: available,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// StagedWritesDir holds the objects a session with staged writes has
+// written but not finalized yet, under their own names.
+const StagedWritesDir = BackupAuxDir + "/" + BackupAuxStaged
+
+// StagedWrites tells whether a BackupSession stages the objects the
+// rewrite writes, see WithStagedWrites.
+type StagedWrites int
+
+const (
+	// StagedWritesAuto stages the writes when the destination reports
+	// that its writes are not atomic, see AtomicWriteReporter.
+	StagedWritesAuto StagedWrites = iota
+	StagedWritesOn
+	StagedWritesOff
+)
+
+// AtomicWriteReporter is implemented by a FileService that knows
+// whether its writes are atomic. A FileService is expected to make a
+// failed write leave nothing behind, one that does not, e.g. one backed
+// by NFS, reports false and gets its writes staged.
+type AtomicWriteReporter interface {
+	AtomicWrites() bool
+}
+
+// WithStagedWrites sets whether the session stages the objects the
+// rewrite writes: an object is written under StagedWritesDir first and
+// only written under its own name once the staged object is synced and
+// checked, the staged object is then deleted. The staged objects left
+// by a crashed session are deleted when the next session starts, and
+// the objects of the same names are not reused, they may be partial.
+//
+// Only use it when the destination is not shared with another session.
+func WithStagedWrites(mode StagedWrites) SessionOption {
+	return func(s *BackupSession) {
+		s.stagedWrites = mode
+	}
+}
+
+// stagesWrites resolves mode for dstFs.
+func stagesWrites(mode StagedWrites, dstFs fileservice.FileService) bool {
+	switch mode {
+	case StagedWritesOn:
+		return true
+	case StagedWritesOff:
+		return false
+	}
+	reporter, ok := dstFs.(AtomicWriteReporter)
+	return ok && !reporter.AtomicWrites()
+}
+
+// StagesWrites tells whether the session stages the objects the
+// rewrite writes.
+func (s *BackupSession) StagesWrites() bool {
+	return s != nil && s.staged
+}
+
+func stagedName(name string) string {
+	return StagedWritesDir + "/" + name
+}
+
+// discardStagedWrites deletes the staged objects an earlier session did
+// not finalize, the objects of their names are not reused.
+func (s *BackupSession) discardStagedWrites(ctx context.Context) error {
+	staged := fileservice.SubPath(s.dstFs, StagedWritesDir)
+	entries, err := staged.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		s.unfinalized[entry.Name] = struct{}{}
+		if err = staged.Delete(ctx, entry.Name); err != nil &&
+			!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+			return err
+		}
+		s.log().Info("[BackupSession]", common.OperationField("discard staged object"),
+			common.AnyField("object", entry.Name))
+	}
+	return nil
+}
+
+// finalized tells whether the object name in the destination, if any,
+// is complete, which it may not be while it is being finalized or when
+// an earlier session crashed doing so.
+func (s *BackupSession) finalized(name string) bool {
+	if s == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.unfinalized[name]
+	return !ok
+}
+
+func (s *BackupSession) setFinalized(name string, finalized bool) {
+	s.Lock()
+	defer s.Unlock()
+	if finalized {
+		delete(s.unfinalized, name)
+	} else {
+		s.unfinalized[name] = struct{}{}
+	}
+}
+
+// writerName is the name the writer of the object name in dstFs
+// writes, its staged name when the session stages writes. A staged
+// object left by an attempt that failed is deleted.
+func (s *BackupSession) writerName(ctx context.Context, dstFs fileservice.FileService, name string) (string, error) {
+	if !s.StagesWrites() {
+		return name, nil
+	}
+	staged := stagedName(name)
+	if err := dstFs.Delete(ctx, staged); err != nil &&
+		!moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		return "", err
+	}
+	return staged, nil
+}
+
+// finalize writes the staged object written in dstFs to its own name,
+// once it is checked to be what the writer synced, and deletes it.
+func (s *BackupSession) finalize(ctx context.Context, dstFs fileservice.FileService, written *writtenObject) error {
+	if !s.StagesWrites() {
+		return nil
+	}
+	name := written.name.String()
+	staged := stagedName(name)
+	buf, err := readBackupFile(ctx, dstFs, staged)
+	if err != nil {
+		return err
+	}
+	if len(buf) < objectio.HeaderSize || int64(len(buf)) != written.size() ||
+		!bytes.Equal(objectio.Header(buf).Extent(), written.extent) {
+		return moerr.NewInternalErrorNoCtx("staged object %s has %d bytes, %d were synced",
+			name, len(buf), written.size())
+	}
+	s.setFinalized(name, false)
+	if err = writeBackupFile(ctx, dstFs, name, buf); err != nil {
+		return err
+	}
+	if err = dstFs.Delete(ctx, staged); err != nil {
+		return err
+	}
+	s.setFinalized(name, true)
+	return nil
+}
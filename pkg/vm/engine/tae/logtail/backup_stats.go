@@ -0,0 +1,298 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	v2 "github.com/matrixorigin/matrixone/pkg/util/metric/v2"
+	"go.uber.org/zap"
+)
+
+// The phases the backup stats are scoped by.
+const (
+	StatsPhaseTrim    = "trim"
+	StatsPhaseRewrite = "rewrite"
+	StatsPhaseVerify  = "verify"
+	StatsPhaseSession = "session"
+)
+
+// The counters of the backup stats.
+const (
+	StatStaleBlocks      = "stale_blocks"
+	StatOverlapRows      = "overlap_rows"
+	StatFilteredRows     = "filtered_rows"
+	StatUnorderedBlocks  = "unordered_blocks"
+	StatInputBytes       = "input_bytes"
+	StatOutputBytes      = "output_bytes"
+	StatConverted        = "converted_objects"
+	StatRewritten        = "rewritten_objects"
+	StatSortViolations   = "sort_violations"
+	StatSortFallbacks    = "sort_fallbacks"
+	StatDuplicateBlocks  = "duplicate_blocks"
+	StatDuplicateMeta    = "duplicate_meta_rows"
+	StatCorruptLocations = "corrupt_locations"
+	StatWrittenBytes     = "written_bytes"
+	StatWrittenObjects   = "written_objects"
+	StatBatchedABlocks   = "batched_ablocks"
+	StatUnmatchedDeletes = "unmatched_deletes"
+	StatEmptiedObjects   = "emptied_objects"
+	StatKeyMismatches    = "sort_key_mismatches"
+	StatDuplicateRowIDs  = "duplicate_rowids"
+	StatAbortedWriters   = "aborted_writers"
+)
+
+// The codes of the backup warnings.
+const (
+	WarnBlockNotSorted      = "block_not_sorted"
+	WarnStaleBlock          = "stale_block"
+	WarnUnorderedCommits    = "unordered_commits"
+	WarnSortFallback        = "sort_fallback"
+	WarnDuplicateBlock      = "duplicate_block"
+	WarnObjectWithoutBlocks = "object_without_blocks"
+	WarnDuplicateMetaRow    = "duplicate_meta_row"
+	WarnCorruptLocation     = "corrupt_location"
+	WarnSoftDeleteConflict  = "soft_delete_conflict"
+	WarnUnmatchedDeletes    = "unmatched_deletes"
+	WarnSortViolation       = "sort_violation"
+	WarnSkippedObject       = "skipped_object"
+	WarnBatchGrowth         = "batch_growth"
+	WarnHookFailed          = "hook_failed"
+	WarnSortKeyMismatch     = "sort_key_mismatch"
+	WarnCollectedObject     = "collected_object"
+	WarnDuplicateRowID      = "duplicate_rowid"
+)
+
+const statsScopeSeparator = "/"
+
+// BackupWarning is an anomaly a stage of the backup met and went past,
+// e.g. a block written unsorted. It is logged as well.
+type BackupWarning struct {
+	Code string
+	// Object and Block name what the warning is about, either can be
+	// empty.
+	Object string
+	Block  string
+	Detail string
+}
+
+func (w BackupWarning) String() string {
+	var b strings.Builder
+	b.WriteString(w.Code)
+	for _, field := range []struct{ key, value string }{
+		{"object", w.Object}, {"block", w.Block}, {"detail", w.Detail},
+	} {
+		if field.value != "" {
+			b.WriteString(" " + field.key + "=" + field.value)
+		}
+	}
+	return b.String()
+}
+
+// BackupStats counts what the stages of a backup do. The counters are
+// updated atomically, one instance can be shared by stages that run
+// concurrently. Counters are grouped by labeled scopes, see Phase and
+// Table. It also collects the warnings of the stages, see Warn. All
+// methods accept a nil *BackupStats and do nothing.
+type BackupStats struct {
+	sync.RWMutex
+	counters map[string]*atomic.Int64
+	scopes   map[string]*BackupStats
+	warnings []BackupWarning
+}
+
+func NewBackupStats() *BackupStats {
+	return &BackupStats{
+		counters: make(map[string]*atomic.Int64),
+		scopes:   make(map[string]*BackupStats),
+	}
+}
+
+// Phase returns the scope of the counters of phase.
+func (s *BackupStats) Phase(phase string) *BackupStats {
+	return s.Scope("phase", phase)
+}
+
+// Table returns the scope of the counters of table tid.
+func (s *BackupStats) Table(tid uint64) *BackupStats {
+	return s.Scope("table", strconv.FormatUint(tid, 10))
+}
+
+// Scope returns the sub-scope labeled key=value, creating it on first
+// use.
+func (s *BackupStats) Scope(key, value string) *BackupStats {
+	if s == nil {
+		return nil
+	}
+	label := key + "=" + value
+	s.RLock()
+	scope, ok := s.scopes[label]
+	s.RUnlock()
+	if ok {
+		return scope
+	}
+	s.Lock()
+	defer s.Unlock()
+	if scope, ok = s.scopes[label]; !ok {
+		scope = NewBackupStats()
+		s.scopes[label] = scope
+	}
+	return scope
+}
+
+func (s *BackupStats) counter(name string) *atomic.Int64 {
+	s.RLock()
+	c, ok := s.counters[name]
+	s.RUnlock()
+	if ok {
+		return c
+	}
+	s.Lock()
+	defer s.Unlock()
+	if c, ok = s.counters[name]; !ok {
+		c = new(atomic.Int64)
+		s.counters[name] = c
+	}
+	return c
+}
+
+func (s *BackupStats) Add(name string, delta int64) {
+	if s == nil {
+		return
+	}
+	s.counter(name).Add(delta)
+}
+
+func (s *BackupStats) Get(name string) int64 {
+	if s == nil {
+		return 0
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if c, ok := s.counters[name]; ok {
+		return c.Load()
+	}
+	return 0
+}
+
+// Warn records warning.
+func (s *BackupStats) Warn(warning BackupWarning) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.warnings = append(s.warnings, warning)
+}
+
+// Warnings returns the warnings recorded in s, its scopes excluded, in
+// the order they were recorded.
+func (s *BackupStats) Warnings() []BackupWarning {
+	if s == nil {
+		return nil
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return append([]BackupWarning(nil), s.warnings...)
+}
+
+// Merge adds the counters and the warnings of other, scopes included,
+// to s.
+func (s *BackupStats) Merge(other *BackupStats) {
+	if s == nil || other == nil || s == other {
+		return
+	}
+	other.RLock()
+	counters := make(map[string]int64, len(other.counters))
+	for name, c := range other.counters {
+		counters[name] = c.Load()
+	}
+	scopes := make(map[string]*BackupStats, len(other.scopes))
+	for label, scope := range other.scopes {
+		scopes[label] = scope
+	}
+	warnings := append([]BackupWarning(nil), other.warnings...)
+	other.RUnlock()
+	for name, v := range counters {
+		s.Add(name, v)
+	}
+	s.Lock()
+	s.warnings = append(s.warnings, warnings...)
+	s.Unlock()
+	for label, scope := range scopes {
+		key, value, _ := strings.Cut(label, "=")
+		s.Scope(key, value).Merge(scope)
+	}
+}
+
+// StatsSnapshot is a copy of the counters of a BackupStats, keyed by
+// the scope labels and the counter name joined by '/', e.g.
+// "phase=trim/stale_blocks".
+type StatsSnapshot map[string]int64
+
+func (s *BackupStats) Snapshot() StatsSnapshot {
+	snapshot := make(StatsSnapshot)
+	s.snapshot("", snapshot)
+	return snapshot
+}
+
+func (s *BackupStats) snapshot(prefix string, snapshot StatsSnapshot) {
+	if s == nil {
+		return
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for name, c := range s.counters {
+		snapshot[prefix+name] = c.Load()
+	}
+	for label, scope := range s.scopes {
+		scope.snapshot(prefix+label+statsScopeSeparator, snapshot)
+	}
+}
+
+func (s StatsSnapshot) keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Fields returns the counters as structured log fields.
+func (s StatsSnapshot) Fields() []zap.Field {
+	fields := make([]zap.Field, 0, len(s))
+	for _, key := range s.keys() {
+		fields = append(fields, zap.Int64(key, s[key]))
+	}
+	return fields
+}
+
+// Export adds the counters to the backup stats metric, labeled by their
+// scope and name. Export the snapshot of a finished backup once, the
+// metric is a counter.
+func (s StatsSnapshot) Export() {
+	for _, key := range s.keys() {
+		scope, name := "", key
+		if i := strings.LastIndex(key, statsScopeSeparator); i >= 0 {
+			scope, name = key[:i], key[i+1:]
+		}
+		v2.BackupStatsCounter.WithLabelValues(scope, name).Add(float64(s[key]))
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// SummaryTopTables is the number of tables a RewriteSummary lists.
+const SummaryTopTables = 5
+
+// TableBytes is the size of the objects of a table a rewritten
+// checkpoint references.
+type TableBytes struct {
+	Table uint64 `json:"table"`
+	Bytes int64  `json:"bytes"`
+}
+
+// tableBytes sums sizes, keyed by object, by the tables of the objects.
+func tableBytes(sizes map[string]int64, tables map[string]uint64) []TableBytes {
+	sums := make(map[uint64]int64)
+	for name, size := range sizes {
+		sums[tables[name]] += size
+	}
+	result := make([]TableBytes, 0, len(sums))
+	for tid, size := range sums {
+		result = append(result, TableBytes{Table: tid, Bytes: size})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// RewriteSummary is the compact report of a rewrite, see
+// RewriteResult.Summary. Tools parse its JSON, the field names are
+// stable.
+type RewriteSummary struct {
+	Phase          int               `json:"phase"`
+	Partial        bool              `json:"partial"`
+	InputBytes     int64             `json:"input_bytes"`
+	OutputBytes    int64             `json:"output_bytes"`
+	WrittenObjects int               `json:"written_objects"`
+	WrittenBytes   int64             `json:"written_bytes"`
+	Files          RewriteFileCounts `json:"files"`
+	// TopTables are the SummaryTopTables tables of the most output
+	// bytes, largest first.
+	TopTables []TableBytes `json:"top_tables"`
+	// Warnings counts the anomalies the rewrite went past by code,
+	// those it did not meet are left out.
+	Warnings []WarningCount `json:"warnings"`
+}
+
+// RewriteFileCounts counts the files of RewriteFiles, the exported
+// files and the emptied objects.
+type RewriteFileCounts struct {
+	Rewritten  int `json:"rewritten"`
+	Tombstones int `json:"tombstones"`
+	Converted  int `json:"converted"`
+	Checkpoint int `json:"checkpoint"`
+	Exported   int `json:"exported"`
+	Emptied    int `json:"emptied"`
+}
+
+type WarningCount struct {
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+// Summary returns the compact report of r.
+func (r *RewriteResult) Summary() RewriteSummary {
+	summary := RewriteSummary{
+		Phase:          r.Phase,
+		Partial:        r.Partial,
+		InputBytes:     r.Stats.InputBytes,
+		OutputBytes:    r.Stats.OutputBytes,
+		WrittenObjects: r.WrittenObjects,
+		WrittenBytes:   r.WrittenBytes,
+		Files: RewriteFileCounts{
+			Rewritten:  len(r.Files.Rewritten),
+			Tombstones: len(r.Files.Tombstones),
+			Converted:  len(r.Files.Converted),
+			Checkpoint: len(r.Files.Checkpoint),
+			Exported:   len(r.Exported),
+			Emptied:    len(r.Emptied),
+		},
+		TopTables: append([]TableBytes{}, r.Tables...),
+		Warnings:  []WarningCount{},
+	}
+	sort.SliceStable(summary.TopTables, func(i, j int) bool {
+		return summary.TopTables[i].Bytes > summary.TopTables[j].Bytes
+	})
+	if len(summary.TopTables) > SummaryTopTables {
+		summary.TopTables = summary.TopTables[:SummaryTopTables]
+	}
+	for _, warning := range []WarningCount{
+		{WarnSkippedObject, len(r.Skipped)},
+		{WarnSortFallback, r.SortFallbacks},
+		{WarnSortViolation, len(r.SortViolations)},
+		{WarnDuplicateBlock, len(r.DuplicateBlocks)},
+		{WarnDuplicateMetaRow, len(r.DuplicateBlockRows)},
+		{WarnCorruptLocation, len(r.CorruptLocations)},
+		{WarnSoftDeleteConflict, len(r.SoftDeleteConflicts)},
+		{WarnCollectedObject, len(r.Collected)},
+		{WarnDuplicateRowID, len(r.DuplicateRowIDs)},
+	} {
+		if warning.Count > 0 {
+			summary.Warnings = append(summary.Warnings, warning)
+		}
+	}
+	return summary
+}
+
+// String returns the summary of r on one line, for the logs.
+func (r *RewriteResult) String() string {
+	return r.Summary().String()
+}
+
+func (s RewriteSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "phase %d, input %s, output %s, written %d objects %s",
+		s.Phase,
+		common.HumanReadableBytes(int(s.InputBytes)),
+		common.HumanReadableBytes(int(s.OutputBytes)),
+		s.WrittenObjects,
+		common.HumanReadableBytes(int(s.WrittenBytes)))
+	fmt.Fprintf(&b, ", files rewritten=%d tombstones=%d converted=%d checkpoint=%d exported=%d emptied=%d",
+		s.Files.Rewritten, s.Files.Tombstones, s.Files.Converted, s.Files.Checkpoint, s.Files.Exported, s.Files.Emptied)
+	if len(s.TopTables) > 0 {
+		b.WriteString(", top tables")
+		for _, table := range s.TopTables {
+			fmt.Fprintf(&b, " %d=%s", table.Table, common.HumanReadableBytes(int(table.Bytes)))
+		}
+	}
+	if len(s.Warnings) > 0 {
+		b.WriteString(", warnings")
+		for _, warning := range s.Warnings {
+			fmt.Fprintf(&b, " %s=%d", warning.Code, warning.Count)
+		}
+	}
+	if s.Partial {
+		b.WriteString(", partial")
+	}
+	return b.String()
+}
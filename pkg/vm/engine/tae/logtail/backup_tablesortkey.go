@@ -0,0 +1,129 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+)
+
+// WithTableSortKeys sorts all the converted aBlocks of a table by one
+// sort key rather than by the one the object of each declares: the
+// sort key of the table schema in the checkpoint, or else the one the
+// aBlock of the table with the lowest object name declares, see
+// resolveTableSortKeys. An aBlock that declares another one is sorted
+// by that of the table and warned about.
+func WithTableSortKeys() BackupOption {
+	return func(o *backupOptions) {
+		o.tableSortKeys = &tableSortKeys{keys: make(map[uint64]uint16)}
+	}
+}
+
+// tableSortKeys are the sort keys resolved for the tables, the aBlocks
+// of several tables can be converted at once.
+type tableSortKeys struct {
+	sync.Mutex
+	keys map[uint64]uint16
+}
+
+// resolveTableSortKeys picks the sort key of the tables of objectsData
+// whose schema has none before their aBlocks are converted: the one the
+// aBlock with the lowest object name declares, rather than that of the
+// aBlock converted first, so that the layout of the output does not
+// depend on the order the objects are visited in.
+func (o *backupOptions) resolveTableSortKeys(objectsData map[string]*fileData) {
+	if o.tableSortKeys == nil {
+		return
+	}
+	names := make([]string, 0, len(objectsData))
+	for name := range objectsData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	o.tableSortKeys.Lock()
+	defer o.tableSortKeys.Unlock()
+	for _, name := range names {
+		blocks, _ := sortBlocks(objectsData[name].data)
+		for _, block := range blocks {
+			if !block.isABlock || block.blockType != objectio.SchemaData ||
+				block.sortKey == math.MaxUint16 {
+				continue
+			}
+			if _, ok := o.schemaSortKeys[block.tid]; ok {
+				continue
+			}
+			if _, ok := o.tableSortKeys.keys[block.tid]; !ok {
+				o.tableSortKeys.keys[block.tid] = block.sortKey
+			}
+		}
+	}
+}
+
+// tableSortKey returns the sort key of table tid the aBlock at location,
+// of columns data columns, is sorted by with WithTableSortKeys, given
+// the one its object declares, math.MaxUint16 for none. It is declared
+// without the option, and for a table that has no sort key yet.
+func (o *backupOptions) tableSortKey(
+	tid uint64,
+	declared uint16,
+	columns int,
+	location objectio.Location,
+) uint16 {
+	if o.tableSortKeys == nil {
+		return declared
+	}
+	o.tableSortKeys.Lock()
+	key, ok := o.tableSortKeys.keys[tid]
+	if !ok {
+		key = declared
+		// The schema may be newer than the block, a key past its data
+		// columns is not the key of the table.
+		if schema, ok := o.schemaSortKeys[tid]; ok && int(schema) < columns {
+			key = schema
+		}
+		if key != math.MaxUint16 {
+			o.tableSortKeys.keys[tid] = key
+		}
+	}
+	o.tableSortKeys.Unlock()
+	if key == math.MaxUint16 || key == declared {
+		return declared
+	}
+	if int(key) >= columns {
+		// The block is older than the table key.
+		return declared
+	}
+	if declared != math.MaxUint16 {
+		o.log().Warn("[ReWrite Checkpoint]", common.OperationField("sort key mismatch"),
+			common.AnyField("block", location.String()),
+			common.AnyField("table", tid),
+			common.AnyField("declared", declared),
+			common.AnyField("sort key", key))
+		o.stats.Warn(BackupWarning{
+			Code:   WarnSortKeyMismatch,
+			Block:  location.String(),
+			Detail: fmt.Sprintf("table %d: declared sort key %d, sorted by %d", tid, declared, key),
+		})
+		rewrite := o.stats.Phase(StatsPhaseRewrite)
+		rewrite.Add(StatKeyMismatches, 1)
+		rewrite.Table(tid).Add(StatKeyMismatches, 1)
+	}
+	return key
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+)
+
+// ObjectTagger is implemented by a FileService that can attach tags to
+// the files it stores, e.g. one backed by an object store whose
+// lifecycle policies key off object tags.
+type ObjectTagger interface {
+	TagObject(ctx context.Context, filePath string, tags map[string]string) error
+}
+
+// TaggedWriter is implemented by a FileService that takes the tags of a
+// file with the write of the file, e.g. one backed by an object store
+// that sets them on upload. It is preferred to ObjectTagger, the file
+// is never stored without its tags.
+type TaggedWriter interface {
+	WriteTagged(ctx context.Context, vector fileservice.IOVector, tags map[string]string) error
+}
+
+// WithObjectTags attaches tags, e.g. the id of the backup and its
+// retention class, to every file the session and its rewrites write to
+// the destination: the objects, those it copies to CopyFS included, the
+// checkpoint and the auxiliary files.
+// They are attached by the destination if it is a TaggedWriter or an
+// ObjectTagger, and recorded in the CheckpointFooter of the rewrites
+// either way. A destination that cannot attach them is written without,
+// unless WithStrictObjectTags is set.
+func WithObjectTags(tags map[string]string) SessionOption {
+	return func(s *BackupSession) {
+		s.tags = tags
+	}
+}
+
+// WithStrictObjectTags fails the session, and its rewrites, on a
+// destination that cannot attach the tags of WithObjectTags rather
+// than writing the files without them.
+func WithStrictObjectTags() SessionOption {
+	return func(s *BackupSession) {
+		s.strictTags = true
+	}
+}
+
+// objectTags returns the tags of the session, nil if it has none.
+func (s *BackupSession) objectTags() map[string]string {
+	if s == nil {
+		return nil
+	}
+	return s.tags
+}
+
+// taggedFS returns dstFs, the destination of a write of the session,
+// with the tags of the session attached to what is written to it. It
+// is dstFs itself when there are no tags to attach, or when dstFs
+// cannot and the tags are not strict.
+func (s *BackupSession) taggedFS(dstFs fileservice.FileService) (fileservice.FileService, error) {
+	tags := s.objectTags()
+	if len(tags) == 0 {
+		return dstFs, nil
+	}
+	if _, ok := dstFs.(taggingFS); ok {
+		return dstFs, nil
+	}
+	fs := taggingFS{FileService: dstFs, tags: tags}
+	fs.writer, _ = dstFs.(TaggedWriter)
+	fs.tagger, _ = dstFs.(ObjectTagger)
+	if fs.writer == nil && fs.tagger == nil {
+		if s.strictTags {
+			return nil, moerr.NewNotSupportedNoCtx(fmt.Sprintf("object tags on %s", dstFs.Name()))
+		}
+		return dstFs, nil
+	}
+	return fs, nil
+}
+
+// taggingFS attaches tags to every file written to it, with the write
+// if it can, after it otherwise.
+type taggingFS struct {
+	fileservice.FileService
+	writer TaggedWriter
+	tagger ObjectTagger
+	tags   map[string]string
+}
+
+func (fs taggingFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if fs.writer != nil {
+		return fs.writer.WriteTagged(ctx, vector, fs.tags)
+	}
+	if err := fs.FileService.Write(ctx, vector); err != nil {
+		return err
+	}
+	return fs.tagger.TagObject(ctx, vector.FilePath, fs.tags)
+}
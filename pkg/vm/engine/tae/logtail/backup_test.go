@@ -0,0 +1,3603 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/compress"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/defines"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/blockio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/db/dbutils"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackupTestFS(t testing.TB) fileservice.FileService {
+	fs, err := fileservice.NewMemoryFS(defines.LocalFileServiceName, fileservice.DisabledCacheConfig, nil)
+	require.NoError(t, err)
+	return fs
+}
+
+func newInt32Batch(t testing.TB, mp *mpool.MPool, cols ...[]int32) *batch.Batch {
+	bat := batch.NewWithSize(len(cols))
+	for i, col := range cols {
+		bat.Vecs[i] = vector.NewVec(types.T_int32.ToType())
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[i], col, nil, mp))
+	}
+	bat.SetRowCount(len(cols[0]))
+	return bat
+}
+
+// writeTestObject writes one data block per batch and returns the
+// location of the first block.
+func writeTestObject(
+	t testing.TB,
+	fs fileservice.FileService,
+	sortKey uint16,
+	bats ...*batch.Batch,
+) objectio.Location {
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	if sortKey != math.MaxUint16 {
+		writer.SetPrimaryKey(sortKey)
+	}
+	for _, bat := range bats {
+		_, err = writer.WriteBatch(bat)
+		require.NoError(t, err)
+	}
+	blocks, extent, err := writer.Sync(context.Background())
+	require.NoError(t, err)
+	return objectio.BuildLocation(name, extent, blocks[0].GetRows(), blocks[0].GetID())
+}
+
+func TestVerifyObjectSorted(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	sorted := writeTestObject(t, fs, 0,
+		newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{4, 3, 2, 1}))
+	violations, err := verifyObjectSorted(ctx, fs, sorted)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	// The writer does not sort, so the block is falsely marked sorted.
+	unsorted := writeTestObject(t, fs, 0,
+		newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{4, 3, 2, 1}),
+		newInt32Batch(t, mp, []int32{5, 7, 6, 8}, []int32{4, 3, 2, 1}))
+	violations, err = verifyObjectSorted(ctx, fs, unsorted)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(violations))
+	require.Equal(t, uint16(1), violations[0].Block)
+	require.Equal(t, 2, violations[0].Row)
+
+	// Without a sort key there is nothing to verify.
+	noKey := writeTestObject(t, fs, math.MaxUint16,
+		newInt32Batch(t, mp, []int32{3, 2, 1}))
+	violations, err = verifyObjectSorted(ctx, fs, noKey)
+	require.NoError(t, err)
+	require.Empty(t, violations)
+}
+
+func TestBackupSessionQuota(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	names := []string{"a", "b", "c", "d", "e"}
+
+	copied := make(map[string]int)
+	runSession := func(maxObjects int64) error {
+		session, err := NewBackupSession(ctx, fs,
+			WithQuota(0, maxObjects), WithJournal("journal"))
+		require.NoError(t, err)
+		for _, name := range names {
+			err = session.Copy(ctx, name, 10, func(context.Context) error {
+				copied[name]++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return session.Flush(ctx)
+	}
+
+	err := runSession(2)
+	require.True(t, IsQuotaExceeded(err))
+	require.Equal(t, 2, len(copied))
+	err = runSession(2)
+	require.True(t, IsQuotaExceeded(err))
+	require.Equal(t, 4, len(copied))
+	require.NoError(t, runSession(0))
+
+	// The resumed sessions together copy every object exactly once,
+	// same as a single unbounded run.
+	require.Equal(t, len(names), len(copied))
+	for _, name := range names {
+		require.Equal(t, 1, copied[name])
+	}
+}
+
+// crashFS fails the mutation crash of the file service and every one
+// after it, as a process that crashed before it would not make them.
+type crashFS struct {
+	fileservice.FileService
+	crash, ops int
+}
+
+func (f *crashFS) mutate(name string) error {
+	f.ops++
+	if f.crash > 0 && f.ops >= f.crash {
+		return moerr.NewInternalErrorNoCtx("crash before mutating %s", name)
+	}
+	return nil
+}
+
+func (f *crashFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if err := f.mutate(vector.FilePath); err != nil {
+		return err
+	}
+	return f.FileService.Write(ctx, vector)
+}
+
+func (f *crashFS) Delete(ctx context.Context, filePaths ...string) error {
+	if err := f.mutate(filePaths[0]); err != nil {
+		return err
+	}
+	return f.FileService.Delete(ctx, filePaths...)
+}
+
+func TestWriteBackupFileCrash(t *testing.T) {
+	ctx := context.Background()
+	name := "journal"
+	replace := func(crash int) (*crashFS, error) {
+		fs := &crashFS{FileService: newBackupTestFS(t)}
+		require.NoError(t, writeBackupFile(ctx, fs, name, []byte("old")))
+		fs.crash, fs.ops = crash, 0
+		return fs, writeBackupFile(ctx, fs, name, []byte("new"))
+	}
+	fs, err := replace(0)
+	require.NoError(t, err)
+	mutations := fs.ops
+
+	// Wherever the replace crashes, one of the versions is read whole,
+	// and the next write replaces it.
+	for crash := 1; crash <= mutations; crash++ {
+		fs, err := replace(crash)
+		require.Error(t, err)
+		buf, err := readBackupFile(ctx, fs, name)
+		require.NoError(t, err, crash)
+		require.Contains(t, []string{"old", "new"}, string(buf), crash)
+		fs.crash = 0
+		require.NoError(t, writeBackupFile(ctx, fs, name, []byte("newer")))
+		buf, err = readBackupFile(ctx, fs, name)
+		require.NoError(t, err)
+		require.Equal(t, "newer", string(buf))
+		entries, err := fs.List(ctx, "")
+		require.NoError(t, err)
+		require.Len(t, entries, 1, crash)
+	}
+}
+
+func TestBackupSessionBestEffort(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	bestEffort := NewBestEffort(10*time.Millisecond, 2)
+	session, err := NewBackupSession(ctx, fs, WithBestEffort(bestEffort))
+	require.NoError(t, err)
+	attempts := 0
+	err = session.Copy(ctx, "hung", 10, func(ctx context.Context) error {
+		attempts++
+		return hang(ctx)
+	})
+	require.True(t, IsObjectSkipped(err), err)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 3, attempts)
+	_, ok := session.Written("hung")
+	require.False(t, ok)
+
+	// A transient failure is retried, a missing object is not.
+	attempts = 0
+	require.NoError(t, session.Copy(ctx, "flaky", 10, func(context.Context) error {
+		if attempts++; attempts < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}))
+	_, ok = session.Written("flaky")
+	require.True(t, ok)
+	attempts = 0
+	err = session.Copy(ctx, "missing", 10, func(context.Context) error {
+		attempts++
+		return moerr.NewFileNotFoundNoCtx("missing")
+	})
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound))
+	require.Equal(t, 1, attempts)
+
+	// Any other error fails the backup, an object is not skipped for a
+	// corruption.
+	attempts = 0
+	corrupt := moerr.NewInternalErrorNoCtx("corrupt")
+	err = session.Copy(ctx, "corrupt", 10, func(context.Context) error {
+		attempts++
+		return corrupt
+	})
+	require.ErrorIs(t, err, corrupt)
+	require.False(t, IsObjectSkipped(err))
+	require.Equal(t, 1, attempts)
+
+	// Another session of the same backup adds to the same list, an
+	// object skipped twice keeps its first reason.
+	other, err := NewBackupSession(ctx, fs, WithBestEffort(bestEffort))
+	require.NoError(t, err)
+	err = other.Attempt(ctx, "hung", func(context.Context) error {
+		return io.ErrUnexpectedEOF
+	})
+	require.True(t, IsObjectSkipped(err))
+	require.True(t, bestEffort.Partial())
+	require.Equal(t, []SkippedObject{{Name: "hung", Reason: context.DeadlineExceeded.Error()}},
+		bestEffort.Skipped())
+
+	// A cancelled backup is not a skipped object.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = session.Attempt(cancelled, "cancelled", hang)
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, IsObjectSkipped(err))
+
+	// A strict session fails on the first error.
+	strict, err := NewBackupSession(ctx, fs)
+	require.NoError(t, err)
+	injected := moerr.NewInternalErrorNoCtx("injected")
+	err = strict.Copy(ctx, "failed", 10, func(context.Context) error {
+		return injected
+	})
+	require.ErrorIs(t, err, injected)
+}
+
+func TestRewriteStatsReduction(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	rows := make([]int32, 8192)
+	for i := range rows {
+		rows[i] = int32(i)
+	}
+	source := writeTestObject(t, fs, 0, newInt32Batch(t, mp, rows))
+	object := &fileData{
+		name: source.Name(),
+		data: map[uint16]*blockData{
+			0: {location: source},
+		},
+	}
+
+	// Trim away most rows and write the rest, the way phase 4 does.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteBatch(newInt32Batch(t, mp, rows[:100]))
+	require.NoError(t, err)
+	written, err := syncObject(ctx, writer, name)
+	require.NoError(t, err)
+
+	stats := RewriteStats{
+		InputBytes:  object.size(),
+		OutputBytes: written.size(),
+	}
+	require.Greater(t, stats.ReductionRatio(), float64(0))
+	require.Less(t, stats.ReductionRatio(), float64(1))
+}
+
+func TestCheckTombstoneBlock(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	live := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	dropped := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	rowids := []types.Rowid{
+		*types.NewRowid(live, 1),
+		*types.NewRowid(dropped, 3),
+		*types.NewRowid(live, 5),
+		*types.NewRowid(dropped, 7),
+	}
+	deltaLoc := writeTestTombstone(t, fs, mp, rowids...)
+
+	// The object holding dropped is missing from the backup.
+	dangling, err := checkTombstoneBlock(ctx, fs, deltaLoc,
+		map[types.Blockid]struct{}{*live: {}})
+	require.NoError(t, err)
+	require.Equal(t, 2, dangling)
+
+	dangling, err = checkTombstoneBlock(ctx, fs, deltaLoc,
+		map[types.Blockid]struct{}{*live: {}, *dropped: {}})
+	require.NoError(t, err)
+	require.Equal(t, 0, dangling)
+}
+
+// writeTestTombstone writes an object of one tombstone block that
+// deletes rowids and returns the location of the block.
+func writeTestTombstone(
+	t testing.TB,
+	fs fileservice.FileService,
+	mp *mpool.MPool,
+	rowids ...types.Rowid,
+) objectio.Location {
+	bat := batch.NewWithSize(1)
+	bat.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[0], rowids, nil, mp))
+	bat.SetRowCount(len(rowids))
+	return writeTombstoneBatch(t, fs, bat)
+}
+
+// writeTombstoneBatch writes an object of one tombstone block and
+// returns the location of the block.
+func writeTombstoneBatch(t testing.TB, fs fileservice.FileService, bat *batch.Batch) objectio.Location {
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(bat)
+	require.NoError(t, err)
+	blocks, _, err := writer.Sync(context.Background())
+	require.NoError(t, err)
+	return objectio.BuildLocation(name, blocks[0].GetExtent(), uint32(bat.RowCount()), blocks[0].GetID())
+}
+
+// writeLegacyTombstoneBatch writes bat, a tombstone in the legacy
+// layout, in an object whose meta claims IOET_ObjectMeta_V2 as the
+// objects written before the reordering of the tombstone columns do.
+// The V2 meta is the V3 one without the sub meta index, which the
+// tombstone blocks do not use.
+func writeLegacyTombstoneBatch(t testing.TB, fs fileservice.FileService, bat *batch.Batch) objectio.Location {
+	ctx := context.Background()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	// The meta is patched in place, it must not be compressed.
+	writer.SetCompression(compress.None)
+	_, err = writer.WriteTombstoneBatch(bat)
+	require.NoError(t, err)
+	blocks, _, err := writer.Sync(ctx)
+	require.NoError(t, err)
+	location := objectio.BuildLocation(name, blocks[0].GetExtent(), uint32(bat.RowCount()), blocks[0].GetID())
+
+	buf, err := readBackupFile(ctx, fs, name.String())
+	require.NoError(t, err)
+	header := objectio.DecodeIOEntryHeader(buf[location.Extent().Offset():])
+	require.Equal(t, uint16(objectio.IOET_ObjectMeta_V3), header.Version)
+	header.Version = objectio.IOET_ObjectMeta_V2
+	require.NoError(t, writeBackupFile(ctx, fs, name.String(), buf))
+	return location
+}
+
+func TestDecodeRowid(t *testing.T) {
+	mp := mpool.MustNewZero()
+	blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	rowid := types.NewRowid(blkID, 42)
+
+	id, offset, err := decodeRowid(rowid[:])
+	require.NoError(t, err)
+	require.Equal(t, *blkID, id)
+	require.Equal(t, uint32(42), offset)
+
+	_, _, err = decodeRowid(rowid[:types.RowidSize-1])
+	require.Error(t, err)
+	_, _, err = decodeRowid(append(rowid[:], 0))
+	require.Error(t, err)
+
+	// A tombstone whose first column is not a rowid is rejected instead
+	// of being decoded into garbage offsets.
+	data := newInt32Batch(t, mp, []int32{1, 2, 3})
+	malformed := batch.NewWithSize(1)
+	malformed.Vecs[0] = vector.NewVec(types.T_varchar.ToType())
+	require.NoError(t, vector.AppendBytes(malformed.Vecs[0], rowid[:types.RowidSize-1], false, mp))
+	malformed.SetRowCount(1)
+	_, _, err = applyDelete(data, malformed, blkID.String())
+	require.Error(t, err)
+	require.Equal(t, 3, data.RowCount())
+}
+
+func TestApplyDeleteUnmatched(t *testing.T) {
+	mp := mpool.MustNewZero()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	blkID := objectio.BuildObjectBlockid(name, 0)
+	other := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	// The tombstone deletes row 1, a row 5 the block does not have, and
+	// a row of another block.
+	rowids := []types.Rowid{
+		*types.NewRowid(blkID, 1),
+		*types.NewRowid(blkID, 5),
+		*types.NewRowid(other, 0),
+	}
+	deletes := batch.NewWithSize(1)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[0], rowids, nil, mp))
+	deletes.SetRowCount(len(rowids))
+
+	data := newInt32Batch(t, mp, []int32{10, 11, 12, 13})
+	removed, unmatched, err := applyDelete(data, deletes, blkID.String(), 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Equal(t, 1, unmatched)
+	require.Equal(t, []int32{10, 12}, vector.MustFixedCol[int32](data.Vecs[0]))
+
+	// The rewrite goes past them with a warning.
+	stats := NewBackupStats()
+	options := newBackupOptions(WithBackupStats(stats))
+	location := objectio.BuildLocation(name, objectio.Extent{}, 4, 0)
+	aBlock := &blockData{location: location, data: newInt32Batch(t, mp, []int32{10, 11, 12, 13})}
+	tombstone := &blockData{location: location, data: deletes}
+	require.NoError(t, options.applyABlockDeletes(aBlock, tombstone, *blkID))
+	require.Equal(t, 3, aBlock.data.RowCount())
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseVerify).Get(StatUnmatchedDeletes))
+	warnings := stats.Warnings()
+	require.Equal(t, 1, len(warnings))
+	require.Equal(t, WarnUnmatchedDeletes, warnings[0].Code)
+	require.Equal(t, blkID.String(), warnings[0].Block)
+}
+
+func TestApplyDeleteJoins(t *testing.T) {
+	mp := mpool.MustNewZero()
+	blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	other := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	const rows = 1000
+	col := make([]int32, rows)
+	for i := range col {
+		col[i] = int32(i)
+	}
+	// The deletes of the block, some twice and some past its rows, among
+	// those of another block, in rowid order and shuffled.
+	rnd := rand.New(rand.NewSource(1))
+	rowids := make([]types.Rowid, 0)
+	for i := 0; i < 2*rows; i++ {
+		id := blkID
+		if rnd.Intn(3) == 0 {
+			id = other
+		}
+		rowids = append(rowids, *types.NewRowid(id, uint32(rnd.Intn(rows+rows/10))))
+	}
+	sorted := append([]types.Rowid(nil), rowids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Less(sorted[j]) })
+	filtered := []int64{3, 3, 999, -1, rows + 5}
+
+	for _, order := range [][]types.Rowid{rowids, sorted, nil} {
+		var deletes *batch.Batch
+		if order != nil {
+			deletes = batch.NewWithSize(1)
+			deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+			require.NoError(t, vector.AppendFixedList(deletes.Vecs[0], order, nil, mp))
+			deletes.SetRowCount(len(order))
+		}
+		var want []int32
+		wantRemoved, wantUnmatched := 0, 0
+		for _, join := range []DeleteJoin{DeleteJoinHash, DeleteJoinMerge, DeleteJoinAuto} {
+			data := newInt32Batch(t, mp, col)
+			removed, unmatched, err := applyDeleteJoin(join, data, deletes, blkID.String(), filtered...)
+			require.NoError(t, err)
+			got := append([]int32(nil), vector.MustFixedCol[int32](data.Vecs[0])...)
+			if join == DeleteJoinHash {
+				want, wantRemoved, wantUnmatched = got, removed, unmatched
+				require.NotZero(t, removed)
+				continue
+			}
+			require.Equal(t, want, got, join)
+			require.Equal(t, wantRemoved, removed, join)
+			require.Equal(t, wantUnmatched, unmatched, join)
+		}
+	}
+}
+
+func TestSortABlockResolvesSortKey(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	// An aBlock with a PK on the second column, the rows are in commit
+	// order and not sorted by PK.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	writer.SetAppendable()
+	writer.SetPrimaryKey(1)
+	_, err = writer.WriteBatch(newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{30, 10, 40, 20}))
+	require.NoError(t, err)
+	blocks, extent, err := writer.Sync(ctx)
+	require.NoError(t, err)
+	location := objectio.BuildLocation(name, extent, blocks[0].GetRows(), blocks[0].GetID())
+
+	// Only the tombstone changed, so trimObjectsData never set sortKey.
+	sortKey := uint16(math.MaxUint16)
+	bat, err := newBackupOptions().sortABlock(ctx, fs, location, &sortKey, 1,
+		formatData(newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{30, 10, 40, 20}), common.CheckpointAllocator), pool)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), sortKey)
+	require.Equal(t, []int32{10, 20, 30, 40}, vector.MustFixedCol[int32](bat.Vecs[1]))
+	require.Equal(t, []int32{2, 4, 1, 3}, vector.MustFixedCol[int32](bat.Vecs[0]))
+	require.Equal(t, -1, firstUnsortedRow(bat.Vecs[1]))
+}
+
+func TestSortABlockTableSortKeys(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	// Two aBlocks of table 1, the first declares the second column as
+	// its sort key, the second declares the first one. The last three
+	// columns stand for the trailing ones.
+	trailing := []int32{0, 0, 0, 0}
+	sortABlocks := func(options *backupOptions) ([]uint16, [][]int32) {
+		keys := make([]uint16, 0, 2)
+		cols := make([][]int32, 0, 2)
+		for _, declared := range []uint16{1, 0} {
+			sortKey := declared
+			bat := newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{30, 10, 40, 20}, trailing, trailing, trailing)
+			bat, err := options.sortABlock(ctx, fs, objectio.Location{}, &sortKey, 1,
+				formatData(bat, common.CheckpointAllocator), pool)
+			require.NoError(t, err)
+			keys = append(keys, sortKey)
+			cols = append(cols, vector.MustFixedCol[int32](bat.Vecs[1]))
+		}
+		return keys, cols
+	}
+	mismatches := func(options *backupOptions) int {
+		n := 0
+		for _, warning := range options.stats.Warnings() {
+			if warning.Code == WarnSortKeyMismatch {
+				n++
+			}
+		}
+		require.Equal(t, int64(n), options.stats.Phase(StatsPhaseRewrite).Get(StatKeyMismatches))
+		return n
+	}
+
+	// Each is sorted by the key it declares.
+	options := newBackupOptions()
+	keys, cols := sortABlocks(options)
+	require.Equal(t, []uint16{1, 0}, keys)
+	require.Equal(t, [][]int32{{10, 20, 30, 40}, {30, 10, 40, 20}}, cols)
+	require.Zero(t, mismatches(options))
+
+	// Both by the key the first declares, the second is warned about.
+	options = newBackupOptions(WithTableSortKeys())
+	keys, cols = sortABlocks(options)
+	require.Equal(t, []uint16{1, 1}, keys)
+	require.Equal(t, [][]int32{{10, 20, 30, 40}, {10, 20, 30, 40}}, cols)
+	require.Equal(t, 1, mismatches(options))
+
+	// Both by the key of the schema, the first is warned about.
+	options = newBackupOptions(WithTableSortKeys())
+	options.schemaSortKeys = map[uint64]uint16{1: 0}
+	keys, cols = sortABlocks(options)
+	require.Equal(t, []uint16{0, 0}, keys)
+	require.Equal(t, [][]int32{{30, 10, 40, 20}, {30, 10, 40, 20}}, cols)
+	require.Equal(t, 1, mismatches(options))
+}
+
+func TestInPlaceRewriteCrash(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	staging := fileservice.SubPath(fs, InPlaceStagingDir)
+	read := func(fs fileservice.FileService, name string) string {
+		buf, err := readBackupFile(ctx, fs, name)
+		require.NoError(t, err)
+		return string(buf)
+	}
+	notFound := func(fs fileservice.FileService, name string) {
+		_, err := readBackupFile(ctx, fs, name)
+		require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+	}
+	var published []objectio.Location
+	publish := func(_ context.Context, loc, _ objectio.Location) error {
+		// The rewritten object is in place before it is published.
+		require.Equal(t, "rewritten", read(fs, "new"))
+		published = append(published, loc)
+		return nil
+	}
+
+	require.NoError(t, writeBackupFile(ctx, fs, "old", []byte("original")))
+	require.NoError(t, writeBackupFile(ctx, staging, "new", []byte("rewritten")))
+	loc := objectio.MockLocation(objectio.MockObjectName())
+	intent := &swapIntent{Files: []string{"new"}, Location: loc, Originals: []string{"old"}}
+
+	// Crash after the rewritten object is written but before the swap
+	// is committed: the original wins and the staged copy is dropped.
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fs, publish))
+	require.Equal(t, "original", read(fs, "old"))
+	notFound(staging, "new")
+	notFound(fs, "new")
+	require.Empty(t, published)
+
+	// Crash after the commit point, with a torn copy in place: the swap
+	// is rolled forward and the original is deleted once published.
+	require.NoError(t, writeBackupFile(ctx, staging, "new", []byte("rewritten")))
+	require.NoError(t, commitSwap(ctx, fs, intent))
+	require.NoError(t, writeBackupFile(ctx, fs, "new", []byte("rewr")))
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fs, publish))
+	require.Equal(t, "rewritten", read(fs, "new"))
+	notFound(staging, "new")
+	notFound(fs, "old")
+	notFound(fs, InPlaceIntentName)
+	require.Equal(t, []objectio.Location{loc}, published)
+
+	// Recovering again is a no-op.
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fs, publish))
+	require.Equal(t, "rewritten", read(fs, "new"))
+	require.Len(t, published, 1)
+
+	// Without publish the original is left to the GC.
+	require.NoError(t, writeBackupFile(ctx, fs, "old", []byte("original")))
+	require.NoError(t, writeBackupFile(ctx, staging, "new2", []byte("rewritten")))
+	require.NoError(t, commitSwap(ctx, fs, &swapIntent{Files: []string{"new2"}, Originals: []string{"old"}}))
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fs, nil))
+	require.Equal(t, "rewritten", read(fs, "new2"))
+	require.Equal(t, "original", read(fs, "old"))
+	notFound(fs, InPlaceIntentName)
+
+	// A staged object never replaces an original.
+	require.NoError(t, writeBackupFile(ctx, staging, "old", []byte("rewritten")))
+	require.NoError(t, commitSwap(ctx, fs, &swapIntent{Files: []string{"old"}, Originals: []string{"old"}}))
+	require.Error(t, RecoverInPlaceRewrite(ctx, fs, nil))
+	require.Equal(t, "original", read(fs, "old"))
+	require.NoError(t, fs.Delete(ctx, InPlaceIntentName))
+}
+
+func TestSoftDeletesSpill(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	names := make([]objectio.ObjectName, 1000)
+	for i := range names {
+		names[i] = objectio.BuildObjectName(objectio.NewSegmentid(), uint16(i))
+	}
+
+	budget := int64(100 * softDeleteEntrySize)
+	set := NewSoftDeletes(WithSoftDeletesSpill(fs, "softdeletes", budget))
+	for _, name := range names {
+		added, err := set.Add(ctx, name)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+	added, err := set.Add(ctx, names[0])
+	require.NoError(t, err)
+	require.False(t, added)
+	require.Equal(t, len(names), set.Len())
+	// Only the last used shard may keep the set above its budget.
+	require.LessOrEqual(t, set.MemUsage(), budget+int64(len(names))*softDeleteEntrySize/softDeleteShards*2)
+
+	for _, name := range names {
+		ok, err := set.Contains(ctx, name)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	ok, err := set.Contains(ctx, objectio.BuildObjectName(objectio.NewSegmentid(), 0))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, len(names), set.Len())
+}
+
+func BenchmarkSoftDeletesMemory(b *testing.B) {
+	const entries = 5_000_000
+	names := make([]objectio.ObjectName, entries)
+	for i := range names {
+		names[i] = objectio.BuildObjectName(objectio.NewSegmentid(), uint16(i))
+	}
+	heapInUse := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	b.Run("nested-map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			set := make(map[string]bool)
+			for j := range names {
+				set[names[j].String()] = true
+			}
+			b.ReportMetric(float64(heapInUse()-before)/entries, "bytes/entry")
+			runtime.KeepAlive(set)
+		}
+	})
+	b.Run("sharded", func(b *testing.B) {
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			set := NewSoftDeletes()
+			for j := range names {
+				if _, err := set.Add(ctx, names[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(heapInUse()-before)/entries, "bytes/entry")
+			runtime.KeepAlive(set)
+		}
+	})
+}
+
+func TestProjectColumns(t *testing.T) {
+	mp := mpool.MustNewZero()
+	// Five data columns followed by the aBlock metadata columns.
+	bat := newInt32Batch(t, mp,
+		[]int32{0, 0}, []int32{1, 1}, []int32{2, 2}, []int32{3, 3}, []int32{4, 4},
+		[]int32{5, 5}, []int32{6, 6}, []int32{7, 7})
+	bat.Attrs = []string{"a", "b", "c", "d", "e", "m1", "m2", "m3"}
+
+	projected, sortKey, err := projectColumns(bat, []uint16{1, 3}, appendableMetaColumns, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2+appendableMetaColumns, len(projected.Vecs))
+	require.Equal(t, []string{"b", "d", "m1", "m2", "m3"}, projected.Attrs)
+	for i, want := range []int32{1, 3, 5, 6, 7} {
+		require.Equal(t, want, vector.MustFixedCol[int32](projected.Vecs[i])[0])
+	}
+	require.Equal(t, uint16(1), sortKey)
+	require.Equal(t, 2, projected.RowCount())
+
+	// Dropping the sort key leaves the block without one.
+	_, sortKey, err = projectColumns(bat, []uint16{0, 2}, appendableMetaColumns, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint16(math.MaxUint16), sortKey)
+
+	// The metadata columns cannot be projected as data columns.
+	_, _, err = projectColumns(bat, []uint16{5}, appendableMetaColumns, 0)
+	require.Error(t, err)
+
+	options := newBackupOptions(WithColumnProjection(map[uint64][]uint16{1: {1, 3}}))
+	same, _, err := options.project(2, bat, appendableMetaColumns, 0)
+	require.NoError(t, err)
+	require.Equal(t, bat, same)
+}
+
+func TestEncryptedFS(t *testing.T) {
+	ctx := context.Background()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 16))
+	require.NoError(t, err)
+	raw := newBackupTestFS(t)
+	fs, err := NewEncryptedFS(raw, EncryptionKey{ID: "test", Block: block})
+	require.NoError(t, err)
+	content := make([]byte, 2*encryptedChunkSize+5)
+	for i := range content {
+		content[i] = byte(i * 31)
+	}
+
+	// Written whole or streamed, the content reads back at any offset,
+	// across the chunks.
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, len(content)} {
+		for _, streamed := range []bool{false, true} {
+			name := fmt.Sprintf("%d-%v", size, streamed)
+			entry := fileservice.IOEntry{Size: int64(size), Data: content[:size]}
+			if streamed {
+				entry = fileservice.IOEntry{Size: -1, ReaderForWrite: bytes.NewReader(content[:size])}
+			}
+			require.NoError(t, fs.Write(ctx, fileservice.IOVector{FilePath: name, Entries: []fileservice.IOEntry{entry}}))
+			stat, err := raw.StatFile(ctx, name)
+			require.NoError(t, err)
+			require.Equal(t, encryptedSize(int64(size)), stat.Size, name)
+			stat, err = fs.StatFile(ctx, name)
+			require.NoError(t, err)
+			require.Equal(t, int64(size), stat.Size, name)
+			buf, err := readBackupFile(ctx, fs, name)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(content[:size], buf), name)
+			for _, offset := range []int{1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 3} {
+				if offset+2 > size {
+					continue
+				}
+				vector := &fileservice.IOVector{
+					FilePath: name,
+					Entries: []fileservice.IOEntry{
+						{Offset: int64(offset), Size: 2},
+						{Offset: int64(offset), Size: -1},
+					},
+				}
+				require.NoError(t, fs.Read(ctx, vector))
+				require.Equal(t, content[offset:offset+2], vector.Entries[0].Data, name)
+				require.Equal(t, content[offset:size], vector.Entries[1].Data, name)
+			}
+		}
+	}
+	err = fs.Read(ctx, &fileservice.IOVector{
+		FilePath: "1-false",
+		Entries:  []fileservice.IOEntry{{Offset: 0, Size: 2}},
+	})
+	require.Error(t, err)
+
+	// A file that was changed fails to read: a byte of a chunk flipped,
+	// two chunks swapped, the last chunk cut or taken from another file.
+	name := fmt.Sprintf("%d-false", len(content))
+	sealed, err := readBackupFile(ctx, raw, name)
+	require.NoError(t, err)
+	other, err := readBackupFile(ctx, raw, fmt.Sprintf("%d-true", len(content)))
+	require.NoError(t, err)
+	chunk := func(buf []byte, i int) []byte {
+		start := encryptedHeaderLen + i*encryptedChunkLen
+		return buf[start:min(start+encryptedChunkLen, len(buf))]
+	}
+	tampered := map[string][]byte{
+		"flipped": func() []byte {
+			buf := bytes.Clone(sealed)
+			buf[encryptedHeaderLen+encryptedChunkLen+10] ^= 1
+			return buf
+		}(),
+		"swapped": func() []byte {
+			buf := bytes.Clone(sealed)
+			copy(chunk(buf, 0), chunk(sealed, 1))
+			copy(chunk(buf, 1), chunk(sealed, 0))
+			return buf
+		}(),
+		"cut": sealed[:encryptedHeaderLen+2*encryptedChunkLen],
+		"moved": append(bytes.Clone(sealed[:encryptedHeaderLen+2*encryptedChunkLen]),
+			chunk(other, 2)...),
+	}
+	for kind, buf := range tampered {
+		require.NoError(t, writeBackupFile(ctx, raw, name, buf))
+		_, err = readBackupFile(ctx, fs, name)
+		require.ErrorContains(t, err, "does not authenticate", kind)
+	}
+}
+
+func TestUpgradeColumns(t *testing.T) {
+	mp := mpool.MustNewZero()
+	// Two data columns followed by the aBlock metadata columns.
+	bat := newInt32Batch(t, mp,
+		[]int32{0, 0, 0, 0}, []int32{1, 2, 3, 4},
+		[]int32{5, 5, 5, 5}, []int32{6, 6, 6, 6}, []int32{7, 7, 7, 7})
+	bat.Vecs[0].Free(mp)
+	bat.Vecs[0] = vector.NewVec(types.T_int32.ToType())
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[0],
+		[]int32{math.MinInt32, 0, 0, math.MaxInt32}, []bool{false, true, false, false}, mp))
+	options := newBackupOptions(
+		WithBatchAllocators(mp, mp),
+		WithColumnTypeUpgrades(map[uint64]map[uint16]types.Type{
+			1: {0: types.T_int64.ToType()},
+		}))
+
+	upgraded, err := options.upgradeColumns(1, bat)
+	require.NoError(t, err)
+	require.Equal(t, types.T_int64, upgraded.Vecs[0].GetType().Oid)
+	require.Equal(t, []int64{math.MinInt32, 0, 0, math.MaxInt32}, vector.MustFixedCol[int64](upgraded.Vecs[0]))
+	require.True(t, upgraded.Vecs[0].IsNull(1))
+	require.False(t, upgraded.Vecs[0].IsNull(0))
+	for i, want := range []int32{1, 5, 6, 7} {
+		vec := upgraded.Vecs[i+1]
+		require.Equal(t, types.T_int32, vec.GetType().Oid)
+		require.Equal(t, want, vector.MustFixedCol[int32](vec)[0])
+	}
+	// Upgrading again does nothing, the other tables are left as they are.
+	again, err := options.upgradeColumns(1, upgraded)
+	require.NoError(t, err)
+	require.Equal(t, upgraded, again)
+	other, err := options.upgradeColumns(2, upgraded)
+	require.NoError(t, err)
+	require.Equal(t, types.T_int64, other.Vecs[0].GetType().Oid)
+
+	// A metadata column cannot be upgraded.
+	options = newBackupOptions(
+		WithBatchAllocators(mp, mp),
+		WithColumnTypeUpgrades(map[uint64]map[uint16]types.Type{
+			1: {2: types.T_int64.ToType()},
+		}))
+	_, err = options.upgradeColumns(1, newInt32Batch(t, mp, []int32{0}, []int32{1}, []int32{2}, []int32{3}, []int32{4}))
+	require.Error(t, err)
+
+	// Narrowing casts what fits and fails on what does not.
+	vec := vector.NewVec(types.T_int64.ToType())
+	require.NoError(t, vector.AppendFixedList(vec, []int64{1, math.MaxInt32 + 1}, nil, mp))
+	_, err = castColumn(vec, types.T_int32.ToType(), mp)
+	require.ErrorContains(t, err, "does not fit")
+	_, err = castColumn(vec, types.T_uint8.ToType(), mp)
+	require.ErrorContains(t, err, "does not fit")
+	vec.Free(mp)
+	vec = vector.NewVec(types.T_int32.ToType())
+	require.NoError(t, vector.AppendFixedList(vec, []int32{-1}, nil, mp))
+	_, err = castColumn(vec, types.T_uint64.ToType(), mp)
+	require.ErrorContains(t, err, "does not fit")
+	floats, err := castColumn(vec, types.T_float64.ToType(), mp)
+	require.NoError(t, err)
+	require.Equal(t, []float64{-1}, vector.MustFixedCol[float64](floats))
+	floats.Free(mp)
+
+	// Strings are cast to strings wide enough for them.
+	strs := vector.NewVec(types.New(types.T_varchar, 10, 0))
+	require.NoError(t, vector.AppendBytes(strs, []byte("héllo"), false, mp))
+	require.NoError(t, vector.AppendBytes(strs, nil, true, mp))
+	wider, err := castColumn(strs, types.New(types.T_varchar, 5, 0), mp)
+	require.NoError(t, err)
+	require.Equal(t, "héllo", string(wider.GetBytesAt(0)))
+	require.True(t, wider.IsNull(1))
+	wider.Free(mp)
+	_, err = castColumn(strs, types.New(types.T_char, 4, 0), mp)
+	require.ErrorContains(t, err, "does not fit")
+
+	// Other casts are not supported.
+	_, err = castColumn(vec, types.T_varchar.ToType(), mp)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported))
+	_, err = castColumn(strs, types.T_int64.ToType(), mp)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrNotSupported))
+	vec.Free(mp)
+	strs.Free(mp)
+}
+
+func appendBlockMetaRow(bat *containers.Batch, blkID types.Blockid, commit types.TS) {
+	for i, attr := range bat.Attrs {
+		switch attr {
+		case catalog.BlockMeta_ID:
+			bat.Vecs[i].Append(blkID, false)
+		case catalog.BlockMeta_CommitTs:
+			bat.Vecs[i].Append(commit, false)
+		default:
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
+
+func appendTxnRow(bat *containers.Batch, tid uint64) {
+	for i, attr := range bat.Attrs {
+		if attr == SnapshotAttr_TID {
+			bat.Vecs[i].Append(tid, false)
+		} else {
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
+
+// overlapCheckpointData returns checkpoint data with blocks in the
+// compaction window of ts, as TestResolveBlockOverlap describes them.
+func overlapCheckpointData() (*CheckpointData, types.TS, [4]types.Blockid) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+	ts := types.BuildTS(10, 0)
+	a, b, c, d := newBlock(), newBlock(), newBlock(), newBlock()
+
+	// a: merged at 5, its aBlock rows committed at 15, after ts.
+	// b: merged at 15, after ts, the aBlock rows committed at 5.
+	// c: only in the meta insert batch.
+	// d: both visible at ts, not a compaction window.
+	for _, row := range []struct {
+		id     types.Blockid
+		commit int64
+	}{{a, 5}, {b, 15}, {c, 5}, {d, 3}} {
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], row.id, types.BuildTS(row.commit, 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	for _, row := range []struct {
+		id     types.Blockid
+		commit int64
+	}{{a, 15}, {b, 5}, {d, 4}} {
+		appendBlockMetaRow(data.bats[BLKCNMetaInsertIDX], row.id, types.BuildTS(row.commit, 0))
+	}
+	data.UpdateBlockInsertBlkMeta(1, 0, 4)
+	data.resetTableMeta(1, CNBlockInsert, 0, 3)
+	return data, ts, [4]types.Blockid{a, b, c, d}
+}
+
+func TestResolveBlockOverlap(t *testing.T) {
+	data, ts, blocks := overlapCheckpointData()
+	defer data.Close()
+	a, b, c, d := blocks[0], blocks[1], blocks[2], blocks[3]
+
+	require.Equal(t, 2, resolveBlockOverlap(context.Background(), data, ts))
+
+	ids := func(idx uint16) []types.Blockid {
+		bat := data.bats[idx]
+		res := make([]types.Blockid, 0, bat.Length())
+		for i := 0; i < bat.Length(); i++ {
+			res = append(res, bat.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid))
+		}
+		return res
+	}
+	require.Equal(t, []types.Blockid{a, c, d}, ids(BLKMetaInsertIDX))
+	require.Equal(t, 3, data.bats[BLKMetaInsertTxnIDX].Length())
+	require.Equal(t, []types.Blockid{b, d}, ids(BLKCNMetaInsertIDX))
+	require.Equal(t, uint64(3), data.meta[1].tables[BlockInsert].End)
+	require.Equal(t, uint64(2), data.meta[1].tables[CNBlockInsert].End)
+}
+
+func TestResolveDuplicateBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+	a, b, c := newBlock(), newBlock(), newBlock()
+
+	// a is listed twice in the meta insert batch, the copy committed
+	// last first. b is listed three times in the CN batch. c is listed
+	// once in each batch, which is not a duplicate.
+	for _, row := range []struct {
+		id     types.Blockid
+		commit int64
+	}{{a, 7}, {c, 5}, {a, 3}} {
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], row.id, types.BuildTS(row.commit, 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	for _, row := range []struct {
+		id     types.Blockid
+		commit int64
+	}{{b, 2}, {c, 6}, {b, 9}, {b, 4}} {
+		appendBlockMetaRow(data.bats[BLKCNMetaInsertIDX], row.id, types.BuildTS(row.commit, 0))
+	}
+	data.UpdateBlockInsertBlkMeta(1, 0, 3)
+	data.resetTableMeta(1, CNBlockInsert, 0, 4)
+
+	strict := newBackupOptions(WithStrictBlockMeta())
+	_, err := strict.resolveDuplicateBlocks(ctx, data)
+	require.Error(t, err)
+	require.Equal(t, 3, data.bats[BLKMetaInsertIDX].Length())
+
+	options := newBackupOptions()
+	dropped, err := options.resolveDuplicateBlocks(ctx, data)
+	require.NoError(t, err)
+	require.Equal(t, 3, dropped)
+
+	rows := func(idx uint16) map[types.Blockid]int64 {
+		bat := data.bats[idx]
+		res := make(map[types.Blockid]int64, bat.Length())
+		for i := 0; i < bat.Length(); i++ {
+			commit := bat.GetVectorByName(catalog.BlockMeta_CommitTs).Get(i).(types.TS)
+			res[bat.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid)] = commit.Physical()
+		}
+		require.Equal(t, bat.Length(), len(res))
+		return res
+	}
+	require.Equal(t, map[types.Blockid]int64{a: 7, c: 5}, rows(BLKMetaInsertIDX))
+	require.Equal(t, 2, data.bats[BLKMetaInsertTxnIDX].Length())
+	require.Equal(t, map[types.Blockid]int64{b: 9, c: 6}, rows(BLKCNMetaInsertIDX))
+	require.Equal(t, uint64(2), data.meta[1].tables[BlockInsert].End)
+	require.Equal(t, uint64(2), data.meta[1].tables[CNBlockInsert].End)
+	require.Equal(t, []DuplicateBlockRow{
+		{Block: a.String(), Batch: "BLKMetaInsert", Kept: types.BuildTS(7, 0), Dropped: types.BuildTS(3, 0)},
+		{Block: b.String(), Batch: "BLKCNMetaInsert", Kept: types.BuildTS(9, 0), Dropped: types.BuildTS(2, 0)},
+		{Block: b.String(), Batch: "BLKCNMetaInsert", Kept: types.BuildTS(9, 0), Dropped: types.BuildTS(4, 0)},
+	}, options.result.DuplicateBlockRows)
+}
+
+func TestForEachBlockMeta(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	fs := newBackupTestFS(t)
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	newLocation := func() objectio.Location {
+		return objectio.BuildLocation(
+			objectio.BuildObjectName(objectio.NewSegmentid(), 0), objectio.NewExtent(0, 0, 1, 1), 1, 0)
+	}
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+
+	type row struct {
+		source  BlockMetaSource
+		row     int
+		id      types.Blockid
+		metaLoc objectio.Location
+		delta   objectio.Location
+		aBlock  bool
+		sorted  bool
+		commit  types.TS
+		tid     uint64
+	}
+	// Table 1 has two rows in each batch, table 2 one. The CN rows have
+	// no txn batch, their table is that of their range.
+	want := []row{
+		{BlockMetaInsert, 0, newBlock(), nil, newLocation(), true, false, types.BuildTS(1, 0), 1},
+		{BlockMetaInsert, 1, newBlock(), newLocation(), newLocation(), false, true, types.BuildTS(2, 0), 1},
+		{BlockMetaInsert, 2, newBlock(), nil, newLocation(), false, true, types.BuildTS(3, 0), 2},
+		{BlockMetaCN, 0, newBlock(), newLocation(), newLocation(), false, true, types.BuildTS(4, 0), 1},
+		{BlockMetaCN, 1, newBlock(), nil, newLocation(), false, false, types.BuildTS(5, 0), 1},
+		{BlockMetaCN, 2, newBlock(), newLocation(), newLocation(), false, true, types.BuildTS(6, 0), 2},
+	}
+	for _, r := range want {
+		appendFixtureRow(data.bats[r.source], map[string]any{
+			catalog.BlockMeta_ID:         r.id,
+			catalog.BlockMeta_MetaLoc:    []byte(r.metaLoc),
+			catalog.BlockMeta_DeltaLoc:   []byte(r.delta),
+			catalog.BlockMeta_EntryState: r.aBlock,
+			catalog.BlockMeta_Sorted:     r.sorted,
+			catalog.BlockMeta_CommitTs:   r.commit,
+		})
+		if r.source == BlockMetaInsert {
+			appendTxnRow(data.bats[BLKMetaInsertTxnIDX], r.tid)
+		}
+	}
+	data.UpdateBlockInsertBlkMeta(1, 0, 2)
+	data.UpdateBlockInsertBlkMeta(2, 2, 3)
+	data.UpdateBlockDeleteBlkMeta(1, 0, 2)
+	data.UpdateBlockDeleteBlkMeta(2, 2, 3)
+
+	check := func(data *CheckpointData) {
+		got := make([]row, 0, len(want))
+		require.NoError(t, data.ForEachBlockMeta(func(view BlockMetaView) error {
+			got = append(got, row{
+				source:  view.Source(),
+				row:     view.Row(),
+				id:      view.Blockid(),
+				metaLoc: view.MetaLoc(),
+				delta:   view.DeltaLoc(),
+				aBlock:  view.EntryState(),
+				sorted:  view.Sorted(),
+				commit:  view.CommitTs(),
+				tid:     view.TID(),
+			})
+			return nil
+		}))
+		require.Equal(t, len(want), len(got))
+		for i, w := range want {
+			g := got[i]
+			require.Equal(t, w.metaLoc.IsEmpty(), g.metaLoc.IsEmpty(), i)
+			if !w.metaLoc.IsEmpty() {
+				require.Equal(t, w.metaLoc.String(), g.metaLoc.String(), i)
+			}
+			require.Equal(t, w.delta.String(), g.delta.String(), i)
+			w.metaLoc, w.delta = nil, nil
+			g.metaLoc, g.delta = nil, nil
+			require.Equal(t, w, g, i)
+		}
+	}
+	check(data)
+
+	cnLocation, _, _, err := data.WriteTo(fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+	loaded, err := getCheckpointData(ctx, "", fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer loaded.Close()
+	check(loaded)
+
+	// The walk stops at the first error.
+	visited := 0
+	err = loaded.ForEachBlockMeta(func(view BlockMetaView) error {
+		visited++
+		if view.Source() == BlockMetaCN {
+			return moerr.NewInternalErrorNoCtx("stop")
+		}
+		return nil
+	})
+	require.Error(t, err)
+	require.Equal(t, 4, visited)
+}
+
+func TestCheckWrittenBlocks(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	// Two batches end up in a single block, e.g. a writer that coalesces.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteBatch(newInt32Batch(t, mp, []int32{1, 2, 3, 4}))
+	require.NoError(t, err)
+	written, err := syncObject(ctx, writer, name)
+	require.NoError(t, err)
+
+	blocks := []*blockData{{num: 0}, {num: 1}}
+	require.Error(t, checkWrittenBlocks(written, blocks))
+	require.NoError(t, checkWrittenBlocks(written, blocks[:1]))
+}
+
+func TestCheckpointCompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	for _, algo := range []uint8{compress.None, compress.Lz4} {
+		t.Run(compress.T(algo).String(), func(t *testing.T) {
+			fs := newBackupTestFS(t)
+			data := NewCheckpointData("", mpool.MustNewZero())
+			defer data.Close()
+			for i := 0; i < 3; i++ {
+				blkID := *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+				appendBlockMetaRow(data.bats[BLKMetaInsertIDX], blkID, types.BuildTS(int64(i+1), 0))
+				appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+			}
+			data.UpdateBlockInsertBlkMeta(1, 0, 3)
+			data.SetCompression(algo)
+
+			cnLocation, _, _, err := data.WriteTo(fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+			require.NoError(t, err)
+			require.Equal(t, algo, cnLocation.Extent().Alg())
+
+			loaded, err := getCheckpointData(ctx, "", fs, cnLocation, CheckpointCurrentVersion)
+			require.NoError(t, err)
+			defer loaded.Close()
+			diff := CompareCheckpointData(data, loaded, MetaIDX, TNMetaIDX)
+			require.True(t, diff.Empty(), diff.String())
+		})
+	}
+}
+
+func TestRewriteFiles(t *testing.T) {
+	files := RewriteFiles{
+		Rewritten:  []string{"obj-b", "obj-a"},
+		Converted:  []string{"obj-c_01000"},
+		Checkpoint: []string{"ckp-2", "ckp-1"},
+	}
+	files.sort()
+	require.Equal(t, []string{"obj-a", "obj-b"}, files.Rewritten)
+	require.Equal(t, []string{"obj-c_01000"}, files.Converted)
+	require.Equal(t, []string{"ckp-1", "ckp-2"}, files.Checkpoint)
+	require.Equal(t, []string{"ckp-1", "ckp-2", "obj-a", "obj-b", "obj-c_01000"}, files.All())
+	require.Empty(t, (&RewriteFiles{}).All())
+}
+
+func TestRewriteFilesRestoreOrder(t *testing.T) {
+	files := RewriteFiles{
+		Rewritten:  []string{"obj-b", "obj-a", "obj-d"},
+		Tombstones: []string{"obj-b"},
+		Converted:  []string{"obj-c_01000"},
+		Checkpoint: []string{"ckp-2", "ckp-1"},
+		// The meta object sorts first, it is still restored last.
+		Meta: "ckp-1",
+	}
+	files.sort()
+	require.Equal(t, []RestoreFile{
+		{Name: "obj-a", Role: FileRoleData},
+		{Name: "obj-c_01000", Role: FileRoleData},
+		{Name: "obj-d", Role: FileRoleData},
+		{Name: "obj-b", Role: FileRoleTombstone},
+		{Name: "ckp-2", Role: FileRoleCheckpoint},
+		{Name: "ckp-1", Role: FileRoleCheckpoint},
+	}, files.RestoreOrder())
+	require.Equal(t, "tombstone", FileRoleTombstone.String())
+	require.Empty(t, (&RewriteFiles{}).RestoreOrder())
+}
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files of the tests")
+
+// requireGolden compares got to the golden file testdata/name, which
+// -update-golden rewrites instead.
+func requireGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+}
+
+func TestRewriteSummary(t *testing.T) {
+	result := &RewriteResult{
+		Phase:               6,
+		Partial:             true,
+		Skipped:             []SkippedObject{{Name: "obj-e", Reason: "timeout"}},
+		SortFallbacks:       2,
+		SoftDeleteConflicts: []SoftDeleteConflict{{Object: "obj-f"}},
+		Stats:               RewriteStats{InputBytes: 3 << 20, OutputBytes: 2 << 20},
+		WrittenObjects:      3,
+		WrittenBytes:        1536 << 10,
+		Files: RewriteFiles{
+			Rewritten:  []string{"obj-a", "obj-b"},
+			Tombstones: []string{"obj-b"},
+			Converted:  []string{"obj-c_01000"},
+			Checkpoint: []string{"ckp-1", "ckp-2"},
+			Meta:       "ckp-1",
+		},
+		Exported: []string{"obj-c_01000.csv"},
+		Emptied:  []string{"obj-g"},
+		Tables: []TableBytes{
+			{Table: 1000, Bytes: 100},
+			{Table: 1001, Bytes: 700 << 10},
+			{Table: 1002, Bytes: 300 << 10},
+			{Table: 1003, Bytes: 512},
+			{Table: 1004, Bytes: 1 << 20},
+			{Table: 1005, Bytes: 512},
+		},
+	}
+	summary := result.Summary()
+	// The tables of the most bytes come first, those of the same bytes
+	// by table.
+	require.Equal(t, []TableBytes{
+		{Table: 1004, Bytes: 1 << 20},
+		{Table: 1001, Bytes: 700 << 10},
+		{Table: 1002, Bytes: 300 << 10},
+		{Table: 1003, Bytes: 512},
+		{Table: 1005, Bytes: 512},
+	}, summary.TopTables)
+	requireGolden(t, "rewrite_summary.golden", []byte(result.String()+"\n"))
+	data, err := json.MarshalIndent(summary, "", "  ")
+	require.NoError(t, err)
+	requireGolden(t, "rewrite_summary.json.golden", append(data, '\n'))
+
+	// A clean rewrite has no warnings, still listed in the JSON.
+	data, err = json.Marshal((&RewriteResult{Phase: 6}).Summary())
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"warnings":[]`)
+	require.Equal(t,
+		"phase 6, input 0B, output 0B, written 0 objects 0B, files rewritten=0 tombstones=0 converted=0 checkpoint=0 exported=0 emptied=0",
+		(&RewriteResult{Phase: 6}).String())
+}
+
+func TestNormalizeLocations(t *testing.T) {
+	ckp := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	shared := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	other := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	var extent objectio.Extent
+	location := func(name objectio.ObjectName, blk uint16) objectio.Location {
+		return objectio.BuildLocation(name, extent, 10, blk)
+	}
+
+	res := NormalizeLocations([]*objectio.BackupObject{
+		{Location: location(ckp, 0), NeedCopy: true},
+		{Location: location(shared, 0), CrateTS: types.BuildTS(5, 0)},
+		{Location: location(other, 0), CrateTS: types.BuildTS(4, 0), NeedCopy: true},
+		{Location: location(shared, 1), CrateTS: types.BuildTS(3, 0), NeedCopy: true},
+		{Location: location(shared, 2), CrateTS: types.BuildTS(6, 0)},
+	})
+	require.Len(t, res, 3)
+	require.Equal(t, ckp.String(), res[0].Location.Name().String())
+	require.Equal(t, shared.String(), res[1].Location.Name().String())
+	require.Equal(t, uint16(0), res[1].Location.ID())
+	require.True(t, res[1].NeedCopy)
+	require.Equal(t, types.BuildTS(3, 0), res[1].CrateTS)
+	require.Equal(t, other.String(), res[2].Location.Name().String())
+}
+
+func TestTrimStaleBlock(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	stale := writeTestObject(t, fs, math.MaxUint16, newInt32Batch(t, mp, []int32{}))
+	objectsData := func() map[string]*fileData {
+		return map[string]*fileData{
+			stale.Name().String(): {
+				name:          stale.Name(),
+				isDeleteBatch: true,
+				data: map[uint16]*blockData{
+					0: {
+						location:  stale,
+						blockType: objectio.SchemaData,
+						isABlock:  true,
+						sortKey:   math.MaxUint16,
+					},
+				},
+			},
+		}
+	}
+
+	stats := NewBackupStats()
+	data := objectsData()
+	isCkpChange, err := trimObjectsData(ctx, fs, types.BuildTS(10, 0), &data, newBackupOptions(WithBackupStats(stats)))
+	require.NoError(t, err)
+	require.True(t, isCkpChange)
+	block := data[stale.Name().String()].data[0]
+	require.True(t, block.dropped)
+	require.Nil(t, block.data)
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseTrim).Get(StatStaleBlocks))
+
+	data = objectsData()
+	_, err = trimObjectsData(ctx, fs, types.BuildTS(10, 0), &data, newBackupOptions(WithStrictBlockLoad()))
+	require.Error(t, err)
+}
+
+func TestTrimDuplicateRowIDs(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	// An aBlock whose rows 0 and 2, and 1 and 4, have the same rowid.
+	blkID := objectio.NewBlockid(objectio.NewSegmentid(), 0, 0)
+	rowids := []types.Rowid{
+		*types.NewRowid(blkID, 0), *types.NewRowid(blkID, 1), *types.NewRowid(blkID, 0),
+		*types.NewRowid(blkID, 3), *types.NewRowid(blkID, 1),
+	}
+	bat := newInt32Batch(t, mp, []int32{1, 2, 3, 4, 5})
+	bat.Vecs = append(bat.Vecs,
+		vector.NewVec(types.T_Rowid.ToType()),
+		vector.NewVec(types.T_TS.ToType()),
+		vector.NewVec(types.T_bool.ToType()))
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[1], rowids, nil, mp))
+	commits := make([]types.TS, len(rowids))
+	for i := range commits {
+		commits[i] = types.BuildTS(1, 0)
+	}
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[2], commits, nil, mp))
+	require.NoError(t, vector.AppendFixedList(bat.Vecs[3], make([]bool, len(rowids)), nil, mp))
+	location := writeTestObject(t, fs, math.MaxUint16, bat)
+	objectsData := func() map[string]*fileData {
+		return map[string]*fileData{
+			location.Name().String(): {
+				name:          location.Name(),
+				isDeleteBatch: true,
+				data: map[uint16]*blockData{
+					0: {
+						tid:       7,
+						location:  location,
+						blockType: objectio.SchemaData,
+						isABlock:  true,
+						sortKey:   math.MaxUint16,
+					},
+				},
+			},
+		}
+	}
+
+	// Without the scan the block is trimmed as it is.
+	result := &RewriteResult{}
+	data := objectsData()
+	_, err := trimObjectsData(ctx, fs, types.BuildTS(10, 0), &data,
+		newBackupOptions(WithRewriteResult(result)))
+	require.NoError(t, err)
+	require.Empty(t, result.DuplicateRowIDs)
+
+	stats := NewBackupStats()
+	data = objectsData()
+	_, err = trimObjectsData(ctx, fs, types.BuildTS(10, 0), &data,
+		newBackupOptions(WithRewriteResult(result), WithBackupStats(stats), WithDuplicateRowIDScan()))
+	require.NoError(t, err)
+	require.Equal(t, []DuplicateRowID{
+		{Table: 7, Block: location.String(), RowID: rowids[0].String(), Rows: []int{0, 2}},
+		{Table: 7, Block: location.String(), RowID: rowids[1].String(), Rows: []int{1, 4}},
+	}, result.DuplicateRowIDs)
+	require.Equal(t, int64(2), stats.Phase(StatsPhaseTrim).Get(StatDuplicateRowIDs))
+	require.Len(t, stats.Warnings(), 2)
+	require.Equal(t, WarnDuplicateRowID, stats.Warnings()[0].Code)
+	require.Contains(t, result.Summary().Warnings, WarningCount{WarnDuplicateRowID, 2})
+}
+
+func TestSetBlockLocation(t *testing.T) {
+	location := objectio.MockLocation(objectio.MockObjectName())
+	old := []byte("old")
+	for _, tc := range []struct {
+		kind      rowKind
+		blockType objectio.DataMetaType
+		isABlock  bool
+		updated   bool
+	}{
+		{insertRowKind, objectio.SchemaTombstone, false, true},
+		{insertRowKind, objectio.SchemaTombstone, true, true},
+		{deleteRowKind, objectio.SchemaTombstone, false, true},
+		{deleteRowKind, objectio.SchemaTombstone, true, true},
+		// The rows of a data block are updated with its tombstone.
+		{insertRowKind, objectio.SchemaData, false, false},
+		{insertRowKind, objectio.SchemaData, true, false},
+		{deleteRowKind, objectio.SchemaData, false, false},
+		{deleteRowKind, objectio.SchemaData, true, false},
+	} {
+		data := NewCheckpointData("", mpool.MustNewZero())
+		for _, idx := range []uint16{BLKMetaInsertIDX, BLKMetaInsertTxnIDX, BLKCNMetaInsertIDX} {
+			for row := 0; row < 2; row++ {
+				appendFixtureRow(data.bats[idx], map[string]any{catalog.BlockMeta_DeltaLoc: old})
+			}
+		}
+		block := &blockData{blockType: tc.blockType, isABlock: tc.isABlock, location: location}
+		name := fmt.Sprintf("kind %d type %d aBlock %v", tc.kind, tc.blockType, tc.isABlock)
+		require.Equal(t, tc.updated, setBlockLocation(data, tc.kind, block, 1, location), name)
+		expected := map[uint16][]string{
+			BLKMetaInsertIDX:    {"old", "old"},
+			BLKMetaInsertTxnIDX: {"old", "old"},
+			BLKCNMetaInsertIDX:  {"old", "old"},
+		}
+		if tc.updated {
+			expected[BLKMetaInsertIDX][1] = string(location)
+			expected[BLKMetaInsertTxnIDX][1] = string(location)
+		}
+		for idx, rows := range expected {
+			deltaLoc := data.bats[idx].GetVectorByName(catalog.BlockMeta_DeltaLoc)
+			for row, want := range rows {
+				require.Equal(t, want, string(deltaLoc.Get(row).([]byte)), name)
+			}
+		}
+		data.Close()
+	}
+}
+
+func TestConvertedNameSegmentRemap(t *testing.T) {
+	src := objectio.NewSegmentid()
+	target := objectio.NewSegmentid()
+	kept := objectio.NewSegmentid()
+	options := newBackupOptions(WithSegmentRemap(map[objectio.Segmentid]objectio.Segmentid{
+		*src: *target,
+	}))
+
+	for num := uint16(0); num < 3; num++ {
+		name := options.convertedName(objectio.BuildObjectName(src, num))
+		require.Equal(t, *target, name.SegmentId())
+		require.Equal(t, 1000+num, name.Num())
+		blkID := objectio.BuildObjectBlockid(name, 0)
+		require.Equal(t, *target, *blkID.Segment())
+		rowid := types.NewRowid(blkID, 5)
+		require.Equal(t, *target, *rowid.BorrowSegmentID())
+	}
+
+	name := options.convertedName(objectio.BuildObjectName(kept, 2))
+	require.Equal(t, *kept, name.SegmentId())
+	name = newBackupOptions().convertedName(objectio.BuildObjectName(src, 2))
+	require.Equal(t, *src, name.SegmentId())
+}
+
+func TestConvertedObjectSkipExisting(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	dstFs := newBackupTestFS(t)
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 1000)
+	seeded, err := newBackupOptions().writeConverted(ctx, dstFs, name, newInt32Batch(t, mp, []int32{1, 2, 3}, []int32{4, 5, 6}), 0)
+	require.NoError(t, err)
+
+	converted := 0
+	convert := func() (*writtenObject, error) {
+		converted++
+		return seeded, nil
+	}
+
+	written, err := newBackupOptions(WithSkipExisting()).convertedObject(ctx, nil, dstFs, name, name, convert)
+	require.NoError(t, err)
+	require.Equal(t, 0, converted)
+	require.Equal(t, seeded.name, written.name)
+	require.Equal(t, seeded.extent, written.extent)
+	require.Equal(t, seeded.rows, written.rows)
+	require.Equal(t, seeded.stats, written.stats)
+	require.Equal(t, seeded.location(0), written.location(0))
+
+	// Not in the destination, the aBlock is converted.
+	missing := objectio.BuildObjectName(objectio.NewSegmentid(), 1000)
+	_, err = newBackupOptions(WithSkipExisting()).convertedObject(ctx, nil, dstFs, missing, missing, convert)
+	require.NoError(t, err)
+	require.Equal(t, 1, converted)
+
+	// Without the option the existing object is not looked at.
+	_, err = newBackupOptions().convertedObject(ctx, nil, dstFs, name, name, convert)
+	require.NoError(t, err)
+	require.Equal(t, 2, converted)
+
+	// An object without its journal entry, e.g. one whose writer died,
+	// is written again.
+	require.NoError(t, dstFs.Delete(ctx, writtenEntryName(name)))
+	options := newBackupOptions(WithSkipExisting())
+	written, err = options.convertedObject(ctx, nil, dstFs, name, name, func() (*writtenObject, error) {
+		converted++
+		return options.writeConverted(ctx, dstFs, name, newInt32Batch(t, mp, []int32{1, 2, 3}, []int32{4, 5, 6}), 0)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, converted)
+	loaded, err := loadWrittenObject(ctx, dstFs, name)
+	require.NoError(t, err)
+	require.Equal(t, written.stats, loaded.stats)
+}
+
+// tornFS is a destination whose writes are not atomic: a write of the
+// file tear leaves the first half of it behind and fails, as a crash
+// in the middle of it would.
+type tornFS struct {
+	fileservice.FileService
+	tear string
+}
+
+func (f *tornFS) AtomicWrites() bool {
+	return false
+}
+
+func (f *tornFS) Write(ctx context.Context, vector fileservice.IOVector) error {
+	if vector.FilePath != f.tear {
+		return f.FileService.Write(ctx, vector)
+	}
+	data := vector.Entries[0].Data
+	half := data[:len(data)/2]
+	if err := f.FileService.Write(ctx, fileservice.IOVector{
+		FilePath: vector.FilePath,
+		Entries: []fileservice.IOEntry{
+			{Offset: 0, Size: int64(len(half)), Data: half},
+		},
+	}); err != nil {
+		return err
+	}
+	return moerr.NewInternalErrorNoCtx("crash writing %s", vector.FilePath)
+}
+
+func TestStagedWrites(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 1000)
+	dstFs := &tornFS{FileService: newBackupTestFS(t), tear: name.String()}
+
+	require.True(t, stagesWrites(StagedWritesAuto, dstFs))
+	require.False(t, stagesWrites(StagedWritesOff, dstFs))
+	require.False(t, stagesWrites(StagedWritesAuto, dstFs.FileService))
+	require.True(t, stagesWrites(StagedWritesOn, dstFs.FileService))
+
+	converted := 0
+	convert := func(session *BackupSession) (*writtenObject, error) {
+		options := newBackupOptions(WithBackupSession(session), WithSkipExisting())
+		return options.convertedObject(ctx, session, dstFs, name, name, func() (*writtenObject, error) {
+			converted++
+			return options.writeConverted(ctx, dstFs, name,
+				newInt32Batch(t, mp, []int32{1, 2, 3}, []int32{4, 5, 6}), 0)
+		})
+	}
+
+	// The session crashes while it finalizes the object, the staged
+	// object is complete, the object of its name is not.
+	session, err := NewBackupSession(ctx, dstFs)
+	require.NoError(t, err)
+	require.True(t, session.StagesWrites())
+	_, err = convert(session)
+	require.Error(t, err)
+	require.False(t, session.finalized(name.String()))
+	staged, err := dstFs.StatFile(ctx, stagedName(name.String()))
+	require.NoError(t, err)
+	torn, err := dstFs.StatFile(ctx, name.String())
+	require.NoError(t, err)
+	require.Equal(t, staged.Size/2, torn.Size)
+
+	// The next session discards the staged object and writes the
+	// object again rather than reusing it.
+	dstFs.tear = ""
+	session, err = NewBackupSession(ctx, dstFs)
+	require.NoError(t, err)
+	entries, err := fileservice.SubPath(dstFs, StagedWritesDir).List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.False(t, session.finalized(name.String()))
+	written, err := convert(session)
+	require.NoError(t, err)
+	require.Equal(t, 2, converted)
+	require.True(t, session.finalized(name.String()))
+	_, err = dstFs.StatFile(ctx, stagedName(name.String()))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound), err)
+
+	loaded, err := loadWrittenObject(ctx, dstFs, name)
+	require.NoError(t, err)
+	require.Equal(t, written.extent, loaded.extent)
+	require.Equal(t, written.rows, loaded.rows)
+	bat, err := blockio.LoadOneBlock(ctx, dstFs, written.location(0), objectio.SchemaData)
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 2, 3}, vector.MustFixedCol[int32](bat.Vecs[0]))
+	require.Equal(t, []int32{4, 5, 6}, vector.MustFixedCol[int32](bat.Vecs[1]))
+
+	// A later session reuses the finalized object.
+	session, err = NewBackupSession(ctx, dstFs)
+	require.NoError(t, err)
+	_, err = convert(session)
+	require.NoError(t, err)
+	require.Equal(t, 2, converted)
+}
+
+func TestConvertABlockWithTombstone(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	dstFs := newBackupTestFS(t)
+
+	// The aBlock carries the three trailing columns the conversion cuts.
+	data := newInt32Batch(t, mp,
+		[]int32{1, 2, 3, 4, 5}, []int32{0, 0, 0, 0, 0},
+		[]int32{0, 0, 0, 0, 0}, []int32{0, 0, 0, 0, 0})
+	location := writeTestObject(t, fs, math.MaxUint16, data)
+	blockID := *objectio.BuildObjectBlockid(location.Name(), 0)
+	other := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+
+	rowids := []types.Rowid{
+		*types.NewRowid(&blockID, 1),
+		*types.NewRowid(other, 2),
+		*types.NewRowid(&blockID, 3),
+	}
+	deletes := batch.NewWithSize(1)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[0], rowids, nil, mp))
+	deletes.SetRowCount(len(rowids))
+
+	newBlocks := func() []*blockData {
+		aBlock := &blockData{
+			num:       0,
+			blockType: objectio.SchemaData,
+			location:  location,
+			data:      newInt32Batch(t, mp, []int32{1, 2, 3, 4, 5}, []int32{0, 0, 0, 0, 0}, []int32{0, 0, 0, 0, 0}, []int32{0, 0, 0, 0, 0}),
+			sortKey:   math.MaxUint16,
+			isABlock:  true,
+			deleteRow: []int{7},
+			tid:       1,
+		}
+		tombstone := &blockData{
+			num:       1,
+			blockType: objectio.SchemaTombstone,
+			location:  location,
+			data:      deletes,
+			isABlock:  true,
+			tid:       1,
+		}
+		return []*blockData{aBlock, tombstone}
+	}
+
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	// The tombstone is a block of the object but not linked to the aBlock.
+	written, ib, _, _, err := convertABlock(ctx, fs, dstFs, nil, newBackupOptions(), newBlocks(), pool)
+	require.NoError(t, err)
+	segment := location.Name().SegmentId()
+	name := objectio.BuildObjectName(&segment, 1000+location.Name().Num())
+	require.Equal(t, name.String(), written.name.String())
+	require.Equal(t, written.location(0), ib.location)
+	require.Equal(t, *objectio.BuildObjectBlockid(name, 0), ib.blockId)
+	require.Equal(t, 7, ib.deleteRow)
+	require.False(t, ib.apply)
+	require.Equal(t, []uint32{3}, written.rows)
+
+	bat, release, err := blockio.LoadColumns(ctx, []uint16{0},
+		[]types.Type{types.T_int32.ToType()}, dstFs, ib.location, nil, fileservice.Policy(0))
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, []int32{1, 3, 5}, vector.MustFixedCol[int32](bat.Vecs[0]))
+
+	// A second data block next to the aBlock is not a shape we handle.
+	blocks := newBlocks()
+	blocks[1].blockType = objectio.SchemaData
+	_, _, _, _, err = convertABlock(ctx, fs, newBackupTestFS(t), nil, newBackupOptions(), blocks, pool)
+	require.Error(t, err)
+}
+
+func TestConvertABlockObjectRows(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	dstFs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	keys := []int32{5, 3, 1, 7, 2, 6, 4}
+	zeros := make([]int32, len(keys))
+	location := writeTestObject(t, fs, 0, newInt32Batch(t, mp, keys, zeros, zeros, zeros))
+	newBlocks := func() []*blockData {
+		return []*blockData{{
+			blockType: objectio.SchemaData,
+			location:  location,
+			data:      formatData(newInt32Batch(t, mp, keys, zeros, zeros, zeros), common.CheckpointAllocator),
+			sortKey:   0,
+			isABlock:  true,
+			deleteRow: []int{4},
+			tid:       1,
+		}}
+	}
+
+	// Split in objects of at most 3 rows, in the order of the sort key.
+	options := newBackupOptions(WithConvertedObjectRows(3), WithBlockIDMapping())
+	written, ib, parts, partBlocks, err := convertABlock(ctx, fs, dstFs, nil, options, newBlocks(), pool)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{3}, written.rows)
+	require.Len(t, parts, 2)
+	require.Len(t, partBlocks, 2)
+	name := options.convertedName(location.Name())
+	want := [][]int32{{1, 2, 3}, {4, 5, 6}, {7}}
+	for i, block := range append([]*insertBlock{ib}, partBlocks...) {
+		object := written
+		if i > 0 {
+			object = parts[i-1]
+		}
+		require.Equal(t, convertedPartName(name, i).String(), object.name.String(), i)
+		require.Equal(t, object.location(0), block.location, i)
+		require.Equal(t, *objectio.BuildObjectBlockid(object.name, 0), block.blockId, i)
+		// Every part is referenced from the row of the aBlock.
+		require.Equal(t, 4, block.deleteRow, i)
+		require.Equal(t, uint32(len(want[i])), object.stats.Rows(), i)
+
+		bat, release, err := blockio.LoadColumns(ctx, []uint16{0},
+			[]types.Type{types.T_int32.ToType()}, dstFs, block.location, nil, fileservice.Policy(0))
+		require.NoError(t, err)
+		require.Equal(t, want[i], vector.MustFixedCol[int32](bat.Vecs[0]), i)
+		release()
+	}
+	require.Len(t, options.result.RelocatedBlocks, 3)
+	require.Equal(t, ib.blockId, options.result.RelocatedBlockMap()[*objectio.BuildObjectBlockid(location.Name(), 0)])
+
+	// The parts left by an earlier rewrite are reused with the first.
+	reused, _, reusedParts, _, err := convertABlock(ctx, fs, dstFs, nil,
+		newBackupOptions(WithConvertedObjectRows(3), WithSkipExisting()), newBlocks(), pool)
+	require.NoError(t, err)
+	require.Equal(t, written.name.String(), reused.name.String())
+	require.Len(t, reusedParts, 2)
+	for i := range parts {
+		require.Equal(t, parts[i].name.String(), reusedParts[i].name.String())
+		require.Equal(t, parts[i].stats, reusedParts[i].stats)
+	}
+
+	// Without a limit the aBlock is one object.
+	written, _, parts, _, err = convertABlock(ctx, fs, newBackupTestFS(t), nil, newBackupOptions(), newBlocks(), pool)
+	require.NoError(t, err)
+	require.Empty(t, parts)
+	require.Equal(t, []uint32{7}, written.rows)
+}
+
+// newConvertFixture writes n aBlocks of rows rows with the tombstones
+// deleting from them, linked the way the rewrite links them. With
+// shared one tombstone deletes the first row of every aBlock, otherwise
+// each aBlock has a tombstone deleting every other row.
+func newConvertFixture(
+	t testing.TB,
+	fs fileservice.FileService,
+	mp *mpool.MPool,
+	n, rows int,
+	shared bool,
+) (map[string]*fileData, []*blockData) {
+	col := make([]int32, rows)
+	commits := make([]types.TS, rows)
+	for i := range col {
+		col[i] = int32(i)
+		commits[i] = types.BuildTS(int64(i+1), 0)
+	}
+	objectsData := make(map[string]*fileData, n+1)
+	addTombstone := func(rowids []types.Rowid) *blockData {
+		// The rowids are followed by the commit ts, the primary key and
+		// the abort flag.
+		bat := batch.NewWithSize(4)
+		for i, typ := range []types.T{types.T_Rowid, types.T_TS, types.T_int32, types.T_bool} {
+			bat.Vecs[i] = vector.NewVec(typ.ToType())
+		}
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[0], rowids, nil, mp))
+		require.NoError(t, vector.AppendMultiFixed(bat.Vecs[1], types.BuildTS(1, 0), false, len(rowids), mp))
+		require.NoError(t, vector.AppendMultiFixed(bat.Vecs[2], int32(0), false, len(rowids), mp))
+		require.NoError(t, vector.AppendMultiFixed(bat.Vecs[3], false, false, len(rowids), mp))
+		bat.SetRowCount(len(rowids))
+		deltaLoc := writeTombstoneBatch(t, fs, bat)
+		deletes, err := blockio.LoadOneBlock(context.Background(), fs, deltaLoc, objectio.SchemaTombstone)
+		require.NoError(t, err)
+		tombstone := &blockData{
+			blockType: objectio.SchemaTombstone,
+			location:  deltaLoc,
+			data:      deletes,
+			isABlock:  true,
+			tid:       1,
+		}
+		objectsData[deltaLoc.Name().String()] = &fileData{
+			name:          deltaLoc.Name(),
+			isDeleteBatch: true,
+			data:          map[uint16]*blockData{0: tombstone},
+		}
+		return tombstone
+	}
+	aBlocks := make([]*blockData, 0, n)
+	tombstones := make([]*blockData, 0, n)
+	sharedRowids := make([]types.Rowid, 0, n)
+	for i := 0; i < n; i++ {
+		// The aBlock carries the three trailing columns, the commit ts
+		// of row i is i+1.
+		bat := newInt32Batch(t, mp, col, col)
+		bat.Vecs = append(bat.Vecs, vector.NewVec(types.T_TS.ToType()), vector.NewVec(types.T_bool.ToType()))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[2], commits, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[3], make([]bool, rows), nil, mp))
+		location := writeTestObject(t, fs, math.MaxUint16, bat)
+		blockID := *objectio.BuildObjectBlockid(location.Name(), 0)
+		aBlock := &blockData{
+			blockType: objectio.SchemaData,
+			location:  location,
+			data:      bat,
+			sortKey:   math.MaxUint16,
+			isABlock:  true,
+			blockId:   blockID,
+			deleteRow: []int{i},
+			tid:       1,
+		}
+		aBlocks = append(aBlocks, aBlock)
+		objectsData[location.Name().String()] = &fileData{
+			name:          location.Name(),
+			isDeleteBatch: true,
+			isABlock:      true,
+			data:          map[uint16]*blockData{0: aBlock},
+		}
+		if shared {
+			sharedRowids = append(sharedRowids, *types.NewRowid(&blockID, 0))
+			continue
+		}
+		rowids := make([]types.Rowid, 0, rows/2)
+		for row := 0; row < rows; row += 2 {
+			rowids = append(rowids, *types.NewRowid(&blockID, uint32(row)))
+		}
+		aBlock.tombstone = addTombstone(rowids)
+		tombstones = append(tombstones, aBlock.tombstone)
+	}
+	if shared {
+		tombstone := addTombstone(sharedRowids)
+		for _, aBlock := range aBlocks {
+			aBlock.tombstone = tombstone
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	return objectsData, tombstones
+}
+
+// convertFixture converts the aBlocks of a fixture one by one.
+func convertFixture(
+	t testing.TB,
+	fs, dstFs fileservice.FileService,
+	objectsData map[string]*fileData,
+	pool *containers.VectorPool,
+	converted func(ib *insertBlock),
+) {
+	for _, objectData := range objectsData {
+		if !objectData.isABlock {
+			continue
+		}
+		_, ib, _, _, err := convertABlock(context.Background(), fs, dstFs, nil, newBackupOptions(),
+			[]*blockData{objectData.data[0]}, pool)
+		require.NoError(t, err)
+		converted(ib)
+	}
+}
+
+func TestConvertABlockReleasesTombstone(t *testing.T) {
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	objectsData, tombstones := newConvertFixture(t, fs, mp, 2, 4, true)
+	tombstone := tombstones[0]
+	retainTombstones(objectsData)
+	require.Equal(t, 2, tombstone.users)
+
+	// The tombstone is kept until every aBlock it deletes from applied it.
+	converted := 0
+	convertFixture(t, fs, newBackupTestFS(t), objectsData, pool, func(ib *insertBlock) {
+		require.Equal(t, uint32(3), ib.location.Rows())
+		converted++
+		require.Equal(t, converted == 1, tombstone.data != nil)
+	})
+	require.Equal(t, 0, tombstone.users)
+
+	// A tombstone object that is rewritten uses the tombstone as well.
+	objectsData, tombstones = newConvertFixture(t, fs, mp, 1, 4, true)
+	tombstone = tombstones[0]
+	objectsData[tombstone.location.Name().String()].isChange = true
+	retainTombstones(objectsData)
+	require.Equal(t, 2, tombstone.users)
+
+	objectsData, tombstones = newConvertFixture(t, fs, mp, 3, 4, false)
+	retainTombstones(objectsData)
+	convertFixture(t, fs, newBackupTestFS(t), objectsData, pool, func(ib *insertBlock) {
+		require.Equal(t, uint32(2), ib.location.Rows())
+	})
+	for _, tombstone := range tombstones {
+		require.Nil(t, tombstone.data)
+	}
+}
+
+// BenchmarkConvertABlocksMemory reports the heap a delete heavy rewrite
+// gives back by converting its aBlocks, the loaded blocks are otherwise
+// held while the rewrite goes on with the other objects.
+func BenchmarkConvertABlocksMemory(b *testing.B) {
+	const blocks, rows = 32, 8192
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(b)
+	pool := dbutils.MakeDefaultSmallPool("backup-bench-pool")
+	defer pool.Destory()
+	heapInUse := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		objectsData, _ := newConvertFixture(b, fs, mp, blocks, rows, false)
+		// Half of the rows of each aBlock are committed after ts.
+		_, err := trimObjectsData(context.Background(), fs, types.BuildTS(rows/2, 0), &objectsData, newBackupOptions())
+		require.NoError(b, err)
+		retainTombstones(objectsData)
+		dstFs := newBackupTestFS(b)
+		before := heapInUse()
+		b.StartTimer()
+		convertFixture(b, fs, dstFs, objectsData, pool, func(*insertBlock) {})
+		b.StopTimer()
+		freed := int64(before) - int64(heapInUse())
+		b.ReportMetric(float64(freed)/blocks, "freed-bytes/block")
+		runtime.KeepAlive(objectsData)
+	}
+}
+
+func TestConvertABlockForceSort(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	// The object of the aBlock declares no sort key.
+	newBatch := func() *batch.Batch {
+		return newInt32Batch(t, mp,
+			[]int32{3, 1, 4, 2}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0})
+	}
+	location := writeTestObject(t, fs, math.MaxUint16, newBatch())
+	convert := func(opts ...BackupOption) (*blockData, []int32) {
+		aBlock := &blockData{
+			blockType: objectio.SchemaData,
+			location:  location,
+			data:      formatData(newBatch(), common.CheckpointAllocator),
+			sortKey:   math.MaxUint16,
+			isABlock:  true,
+			tid:       1,
+		}
+		dstFs := newBackupTestFS(t)
+		_, ib, _, _, err := convertABlock(ctx, fs, dstFs, nil, newBackupOptions(opts...), []*blockData{aBlock}, pool)
+		require.NoError(t, err)
+		bat, release, err := blockio.LoadColumns(ctx, []uint16{0},
+			[]types.Type{types.T_int32.ToType()}, dstFs, ib.location, nil, fileservice.Policy(0))
+		require.NoError(t, err)
+		defer release()
+		return aBlock, append([]int32(nil), vector.MustFixedCol[int32](bat.Vecs[0])...)
+	}
+
+	// Written as is and flagged unsorted.
+	aBlock, rows := convert()
+	require.Equal(t, uint16(math.MaxUint16), aBlock.sortKey)
+	require.Equal(t, []int32{3, 1, 4, 2}, rows)
+
+	// Another table is keyed, the block is left alone.
+	aBlock, rows = convert(WithForceSort(map[uint64]uint16{2: 0}))
+	require.Equal(t, uint16(math.MaxUint16), aBlock.sortKey)
+	require.Equal(t, []int32{3, 1, 4, 2}, rows)
+
+	aBlock, rows = convert(WithForceSort(map[uint64]uint16{1: 0}))
+	require.Equal(t, uint16(0), aBlock.sortKey)
+	require.Equal(t, []int32{1, 2, 3, 4}, rows)
+
+	// The key must be a data column.
+	aBlock = &blockData{
+		blockType: objectio.SchemaData,
+		location:  location,
+		data:      formatData(newBatch(), common.CheckpointAllocator),
+		sortKey:   math.MaxUint16,
+		isABlock:  true,
+		tid:       1,
+	}
+	_, _, _, _, err := convertABlock(ctx, fs, newBackupTestFS(t), nil,
+		newBackupOptions(WithForceSort(map[uint64]uint16{1: 1})), []*blockData{aBlock}, pool)
+	require.Error(t, err)
+}
+
+func TestConvertABlockSchemaSort(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+
+	// Table 1 has a primary key on its second column, table 2 is
+	// clustered by its first one and table 3 has neither.
+	data := NewCheckpointData("", mp)
+	defer data.Close()
+	columns := data.bats[TBLColInsertIDX]
+	for _, col := range []struct {
+		tid        uint64
+		seqnum     uint16
+		constraint string
+		clusterBy  int8
+	}{
+		{1, 0, "", 0}, {1, 1, catalog.SystemColPKConstraint, 0},
+		{2, 0, "", 1}, {2, 1, "", 0},
+		{3, 0, "", 0},
+	} {
+		appendFixtureRow(columns, map[string]any{
+			catalog.SystemColAttr_RelID:          col.tid,
+			catalog.SystemColAttr_Seqnum:         col.seqnum,
+			catalog.SystemColAttr_ConstraintType: []byte(col.constraint),
+			catalog.SystemColAttr_IsClusterBy:    col.clusterBy,
+		})
+	}
+	keys := schemaSortKeys(columns)
+	require.Equal(t, map[uint64]uint16{1: 1, 2: 0}, keys)
+
+	// The object of the aBlock declares no sort key.
+	location := writeTestObject(t, fs, math.MaxUint16, newInt32Batch(t, mp,
+		[]int32{0, 0, 0, 0}, []int32{3, 1, 4, 2}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0}))
+	convert := func(tid uint64, opts ...BackupOption) (*blockData, []int32) {
+		aBlock := &blockData{
+			blockType: objectio.SchemaData,
+			location:  location,
+			data: formatData(newInt32Batch(t, mp,
+				[]int32{0, 0, 0, 0}, []int32{3, 1, 4, 2}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0}, []int32{0, 0, 0, 0}),
+				common.CheckpointAllocator),
+			sortKey:  math.MaxUint16,
+			isABlock: true,
+			tid:      tid,
+		}
+		options := newBackupOptions(opts...)
+		options.schemaSortKeys = keys
+		dstFs := newBackupTestFS(t)
+		_, ib, _, _, err := convertABlock(ctx, fs, dstFs, nil, options, []*blockData{aBlock}, pool)
+		require.NoError(t, err)
+		bat, release, err := blockio.LoadColumns(ctx, []uint16{1},
+			[]types.Type{types.T_int32.ToType()}, dstFs, ib.location, nil, fileservice.Policy(0))
+		require.NoError(t, err)
+		defer release()
+		return aBlock, append([]int32(nil), vector.MustFixedCol[int32](bat.Vecs[0])...)
+	}
+
+	// Sorted by the primary key of the schema.
+	aBlock, rows := convert(1)
+	require.Equal(t, uint16(1), aBlock.sortKey)
+	require.Equal(t, []int32{1, 2, 3, 4}, rows)
+
+	// WithForceSort takes precedence over the schema.
+	aBlock, rows = convert(1, WithForceSort(map[uint64]uint16{1: 0}))
+	require.Equal(t, uint16(0), aBlock.sortKey)
+	require.Equal(t, []int32{3, 1, 4, 2}, rows)
+
+	// No key in the schema, written as is and flagged unsorted.
+	aBlock, rows = convert(3)
+	require.Equal(t, uint16(math.MaxUint16), aBlock.sortKey)
+	require.Equal(t, []int32{3, 1, 4, 2}, rows)
+}
+
+func TestSortABlockFallback(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	// The pool has room to shuffle the first column only, so the sort
+	// fails half way.
+	sortMp, err := mpool.NewMPool("backup-test-sort", mpool.MB, mpool.NoFixed)
+	require.NoError(t, err)
+	defer mpool.DeleteMPool(sortMp)
+	probe, err := sortMp.Alloc(1)
+	require.NoError(t, err)
+	header := sortMp.CurrNB() - 1
+	sortMp.Free(probe)
+	filler, err := sortMp.Alloc(int(sortMp.Cap() - 2*header - 4*4))
+	require.NoError(t, err)
+	defer sortMp.Free(filler)
+	pool := containers.NewVectorPool("backup-test-sort", 1, containers.WithMPool(sortMp))
+	defer pool.Destory()
+
+	sortABlock := func(opts ...BackupOption) (*backupOptions, uint16, *batch.Batch, error) {
+		options := newBackupOptions(opts...)
+		sortKey := uint16(0)
+		bat, err := options.sortABlock(ctx, fs, objectio.Location{}, &sortKey, 1,
+			formatData(newInt32Batch(t, mp, []int32{3, 1, 4, 2}, []int32{30, 10, 40, 20}), common.CheckpointAllocator), pool)
+		return options, sortKey, bat, err
+	}
+
+	// Written unsorted, the columns left as they were loaded.
+	options, sortKey, bat, err := sortABlock()
+	require.NoError(t, err)
+	require.Equal(t, uint16(math.MaxUint16), sortKey)
+	require.Equal(t, []int32{3, 1, 4, 2}, vector.MustFixedCol[int32](bat.Vecs[0]))
+	require.Equal(t, []int32{30, 10, 40, 20}, vector.MustFixedCol[int32](bat.Vecs[1]))
+	require.Equal(t, int64(1), options.stats.Phase(StatsPhaseRewrite).Get(StatSortFallbacks))
+	warnings := options.stats.Warnings()
+	require.Equal(t, 1, len(warnings))
+	require.Equal(t, WarnSortFallback, warnings[0].Code)
+
+	_, _, _, err = sortABlock(WithStrictSort())
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInternal), err)
+}
+
+// newSortKeyVector returns a vector of the keys, key i null if keys[i]
+// is negative.
+func newSortKeyVector(t testing.TB, mp *mpool.MPool, keys []int64) *vector.Vector {
+	vec := vector.NewVec(types.T_int64.ToType())
+	nulls := make([]bool, len(keys))
+	for i, key := range keys {
+		nulls[i] = key < 0
+	}
+	require.NoError(t, vector.AppendFixedList(vec, keys, nulls, mp))
+	return vec
+}
+
+func TestStableSortIndex(t *testing.T) {
+	mp := mpool.MustNewZero()
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]int64, 10007)
+	for i := range keys {
+		// Few distinct keys and some nulls, most keys are tied.
+		keys[i] = rng.Int63n(100) - 5
+	}
+	key := newSortKeyVector(t, mp, keys)
+	defer key.Free(mp)
+
+	serial := stableSortIndex(key, 1)
+	require.Len(t, serial, len(keys))
+	cmp := rowComparator(key)
+	for i := 1; i < len(serial); i++ {
+		c := cmp(serial[i-1], serial[i])
+		require.True(t, c < 0 || c == 0 && serial[i-1] < serial[i], i)
+	}
+	for _, workers := range []int{2, 3, 8, 64} {
+		require.Equal(t, serial, stableSortIndex(key, workers), workers)
+	}
+}
+
+func TestSortABlockParallel(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-sort")
+	defer pool.Destory()
+
+	rng := rand.New(rand.NewSource(1))
+	keys := rng.Perm(4096)
+	cols := [2][]int32{make([]int32, len(keys)), make([]int32, len(keys))}
+	for i, key := range keys {
+		cols[0][i], cols[1][i] = int32(key), int32(i)
+	}
+	sortABlock := func(opts ...BackupOption) *batch.Batch {
+		options := newBackupOptions(opts...)
+		sortKey := uint16(0)
+		bat, err := options.sortABlock(ctx, fs, objectio.Location{}, &sortKey, 1,
+			formatData(newInt32Batch(t, mp, cols[0], cols[1]), common.CheckpointAllocator), pool)
+		require.NoError(t, err)
+		require.Equal(t, uint16(0), sortKey)
+		return bat
+	}
+	// The keys are unique, the parallel sort sorts as the serial one,
+	// below the threshold as well as above.
+	serial := sortABlock()
+	for _, threshold := range []int{1, len(keys) + 1} {
+		parallel := sortABlock(WithParallelSort(threshold, 4))
+		for i := range serial.Vecs {
+			require.Equal(t, vector.MustFixedCol[int32](serial.Vecs[i]), vector.MustFixedCol[int32](parallel.Vecs[i]))
+		}
+	}
+}
+
+func BenchmarkSortBlockColumns(b *testing.B) {
+	mp := mpool.MustNewZero()
+	pool := dbutils.MakeDefaultSmallPool("backup-bench-sort")
+	defer pool.Destory()
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]int64, 1<<20)
+	for i := range keys {
+		keys[i] = rng.Int63()
+	}
+	source := newSortKeyVector(b, mp, keys)
+	defer source.Free(mp)
+
+	for _, c := range []struct {
+		name string
+		opts []BackupOption
+	}{
+		{name: "serial"},
+		{name: "parallel", opts: []BackupOption{WithParallelSort(1, 0)}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			options := newBackupOptions(c.opts...)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				key, err := source.Dup(mp)
+				require.NoError(b, err)
+				cols := []containers.Vector{containers.ToTNVector(key, mp)}
+				b.StartTimer()
+				_, err = options.sortBlockColumns(cols, 0, pool)
+				require.NoError(b, err)
+				b.StopTimer()
+				cols[0].Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestTransferInsertBlocksNotSortedWarning(t *testing.T) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	blkID := *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	appendBlockMetaRow(data.bats[BLKMetaInsertIDX], blkID, types.BuildTS(1, 0))
+	appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	data.UpdateBlockInsertBlkMeta(1, 0, 1)
+
+	// An aBlock without a sort key is converted to an unsorted nBlock.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	converted := &insertBlock{
+		blockId:  *objectio.BuildObjectBlockid(name, 0),
+		location: objectio.BuildLocation(name, objectio.NewExtent(0, 0, 10, 10), 3, 0),
+		data:     &blockData{isABlock: true, sortKey: math.MaxUint16},
+	}
+	stats := NewBackupStats()
+	insertBatch := map[uint64]*iBlocks{1: {insertBlocks: []*insertBlock{converted}}}
+	require.NoError(t, transferInsertBlocks(context.Background(), data, insertBatch, stats))
+	require.False(t, data.bats[BLKMetaInsertIDX].GetVectorByName(catalog.BlockMeta_Sorted).Get(0).(bool))
+	require.Equal(t, []BackupWarning{{
+		Code:   WarnBlockNotSorted,
+		Object: name.String(),
+		Block:  converted.blockId.String(),
+	}}, stats.Warnings())
+
+	// Merged stats keep the warnings.
+	merged := NewBackupStats()
+	merged.Merge(stats)
+	require.Equal(t, stats.Warnings(), merged.Warnings())
+}
+
+func TestTransferInsertBlocksTableWithoutRows(t *testing.T) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+	a, b := newBlock(), newBlock()
+	for _, id := range []types.Blockid{a, b} {
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], id, types.BuildTS(1, 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	data.UpdateBlockInsertBlkMeta(1, 0, 2)
+
+	newInsertBlock := func(deleteRow int) *insertBlock {
+		name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+		return &insertBlock{
+			blockId:   *objectio.BuildObjectBlockid(name, 0),
+			location:  objectio.BuildLocation(name, objectio.NewExtent(0, 0, 10, 10), 3, 0),
+			deleteRow: deleteRow,
+			data:      &blockData{sortKey: 0},
+		}
+	}
+	// Table 2 has no block meta insert row in the checkpoint.
+	own, other := newInsertBlock(0), newInsertBlock(1)
+	insertBatch := map[uint64]*iBlocks{
+		1: {insertBlocks: []*insertBlock{own}},
+		2: {insertBlocks: []*insertBlock{other}},
+	}
+	require.NoError(t, transferInsertBlocks(context.Background(), data, insertBatch, nil))
+
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	blkMetaTxn := data.bats[BLKMetaInsertTxnIDX]
+	require.Equal(t, 3, blkMeta.Length())
+	require.Equal(t, 3, blkMetaTxn.Length())
+	ids := blkMeta.GetVectorByName(catalog.BlockMeta_ID)
+	metaLocs := blkMetaTxn.GetVectorByName(catalog.BlockMeta_MetaLoc)
+	tids := blkMetaTxn.GetVectorByName(SnapshotAttr_TID)
+	require.Equal(t, own.blockId, ids.Get(0).(types.Blockid))
+	require.Equal(t, b, ids.Get(1).(types.Blockid))
+	require.Equal(t, other.blockId, ids.Get(2).(types.Blockid))
+	require.Equal(t, []uint64{1, 1, 2}, []uint64{tids.Get(0).(uint64), tids.Get(1).(uint64), tids.Get(2).(uint64)})
+	require.Equal(t, other.location, objectio.Location(metaLocs.Get(2).([]byte)))
+	require.True(t, blkMetaTxn.GetVectorByName(catalog.BlockMeta_DeltaLoc).IsNull(2))
+
+	require.Equal(t, uint64(0), data.meta[1].tables[BlockInsert].Start)
+	require.Equal(t, uint64(2), data.meta[1].tables[BlockInsert].End)
+	require.Equal(t, uint64(2), data.meta[2].tables[BlockInsert].Start)
+	require.Equal(t, uint64(3), data.meta[2].tables[BlockInsert].End)
+}
+
+func TestTransferInsertBlocksInterleavedTables(t *testing.T) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	blocks := make([]types.Blockid, 4)
+	for i := range blocks {
+		blocks[i] = *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], blocks[i], types.BuildTS(1, 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], uint64(1+i%2))
+	}
+
+	// Table 3 has no row of its own, its row is appended after those of
+	// tables 1 and 2, which are interleaved.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	copied := &insertBlock{
+		blockId:   *objectio.BuildObjectBlockid(name, 0),
+		location:  objectio.BuildLocation(name, objectio.NewExtent(0, 0, 10, 10), 3, 0),
+		deleteRow: 2,
+		data:      &blockData{sortKey: 0},
+	}
+	insertBatch := map[uint64]*iBlocks{3: {insertBlocks: []*insertBlock{copied}}}
+	require.NoError(t, transferInsertBlocks(context.Background(), data, insertBatch, nil))
+
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	blkMetaTxn := data.bats[BLKMetaInsertTxnIDX]
+	require.Equal(t, 5, blkMeta.Length())
+	require.Equal(t, 5, blkMetaTxn.Length())
+	ids := make([]types.Blockid, 0, blkMeta.Length())
+	tids := make([]uint64, 0, blkMetaTxn.Length())
+	for i := 0; i < blkMeta.Length(); i++ {
+		ids = append(ids, blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid))
+		tids = append(tids, blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64))
+	}
+	// The rows of a table are contiguous and keep their order.
+	require.Equal(t, []types.Blockid{blocks[0], blocks[2], blocks[1], blocks[3], copied.blockId}, ids)
+	require.Equal(t, []uint64{1, 1, 2, 2, 3}, tids)
+	for tid, rows := range map[uint64][2]uint64{1: {0, 2}, 2: {2, 4}, 3: {4, 5}} {
+		require.Equal(t, rows[0], data.meta[tid].tables[BlockInsert].Start, tid)
+		require.Equal(t, rows[1], data.meta[tid].tables[BlockInsert].End, tid)
+	}
+}
+
+func TestTransferMergedBlocksOfTwoTables(t *testing.T) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	// One merged object holds block 0 of table 1 and block 1 of table 2.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	dataBlocks := make([]*blockData, 2)
+	for i := range dataBlocks {
+		blkID := *objectio.BuildObjectBlockid(name, uint16(i))
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], blkID, types.BuildTS(1, 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], uint64(i+1))
+		dataBlocks[i] = &blockData{
+			num:       uint16(i),
+			blockType: objectio.SchemaData,
+			blockId:   blkID,
+			tid:       uint64(i + 1),
+			deleteRow: []int{i},
+		}
+	}
+
+	insertBatch := make(map[uint64]*iBlocks)
+	addMergedBlocks(insertBatch, dataBlocks)
+	// Registered a second time, e.g. by its deltaLoc row.
+	addMergedBlocks(insertBatch, dataBlocks[1:])
+	require.Len(t, insertBatch, 2)
+	for tid, blocks := range insertBatch {
+		require.Len(t, blocks.insertBlocks, 1, tid)
+		require.Equal(t, tid, blocks.insertBlocks[0].data.tid)
+	}
+	require.NoError(t, transferInsertBlocks(context.Background(), data, insertBatch, nil))
+
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	tids := data.bats[BLKMetaInsertTxnIDX].GetVectorByName(SnapshotAttr_TID)
+	require.Equal(t, 2, blkMeta.Length())
+	for i := range dataBlocks {
+		require.Equal(t, dataBlocks[i].blockId, blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid))
+		require.Equal(t, dataBlocks[i].tid, tids.Get(i).(uint64))
+	}
+
+	// Filed under a table without a row of its own, the row of the block
+	// is copied and the block has two.
+	misfiled := map[uint64]*iBlocks{3: {insertBlocks: []*insertBlock{{
+		blockId:   dataBlocks[1].blockId,
+		deleteRow: 1,
+		data:      dataBlocks[1],
+	}}}}
+	err := transferInsertBlocks(context.Background(), data, misfiled, nil)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInternal), err)
+}
+
+func TestTransferInsertBlocksDroppedRows(t *testing.T) {
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+	// aBlock a has rows 0 and 1 and aBlock c row 3, b and d are kept.
+	a, b, c, d := newBlock(), newBlock(), newBlock(), newBlock()
+	for i, row := range []struct {
+		id  types.Blockid
+		tid uint64
+	}{{a, 1}, {a, 1}, {b, 1}, {c, 2}, {d, 2}} {
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], row.id, types.BuildTS(int64(i+1), 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], row.tid)
+	}
+
+	newInsertBlock := func(deleteRow int, cnRows ...int) *insertBlock {
+		name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+		return &insertBlock{
+			blockId:   *objectio.BuildObjectBlockid(name, 0),
+			location:  objectio.BuildLocation(name, objectio.NewExtent(0, 0, 10, 10), 3, 0),
+			deleteRow: deleteRow,
+			data:      &blockData{isABlock: true, deleteRow: cnRows},
+		}
+	}
+	// Both drop row 1. The row of table 3 is copied from row 3, which
+	// it drops too.
+	own, other := newInsertBlock(0, 0, 1), newInsertBlock(3, 1, 3)
+	insertBatch := map[uint64]*iBlocks{
+		1: {insertBlocks: []*insertBlock{own}},
+		3: {insertBlocks: []*insertBlock{other}},
+	}
+	require.NoError(t, transferInsertBlocks(context.Background(), data, insertBatch, nil))
+
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	blkMetaTxn := data.bats[BLKMetaInsertTxnIDX]
+	require.Equal(t, 4, blkMeta.Length())
+	require.Equal(t, 4, blkMetaTxn.Length())
+	ids := make([]types.Blockid, 0, blkMeta.Length())
+	commits := make([]types.TS, 0, blkMeta.Length())
+	tids := make([]uint64, 0, blkMetaTxn.Length())
+	for i := 0; i < blkMeta.Length(); i++ {
+		ids = append(ids, blkMeta.GetVectorByName(catalog.BlockMeta_ID).Get(i).(types.Blockid))
+		commits = append(commits, blkMeta.GetVectorByName(catalog.BlockMeta_CommitTs).Get(i).(types.TS))
+		tids = append(tids, blkMetaTxn.GetVectorByName(SnapshotAttr_TID).Get(i).(uint64))
+	}
+	// Row 0 holds the insertBlock of table 1 and is kept.
+	require.Equal(t, []types.Blockid{own.blockId, b, d, other.blockId}, ids)
+	require.Equal(t, []types.TS{
+		types.BuildTS(1, 0), types.BuildTS(3, 0), types.BuildTS(5, 0), types.BuildTS(4, 0),
+	}, commits)
+	require.Equal(t, []uint64{1, 1, 2, 3}, tids)
+	for tid, rows := range map[uint64][2]uint64{1: {0, 2}, 2: {2, 3}, 3: {3, 4}} {
+		require.Equal(t, rows[0], data.meta[tid].tables[BlockInsert].Start, tid)
+		require.Equal(t, rows[1], data.meta[tid].tables[BlockInsert].End, tid)
+	}
+
+	// A row out of the batches fails the transfer before any is moved.
+	stray := newInsertBlock(0, 4)
+	err := transferInsertBlocks(context.Background(), data,
+		map[uint64]*iBlocks{1: {insertBlocks: []*insertBlock{stray}}}, nil)
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInternal), err)
+	require.Equal(t, 4, data.bats[BLKMetaInsertIDX].Length())
+	require.False(t, stray.apply)
+}
+
+func TestAppendValToBatchSchema(t *testing.T) {
+	src := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertTxnIDX], common.CheckpointAllocator)
+	defer src.Close()
+	appendTxnRow(src, 1)
+
+	dst := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertTxnIDX], common.CheckpointAllocator)
+	defer dst.Close()
+	require.NoError(t, appendValToBatch(src, dst, 0))
+	require.Equal(t, uint64(1), dst.GetVectorByName(SnapshotAttr_TID).Get(0).(uint64))
+
+	other := makeRespBatchFromSchema(checkpointDataSchemas_Curr[BLKMetaInsertIDX], common.CheckpointAllocator)
+	defer other.Close()
+	require.Error(t, appendValToBatch(src, other, 0))
+	require.Equal(t, 0, other.Length())
+}
+
+func TestTrimObjectsDataByTS(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	commits := []types.TS{types.BuildTS(5, 0), types.BuildTS(10, 0), types.BuildTS(15, 0)}
+
+	// An aBlock has its commit ts second to last, a tombstone block third
+	// to last.
+	data := newInt32Batch(t, mp, []int32{1, 2, 3})
+	data.Vecs = append(data.Vecs, vector.NewVec(types.T_TS.ToType()), vector.NewVec(types.T_bool.ToType()))
+	require.NoError(t, vector.AppendFixedList(data.Vecs[1], commits, nil, mp))
+	require.NoError(t, vector.AppendFixedList(data.Vecs[2], []bool{false, false, false}, nil, mp))
+	aBlock := writeTestObject(t, fs, math.MaxUint16, data)
+
+	blockID := objectio.BuildObjectBlockid(aBlock.Name(), 0)
+	deletes := batch.NewWithSize(4)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	deletes.Vecs[1] = vector.NewVec(types.T_TS.ToType())
+	deletes.Vecs[2] = vector.NewVec(types.T_int32.ToType())
+	deletes.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[0],
+		[]types.Rowid{*types.NewRowid(blockID, 0), *types.NewRowid(blockID, 1), *types.NewRowid(blockID, 2)}, nil, mp))
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[1], commits, nil, mp))
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[2], []int32{1, 2, 3}, nil, mp))
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[3], []bool{false, false, false}, nil, mp))
+	deletes.SetRowCount(3)
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	require.NoError(t, err)
+	_, err = writer.WriteTombstoneBatch(deletes)
+	require.NoError(t, err)
+	blocks, extent, err := writer.Sync(ctx)
+	require.NoError(t, err)
+	tombstone := objectio.BuildLocation(name, extent, blocks[0].GetRows(), blocks[0].GetID())
+
+	trim := func(ts types.TS) map[string]*fileData {
+		objectsData := map[string]*fileData{
+			aBlock.Name().String(): {
+				name: aBlock.Name(),
+				data: map[uint16]*blockData{
+					0: {location: aBlock, blockType: objectio.SchemaData, isABlock: true, sortKey: math.MaxUint16},
+				},
+			},
+			tombstone.Name().String(): {
+				name: tombstone.Name(),
+				data: map[uint16]*blockData{
+					0: {location: tombstone, blockType: objectio.SchemaTombstone, sortKey: math.MaxUint16},
+				},
+			},
+		}
+		isCkpChange, err := trimObjectsData(ctx, fs, ts, &objectsData, newBackupOptions())
+		require.NoError(t, err)
+		require.True(t, isCkpChange)
+		return objectsData
+	}
+	rows := func(objectsData map[string]*fileData, location objectio.Location) int {
+		return objectsData[location.Name().String()].data[0].data.Vecs[0].Length()
+	}
+
+	for _, c := range []struct {
+		ts      types.TS
+		rows    int
+		changed bool
+	}{
+		{types.BuildTS(4, 0), 0, true},
+		{types.BuildTS(10, 0), 2, true},
+		{types.BuildTS(10, 1), 2, true},
+		{types.BuildTS(15, 0), 3, false},
+	} {
+		// Trimming twice at the same ts gives the same result.
+		for i := 0; i < 2; i++ {
+			objectsData := trim(c.ts)
+			if c.rows == 0 {
+				require.True(t, objectsData[aBlock.Name().String()].data[0].dropped)
+			} else {
+				require.Equal(t, c.rows, rows(objectsData, aBlock))
+			}
+			if c.changed {
+				require.Equal(t, c.rows, rows(objectsData, tombstone))
+			} else {
+				// The tombstone is not rewritten, it is not loaded.
+				require.Nil(t, objectsData[tombstone.Name().String()].data[0].data)
+			}
+			require.Equal(t, c.changed, objectsData[aBlock.Name().String()].isChange)
+			require.Equal(t, c.changed, objectsData[tombstone.Name().String()].isChange)
+		}
+	}
+}
+
+func TestBackupNames(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	dstFs := newBackupTestFS(t)
+
+	segment := objectio.NewSegmentid()
+	data := BackupDataObjectName(segment, 3)
+	require.Equal(t, uint16(1003), data.Num())
+	require.False(t, isBackupAuxName(data.String()))
+	aux := BackupAuxName(BackupAuxJournal, "j")
+	require.True(t, isBackupAuxName(aux))
+	require.NotEqual(t, aux, data.String())
+
+	names := NewBackupNames()
+	require.NoError(t, names.Register(data.String(), "src"))
+	require.NoError(t, names.Register(data.String(), "src"))
+	require.Error(t, names.Register(data.String(), "other"))
+	require.NoError(t, names.Register(aux, BackupAuxJournal))
+	require.Error(t, names.Register("somewhere/else", "src"))
+	require.Error(t, names.Register("", "src"))
+	require.Equal(t, []string{data.String(), aux}, names.Names())
+
+	session, err := NewBackupSession(ctx, dstFs, WithJournal("journal"))
+	require.NoError(t, err)
+	require.Equal(t, []string{BackupAuxName(BackupAuxJournal, "journal")}, session.Names().Names())
+
+	// Two sources remapped onto one segment convert to the same name.
+	srcA := objectio.BuildObjectName(objectio.NewSegmentid(), 1)
+	srcB := objectio.BuildObjectName(objectio.NewSegmentid(), 1)
+	options := newBackupOptions(WithSegmentRemap(map[objectio.Segmentid]objectio.Segmentid{
+		srcA.SegmentId(): *segment,
+		srcB.SegmentId(): *segment,
+	}))
+	name := options.convertedName(srcA)
+	require.Equal(t, name, options.convertedName(srcB))
+	convert := func() (*writtenObject, error) {
+		return newBackupOptions().writeConverted(ctx, dstFs, name, newInt32Batch(t, mp, []int32{1, 2, 3}), math.MaxUint16)
+	}
+	_, err = options.convertedObject(ctx, session, dstFs, srcA, name, convert)
+	require.NoError(t, err)
+	_, err = options.convertedObject(ctx, session, dstFs, srcA, name, convert)
+	require.NoError(t, err)
+	_, err = options.convertedObject(ctx, session, dstFs, srcB, name, convert)
+	require.Error(t, err)
+}
+
+func TestWriteCheckpointToSink(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	data := NewCheckpointData("", mpool.MustNewZero())
+	defer data.Close()
+	for i := 0; i < 3; i++ {
+		blkID := *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+		appendBlockMetaRow(data.bats[BLKMetaInsertIDX], blkID, types.BuildTS(int64(i+1), 0))
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	data.UpdateBlockInsertBlkMeta(1, 0, 3)
+
+	var buf bytes.Buffer
+	sink := NewTarSink(&buf)
+	cnLocation, tnLocation, err := data.WriteToSink(ctx, sink, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	fs := newBackupTestFS(t)
+	names, err := UnpackTar(ctx, &buf, fs)
+	require.NoError(t, err)
+	require.Contains(t, names, cnLocation.Name().String())
+	require.Contains(t, names, tnLocation.Name().String())
+
+	loaded, err := getCheckpointData(ctx, "", fs, cnLocation, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	defer loaded.Close()
+	diff := CompareCheckpointData(data, loaded, MetaIDX, TNMetaIDX)
+	require.True(t, diff.Empty(), diff.String())
+}
+
+func TestBackupStatsConcurrent(t *testing.T) {
+	stats := NewBackupStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(tid uint64) {
+			defer wg.Done()
+			rewrite := stats.Phase(StatsPhaseRewrite)
+			for j := 0; j < 100; j++ {
+				rewrite.Add(StatRewritten, 1)
+				rewrite.Table(tid%2).Add(StatRewritten, 1)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	other := NewBackupStats()
+	other.Phase(StatsPhaseTrim).Add(StatStaleBlocks, 3)
+	other.Phase(StatsPhaseRewrite).Table(1).Add(StatRewritten, 5)
+	stats.Merge(other)
+
+	require.Equal(t, StatsSnapshot{
+		"phase=rewrite/rewritten_objects":         800,
+		"phase=rewrite/table=0/rewritten_objects": 400,
+		"phase=rewrite/table=1/rewritten_objects": 405,
+		"phase=trim/stale_blocks":                 3,
+	}, stats.Snapshot())
+	require.Len(t, stats.Snapshot().Fields(), 4)
+
+	var none *BackupStats
+	none.Phase(StatsPhaseTrim).Add(StatStaleBlocks, 1)
+	require.Zero(t, none.Phase(StatsPhaseTrim).Get(StatStaleBlocks))
+	require.Empty(t, none.Snapshot())
+}
+
+func TestSortBlocksDuplicateNum(t *testing.T) {
+	segment := objectio.NewSegmentid()
+	blockID := func(seq uint16) types.Blockid {
+		return *objectio.NewBlockid(segment, 0, seq)
+	}
+	data := map[uint16]*blockData{
+		0: {num: 0, blockId: blockID(0)},
+		// 2 is keyed by its own num but claims 1, as if corrupted.
+		1: {num: 1, blockId: blockID(1)},
+		2: {num: 1, blockId: blockID(2)},
+		3: {num: 3, blockId: blockID(3)},
+	}
+	for i := 0; i < 20; i++ {
+		blocks, duplicates := sortBlocks(data)
+		require.Equal(t, []*blockData{data[0], data[1], data[2], data[3]}, blocks)
+		require.Equal(t, []uint16{1}, duplicates)
+	}
+
+	delete(data, 2)
+	_, duplicates := sortBlocks(data)
+	require.Empty(t, duplicates)
+}
+
+func TestBlocksToRewriteEmpty(t *testing.T) {
+	options := newBackupOptions()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	// The blocks of a changed object were all filtered out.
+	require.NotPanics(t, func() {
+		blocks, ok := options.blocksToRewrite(name.String(), &fileData{
+			name:     name,
+			isChange: true,
+			data:     make(map[uint16]*blockData),
+		})
+		require.False(t, ok)
+		require.Empty(t, blocks)
+	})
+
+	// A deleted object is rewritten from its object entry alone.
+	blocks, ok := options.blocksToRewrite(name.String(), &fileData{
+		name:          name,
+		isChange:      true,
+		isDeleteBatch: true,
+		data:          make(map[uint16]*blockData),
+		obj:           &objData{},
+	})
+	require.True(t, ok)
+	require.Empty(t, blocks)
+}
+
+func TestTrimObjectsDataRowFilter(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	data := newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{0, 0, 0, 0})
+	data.Vecs = append(data.Vecs, vector.NewVec(types.T_TS.ToType()), vector.NewVec(types.T_bool.ToType()))
+	commits := []types.TS{types.BuildTS(5, 0), types.BuildTS(5, 0), types.BuildTS(5, 0), types.BuildTS(5, 0)}
+	require.NoError(t, vector.AppendFixedList(data.Vecs[2], commits, nil, mp))
+	require.NoError(t, vector.AppendFixedList(data.Vecs[3], []bool{false, false, false, false}, nil, mp))
+	location := writeTestObject(t, fs, math.MaxUint16, data)
+
+	even := func(bat *batch.Batch, row int) bool {
+		return vector.GetFixedAt[int32](bat.Vecs[0], row)%2 == 0
+	}
+	stats := NewBackupStats()
+	objectsData := map[string]*fileData{
+		location.Name().String(): {
+			name:          location.Name(),
+			isDeleteBatch: true,
+			data: map[uint16]*blockData{
+				0: {location: location, blockType: objectio.SchemaData, isABlock: true, sortKey: math.MaxUint16, tid: 1},
+			},
+		},
+	}
+	_, err := trimObjectsData(ctx, fs, types.BuildTS(10, 0), &objectsData,
+		newBackupOptions(WithRowFilter(even), WithBackupStats(stats)))
+	require.NoError(t, err)
+	object := objectsData[location.Name().String()]
+	require.True(t, object.isChange)
+	aBlock := object.data[0]
+	// The rows are only marked, a tombstone may still refer to them.
+	require.Equal(t, 4, aBlock.data.Vecs[0].Length())
+	require.Equal(t, []int64{0, 2}, aBlock.filtered)
+	require.Equal(t, int64(2), stats.Phase(StatsPhaseTrim).Get(StatFilteredRows))
+
+	// The tombstone deletes the row at offset 1, as in the block before
+	// it is filtered.
+	blockID := *objectio.BuildObjectBlockid(location.Name(), 0)
+	deletes := batch.NewWithSize(1)
+	deletes.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+	require.NoError(t, vector.AppendFixedList(deletes.Vecs[0], []types.Rowid{*types.NewRowid(&blockID, 1)}, nil, mp))
+	deletes.SetRowCount(1)
+	aBlock.tombstone = &blockData{blockType: objectio.SchemaTombstone, location: location, data: deletes}
+
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+	dstFs := newBackupTestFS(t)
+	_, ib, _, _, err := convertABlock(ctx, fs, dstFs, nil, newBackupOptions(), []*blockData{aBlock}, pool)
+	require.NoError(t, err)
+	bat, release, err := blockio.LoadColumns(ctx, []uint16{0},
+		[]types.Type{types.T_int32.ToType()}, dstFs, ib.location, nil, fileservice.Policy(0))
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, []int32{4}, vector.MustFixedCol[int32](bat.Vecs[0]))
+}
+
+func TestTrimObjectsDataUnorderedCommits(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	// As written by an older replay, rows committed before ts follow rows
+	// committed after it.
+	data := newInt32Batch(t, mp, []int32{1, 2, 3, 4, 5}, []int32{0, 0, 0, 0, 0})
+	data.Vecs = append(data.Vecs, vector.NewVec(types.T_TS.ToType()), vector.NewVec(types.T_bool.ToType()))
+	commits := []types.TS{types.BuildTS(5, 0), types.BuildTS(15, 0), types.BuildTS(7, 0), types.BuildTS(20, 0), types.BuildTS(9, 0)}
+	require.NoError(t, vector.AppendFixedList(data.Vecs[2], commits, nil, mp))
+	require.NoError(t, vector.AppendFixedList(data.Vecs[3], make([]bool, 5), nil, mp))
+	location := writeTestObject(t, fs, math.MaxUint16, data)
+
+	trim := func(isDeleteBatch bool) (*blockData, *BackupStats) {
+		stats := NewBackupStats()
+		objectsData := map[string]*fileData{
+			location.Name().String(): {
+				name:          location.Name(),
+				isDeleteBatch: isDeleteBatch,
+				data: map[uint16]*blockData{
+					0: {location: location, blockType: objectio.SchemaData, isABlock: true, sortKey: math.MaxUint16, tid: 1},
+				},
+			},
+		}
+		_, err := trimObjectsData(ctx, fs, types.BuildTS(10, 0), &objectsData, newBackupOptions(WithBackupStats(stats)))
+		require.NoError(t, err)
+		require.True(t, objectsData[location.Name().String()].isChange)
+		return objectsData[location.Name().String()].data[0], stats
+	}
+
+	// Rewritten in place, the late rows are cut right away.
+	block, stats := trim(false)
+	require.Equal(t, []int32{1, 3, 5}, vector.MustFixedCol[int32](block.data.Vecs[0]))
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseTrim).Get(StatUnorderedBlocks))
+
+	// Converted, the late rows are removed with the deletes.
+	block, stats = trim(true)
+	require.Equal(t, []int64{1, 3}, block.filtered)
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseTrim).Get(StatUnorderedBlocks))
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+	dstFs := newBackupTestFS(t)
+	_, ib, _, _, err := convertABlock(ctx, fs, dstFs, nil, newBackupOptions(), []*blockData{block}, pool)
+	require.NoError(t, err)
+	bat, release, err := blockio.LoadColumns(ctx, []uint16{0},
+		[]types.Type{types.T_int32.ToType()}, dstFs, ib.location, nil, fileservice.Policy(0))
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, []int32{1, 3, 5}, vector.MustFixedCol[int32](bat.Vecs[0]))
+}
+
+func TestTrimObjectsDataBadCommitTs(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	// The commit ts column of the aBlock holds int32s.
+	data := newInt32Batch(t, mp, []int32{1, 2}, []int32{0, 0}, []int32{3, 4})
+	data.Vecs = append(data.Vecs, vector.NewVec(types.T_bool.ToType()))
+	require.NoError(t, vector.AppendFixedList(data.Vecs[3], make([]bool, 2), nil, mp))
+	location := writeTestObject(t, fs, math.MaxUint16, data)
+	objectsData := map[string]*fileData{
+		location.Name().String(): {
+			name: location.Name(),
+			data: map[uint16]*blockData{
+				0: {location: location, blockType: objectio.SchemaData, isABlock: true, sortKey: math.MaxUint16, tid: 1},
+			},
+		},
+	}
+	_, err := trimObjectsData(ctx, fs, types.BuildTS(10, 0), &objectsData, newBackupOptions())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "data block "+location.String()+" row 0")
+
+	// A corrupt record in the middle of a tombstone block.
+	commits := vector.NewVec(types.T_varchar.ToType())
+	ts := types.BuildTS(5, 0)
+	require.NoError(t, vector.AppendBytes(commits, ts[:], false, mp))
+	require.NoError(t, vector.AppendBytes(commits, ts[:5], false, mp))
+	var commitTs types.TS
+	require.NoError(t, unmarshalCommitTs(&commitTs, commits, 0, location, true))
+	require.Equal(t, ts, commitTs)
+	err = unmarshalCommitTs(&commitTs, commits, 1, location, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tombstone block "+location.String()+" row 1")
+}
+
+func TestMaxOpenWriters(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	var open, peak atomic.Int32
+	options := newBackupOptions(WithMaxOpenWriters(3),
+		WithBlockWriterFactory(func(fs fileservice.FileService, name string) (BlockWriterLike, error) {
+			n := open.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			return blockio.NewBlockWriter(fs, name)
+		}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, release, err := options.openWriter(ctx, fs, fmt.Sprintf("writer-%d", i), objectio.SchemaData)
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+			open.Add(-1)
+			release()
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, peak.Load(), int32(3))
+	require.Positive(t, peak.Load())
+
+	// A writer that is synced gives its token back.
+	options = newBackupOptions(WithMaxOpenWriters(1))
+	for i := 0; i < 2; i++ {
+		name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+		_, err := options.writeConverted(ctx, fs, name, newInt32Batch(t, mp, []int32{1, 2, 3}), math.MaxUint16)
+		require.NoError(t, err)
+	}
+
+	// Waiting for a token gives up with the context.
+	_, release, err := options.openWriter(ctx, fs, "held", objectio.SchemaData)
+	require.NoError(t, err)
+	defer release()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = options.openWriter(canceled, fs, "waiting", objectio.SchemaData)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAbortDefaultWriter(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	stats := NewBackupStats()
+	options := newBackupOptions(WithBackupStats(stats))
+
+	// A writer of the default factory given up before its sync drops
+	// what it holds, it cannot be synced after.
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	fs := newBackupTestFS(t)
+	writer, release, err := options.openWriter(ctx, fs, name.String(), objectio.SchemaData)
+	require.NoError(t, err)
+	_, err = writer.WriteBatch(newInt32Batch(t, mp, []int32{1, 2, 3}))
+	require.NoError(t, err)
+	release()
+	blockWriter := writer.(*trackedWriter).BlockWriterLike.(*blockio.BlockWriter)
+	_, _, err = blockWriter.Sync(ctx)
+	require.ErrorContains(t, err, "aborted")
+	_, err = fs.StatFile(ctx, name.String())
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound))
+	require.Equal(t, int64(1), stats.Phase(StatsPhaseRewrite).Get(StatAbortedWriters))
+
+	// A sync that fails midway leaves part of the object behind, the
+	// abort deletes it.
+	name = objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	torn := &tornFS{FileService: newBackupTestFS(t), tear: name.String()}
+	_, err = options.writeConverted(ctx, torn, name, newInt32Batch(t, mp, []int32{1, 2, 3}), math.MaxUint16)
+	require.ErrorContains(t, err, "crash writing")
+	_, err = torn.StatFile(ctx, name.String())
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrFileNotFound))
+	require.Equal(t, int64(2), stats.Phase(StatsPhaseRewrite).Get(StatAbortedWriters))
+}
+
+func appendObjectInfoRow(bat *containers.Batch, location objectio.Location, blkCnt uint32) {
+	stats := objectio.NewObjectStats()
+	objectio.SetObjectStatsLocation(stats, location)
+	objectio.SetObjectStatsBlkCnt(stats, blkCnt)
+	for i, attr := range bat.Attrs {
+		if attr == ObjectAttr_ObjectStats {
+			bat.Vecs[i].Append(stats[:], false)
+		} else {
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
+
+func appendBlockLocRow(bat *containers.Batch, blkID types.Blockid, metaLoc, deltaLoc objectio.Location) {
+	for i, attr := range bat.Attrs {
+		switch attr {
+		case catalog.BlockMeta_ID:
+			bat.Vecs[i].Append(blkID, false)
+		case catalog.BlockMeta_MetaLoc:
+			bat.Vecs[i].Append([]byte(metaLoc), false)
+		case catalog.BlockMeta_DeltaLoc:
+			bat.Vecs[i].Append([]byte(deltaLoc), false)
+		default:
+			bat.Vecs[i].Append(nil, true)
+		}
+	}
+}
+
+func TestVerifyRewrittenCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	sorted := writeTestObject(t, fs, 0,
+		newInt32Batch(t, mp, []int32{1, 2, 3, 4}),
+		newInt32Batch(t, mp, []int32{5, 6, 7}))
+	blk1 := objectio.BuildObjectBlockid(sorted.Name(), 1)
+	blk1Loc := objectio.BuildLocation(sorted.Name(), sorted.Extent(), 3, 1)
+	tombstone := writeTestTombstone(t, fs, mp,
+		*types.NewRowid(blk1, 0), *types.NewRowid(blk1, 2))
+
+	verify := func(build func(data *CheckpointData)) *VerifyReport {
+		data := NewCheckpointData("", mp)
+		defer data.Close()
+		build(data)
+		data.UpdateObjectInsertMeta(1, 0, int32(data.bats[ObjectInfoIDX].Length()))
+		data.UpdateBlockInsertBlkMeta(1, 0, int32(data.bats[BLKMetaInsertIDX].Length()))
+		location, _, _, err := data.WriteTo(fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+		require.NoError(t, err)
+		report, err := VerifyRewrittenCheckpoint(ctx, fs, location, CheckpointCurrentVersion)
+		require.NoError(t, err)
+		return report
+	}
+
+	good := func(data *CheckpointData) {
+		appendObjectInfoRow(data.bats[ObjectInfoIDX], sorted, 2)
+		appendBlockLocRow(data.bats[BLKMetaInsertIDX], *blk1, blk1Loc, tombstone)
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	report := verify(good)
+	require.True(t, report.OK())
+	require.Equal(t, 2, report.CheckedObjects)
+	require.Equal(t, 1, report.Tombstones.ScannedBlocks)
+
+	// The writer does not sort, so the object is falsely marked sorted.
+	unsorted := writeTestObject(t, fs, 0,
+		newInt32Batch(t, mp, []int32{1, 3, 2}))
+	missing := objectio.BuildLocation(
+		objectio.BuildObjectName(objectio.NewSegmentid(), 0), sorted.Extent(), 3, 0)
+	missingBlk := objectio.BuildObjectBlockid(missing.Name(), 0)
+	// One row past the end of blk1, and one of a block that is missing.
+	dangling := writeTestTombstone(t, fs, mp,
+		*types.NewRowid(blk1, 1), *types.NewRowid(blk1, 3), *types.NewRowid(missingBlk, 0))
+	report = verify(func(data *CheckpointData) {
+		good(data)
+		appendObjectInfoRow(data.bats[ObjectInfoIDX], unsorted, 1)
+		// The object does not have a third block.
+		appendObjectInfoRow(data.bats[ObjectInfoIDX], sorted, 3)
+		appendBlockLocRow(data.bats[BLKMetaInsertIDX], *missingBlk, missing, dangling)
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	})
+	require.False(t, report.OK())
+	require.Equal(t, []string{
+		objectio.BuildLocation(sorted.Name(), sorted.Extent(), 0, 0).String(),
+		missing.String(),
+	}, report.Unresolved)
+	require.Equal(t, 1, len(report.SortViolations))
+	require.Equal(t, unsorted.Name().String(), report.SortViolations[0].Object)
+	require.Equal(t, 2, report.SortViolations[0].Row)
+	require.Equal(t, 2, report.Tombstones.ScannedBlocks)
+	require.Equal(t, map[uint64]int{1: 2}, report.Tombstones.Dangling)
+}
+
+func TestClassifyBlocks(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+
+	data := NewCheckpointData("", mp)
+	defer data.Close()
+	newLocation := func() objectio.Location {
+		return objectio.BuildLocation(
+			objectio.BuildObjectName(objectio.NewSegmentid(), 0), objectio.NewExtent(0, 0, 1, 1), 1, 0)
+	}
+	objectInfo := data.bats[ObjectInfoIDX]
+	appendObject := func(blkCnt uint32, deleted, appendable bool) {
+		appendObjectInfoRow(objectInfo, newLocation(), blkCnt)
+		row := objectInfo.Length() - 1
+		if deleted {
+			objectInfo.GetVectorByName(EntryNode_DeleteAt).Update(row, types.BuildTS(5, 0), false)
+		}
+		objectInfo.GetVectorByName(ObjectAttr_State).Update(row, appendable, false)
+	}
+	appendObject(2, false, false)
+	appendObject(3, false, false)
+	appendObject(1, false, true)
+	appendObject(4, true, false)
+	appendObject(1, true, true)
+
+	newBlock := func() types.Blockid {
+		return *objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+	}
+	a, b, c := newBlock(), newBlock(), newBlock()
+	// a has two delta locations, b none.
+	for _, row := range []struct {
+		id       types.Blockid
+		deltaLoc objectio.Location
+	}{{a, newLocation()}, {a, newLocation()}, {b, nil}} {
+		appendBlockLocRow(data.bats[BLKMetaInsertIDX], row.id, newLocation(), row.deltaLoc)
+		appendTxnRow(data.bats[BLKMetaInsertTxnIDX], 1)
+	}
+	// CN wrote c, and deleted from it, and a.
+	for _, row := range []struct {
+		id      types.Blockid
+		metaLoc objectio.Location
+	}{{c, newLocation()}, {a, nil}} {
+		appendBlockLocRow(data.bats[BLKCNMetaInsertIDX], row.id, row.metaLoc, newLocation())
+		appendBlockMetaRow(data.bats[BLKMetaDeleteIDX], row.id, types.BuildTS(1, 0))
+		appendTxnRow(data.bats[BLKMetaDeleteTxnIDX], 1)
+	}
+	data.UpdateObjectInsertMeta(1, 0, int32(objectInfo.Length()))
+	data.UpdateBlockInsertBlkMeta(1, 0, int32(data.bats[BLKMetaInsertIDX].Length()))
+	data.UpdateBlockDeleteBlkMeta(1, 0, int32(data.bats[BLKCNMetaInsertIDX].Length()))
+	location, _, _, err := data.WriteTo(fs, DefaultCheckpointBlockRows, DefaultCheckpointSize)
+	require.NoError(t, err)
+
+	classification, err := ClassifyBlocks(ctx, "", fs, location, CheckpointCurrentVersion)
+	require.NoError(t, err)
+	require.Equal(t, &BlockClassification{
+		LiveNBlocks:       5,
+		LiveABlocks:       1,
+		DeletedBlocks:     5,
+		TombstonedBlocks:  2,
+		SoftDeletedBlocks: 1,
+	}, classification)
+}
+
+func TestBackupAuxHeader(t *testing.T) {
+	ctx := context.Background()
+	fs := newBackupTestFS(t)
+	readHeader := func(name, kind string) *BackupAuxHeader {
+		buf, err := readBackupFile(ctx, fs, name)
+		require.NoError(t, err)
+		header, _, err := DecodeBackupAux(name, kind, buf)
+		require.NoError(t, err)
+		require.Equal(t, kind, header.Kind)
+		require.Equal(t, backupAuxVersions[kind], header.Version)
+		require.False(t, header.CreatedAt.IsEmpty())
+		require.Equal(t, backupAuxBuild(), header.Build)
+		return header
+	}
+
+	// Journal
+	session, err := NewBackupSession(ctx, fs, WithJournal("journal"))
+	require.NoError(t, err)
+	session.Record("obj", &JournalEntry{Name: []byte("obj"), Size: 10})
+	require.NoError(t, session.Flush(ctx))
+	journalName := BackupAuxName(BackupAuxJournal, "journal")
+	readHeader(journalName, BackupAuxJournal)
+	session, err = NewBackupSession(ctx, fs, WithJournal("journal"))
+	require.NoError(t, err)
+	entry, ok := session.Written("obj")
+	require.True(t, ok)
+	require.Equal(t, int64(10), entry.Size)
+
+	// Soft deletes, spilled at once.
+	set := NewSoftDeletes(WithSoftDeletesSpill(fs, "softdeletes", 1))
+	names := make([]objectio.ObjectName, 2*softDeleteShards)
+	for i := range names {
+		names[i] = objectio.BuildObjectName(objectio.NewSegmentid(), uint16(i))
+		_, err = set.Add(ctx, names[i])
+		require.NoError(t, err)
+	}
+	shardDir := BackupAuxName(BackupAuxSoftDeletes, "softdeletes")
+	shards, err := fs.List(ctx, shardDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, shards)
+	for _, shard := range shards {
+		readHeader(shardDir+"/"+shard.Name, BackupAuxSoftDeletes)
+	}
+	for _, name := range names {
+		ok, err = set.Contains(ctx, name)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// In-place intent
+	require.NoError(t, commitSwap(ctx, fs, &swapIntent{}))
+	readHeader(InPlaceIntentName, BackupAuxInPlace)
+	require.NoError(t, RecoverInPlaceRewrite(ctx, fs, nil))
+
+	// A journal is not an intent.
+	journal, err := readBackupFile(ctx, fs, journalName)
+	require.NoError(t, err)
+	require.NoError(t, writeBackupFile(ctx, fs, InPlaceIntentName, journal))
+	err = RecoverInPlaceRewrite(ctx, fs, nil)
+	require.True(t, IsBackupAuxKindError(err), err)
+	require.NoError(t, fs.Delete(ctx, InPlaceIntentName))
+
+	// Nor is a file without a header.
+	_, _, err = DecodeBackupAux("raw", BackupAuxJournal, []byte(`{"objects":{}}`))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInternal), err)
+
+	// A newer version of the payload is rejected.
+	buf, err := EncodeBackupAux(BackupAuxJournal, types.BuildTS(1, 0), []byte("{}"))
+	require.NoError(t, err)
+	binary.LittleEndian.PutUint16(buf[backupAuxFixedLen:], backupAuxVersions[BackupAuxJournal]+1)
+	_, _, err = DecodeBackupAux("newer", BackupAuxJournal, buf)
+	require.True(t, IsBackupAuxVersionError(err), err)
+
+	// Header fields a newer build added are skipped.
+	buf, err = EncodeBackupAux(BackupAuxJournal, types.BuildTS(1, 0), []byte("{}"))
+	require.NoError(t, err)
+	headerEnd := len(buf) - 2
+	extended := append(append(append([]byte(nil), buf[:headerEnd]...), "future"...), "{}"...)
+	headerLen := binary.LittleEndian.Uint32(buf[len(backupAuxMagic):])
+	binary.LittleEndian.PutUint32(extended[len(backupAuxMagic):], headerLen+uint32(len("future")))
+	header, payload, err := DecodeBackupAux("extended", BackupAuxJournal, extended)
+	require.NoError(t, err)
+	require.Equal(t, BackupAuxJournal, header.Kind)
+	require.Equal(t, "{}", string(payload))
+}
+
+func TestBatchAllocators(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	pool := dbutils.MakeDefaultSmallPool("backup-test-pool")
+	defer pool.Destory()
+	tn, cn := mpool.MustNewZero(), mpool.MustNewZero()
+	options := newBackupOptions(WithBatchAllocators(tn, cn))
+
+	// Cutting the late rows copies the rows kept.
+	bat := formatData(newInt32Batch(t, mp, []int32{1, 2, 3, 4}, []int32{10, 20, 30, 40}), options.tnAllocator)
+	require.NoError(t, cutRows(bat, []int64{2, 3}, true, options.cnAllocator))
+	require.Equal(t, []int32{1, 2}, vector.MustFixedCol[int32](bat.Vecs[0]))
+	require.Equal(t, int64(2), cn.Stats().NumAlloc.Load())
+
+	// Sorting copies the block.
+	sortKey := uint16(0)
+	bat, err := options.sortABlock(ctx, fs, objectio.Location{}, &sortKey, 1,
+		formatData(newInt32Batch(t, mp, []int32{3, 1, 4, 2}, []int32{30, 10, 40, 20}), options.tnAllocator), pool)
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 2, 3, 4}, vector.MustFixedCol[int32](bat.Vecs[0]))
+	require.Equal(t, int64(4), cn.Stats().NumAlloc.Load())
+
+	// Converting to TN batches wraps the vectors, it allocates nothing.
+	require.Zero(t, tn.Stats().NumAlloc.Load())
+}
+
+func TestValidateLocation(t *testing.T) {
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 3)
+	extent := objectio.NewExtent(compress.Lz4, 0, 128, 256)
+	location := objectio.BuildLocation(name, extent, 10, 1)
+	require.NoError(t, ValidateLocation(location))
+	require.NoError(t, ValidateLocation(nil))
+	require.NoError(t, ValidateLocation(make([]byte, objectio.LocationLen)))
+
+	for _, corrupt := range [][]byte{
+		location[:20],
+		append(bytes.Clone(location), 0),
+		objectio.BuildLocation(name, extent, 0, 1),
+		objectio.BuildLocation(name, objectio.NewExtent(compress.Lz4, 0, 0, 0), 10, 1),
+		objectio.BuildLocation(name, objectio.NewExtent(compress.Lz4, math.MaxUint32, 128, 256), 10, 1),
+	} {
+		require.Error(t, ValidateLocation(corrupt))
+	}
+	garbled := bytes.Clone(location)
+	garbled[objectio.NameStringOff] = '#'
+	require.Error(t, ValidateLocation(garbled))
+	unnamed := bytes.Clone(location)
+	copy(unnamed, make([]byte, 8))
+	require.Error(t, ValidateLocation(unnamed))
+}
+
+func FuzzValidateLocation(f *testing.F) {
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 3)
+	location := objectio.BuildLocation(name, objectio.NewExtent(compress.Lz4, 0, 128, 256), 10, 1)
+	f.Add([]byte(location))
+	f.Add([]byte(location[:20]))
+	f.Add(make([]byte, objectio.LocationLen))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if ValidateLocation(buf) != nil {
+			return
+		}
+		// A valid location is safe to read.
+		location := objectio.Location(buf)
+		if location.IsEmpty() {
+			return
+		}
+		_ = location.String()
+		require.NotZero(t, location.Rows())
+		require.Greater(t, location.Extent().End(), location.Extent().Offset())
+	})
+}
+
+func TestRewriteSortsTombstones(t *testing.T) {
+	ctx := context.Background()
+	blockio.Start("")
+	mp := mpool.MustNewZero()
+	fs := newBackupTestFS(t)
+	blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+
+	// A trimmed tombstone, in the current layout, whose rows are out of
+	// order, rowid 0 deleted twice.
+	offsets := []uint32{2, 0, 1, 0}
+	commits := []types.TS{types.BuildTS(5, 0), types.BuildTS(3, 0), types.BuildTS(4, 0), types.BuildTS(1, 0)}
+	newTombstone := func() *batch.Batch {
+		rowids := make([]types.Rowid, len(offsets))
+		for i, offset := range offsets {
+			rowids[i] = *types.NewRowid(blkID, offset)
+		}
+		bat := batch.NewWithSize(4)
+		bat.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+		bat.Vecs[1] = vector.NewVec(types.T_TS.ToType())
+		bat.Vecs[2] = vector.NewVec(types.T_int32.ToType())
+		bat.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[0], rowids, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[1], commits, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[2], []int32{12, 10, 11, 10}, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[3], make([]bool, len(offsets)), nil, mp))
+		bat.SetRowCount(len(offsets))
+		return bat
+	}
+	write := func(opts ...BackupOption) objectio.Location {
+		name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+		block := &blockData{
+			location:  objectio.BuildLocation(name, objectio.Extent{}, uint32(len(offsets)), 0),
+			blockType: objectio.SchemaTombstone,
+			data:      newTombstone(),
+		}
+		written, err := newBackupOptions(opts...).writeRewritten(ctx, fs, name, []*blockData{block})
+		require.NoError(t, err)
+		return objectio.BuildLocation(name, written.extent, uint32(len(offsets)), 0)
+	}
+
+	location := write()
+	bat, err := blockio.LoadOneBlock(ctx, fs, location, objectio.SchemaTombstone)
+	require.NoError(t, err)
+	rowids := vector.MustFixedCol[types.Rowid](bat.Vecs[0])
+	got := make([]uint32, len(rowids))
+	for i := range rowids {
+		got[i] = rowids[i].GetRowOffset()
+	}
+	require.Equal(t, []uint32{0, 0, 1, 2}, got)
+	require.Equal(t, []types.TS{types.BuildTS(1, 0), types.BuildTS(3, 0), types.BuildTS(4, 0), types.BuildTS(5, 0)},
+		vector.MustFixedCol[types.TS](bat.Vecs[1]))
+	require.Equal(t, []int32{10, 10, 11, 12}, vector.MustFixedCol[int32](bat.Vecs[2]))
+	violation, err := verifyTombstoneOrdered(ctx, fs, location)
+	require.NoError(t, err)
+	require.Nil(t, violation)
+
+	// Unless asked not to, and the verification finds it.
+	location = write(WithUnorderedTombstones())
+	violation, err = verifyTombstoneOrdered(ctx, fs, location)
+	require.NoError(t, err)
+	require.Equal(t, &SortViolation{Object: location.Name().String(), Block: 0, Row: 1}, violation)
+}
+
+// newShuffledTombstones returns count tombstone blocks of rows deletes
+// each, of the rows of a block of its own in a random order.
+func newShuffledTombstones(t testing.TB, mp *mpool.MPool, count, rows int) []*blockData {
+	rng := rand.New(rand.NewSource(int64(count * rows)))
+	blocks := make([]*blockData, count)
+	for i := range blocks {
+		blkID := objectio.BuildObjectBlockid(objectio.BuildObjectName(objectio.NewSegmentid(), 0), 0)
+		rowids := make([]types.Rowid, rows)
+		commits := make([]types.TS, rows)
+		pks := make([]int32, rows)
+		for j, row := range rng.Perm(rows) {
+			rowids[j] = *types.NewRowid(blkID, uint32(row))
+			commits[j] = types.BuildTS(int64(row+1), 0)
+			pks[j] = int32(row)
+		}
+		bat := batch.NewWithSize(4)
+		bat.Vecs[0] = vector.NewVec(types.T_Rowid.ToType())
+		bat.Vecs[1] = vector.NewVec(types.T_TS.ToType())
+		bat.Vecs[2] = vector.NewVec(types.T_int32.ToType())
+		bat.Vecs[3] = vector.NewVec(types.T_bool.ToType())
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[0], rowids, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[1], commits, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[2], pks, nil, mp))
+		require.NoError(t, vector.AppendFixedList(bat.Vecs[3], make([]bool, rows), nil, mp))
+		bat.SetRowCount(rows)
+		blocks[i] = &blockData{
+			num:       uint16(i),
+			blockId:   *blkID,
+			blockType: objectio.SchemaTombstone,
+			data:      bat,
+		}
+	}
+	return blocks
+}
+
+func TestRewriteBlockParallelism(t *testing.T) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	const count, rows = 16, 256
+	source := newShuffledTombstones(t, mp, count, rows)
+	defer func() {
+		for _, block := range source {
+			block.data.Clean(mp)
+		}
+	}()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	// write writes the blocks of source, a copy of them with the block
+	// broken if any, and returns the rowids of the blocks written.
+	write := func(broken int, opts ...BackupOption) ([][]types.Rowid, error) {
+		fs := newBackupTestFS(t)
+		blocks := make([]*blockData, count)
+		for i, block := range source {
+			data, err := block.data.Dup(mp)
+			require.NoError(t, err)
+			defer data.Clean(mp)
+			copied := *block
+			copied.data = data
+			blocks[i] = &copied
+		}
+		if broken >= 0 {
+			// A commit ts column that is not one.
+			blocks[broken].data.Vecs[1], blocks[broken].data.Vecs[2] =
+				blocks[broken].data.Vecs[2], blocks[broken].data.Vecs[1]
+		}
+		written, err := newBackupOptions(opts...).writeRewritten(ctx, fs, name, blocks)
+		if err != nil {
+			return nil, err
+		}
+		got := make([][]types.Rowid, count)
+		for i := range got {
+			location := objectio.BuildLocation(name, written.extent, rows, uint16(i))
+			bat, err := blockio.LoadOneBlock(ctx, fs, location, objectio.SchemaTombstone)
+			require.NoError(t, err)
+			got[i] = vector.MustFixedCol[types.Rowid](bat.Vecs[0])
+		}
+		return got, nil
+	}
+
+	serial, err := write(-1)
+	require.NoError(t, err)
+	parallel, err := write(-1, WithBlockParallelism(4))
+	require.NoError(t, err)
+	// The blocks are written in order, each sorted, as serially.
+	require.Equal(t, serial, parallel)
+	for i, rowids := range parallel {
+		require.Len(t, rowids, rows)
+		for j := range rowids {
+			require.Equal(t, source[i].blockId, *rowids[j].BorrowBlockID())
+			require.Equal(t, uint32(j), rowids[j].GetRowOffset())
+		}
+	}
+
+	// A block that fails to sort fails the write, once the blocks
+	// being sorted are done.
+	_, err = write(count/2, WithBlockParallelism(4))
+	require.Error(t, err)
+}
+
+func BenchmarkWriteRewrittenBlocks(b *testing.B) {
+	ctx := context.Background()
+	mp := mpool.MustNewZero()
+	const count, rows = 32, 64 * 1024
+	blocks := newShuffledTombstones(b, mp, count, rows)
+	defer func() {
+		for _, block := range blocks {
+			block.data.Clean(mp)
+		}
+	}()
+	name := objectio.BuildObjectName(objectio.NewSegmentid(), 0)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			options := newBackupOptions(WithBlockParallelism(workers))
+			shuffled := make([]*blockData, count)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j, block := range blocks {
+					data, err := block.data.Dup(mp)
+					require.NoError(b, err)
+					copied := *block
+					copied.data = data
+					shuffled[j] = &copied
+				}
+				fs := newBackupTestFS(b)
+				b.StartTimer()
+				_, err := options.writeRewritten(ctx, fs, name, shuffled)
+				require.NoError(b, err)
+				b.StopTimer()
+				for _, block := range shuffled {
+					block.data.Clean(mp)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestResolveBackupTS(t *testing.T) {
+	ts := func(physical int64) types.TS { return types.BuildTS(physical, 0) }
+	incremental := func(start, end int64) CheckpointSpan {
+		after := ts(start)
+		return CheckpointSpan{Start: after.Next(), End: ts(end)}
+	}
+	// A global checkpoint, incrementals up to 30, a gap, an incremental
+	// after the gap and a global checkpoint that covers it over.
+	chain := []CheckpointSpan{
+		incremental(40, 50),
+		{End: ts(10)},
+		incremental(10, 20),
+		{End: ts(60)},
+		incremental(20, 30),
+	}
+	for _, c := range []struct {
+		requested, resolved int64
+	}{
+		{requested: 10, resolved: 10},
+		{requested: 15, resolved: 10},
+		{requested: 20, resolved: 20},
+		{requested: 35, resolved: 30},
+		{requested: 45, resolved: 30},
+		{requested: 50, resolved: 30},
+		{requested: 60, resolved: 60},
+		{requested: 100, resolved: 60},
+	} {
+		resolved, err := ResolveBackupTS(chain, ts(c.requested))
+		require.NoError(t, err, c.requested)
+		require.Equal(t, ts(c.resolved), resolved, c.requested)
+	}
+
+	// Before the chain, or with a chain that does not start with a
+	// global checkpoint.
+	_, err := ResolveBackupTS(chain, ts(5))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	_, err = ResolveBackupTS([]CheckpointSpan{incremental(10, 20)}, ts(30))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+	_, err = ResolveBackupTS(nil, ts(30))
+	require.True(t, moerr.IsMoErrCode(err, moerr.ErrInvalidInput), err)
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+)
+
+// WithSkipTrimmed returns a checkpoint that a rewrite already wrote as
+// of ts as it is, with RewriteResult.AlreadyTrimmed set, instead of
+// rewriting it again to the same checkpoint, e.g. when a backup is run
+// twice by mistake. The check only reads the provenance of the
+// checkpoint, a checkpoint without one is always rewritten.
+func WithSkipTrimmed() BackupOption {
+	return func(o *backupOptions) {
+		o.skipTrimmed = true
+	}
+}
+
+// TrimmedAt reports whether the last rewrite of the checkpoint of p
+// was as of ts.
+func (p *CheckpointProvenance) TrimmedAt(ts types.TS) bool {
+	if p == nil || len(p.Hops) == 0 {
+		return false
+	}
+	return p.Hops[len(p.Hops)-1].TS == ts.ToString()
+}
+
+// alreadyTrimmed reports whether the checkpoint of provenance can be
+// returned as it is by the rewrite as of ts. A checkpoint with a TN
+// side still has to be rewritten WithCNOnly.
+func (o *backupOptions) alreadyTrimmed(provenance *CheckpointProvenance, ts types.TS) bool {
+	if !o.skipTrimmed || !provenance.TrimmedAt(ts) {
+		return false
+	}
+	return !o.cnOnly || provenance.IsCNOnly()
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+)
+
+// WithColumnTypeUpgrades casts the data columns of the tables in
+// upgrades, by position, to their new type, e.g. for a backup restored
+// into a schema that widened a column from int32 to int64. The trailing
+// metadata columns are kept as they are.
+//
+// The columns are cast as the aBlocks are loaded, before they are
+// trimmed, sorted and converted. The nBlocks are referenced as they are
+// and keep their types, like WithColumnProjection only the blocks the
+// rewrite writes are changed.
+//
+// Integers and floats are cast between each other and strings to wider
+// strings. A value the new type cannot hold exactly, e.g. one out of
+// its range or a float with a fraction cast to an integer, fails the
+// rewrite, and so does a cast between other types.
+func WithColumnTypeUpgrades(upgrades map[uint64]map[uint16]types.Type) BackupOption {
+	return func(o *backupOptions) {
+		o.upgrades = upgrades
+	}
+}
+
+// upgradeColumns casts the columns of bat, an aBlock of table tid, to
+// the types of WithColumnTypeUpgrades. The columns are replaced in bat
+// once they are all cast, bat is freed when it fails, as the
+// BatchNormalizer does.
+func (o *backupOptions) upgradeColumns(tid uint64, bat *batch.Batch) (*batch.Batch, error) {
+	upgrades, ok := o.upgrades[tid]
+	if !ok {
+		return bat, nil
+	}
+	cols := make([]int, 0, len(upgrades))
+	for col := range upgrades {
+		cols = append(cols, int(col))
+	}
+	sort.Ints(cols)
+	dataCols := len(bat.Vecs) - appendableMetaColumns
+	cast := make(map[int]*vector.Vector, len(cols))
+	fail := func(err error) (*batch.Batch, error) {
+		for _, vec := range cast {
+			vec.Free(o.tnAllocator)
+		}
+		bat.Clean(o.tnAllocator)
+		return nil, err
+	}
+	for _, col := range cols {
+		if col >= dataCols {
+			return fail(moerr.NewInternalErrorNoCtx(
+				"upgraded column %d of table %d is not a data column, %d data columns", col, tid, dataCols))
+		}
+		to := upgrades[uint16(col)]
+		if sameColumnType(*bat.Vecs[col].GetType(), to) {
+			continue
+		}
+		vec, err := castColumn(bat.Vecs[col], to, o.tnAllocator)
+		if err != nil {
+			return fail(moerr.NewInternalErrorNoCtx("upgrade column %d of table %d: %v", col, tid, err))
+		}
+		cast[col] = vec
+	}
+	for col, vec := range cast {
+		bat.Vecs[col].Free(o.tnAllocator)
+		bat.Vecs[col] = vec
+	}
+	return bat, nil
+}
+
+func sameColumnType(a, b types.Type) bool {
+	return a.Oid == b.Oid && a.Width == b.Width && a.Scale == b.Scale
+}
+
+// castColumn returns a copy of vec cast to the type to, allocated from
+// mp, see WithColumnTypeUpgrades.
+func castColumn(vec *vector.Vector, to types.Type, mp *mpool.MPool) (*vector.Vector, error) {
+	switch vec.GetType().Oid {
+	case types.T_int8:
+		return castNumbersFrom[int8](vec, to, mp)
+	case types.T_int16:
+		return castNumbersFrom[int16](vec, to, mp)
+	case types.T_int32:
+		return castNumbersFrom[int32](vec, to, mp)
+	case types.T_int64:
+		return castNumbersFrom[int64](vec, to, mp)
+	case types.T_uint8:
+		return castNumbersFrom[uint8](vec, to, mp)
+	case types.T_uint16:
+		return castNumbersFrom[uint16](vec, to, mp)
+	case types.T_uint32:
+		return castNumbersFrom[uint32](vec, to, mp)
+	case types.T_uint64:
+		return castNumbersFrom[uint64](vec, to, mp)
+	case types.T_float32:
+		return castNumbersFrom[float32](vec, to, mp)
+	case types.T_float64:
+		return castNumbersFrom[float64](vec, to, mp)
+	case types.T_char, types.T_varchar, types.T_text:
+		return castStrings(vec, to, mp)
+	}
+	return nil, incompatibleCast(vec, to)
+}
+
+type castNumber interface {
+	~int8 | ~int16 | ~int32 | ~int64 | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64
+}
+
+func castNumbersFrom[F castNumber](vec *vector.Vector, to types.Type, mp *mpool.MPool) (*vector.Vector, error) {
+	switch to.Oid {
+	case types.T_int8:
+		return castNumbers[F, int8](vec, to, mp)
+	case types.T_int16:
+		return castNumbers[F, int16](vec, to, mp)
+	case types.T_int32:
+		return castNumbers[F, int32](vec, to, mp)
+	case types.T_int64:
+		return castNumbers[F, int64](vec, to, mp)
+	case types.T_uint8:
+		return castNumbers[F, uint8](vec, to, mp)
+	case types.T_uint16:
+		return castNumbers[F, uint16](vec, to, mp)
+	case types.T_uint32:
+		return castNumbers[F, uint32](vec, to, mp)
+	case types.T_uint64:
+		return castNumbers[F, uint64](vec, to, mp)
+	case types.T_float32:
+		return castNumbers[F, float32](vec, to, mp)
+	case types.T_float64:
+		return castNumbers[F, float64](vec, to, mp)
+	}
+	return nil, incompatibleCast(vec, to)
+}
+
+// castNumbers casts the values of vec from F to T. A value is cast if it
+// converts back to itself with its sign, nothing is rounded nor wraps.
+func castNumbers[F, T castNumber](vec *vector.Vector, to types.Type, mp *mpool.MPool) (*vector.Vector, error) {
+	result := vector.NewVec(to)
+	for i := 0; i < vec.Length(); i++ {
+		var value T
+		isNull := vec.IsNull(uint64(i))
+		if !isNull {
+			from := vector.GetFixedAt[F](vec, i)
+			value = T(from)
+			// NaN is never equal to itself, it is kept by a float.
+			nan := from != from && value != value
+			if !nan && (F(value) != from || (value < 0) != (from < 0)) {
+				result.Free(mp)
+				return nil, moerr.NewInternalErrorNoCtx("%v at row %d does not fit %s",
+					from, i, to.String())
+			}
+		}
+		if err := vector.AppendFixed(result, value, isNull, mp); err != nil {
+			result.Free(mp)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// castStrings casts the strings of vec to to, whose width, if it has
+// one, is in characters.
+func castStrings(vec *vector.Vector, to types.Type, mp *mpool.MPool) (*vector.Vector, error) {
+	switch to.Oid {
+	case types.T_char, types.T_varchar, types.T_text:
+	default:
+		return nil, incompatibleCast(vec, to)
+	}
+	width := 0
+	if to.Oid != types.T_text {
+		width = int(to.Width)
+	}
+	result := vector.NewVec(to)
+	for i := 0; i < vec.Length(); i++ {
+		var value []byte
+		isNull := vec.IsNull(uint64(i))
+		if !isNull {
+			value = vec.GetBytesAt(i)
+			if width > 0 && utf8.RuneCount(value) > width {
+				result.Free(mp)
+				return nil, moerr.NewInternalErrorNoCtx("%q at row %d does not fit %s",
+					value, i, to.String())
+			}
+		}
+		if err := vector.AppendBytes(result, value, isNull, mp); err != nil {
+			result.Free(mp)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func incompatibleCast(vec *vector.Vector, to types.Type) error {
+	return moerr.NewNotSupportedNoCtx("cast of %s to %s", vec.GetType().String(), to.String())
+}
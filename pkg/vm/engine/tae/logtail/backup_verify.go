@@ -0,0 +1,560 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/matrixorigin/matrixone/pkg/catalog"
+	"github.com/matrixorigin/matrixone/pkg/common/moerr"
+	"github.com/matrixorigin/matrixone/pkg/container/types"
+	"github.com/matrixorigin/matrixone/pkg/container/vector"
+	"github.com/matrixorigin/matrixone/pkg/fileservice"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/common"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/compute"
+	"github.com/matrixorigin/matrixone/pkg/vm/engine/tae/containers"
+)
+
+// verifyObjectSorted checks every block of a non-appendable object
+// that declares a sort key, and returns the blocks whose sort key
+// column is not ordered.
+func verifyObjectSorted(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+) ([]SortViolation, error) {
+	meta, err := readObjectMeta(ctx, fs, location)
+	if err != nil {
+		return nil, err
+	}
+	dataMeta := meta.MustDataMeta()
+	header := dataMeta.BlockHeader()
+	if header.Appendable() || header.SortKey() == math.MaxUint16 {
+		return nil, nil
+	}
+	sortKey := header.SortKey()
+	name := location.Name()
+	violations := make([]SortViolation, 0)
+	for i := uint32(0); i < dataMeta.BlockCount(); i++ {
+		blk := dataMeta.GetBlockMeta(i)
+		blkLoc := objectio.BuildLocation(name, blk.GetExtent(), blk.GetRows(), blk.GetID())
+		bat, err := readBlockColumns(ctx, fs, &dataMeta, blkLoc, []uint16{sortKey})
+		if err != nil {
+			return nil, err
+		}
+		row := firstUnsortedRow(bat.Vecs[0])
+		if row >= 0 {
+			v := SortViolation{
+				Object: name.String(),
+				Block:  blk.GetID(),
+				Row:    row,
+			}
+			jobLogger(ctx).Warn("[VerifySort]", common.OperationField("block is not sorted"),
+				common.AnyField("block", v.String()))
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// firstUnsortedRow returns the first row of vec that is smaller than
+// the previous non-null row, or -1 if vec is ordered.
+func firstUnsortedRow(vec *vector.Vector) int {
+	typ := vec.GetType()
+	prev := -1
+	for i := 0; i < vec.Length(); i++ {
+		if vec.IsNull(uint64(i)) {
+			continue
+		}
+		if prev >= 0 && compute.Compare(
+			vec.GetRawBytesAt(prev), vec.GetRawBytesAt(i),
+			typ.Oid, typ.Scale, typ.Scale) > 0 {
+			return i
+		}
+		prev = i
+	}
+	return -1
+}
+
+// TombstoneReport is the result of VerifyTombstoneReferences.
+type TombstoneReport struct {
+	// ScannedBlocks is the number of tombstone blocks read.
+	ScannedBlocks int
+	// SkippedBlocks is the number of tombstone blocks left out by
+	// sampling.
+	SkippedBlocks int
+	// Dangling counts, per table, the tombstone rows whose rowid points
+	// at a block the backup does not contain.
+	Dangling map[uint64]int
+}
+
+func (r *TombstoneReport) DanglingRows() int {
+	total := 0
+	for _, n := range r.Dangling {
+		total += n
+	}
+	return total
+}
+
+// VerifyTombstoneReferences checks that every tombstone row of the
+// checkpoint at location deletes from a block the checkpoint contains,
+// either as part of a listed object or as a block meta row. Objects
+// that were dropped are still listed, so their tombstones are fine.
+//
+// The tombstone blocks are read one at a time and only their rowid
+// column is loaded. With sample > 1 only every sample-th tombstone
+// block is read.
+func VerifyTombstoneReferences(
+	ctx context.Context,
+	sid string,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+	sample int,
+) (*TombstoneReport, error) {
+	data, err := getCheckpointData(ctx, sid, fs, location, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	blocks := checkpointBlockSet(data)
+	return verifyTombstoneReferences(ctx, fs, data, sample, func(rowid *types.Rowid) bool {
+		_, ok := blocks[*rowid.BorrowBlockID()]
+		return ok
+	}, nil)
+}
+
+// verifyTombstoneReferences counts the tombstone rows of data whose
+// rowid exists rejects. The tombstone blocks in skip are not read.
+func verifyTombstoneReferences(
+	ctx context.Context,
+	fs fileservice.FileService,
+	data *CheckpointData,
+	sample int,
+	exists func(rowid *types.Rowid) bool,
+	skip map[string]struct{},
+) (*TombstoneReport, error) {
+	if sample < 1 {
+		sample = 1
+	}
+	report := &TombstoneReport{
+		Dangling: make(map[uint64]int),
+	}
+	seen := make(map[string]struct{})
+	err := data.ForEachBlockMeta(func(view BlockMetaView) error {
+		deltaLoc := view.DeltaLoc()
+		if view.Source() != BlockMetaInsert || deltaLoc.IsEmpty() {
+			return nil
+		}
+		// Several block meta rows can share one tombstone block.
+		if _, ok := seen[deltaLoc.String()]; ok {
+			return nil
+		}
+		seen[deltaLoc.String()] = struct{}{}
+		if _, ok := skip[deltaLoc.String()]; ok {
+			report.SkippedBlocks++
+			return nil
+		}
+		if (len(seen)-1)%sample != 0 {
+			report.SkippedBlocks++
+			return nil
+		}
+		dangling, err := countTombstoneRows(ctx, fs, deltaLoc, exists)
+		if err != nil {
+			return err
+		}
+		report.ScannedBlocks++
+		if dangling > 0 {
+			tid := view.TID()
+			report.Dangling[tid] += dangling
+			jobLogger(ctx).Warn("[VerifyTombstone]", common.OperationField("dangling tombstone"),
+				common.AnyField("table", tid),
+				common.AnyField("tombstone", deltaLoc.String()),
+				common.AnyField("rows", dangling))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkpointBlockSet returns the ids of all the blocks the checkpoint
+// contains.
+func checkpointBlockSet(data *CheckpointData) map[types.Blockid]struct{} {
+	blocks := make(map[types.Blockid]struct{})
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			name := stats.ObjectName()
+			for blk := uint32(0); blk < stats.BlkCnt(); blk++ {
+				blocks[*objectio.BuildObjectBlockid(name, uint16(blk))] = struct{}{}
+			}
+		}
+	}
+	_ = data.ForEachBlockMeta(func(view BlockMetaView) error {
+		if view.Source() == BlockMetaInsert && !view.MetaLoc().IsEmpty() {
+			blocks[view.Blockid()] = struct{}{}
+		}
+		return nil
+	})
+	return blocks
+}
+
+// checkTombstoneBlock returns the number of rows of the tombstone block
+// at location that delete from a block not in blocks.
+func checkTombstoneBlock(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	blocks map[types.Blockid]struct{},
+) (int, error) {
+	return countTombstoneRows(ctx, fs, location, func(rowid *types.Rowid) bool {
+		_, ok := blocks[*rowid.BorrowBlockID()]
+		return ok
+	})
+}
+
+// countTombstoneRows returns the number of rows of the tombstone block
+// at location whose rowid exists rejects.
+func countTombstoneRows(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	exists func(rowid *types.Rowid) bool,
+) (int, error) {
+	tombstoneMeta, layout, err := readTombstoneMeta(ctx, fs, location)
+	if err != nil {
+		return 0, err
+	}
+	bat, err := readBlockColumns(ctx, fs, &tombstoneMeta, location, []uint16{uint16(layout.rowid)})
+	if err != nil {
+		return 0, err
+	}
+	dangling := 0
+	rowids := vector.MustFixedCol[types.Rowid](bat.Vecs[0])
+	for i := range rowids {
+		if !exists(&rowids[i]) {
+			dangling++
+		}
+	}
+	return dangling, nil
+}
+
+// VerifyReport is the result of VerifyRewrittenCheckpoint.
+type VerifyReport struct {
+	// CheckedObjects is the number of objects whose meta was loaded.
+	CheckedObjects int
+	// Unresolved lists the locations the checkpoint references whose
+	// object is missing from the backup, or does not have the block.
+	Unresolved []string
+	// SortViolations lists the blocks marked sorted that are not.
+	SortViolations []SortViolation
+	// Tombstones counts the tombstone rows that delete a row the backup
+	// does not contain, past the end of its block included.
+	Tombstones *TombstoneReport
+	// UnorderedTombstones lists the tombstone blocks whose rows are not
+	// ordered by rowid then commit ts.
+	UnorderedTombstones []SortViolation
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Unresolved) == 0 &&
+		len(r.SortViolations) == 0 &&
+		r.Tombstones.DanglingRows() == 0 &&
+		len(r.UnorderedTombstones) == 0
+}
+
+// VerifyRewrittenCheckpoint checks the output of a rewrite in fs, the
+// destination of the rewrite, without changing it: every object and
+// block location of the checkpoint at location must resolve, the
+// blocks of the objects that declare a sort key must be sorted, and
+// every tombstone row must delete a row of a block the backup contains
+// and the rows of every tombstone block must be ordered. Problems are collected in the report, the error is for a checkpoint
+// or an object that cannot be read.
+func VerifyRewrittenCheckpoint(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+	version uint32,
+) (*VerifyReport, error) {
+	data, err := getCheckpointData(ctx, "", fs, location, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	return verifyRewrittenCheckpoint(ctx, fs, data)
+}
+
+// unknownBlockRows is the row count of a block whose object has no
+// meta, e.g. an appendable object that was not flushed.
+const unknownBlockRows = math.MaxUint32
+
+type checkpointVerifier struct {
+	ctx    context.Context
+	fs     fileservice.FileService
+	report *VerifyReport
+	// metas caches the meta of the objects by name, nil for the objects
+	// missing from fs.
+	metas map[string]objectio.ObjectMeta
+	// rows is the row count of every block the backup contains.
+	rows map[types.Blockid]uint32
+	// sorted holds one location per object whose sort order is checked.
+	sorted map[string]objectio.Location
+}
+
+func verifyRewrittenCheckpoint(
+	ctx context.Context,
+	fs fileservice.FileService,
+	data *CheckpointData,
+) (*VerifyReport, error) {
+	v := &checkpointVerifier{
+		ctx:    ctx,
+		fs:     fs,
+		report: &VerifyReport{},
+		metas:  make(map[string]objectio.ObjectMeta),
+		rows:   make(map[types.Blockid]uint32),
+		sorted: make(map[string]objectio.Location),
+	}
+	for _, idx := range []uint16{ObjectInfoIDX, TNObjectInfoIDX} {
+		bat := data.bats[idx]
+		statsVec := bat.GetVectorByName(ObjectAttr_ObjectStats)
+		for i := 0; i < bat.Length(); i++ {
+			var stats objectio.ObjectStats
+			stats.UnMarshal(statsVec.Get(i).([]byte))
+			if err := v.checkObject(&stats); err != nil {
+				return nil, err
+			}
+		}
+	}
+	blkMeta := data.bats[BLKMetaInsertIDX]
+	ids := blkMeta.GetVectorByName(catalog.BlockMeta_ID)
+	metaLocs := blkMeta.GetVectorByName(catalog.BlockMeta_MetaLoc)
+	deltaLocs := blkMeta.GetVectorByName(catalog.BlockMeta_DeltaLoc)
+	missing := make(map[string]struct{})
+	tombstones := make(map[string]objectio.Location)
+	for i := 0; i < blkMeta.Length(); i++ {
+		metaLoc := objectio.Location(metaLocs.Get(i).([]byte))
+		if !metaLoc.IsEmpty() {
+			ok, err := v.resolve(metaLoc, false)
+			if err != nil {
+				return nil, err
+			}
+			id := ids.Get(i).(types.Blockid)
+			if _, known := v.rows[id]; ok && !known {
+				v.rows[id] = metaLoc.Rows()
+			}
+		}
+		deltaLoc := objectio.Location(deltaLocs.Get(i).([]byte))
+		if !deltaLoc.IsEmpty() {
+			ok, err := v.resolve(deltaLoc, true)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				missing[deltaLoc.String()] = struct{}{}
+			} else {
+				tombstones[deltaLoc.String()] = deltaLoc
+			}
+		}
+	}
+	names := make([]string, 0, len(v.sorted))
+	for name := range v.sorted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		violations, err := verifyObjectSorted(ctx, fs, v.sorted[name])
+		if err != nil {
+			return nil, err
+		}
+		v.report.SortViolations = append(v.report.SortViolations, violations...)
+	}
+	locations := make([]string, 0, len(tombstones))
+	for location := range tombstones {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	for _, location := range locations {
+		violation, err := verifyTombstoneOrdered(ctx, fs, tombstones[location])
+		if err != nil {
+			return nil, err
+		}
+		if violation != nil {
+			v.report.UnorderedTombstones = append(v.report.UnorderedTombstones, *violation)
+		}
+	}
+	report, err := verifyTombstoneReferences(ctx, fs, data, 1, v.rowExists, missing)
+	if err != nil {
+		return nil, err
+	}
+	v.report.Tombstones = report
+	return v.report, nil
+}
+
+// verifyTombstoneOrdered checks that the rows of the tombstone block at
+// location are ordered by rowid then commit ts, and returns where they
+// are not.
+func verifyTombstoneOrdered(
+	ctx context.Context,
+	fs fileservice.FileService,
+	location objectio.Location,
+) (*SortViolation, error) {
+	tombstoneMeta, layout, err := readTombstoneMeta(ctx, fs, location)
+	if err != nil {
+		return nil, err
+	}
+	columns := tombstoneMeta.BlockHeader().ColumnCount()
+	idxes := []uint16{uint16(layout.rowid)}
+	if commitTs := layout.commitTsIdx(int(columns)); commitTs > layout.rowid {
+		idxes = append(idxes, uint16(commitTs))
+	}
+	bat, err := readBlockColumns(ctx, fs, &tombstoneMeta, location, idxes)
+	if err != nil {
+		return nil, err
+	}
+	var commits *vector.Vector
+	if len(bat.Vecs) > 1 {
+		commits = bat.Vecs[1]
+	}
+	keys, err := tombstoneKeys(bat.Vecs[0], commits, location)
+	if err != nil {
+		return nil, err
+	}
+	row := keys.firstUnordered()
+	if row < 0 {
+		return nil, nil
+	}
+	violation := &SortViolation{
+		Object: location.Name().String(),
+		Block:  location.ID(),
+		Row:    row,
+	}
+	jobLogger(ctx).Warn("[VerifyTombstone]", common.OperationField("tombstone is not ordered"),
+		common.AnyField("block", violation.String()))
+	return violation, nil
+}
+
+// checkObject resolves the object of stats and records its blocks.
+func (v *checkpointVerifier) checkObject(stats *objectio.ObjectStats) error {
+	name := stats.ObjectName()
+	if stats.Extent().End() == 0 {
+		for blk := uint32(0); blk < stats.BlkCnt(); blk++ {
+			id := *objectio.BuildObjectBlockid(name, uint16(blk))
+			if _, ok := v.rows[id]; !ok {
+				v.rows[id] = unknownBlockRows
+			}
+		}
+		return nil
+	}
+	location := stats.ObjectLocation()
+	meta, err := v.objectMeta(location)
+	if err != nil || meta == nil {
+		return err
+	}
+	dataMeta, ok := meta.DataMeta()
+	if !ok || dataMeta.BlockCount() < stats.BlkCnt() {
+		v.unresolved(location)
+		return nil
+	}
+	v.sorted[name.String()] = location
+	return nil
+}
+
+// resolve tells if location resolves to a block of its object, and
+// reports it otherwise.
+func (v *checkpointVerifier) resolve(location objectio.Location, tombstone bool) (bool, error) {
+	meta, err := v.objectMeta(location)
+	if err != nil || meta == nil {
+		return false, err
+	}
+	blocks, ok := meta.DataMeta()
+	if tombstone {
+		blocks, ok = meta.TombstoneMeta()
+	}
+	if !ok || uint32(location.ID()) >= blocks.BlockCount() {
+		v.unresolved(location)
+		return false, nil
+	}
+	return true, nil
+}
+
+// objectMeta loads the meta of the object of location once, and records
+// the rows of its data blocks. A missing object is reported and has a
+// nil meta.
+func (v *checkpointVerifier) objectMeta(location objectio.Location) (objectio.ObjectMeta, error) {
+	name := location.Name()
+	if meta, ok := v.metas[name.String()]; ok {
+		if meta == nil {
+			v.unresolved(location)
+		}
+		return meta, nil
+	}
+	meta, err := readObjectMeta(v.ctx, v.fs, location)
+	if moerr.IsMoErrCode(err, moerr.ErrFileNotFound) {
+		v.metas[name.String()] = nil
+		v.unresolved(location)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.metas[name.String()] = meta
+	v.report.CheckedObjects++
+	if dataMeta, ok := meta.DataMeta(); ok {
+		for i := uint32(0); i < dataMeta.BlockCount(); i++ {
+			blk := dataMeta.GetBlockMeta(i)
+			v.rows[*objectio.BuildObjectBlockid(name, blk.GetID())] = blk.GetRows()
+		}
+	}
+	return meta, nil
+}
+
+func (v *checkpointVerifier) unresolved(location objectio.Location) {
+	jobLogger(v.ctx).Warn("[VerifyRewrite]", common.OperationField("location does not resolve"),
+		common.AnyField("location", location.String()))
+	v.report.Unresolved = append(v.report.Unresolved, location.String())
+}
+
+func (v *checkpointVerifier) rowExists(rowid *types.Rowid) bool {
+	rows, ok := v.rows[*rowid.BorrowBlockID()]
+	return ok && (rows == unknownBlockRows || rowid.GetRowOffset() < rows)
+}
+
+// CompareCheckpointData compares the batches of a and b, except the ones
+// at ignoreBatchIdxs, and describes how they differ.
+func CompareCheckpointData(a, b *CheckpointData, ignoreBatchIdxs ...uint16) containers.Diff {
+	ignored := make(map[uint16]struct{}, len(ignoreBatchIdxs))
+	for _, idx := range ignoreBatchIdxs {
+		ignored[idx] = struct{}{}
+	}
+	var diff containers.Diff
+	for idx := uint16(0); idx < MaxIDX; idx++ {
+		if _, ok := ignored[idx]; ok {
+			continue
+		}
+		diff.Merge(fmt.Sprintf("batch %d: ", idx),
+			containers.CompareBatches(a.bats[idx], b.bats[idx], containers.CompareOptions{}))
+	}
+	return diff
+}
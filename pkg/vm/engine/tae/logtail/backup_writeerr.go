@@ -0,0 +1,93 @@
+// Copyright 2021 Matrix Origin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtail
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrixorigin/matrixone/pkg/container/batch"
+	"github.com/matrixorigin/matrixone/pkg/objectio"
+)
+
+// BackupError is returned when the writer of an object of the
+// destination fails. It names the object and how much of it was written
+// before, so that it can be matched with the logs of the object store.
+type BackupError struct {
+	// Op is the call of the writer that failed: write batch, write
+	// tombstone batch or sync.
+	Op     string
+	Object string
+	// Blocks, Rows and Bytes are what was written to the object before
+	// Op, the bytes are those of the batches written.
+	Blocks int
+	Rows   int
+	Bytes  int64
+	Err    error
+}
+
+func (e *BackupError) Error() string {
+	return fmt.Sprintf("%s of object %s failed after %d blocks, %d rows, %d bytes: %v",
+		e.Op, e.Object, e.Blocks, e.Rows, e.Bytes, e.Err)
+}
+
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+func IsBackupError(err error) bool {
+	var be *BackupError
+	return errors.As(err, &be)
+}
+
+// objectWrite counts what is written to the object name, for the
+// BackupError of a failed call of its writer.
+type objectWrite struct {
+	name   objectio.ObjectName
+	blocks int
+	rows   int
+	bytes  int64
+}
+
+// write writes bat to writer as a block of schema.
+func (w *objectWrite) write(writer BlockWriterLike, schema objectio.DataMetaType, bat *batch.Batch) (err error) {
+	op := "write batch"
+	if schema == objectio.SchemaTombstone {
+		op = "write tombstone batch"
+		_, err = writer.WriteTombstoneBatch(bat)
+	} else {
+		_, err = writer.WriteBatch(bat)
+	}
+	if err != nil {
+		return w.fail(op, err)
+	}
+	w.blocks++
+	w.rows += bat.RowCount()
+	w.bytes += int64(bat.Size())
+	return nil
+}
+
+// fail wraps err, the error of the call op of the writer, in a
+// BackupError.
+func (w *objectWrite) fail(op string, err error) error {
+	return &BackupError{
+		Op:     op,
+		Object: w.name.String(),
+		Blocks: w.blocks,
+		Rows:   w.rows,
+		Bytes:  w.bytes,
+		Err:    err,
+	}
+}
@@ -23,6 +23,7 @@ import (
 	pkgcatalog "github.com/matrixorigin/matrixone/pkg/catalog"
 	"github.com/matrixorigin/matrixone/pkg/common/moerr"
 	"github.com/matrixorigin/matrixone/pkg/common/mpool"
+	"github.com/matrixorigin/matrixone/pkg/compress"
 	"github.com/matrixorigin/matrixone/pkg/container/batch"
 	"github.com/matrixorigin/matrixone/pkg/container/types"
 	"github.com/matrixorigin/matrixone/pkg/container/vector"
@@ -788,6 +789,14 @@ type CheckpointData struct {
 	locations map[string]objectio.Location
 	bats      [MaxIDX]*containers.Batch
 	allocator *mpool.MPool
+	// compression is the codec WriteTo writes the checkpoint with, the
+	// reader picks it up from the extents.
+	compression uint8
+	// cnOnly makes WriteTo leave out the TN meta, see SetCNOnly.
+	cnOnly bool
+	// provenance is that of a rewritten checkpoint, see
+	// LoadCheckpointEntriesFromKey.
+	provenance *CheckpointProvenance
 }
 
 func NewCheckpointData(
@@ -795,9 +804,10 @@ func NewCheckpointData(
 	mp *mpool.MPool,
 ) *CheckpointData {
 	data := &CheckpointData{
-		sid:       sid,
-		meta:      make(map[uint64]*CheckpointMeta),
-		allocator: mp,
+		sid:         sid,
+		meta:        make(map[uint64]*CheckpointMeta),
+		allocator:   mp,
+		compression: compress.Lz4,
 	}
 	for idx, schema := range checkpointDataSchemas_Curr {
 		data.bats[idx] = makeRespBatchFromSchema(schema, mp)
@@ -808,8 +818,9 @@ func NewCheckpointData(
 // for test
 func NewCheckpointDataWithVersion(ver uint32, mp *mpool.MPool) *CheckpointData {
 	data := &CheckpointData{
-		meta:      make(map[uint64]*CheckpointMeta),
-		allocator: mp,
+		meta:        make(map[uint64]*CheckpointMeta),
+		allocator:   mp,
+		compression: compress.Lz4,
 	}
 
 	for idx, item := range checkpointDataReferVersions[ver] {
@@ -1882,6 +1893,29 @@ func (data *CheckpointData) FormatData(mp *mpool.MPool) (err error) {
 	return
 }
 
+func (data *CheckpointData) SetCompression(algo uint8) {
+	data.compression = algo
+}
+
+// SetCNOnly makes WriteTo write only what a CN reads of the checkpoint.
+// The TN meta is left out and WriteTo returns an empty TNLocation, the
+// checkpoint cannot be replayed by a TN.
+func (data *CheckpointData) SetCNOnly(cnOnly bool) {
+	data.cnOnly = cnOnly
+}
+
+func (data *CheckpointData) newWriter(
+	fs fileservice.FileService,
+	name objectio.ObjectName,
+) (*blockio.BlockWriter, error) {
+	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetCompression(data.compression)
+	return writer, nil
+}
+
 type blockIndexes struct {
 	fileNum uint16
 	indexes *BlockLocation
@@ -1896,7 +1930,7 @@ func (data *CheckpointData) WriteTo(
 	segmentid := objectio.NewSegmentid()
 	fileNum := uint16(0)
 	name := objectio.BuildObjectName(segmentid, fileNum)
-	writer, err := blockio.NewBlockWriterNew(fs, name, 0, nil)
+	writer, err := data.newWriter(fs, name)
 	if err != nil {
 		return
 	}
@@ -1925,7 +1959,7 @@ func (data *CheckpointData) WriteTo(
 			}
 			checkpointFiles = append(checkpointFiles, name.String())
 			name = objectio.BuildObjectName(segmentid, fileNum)
-			writer, err = blockio.NewBlockWriterNew(fs, name, 0, nil)
+			writer, err = data.newWriter(fs, name)
 			if err != nil {
 				return
 			}
@@ -1977,7 +2011,9 @@ func (data *CheckpointData) WriteTo(
 	schemas = append(schemas, schemaTypes)
 	objectBlocks = append(objectBlocks, blks)
 
-	data.prepareTNMetaBatch(checkpointNames, objectBlocks, schemas)
+	if !data.cnOnly {
+		data.prepareTNMetaBatch(checkpointNames, objectBlocks, schemas)
+	}
 
 	for tid, mata := range data.meta {
 		for i, table := range mata.tables {
@@ -2046,7 +2082,7 @@ func (data *CheckpointData) WriteTo(
 
 	segmentid2 := objectio.NewSegmentid()
 	name2 := objectio.BuildObjectName(segmentid2, 0)
-	writer2, err := blockio.NewBlockWriterNew(fs, name2, 0, nil)
+	writer2, err := data.newWriter(fs, name2)
 	if err != nil {
 		return
 	}
@@ -2058,17 +2094,24 @@ func (data *CheckpointData) WriteTo(
 	if err != nil {
 		return
 	}
-	if _, _, err = writer2.WriteSubBatch(
-		containers.ToCNBatch(data.bats[TNMetaIDX]),
-		objectio.ConvertToSchemaType(uint16(TNMetaIDX))); err != nil {
-		return
+	if !data.cnOnly {
+		if _, _, err = writer2.WriteSubBatch(
+			containers.ToCNBatch(data.bats[TNMetaIDX]),
+			objectio.ConvertToSchemaType(uint16(TNMetaIDX))); err != nil {
+			return
+		}
 	}
 	if err != nil {
 		return
 	}
 	blks2, _, err := writer2.Sync(context.Background())
+	if err != nil {
+		return
+	}
 	CNLocation = objectio.BuildLocation(name2, blks2[0].GetExtent(), 0, blks2[0].GetID())
-	TNLocation = objectio.BuildLocation(name2, blks2[1].GetExtent(), 0, blks2[1].GetID())
+	if !data.cnOnly {
+		TNLocation = objectio.BuildLocation(name2, blks2[1].GetExtent(), 0, blks2[1].GetID())
+	}
 	return
 }
 
@@ -2082,6 +2125,36 @@ func validateBeforeLoadBlkCol(version uint32, idxs []uint16, colNames []string)
 	return idxs
 }
 
+// checkColumn returns an error if vec, as decoded, has less data than
+// rows or values out of its area. The vector is decoded in place from
+// the file, a corrupt one would panic when cloned.
+func checkColumn(vec *vector.Vector) error {
+	if vec.IsConstNull() {
+		return nil
+	}
+	rows := vec.Length()
+	if vec.IsConst() {
+		rows = 1
+	}
+	typ := vec.GetType()
+	if len(vec.GetData()) < rows*typ.TypeSize() {
+		return moerr.NewInternalErrorNoCtx("%d rows of %s in %d bytes", rows, typ.String(), len(vec.GetData()))
+	}
+	if !typ.IsVarlen() {
+		return nil
+	}
+	values, area := vector.MustVarlenaRawData(vec)
+	for i := range values {
+		if values[i].IsSmall() || vec.IsNull(uint64(i)) {
+			continue
+		}
+		if offset, length := values[i].OffsetLen(); uint64(offset)+uint64(length) > uint64(len(area)) {
+			return moerr.NewInternalErrorNoCtx("value %d at %d of %d bytes, the area is %d bytes", i, offset, length, len(area))
+		}
+	}
+	return nil
+}
+
 func LoadBlkColumnsByMeta(
 	version uint32,
 	cxt context.Context,
@@ -2113,9 +2186,33 @@ func LoadBlkColumnsByMeta(
 	if err != nil {
 		return nil, err
 	}
+	// the type of a column is that of its file, a corrupt one must not
+	// reach the readers of the batches
+	for _, ioResult := range ioResults {
+		for i, idx := range idxs {
+			if typ := ioResult.Vecs[i].GetType(); typ.Oid != colTypes[i].Oid {
+				return nil, moerr.NewInternalErrorNoCtx("column %s of checkpoint batch %d is %s, expected %s",
+					colNames[idx], id, typ.String(), colTypes[i].String())
+			}
+			if err = checkColumn(ioResult.Vecs[i]); err != nil {
+				return nil, moerr.NewInternalErrorNoCtx("column %s of checkpoint batch %d: %v", colNames[idx], id, err)
+			}
+		}
+	}
 	bats := make([]*containers.Batch, 0)
+	loaded := false
+	defer func() {
+		// CloneWindow panics when it cannot allocate, e.g. the rows a
+		// corrupt column claims, the batches cloned before are freed
+		if !loaded {
+			for _, bat := range bats {
+				bat.Close()
+			}
+		}
+	}()
 	for _, ioResult := range ioResults {
 		bat := containers.NewBatch()
+		bats = append(bats, bat)
 		for i, idx := range idxs {
 			pkgVec := ioResult.Vecs[i]
 			var vec containers.Vector
@@ -2130,8 +2227,8 @@ func LoadBlkColumnsByMeta(
 			bat.Vecs[i] = vec
 
 		}
-		bats = append(bats, bat)
 	}
+	loaded = true
 	return bats, nil
 }
 
@@ -2392,7 +2489,9 @@ func LoadCheckpointLocations(
 		return nil, err
 	}
 
-	data.replayMetaBatch(version)
+	if err = data.replayMetaBatch(version); err != nil {
+		return nil, err
+	}
 	return data.locations, nil
 }
 
@@ -2426,7 +2525,9 @@ func LoadSpecifiedCkpBatch(
 		return
 	}
 
-	data.replayMetaBatch(version)
+	if err = data.replayMetaBatch(version); err != nil {
+		return
+	}
 	for _, val := range data.locations {
 		if reader, err = blockio.NewObjectReader(sid, fs, val); err != nil {
 			return
@@ -2469,7 +2570,7 @@ func (data *CheckpointData) readMetaBatch(
 	return
 }
 
-func (data *CheckpointData) replayMetaBatch(version uint32) {
+func (data *CheckpointData) replayMetaBatch(version uint32) error {
 	bat := data.bats[MetaIDX]
 	data.locations = make(map[string]objectio.Location)
 	tidVec := vector.MustFixedCol[uint64](bat.GetVectorByName(SnapshotAttr_TID).GetDownstreamVector())
@@ -2483,11 +2584,32 @@ func (data *CheckpointData) replayMetaBatch(version uint32) {
 		usageInsVec = bat.GetVectorByName(CheckpointMetaAttr_StorageUsageInsLocation).GetDownstreamVector()
 		usageDelVec = bat.GetVectorByName(CheckpointMetaAttr_StorageUsageDelLocation).GetDownstreamVector()
 	}
+	// the columns of a corrupt meta batch may have less rows than the
+	// tids, or locations that are not a whole number of block locations
+	for _, vec := range []*vector.Vector{insVec, delVec, delCNVec, segVec, usageInsVec, usageDelVec} {
+		if vec != nil && vec.Length() < len(tidVec) {
+			return moerr.NewInternalErrorNoCtx("checkpoint meta column of %d rows, expected %d",
+				vec.Length(), len(tidVec))
+		}
+	}
+	getLocations := func(vec *vector.Vector, i int) (BlockLocations, error) {
+		if vec.IsNull(uint64(i)) {
+			return nil, nil
+		}
+		bl := BlockLocations(vec.GetBytesAt(i))
+		if err := validateBlockLocations(bl); err != nil {
+			return nil, moerr.NewInternalErrorNoCtx("checkpoint meta row %d: %v", i, err)
+		}
+		return bl, nil
+	}
 
 	for i := 0; i < len(tidVec); i++ {
 		tid := tidVec[i]
 		if tid == 0 {
-			bl := BlockLocations(insVec.GetBytesAt(i))
+			bl, err := getLocations(insVec, i)
+			if err != nil {
+				return err
+			}
 			it := bl.MakeIterator()
 			for it.HasNext() {
 				block := it.Next()
@@ -2497,15 +2619,17 @@ func (data *CheckpointData) replayMetaBatch(version uint32) {
 			}
 			continue
 		}
-		insLocation := insVec.GetBytesAt(i)
-		delLocation := delVec.GetBytesAt(i)
-		delCNLocation := delCNVec.GetBytesAt(i)
-		segLocation := segVec.GetBytesAt(i)
-
-		tmp := [][]byte{insLocation, delLocation, delCNLocation, segLocation}
+		vecs := []*vector.Vector{insVec, delVec, delCNVec, segVec}
 		if usageInsVec != nil {
-			tmp = append(tmp, usageInsVec.GetBytesAt(i))
-			tmp = append(tmp, usageDelVec.GetBytesAt(i))
+			vecs = append(vecs, usageInsVec, usageDelVec)
+		}
+		tmp := make([][]byte, 0, len(vecs))
+		for _, vec := range vecs {
+			bl, err := getLocations(vec, i)
+			if err != nil {
+				return err
+			}
+			tmp = append(tmp, bl)
 		}
 
 		tableMeta := NewCheckpointMeta()
@@ -2528,6 +2652,7 @@ func (data *CheckpointData) replayMetaBatch(version uint32) {
 			}
 		}
 	}
+	return nil
 }
 
 func (data *CheckpointData) readAll(
@@ -2535,7 +2660,9 @@ func (data *CheckpointData) readAll(
 	version uint32,
 	service fileservice.FileService,
 ) (err error) {
-	data.replayMetaBatch(version)
+	if err = data.replayMetaBatch(version); err != nil {
+		return
+	}
 	checkpointDataSize := uint64(0)
 	readDuration := time.Now()
 	for _, val := range data.locations {
@@ -2724,7 +2851,12 @@ func (data *CheckpointData) ExportStats(prefix string) []zap.Field {
 	return fields
 }
 
+// Close frees the batches of data. It does nothing on a data already
+// closed, or nil.
 func (data *CheckpointData) Close() {
+	if data == nil {
+		return
+	}
 	for idx := range data.bats {
 		if data.bats[idx] != nil {
 			data.bats[idx].Close()